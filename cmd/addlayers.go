@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/nlewo/nix2container/nix"
+	"github.com/nlewo/nix2container/types"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var addLayersCmd = &cobra.Command{
+	Use:   "add-layers OUTPUT-FILENAME IMAGE.JSON LAYERS.JSON...",
+	Short: "Write an image.json file with additional layers on top of an image",
+	Long: `Write an image.json file with additional layers on top of an image.
+
+This allows to build a debug variant of an image at copy time, for
+instance with a layer containing busybox, without a separate image
+build. Layers already part of the image are skipped.`,
+	Args: cobra.MinimumNArgs(3),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := addLayers(args[0], args[1], args[2:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+	},
+}
+
+func addLayers(outputFilename, imageFilename string, layerPaths []string) error {
+	image, err := nix.NewImageFromFile(imageFilename)
+	if err != nil {
+		return err
+	}
+	for _, path := range layerPaths {
+		layers, err := types.NewLayersFromFile(path)
+		if err != nil {
+			return err
+		}
+		logrus.Infof("Adding %d layers from %s", len(layers), path)
+		image = nix.AppendLayers(image, layers)
+	}
+	reportPathDuplicates(image.Layers)
+	res, err := types.MarshalCanonical(image)
+	if err != nil {
+		return err
+	}
+	err = types.WriteFile(outputFilename, res)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Image has been written to %s", outputFilename)
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(addLayersCmd)
+}
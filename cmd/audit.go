@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/nlewo/nix2container/nix"
+	"github.com/nlewo/nix2container/types"
+	"github.com/spf13/cobra"
+)
+
+var permsAuditCmd = &cobra.Command{
+	Use:   "perms-audit LAYERS-1.JSON LAYERS-2.JSON ...",
+	Short: "List the layer entries whose ownership or mode is modified, grouped by rule",
+	Long: `List the layer entries whose ownership or mode is modified, grouped by rule.
+
+Perms rules matching no entries are also listed. No archive is
+produced.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := permsAudit(cmd, args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+	},
+}
+
+func permsAudit(cmd *cobra.Command, layersPaths []string) error {
+	layers, err := getLayersFromFiles(layersPaths)
+	if err != nil {
+		return err
+	}
+	var paths types.Paths
+	for _, layer := range layers {
+		paths = append(paths, layer.Paths...)
+	}
+	audits, err := nix.AuditPaths(cmd.Context(), paths)
+	if err != nil {
+		return err
+	}
+	for _, audit := range audits {
+		fmt.Printf("%s (%d entries)\n", audit.Rule, len(audit.Entries))
+		for _, entry := range audit.Entries {
+			fmt.Printf("  %s: %s\n", entry.Name, entry.Change)
+		}
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(permsAuditCmd)
+}
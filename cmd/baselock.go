@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/nlewo/nix2container/nix"
+	"github.com/nlewo/nix2container/types"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var lockBlobDirectory string
+
+var lockBaseCmd = &cobra.Command{
+	Use:   "lock-base LOCK.JSON NAME DIRECTORY",
+	Short: "Record in a base image lock the digests of an image populated by the Skopeo dir transport",
+	Long: `Record in a base image lock the digests of the manifest, the config and
+the layers of the image NAME, stored in a DIRECTORY populated by the
+Skopeo dir transport. The lock is created if it doesn't exist and the
+image NAME is replaced if it is already locked.
+
+With --blob-directory, the manifest and the blobs of the image are
+copied into a blob directory, which is then used by image-from-lock to
+build without network access.`,
+	Args: cobra.ExactArgs(3),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := lockBase(args[0], args[1], args[2], lockBlobDirectory)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+	},
+}
+
+var imageFromLockCmd = &cobra.Command{
+	Use:   "image-from-lock OUTPUT-FILENAME LOCK.JSON NAME BLOB-DIRECTORY",
+	Short: "Write an image.json file from a base image of a lock and a local blob directory",
+	Long: `Write an image.json file from the base image NAME of a lock. The
+manifest, the config and the layers are read from BLOB-DIRECTORY and
+have to match the digests of the lock: the base image can not drift
+when the upstream tag is moved.`,
+	Args: cobra.ExactArgs(4),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := imageFromLock(args[0], args[1], args[2], args[3])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+	},
+}
+
+func lockBase(lockFilename, name, directory, blobDirectory string) error {
+	lock, err := nix.NewBaseImageLockFromFile(lockFilename)
+	if err != nil {
+		return err
+	}
+	locked, err := nix.LockBaseImage(name, directory, blobDirectory)
+	if err != nil {
+		return err
+	}
+	lock.Set(locked)
+	res, err := types.MarshalCanonical(lock)
+	if err != nil {
+		return err
+	}
+	err = types.WriteFile(lockFilename, res)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("The base image %s has been locked to %s in %s", name, locked.Manifest, lockFilename)
+	return nil
+}
+
+func imageFromLock(outputFilename, lockFilename, name, blobDirectory string) error {
+	lock, err := nix.NewBaseImageLockFromFile(lockFilename)
+	if err != nil {
+		return err
+	}
+	image, err := nix.NewImageFromLock(lock, name, blobDirectory)
+	if err != nil {
+		return err
+	}
+	res, err := types.MarshalCanonical(image)
+	if err != nil {
+		return err
+	}
+	err = types.WriteFile(outputFilename, res)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Image has been written to %s", outputFilename)
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(lockBaseCmd)
+	lockBaseCmd.Flags().StringVarP(&lockBlobDirectory, "blob-directory", "", "", "A directory where the manifest and the blobs of the image are copied")
+	rootCmd.AddCommand(imageFromLockCmd)
+}
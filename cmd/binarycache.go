@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/nlewo/nix2container/nix"
+	"github.com/nlewo/nix2container/types"
+	"github.com/spf13/cobra"
+)
+
+var binaryCacheSecretKeyFile string
+var binaryCacheBlobCache string
+
+var publishBinaryCacheCmd = &cobra.Command{
+	Use:   "publish-binary-cache IMAGE.JSON BINARY-CACHE",
+	Short: "Publish the layer blobs of an image into a Nix binary cache",
+	Long: `Publish the layer blobs of an image as NARs into a Nix binary cache,
+a directory (or a file:// URL), an http(s):// URL accepting PUT
+requests or an s3://BUCKET/PREFIX URL.
+
+Each blob is published as the store path of a fixed-output derivation
+named nix2container-layer, with a flat SHA256 output hash: the hash of
+the layer digest. Builders having the binary cache as substituter can
+then fetch the blobs like any other store path, for instance with
+nix2container.layerBlobFromBinaryCache. Blobs already in the binary
+cache are not uploaded again. The published store paths are written
+as JSON to the standard output.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := publishBinaryCache(cmd, args[0], args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+	},
+}
+
+func publishBinaryCache(cmd *cobra.Command, imageFilename string, location string) error {
+	image, err := nix.NewImageFromFile(imageFilename)
+	if err != nil {
+		return err
+	}
+	cache, err := nix.NewBinaryCache(location)
+	if err != nil {
+		return err
+	}
+	if binaryCacheSecretKeyFile != "" {
+		if err := cache.SetSecretKeyFile(binaryCacheSecretKeyFile); err != nil {
+			return err
+		}
+	}
+	getBlob, err := blobGetter(binaryCacheBlobCache)
+	if err != nil {
+		return err
+	}
+	published, err := cache.Publish(cmd.Context(), image, getBlob)
+	if err != nil {
+		return err
+	}
+	content, err := types.MarshalCanonical(published)
+	if err != nil {
+		return err
+	}
+	return types.WriteFile(types.Stdio, append(content, '\n'))
+}
+
+func init() {
+	rootCmd.AddCommand(publishBinaryCacheCmd)
+	publishBinaryCacheCmd.Flags().StringVarP(&binaryCacheSecretKeyFile, "secret-key-file", "", os.Getenv("NIX2CONTAINER_BINARY_CACHE_SECRET_KEY_FILE"), "The file of the key signing the published store paths, generated by nix-store --generate-binary-cache-key")
+	publishBinaryCacheCmd.Flags().StringVarP(&binaryCacheBlobCache, "blob-cache", "", os.Getenv("NIX2CONTAINER_BLOB_CACHE"), "The blob store where the layers are read or generated")
+}
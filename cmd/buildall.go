@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/nlewo/nix2container/metrics"
+	"github.com/nlewo/nix2container/nix"
+	"github.com/nlewo/nix2container/transport"
+	"github.com/nlewo/nix2container/types"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var buildAllBlobCache string
+var buildAllParallel int
+var buildAllOCILayout string
+var buildAllPush string
+
+var buildAllCmd = &cobra.Command{
+	Use:   "build-all IMAGE.JSON...",
+	Short: "Generate the layers of many images sharing layers in a blob cache",
+	Long: `Generate the layer blobs of many images, such as the images of a
+monorepo, in a blob cache. Layers shared by several images are only
+generated once, the layers used by the most images first.
+
+With --push, the images are then pushed from the blob cache to the
+destination, such as docker://registry.example.com/{name}:v1.2.3,
+where {name} is replaced by the image file name (without the .json
+extension). The digest and the destination of each pushed image are
+written to the standard output. The images can also be pushed later
+with the cache set in the NIX2CONTAINER_BLOB_CACHE environment
+variable, so that Skopeo reads the generated blobs instead of
+generating them again. With --oci-layout, the images are also
+written into an OCI layout, with the image file names as reference
+names.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := buildAll(cmd, args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+	},
+}
+
+func buildAll(cmd *cobra.Command, filenames []string) error {
+	if buildAllBlobCache == "" {
+		return fmt.Errorf("A blob cache is required (--blob-cache or NIX2CONTAINER_BLOB_CACHE)")
+	}
+	if buildAllPush != "" && len(filenames) > 1 && !strings.Contains(buildAllPush, "{name}") {
+		return fmt.Errorf("The destination %s should contain {name} to push several images", buildAllPush)
+	}
+	var images []types.Image
+	for _, filename := range filenames {
+		image, err := nix.NewImageFromFile(filename)
+		if err != nil {
+			return err
+		}
+		images = append(images, image)
+	}
+	cache, err := nix.NewBlobCache(buildAllBlobCache)
+	if err != nil {
+		return err
+	}
+	shared := nix.OrderSharedLayers(images)
+	logrus.Infof("Building %d unique layers of %d images", len(shared), len(images))
+	startBuildStatus(shared)
+	err = nix.BuildSharedLayers(cmd.Context(), shared, cache, buildAllParallel, nix.BuildHooks{
+		Started: func(layer types.Layer) {
+			metrics.StartStatusLayer(layer.Digest)
+		},
+		Done: func(layer types.Layer, err error) {
+			metrics.EndStatusLayer(layer.Digest, err == nil)
+		},
+	})
+	if err != nil {
+		return err
+	}
+	for i, image := range images {
+		refName := strings.TrimSuffix(filepath.Base(filenames[i]), ".json")
+		if buildAllOCILayout != "" {
+			_, err := nix.WriteOCILayoutFromCache(cmd.Context(), cache, image, buildAllOCILayout, refName)
+			if err != nil {
+				return err
+			}
+		}
+		if buildAllPush != "" {
+			if err := pushFromCache(cmd, filenames[i], cache, strings.ReplaceAll(buildAllPush, "{name}", refName)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// pushFromCache pushes the image JSON file to the destination, reading
+// its layer blobs from the cache.
+func pushFromCache(cmd *cobra.Command, filename string, cache *nix.BlobCache, destination string) error {
+	destRef, err := alltransports.ParseImageName(destination)
+	if err != nil {
+		return fmt.Errorf("Invalid destination %s: %w", destination, err)
+	}
+	srcRef, err := transport.NewReferenceWithBlobCache(filename, cache)
+	if err != nil {
+		return err
+	}
+	sys, err := registrySystemContext(copyDestCreds, copyDestTLSVerify)
+	if err != nil {
+		return err
+	}
+	digest, err := copyImageFrom(cmd, srcRef, filename, destRef, sys)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s %s\n", digest, destination)
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(buildAllCmd)
+	buildAllCmd.Flags().StringVarP(&buildAllBlobCache, "blob-cache", "", os.Getenv("NIX2CONTAINER_BLOB_CACHE"), "The blob store where layer blobs are generated, such as a directory (see copy-blobs)")
+	buildAllCmd.Flags().IntVarP(&buildAllParallel, "parallel", "", runtime.NumCPU(), "The number of layers generated at the same time")
+	buildAllCmd.Flags().StringVarP(&buildAllOCILayout, "oci-layout", "", "", "Also write the images into this OCI layout directory")
+	buildAllCmd.Flags().StringVarP(&buildAllPush, "push", "", "", "Push the images to this destination, where {name} is replaced by the image file name")
+	buildAllCmd.Flags().StringVarP(&copyDestCreds, "dest-creds", "", "", "The USERNAME:PASSWORD used to access the registry")
+	buildAllCmd.Flags().BoolVarP(&copyDestTLSVerify, "dest-tls-verify", "", true, "Require HTTPS and verify certificates when talking to the registry")
+	buildAllCmd.Flags().StringVarP(&copyPolicy, "policy", "", "", "The containers-policy.json file checking the signatures (/etc/containers/policy.json by default)")
+	buildAllCmd.Flags().BoolVarP(&copyInsecurePolicy, "insecure-policy", "", false, "Accept any image, without checking signatures")
+}
@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+
+	"github.com/nlewo/nix2container/nix"
+	"github.com/spf13/cobra"
+)
+
+var catCmd = &cobra.Command{
+	Use:   "cat IMAGE.JSON PATH",
+	Short: "Write the content of a file of an image to the standard output",
+	Long: `Write the content of a file of an image to the standard output.
+
+Layers are searched from the top one, honoring whiteouts, and symlinks
+are followed inside the image. Layers built with a file index
+(--file-index-directory) are only read if they contain the file, and
+only the file content is read from uncompressed layer archives. For
+instance:
+
+  nix2container cat image.json /etc/nginx/nginx.conf`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := cat(cmd, args[0], args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+	},
+}
+
+func cat(cmd *cobra.Command, imageFilename, name string) error {
+	image, err := nix.NewImageFromFile(imageFilename)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(os.Stdout)
+	if err := nix.CatFile(cmd.Context(), image, name, w); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func init() {
+	rootCmd.AddCommand(catCmd)
+}
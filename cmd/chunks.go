@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/nlewo/nix2container/nix"
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// This command is experimental and then hidden: the chunk index
+// format can change at any time.
+var chunksPush string
+var chunksDestCreds string
+var chunksDestTLSVerify bool
+
+var chunksCmd = &cobra.Command{
+	Use:   "experimental-chunks IMAGE.JSON DIRECTORY",
+	Short: "Split layers of an image into content-defined chunks (experimental)",
+	Long: `Split the layers of an image into content-defined chunks, written
+into DIRECTORY. With --push, the chunks missing from the repository
+of the destination (such as docker://registry.example.com/blobs) and
+the chunk index of each layer are uploaded. The chunks of a layer are
+referenced by a manifest tagged with the encoded digest of the layer.`,
+	Hidden: true,
+	Args:   cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := chunks(cmd, args[0], args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+	},
+}
+
+// chunks writes chunks of all image layers into directory. For each
+// layer, the chunk index is written to DIRECTORY/LAYER-DIGEST.json.
+func chunks(cmd *cobra.Command, imageFilename, directory string) error {
+	image, err := nix.NewImageFromFile(imageFilename)
+	if err != nil {
+		return err
+	}
+	sys, err := registrySystemContext(chunksDestCreds, chunksDestTLSVerify)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return err
+	}
+	for _, layer := range image.Layers {
+		d, err := godigest.Parse(layer.Digest)
+		if err != nil {
+			return err
+		}
+		reader, _, err := nix.LayerGetBlob(layer)
+		if err != nil {
+			return err
+		}
+		index, err := nix.ChunkBlob(reader, directory)
+		reader.Close()
+		if err != nil {
+			return err
+		}
+		if index.Digest != layer.Digest {
+			return fmt.Errorf("The digest of the layer blob is %s while it should be %s", index.Digest, layer.Digest)
+		}
+		res, err := types.MarshalCanonical(index)
+		if err != nil {
+			return err
+		}
+		indexFilename := filepath.Join(directory, d.Encoded()+".json")
+		err = types.WriteFile(indexFilename, res)
+		if err != nil {
+			return err
+		}
+		logrus.Infof("Layer %s has been split into %d chunks (index: %s)", layer.Digest, len(index.Chunks), indexFilename)
+		if chunksPush != "" {
+			if err := nix.PushChunks(cmd.Context(), sys, chunksPush, directory, index); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(chunksCmd)
+	chunksCmd.Flags().StringVarP(&chunksPush, "push", "", "", "Upload the chunks and the chunk indexes to this destination")
+	chunksCmd.Flags().StringVarP(&chunksDestCreds, "dest-creds", "", "", "The USERNAME:PASSWORD used to access the registry")
+	chunksCmd.Flags().BoolVarP(&chunksDestTLSVerify, "dest-tls-verify", "", true, "Require HTTPS and verify certificates when talking to the registry")
+}
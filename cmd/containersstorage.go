@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	istorage "github.com/containers/image/v5/storage"
+	imageTypes "github.com/containers/image/v5/types"
+	"github.com/containers/storage"
+	"github.com/containers/storage/pkg/unshare"
+	"github.com/spf13/cobra"
+)
+
+var storageDriver string
+var storageRoot string
+var storageRunRoot string
+
+var copyToContainersStorageCmd = &cobra.Command{
+	Use:   "copy-to-containers-storage IMAGE.JSON [containers-storage:]NAME:TAG",
+	Short: "Copy an image into the Podman and Buildah local storage",
+	Long: `Copy an image into the containers storage, the local storage of
+Podman and Buildah, without Skopeo.
+
+The layers are applied by the containers/storage library, with the
+storage configuration of the user (storage.conf), in the user
+namespace of the user when run rootless, as Podman does. The --root,
+--runroot and --storage-driver flags override this configuration.
+
+Signatures are checked as copy-to-registry does: with the --policy
+file, or the system policy (/etc/containers/policy.json) if it is not
+set, unless --insecure-policy is set. The digest of the copied manifest is written to
+the standard output.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := copyToContainersStorage(cmd, args[0], args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+	},
+}
+
+// openStore opens the containers storage configured by the storage
+// configuration of the user and the --root, --runroot and
+// --storage-driver flags.
+func openStore() (storage.Store, error) {
+	// Rootless users can only write their storage from their user
+	// namespace: the command is then run again in this namespace
+	unshare.MaybeReexecUsingUserNamespace(false)
+
+	options, err := storage.DefaultStoreOptionsAutoDetectUID()
+	if err != nil {
+		return nil, err
+	}
+	if storageDriver != "" {
+		options.GraphDriverName = storageDriver
+	}
+	if storageRoot != "" {
+		options.GraphRoot = storageRoot
+	}
+	if storageRunRoot != "" {
+		options.RunRoot = storageRunRoot
+	}
+	store, err := storage.GetStore(options)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open the containers storage %s: %w", options.GraphRoot, err)
+	}
+	return store, nil
+}
+
+// addStorageFlags adds the flags of the containers storage.
+func addStorageFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&storageDriver, "storage-driver", "", "", "The storage driver, such as overlay or vfs")
+	cmd.Flags().StringVarP(&storageRoot, "root", "", "", "The root directory of the storage")
+	cmd.Flags().StringVarP(&storageRunRoot, "runroot", "", "", "The directory of the storage runtime state")
+}
+
+func copyToContainersStorage(cmd *cobra.Command, imageFilename string, destination string) error {
+	store, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer store.Shutdown(false)
+
+	destRef, err := istorage.Transport.ParseStoreReference(store, strings.TrimPrefix(destination, "containers-storage:"))
+	if err != nil {
+		return fmt.Errorf("Invalid destination %s: %w", destination, err)
+	}
+	digest, err := copyImage(cmd, imageFilename, destRef, &imageTypes.SystemContext{})
+	if err != nil {
+		return err
+	}
+	fmt.Println(digest.String())
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(copyToContainersStorageCmd)
+	addStorageFlags(copyToContainersStorageCmd)
+	addCopyFlags(copyToContainersStorageCmd)
+}
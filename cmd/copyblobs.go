@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/nlewo/nix2container/nix"
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+	"github.com/spf13/cobra"
+)
+
+var copyBlobsBlobCache string
+
+var copyBlobsCmd = &cobra.Command{
+	Use:   "copy-blobs IMAGE.JSON BLOB-STORE",
+	Short: "Copy the blobs of an image into a blob store",
+	Long: `Copy the config blob and the layer blobs of an image into a blob
+store, such as an S3 bucket shared by builders or a registry
+repository to prefill. Blobs already in the store are not copied
+again. The digests of the copied blobs are written as JSON to the
+standard output.
+
+Blob stores are also accepted by all the commands reading or writing
+blobs, such as --blob-cache and NIX2CONTAINER_BLOB_CACHE:
+
+  DIRECTORY, file://DIRECTORY  blobs in DIRECTORY/ALGORITHM/ENCODED
+  oci:DIRECTORY                the blobs of an OCI image layout
+  http(s)://URL                a server accepting GET, HEAD and PUT
+                               requests (NIX2CONTAINER_DIGEST_CACHE_TOKEN
+                               is sent as bearer token)
+  s3://BUCKET/PREFIX           an S3 bucket (AWS_* environment variables)
+  docker://REGISTRY/REPOSITORY a registry repository
+  containerd://NAMESPACE       the containerd content store, through ctr
+                               (or NIX2CONTAINER_CTR)`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := copyBlobs(cmd, args[0], args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+	},
+}
+
+func copyBlobs(cmd *cobra.Command, imageFilename string, location string) error {
+	image, err := nix.NewImageFromFile(imageFilename)
+	if err != nil {
+		return err
+	}
+	store, err := nix.NewBlobStore(location)
+	if err != nil {
+		return err
+	}
+	getBlob, err := blobGetter(copyBlobsBlobCache)
+	if err != nil {
+		return err
+	}
+	copied, err := nix.CopyBlobs(cmd.Context(), image, store, getBlob)
+	if err != nil {
+		return err
+	}
+	content, err := types.MarshalCanonical(copied)
+	if err != nil {
+		return err
+	}
+	return types.WriteFile(types.Stdio, append(content, '\n'))
+}
+
+// blobGetter returns the function reading the blobs of images: the
+// layers are read (or generated) in the blob cache if it is set.
+func blobGetter(blobCache string) (nix.BlobGetter, error) {
+	if blobCache == "" {
+		return func(ctx context.Context, image types.Image, digest godigest.Digest) (io.ReadCloser, int64, error) {
+			return nix.GetBlob(image, digest)
+		}, nil
+	}
+	cache, err := nix.NewBlobCache(blobCache)
+	if err != nil {
+		return nil, err
+	}
+	return cache.GetBlob, nil
+}
+
+func init() {
+	rootCmd.AddCommand(copyBlobsCmd)
+	copyBlobsCmd.Flags().StringVarP(&copyBlobsBlobCache, "blob-cache", "", os.Getenv("NIX2CONTAINER_BLOB_CACHE"), "The blob store where the layers are read or generated")
+}
@@ -0,0 +1,184 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/transports"
+	"github.com/containers/image/v5/transports/alltransports"
+	imageTypes "github.com/containers/image/v5/types"
+	"github.com/nlewo/nix2container/metrics"
+	"github.com/nlewo/nix2container/nix"
+	"github.com/nlewo/nix2container/transport"
+	godigest "github.com/opencontainers/go-digest"
+	"github.com/spf13/cobra"
+)
+
+var copyDestCreds string
+var copyDestTLSVerify bool
+var copyDestAuthFile string
+var copyDestCertDir string
+var copyDigestFile string
+var copyPolicy string
+var copyInsecurePolicy bool
+var copyRegistriesDir string
+var copySignBy string
+var copyQuiet bool
+
+var copyToRegistryCmd = &cobra.Command{
+	Use:   "copy-to-registry IMAGE.JSON DESTINATION",
+	Short: "Push an image to a registry",
+	Long: `Push an image to a registry, without Skopeo.
+
+The image JSON file (or index JSON file) is copied to the DESTINATION,
+such as docker://registry.example.com/app:v1.2.3, through the nix
+transport. The progress of the blobs is written to the standard error
+and the digest of the pushed manifest to the standard output. The
+destination can have several tags, such as
+docker://registry/app:v1.2.3,:v1.2,:latest: the image is pushed with
+the first tag and its manifest is then put for the other ones.
+
+The credentials are read from --dest-creds or, as with Skopeo, from
+the containers auth files (such as $REGISTRY_AUTH_FILE or
+~/.docker/config.json). To registries, layers are uploaded in chunks
+with bearer tokens refreshed during the upload, so that the push of
+huge layers doesn't fail once a token has expired. The flags follow the ones of "skopeo copy", so
+that copy scripts can use both.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := copyToRegistry(cmd, args[0], args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+	},
+}
+
+func copyToRegistry(cmd *cobra.Command, imageFilename string, destination string) error {
+	first, tags, err := nix.ParseDestinationTags(destination)
+	if err != nil {
+		return err
+	}
+	destRef, err := alltransports.ParseImageName(first)
+	if err != nil {
+		return fmt.Errorf("Invalid destination %s: %w", first, err)
+	}
+	sys, err := registrySystemContext(copyDestCreds, copyDestTLSVerify)
+	if err != nil {
+		return err
+	}
+	sys.AuthFilePath = copyDestAuthFile
+	sys.DockerCertPath = copyDestCertDir
+	digest, err := copyImage(cmd, imageFilename, destRef, sys)
+	if err != nil {
+		return err
+	}
+	if len(tags) > 0 {
+		if err := nix.TagImage(cmd.Context(), sys, first, tags); err != nil {
+			return err
+		}
+	}
+	fmt.Println(digest.String())
+	return nil
+}
+
+// copyImage copies the image JSON file to destRef, according to the
+// signature policy flags, and writes the digest of the copied manifest
+// to the --digestfile.
+func copyImage(cmd *cobra.Command, imageFilename string, destRef imageTypes.ImageReference, sys *imageTypes.SystemContext) (digest godigest.Digest, err error) {
+	srcRef, err := transport.NewReference(imageFilename)
+	if err != nil {
+		return digest, err
+	}
+	return copyImageFrom(cmd, srcRef, imageFilename, destRef, sys)
+}
+
+// copyImageFrom is like copyImage but the image is read from srcRef,
+// a reference of the image JSON file imageFilename.
+func copyImageFrom(cmd *cobra.Command, srcRef imageTypes.ImageReference, imageFilename string, destRef imageTypes.ImageReference, sys *imageTypes.SystemContext) (digest godigest.Digest, err error) {
+	sys.RegistriesDirPath = copyRegistriesDir
+	ctx, span := metrics.StartSpan(cmd.Context(), "copy", "copy.destination", transports.ImageName(destRef))
+	defer func() { span.End(err) }()
+	if metrics.StatusEnabled() {
+		image, err := nix.NewImageFromFile(imageFilename)
+		if err != nil {
+			return digest, err
+		}
+		startPushStatus(image)
+	}
+
+	var policy *signature.Policy
+	switch {
+	case copyInsecurePolicy:
+		policy = &signature.Policy{Default: []signature.PolicyRequirement{signature.NewPRInsecureAcceptAnything()}}
+	case copyPolicy != "":
+		policy, err = signature.NewPolicyFromFile(copyPolicy)
+	default:
+		policy, err = signature.DefaultPolicy(sys)
+	}
+	if err != nil {
+		return digest, err
+	}
+	policyContext, err := signature.NewPolicyContext(policy)
+	if err != nil {
+		return digest, err
+	}
+	defer policyContext.Destroy()
+
+	// The layers are uploaded first with refreshed tokens, and then
+	// reused by the copy
+	if err := transport.UploadLayers(ctx, srcRef, destRef, sys, policyContext); err != nil {
+		return digest, err
+	}
+	var report io.Writer = os.Stderr
+	if copyQuiet {
+		report = ioutil.Discard
+	}
+	copied, err := copy.Image(ctx, policyContext, destRef, srcRef, &copy.Options{
+		ReportWriter:   report,
+		DestinationCtx: sys,
+		SignBy:         copySignBy,
+	})
+	if err != nil {
+		if errors.As(err, &docker.ErrUnauthorizedForCredentials{}) {
+			return digest, fmt.Errorf("Could not copy the image %s to %s: %s: %w", imageFilename, transports.ImageName(destRef), err, nix.ErrAuth)
+		}
+		return digest, err
+	}
+	digest, err = manifest.Digest(copied)
+	if err != nil {
+		return digest, err
+	}
+	if copyDigestFile != "" {
+		if err := ioutil.WriteFile(copyDigestFile, []byte(digest.String()), 0644); err != nil {
+			return digest, err
+		}
+	}
+	return digest, nil
+}
+
+// addCopyFlags adds the flags of the copy commands.
+func addCopyFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&copyDigestFile, "digestfile", "", "", "Write the digest of the copied manifest to this file")
+	cmd.Flags().StringVarP(&copyPolicy, "policy", "", "", "The containers-policy.json file checking the signatures (/etc/containers/policy.json by default)")
+	cmd.Flags().BoolVarP(&copyInsecurePolicy, "insecure-policy", "", false, "Accept any image, without checking signatures")
+	cmd.Flags().StringVarP(&copyRegistriesDir, "registries.d", "", "", "The directory configuring where signatures are looked up and stored")
+	cmd.Flags().StringVarP(&copySignBy, "sign-by", "", "", "Sign the image with the GPG key of this fingerprint (not supported when built with the containers_image_openpgp tag, as by default.nix)")
+	cmd.Flags().BoolVarP(&copyQuiet, "quiet", "q", false, "Don't write the progress of the copy")
+}
+
+func init() {
+	rootCmd.AddCommand(copyToRegistryCmd)
+	copyToRegistryCmd.Flags().StringVarP(&copyDestCreds, "dest-creds", "", "", "The USERNAME:PASSWORD used to access the registry")
+	copyToRegistryCmd.Flags().BoolVarP(&copyDestTLSVerify, "dest-tls-verify", "", true, "Require HTTPS and verify certificates when talking to the registry")
+	copyToRegistryCmd.Flags().StringVarP(&copyDestAuthFile, "dest-authfile", "", "", "The auth file of the registry credentials ($REGISTRY_AUTH_FILE or the containers auth files by default)")
+	copyToRegistryCmd.Flags().StringVarP(&copyDestCertDir, "dest-cert-dir", "", "", "The directory of the certificates (*.crt, *.cert and *.key) used to talk to the registry")
+	addCopyFlags(copyToRegistryCmd)
+}
@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/nlewo/nix2container/cri"
+	"github.com/spf13/cobra"
+)
+
+var criAddress string
+var criImages string
+var criPolicy string
+
+var criShimCmd = &cobra.Command{
+	Use:   "cri-shim",
+	Short: "Serve the CRI ImageService backed by image JSON files",
+	Long: `Serve the CRI ImageService (ListImages, ImageStatus, PullImage,
+RemoveImage and ImageFsInfo) on --address, a Unix socket (unix:PATH)
+only accessible to the user running the shim (mode 0600), so that
+kubelets run Nix-built images without any registry.
+
+The --images file is a JSON object mapping the names of the images,
+such as registry.example.com/app:1.0, to their image JSON files. A
+pulled image is copied from its JSON file into the containers storage
+(configured as copy-to-containers-storage does), where the runtime
+creates its containers from: the runtime has to share this storage,
+as CRI-O does. The kubelet is then configured with the shim as image
+service endpoint (--image-service-endpoint) and CRI-O as runtime
+endpoint.
+
+Messages are encoded in protobuf, with the CRI versions v1 and
+v1alpha2. The credentials of the pull requests are ignored.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		err := runCRIShim(cmd)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+	},
+}
+
+func runCRIShim(cmd *cobra.Command) error {
+	if criAddress == "" {
+		return fmt.Errorf("An address is required (--address)")
+	}
+	store, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer store.Shutdown(false)
+	server, err := cri.NewServer(store, cri.Options{
+		Images: criImages,
+		Policy: criPolicy,
+	})
+	if err != nil {
+		return err
+	}
+	return cri.Serve(cmd.Context(), server, criAddress)
+}
+
+func init() {
+	rootCmd.AddCommand(criShimCmd)
+	criShimCmd.Flags().StringVarP(&criAddress, "address", "", "", "The address of the shim, a Unix socket (unix:PATH)")
+	criShimCmd.Flags().StringVarP(&criImages, "images", "", "", "The JSON file mapping the names of the images to their image JSON files")
+	criShimCmd.Flags().StringVarP(&criPolicy, "policy", "", "", "The signature policy file of the pulled images (all images are accepted by default)")
+	addStorageFlags(criShimCmd)
+}
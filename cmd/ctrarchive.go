@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/nlewo/nix2container/nix"
+	"github.com/nlewo/nix2container/types"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var ctrArchiveNames []string
+var ctrArchiveVariant string
+
+var ctrArchiveCmd = &cobra.Command{
+	Use:   "ctr-archive IMAGE.JSON OUTPUT.TAR",
+	Short: "Write an image into an OCI archive, importable with ctr images import",
+	Long: `Write an image into an OCI archive, importable with
+"ctr images import" and "nerdctl load", for instance into the
+containerd of a Colima or Lima VM on macOS, without Docker:
+
+  nix2container ctr-archive image.json - --name app:v1 | colima ssh -- sudo ctr images import -
+
+The entries of the archive index are labeled with the containerd image
+names (such as docker.io/library/app:v1) and the platform of the image,
+so that ctr creates the images with these names and unpacks them for
+the platform of the VM. The snapshotter is chosen at import time, for
+instance with "ctr images import --snapshotter".`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		image, err := nix.NewImageFromFile(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+		err = ctrArchive(cmd, image, args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+	},
+}
+
+func ctrArchive(cmd *cobra.Command, image types.Image, outputFilename string) error {
+	var w io.WriteCloser = os.Stdout
+	if outputFilename != types.Stdio {
+		f, err := os.Create(outputFilename)
+		if err != nil {
+			return err
+		}
+		w = f
+	}
+	err := nix.WriteCtrArchive(cmd.Context(), image, w, ctrArchiveNames, ctrArchiveVariant)
+	if outputFilename != types.Stdio {
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		if outputFilename != types.Stdio {
+			os.Remove(outputFilename)
+		}
+		return err
+	}
+	logrus.Infof("Image has been written to the OCI archive %s", outputFilename)
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(ctrArchiveCmd)
+	ctrArchiveCmd.Flags().StringArrayVarP(&ctrArchiveNames, "name", "", nil, "The NAME:TAG of the image in the archive (can be repeated)")
+	ctrArchiveCmd.Flags().StringVarP(&ctrArchiveVariant, "variant", "", "", "The CPU variant of the platform of the image, such as v8 for arm64")
+}
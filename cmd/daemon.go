@@ -0,0 +1,182 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/nlewo/nix2container/daemon"
+	"github.com/nlewo/nix2container/nix"
+	"github.com/nlewo/nix2container/types"
+	"github.com/spf13/cobra"
+)
+
+var daemonAddress string
+var daemonBlobCache string
+var daemonParallel int
+var daemonPolicy string
+var daemonInsecurePolicy bool
+var daemonDestCreds string
+var daemonCompressionCommand string
+
+var daemonCmd = &cobra.Command{
+	Use:   "daemon",
+	Short: "Serve a gRPC API building and pushing images",
+	Long: `Run nix2container as a long-lived daemon serving the gRPC service
+nix2container.Builder (BuildImage, PushImage and GetLayerStatus) on
+--address, a Unix socket (unix:PATH). Since the API is not
+authenticated and pushes images with the credentials of the clients,
+it is not served on the network: the socket is only accessible to the
+user running the daemon (mode 0600).
+
+The daemon keeps its caches warm between jobs: layers are generated
+once in the blob cache and image JSON files are only parsed again
+when they change. Messages are encoded in JSON: clients have to use
+the "json" content subtype, as the daemon-build, daemon-push and
+daemon-layer-status commands do.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		err := runDaemon(cmd)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+	},
+}
+
+func runDaemon(cmd *cobra.Command) error {
+	if daemonAddress == "" {
+		return fmt.Errorf("An address is required (--address or NIX2CONTAINER_DAEMON)")
+	}
+	if daemonBlobCache == "" {
+		return fmt.Errorf("A blob cache is required (--blob-cache or NIX2CONTAINER_BLOB_CACHE)")
+	}
+	server, err := daemon.NewServer(daemon.Options{
+		BlobCache:          daemonBlobCache,
+		Parallel:           daemonParallel,
+		Policy:             daemonPolicy,
+		InsecurePolicy:     daemonInsecurePolicy,
+		CompressionCommand: strings.Fields(daemonCompressionCommand),
+	})
+	if err != nil {
+		return err
+	}
+	return daemon.Serve(cmd.Context(), server, daemonAddress)
+}
+
+var daemonBuildCmd = &cobra.Command{
+	Use:   "daemon-build IMAGE.JSON...",
+	Short: "Build the layers of images with the daemon",
+	Long: `Ask the daemon to generate the layers of the images in its blob
+cache, and write the status of the layers as JSON to the standard
+output.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := daemonCall(cmd, func(client *daemon.Client) (interface{}, error) {
+			images, err := absPaths(args)
+			if err != nil {
+				return nil, err
+			}
+			return client.BuildImage(cmd.Context(), &daemon.BuildImageRequest{Images: images})
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+	},
+}
+
+var daemonPushCmd = &cobra.Command{
+	Use:   "daemon-push IMAGE.JSON DESTINATION",
+	Short: "Push an image with the daemon",
+	Long: `Ask the daemon to build the layers of the image and to copy it to
+the destination, such as docker://registry.example.com/app:tag. The
+digest of the pushed manifest is written as JSON to the standard
+output.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := daemonCall(cmd, func(client *daemon.Client) (interface{}, error) {
+			image, err := filepath.Abs(args[0])
+			if err != nil {
+				return nil, err
+			}
+			return client.PushImage(cmd.Context(), &daemon.PushImageRequest{
+				Image:       image,
+				Destination: args[1],
+				Credentials: daemonDestCreds,
+			})
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+	},
+}
+
+var daemonLayerStatusCmd = &cobra.Command{
+	Use:   "daemon-layer-status DIGEST",
+	Short: "Show the status of a layer built by the daemon",
+	Long: `Write the status of the layer (unknown, building, built or failed)
+as JSON to the standard output.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := daemonCall(cmd, func(client *daemon.Client) (interface{}, error) {
+			return client.GetLayerStatus(cmd.Context(), &daemon.GetLayerStatusRequest{Digest: args[0]})
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+	},
+}
+
+// daemonCall calls the daemon with call and writes its response as
+// JSON to the standard output.
+func daemonCall(cmd *cobra.Command, call func(client *daemon.Client) (interface{}, error)) error {
+	if daemonAddress == "" {
+		return fmt.Errorf("An address is required (--address or NIX2CONTAINER_DAEMON)")
+	}
+	client, err := daemon.Dial(daemonAddress)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	resp, err := call(client)
+	if err != nil {
+		return err
+	}
+	content, err := types.MarshalCanonical(resp)
+	if err != nil {
+		return err
+	}
+	return types.WriteFile(types.Stdio, append(content, '\n'))
+}
+
+// absPaths returns the absolute paths of the files, since the daemon
+// doesn't run in the directory of the client.
+func absPaths(filenames []string) ([]string, error) {
+	var paths []string
+	for _, filename := range filenames {
+		path, err := filepath.Abs(filename)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+func init() {
+	for _, cmd := range []*cobra.Command{daemonCmd, daemonBuildCmd, daemonPushCmd, daemonLayerStatusCmd} {
+		rootCmd.AddCommand(cmd)
+		cmd.Flags().StringVarP(&daemonAddress, "address", "", os.Getenv("NIX2CONTAINER_DAEMON"), "The address of the daemon, a Unix socket (unix:PATH)")
+	}
+	daemonCmd.Flags().StringVarP(&daemonBlobCache, "blob-cache", "", os.Getenv("NIX2CONTAINER_BLOB_CACHE"), "The blob store where the layer blobs are generated, such as a directory (see copy-blobs)")
+	daemonCmd.Flags().IntVarP(&daemonParallel, "parallel", "", runtime.NumCPU(), "The number of layers generated at the same time")
+	daemonCmd.Flags().StringVarP(&daemonPolicy, "policy", "", "", "The signature policy file of the push destinations (/etc/containers/policy.json by default)")
+	daemonCmd.Flags().BoolVarP(&daemonInsecurePolicy, "insecure-policy", "", false, "Accept any image pushed, without checking signatures")
+	daemonCmd.Flags().StringVarP(&daemonCompressionCommand, "compression-command", "", os.Getenv(nix.CompressionCommandEnv), "The command generating the blobs of the layers compressed by a command (see layers-from-reproducible-storepaths --compression-command)")
+	daemonPushCmd.Flags().StringVarP(&daemonDestCreds, "dest-creds", "", "", "The credentials of the destination registry (USERNAME:PASSWORD)")
+}
@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/nlewo/nix2container/nix"
+	"github.com/spf13/cobra"
+)
+
+var diffCreds string
+var diffTLSVerify bool
+
+var diffCmd = &cobra.Command{
+	Use:   "diff IMAGE.JSON DESTINATION",
+	Short: "Report the layers of an image which are not part of a registry image",
+	Long: `Report the layers of an image which are not part of a registry image.
+
+The manifest of the DESTINATION (such as docker://registry/app:prod) is
+read to list the local layers which are new and the ones which are
+already present remotely, with the estimated upload size, before
+actually pushing the image. For instance:
+
+  nix2container diff image.json docker://registry/app:prod`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := diff(cmd, args[0], args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+	},
+}
+
+func diff(cmd *cobra.Command, imageFilename, destination string) error {
+	image, err := nix.NewImageFromFile(imageFilename)
+	if err != nil {
+		return err
+	}
+	sys, err := registrySystemContext(diffCreds, diffTLSVerify)
+	if err != nil {
+		return err
+	}
+	remote, err := nix.GetRemoteManifest(cmd.Context(), sys, image, destination)
+	if err != nil {
+		return err
+	}
+	d, err := nix.DiffImage(image, remote)
+	if err != nil {
+		return err
+	}
+	for _, layer := range d.Layers {
+		status := "new"
+		if layer.Present {
+			status = "present"
+		}
+		fmt.Printf("%s\t%s\t%s\n", status, layer.Digest, nix.FormatByteSize(layer.Size))
+	}
+	fmt.Printf("%d new layers, %d already present, %s to upload\n", d.NewLayers(), len(d.Layers)-d.NewLayers(), nix.FormatByteSize(d.UploadSize))
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(diffCmd)
+	diffCmd.Flags().StringVarP(&diffCreds, "creds", "", "", "The USERNAME:PASSWORD used to access the registry")
+	diffCmd.Flags().BoolVarP(&diffTLSVerify, "tls-verify", "", true, "Require HTTPS and verify certificates when talking to the registry")
+}
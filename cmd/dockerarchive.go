@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/nlewo/nix2container/nix"
+	"github.com/nlewo/nix2container/types"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var dockerArchiveTags []string
+
+var dockerArchiveCmd = &cobra.Command{
+	Use:   "docker-archive IMAGE.JSON OUTPUT.TAR",
+	Short: "Write an image into a docker-archive, loadable with docker load",
+	Long: `Write an image into a docker-archive, the format of "docker save",
+loadable with "docker load". The archive also contains the legacy V1
+layer directories and the repositories file, for old Docker daemons
+and tools parsing the archive directly.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		image, err := nix.NewImageFromFile(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+		err = dockerArchive(cmd, image, args[1], dockerArchiveTags)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+	},
+}
+
+func dockerArchive(cmd *cobra.Command, image types.Image, outputFilename string, tags []string) error {
+	var w io.WriteCloser = os.Stdout
+	if outputFilename != types.Stdio {
+		f, err := os.Create(outputFilename)
+		if err != nil {
+			return err
+		}
+		w = f
+	}
+	err := nix.WriteDockerArchive(cmd.Context(), image, w, tags)
+	if outputFilename != types.Stdio {
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		if outputFilename != types.Stdio {
+			os.Remove(outputFilename)
+		}
+		return err
+	}
+	logrus.Infof("Image has been written to the docker-archive %s", outputFilename)
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(dockerArchiveCmd)
+	dockerArchiveCmd.Flags().StringArrayVarP(&dockerArchiveTags, "tag", "", nil, "The NAME:TAG of the image in the archive (can be repeated)")
+}
@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+
+	"github.com/nlewo/nix2container/nix"
+	"github.com/sirupsen/logrus"
+)
+
+// Exit codes of the commands, allowing scripts to branch on the
+// class of the failure.
+const (
+	exitFailure         = 1
+	exitConflict        = 3
+	exitAuth            = 4
+	exitBlobMissing     = 5
+	exitDigestMismatch  = 6
+	exitNotReproducible = 7
+)
+
+// exitCode returns the exit code corresponding to the class of err.
+func exitCode(err error) int {
+	switch {
+	case errors.Is(err, nix.ErrConflict):
+		return exitConflict
+	case errors.Is(err, nix.ErrAuth):
+		return exitAuth
+	case errors.Is(err, nix.ErrBlobMissing):
+		return exitBlobMissing
+	case errors.Is(err, nix.ErrDigestMismatch):
+		return exitDigestMismatch
+	case errors.Is(err, nix.ErrNotReproducible):
+		return exitNotReproducible
+	default:
+		return exitFailure
+	}
+}
+
+// fail exits with the code corresponding to the class of err, once the
+// status, if it is served, has been finished as failed and the metrics
+// and trace files have been written: commands exit from their Run
+// function, so neither PersistentPostRun nor the end of Execute are
+// run on failures.
+func fail(err error) {
+	finishStatus(err)
+	if err := writeMetrics(err); err != nil {
+		logrus.Errorf("%s", err)
+	}
+	os.Exit(exitCode(err))
+}
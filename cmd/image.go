@@ -3,8 +3,9 @@ package cmd
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"os"
+	"regexp"
+	"time"
 
 	"github.com/nlewo/nix2container/nix"
 	"github.com/nlewo/nix2container/types"
@@ -14,16 +15,37 @@ import (
 )
 
 var fromImageFilename string
+var entrypointWrapperFilename string
+var architecture string
+var operatingSystem string
+var maxImageSize string
+var maxLayerSize string
+var configInheritance map[string]string
+var secretsPolicy string
+var secretsAllow []string
+var provenanceFilename string
+var subjectFilename string
+var subjectImageFilename string
+var rebuildFilename string
+var created string
+var osVersion string
+var osFeatures []string
+var checkEntrypoint bool
+var checkLinkage bool
+var inlineFilesFilename string
+var historyFilename string
+var configHistory bool
+var hoistDuplicates bool
 
 var imageCmd = &cobra.Command{
 	Use:   "image OUTPUT-FILENAME CONFIG.JSON LAYERS-1.JSON LAYERS-2.JSON ...",
 	Short: "Generate an image.json file from a image configuration and layers",
 	Args:  cobra.MinimumNArgs(3),
 	Run: func(cmd *cobra.Command, args []string) {
-		err := image(args[0], args[1], fromImageFilename, args[2:])
+		err := image(cmd, args[0], args[1], fromImageFilename, entrypointWrapperFilename, args[2:])
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "%s", err)
-			os.Exit(1)
+			fail(err)
 		}
 	},
 }
@@ -36,7 +58,7 @@ var imageFromDirCmd = &cobra.Command{
 		err := imageFromDir(args[0], args[1])
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "%s", err)
-			os.Exit(1)
+			fail(err)
 		}
 	},
 }
@@ -46,11 +68,11 @@ func imageFromDir(outputFilename, directory string) error {
 	if err != nil {
 		return err
 	}
-	res, err := json.MarshalIndent(image, "", "\t")
+	res, err := types.MarshalCanonical(image)
 	if err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(outputFilename, []byte(res), 0666)
+	err = types.WriteFile(outputFilename, []byte(res))
 	if err != nil {
 		return err
 	}
@@ -58,12 +80,13 @@ func imageFromDir(outputFilename, directory string) error {
 	return nil
 }
 
-func image(outputFilename, imageConfigPath string, fromImageFilename string, layerPaths []string) error{
+func image(cmd *cobra.Command, outputFilename, imageConfigPath string, fromImageFilename string, entrypointWrapperFilename string, layerPaths []string) error{
 	var imageConfig v1.ImageConfig
 	var image types.Image
+	imageArchitecture, imageOS := architecture, operatingSystem
 
 	logrus.Infof("Getting image configuration from %s", imageConfigPath)
-	imageConfigJson, err := ioutil.ReadFile(imageConfigPath)
+	imageConfigJson, err := types.ReadFile(imageConfigPath)
 	if err != nil {
 		return err
 	}
@@ -81,29 +104,217 @@ func image(outputFilename, imageConfigPath string, fromImageFilename string, lay
 			image.Layers = append(image.Layers, layer)
 		}
 		logrus.Infof("Using base image %s containing %d layers", fromImageFilename, len(fromImage.Layers))
+		// The platform is inherited from the base image, which
+		// can be another nix2container image
+		if imageArchitecture == "" {
+			imageArchitecture = fromImage.Architecture
+		}
+		if imageOS == "" {
+			imageOS = fromImage.OS
+		}
+		// The fields of Windows base images which are not
+		// supported by nix2container are preserved
+		if imageOS == "windows" && fromImage.OS == "windows" {
+			image.OSVersion = fromImage.OSVersion
+			image.OSFeatures = fromImage.OSFeatures
+			image.ExtraConfig = fromImage.ExtraConfig
+		}
+		imageConfig, err = nix.InheritImageConfig(fromImage.ImageConfig, imageConfig, configInheritance)
+		if err != nil {
+			return err
+		}
+	} else if err := nix.ValidateConfigInheritance(configInheritance); err != nil {
+		return err
 	}
 
+	image.Version = types.ImageVersion
 	image.ImageConfig = imageConfig
-	for _, path := range layerPaths {
-		var layers []types.Layer
-		layerJson, err := ioutil.ReadFile(path)
+	image.Architecture = imageArchitecture
+	image.OS = imageOS
+	extraConfig, err := nix.ExtraConfigFromJSON(imageConfigJson)
+	if err != nil {
+		return err
+	}
+	for name, value := range extraConfig {
+		if image.ExtraConfig == nil {
+			image.ExtraConfig = make(map[string]json.RawMessage)
+		}
+		image.ExtraConfig[name] = value
+	}
+	if osVersion != "" {
+		image.OSVersion = osVersion
+	}
+	if len(osFeatures) > 0 {
+		image.OSFeatures = osFeatures
+	}
+	if created != "" {
+		if _, err := time.Parse(time.RFC3339, created); err != nil {
+			return fmt.Errorf("Invalid created date %q: %w", created, err)
+		}
+		image.Created = created
+	}
+	if historyFilename != "" {
+		historyJson, err := types.ReadFile(historyFilename)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(historyJson, &image.History); err != nil {
+			return fmt.Errorf("Could not parse the history %s: %w", historyFilename, err)
+		}
+	}
+	if configHistory {
+		image.History = append(image.History, nix.ConfigHistory(image.ImageConfig)...)
+	}
+	if provenanceFilename != "" {
+		var provenance types.Provenance
+		provenanceJson, err := types.ReadFile(provenanceFilename)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(provenanceJson, &provenance)
+		if err != nil {
+			return err
+		}
+		image.Provenance = &provenance
+	}
+	if subjectFilename != "" {
+		var subject v1.Descriptor
+		subjectJson, err := types.ReadFile(subjectFilename)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(subjectJson, &subject)
+		if err != nil {
+			return err
+		}
+		if err := subject.Digest.Validate(); err != nil {
+			return fmt.Errorf("Invalid subject digest %q: %w", subject.Digest, err)
+		}
+		image.Subject = &subject
+	}
+	if subjectImageFilename != "" {
+		subjectImage, err := nix.NewImageFromFile(subjectImageFilename)
 		if err != nil {
 			return err
 		}
-		err = json.Unmarshal(layerJson, &layers)
+		subject, err := nix.GetManifestDescriptor(subjectImage)
+		if err != nil {
+			return err
+		}
+		image.Subject = &subject
+	}
+	if rebuildFilename != "" {
+		var rebuild types.RebuildInstructions
+		rebuildJson, err := types.ReadFile(rebuildFilename)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(rebuildJson, &rebuild)
+		if err != nil {
+			return err
+		}
+		err = nix.SetRebuildLabel(&image.ImageConfig, rebuild)
+		if err != nil {
+			return err
+		}
+	}
+	baseLayers := len(image.Layers)
+	for _, path := range layerPaths {
+		layers, err := types.NewLayersFromFile(path)
 		if err != nil {
 			return err
 		}
 		logrus.Infof("Adding %d layers from %s", len(layers), path)
-		for _, layer := range layers {
-			image.Layers = append(image.Layers, layer)
+		// Layers shared with the base image, such as layers
+		// built once and used by a hierarchy of images, are
+		// only added once
+		image = nix.AppendLayers(image, layers)
+	}
+	// The layers of the base image stay below the layers of the
+	// image
+	ordered, err := nix.OrderLayers(cmd.Context(), image.Layers[baseLayers:])
+	if err != nil {
+		return err
+	}
+	image.Layers = append(image.Layers[:baseLayers], ordered...)
+	if inlineFilesFilename != "" {
+		var files []types.File
+		filesJson, err := types.ReadFile(inlineFilesFilename)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(filesJson, &files)
+		if err != nil {
+			return err
+		}
+		layer, err := nix.NewLayerFromFiles(cmd.Context(), files)
+		if err != nil {
+			return err
+		}
+		image.Layers = append(image.Layers, layer)
+	}
+	if entrypointWrapperFilename != "" {
+		var wrapper types.EntrypointWrapper
+		wrapperJson, err := types.ReadFile(entrypointWrapperFilename)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(wrapperJson, &wrapper)
+		if err != nil {
+			return err
+		}
+		layer, entrypoint, err := nix.NewEntrypointWrapperLayer(cmd.Context(), wrapper, image.ImageConfig.Entrypoint)
+		if err != nil {
+			return err
+		}
+		logrus.Infof("Wrapping the entrypoint with the script %s", entrypoint[0])
+		image.Layers = append(image.Layers, layer)
+		image.ImageConfig.Entrypoint = entrypoint
+	}
+	if hoistDuplicates {
+		image.Layers, err = nix.HoistPathDuplicates(cmd.Context(), image.Layers)
+		if err != nil {
+			return err
+		}
+	}
+	reportPathDuplicates(image.Layers)
+	budget, err := sizeBudget(maxImageSize, maxLayerSize)
+	if err != nil {
+		return err
+	}
+	err = nix.CheckSizeBudget(image, budget)
+	if err != nil {
+		return err
+	}
+	var allowed []*regexp.Regexp
+	for _, a := range secretsAllow {
+		re, err := regexp.Compile(a)
+		if err != nil {
+			return fmt.Errorf("Invalid --secrets-allow regex %q: %w", a, err)
 		}
+		allowed = append(allowed, re)
 	}
-	res, err := json.MarshalIndent(image, "", "\t")
+	err = nix.ApplySecretsPolicy(cmd.Context(), image, secretsPolicy, allowed)
 	if err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(outputFilename, []byte(res), 0666)
+	if checkEntrypoint {
+		err = nix.CheckEntrypoint(cmd.Context(), image)
+		if err != nil {
+			return err
+		}
+	}
+	if checkLinkage {
+		err = nix.CheckLinkage(cmd.Context(), image)
+		if err != nil {
+			return err
+		}
+	}
+	res, err := types.MarshalCanonical(image)
+	if err != nil {
+		return err
+	}
+	err = types.WriteFile(outputFilename, []byte(res))
 	if err != nil {
 		return err
 	}
@@ -111,8 +322,45 @@ func image(outputFilename, imageConfigPath string, fromImageFilename string, lay
 	return nil
 }
 
+func sizeBudget(maxImageSize, maxLayerSize string) (budget nix.SizeBudget, err error) {
+	if maxImageSize != "" {
+		budget.MaxImageSize, err = nix.ParseByteSize(maxImageSize)
+		if err != nil {
+			return budget, err
+		}
+	}
+	if maxLayerSize != "" {
+		budget.MaxLayerSize, err = nix.ParseByteSize(maxLayerSize)
+		if err != nil {
+			return budget, err
+		}
+	}
+	return budget, nil
+}
+
 func init() {
 	rootCmd.AddCommand(imageCmd)
 	imageCmd.Flags().StringVarP(&fromImageFilename, "from-image", "", "", "A JSON file describing the base image")
+	imageCmd.Flags().StringVarP(&entrypointWrapperFilename, "entrypoint-wrapper", "", "", "A JSON file describing a script wrapping the entrypoint")
+	imageCmd.Flags().StringVarP(&architecture, "architecture", "", "", "The CPU architecture of the image (amd64 by default)")
+	imageCmd.Flags().StringVarP(&operatingSystem, "os", "", "", "The operating system of the image (linux by default)")
+	imageCmd.Flags().StringVarP(&osVersion, "os-version", "", "", "The version of the operating system of the image, such as 10.0.17763.1234 for Windows images (inherited from Windows base images)")
+	imageCmd.Flags().StringArrayVarP(&osFeatures, "os-feature", "", nil, "A feature of the operating system of the image, such as win32k (can be repeated, inherited from Windows base images)")
+	imageCmd.Flags().StringVarP(&provenanceFilename, "provenance", "", "", "A JSON file describing the Nix inputs of the image (flake-ref, nixpkgs-revision and derivations), recorded as manifest annotations")
+	imageCmd.Flags().StringVarP(&subjectFilename, "subject", "", "", "A JSON file containing the descriptor (mediaType, digest and size) of the manifest the image is attached to as a referrer")
+	imageCmd.Flags().StringVarP(&subjectImageFilename, "subject-image", "", "", "An image JSON file whose manifest is the subject of the image")
+	imageCmd.Flags().StringVarP(&rebuildFilename, "rebuild", "", "", "A JSON file describing how to build the image again (flake, attribute and system), added to the image labels")
+	imageCmd.Flags().StringToStringVarP(&configInheritance, "config-inheritance", "", map[string]string{}, "How configuration fields are inherited from the base image, such as Env=merge,User=inherit (replace, inherit or merge)")
+	imageCmd.Flags().StringVarP(&maxImageSize, "max-image-size", "", "", "Fail if the size of the image layers exceeds this size (such as 500M)")
+	imageCmd.Flags().StringVarP(&maxLayerSize, "max-layer-size", "", "", "Fail if the size of a layer exceeds this size (such as 100M)")
+	imageCmd.Flags().StringVarP(&secretsPolicy, "secrets-policy", "", nix.SecretsPolicyIgnore, "Scan the layers for secrets such as private keys and warn or fail if some are found (ignore, warn or fail)")
+	imageCmd.Flags().StringArrayVarP(&secretsAllow, "secrets-allow", "", []string{}, "A regex matching files not reported by the secrets scanner (can be repeated)")
+	imageCmd.Flags().StringVarP(&created, "created", "", "", "The RFC3339 creation date of the image, such as 2024-01-01T00:00:00Z (not set by default, which registries show as the epoch)")
+	imageCmd.Flags().StringVarP(&historyFilename, "history", "", "", "A JSON list of history entries without layer (created, created-by, author and comment), added as empty_layer entries after the entries of the layers")
+	imageCmd.Flags().BoolVarP(&configHistory, "config-history", "", false, "Add the Dockerfile instructions producing the image configuration (such as ENV and LABEL) as empty_layer history entries")
+	imageCmd.Flags().BoolVarP(&hoistDuplicates, "hoist-duplicates", "", false, "Remove the store paths added to several layers from all of them but the lowest one")
+	imageCmd.Flags().StringVarP(&inlineFilesFilename, "inline-files", "", "", "A JSON list of small files (path, content, encoding, mode, uid and gid) added to the image in a generated layer")
+	imageCmd.Flags().BoolVarP(&checkEntrypoint, "check-entrypoint", "", false, "Fail if the executable of the Entrypoint (or of the Cmd) doesn't exist in the image layers or is not executable")
+	imageCmd.Flags().BoolVarP(&checkLinkage, "check-linkage", "", false, "Fail if shared libraries (DT_NEEDED) of the ELF executable of the Entrypoint, or of its libraries, can not be found in the image")
 	rootCmd.AddCommand(imageFromDirCmd)
 }
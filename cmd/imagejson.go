@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/nlewo/nix2container/nix"
+	"github.com/nlewo/nix2container/types"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var pushImageJSONCreds string
+var pushImageJSONTLSVerify bool
+var pullImageJSONCreds string
+var pullImageJSONTLSVerify bool
+var pullImageJSONRealise bool
+
+var pushImageJSONCmd = &cobra.Command{
+	Use:   "push-image-json IMAGE.JSON DESTINATION",
+	Short: "Push the image JSON as an OCI artifact, to generate its blobs on another machine",
+	Long: `Push the image JSON as an OCI artifact, to generate its blobs on another machine.
+
+The JSON description of the image, which references the store paths of
+its layers, is pushed as an OCI artifact to DESTINATION (such as
+docker://ghcr.io/org/app-json:v1), without generating any layer. Another
+machine, for instance with the registry credentials or of another
+architecture, then pulls it with pull-image-json and pushes the image:
+
+  nix2container push-image-json image.json docker://ghcr.io/org/app-json:v1
+  nix2container pull-image-json docker://ghcr.io/org/app-json:v1 image.json --realise
+  skopeo copy nix:image.json docker://ghcr.io/org/app:v1
+
+The store paths of the layers have to be available on this machine, for
+instance from a binary cache.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := pushImageJSON(cmd, args[0], args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+	},
+}
+
+var pullImageJSONCmd = &cobra.Command{
+	Use:   "pull-image-json SOURCE OUTPUT.JSON",
+	Short: "Pull an image JSON pushed by push-image-json",
+	Long: `Pull an image JSON pushed by push-image-json.
+
+The image JSON of the OCI artifact SOURCE (such as
+docker://ghcr.io/org/app-json:v1) is written to OUTPUT.JSON ("-" for the
+standard output). With --realise, the store paths of its layers are
+realised with nix-store, for instance from a binary cache, so that the
+image can be pushed from this machine.
+
+The artifact is not trusted: anyone with write access to its
+repository can replace it, while the image is then pushed with the
+credentials of this machine. The image JSON is then strictly validated
+and only layers built from store paths are accepted: layers read from
+files (layer-path), compressed by commands or with paths outside of the
+Nix store are rejected.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := pullImageJSON(cmd, args[0], args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+	},
+}
+
+func pushImageJSON(cmd *cobra.Command, imageFilename, destination string) error {
+	image, err := nix.NewImageFromFile(imageFilename)
+	if err != nil {
+		return err
+	}
+	sys, err := registrySystemContext(pushImageJSONCreds, pushImageJSONTLSVerify)
+	if err != nil {
+		return err
+	}
+	_, err = nix.PushImageArtifact(cmd.Context(), sys, destination, image)
+	return err
+}
+
+func pullImageJSON(cmd *cobra.Command, source, outputFilename string) error {
+	sys, err := registrySystemContext(pullImageJSONCreds, pullImageJSONTLSVerify)
+	if err != nil {
+		return err
+	}
+	image, err := nix.PullImageArtifact(cmd.Context(), sys, source)
+	if err != nil {
+		return err
+	}
+	if pullImageJSONRealise {
+		if err := nix.RealiseStorePaths(cmd.Context(), image); err != nil {
+			return err
+		}
+	}
+	content, err := types.MarshalCanonical(image)
+	if err != nil {
+		return err
+	}
+	if err := types.WriteFile(outputFilename, content); err != nil {
+		return err
+	}
+	logrus.Infof("The image JSON of %s has been written to %s", source, outputFilename)
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(pushImageJSONCmd)
+	pushImageJSONCmd.Flags().StringVarP(&pushImageJSONCreds, "creds", "", "", "The USERNAME:PASSWORD used to access the registry")
+	pushImageJSONCmd.Flags().BoolVarP(&pushImageJSONTLSVerify, "tls-verify", "", true, "Require HTTPS and verify certificates when talking to the registry")
+	rootCmd.AddCommand(pullImageJSONCmd)
+	pullImageJSONCmd.Flags().StringVarP(&pullImageJSONCreds, "creds", "", "", "The USERNAME:PASSWORD used to access the registry")
+	pullImageJSONCmd.Flags().BoolVarP(&pullImageJSONTLSVerify, "tls-verify", "", true, "Require HTTPS and verify certificates when talking to the registry")
+	pullImageJSONCmd.Flags().BoolVarP(&pullImageJSONRealise, "realise", "", false, "Realise the store paths of the layers with nix-store")
+}
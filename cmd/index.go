@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/nlewo/nix2container/nix"
+	"github.com/nlewo/nix2container/types"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var indexCmd = &cobra.Command{
+	Use:   "index OUTPUT-FILENAME ENTRIES.JSON",
+	Short: "Generate an index.json file describing a multi-platform image",
+	Long: `Generate an index.json file describing a multi-platform image.
+
+ENTRIES.JSON contains a list of platforms and their image JSON file,
+such as:
+
+  [{"platform": {"os": "linux", "architecture": "arm64"}, "image": "image.json"},
+   {"platform": {"os": "windows", "architecture": "amd64"}, "skip": true}]
+
+Skipped entries and entries without image are not written to the
+index. The platform of each image is checked against the declared
+platform.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := index(args[0], args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+	},
+}
+
+func index(outputFilename, entriesFilename string) error {
+	content, err := types.ReadFile(entriesFilename)
+	if err != nil {
+		return err
+	}
+	var entries []types.IndexEntry
+	err = json.Unmarshal(content, &entries)
+	if err != nil {
+		return err
+	}
+	idx, err := nix.NewIndex(entries)
+	if err != nil {
+		return err
+	}
+	res, err := types.MarshalCanonical(idx)
+	if err != nil {
+		return err
+	}
+	err = types.WriteFile(outputFilename, []byte(res))
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Index has been written to %s", outputFilename)
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(indexCmd)
+}
@@ -1,30 +1,70 @@
-// The generated structure is a list of layers. Currently, the list
-// always contains a single Layer, but in the future, we would like to
-// generate several layers with some algorithms, such as
+// The generated structure is a list of layers. The list contains a
+// single Layer, unless a closure graph is provided: store paths are
+// then split into several layers ordered by stability (see
+// nix.GroupByStability), with an approach similar to
 // https://grahamc.com/blog/nix-and-layered-docker-images
 
 package cmd
 
 import (
+	"context"
 	_ "crypto/sha256"
 	_ "crypto/sha512"
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/nlewo/nix2container/metrics"
 	"github.com/nlewo/nix2container/nix"
 	"github.com/nlewo/nix2container/types"
 	digest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
 var rewrites rewritePaths
+var files filePaths
 var ignore string
 var tarDirectory string
 var permsFilepath string
+var stripSpecialBits bool
+var umask string
+var acls string
+var tarFormat string
+var compression string
+var parentImages []string
+var tarPrefix optionalString
+var uname, gname optionalString
+var encryptionRecipients []string
+var digestCache string
+var digestCacheRemote string
+var digestCacheSegmentSize string
+var digestAlgorithm string
+var compressionCommand string
+var fileIndexDirectory string
+var closureGraphFilepath string
+var maxLayers int
+var splitStrategy string
+var closureOf []string
+var excludeClosureOf []string
+var closureMaxDepth int
+var strictRepro bool
+var maxEntrySize string
+var sparse bool
+var layerCreated string
+var layerAuthor string
+var layerCreatedBy string
+var layerOrder int
+var namePolicy string
+var absoluteSymlinks string
+var conflicts string
+var budgetMaxSize string
+var budgetName string
 
 // layerCmd represents the layer command
 var layersReproducibleCmd = &cobra.Command{
@@ -35,30 +75,82 @@ var layersReproducibleCmd = &cobra.Command{
 		storepaths, err := getStorepaths(args[1])
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "%s", err)
-			os.Exit(1)
+			fail(err)
 		}
 		parents, err := getLayersFromFiles(args[2:])
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "%s", err)
-			os.Exit(1)
+			fail(err)
 		}
+		imageParents, err := getLayersFromImages(parentImages)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+		parents = append(parents, imageParents...)
 		var perms []types.PermPath
 		if permsFilepath != "" {
 			perms, err = readPermsFile(permsFilepath)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "%s", err)
-				os.Exit(1)
+				fail(err)
 			}
 		}
-		layers, err := nix.NewLayers(storepaths, parents, rewrites, ignore, perms)
+		if digestCache != "" || digestCacheRemote != "" {
+			cache, err := nix.NewSumCache(digestCache)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s", err)
+				fail(err)
+			}
+			if digestCacheRemote != "" {
+				if err := cache.SetRemote(digestCacheRemote); err != nil {
+					fmt.Fprintf(os.Stderr, "%s", err)
+					fail(err)
+				}
+			}
+			if err := setDigestCacheSegmentSize(cache, digestCacheSegmentSize); err != nil {
+				fmt.Fprintf(os.Stderr, "%s", err)
+				fail(err)
+			}
+			nix.SetSumCache(cache)
+		}
+		err = nix.SetDigestAlgorithm(digestAlgorithm)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+		nix.SetCompressionCommand(strings.Fields(compressionCommand))
+		nix.SetFileIndexDirectory(fileIndexDirectory)
+		nix.SetStrictReproducibility(strictRepro)
+		if err := setMaxEntrySize(maxEntrySize); err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+		storepaths, err = selectStorepaths(storepaths)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+		storepaths, allRewrites := addFiles(storepaths, rewrites, files)
+		groups, err := groupStorepaths(storepaths)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "%s", err)
-			os.Exit(1)
+			fail(err)
+		}
+		metrics.StartStatusPhase(metrics.PhaseBuilding, len(groups), 0)
+		var layers []types.Layer
+		for _, group := range groups {
+			groupLayers, err := nix.NewLayers(cmd.Context(), group, parents, allRewrites, ignore, perms, defaultPathOptions(), compression)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s", err)
+				fail(err)
+			}
+			layers = append(layers, groupLayers...)
 		}
 		err = layersToJson(args[0], layers)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "%s", err)
-			os.Exit(1)
+			fail(err)
 		}
 	},
 }
@@ -72,36 +164,217 @@ var layersNonReproducibleCmd = &cobra.Command{
 		storepaths, err := getStorepaths(args[1])
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "%s", err)
-			os.Exit(1)
+			fail(err)
 		}
 		parents, err := getLayersFromFiles(args[2:])
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "%s", err)
-			os.Exit(1)
+			fail(err)
 		}
+		imageParents, err := getLayersFromImages(parentImages)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+		parents = append(parents, imageParents...)
 		var perms []types.PermPath
 		if permsFilepath != "" {
 			perms, err = readPermsFile(permsFilepath)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "%s", err)
-				os.Exit(1)
+				fail(err)
 			}
 		}
-		layers, err := nix.NewLayersNonReproducible(storepaths, tarDirectory, parents, rewrites, ignore, perms)
+		err = nix.SetDigestAlgorithm(digestAlgorithm)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "%s", err)
-			os.Exit(1)
+			fail(err)
+		}
+		nix.SetCompressionCommand(strings.Fields(compressionCommand))
+		nix.SetFileIndexDirectory(fileIndexDirectory)
+		nix.SetStrictReproducibility(strictRepro)
+		if err := setMaxEntrySize(maxEntrySize); err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+		storepaths, err = selectStorepaths(storepaths)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+		storepaths, allRewrites := addFiles(storepaths, rewrites, files)
+		metrics.StartStatusPhase(metrics.PhaseBuilding, 1, 0)
+		layers, err := nix.NewLayersNonReproducible(cmd.Context(), storepaths, tarDirectory, parents, allRewrites, ignore, perms, defaultPathOptions(), compression)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+		if len(encryptionRecipients) > 0 {
+			layers, err = encryptLayers(cmd.Context(), layers, encryptionRecipients, tarDirectory)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s", err)
+				fail(err)
+			}
 		}
 		err = layersToJson(args[0], layers)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "%s", err)
-			os.Exit(1)
+			fail(err)
+		}
+	},
+}
+
+var pinnedMediaType string
+var pinnedURLs []string
+
+var layerPinnedCmd = &cobra.Command{
+	Use:   "layer-pinned OUTPUT-FILENAME.JSON DIGEST DIFF-ID SIZE",
+	Short: "Generate a layers.json file containing a layer only referenced by its digest",
+	Long: `Generate a layers.json file containing a layer only referenced by its digest.
+
+The layer blob is never generated: it has to be already present on the
+destination when the image is copied, or to be available at one of the
+layer URLs.`,
+	Args: cobra.ExactArgs(4),
+	Run: func(cmd *cobra.Command, args []string) {
+		size, err := strconv.ParseInt(args[3], 10, 64)
+		if err != nil {
+			err = fmt.Errorf("Invalid size %q: %w", args[3], err)
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+		layer, err := nix.NewPinnedLayer(args[1], args[2], size, pinnedMediaType, pinnedURLs)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+		err = layersToJson(args[0], []types.Layer{layer})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
 		}
 	},
 }
 
 type rewritePaths []types.RewritePath
 
+// filePaths are rewrites moving a single file to a destination.
+type filePaths []types.RewritePath
+
+func (i *filePaths) String() string {
+	return ""
+}
+func (i *filePaths) Type() string {
+	return "PATH,DESTINATION"
+}
+func (i *filePaths) Set(value string) error {
+	elts := strings.Split(value, ",")
+	if len(elts) != 2 {
+		return fmt.Errorf("The file %q must be formatted as PATH,DESTINATION", value)
+	}
+	*i = append(*i, nix.NewFileRewritePath(elts[0], elts[1]))
+	return nil
+}
+
+// groupStorepaths splits the store paths into the groups of store
+// paths of each layer, according to the closure graph if any.
+func groupStorepaths(storepaths []string) ([][]string, error) {
+	if closureGraphFilepath == "" {
+		return [][]string{storepaths}, nil
+	}
+	graph, err := nix.NewClosureGraphFromFile(closureGraphFilepath)
+	if err != nil {
+		return nil, err
+	}
+	var groups [][]string
+	switch splitStrategy {
+	case nix.SplitStability:
+		groups = nix.GroupByStability(graph, storepaths, maxLayers)
+	case nix.SplitPopularity:
+		groups = nix.GroupByPopularity(graph, storepaths, maxLayers)
+	default:
+		return nil, fmt.Errorf("Unknown split strategy %q (stability or popularity)", splitStrategy)
+	}
+	logrus.Infof("Splitting %d store paths into %d layers by %s", len(storepaths), len(groups), splitStrategy)
+	return groups, nil
+}
+
+// selectStorepaths returns the store paths selected by the closure
+// options, according to the closure graph.
+func selectStorepaths(storepaths []string) ([]string, error) {
+	selection := nix.ClosureSelection{
+		Include:  closureOf,
+		Exclude:  excludeClosureOf,
+		MaxDepth: closureMaxDepth,
+	}
+	if selection.IsEmpty() {
+		return storepaths, nil
+	}
+	if closureGraphFilepath == "" {
+		return nil, fmt.Errorf("Selecting store paths by closure requires a closure graph (--closure-graph)")
+	}
+	graph, err := nix.NewClosureGraphFromFile(closureGraphFilepath)
+	if err != nil {
+		return nil, err
+	}
+	selected, err := nix.SelectStorePaths(graph, storepaths, selection)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infof("Selecting %d of %d store paths by closure", len(selected), len(storepaths))
+	return selected, nil
+}
+
+// setMaxEntrySize parses the --max-entry-size flag value.
+func setMaxEntrySize(s string) error {
+	var size int64
+	if s != "" {
+		var err error
+		size, err = nix.ParseByteSize(s)
+		if err != nil {
+			return fmt.Errorf("Invalid maximum entry size %q: %w", s, err)
+		}
+	}
+	nix.SetMaxEntrySize(size)
+	return nil
+}
+
+// setDigestCacheSegmentSize sets the size of the segments of the
+// archives whose digests are cached, if s is not empty.
+func setDigestCacheSegmentSize(cache *nix.SumCache, s string) error {
+	if s == "" {
+		return nil
+	}
+	size, err := nix.ParseByteSize(s)
+	if err == nil && size <= 0 {
+		err = fmt.Errorf("The size should be positive")
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid digest cache segment size %q: %w", s, err)
+	}
+	cache.SetSegmentSize(size)
+	return nil
+}
+
+// addFiles adds files to the storepaths (if not already present) and
+// returns the rewrites moving them to their destination.
+func addFiles(storepaths []string, rewrites []types.RewritePath, files []types.RewritePath) ([]string, []types.RewritePath) {
+	for _, f := range files {
+		found := false
+		for _, p := range storepaths {
+			if p == f.Path {
+				found = true
+				break
+			}
+		}
+		if !found {
+			storepaths = append(storepaths, f.Path)
+		}
+		rewrites = append(rewrites, f)
+	}
+	return storepaths, rewrites
+}
+
 func (i *rewritePaths) String() string {
 	return ""
 }
@@ -110,6 +383,12 @@ func (i *rewritePaths) Type() string {
 }
 func (i *rewritePaths) Set(value string) error {
 	elts := strings.Split(value, ",")
+	if len(elts) != 3 {
+		return fmt.Errorf("The rewrite %q must be PATH,REGEX,REPLACEMENT", value)
+	}
+	if _, err := regexp.Compile(elts[1]); err != nil {
+		return fmt.Errorf("Invalid rewrite regex %q: %w", elts[1], err)
+	}
 	*i = append(*i, types.RewritePath{
 		Path:  elts[0],
 		Regex: elts[1],
@@ -118,12 +397,106 @@ func (i *rewritePaths) Set(value string) error {
 	return nil
 }
 
+// defaultPathOptions returns the options applied on all paths of the
+// layer.
+func defaultPathOptions() types.PathOptions {
+	return types.PathOptions{
+		StripSpecialBits: stripSpecialBits,
+		Umask:            umask,
+		ACLs:             acls,
+		TarFormat:        tarFormat,
+		Sparse:           sparse,
+		NamePolicy:       namePolicy,
+		AbsoluteSymlinks: absoluteSymlinks,
+		Conflicts:        conflicts,
+		Prefix:           tarPrefix.value,
+		Uname:            uname.value,
+		Gname:            gname.value,
+	}
+}
+
+// optionalString is a string flag distinguishing an empty value from
+// an unset flag.
+type optionalString struct {
+	value *string
+}
+
+func (o *optionalString) String() string {
+	if o.value == nil {
+		return ""
+	}
+	return *o.value
+}
+func (o *optionalString) Type() string {
+	return "string"
+}
+func (o *optionalString) Set(value string) error {
+	o.value = &value
+	return nil
+}
+
+// encryptLayers encrypts the layers for the recipients. Encrypted
+// blobs are written to tarDirectory, in a file named after the digest
+// of the unencrypted layer, and replace the unencrypted archives.
+func encryptLayers(ctx context.Context, layers []types.Layer, recipients []string, tarDirectory string) ([]types.Layer, error) {
+	var encrypted []types.Layer
+	for _, layer := range layers {
+		filename := filepath.Join(tarDirectory, digest.Digest(layer.Digest).Encoded()+".enc")
+		l, err := nix.EncryptLayer(ctx, layer, recipients, filename)
+		if err != nil {
+			return nil, err
+		}
+		if layer.LayerPath != "" {
+			if err := os.Remove(layer.LayerPath); err != nil {
+				return nil, err
+			}
+		}
+		encrypted = append(encrypted, l)
+	}
+	return encrypted, nil
+}
+
+// layersToJson writes the layers, with the creation date, the author
+// and the command of the --created, --author and --created-by flags,
+// the order of the --order flag and the budget of the --max-size flag. The budget
+// is named after the output file by default, so that the layers
+// written together share the budget.
 func layersToJson(outputFilename string, layers []types.Layer) error {
-	res, err := json.MarshalIndent(layers, "", "\t")
+	if budgetMaxSize != "" {
+		maxSize, err := nix.ParseByteSize(budgetMaxSize)
+		if err != nil {
+			return err
+		}
+		name := budgetName
+		if name == "" {
+			name = outputFilename
+		}
+		for i := range layers {
+			layers[i].Budget = &types.LayerBudget{Name: name, MaxSize: maxSize}
+		}
+	}
+	if layerCreated != "" {
+		if _, err := time.Parse(time.RFC3339, layerCreated); err != nil {
+			return fmt.Errorf("Invalid created date %q: %w", layerCreated, err)
+		}
+		for i := range layers {
+			layers[i].Created = layerCreated
+		}
+	}
+	for i := range layers {
+		if layerAuthor != "" {
+			layers[i].Author = layerAuthor
+		}
+		if layerCreatedBy != "" {
+			layers[i].CreatedBy = layerCreatedBy
+		}
+		layers[i].Order = layerOrder
+	}
+	res, err := types.MarshalCanonical(layers)
 	if err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(outputFilename, []byte(res), 0666)
+	err = types.WriteFile(outputFilename, []byte(res))
 	if err != nil {
 		return err
 	}
@@ -132,7 +505,7 @@ func layersToJson(outputFilename string, layers []types.Layer) error {
 }
 
 func getStorepaths(pathsFilename string) (paths []string, err error) {
-	content, err := ioutil.ReadFile(pathsFilename)
+	content, err := types.ReadFile(pathsFilename)
 	if err != nil {
 		return paths, err
 	}
@@ -157,6 +530,22 @@ func getLayersFromFiles(layersPaths []string) (layers []types.Layer, err error)
 	return layers, nil
 }
 
+// getLayersFromImages returns the layers of the images described by
+// the JSON files imagePaths. Store paths of these layers are then
+// skipped, which allows to only build the delta between an image and
+// a new closure.
+func getLayersFromImages(imagePaths []string) (layers []types.Layer, err error) {
+	for _, imagePath := range imagePaths {
+		image, err := nix.NewImageFromFile(imagePath)
+		if err != nil {
+			return layers, err
+		}
+		logrus.Infof("Skipping store paths of the %d layers of the image %s", len(image.Layers), imagePath)
+		layers = append(layers, image.Layers...)
+	}
+	return layers, nil
+}
+
 func layerFromTar(filename string) (layers []types.Layer, err error) {
 	f, err := os.Open(filename)
 	defer f.Close()
@@ -184,10 +573,82 @@ func init() {
 
 	layersNonReproducibleCmd.Flags().Var(&rewrites, "rewrite", "Replace the REGEX part by REPLACEMENT for all files in the tree PATH")
 	layersNonReproducibleCmd.Flags().StringVarP(&permsFilepath, "perms", "", "", "A JSON file containing file permissions")
+	layersNonReproducibleCmd.Flags().Var(&files, "file", "Add the file PATH to the layer at DESTINATION")
+	layersNonReproducibleCmd.Flags().BoolVarP(&stripSpecialBits, "strip-special-bits", "", false, "Clear the setuid, setgid and sticky bits of all files (perms are applied after)")
+	layersNonReproducibleCmd.Flags().StringVarP(&umask, "umask", "", "", "Clear these octal permission bits on all files (perms are applied after)")
+	layersNonReproducibleCmd.Flags().StringVarP(&acls, "acls", "", "", "How the POSIX ACLs of files are handled: strip (default, with a warning), preserve (as xattrs) or error")
+	layersNonReproducibleCmd.Flags().StringVarP(&compression, "compression", "", "", "Compress the layer with gzip, zstd or zstd:chunked")
+	layersNonReproducibleCmd.Flags().StringVarP(&compressionCommand, "compression-command", "", "", "An external command compressing the layer from its standard input to its standard output, such as \"pigz -n\" or zstdmt (its output must be reproducible)")
+	layersNonReproducibleCmd.Flags().StringArrayVarP(&parentImages, "parent-image", "", nil, "A JSON file describing an image whose store paths are skipped")
+	layersNonReproducibleCmd.Flags().BoolVarP(&strictRepro, "strict-repro", "", false, "Fail on inputs which can not be normalized deterministically (paths outside of the Nix store, sockets, devices, named pipes or POSIX ACLs to strip) instead of normalizing or skipping them")
+	layersNonReproducibleCmd.Flags().StringVarP(&maxEntrySize, "max-entry-size", "", "", "Fail if a file of the layer is larger than this size, such as 1G (no limit by default)")
+	layersNonReproducibleCmd.Flags().StringVarP(&namePolicy, "name-policy", "", "", "How unsafe file names (control characters, invalid UTF-8, . or .. elements, not NFC normalized) and symlinks escaping the archive root are handled: keep (default), reject or sanitize")
+	layersNonReproducibleCmd.Flags().StringVarP(&absoluteSymlinks, "absolute-symlinks", "", "", "How symlinks with an absolute target are handled: keep (default), reject or relativize (rewritten relative to the symlink)")
+	layersNonReproducibleCmd.Flags().StringVarP(&conflicts, "conflicts", "", "", "How a file overriding a file of the layer with different attributes is handled: strict (default) fails, relaxed only fails if their type, link target or content differ")
+	layersNonReproducibleCmd.Flags().BoolVarP(&sparse, "sparse", "", false, "Store the holes of sparse files (runs of zero blocks) as PAX sparse records instead of expanding them")
+	layersNonReproducibleCmd.Flags().StringVarP(&tarFormat, "tar-format", "", "", "Pin the version of the archive serialization, v1 or v2, to keep layer digests stable across nix2container upgrades (the latest version by default). The options introduced by v2 (--acls preserve, --sparse, --uname, --gname, --name-policy and --absolute-symlinks) are rejected with v1")
+	layersNonReproducibleCmd.Flags().Var(&tarPrefix, "tar-prefix", "Replace the leading slashes of archive entries by this prefix (\"/\" or \"\" for instance)")
+	layersNonReproducibleCmd.Flags().Var(&uname, "uname", "The owner user name of the archive entries (root by default, \"\" to only keep the numeric owner)")
+	layersNonReproducibleCmd.Flags().Var(&gname, "gname", "The owner group name of the archive entries (root by default, \"\" to only keep the numeric owner)")
+	layersNonReproducibleCmd.Flags().StringVarP(&fileIndexDirectory, "file-index-directory", "", "", "Write the index of the files of the layer archive into this directory, to extract single files quickly")
+	layersNonReproducibleCmd.Flags().StringVarP(&digestAlgorithm, "digest-algorithm", "", "sha256", "The algorithm of the layer digests (sha256 or sha512)")
+	layersNonReproducibleCmd.Flags().StringVarP(&closureGraphFilepath, "closure-graph", "", "", "A JSON closure graph used to select store paths by closure")
+	layersNonReproducibleCmd.Flags().StringArrayVarP(&closureOf, "closure-of", "", nil, "Only keep the store paths in the closure of this store path (can be repeated)")
+	layersNonReproducibleCmd.Flags().StringArrayVarP(&excludeClosureOf, "exclude-closure-of", "", nil, "Skip the store paths in the closure of this store path (can be repeated)")
+	layersNonReproducibleCmd.Flags().IntVarP(&closureMaxDepth, "closure-max-depth", "", 0, "Only keep the store paths at most this number of references away from the --closure-of store paths (or from the store paths)")
+	layersNonReproducibleCmd.Flags().StringVarP(&budgetMaxSize, "max-size", "", "", "The size budget of the layers, such as 100M, enforced when the image is built")
+	layersNonReproducibleCmd.Flags().StringVarP(&budgetName, "budget-name", "", "", "The name of the component the layers belong to, reported when its budget is exceeded (the output filename by default)")
+	layersNonReproducibleCmd.Flags().StringVarP(&layerCreated, "created", "", "", "The RFC3339 creation date of the layer, such as 2024-01-01T00:00:00Z, set in the history of the image configuration")
+	layersNonReproducibleCmd.Flags().StringVarP(&layerAuthor, "author", "", "", "The author of the history entry of the layer")
+	layersNonReproducibleCmd.Flags().StringVarP(&layerCreatedBy, "created-by", "", "", "The command of the history entry of the layer (nix2container by default)")
+	layersNonReproducibleCmd.Flags().IntVarP(&layerOrder, "order", "", 0, "The position of the layer in the image: layers are sorted by their order, layers with a higher order being above (0 by default)")
+	layersNonReproducibleCmd.Flags().StringArrayVarP(&encryptionRecipients, "encryption-recipient", "", nil, "Encrypt the layer for this recipient (jwe:PUBLIC-KEY.pem, pgp:EMAIL or pkcs7:CERT.pem)")
 
 	rootCmd.AddCommand(layersReproducibleCmd)
 	layersReproducibleCmd.Flags().StringVarP(&ignore, "ignore", "", "", "Ignore the path from the list of storepaths")
 	layersReproducibleCmd.Flags().Var(&rewrites, "rewrite", "Replace the regex part by replacement for all files of the a path")
 	layersReproducibleCmd.Flags().StringVarP(&permsFilepath, "perms", "", "", "A JSON file containing file permissions")
+	layersReproducibleCmd.Flags().Var(&files, "file", "Add the file PATH to the layer at DESTINATION")
+	layersReproducibleCmd.Flags().BoolVarP(&stripSpecialBits, "strip-special-bits", "", false, "Clear the setuid, setgid and sticky bits of all files (perms are applied after)")
+	layersReproducibleCmd.Flags().StringVarP(&umask, "umask", "", "", "Clear these octal permission bits on all files (perms are applied after)")
+	layersReproducibleCmd.Flags().StringVarP(&acls, "acls", "", "", "How the POSIX ACLs of files are handled: strip (default, with a warning), preserve (as xattrs) or error")
+	layersReproducibleCmd.Flags().StringVarP(&compression, "compression", "", "", "Compress the layer with gzip, zstd or zstd:chunked")
+	layersReproducibleCmd.Flags().StringVarP(&compressionCommand, "compression-command", "", "", "An external command compressing the layer from its standard input to its standard output, such as \"pigz -n\" or zstdmt (its output must be reproducible)")
+	layersReproducibleCmd.Flags().StringArrayVarP(&parentImages, "parent-image", "", nil, "A JSON file describing an image whose store paths are skipped")
+	layersReproducibleCmd.Flags().BoolVarP(&strictRepro, "strict-repro", "", false, "Fail on inputs which can not be normalized deterministically (paths outside of the Nix store, sockets, devices, named pipes or POSIX ACLs to strip) instead of normalizing or skipping them")
+	layersReproducibleCmd.Flags().StringVarP(&maxEntrySize, "max-entry-size", "", "", "Fail if a file of the layer is larger than this size, such as 1G (no limit by default)")
+	layersReproducibleCmd.Flags().StringVarP(&namePolicy, "name-policy", "", "", "How unsafe file names (control characters, invalid UTF-8, . or .. elements, not NFC normalized) and symlinks escaping the archive root are handled: keep (default), reject or sanitize")
+	layersReproducibleCmd.Flags().StringVarP(&absoluteSymlinks, "absolute-symlinks", "", "", "How symlinks with an absolute target are handled: keep (default), reject or relativize (rewritten relative to the symlink)")
+	layersReproducibleCmd.Flags().StringVarP(&conflicts, "conflicts", "", "", "How a file overriding a file of the layer with different attributes is handled: strict (default) fails, relaxed only fails if their type, link target or content differ")
+	layersReproducibleCmd.Flags().BoolVarP(&sparse, "sparse", "", false, "Store the holes of sparse files (runs of zero blocks) as PAX sparse records instead of expanding them")
+	layersReproducibleCmd.Flags().StringVarP(&tarFormat, "tar-format", "", "", "Pin the version of the archive serialization, v1 or v2, to keep layer digests stable across nix2container upgrades (the latest version by default). The options introduced by v2 (--acls preserve, --sparse, --uname, --gname, --name-policy and --absolute-symlinks) are rejected with v1")
+	layersReproducibleCmd.Flags().Var(&tarPrefix, "tar-prefix", "Replace the leading slashes of archive entries by this prefix (\"/\" or \"\" for instance)")
+	layersReproducibleCmd.Flags().Var(&uname, "uname", "The owner user name of the archive entries (root by default, \"\" to only keep the numeric owner)")
+	layersReproducibleCmd.Flags().Var(&gname, "gname", "The owner group name of the archive entries (root by default, \"\" to only keep the numeric owner)")
+	layersReproducibleCmd.Flags().StringVarP(&fileIndexDirectory, "file-index-directory", "", "", "Write the index of the files of the layer archive into this directory, to extract single files quickly")
+	layersReproducibleCmd.Flags().StringVarP(&digestAlgorithm, "digest-algorithm", "", "sha256", "The algorithm of the layer digests (sha256 or sha512)")
+	layersReproducibleCmd.Flags().StringVarP(&closureGraphFilepath, "closure-graph", "", "", "A JSON closure graph used to split store paths into layers ordered by stability or to select store paths by closure")
+	layersReproducibleCmd.Flags().StringArrayVarP(&closureOf, "closure-of", "", nil, "Only keep the store paths in the closure of this store path (can be repeated)")
+	layersReproducibleCmd.Flags().StringArrayVarP(&excludeClosureOf, "exclude-closure-of", "", nil, "Skip the store paths in the closure of this store path (can be repeated)")
+	layersReproducibleCmd.Flags().IntVarP(&closureMaxDepth, "closure-max-depth", "", 0, "Only keep the store paths at most this number of references away from the --closure-of store paths (or from the store paths)")
+	layersReproducibleCmd.Flags().IntVarP(&maxLayers, "max-layers", "", 1, "The maximum number of layers generated from the closure graph")
+	layersReproducibleCmd.Flags().StringVarP(&splitStrategy, "split-strategy", "", nix.SplitStability, "How store paths are split into layers: stability (by dependency depth) or popularity (the most popular store paths have their own layer)")
+	layersReproducibleCmd.Flags().StringVarP(&digestCache, "digest-cache", "", os.Getenv("NIX2CONTAINER_DIGEST_CACHE"), "A directory caching layer digests, to avoid generating archives of already known store paths")
+	layersReproducibleCmd.Flags().StringVarP(&budgetMaxSize, "max-size", "", "", "The size budget of the layers, such as 100M, enforced when the image is built")
+	layersReproducibleCmd.Flags().StringVarP(&budgetName, "budget-name", "", "", "The name of the component the layers belong to, reported when its budget is exceeded (the output filename by default)")
+	layersReproducibleCmd.Flags().StringVarP(&layerCreated, "created", "", "", "The RFC3339 creation date of the layer, such as 2024-01-01T00:00:00Z, set in the history of the image configuration")
+	layersReproducibleCmd.Flags().StringVarP(&layerAuthor, "author", "", "", "The author of the history entry of the layer")
+	layersReproducibleCmd.Flags().StringVarP(&layerCreatedBy, "created-by", "", "", "The command of the history entry of the layer (nix2container by default)")
+	layersReproducibleCmd.Flags().IntVarP(&layerOrder, "order", "", 0, "The position of the layer in the image: layers are sorted by their order, layers with a higher order being above (0 by default)")
+	layersReproducibleCmd.Flags().StringVarP(&digestCacheRemote, "digest-cache-remote", "", os.Getenv("NIX2CONTAINER_DIGEST_CACHE_REMOTE"), "A remote cache of layer digests shared across builders (an http(s):// URL accepting GET and PUT requests or an s3://BUCKET/PREFIX URL). Its entries are authenticated with the secret key of NIX2CONTAINER_DIGEST_CACHE_KEY, or checked by generating the archives if it is not set")
+	layersReproducibleCmd.Flags().StringVarP(&digestCacheSegmentSize, "digest-cache-segment-size", "", "", "Also cache the digests of layers with paths outside of the Nix store, keyed by the hashes of the segments of this size, such as 64M, of their archive, computed in parallel (disabled by default)")
+
+	rootCmd.AddCommand(layerPinnedCmd)
+	layerPinnedCmd.Flags().StringVarP(&pinnedMediaType, "media-type", "", v1.MediaTypeImageLayerGzip, "The media type of the layer blob")
+	layerPinnedCmd.Flags().StringVarP(&layerCreated, "created", "", "", "The RFC3339 creation date of the layer, such as 2024-01-01T00:00:00Z, set in the history of the image configuration")
+	layerPinnedCmd.Flags().StringVarP(&layerAuthor, "author", "", "", "The author of the history entry of the layer")
+	layerPinnedCmd.Flags().StringVarP(&layerCreatedBy, "created-by", "", "", "The command of the history entry of the layer (nix2container by default)")
+	layerPinnedCmd.Flags().IntVarP(&layerOrder, "order", "", 0, "The position of the layer in the image: layers are sorted by their order, layers with a higher order being above (0 by default)")
+	layerPinnedCmd.Flags().StringArrayVarP(&pinnedURLs, "url", "", nil, "An URL the layer blob can be downloaded from, added to the image manifest")
 
 }
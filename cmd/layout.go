@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/nlewo/nix2container/nix"
+	"github.com/spf13/cobra"
+)
+
+var layoutRefName string
+
+var ociLayoutCmd = &cobra.Command{
+	Use:   "oci-layout IMAGE.JSON DIRECTORY",
+	Short: "Write an image into an OCI image layout directory",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		image, err := nix.NewImageFromFile(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+		_, err = nix.WriteOCILayout(cmd.Context(), image, args[1], layoutRefName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(ociLayoutCmd)
+	ociLayoutCmd.Flags().StringVarP(&layoutRefName, "ref-name", "", "latest", "The reference name of the image in the layout")
+}
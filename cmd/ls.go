@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/nlewo/nix2container/nix"
+	"github.com/spf13/cobra"
+)
+
+var lsCmd = &cobra.Command{
+	Use:   "ls IMAGE.JSON [REGEX]",
+	Short: "List the files of an image with the store path and the layer they come from",
+	Long: `List the files of an image with the store path and the layer they come from.
+
+Only files whose name matches the optional REGEX are listed, which
+allows to find out why a file is part of the image. For instance:
+
+  nix2container ls image.json libLLVM`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := ls(cmd, args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+	},
+}
+
+func ls(cmd *cobra.Command, args []string) error {
+	var re *regexp.Regexp
+	if len(args) == 2 {
+		var err error
+		re, err = regexp.Compile(args[1])
+		if err != nil {
+			return err
+		}
+	}
+	image, err := nix.NewImageFromFile(args[0])
+	if err != nil {
+		return err
+	}
+	entries, err := nix.TraceImage(cmd.Context(), image)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if re != nil && !re.MatchString(entry.Name) {
+			continue
+		}
+		storePath := entry.StorePath
+		if storePath == "" {
+			storePath = "-"
+		}
+		fmt.Printf("%s\t%s\t%s\n", entry.Name, storePath, entry.Layer)
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(lsCmd)
+}
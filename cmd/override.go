@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/nlewo/nix2container/nix"
+	"github.com/nlewo/nix2container/types"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var overrideCmd = &cobra.Command{
+	Use:   "override OUTPUT-FILENAME IMAGE.JSON CONFIG.JSON",
+	Short: "Write an image.json file whose configuration is overridden by a configuration file",
+	Long: `Write an image.json file whose configuration is overridden by a configuration file.
+
+Env, Labels, ExposedPorts and Volumes entries of CONFIG.JSON are merged
+into the image configuration while other fields replace the image ones.
+This allows to parameterize an image per environment at copy time,
+without rebuilding it.`,
+	Args: cobra.ExactArgs(3),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := override(args[0], args[1], args[2])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+	},
+}
+
+func override(outputFilename, imageFilename, configFilename string) error {
+	image, err := nix.NewImageFromFile(imageFilename)
+	if err != nil {
+		return err
+	}
+	content, err := types.ReadFile(configFilename)
+	if err != nil {
+		return err
+	}
+	var config v1.ImageConfig
+	err = json.Unmarshal(content, &config)
+	if err != nil {
+		return err
+	}
+	image.ImageConfig = nix.OverrideImageConfig(image.ImageConfig, config)
+	res, err := types.MarshalCanonical(image)
+	if err != nil {
+		return err
+	}
+	err = types.WriteFile(outputFilename, res)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Image has been written to %s", outputFilename)
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(overrideCmd)
+}
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/nlewo/nix2container/nix"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var pushStateMarkPushed bool
+var pushStateCreds string
+var pushStateTLSVerify bool
+
+var pushStateCmd = &cobra.Command{
+	Use:   "push-state STATE-FILE IMAGE.JSON DESTINATION",
+	Short: "Show the progress of the push of an image recorded in a push state file",
+	Long: `Show the progress of the push of an image to a destination, as
+recorded in a push state file by the nix transport when the
+NIX2CONTAINER_PUSH_STATE environment variable is set.
+
+Blobs are recorded once the registry has committed their upload, by
+copy-to-registry. If the image is recorded as pushed to the destination
+and the manifest of the destination is still this image, its manifest
+digest is written to the standard output, so that the push can be
+skipped. With --mark-pushed, the image is recorded as pushed: it has to
+be called once the copy succeeded.`,
+	Args: cobra.ExactArgs(3),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := pushState(cmd, args[0], args[1], args[2], pushStateMarkPushed)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+	},
+}
+
+func pushState(cmd *cobra.Command, stateFilename, imageFilename, destination string, markPushed bool) error {
+	image, err := nix.NewImageFromFile(imageFilename)
+	if err != nil {
+		return err
+	}
+	state, err := nix.ReadPushState(stateFilename)
+	if err != nil {
+		return err
+	}
+	progress, err := nix.GetPushProgress(state, image, destination)
+	if err != nil {
+		return err
+	}
+	if markPushed {
+		return nix.RecordManifestPushed(stateFilename, progress.Manifest, destination)
+	}
+	if progress.ManifestPushed {
+		sys, err := registrySystemContext(pushStateCreds, pushStateTLSVerify)
+		if err != nil {
+			return err
+		}
+		remote, err := nix.RemoteManifestDigest(cmd.Context(), sys, destination)
+		if err != nil {
+			logrus.Warnf("Could not check the manifest of %s, the image is pushed again: %s", destination, err)
+			return nil
+		}
+		if remote.String() != progress.Manifest {
+			logrus.Warnf("The manifest of %s is %s instead of %s, the image is pushed again", destination, remote, progress.Manifest)
+			return nil
+		}
+	}
+	logrus.Infof("Push of %s to %s: %s", progress.Manifest, destination, progress)
+	if progress.ManifestPushed {
+		fmt.Println(progress.Manifest)
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(pushStateCmd)
+	pushStateCmd.Flags().BoolVarP(&pushStateMarkPushed, "mark-pushed", "", false, "Record the image as pushed to the destination")
+	pushStateCmd.Flags().StringVarP(&pushStateCreds, "creds", "", "", "The USERNAME:PASSWORD used to check the manifest of the destination")
+	pushStateCmd.Flags().BoolVarP(&pushStateTLSVerify, "tls-verify", "", true, "Require HTTPS and verify certificates when talking to the registry")
+}
@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/nlewo/nix2container/nix"
+	"github.com/nlewo/nix2container/types"
+	"github.com/spf13/cobra"
+)
+
+var recompressTo string
+var recompressBlobCache string
+var recompressOutput string
+
+var recompressCmd = &cobra.Command{
+	Use:   "recompress IMAGE.JSON",
+	Short: "Compress the layers of an image with another compression",
+	Long: `Compress the layers of an image with another compression, for
+instance to migrate a registry from gzip to zstd.
+
+The blobs of the layers built from store paths are read from the blob
+cache, decompressed and compressed with the --to compression, without
+generating their archives again. The new blobs are stored in the blob
+cache and the image JSON file, whose layer digests, sizes and media
+types are updated, is written to the standard output (or to
+--output). The image can then be copied with the same blob cache.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := recompress(cmd, args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+	},
+}
+
+func recompress(cmd *cobra.Command, imageFilename string) error {
+	if recompressBlobCache == "" {
+		return fmt.Errorf("A blob cache is required (--blob-cache or NIX2CONTAINER_BLOB_CACHE)")
+	}
+	image, err := nix.NewImageFromFile(imageFilename)
+	if err != nil {
+		return err
+	}
+	cache, err := nix.NewBlobCache(recompressBlobCache)
+	if err != nil {
+		return err
+	}
+	image, err = nix.RecompressImage(cmd.Context(), image, cache, recompressTo)
+	if err != nil {
+		return err
+	}
+	content, err := types.MarshalCanonical(image)
+	if err != nil {
+		return err
+	}
+	return types.WriteFile(recompressOutput, append(content, '\n'))
+}
+
+func init() {
+	rootCmd.AddCommand(recompressCmd)
+	recompressCmd.Flags().StringVarP(&recompressTo, "to", "", nix.CompressionZstd, "The compression of the layers (gzip, zstd or zstd:chunked)")
+	recompressCmd.Flags().StringVarP(&recompressBlobCache, "blob-cache", "", os.Getenv("NIX2CONTAINER_BLOB_CACHE"), "The blob store where the layers are read and the new blobs are stored")
+	recompressCmd.Flags().StringVarP(&recompressOutput, "output", "o", types.Stdio, "The file where the image JSON file is written")
+}
@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/nlewo/nix2container/nix"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var reproduceSkopeo string
+var reproduceNix string
+
+var reproduceCmd = &cobra.Command{
+	Use:   "reproduce REFERENCE",
+	Short: "Build a published image again and compare its digests",
+	Long: `Build a published image again and compare its digests.
+
+The rebuild instructions (flake, attribute and system) are read from
+the labels of the image REFERENCE, such as
+docker://registry.example.com/app:1.0, fetched with skopeo. The image
+is then built with nix build and the command fails if the manifest or
+configuration digests of the rebuilt image differ.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := reproduce(cmd, args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+	},
+}
+
+func reproduce(cmd *cobra.Command, ref string) error {
+	result, err := nix.Reproduce(cmd.Context(), ref, reproduceSkopeo, reproduceNix)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("manifest: %s (rebuilt: %s)\n", result.ManifestDigest, result.RebuiltManifestDigest)
+	fmt.Printf("config:   %s (rebuilt: %s)\n", result.ConfigDigest, result.RebuiltConfigDigest)
+	if !result.Reproducible() {
+		return fmt.Errorf("The image %s is not reproducible from %s#%s: %w", ref, result.Rebuild.Flake, result.Rebuild.Attribute, nix.ErrDigestMismatch)
+	}
+	logrus.Infof("The image %s has been reproduced", ref)
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(reproduceCmd)
+	reproduceCmd.Flags().StringVarP(&reproduceSkopeo, "skopeo", "", "skopeo", "The skopeo command fetching the image manifest and configuration")
+	reproduceCmd.Flags().StringVarP(&reproduceNix, "nix", "", "nix", "The nix command building the image")
+}
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/nlewo/nix2container/nix"
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var digestFilename string
+var destinations []string
+var uploadReportFilename string
+
+var resultCmd = &cobra.Command{
+	Use:   "result OUTPUT-FILENAME.JSON IMAGE.JSON",
+	Short: "Write a JSON file describing the result of the copy of an image",
+	Long: `Write a JSON file describing the result of the copy of an image.
+
+The manifest digest is read from the file written by the Skopeo
+--digestfile option. With --upload-report, the file written by the
+nix transport when the NIX2CONTAINER_UPLOAD_REPORT environment variable
+is set, the bytes uploaded and reused for each layer are also recorded
+and logged.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := result(args[0], args[1], digestFilename, destinations)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+	},
+}
+
+func result(outputFilename, imageFilename, digestFilename string, destinations []string) error {
+	image, err := nix.NewImageFromFile(imageFilename)
+	if err != nil {
+		return err
+	}
+	content, err := types.ReadFile(digestFilename)
+	if err != nil {
+		return err
+	}
+	digest, err := godigest.Parse(strings.TrimSpace(string(content)))
+	if err != nil {
+		return fmt.Errorf("The digest file %s doesn't contain a valid digest: %w", digestFilename, err)
+	}
+	r, err := nix.NewResult(image, digest, destinations)
+	if err != nil {
+		return err
+	}
+	if uploadReportFilename != "" {
+		uploads, err := nix.ReadUploadReport(uploadReportFilename)
+		if err != nil {
+			return err
+		}
+		nix.SetResultUploads(&r, uploads)
+		nix.LogResultUploads(r)
+	}
+	res, err := types.MarshalCanonical(r)
+	if err != nil {
+		return err
+	}
+	err = types.WriteFile(outputFilename, []byte(res))
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Result has been written to %s", outputFilename)
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(resultCmd)
+	resultCmd.Flags().StringVarP(&digestFilename, "digest-file", "", "", "A file containing the digest of the copied manifest")
+	resultCmd.Flags().StringSliceVarP(&destinations, "destination", "", nil, "The destination the image has been copied to")
+	resultCmd.Flags().StringVarP(&uploadReportFilename, "upload-report", "", "", "The upload report written by the nix transport")
+	resultCmd.MarkFlagRequired("digest-file")
+}
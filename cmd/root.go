@@ -1,25 +1,140 @@
 package cmd
 
 import (
+	"context"
+	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/nlewo/nix2container/metrics"
+	"github.com/nlewo/nix2container/nix"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
+var metricsFilename string
+var traceFilename string
+var httpOptions nix.HTTPOptions
+var statusAddress string
+var statusLinger time.Duration
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "container2nix",
 	Short: "Generate container image from Nix storepaths",
+	Long: `Generate container image from Nix storepaths.
+
+The filename "-" designates the standard input for JSON files read by
+commands, and the standard output for files written by commands.
+
+Commands exit with a code depending on the class of the failure:
+  1  other failures
+  3  conflict, such as a file provided by several store paths with
+     different attributes
+  4  credentials rejected by a server
+  5  missing blob
+  6  blob not matching its digest or its size
+  7  input which can not be archived reproducibly (with --strict-repro)
+
+Blobs of pinned layers and remote digest caches are fetched through the
+proxy set by the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment
+variables. The --http-* options apply to these requests and to the
+blobs read from and uploaded to registries by nix2container, but not to
+the other registry requests, such as the manifest ones, which are sent
+by containers/image.
+
+File trees are walked ahead of the archive generation, reading the
+attributes of NIX2CONTAINER_WALK_CONCURRENCY files (16 by default) at
+the same time, which speeds up network filesystems and slow disks.
+
+The compression command recorded in a layer (see --compression-command)
+is never run as is when its blob is generated: the same command has to
+be set in the NIX2CONTAINER_COMPRESSION_COMMAND environment variable.
+
+With --status-address (or NIX2CONTAINER_STATUS_ADDRESS), a loopback
+address such as 127.0.0.1:9080, the status of the command (current layers, bytes
+processed, ETA) is served as JSON on this address, so that CI plugins
+can poll it instead of parsing logs.`,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		if err := nix.ConfigureFromEnv(); err != nil {
+			logrus.Errorf("%s", err)
+			os.Exit(1)
+		}
+		nix.SetHTTPOptions(httpOptions)
+		if traceFilename != "" {
+			metrics.EnableTrace(cmd.Name())
+		}
+		if statusAddress != "" {
+			metrics.EnableStatus(cmd.Name())
+			address, err := metrics.ServeStatus(context.Background(), statusAddress)
+			if err != nil {
+				logrus.Errorf("Could not serve the status on %s: %s", statusAddress, err)
+				os.Exit(1)
+			}
+			logrus.Infof("The status is served on http://%s", address)
+		}
+	},
+	PersistentPostRun: func(cmd *cobra.Command, args []string) {
+		finishStatus(nil)
+	},
+}
+
+// finishStatus finishes the status, as failed if err is not nil, and
+// keeps serving it during --status-linger.
+func finishStatus(err error) {
+	if statusAddress != "" {
+		metrics.FinishStatus(err)
+		// Let pollers see the final status
+		time.Sleep(statusLinger)
+	}
+}
+
+// writeMetrics writes the --metrics-file and the --trace-file, if they
+// are set, once the command finished, as failed if err is not nil.
+func writeMetrics(err error) error {
+	if metricsFilename != "" {
+		if err := metrics.WriteFile(metricsFilename); err != nil {
+			return fmt.Errorf("Could not write metrics to %s: %w", metricsFilename, err)
+		}
+	}
+	if traceFilename != "" {
+		metrics.FinishTrace(err)
+		if err := metrics.WriteTraceFile(traceFilename); err != nil {
+			return fmt.Errorf("Could not write the trace to %s: %w", traceFilename, err)
+		}
+	}
+	return nil
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
+//
+// The command context is cancelled on SIGINT and SIGTERM in order to
+// stop in-flight tar operations and remove partially written files.
 func Execute() {
-	err := rootCmd.Execute()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err := rootCmd.ExecuteContext(ctx)
+	stop()
+	if err := writeMetrics(err); err != nil {
+		logrus.Errorf("%s", err)
+		os.Exit(1)
+	}
 	if err != nil {
 		os.Exit(1)
 	}
 }
 
 func init() {
+	rootCmd.PersistentFlags().StringVarP(&metricsFilename, "metrics-file", "", "", "Write metrics in the Prometheus text format to this file")
+	rootCmd.PersistentFlags().StringVarP(&traceFilename, "trace-file", "", "", "Write the spans of the layer builds and blob uploads in the OpenTelemetry OTLP/JSON format to this file")
+	rootCmd.PersistentFlags().StringVarP(&statusAddress, "status-address", "", os.Getenv("NIX2CONTAINER_STATUS_ADDRESS"), "Serve the status of the command as JSON on this loopback address, such as 127.0.0.1:9080")
+	rootCmd.PersistentFlags().DurationVarP(&statusLinger, "status-linger", "", 0, "Keep serving the final status during this duration once the command finished")
+	// The flags default to the environment variables also read by
+	// the nix transport
+	defaults, _ := nix.HTTPOptionsFromEnv()
+	rootCmd.PersistentFlags().DurationVarP(&httpOptions.DialTimeout, "http-dial-timeout", "", defaults.DialTimeout, "The timeout of HTTP connections (30s by default, "+nix.HTTPDialTimeoutEnv+")")
+	rootCmd.PersistentFlags().DurationVarP(&httpOptions.KeepAlive, "http-keep-alive", "", defaults.KeepAlive, "The interval between keep-alive probes of HTTP connections, a negative value disables keep-alive (30s by default, "+nix.HTTPKeepAliveEnv+")")
+	rootCmd.PersistentFlags().IntVarP(&httpOptions.MaxIdleConns, "http-max-idle-conns", "", defaults.MaxIdleConns, "The maximal number of idle HTTP connections (100 by default, "+nix.HTTPMaxIdleConnsEnv+")")
 }
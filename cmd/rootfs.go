@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/nlewo/nix2container/nix"
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var rootfsFormat string
+var rootfsSize string
+var mkfsCommand string
+var rootfsResultFilename string
+
+var rootfsCmd = &cobra.Command{
+	Use:   "rootfs IMAGE.JSON OUTPUT",
+	Short: "Write the files of an image into an ext4, erofs or squashfs filesystem image",
+	Long: `Write the files of an image into an ext4, erofs or squashfs filesystem image.
+
+The layers of the image are applied and the resulting archive is
+written into the filesystem by mkfs.ext4 (which must support tarballs,
+e2fsprogs >= 1.47.1), mkfs.erofs or mksquashfs (squashfs-tools >= 4.6).
+Timestamps and UUIDs of the filesystem are fixed, for instance to
+build reproducible microVM root filesystems or appliance images.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := rootfs(cmd, args[0], args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+	},
+}
+
+func rootfs(cmd *cobra.Command, imageFilename, output string) error {
+	image, err := nix.NewImageFromFile(imageFilename)
+	if err != nil {
+		return err
+	}
+	var size int64
+	if rootfsSize != "" {
+		size, err = nix.ParseByteSize(rootfsSize)
+		if err != nil {
+			return err
+		}
+	}
+	mkfs := mkfsCommand
+	if mkfs == "" {
+		mkfs = "mkfs." + rootfsFormat
+		if rootfsFormat == nix.RootfsSquashfs {
+			mkfs = "mksquashfs"
+		}
+	}
+	err = nix.WriteRootfs(cmd.Context(), image, rootfsFormat, size, mkfs, output)
+	if err != nil {
+		return err
+	}
+	if rootfsResultFilename == "" {
+		return nil
+	}
+	f, err := os.Open(output)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	digest, err := godigest.FromReader(f)
+	if err != nil {
+		return err
+	}
+	res, err := types.MarshalCanonical(types.RootfsResult{
+		Format: rootfsFormat,
+		Digest: digest.String(),
+		Size:   info.Size(),
+	})
+	if err != nil {
+		return err
+	}
+	err = types.WriteFile(rootfsResultFilename, res)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Result has been written to %s", rootfsResultFilename)
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(rootfsCmd)
+	rootfsCmd.Flags().StringVarP(&rootfsFormat, "format", "", nix.RootfsExt4, "The filesystem format (ext4, erofs or squashfs)")
+	rootfsCmd.Flags().StringVarP(&rootfsSize, "size", "", "", "The size of the ext4 filesystem image (such as 512M)")
+	rootfsCmd.Flags().StringVarP(&mkfsCommand, "mkfs", "", "", "The command creating the filesystem (mkfs.ext4, mkfs.erofs or mksquashfs by default)")
+	rootfsCmd.Flags().StringVarP(&rootfsResultFilename, "result", "", "", "Write the digest and the size of the filesystem image to this JSON file")
+}
@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/nlewo/nix2container/nix"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var scanLayoutDirectory string
+var scanAttach bool
+var scanArtifactType string
+var scanResultMediaType string
+var scanPush string
+var scanDestCreds string
+var scanDestTLSVerify bool
+
+var scanCmd = &cobra.Command{
+	Use:   "scan IMAGE.JSON -- COMMAND ARGS...",
+	Short: "Run a scanner on the OCI image layout of an image",
+	Long: `Run a scanner on the OCI image layout of an image.
+
+The image is written into an OCI image layout: the {} arguments of the
+command are replaced by the layout directory, which is also available
+in the OCI_LAYOUT environment variable. For instance:
+
+  nix2container scan image.json -- grype oci-dir:{} --fail-on high
+
+The scan fails if the command fails. With --attach, the standard
+output of the command is attached to the image as an OCI referrer in
+the layout (even if the scan fails). With --push, this referrer is
+also pushed to the repository of the destination, such as
+docker://registry.example.com/app, where the image has to be pushed.`,
+	Args: cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := scan(cmd, args[0], args[1:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+	},
+}
+
+func scan(cmd *cobra.Command, imageFilename string, command []string) error {
+	image, err := nix.NewImageFromFile(imageFilename)
+	if err != nil {
+		return err
+	}
+	directory := scanLayoutDirectory
+	if directory == "" {
+		directory, err = ioutil.TempDir("", "nix2container-scan-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(directory)
+	}
+	desc, err := nix.WriteOCILayout(cmd.Context(), image, directory, "latest")
+	if err != nil {
+		return err
+	}
+
+	var args []string
+	for _, arg := range command[1:] {
+		args = append(args, strings.ReplaceAll(arg, "{}", directory))
+	}
+	logrus.Infof("Running the scanner %s", command[0])
+	var result bytes.Buffer
+	c := exec.CommandContext(cmd.Context(), command[0], args...)
+	c.Env = append(os.Environ(), "OCI_LAYOUT="+directory)
+	c.Stdout = io.MultiWriter(os.Stdout, &result)
+	c.Stderr = os.Stderr
+	scanErr := c.Run()
+
+	if scanAttach {
+		referrer, err := nix.AddOCILayoutReferrer(directory, desc, scanArtifactType, scanResultMediaType, result.Bytes())
+		if err != nil {
+			return err
+		}
+		logrus.Infof("The scan result has been attached to the image as %s", referrer.Digest)
+	}
+	if scanPush != "" {
+		sys, err := registrySystemContext(scanDestCreds, scanDestTLSVerify)
+		if err != nil {
+			return err
+		}
+		referrer, err := nix.PushReferrer(cmd.Context(), sys, scanPush, desc, scanArtifactType, scanResultMediaType, result.Bytes())
+		if err != nil {
+			return err
+		}
+		logrus.Infof("The scan result has been pushed to %s as %s", scanPush, referrer.Digest)
+	}
+	if scanErr != nil {
+		return fmt.Errorf("The scanner %s failed: %w", command[0], scanErr)
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(scanCmd)
+	scanCmd.Flags().StringVarP(&scanLayoutDirectory, "oci-layout", "", "", "The OCI image layout directory to keep (a temporary directory is used by default)")
+	scanCmd.Flags().BoolVarP(&scanAttach, "attach", "", false, "Attach the scanner output to the image as an OCI referrer")
+	scanCmd.Flags().StringVarP(&scanArtifactType, "artifact-type", "", "application/vnd.nix2container.scan.v1", "The artifact type of the attached scan result")
+	scanCmd.Flags().StringVarP(&scanResultMediaType, "result-media-type", "", "application/json", "The media type of the scanner output")
+	scanCmd.Flags().StringVarP(&scanPush, "push", "", "", "Push the scanner output as an OCI referrer of the image to this destination")
+	scanCmd.Flags().StringVarP(&scanDestCreds, "dest-creds", "", "", "The USERNAME:PASSWORD used to access the registry")
+	scanCmd.Flags().BoolVarP(&scanDestTLSVerify, "dest-tls-verify", "", true, "Require HTTPS and verify certificates when talking to the registry")
+}
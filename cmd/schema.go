@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/nlewo/nix2container/types"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var schemaCmd = &cobra.Command{
+	Use:   "schema image|layer",
+	Short: "Print the JSON Schema of image or layer JSON files",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		switch args[0] {
+		case "image":
+			os.Stdout.Write(types.ImageSchema())
+		case "layer":
+			os.Stdout.Write(types.LayerSchema())
+		default:
+			err := fmt.Errorf("Unknown schema %q: it must be 'image' or 'layer'", args[0])
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+	},
+}
+
+var validateCmd = &cobra.Command{
+	Use:   "validate image|layers FILENAME.JSON",
+	Short: "Validate an image JSON file or a layers JSON file",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := validate(args[0], args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+	},
+}
+
+func validate(kind, filename string) error {
+	content, err := types.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	switch kind {
+	case "image":
+		image, err := types.ValidateImage(content)
+		if err != nil {
+			return fmt.Errorf("The image %s is not valid: %w", filename, err)
+		}
+		logrus.Infof("The image %s is valid (%d layers)", filename, len(image.Layers))
+	case "layers":
+		layers, err := types.ValidateLayers(content)
+		if err != nil {
+			return fmt.Errorf("The layers file %s is not valid: %w", filename, err)
+		}
+		logrus.Infof("The layers file %s is valid (%d layers)", filename, len(layers))
+	default:
+		return fmt.Errorf("Unknown file type %q: it must be 'image' or 'layers'", kind)
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(schemaCmd)
+	rootCmd.AddCommand(validateCmd)
+}
@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/nlewo/nix2container/nix"
+	"github.com/spf13/cobra"
+)
+
+var tagCreds string
+var tagTLSVerify bool
+
+var tagCmd = &cobra.Command{
+	Use:   "tag DESTINATION TAG...",
+	Short: "Add tags to an image already pushed to a registry",
+	Long: `Add tags to an image already pushed to a registry.
+
+The manifest of the DESTINATION (such as docker://registry/app:v1.2.3)
+is put once per TAG, without checking the blobs again. Tags can also be
+given as a list, such as :v1.2,:latest.`,
+	Args: cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := tag(cmd, args[0], args[1:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+	},
+}
+
+func tag(cmd *cobra.Command, destination string, args []string) error {
+	_, tags, err := nix.ParseDestinationTags(destination + "," + strings.Join(args, ","))
+	if err != nil {
+		return err
+	}
+	sys, err := registrySystemContext(tagCreds, tagTLSVerify)
+	if err != nil {
+		return err
+	}
+	return nix.TagImage(cmd.Context(), sys, destination, tags)
+}
+
+func init() {
+	rootCmd.AddCommand(tagCmd)
+	tagCmd.Flags().StringVarP(&tagCreds, "creds", "", "", "The USERNAME:PASSWORD used to access the registry")
+	tagCmd.Flags().BoolVarP(&tagTLSVerify, "tls-verify", "", true, "Require HTTPS and verify certificates when talking to the registry")
+}
@@ -2,13 +2,19 @@ package cmd
 
 import (
 	"encoding/json"
-	"io/ioutil"
+	"fmt"
+	"regexp"
+	"strings"
 
+	imageTypes "github.com/containers/image/v5/types"
+	"github.com/nlewo/nix2container/metrics"
+	"github.com/nlewo/nix2container/nix"
 	"github.com/nlewo/nix2container/types"
+	"github.com/sirupsen/logrus"
 )
 
 func readPermsFile(filename string) (permPaths []types.PermPath, err error) {
-	content, err := ioutil.ReadFile(filename)
+	content, err := types.ReadFile(filename)
 	if err != nil {
 		return permPaths, err
 	}
@@ -16,5 +22,80 @@ func readPermsFile(filename string) (permPaths []types.PermPath, err error) {
 	if err != nil {
 		return permPaths, err
 	}
+	for _, perm := range permPaths {
+		if _, err := regexp.Compile(perm.Regex); err != nil {
+			return permPaths, fmt.Errorf("Invalid regex %q of the perms of %s: %w", perm.Regex, perm.Path, err)
+		}
+	}
 	return 
 }
+
+// registrySystemContext returns the context used to talk to registries
+// with the USERNAME:PASSWORD credentials.
+func registrySystemContext(creds string, tlsVerify bool) (*imageTypes.SystemContext, error) {
+	sys := &imageTypes.SystemContext{
+		DockerInsecureSkipTLSVerify: imageTypes.NewOptionalBool(!tlsVerify),
+	}
+	if creds != "" {
+		elts := strings.SplitN(creds, ":", 2)
+		if len(elts) != 2 {
+			return nil, fmt.Errorf("The credentials must be USERNAME:PASSWORD")
+		}
+		sys.DockerAuthConfig = &imageTypes.DockerAuthConfig{Username: elts[0], Password: elts[1]}
+	}
+	return sys, nil
+}
+
+// reportPathDuplicates warns about the store paths added to several
+// layers and the size they waste.
+func reportPathDuplicates(layers []types.Layer) {
+	var wasted int64
+	duplicates := nix.FindPathDuplicates(layers)
+	for _, d := range duplicates {
+		logrus.Warnf("The path %s is added by several layers (%s), wasting %s", d.Path, strings.Join(d.Layers, ", "), nix.FormatByteSize(d.Wasted()))
+		wasted += d.Wasted()
+	}
+	if len(duplicates) > 0 {
+		logrus.Warnf("%d store paths are added by several layers, wasting %s: they can be removed from the upper layers by the image command with --hoist-duplicates (hoistDuplicates of buildImage)", len(duplicates), nix.FormatByteSize(wasted))
+	}
+}
+
+// startBuildStatus starts the building phase of the status with the
+// layers generated by build-all.
+func startBuildStatus(shared []nix.SharedLayer) {
+	var layers []types.Layer
+	for _, s := range shared {
+		if s.Layer.LayerPath == "" && s.Layer.Paths != nil {
+			layers = append(layers, s.Layer)
+		}
+	}
+	metrics.StartStatusPhase(metrics.PhaseBuilding, len(layers), statusBytesTotal(layers))
+}
+
+// startPushStatus starts the pushing phase of the status with the
+// layers of the image whose blob can be read.
+func startPushStatus(image types.Image) {
+	var layers []types.Layer
+	seen := make(map[string]bool)
+	for _, layer := range image.Layers {
+		if seen[layer.Digest] || (layer.Pinned && len(layer.URLs) == 0) {
+			continue
+		}
+		seen[layer.Digest] = true
+		layers = append(layers, layer)
+	}
+	metrics.StartStatusPhase(metrics.PhasePushing, len(layers), statusBytesTotal(layers))
+}
+
+// statusBytesTotal returns the size of the layers, or 0 if the size
+// of one of them is unknown: the ETA is then computed from the number
+// of layers.
+func statusBytesTotal(layers []types.Layer) (total int64) {
+	for _, layer := range layers {
+		if layer.Size <= 0 {
+			return 0
+		}
+		total += layer.Size
+	}
+	return total
+}
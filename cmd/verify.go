@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/nlewo/nix2container/nix"
+	"github.com/nlewo/nix2container/types"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var verifyCreds string
+var verifyTLSVerify bool
+var verifyJSON bool
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify IMAGE.JSON REFERENCE",
+	Short: "Verify a registry image matches the image built by Nix",
+	Long: `Verify a registry image matches the image built by Nix.
+
+The configuration, the layer digests and the diff IDs of the registry
+image REFERENCE (such as docker://registry/app@sha256:...) are
+compared to the ones of the local image, proving that the image
+running in production is the one built by Nix. The differences are
+reported and the command fails if there is any. For instance:
+
+  nix2container verify image.json docker://registry/app@sha256:...
+
+With --json, the result is written as JSON to the standard output.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := verify(cmd, args[0], args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+	},
+}
+
+func verify(cmd *cobra.Command, imageFilename, reference string) error {
+	image, err := nix.NewImageFromFile(imageFilename)
+	if err != nil {
+		return err
+	}
+	sys, err := registrySystemContext(verifyCreds, verifyTLSVerify)
+	if err != nil {
+		return err
+	}
+	result, err := nix.VerifyImage(cmd.Context(), sys, image, reference)
+	if err != nil {
+		return err
+	}
+	if verifyJSON {
+		content, err := types.MarshalCanonical(result)
+		if err != nil {
+			return err
+		}
+		if err := types.WriteFile(types.Stdio, append(content, '\n')); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("config: %s (local: %s)\n", result.ConfigDigest, result.LocalConfigDigest)
+		for _, m := range result.Mismatches {
+			switch m.Kind {
+			case "config":
+				fmt.Printf("mismatch\t%s\t%s (local: %s)\n", m.Field, m.Remote, m.Local)
+			case "layer-count":
+				fmt.Printf("mismatch\tlayers\t%s (local: %s)\n", m.Remote, m.Local)
+			default:
+				fmt.Printf("mismatch\t%s %d\t%s (local: %s)\n", m.Kind, m.Index, m.Remote, m.Local)
+			}
+		}
+	}
+	if !result.Verified() {
+		return fmt.Errorf("The image %s doesn't match %s: %d differences: %w", reference, imageFilename, len(result.Mismatches), nix.ErrDigestMismatch)
+	}
+	logrus.Infof("The image %s matches %s (%d layers)", reference, imageFilename, result.Layers)
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+	verifyCmd.Flags().StringVarP(&verifyCreds, "creds", "", "", "The USERNAME:PASSWORD used to access the registry")
+	verifyCmd.Flags().BoolVarP(&verifyTLSVerify, "tls-verify", "", true, "Require HTTPS and verify certificates when talking to the registry")
+	verifyCmd.Flags().BoolVarP(&verifyJSON, "json", "", false, "Write the result as JSON")
+}
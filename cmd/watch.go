@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/nlewo/nix2container/nix"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var watchDestination string
+var watchInterval time.Duration
+var watchSkopeo string
+var watchPolicy string
+var watchRegistriesDir string
+
+var watchCmd = &cobra.Command{
+	Use:   "watch IMAGE.JSON --to DESTINATION [-- SKOPEO-ARGS...]",
+	Short: "Copy an image each time its JSON file changes",
+	Long: `Copy an image each time its JSON file changes.
+
+The image is copied to the DESTINATION (such as
+containers-storage:localhost/app:dev) with skopeo, which has to
+support the nix transport, when the command starts and each time the
+image JSON file changes, for instance when the result symlink is
+updated by nix build. Layers already present on the destination are
+not copied again. Arguments after -- are passed to skopeo copy.
+
+Signatures are only checked with --policy, a containers-policy.json
+file or "system" for /etc/containers/policy.json: the policy has to
+accept the nix transport.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := watch(cmd, args[0], args[1:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			fail(err)
+		}
+	},
+}
+
+func watch(cmd *cobra.Command, imageFilename string, skopeoArgs []string) error {
+	if watchDestination == "" {
+		return fmt.Errorf("The destination is required (--to)")
+	}
+	return nix.WatchFile(cmd.Context(), imageFilename, watchInterval, func(target string) error {
+		// The image is validated before running skopeo
+		if _, err := nix.NewImageFromFile(target); err != nil {
+			return err
+		}
+		args := append(nix.SkopeoPolicyArgs(watchPolicy, watchRegistriesDir), "copy")
+		args = append(args, skopeoArgs...)
+		args = append(args, "nix:"+target, watchDestination)
+		c := exec.CommandContext(cmd.Context(), watchSkopeo, args...)
+		c.Stdout = os.Stderr
+		c.Stderr = os.Stderr
+		if err := c.Run(); err != nil {
+			return fmt.Errorf("Could not copy the image %s to %s: %w", target, watchDestination, err)
+		}
+		logrus.Infof("The image %s has been copied to %s", target, watchDestination)
+		return nil
+	})
+}
+
+func init() {
+	rootCmd.AddCommand(watchCmd)
+	watchCmd.Flags().StringVarP(&watchDestination, "to", "", "", "The destination the image is copied to, such as containers-storage:localhost/app:dev")
+	watchCmd.Flags().DurationVarP(&watchInterval, "interval", "", time.Second, "The interval between two checks of the image JSON file")
+	watchCmd.Flags().StringVarP(&watchSkopeo, "skopeo", "", "skopeo", "The skopeo command, which has to support the nix transport")
+	watchCmd.Flags().StringVarP(&watchPolicy, "policy", "", os.Getenv(nix.PolicyEnv), "The signature policy file enforced by skopeo (\"system\" for /etc/containers/policy.json)")
+	watchCmd.Flags().StringVarP(&watchRegistriesDir, "registries.d", "", os.Getenv(nix.RegistriesDirEnv), "The registries.d directory configuring where signatures are looked up")
+}
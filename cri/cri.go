@@ -0,0 +1,414 @@
+// Package cri implements a shim serving the CRI ImageService gRPC API
+// (see Serve) backed by image JSON files, so that Kubernetes nodes can
+// run Nix-built images without any registry.
+//
+// Container runtimes create containers from the images of their own
+// storage: the shim is meant to be used with a runtime sharing the
+// containers storage, such as CRI-O, the kubelet being configured with
+// the shim as image service endpoint. Pulled images are then read from
+// their JSON files and copied into this storage with the name they are
+// pulled with.
+package cri
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/signature"
+	istorage "github.com/containers/image/v5/storage"
+	"github.com/containers/storage"
+	"github.com/nlewo/nix2container/daemon"
+	"github.com/nlewo/nix2container/nix"
+	"github.com/nlewo/nix2container/transport"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The names of the ImageService of the CRI versions served by the
+// shim. Their messages are the same.
+var serviceNames = []string{"runtime.v1.ImageService", "runtime.v1alpha2.ImageService"}
+
+// Options configure a Server.
+type Options struct {
+	// The JSON file mapping the names of the images, such as
+	// registry.example.com/app:1.0, to their image JSON files. It is
+	// read again on each pull, so that images can be added without
+	// restarting the shim.
+	Images string
+	// The signature policy file of the pulled images. All images are
+	// accepted if it is empty.
+	Policy string
+}
+
+// imageStore is the part of the containers storage used by the
+// ImageService.
+type imageStore interface {
+	GraphRoot() string
+	Images() ([]storage.Image, error)
+	Image(id string) (*storage.Image, error)
+	ImageSize(id string) (int64, error)
+	DeleteImage(id string, commit bool) (layers []string, err error)
+}
+
+// Server is an ImageService backed by image JSON files.
+type Server struct {
+	images string
+	store  imageStore
+	// pull copies the image JSON file into the storage with the
+	// name, it is replaced by tests
+	pull func(ctx context.Context, name, imageFilename string) error
+}
+
+// NewServer returns a Server copying the pulled images into the
+// containers storage store.
+func NewServer(store storage.Store, opts Options) (*Server, error) {
+	if opts.Images == "" {
+		return nil, fmt.Errorf("The CRI shim requires an images file")
+	}
+	policy := &signature.Policy{Default: []signature.PolicyRequirement{signature.NewPRInsecureAcceptAnything()}}
+	if opts.Policy != "" {
+		var err error
+		policy, err = signature.NewPolicyFromFile(opts.Policy)
+		if err != nil {
+			return nil, err
+		}
+	}
+	pull := func(ctx context.Context, name, imageFilename string) error {
+		srcRef, err := transport.NewReference(imageFilename)
+		if err != nil {
+			return err
+		}
+		destRef, err := istorage.Transport.ParseStoreReference(store, name)
+		if err != nil {
+			return err
+		}
+		policyContext, err := signature.NewPolicyContext(policy)
+		if err != nil {
+			return err
+		}
+		defer policyContext.Destroy()
+		_, err = copy.Image(ctx, policyContext, destRef, srcRef, &copy.Options{})
+		return err
+	}
+	return &Server{images: opts.Images, store: store, pull: pull}, nil
+}
+
+// normalizeName returns the fully qualified name of the image, with
+// the latest tag if it has neither tag nor digest, as the kubelet and
+// the containers storage do.
+func normalizeName(name string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return "", fmt.Errorf("Invalid image name %s: %w", name, err)
+	}
+	return reference.TagNameOnly(named).String(), nil
+}
+
+// imageFiles reads the images file, whose names are normalized.
+func (s *Server) imageFiles() (map[string]string, error) {
+	content, err := ioutil.ReadFile(s.images)
+	if err != nil {
+		return nil, err
+	}
+	var images map[string]string
+	if err := json.Unmarshal(content, &images); err != nil {
+		return nil, fmt.Errorf("Could not parse the images file %s: %w", s.images, err)
+	}
+	normalized := make(map[string]string)
+	for name, filename := range images {
+		n, err := normalizeName(name)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid image of the images file %s: %w", s.images, err)
+		}
+		normalized[n] = filename
+	}
+	return normalized, nil
+}
+
+// image returns the image of the storage designated by spec, an image
+// ID or name, or nil if it is not in the storage.
+func (s *Server) image(spec *ImageSpec) (*storage.Image, error) {
+	if spec == nil || spec.Image == "" {
+		return nil, status.Error(codes.InvalidArgument, "An image is required")
+	}
+	image, err := s.store.Image(spec.Image)
+	if errors.Is(err, storage.ErrImageUnknown) {
+		name, nerr := normalizeName(spec.Image)
+		if nerr != nil {
+			return nil, nil
+		}
+		image, err = s.store.Image(name)
+	}
+	if errors.Is(err, storage.ErrImageUnknown) {
+		return nil, nil
+	}
+	return image, err
+}
+
+// parseUser returns the UID of the user of an image configuration if
+// it is numeric, and its name otherwise.
+func parseUser(user string) (*int64, string) {
+	user = strings.SplitN(user, ":", 2)[0]
+	if user == "" {
+		return nil, ""
+	}
+	uid, err := strconv.ParseInt(user, 10, 64)
+	if err != nil {
+		return nil, user
+	}
+	return &uid, ""
+}
+
+// criImage describes the image of the storage. The user of the image
+// is read from its image JSON file, if it is in the images file.
+func (s *Server) criImage(image *storage.Image, files map[string]string) (*Image, error) {
+	size, err := s.store.ImageSize(image.ID)
+	if err != nil {
+		return nil, err
+	}
+	i := &Image{
+		ID:          image.ID,
+		RepoTags:    []string{},
+		RepoDigests: []string{},
+		Size:        uint64(size),
+		Spec:        &ImageSpec{Image: image.ID},
+	}
+	var user string
+	for _, name := range image.Names {
+		i.RepoTags = append(i.RepoTags, name)
+		if image.Digest != "" {
+			named, err := reference.ParseNormalizedNamed(name)
+			if err == nil {
+				i.RepoDigests = append(i.RepoDigests, named.Name()+"@"+image.Digest.String())
+			}
+		}
+		if filename, ok := files[name]; ok && user == "" {
+			config, err := nix.NewImageFromFile(filename)
+			if err != nil {
+				return nil, err
+			}
+			user = config.ImageConfig.User
+		}
+	}
+	i.UID, i.Username = parseUser(user)
+	if i.UID == nil && i.Username == "" {
+		// Images without user are run as root
+		root := int64(0)
+		i.UID = &root
+	}
+	return i, nil
+}
+
+// ListImages lists the images of the storage, or the image of the
+// filter.
+func (s *Server) ListImages(ctx context.Context, req *ListImagesRequest) (*ListImagesResponse, error) {
+	files, err := s.imageFiles()
+	if err != nil {
+		return nil, err
+	}
+	var images []storage.Image
+	if req.Filter != nil && req.Filter.Image != "" {
+		image, err := s.image(req.Filter)
+		if err != nil {
+			return nil, err
+		}
+		if image != nil {
+			images = append(images, *image)
+		}
+	} else {
+		images, err = s.store.Images()
+		if err != nil {
+			return nil, err
+		}
+	}
+	resp := &ListImagesResponse{}
+	for i := range images {
+		image, err := s.criImage(&images[i], files)
+		if err != nil {
+			return nil, err
+		}
+		resp.Images = append(resp.Images, image)
+	}
+	return resp, nil
+}
+
+// ImageStatus returns the status of the image, without image if it is
+// not in the storage.
+func (s *Server) ImageStatus(ctx context.Context, req *ImageStatusRequest) (*ImageStatusResponse, error) {
+	image, err := s.image(req.Image)
+	if err != nil || image == nil {
+		return &ImageStatusResponse{}, err
+	}
+	files, err := s.imageFiles()
+	if err != nil {
+		return nil, err
+	}
+	i, err := s.criImage(image, files)
+	if err != nil {
+		return nil, err
+	}
+	return &ImageStatusResponse{Image: i}, nil
+}
+
+// PullImage copies the image JSON file of the image name, listed in
+// the images file, into the storage.
+func (s *Server) PullImage(ctx context.Context, req *PullImageRequest) (*PullImageResponse, error) {
+	if req.Image == nil || req.Image.Image == "" {
+		return nil, status.Error(codes.InvalidArgument, "An image is required")
+	}
+	name, err := normalizeName(req.Image.Image)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	files, err := s.imageFiles()
+	if err != nil {
+		return nil, err
+	}
+	filename, ok := files[name]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "The image %s is not in the images file %s", name, s.images)
+	}
+	logrus.Infof("Pulling the image %s from %s", name, filename)
+	if err := s.pull(ctx, name, filename); err != nil {
+		return nil, fmt.Errorf("Could not copy the image %s to the storage: %w", filename, err)
+	}
+	image, err := s.store.Image(name)
+	if err != nil {
+		return nil, err
+	}
+	return &PullImageResponse{ImageRef: image.ID}, nil
+}
+
+// RemoveImage removes the image from the storage. Removing an image
+// which is not in the storage is not an error.
+func (s *Server) RemoveImage(ctx context.Context, req *RemoveImageRequest) (*RemoveImageResponse, error) {
+	image, err := s.image(req.Image)
+	if err != nil || image == nil {
+		return &RemoveImageResponse{}, err
+	}
+	logrus.Infof("Removing the image %s", image.ID)
+	if _, err := s.store.DeleteImage(image.ID, true); err != nil && !errors.Is(err, storage.ErrImageUnknown) {
+		return nil, err
+	}
+	return &RemoveImageResponse{}, nil
+}
+
+// ImageFsInfo returns the size of the images of the storage.
+func (s *Server) ImageFsInfo(ctx context.Context, req *ImageFsInfoRequest) (*ImageFsInfoResponse, error) {
+	images, err := s.store.Images()
+	if err != nil {
+		return nil, err
+	}
+	var used uint64
+	for _, image := range images {
+		size, err := s.store.ImageSize(image.ID)
+		if err != nil {
+			return nil, err
+		}
+		used += uint64(size)
+	}
+	return &ImageFsInfoResponse{
+		ImageFilesystems: []*FilesystemUsage{{
+			Timestamp:  time.Now().UnixNano(),
+			Mountpoint: s.store.GraphRoot(),
+			UsedBytes:  used,
+		}},
+	}, nil
+}
+
+// unaryHandler returns the gRPC handler of a method, decoding its
+// request into newRequest() and calling call.
+func unaryHandler(fullMethod string, newRequest func() message, call func(s *Server, ctx context.Context, req message) (message, error)) func(interface{}, context.Context, func(interface{}) error, grpc.UnaryServerInterceptor) (interface{}, error) {
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+		req := newRequest()
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+			resp, err := call(srv.(*Server), ctx, req.(message))
+			if err != nil {
+				logrus.Warnf("%s failed: %s", fullMethod, err)
+			}
+			return resp, err
+		}
+		if interceptor == nil {
+			return handler(ctx, req)
+		}
+		info := &grpc.UnaryServerInfo{Server: srv, FullMethod: fullMethod}
+		return interceptor(ctx, req, info, handler)
+	}
+}
+
+// serviceDesc returns the description of the ImageService serviceName.
+func serviceDesc(serviceName string) *grpc.ServiceDesc {
+	method := func(name string, newRequest func() message, call func(s *Server, ctx context.Context, req message) (message, error)) grpc.MethodDesc {
+		return grpc.MethodDesc{
+			MethodName: name,
+			Handler:    unaryHandler("/"+serviceName+"/"+name, newRequest, call),
+		}
+	}
+	return &grpc.ServiceDesc{
+		ServiceName: serviceName,
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{
+			method("ListImages",
+				func() message { return &ListImagesRequest{} },
+				func(s *Server, ctx context.Context, req message) (message, error) {
+					return s.ListImages(ctx, req.(*ListImagesRequest))
+				}),
+			method("ImageStatus",
+				func() message { return &ImageStatusRequest{} },
+				func(s *Server, ctx context.Context, req message) (message, error) {
+					return s.ImageStatus(ctx, req.(*ImageStatusRequest))
+				}),
+			method("PullImage",
+				func() message { return &PullImageRequest{} },
+				func(s *Server, ctx context.Context, req message) (message, error) {
+					return s.PullImage(ctx, req.(*PullImageRequest))
+				}),
+			method("RemoveImage",
+				func() message { return &RemoveImageRequest{} },
+				func(s *Server, ctx context.Context, req message) (message, error) {
+					return s.RemoveImage(ctx, req.(*RemoveImageRequest))
+				}),
+			method("ImageFsInfo",
+				func() message { return &ImageFsInfoRequest{} },
+				func(s *Server, ctx context.Context, req message) (message, error) {
+					return s.ImageFsInfo(ctx, req.(*ImageFsInfoRequest))
+				}),
+		},
+		Metadata: "api.proto",
+	}
+}
+
+// Serve serves the ImageService on the Unix socket address
+// (unix:PATH), restricted to the user running the shim, until the
+// context is cancelled.
+func Serve(ctx context.Context, server *Server, address string) error {
+	l, err := daemon.Listen(address)
+	if err != nil {
+		return err
+	}
+	// The messages are encoded in protobuf whatever the content
+	// subtype of the requests
+	s := grpc.NewServer(grpc.ForceServerCodec(protoCodec{}))
+	for _, name := range serviceNames {
+		s.RegisterService(serviceDesc(name), server)
+	}
+	go func() {
+		<-ctx.Done()
+		s.GracefulStop()
+	}()
+	logrus.Infof("Serving the CRI ImageService on %s", address)
+	return s.Serve(l)
+}
@@ -0,0 +1,242 @@
+package cri
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/containers/storage"
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeStore is an in-memory containers storage.
+type fakeStore struct {
+	images []storage.Image
+}
+
+func (s *fakeStore) GraphRoot() string {
+	return "/var/lib/containers/storage"
+}
+
+func (s *fakeStore) Images() ([]storage.Image, error) {
+	return s.images, nil
+}
+
+func (s *fakeStore) Image(id string) (*storage.Image, error) {
+	for i, image := range s.images {
+		if image.ID == id {
+			return &s.images[i], nil
+		}
+		for _, name := range image.Names {
+			if name == id {
+				return &s.images[i], nil
+			}
+		}
+	}
+	return nil, storage.ErrImageUnknown
+}
+
+func (s *fakeStore) ImageSize(id string) (int64, error) {
+	return 100, nil
+}
+
+func (s *fakeStore) DeleteImage(id string, commit bool) ([]string, error) {
+	for i, image := range s.images {
+		if image.ID == id {
+			s.images = append(s.images[:i], s.images[i+1:]...)
+			return nil, nil
+		}
+	}
+	return nil, storage.ErrImageUnknown
+}
+
+func newTestServer(t *testing.T) (*Server, *fakeStore) {
+	dir := t.TempDir()
+	image := types.Image{ImageConfig: v1.ImageConfig{User: "1000:100"}}
+	content, err := json.Marshal(image)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	imageFilename := filepath.Join(dir, "image.json")
+	if err := ioutil.WriteFile(imageFilename, content, 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	images := filepath.Join(dir, "images.json")
+	if err := ioutil.WriteFile(images, []byte(fmt.Sprintf(`{"app:1.0": %q}`, imageFilename)), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	store := &fakeStore{}
+	server := &Server{
+		images: images,
+		store:  store,
+		pull: func(ctx context.Context, name, filename string) error {
+			if filename != imageFilename {
+				t.Fatalf("The pulled file should be '%s' (while it is %s)", imageFilename, filename)
+			}
+			store.images = append(store.images, storage.Image{
+				ID:     "abc",
+				Digest: godigest.Digest("sha256:def"),
+				Names:  []string{name},
+			})
+			return nil
+		},
+	}
+	return server, store
+}
+
+func TestPullImage(t *testing.T) {
+	server, _ := newTestServer(t)
+	ctx := context.Background()
+
+	status0, err := server.ImageStatus(ctx, &ImageStatusRequest{Image: &ImageSpec{Image: "app:1.0"}})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if status0.Image != nil {
+		t.Fatalf("The image should not be in the storage (while it is %#v)", status0.Image)
+	}
+
+	resp, err := server.PullImage(ctx, &PullImageRequest{Image: &ImageSpec{Image: "app:1.0"}})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if resp.ImageRef != "abc" {
+		t.Fatalf("The image ref should be 'abc' (while it is %s)", resp.ImageRef)
+	}
+
+	// The image is found by its ID and by its names
+	for _, name := range []string{"abc", "app:1.0", "docker.io/library/app:1.0"} {
+		s, err := server.ImageStatus(ctx, &ImageStatusRequest{Image: &ImageSpec{Image: name}})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		uid := int64(1000)
+		expected := &Image{
+			ID:          "abc",
+			RepoTags:    []string{"docker.io/library/app:1.0"},
+			RepoDigests: []string{"docker.io/library/app@sha256:def"},
+			Size:        100,
+			UID:         &uid,
+			Spec:        &ImageSpec{Image: "abc"},
+		}
+		if !reflect.DeepEqual(s.Image, expected) {
+			t.Fatalf("The status of %s should be '%#v' (while it is %#v)", name, expected, s.Image)
+		}
+	}
+
+	_, err = server.PullImage(ctx, &PullImageRequest{Image: &ImageSpec{Image: "other:1.0"}})
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("Pulling an image which is not in the images file should fail with NotFound (while it is %v)", err)
+	}
+}
+
+func TestListAndRemoveImages(t *testing.T) {
+	server, store := newTestServer(t)
+	ctx := context.Background()
+	if _, err := server.PullImage(ctx, &PullImageRequest{Image: &ImageSpec{Image: "app:1.0"}}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	store.images = append(store.images, storage.Image{ID: "xyz", Names: []string{"docker.io/library/nginx:latest"}})
+
+	list, err := server.ListImages(ctx, &ListImagesRequest{})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(list.Images) != 2 {
+		t.Fatalf("There should be '2' images (while there are %d)", len(list.Images))
+	}
+	// An image without user is run as root
+	if nginx := list.Images[1]; nginx.UID == nil || *nginx.UID != 0 {
+		t.Fatalf("The UID of an image without user should be '0' (while it is %v)", nginx.UID)
+	}
+	list, err = server.ListImages(ctx, &ListImagesRequest{Filter: &ImageSpec{Image: "nginx"}})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(list.Images) != 1 || list.Images[0].ID != "xyz" {
+		t.Fatalf("The filtered images should be '[xyz]' (while they are %#v)", list.Images)
+	}
+
+	fs, err := server.ImageFsInfo(ctx, &ImageFsInfoRequest{})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(fs.ImageFilesystems) != 1 || fs.ImageFilesystems[0].UsedBytes != 200 {
+		t.Fatalf("The used bytes should be '200' (while they are %#v)", fs.ImageFilesystems)
+	}
+
+	if _, err := server.RemoveImage(ctx, &RemoveImageRequest{Image: &ImageSpec{Image: "app:1.0"}}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	// Removing a missing image is not an error
+	if _, err := server.RemoveImage(ctx, &RemoveImageRequest{Image: &ImageSpec{Image: "app:1.0"}}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(store.images) != 1 || store.images[0].ID != "xyz" {
+		t.Fatalf("The remaining images should be '[xyz]' (while they are %#v)", store.images)
+	}
+}
+
+func TestMessages(t *testing.T) {
+	codec := protoCodec{}
+	// The encoding of api.proto: PullImageRequest.image (1) is an
+	// ImageSpec whose image (1) is "a"
+	content, err := codec.Marshal(&PullImageRequest{Image: &ImageSpec{Image: "a"}})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if expected := []byte{0x0a, 0x03, 0x0a, 0x01, 'a'}; !bytes.Equal(content, expected) {
+		t.Fatalf("The encoded request should be '%x' (while it is %x)", expected, content)
+	}
+
+	uid := int64(1000)
+	messages := []message{
+		&ListImagesRequest{Filter: &ImageSpec{Image: "app"}},
+		&ImageStatusResponse{
+			Image: &Image{
+				ID:          "abc",
+				RepoTags:    []string{"app:1.0", "app:latest"},
+				RepoDigests: []string{"app@sha256:def"},
+				Size:        1 << 40,
+				UID:         &uid,
+				Spec:        &ImageSpec{Image: "abc", Annotations: map[string]string{"a": "b", "c": ""}},
+				Pinned:      true,
+			},
+			Info: map[string]string{"info": "{}"},
+		},
+		&ImageFsInfoResponse{ImageFilesystems: []*FilesystemUsage{{Timestamp: 42, Mountpoint: "/var", UsedBytes: 100}}},
+		&PullImageResponse{ImageRef: "abc"},
+	}
+	for _, m := range messages {
+		content, err := codec.Marshal(m)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		decoded := reflect.New(reflect.TypeOf(m).Elem()).Interface()
+		if err := codec.Unmarshal(content, decoded); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if !reflect.DeepEqual(decoded, m) {
+			t.Fatalf("The decoded message should be '%#v' (while it is %#v)", m, decoded)
+		}
+	}
+
+	// Unknown fields, such as the credentials of the pull, are
+	// skipped
+	var pull PullImageRequest
+	if err := codec.Unmarshal([]byte{0x12, 0x02, 0x0a, 0x00, 0x0a, 0x03, 0x0a, 0x01, 'a'}, &pull); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if pull.Image == nil || pull.Image.Image != "a" {
+		t.Fatalf("The image of the pull should be 'a' (while it is %#v)", pull.Image)
+	}
+}
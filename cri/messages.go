@@ -0,0 +1,500 @@
+package cri
+
+import (
+	"fmt"
+	"sort"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The messages of the CRI ImageService (k8s.io/cri-api), encoded by
+// hand with the field numbers of api.proto, so that neither the CRI
+// API module nor generated code are required. Only the fields used by
+// the shim are decoded: the other ones are skipped.
+//
+// The generated types of k8s.io/cri-api are not imported: its
+// releases supporting the Go and gRPC versions of this module (up to
+// v0.23) are generated with gogo/protobuf, which would be added next
+// to google.golang.org/protobuf, while the later releases require Go
+// and gRPC versions newer than the ones shared with containers/image.
+
+// message is a protobuf message of the ImageService.
+type message interface {
+	marshal(b []byte) []byte
+	unmarshal(b []byte) error
+}
+
+// protoCodec encodes the messages in protobuf, as kubelets do.
+type protoCodec struct{}
+
+func (protoCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(message)
+	if !ok {
+		return nil, fmt.Errorf("The type %T is not a message of the CRI ImageService", v)
+	}
+	return m.marshal(nil), nil
+}
+
+func (protoCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(message)
+	if !ok {
+		return fmt.Errorf("The type %T is not a message of the CRI ImageService", v)
+	}
+	return m.unmarshal(data)
+}
+
+func (protoCodec) Name() string {
+	return "proto"
+}
+
+// parseFields calls field for each field of the encoded message b,
+// with its value if it is a varint, or its content if it is length
+// delimited.
+func parseFields(b []byte, field func(num protowire.Number, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		var v uint64
+		var data []byte
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			data, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if err := field(num, v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendMessage(b []byte, num protowire.Number, m message) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, m.marshal(nil))
+}
+
+// appendMap appends a map<string, string> field, whose entries are
+// messages with the key and the value as fields 1 and 2. Entries are
+// sorted by key so that the encoding is deterministic.
+func appendMap(b []byte, num protowire.Number, m map[string]string) []byte {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var entry []byte
+		entry = appendString(entry, 1, k)
+		entry = appendString(entry, 2, m[k])
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b
+}
+
+// parseMapEntry adds the entry of a map<string, string> field to m.
+func parseMapEntry(m map[string]string, data []byte) error {
+	var key, value string
+	err := parseFields(data, func(num protowire.Number, v uint64, data []byte) error {
+		switch num {
+		case 1:
+			key = string(data)
+		case 2:
+			value = string(data)
+		}
+		return nil
+	})
+	m[key] = value
+	return err
+}
+
+// ImageSpec is an internal representation of an image.
+type ImageSpec struct {
+	Image       string
+	Annotations map[string]string
+}
+
+func (m *ImageSpec) marshal(b []byte) []byte {
+	b = appendString(b, 1, m.Image)
+	return appendMap(b, 2, m.Annotations)
+}
+
+func (m *ImageSpec) unmarshal(b []byte) error {
+	return parseFields(b, func(num protowire.Number, v uint64, data []byte) error {
+		switch num {
+		case 1:
+			m.Image = string(data)
+		case 2:
+			if m.Annotations == nil {
+				m.Annotations = make(map[string]string)
+			}
+			return parseMapEntry(m.Annotations, data)
+		}
+		return nil
+	})
+}
+
+// Image describes an image of the storage.
+type Image struct {
+	ID          string
+	RepoTags    []string
+	RepoDigests []string
+	Size        uint64
+	// The UID of the user of the image, if it is numeric, otherwise
+	// the Username is set
+	UID      *int64
+	Username string
+	Spec     *ImageSpec
+	Pinned   bool
+}
+
+func (m *Image) marshal(b []byte) []byte {
+	b = appendString(b, 1, m.ID)
+	for _, tag := range m.RepoTags {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendString(b, tag)
+	}
+	for _, digest := range m.RepoDigests {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendString(b, digest)
+	}
+	b = appendVarint(b, 4, m.Size)
+	if m.UID != nil {
+		// The Int64Value wrapper
+		var uid []byte
+		uid = appendVarint(uid, 1, uint64(*m.UID))
+		b = protowire.AppendTag(b, 5, protowire.BytesType)
+		b = protowire.AppendBytes(b, uid)
+	}
+	b = appendString(b, 6, m.Username)
+	if m.Spec != nil {
+		b = appendMessage(b, 7, m.Spec)
+	}
+	if m.Pinned {
+		b = appendVarint(b, 8, 1)
+	}
+	return b
+}
+
+func (m *Image) unmarshal(b []byte) error {
+	return parseFields(b, func(num protowire.Number, v uint64, data []byte) error {
+		switch num {
+		case 1:
+			m.ID = string(data)
+		case 2:
+			m.RepoTags = append(m.RepoTags, string(data))
+		case 3:
+			m.RepoDigests = append(m.RepoDigests, string(data))
+		case 4:
+			m.Size = v
+		case 5:
+			var uid int64
+			err := parseFields(data, func(num protowire.Number, v uint64, data []byte) error {
+				if num == 1 {
+					uid = int64(v)
+				}
+				return nil
+			})
+			m.UID = &uid
+			return err
+		case 6:
+			m.Username = string(data)
+		case 7:
+			m.Spec = &ImageSpec{}
+			return m.Spec.unmarshal(data)
+		case 8:
+			m.Pinned = v != 0
+		}
+		return nil
+	})
+}
+
+// ListImagesRequest lists the images matching the filter.
+type ListImagesRequest struct {
+	// The image of the ImageFilter
+	Filter *ImageSpec
+}
+
+func (m *ListImagesRequest) marshal(b []byte) []byte {
+	if m.Filter == nil {
+		return b
+	}
+	var filter []byte
+	filter = appendMessage(filter, 1, m.Filter)
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	return protowire.AppendBytes(b, filter)
+}
+
+func (m *ListImagesRequest) unmarshal(b []byte) error {
+	return parseFields(b, func(num protowire.Number, v uint64, data []byte) error {
+		if num != 1 {
+			return nil
+		}
+		return parseFields(data, func(num protowire.Number, v uint64, data []byte) error {
+			if num != 1 {
+				return nil
+			}
+			m.Filter = &ImageSpec{}
+			return m.Filter.unmarshal(data)
+		})
+	})
+}
+
+// ListImagesResponse contains the listed images.
+type ListImagesResponse struct {
+	Images []*Image
+}
+
+func (m *ListImagesResponse) marshal(b []byte) []byte {
+	for _, image := range m.Images {
+		b = appendMessage(b, 1, image)
+	}
+	return b
+}
+
+func (m *ListImagesResponse) unmarshal(b []byte) error {
+	return parseFields(b, func(num protowire.Number, v uint64, data []byte) error {
+		if num != 1 {
+			return nil
+		}
+		image := &Image{}
+		m.Images = append(m.Images, image)
+		return image.unmarshal(data)
+	})
+}
+
+// ImageStatusRequest requests the status of an image.
+type ImageStatusRequest struct {
+	Image   *ImageSpec
+	Verbose bool
+}
+
+func (m *ImageStatusRequest) marshal(b []byte) []byte {
+	if m.Image != nil {
+		b = appendMessage(b, 1, m.Image)
+	}
+	if m.Verbose {
+		b = appendVarint(b, 2, 1)
+	}
+	return b
+}
+
+func (m *ImageStatusRequest) unmarshal(b []byte) error {
+	return parseFields(b, func(num protowire.Number, v uint64, data []byte) error {
+		switch num {
+		case 1:
+			m.Image = &ImageSpec{}
+			return m.Image.unmarshal(data)
+		case 2:
+			m.Verbose = v != 0
+		}
+		return nil
+	})
+}
+
+// ImageStatusResponse contains the status of the image, which is nil
+// if the image is not in the storage.
+type ImageStatusResponse struct {
+	Image *Image
+	Info  map[string]string
+}
+
+func (m *ImageStatusResponse) marshal(b []byte) []byte {
+	if m.Image != nil {
+		b = appendMessage(b, 1, m.Image)
+	}
+	return appendMap(b, 2, m.Info)
+}
+
+func (m *ImageStatusResponse) unmarshal(b []byte) error {
+	return parseFields(b, func(num protowire.Number, v uint64, data []byte) error {
+		switch num {
+		case 1:
+			m.Image = &Image{}
+			return m.Image.unmarshal(data)
+		case 2:
+			if m.Info == nil {
+				m.Info = make(map[string]string)
+			}
+			return parseMapEntry(m.Info, data)
+		}
+		return nil
+	})
+}
+
+// PullImageRequest requests the pull of an image. The credentials and
+// the sandbox configuration are ignored, since images are read from
+// the local image JSON files.
+type PullImageRequest struct {
+	Image *ImageSpec
+}
+
+func (m *PullImageRequest) marshal(b []byte) []byte {
+	if m.Image != nil {
+		b = appendMessage(b, 1, m.Image)
+	}
+	return b
+}
+
+func (m *PullImageRequest) unmarshal(b []byte) error {
+	return parseFields(b, func(num protowire.Number, v uint64, data []byte) error {
+		if num != 1 {
+			return nil
+		}
+		m.Image = &ImageSpec{}
+		return m.Image.unmarshal(data)
+	})
+}
+
+// PullImageResponse contains the ID of the pulled image.
+type PullImageResponse struct {
+	ImageRef string
+}
+
+func (m *PullImageResponse) marshal(b []byte) []byte {
+	return appendString(b, 1, m.ImageRef)
+}
+
+func (m *PullImageResponse) unmarshal(b []byte) error {
+	return parseFields(b, func(num protowire.Number, v uint64, data []byte) error {
+		if num == 1 {
+			m.ImageRef = string(data)
+		}
+		return nil
+	})
+}
+
+// RemoveImageRequest requests the removal of an image.
+type RemoveImageRequest struct {
+	Image *ImageSpec
+}
+
+func (m *RemoveImageRequest) marshal(b []byte) []byte {
+	if m.Image != nil {
+		b = appendMessage(b, 1, m.Image)
+	}
+	return b
+}
+
+func (m *RemoveImageRequest) unmarshal(b []byte) error {
+	return parseFields(b, func(num protowire.Number, v uint64, data []byte) error {
+		if num != 1 {
+			return nil
+		}
+		m.Image = &ImageSpec{}
+		return m.Image.unmarshal(data)
+	})
+}
+
+// RemoveImageResponse is the empty response of RemoveImage.
+type RemoveImageResponse struct{}
+
+func (m *RemoveImageResponse) marshal(b []byte) []byte {
+	return b
+}
+
+func (m *RemoveImageResponse) unmarshal(b []byte) error {
+	return nil
+}
+
+// ImageFsInfoRequest requests the usage of the image filesystem.
+type ImageFsInfoRequest struct{}
+
+func (m *ImageFsInfoRequest) marshal(b []byte) []byte {
+	return b
+}
+
+func (m *ImageFsInfoRequest) unmarshal(b []byte) error {
+	return nil
+}
+
+// FilesystemUsage is the usage of a filesystem storing images.
+type FilesystemUsage struct {
+	// The time of the measure, in nanoseconds since the epoch
+	Timestamp  int64
+	Mountpoint string
+	UsedBytes  uint64
+}
+
+func (m *FilesystemUsage) marshal(b []byte) []byte {
+	b = appendVarint(b, 1, uint64(m.Timestamp))
+	// The FilesystemIdentifier
+	var fsID []byte
+	fsID = appendString(fsID, 1, m.Mountpoint)
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendBytes(b, fsID)
+	// The UInt64Value wrapper
+	var used []byte
+	used = appendVarint(used, 1, m.UsedBytes)
+	b = protowire.AppendTag(b, 3, protowire.BytesType)
+	return protowire.AppendBytes(b, used)
+}
+
+func (m *FilesystemUsage) unmarshal(b []byte) error {
+	return parseFields(b, func(num protowire.Number, v uint64, data []byte) error {
+		switch num {
+		case 1:
+			m.Timestamp = int64(v)
+		case 2, 3:
+			return parseFields(data, func(wrapped protowire.Number, v uint64, data []byte) error {
+				switch {
+				case wrapped == 1 && num == 2:
+					m.Mountpoint = string(data)
+				case wrapped == 1 && num == 3:
+					m.UsedBytes = v
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+}
+
+// ImageFsInfoResponse contains the usage of the image filesystems.
+type ImageFsInfoResponse struct {
+	ImageFilesystems []*FilesystemUsage
+}
+
+func (m *ImageFsInfoResponse) marshal(b []byte) []byte {
+	for _, usage := range m.ImageFilesystems {
+		b = appendMessage(b, 1, usage)
+	}
+	return b
+}
+
+func (m *ImageFsInfoResponse) unmarshal(b []byte) error {
+	return parseFields(b, func(num protowire.Number, v uint64, data []byte) error {
+		if num != 1 {
+			return nil
+		}
+		usage := &FilesystemUsage{}
+		m.ImageFilesystems = append(m.ImageFilesystems, usage)
+		return usage.unmarshal(data)
+	})
+}
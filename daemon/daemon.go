@@ -0,0 +1,352 @@
+// Package daemon implements a long-lived nix2container builder, serving
+// a gRPC API (see Serve) to build and push images. Since the daemon
+// keeps its caches warm (the parsed image JSON files, the generated
+// layer blobs and their locks), CI agents and Nix builds can submit
+// many image jobs without paying the process startup and the cache
+// loading for each of them.
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/transports/alltransports"
+	imagetypes "github.com/containers/image/v5/types"
+	"github.com/nlewo/nix2container/nix"
+	"github.com/nlewo/nix2container/transport"
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// States of the layers reported by GetLayerStatus.
+const (
+	// The layer has never been built by the daemon
+	LayerUnknown = "unknown"
+	// The layer blob is being generated
+	LayerBuilding = "building"
+	// The layer blob is in the blob cache
+	LayerBuilt = "built"
+	// The generation of the layer blob has failed
+	LayerFailed = "failed"
+)
+
+// BuildImageRequest requests the generation of the layers of images.
+type BuildImageRequest struct {
+	// The image JSON files
+	Images []string `json:"images"`
+}
+
+// BuildImageResponse contains the status of the layers of the built
+// images generated from store paths.
+type BuildImageResponse struct {
+	Layers []LayerStatus `json:"layers"`
+}
+
+// PushImageRequest requests the copy of an image to a destination.
+type PushImageRequest struct {
+	// The image JSON file
+	Image string `json:"image"`
+	// The destination, such as docker://registry.example.com/app:tag
+	Destination string `json:"destination"`
+	// The credentials of the destination registry (USERNAME:PASSWORD)
+	Credentials string `json:"credentials,omitempty"`
+}
+
+// PushImageResponse contains the digest of the pushed manifest.
+type PushImageResponse struct {
+	ManifestDigest string `json:"manifest-digest"`
+}
+
+// GetLayerStatusRequest requests the status of a layer.
+type GetLayerStatusRequest struct {
+	Digest string `json:"digest"`
+}
+
+// LayerStatus is the status of a layer built by the daemon.
+type LayerStatus struct {
+	Digest string `json:"digest"`
+	State  string `json:"state"`
+	// The error of failed layers
+	Error string `json:"error,omitempty"`
+}
+
+// Options configure a Server.
+type Options struct {
+	// The blob cache where layers are generated, such as a directory
+	// (see nix.NewBlobStore)
+	BlobCache string
+	// The number of layers generated at the same time
+	Parallel int
+	// The signature policy file of the destinations of pushes. The
+	// policy of the system (/etc/containers/policy.json by default)
+	// is used if it is empty.
+	Policy string
+	// Accept any image pushed, without checking signatures
+	InsecurePolicy bool
+	// The command generating the blobs of the layers compressed by a
+	// command (see nix.SetCompressionCommand)
+	CompressionCommand []string
+}
+
+type cachedImage struct {
+	image   types.Image
+	modTime time.Time
+}
+
+// Server builds and pushes images for the clients of the daemon.
+type Server struct {
+	cache    *nix.BlobCache
+	parallel int
+	// The policy of the pushes, the policy of the system if nil
+	policy *signature.Policy
+	// copyImage copies the images, it is replaced by tests
+	copyImage func(ctx context.Context, policyContext *signature.PolicyContext, destRef, srcRef imagetypes.ImageReference, options *copy.Options) ([]byte, error)
+
+	mu     sync.Mutex
+	images map[string]cachedImage
+	// The layers being built or whose build has failed: built
+	// layers are reported from the blob cache
+	layers map[string]LayerStatus
+	// The failed layers of layers, from the oldest
+	failed []string
+}
+
+// maxFailedLayers is the number of failed layers whose status is
+// kept, so that the status of a long-lived daemon is bounded.
+const maxFailedLayers = 1024
+
+// maxCachedImages is the number of parsed images kept by the server:
+// since rebuilt images are other store paths, an arbitrary image is
+// dropped once it is reached.
+const maxCachedImages = 256
+
+// NewServer returns a Server generating layers in the blob cache of
+// the options. Pushes read the layers from this cache. The settings of
+// the jobs come from the options and from the layers themselves, never
+// from the environment of the daemon, so that several servers can
+// share a process.
+func NewServer(opts Options) (*Server, error) {
+	if opts.BlobCache == "" {
+		return nil, fmt.Errorf("The daemon requires a blob cache")
+	}
+	cache, err := nix.NewBlobCache(opts.BlobCache)
+	if err != nil {
+		return nil, err
+	}
+	cache.SetCompressionCommand(opts.CompressionCommand)
+	var policy *signature.Policy
+	switch {
+	case opts.InsecurePolicy:
+		policy = &signature.Policy{Default: []signature.PolicyRequirement{signature.NewPRInsecureAcceptAnything()}}
+	case opts.Policy != "":
+		policy, err = signature.NewPolicyFromFile(opts.Policy)
+		if err != nil {
+			return nil, err
+		}
+	}
+	parallel := opts.Parallel
+	if parallel < 1 {
+		parallel = 1
+	}
+	return &Server{
+		cache:     cache,
+		parallel:  parallel,
+		policy:    policy,
+		copyImage: copy.Image,
+		images:    make(map[string]cachedImage),
+		layers:    make(map[string]LayerStatus),
+	}, nil
+}
+
+// image returns the image of the JSON file filename, which is only
+// parsed again if it has been modified. Images are cached by the
+// target of their symlinks: a result symlink pointing to a rebuilt
+// image points to another store path, whose files all have the same
+// modification time.
+func (s *Server) image(filename string) (types.Image, error) {
+	filename, err := filepath.EvalSymlinks(filename)
+	if err != nil {
+		return types.Image{}, err
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		return types.Image{}, err
+	}
+	s.mu.Lock()
+	cached, ok := s.images[filename]
+	s.mu.Unlock()
+	if ok && cached.modTime.Equal(info.ModTime()) {
+		return cached.image, nil
+	}
+	image, err := nix.NewImageFromFile(filename)
+	if err != nil {
+		return types.Image{}, err
+	}
+	s.mu.Lock()
+	if _, ok := s.images[filename]; !ok && len(s.images) >= maxCachedImages {
+		for f := range s.images {
+			delete(s.images, f)
+			break
+		}
+	}
+	s.images[filename] = cachedImage{image: image, modTime: info.ModTime()}
+	s.mu.Unlock()
+	return image, nil
+}
+
+func (s *Server) setLayerStatus(status LayerStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch status.State {
+	case LayerBuilt:
+		delete(s.layers, status.Digest)
+	case LayerFailed:
+		s.layers[status.Digest] = status
+		// A layer failing again becomes the most recent failure
+		for i, digest := range s.failed {
+			if digest == status.Digest {
+				s.failed = append(s.failed[:i], s.failed[i+1:]...)
+				break
+			}
+		}
+		s.failed = append(s.failed, status.Digest)
+		if len(s.failed) > maxFailedLayers {
+			if s.layers[s.failed[0]].State == LayerFailed {
+				delete(s.layers, s.failed[0])
+			}
+			s.failed = s.failed[1:]
+		}
+	default:
+		s.layers[status.Digest] = status
+	}
+}
+
+// BuildImage generates the layers of the images in the blob cache.
+// Layers shared by several images are only generated once.
+func (s *Server) BuildImage(ctx context.Context, req *BuildImageRequest) (*BuildImageResponse, error) {
+	var images []types.Image
+	for _, filename := range req.Images {
+		image, err := s.image(filename)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, image)
+	}
+	logrus.Infof("Building the layers of %d images", len(images))
+	shared := nix.OrderSharedLayers(images)
+	err := nix.BuildSharedLayers(ctx, shared, s.cache, s.parallel, nix.BuildHooks{
+		Started: func(layer types.Layer) {
+			s.setLayerStatus(LayerStatus{Digest: layer.Digest, State: LayerBuilding})
+		},
+		Done: func(layer types.Layer, err error) {
+			if err != nil {
+				s.setLayerStatus(LayerStatus{Digest: layer.Digest, State: LayerFailed, Error: err.Error()})
+				return
+			}
+			s.setLayerStatus(LayerStatus{Digest: layer.Digest, State: LayerBuilt})
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp := &BuildImageResponse{Layers: []LayerStatus{}}
+	for _, shared := range shared {
+		// Layers which are not built from store paths are
+		// never generated
+		if shared.Layer.LayerPath != "" || shared.Layer.Paths == nil {
+			continue
+		}
+		status, err := s.GetLayerStatus(ctx, &GetLayerStatusRequest{Digest: shared.Layer.Digest})
+		if err != nil {
+			return nil, err
+		}
+		resp.Layers = append(resp.Layers, *status)
+	}
+	return resp, nil
+}
+
+// PushImage builds the layers of the image and copies it to the
+// destination.
+func (s *Server) PushImage(ctx context.Context, req *PushImageRequest) (*PushImageResponse, error) {
+	if _, err := s.BuildImage(ctx, &BuildImageRequest{Images: []string{req.Image}}); err != nil {
+		return nil, err
+	}
+	srcRef, err := transport.NewReferenceWithBlobCache(req.Image, s.cache)
+	if err != nil {
+		return nil, err
+	}
+	destRef, err := alltransports.ParseImageName(req.Destination)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid destination %s: %w", req.Destination, err)
+	}
+	destCtx := &imagetypes.SystemContext{}
+	if req.Credentials != "" {
+		i := strings.Index(req.Credentials, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("The credentials must be USERNAME:PASSWORD")
+		}
+		destCtx.DockerAuthConfig = &imagetypes.DockerAuthConfig{
+			Username: req.Credentials[:i],
+			Password: req.Credentials[i+1:],
+		}
+	}
+	policy := s.policy
+	if policy == nil {
+		policy, err = signature.DefaultPolicy(destCtx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	policyContext, err := signature.NewPolicyContext(policy)
+	if err != nil {
+		return nil, err
+	}
+	defer policyContext.Destroy()
+	logrus.Infof("Pushing the image %s to %s", req.Image, req.Destination)
+	// The layers are uploaded first with refreshed tokens, and then
+	// reused by the copy
+	if err := transport.UploadLayers(ctx, srcRef, destRef, destCtx, policyContext); err != nil {
+		return nil, err
+	}
+	copied, err := s.copyImage(ctx, policyContext, destRef, srcRef, &copy.Options{
+		DestinationCtx: destCtx,
+	})
+	if err != nil {
+		return nil, err
+	}
+	digest, err := manifest.Digest(copied)
+	if err != nil {
+		return nil, err
+	}
+	return &PushImageResponse{ManifestDigest: digest.String()}, nil
+}
+
+// GetLayerStatus returns the status of the layer. Layers whose blob
+// is in the blob cache are reported as built, even if they have not
+// been built by the daemon, for instance after a restart of the
+// daemon.
+func (s *Server) GetLayerStatus(ctx context.Context, req *GetLayerStatusRequest) (*LayerStatus, error) {
+	digest, err := godigest.Parse(req.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid layer digest %q: %w", req.Digest, err)
+	}
+	s.mu.Lock()
+	status, ok := s.layers[req.Digest]
+	s.mu.Unlock()
+	if ok {
+		return &status, nil
+	}
+	if s.cache.Contains(digest) {
+		return &LayerStatus{Digest: req.Digest, State: LayerBuilt}, nil
+	}
+	return &LayerStatus{Digest: req.Digest, State: LayerUnknown}, nil
+}
@@ -0,0 +1,231 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/signature"
+	imagetypes "github.com/containers/image/v5/types"
+	"github.com/nlewo/nix2container/nix"
+	"github.com/nlewo/nix2container/transport"
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+)
+
+func TestServerBuildImage(t *testing.T) {
+	layers, err := nix.NewLayers(context.Background(), []string{"../data/layer1"}, nil, nil, "", nil, types.PathOptions{}, nix.CompressionNone)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	content, err := types.MarshalCanonical(types.Image{Layers: layers})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	imageFilename := filepath.Join(t.TempDir(), "image.json")
+	if err := types.WriteFile(imageFilename, content); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	server, err := NewServer(Options{BlobCache: t.TempDir()})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	status, err := server.GetLayerStatus(context.Background(), &GetLayerStatusRequest{Digest: layers[0].Digest})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if status.State != LayerUnknown {
+		t.Fatalf("State should be '%#v' (while it is %#v)", LayerUnknown, status.State)
+	}
+
+	resp, err := server.BuildImage(context.Background(), &BuildImageRequest{Images: []string{imageFilename, imageFilename}})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := []LayerStatus{{Digest: layers[0].Digest, State: LayerBuilt}}
+	if fmt.Sprintf("%#v", resp.Layers) != fmt.Sprintf("%#v", expected) {
+		t.Fatalf("Layers should be '%#v' (while it is %#v)", expected, resp.Layers)
+	}
+	status, err = server.GetLayerStatus(context.Background(), &GetLayerStatusRequest{Digest: layers[0].Digest})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if status.State != LayerBuilt {
+		t.Fatalf("State should be '%#v' (while it is %#v)", LayerBuilt, status.State)
+	}
+	// The built layers are reported from the blob cache
+	if len(server.layers) != 0 {
+		t.Fatalf("The status of built layers should not be kept (while it is %#v)", server.layers)
+	}
+	for i := 0; i <= maxFailedLayers; i++ {
+		server.setLayerStatus(LayerStatus{Digest: fmt.Sprintf("sha256:%064d", i), State: LayerFailed})
+	}
+	if len(server.layers) != maxFailedLayers {
+		t.Fatalf("The status of %d failed layers should be kept (while it is %d)", maxFailedLayers, len(server.layers))
+	}
+	if _, ok := server.layers[fmt.Sprintf("sha256:%064d", 0)]; ok {
+		t.Fatalf("The status of the oldest failed layer should be dropped")
+	}
+	// A retried failure doesn't drop other failures
+	retried := fmt.Sprintf("sha256:%064d", maxFailedLayers)
+	for i := 0; i < maxFailedLayers; i++ {
+		server.setLayerStatus(LayerStatus{Digest: retried, State: LayerFailed})
+	}
+	if len(server.layers) != maxFailedLayers {
+		t.Fatalf("The status of %d failed layers should be kept (while it is %d)", maxFailedLayers, len(server.layers))
+	}
+
+	if _, err := server.GetLayerStatus(context.Background(), &GetLayerStatusRequest{Digest: "invalid"}); err == nil {
+		t.Fatalf("An invalid digest should be rejected")
+	}
+}
+
+func TestServerImage(t *testing.T) {
+	server, err := NewServer(Options{BlobCache: t.TempDir()})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	// The image files are store paths, which all have the same
+	// modification time, pointed to by a result symlink
+	dir := t.TempDir()
+	for _, arch := range []string{"amd64", "arm64"} {
+		content, err := types.MarshalCanonical(types.Image{Architecture: arch})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		filename := filepath.Join(dir, arch+".json")
+		if err := types.WriteFile(filename, content); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := os.Chtimes(filename, time.Unix(1, 0), time.Unix(1, 0)); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	result := filepath.Join(dir, "result")
+	for _, arch := range []string{"amd64", "arm64"} {
+		os.Remove(result)
+		if err := os.Symlink(filepath.Join(dir, arch+".json"), result); err != nil {
+			t.Fatalf("%v", err)
+		}
+		image, err := server.image(result)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if image.Architecture != arch {
+			t.Fatalf("The architecture should be '%s' (while it is %s)", arch, image.Architecture)
+		}
+	}
+}
+
+func TestServerPushImage(t *testing.T) {
+	layers, err := nix.NewLayers(context.Background(), []string{"../data/layer1"}, nil, nil, "", nil, types.PathOptions{}, nix.CompressionNone)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	content, err := types.MarshalCanonical(types.Image{Layers: layers})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	imageFilename := filepath.Join(t.TempDir(), "image.json")
+	if err := types.WriteFile(imageFilename, content); err != nil {
+		t.Fatalf("%v", err)
+	}
+	blobCache := t.TempDir()
+	server, err := NewServer(Options{BlobCache: blobCache, InsecurePolicy: true})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if os.Getenv(transport.BlobCacheEnv) != "" {
+		t.Fatalf("The server should not modify the environment")
+	}
+
+	pushed := []byte(`{"schemaVersion":2}`)
+	server.copyImage = func(ctx context.Context, policyContext *signature.PolicyContext, destRef, srcRef imagetypes.ImageReference, options *copy.Options) ([]byte, error) {
+		auth := options.DestinationCtx.DockerAuthConfig
+		if auth == nil || auth.Username != "user" || auth.Password != "pass:word" {
+			t.Fatalf("The credentials should be 'user:pass:word' (while they are %#v)", auth)
+		}
+		if srcRef.StringWithinTransport() != imageFilename {
+			t.Fatalf("The source should be '%s' (while it is %s)", imageFilename, srcRef.StringWithinTransport())
+		}
+		// The source generates the layer again in the blob cache
+		// of the server
+		d := godigest.Digest(layers[0].Digest)
+		if err := os.Remove(filepath.Join(blobCache, d.Algorithm().String(), d.Encoded())); err != nil {
+			return nil, err
+		}
+		src, err := srcRef.NewImageSource(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		defer src.Close()
+		rc, _, err := src.GetBlob(ctx, imagetypes.BlobInfo{Digest: godigest.Digest(layers[0].Digest)}, nil)
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		if _, err := ioutil.ReadAll(rc); err != nil {
+			return nil, err
+		}
+		return pushed, nil
+	}
+	// The destination only has to be parsed since the copy is faked
+	resp, err := server.PushImage(context.Background(), &PushImageRequest{
+		Image:       imageFilename,
+		Destination: "nix:" + imageFilename,
+		Credentials: "user:pass:word",
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if resp.ManifestDigest != godigest.FromBytes(pushed).String() {
+		t.Fatalf("The manifest digest should be '%s' (while it is %s)", godigest.FromBytes(pushed), resp.ManifestDigest)
+	}
+	if !server.cache.Contains(godigest.Digest(layers[0].Digest)) {
+		t.Fatalf("The layer %s should be in the blob cache of the server", layers[0].Digest)
+	}
+
+	if _, err := server.PushImage(context.Background(), &PushImageRequest{Image: imageFilename, Destination: "nix:" + imageFilename, Credentials: "user"}); err == nil {
+		t.Fatalf("Credentials without password should be rejected")
+	}
+}
+
+func TestListen(t *testing.T) {
+	if _, err := Listen("127.0.0.1:0"); err == nil {
+		t.Fatalf("TCP addresses should be rejected")
+	}
+	path := filepath.Join(t.TempDir(), "daemon.sock")
+	l, err := Listen("unix:" + path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer l.Close()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("The socket mode should be '0600' (while it is %o)", info.Mode().Perm())
+	}
+}
+
+func TestStatusErrors(t *testing.T) {
+	err := fromStatus(toStatus(fmt.Errorf("The file /etc/passwd conflicts: %w", nix.ErrConflict)))
+	if !errors.Is(err, nix.ErrConflict) {
+		t.Fatalf("The error should be a conflict (while it is %#v)", err)
+	}
+	if err.Error() != "The file /etc/passwd conflicts: conflict" {
+		t.Fatalf("The error message should be kept (while it is %s)", err)
+	}
+	err = fromStatus(toStatus(errors.New("Failure")))
+	if errors.Is(err, nix.ErrConflict) || err.Error() != "Failure" {
+		t.Fatalf("The error should be unclassified (while it is %#v)", err)
+	}
+}
@@ -0,0 +1,265 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/nlewo/nix2container/nix"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/status"
+)
+
+// ServiceName is the name of the gRPC service of the daemon. Its
+// methods are BuildImage, PushImage and GetLayerStatus.
+const ServiceName = "nix2container.Builder"
+
+// Messages are encoded in JSON (the "application/grpc+json" content
+// type) instead of protobuf, so that no generated code is required:
+// clients have to use the json content subtype, as Client does.
+const codecName = "json"
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Name() string {
+	return codecName
+}
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+// errorCodes maps the classes of nix errors to gRPC status codes, so
+// that clients can branch on the class of a failure.
+var errorCodes = []struct {
+	class error
+	code  codes.Code
+}{
+	{nix.ErrConflict, codes.FailedPrecondition},
+	{nix.ErrAuth, codes.Unauthenticated},
+	{nix.ErrBlobMissing, codes.NotFound},
+	{nix.ErrDigestMismatch, codes.DataLoss},
+	{nix.ErrNotReproducible, codes.InvalidArgument},
+	{context.Canceled, codes.Canceled},
+}
+
+// toStatus converts an error of the server into a gRPC status error.
+func toStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	for _, e := range errorCodes {
+		if errors.Is(err, e.class) {
+			return status.Error(e.code, err.Error())
+		}
+	}
+	return status.Error(codes.Unknown, err.Error())
+}
+
+// remoteError is an error returned by the daemon, belonging to the
+// class of its status code.
+type remoteError struct {
+	class error
+	msg   string
+}
+
+func (e *remoteError) Error() string {
+	return e.msg
+}
+
+func (e *remoteError) Is(target error) bool {
+	return target == e.class
+}
+
+// fromStatus converts a gRPC status error into an error of the class
+// of its code.
+func fromStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	s := status.Convert(err)
+	for _, e := range errorCodes {
+		if s.Code() == e.code {
+			return &remoteError{class: e.class, msg: s.Message()}
+		}
+	}
+	return errors.New(s.Message())
+}
+
+// unaryHandler returns the gRPC handler of a method, decoding its
+// request into newRequest() and calling call.
+func unaryHandler(method string, newRequest func() interface{}, call func(s *Server, ctx context.Context, req interface{}) (interface{}, error)) func(interface{}, context.Context, func(interface{}) error, grpc.UnaryServerInterceptor) (interface{}, error) {
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+		req := newRequest()
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+			resp, err := call(srv.(*Server), ctx, req)
+			if err != nil {
+				logrus.Warnf("%s failed: %s", method, err)
+			}
+			return resp, toStatus(err)
+		}
+		if interceptor == nil {
+			return handler(ctx, req)
+		}
+		info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + ServiceName + "/" + method}
+		return interceptor(ctx, req, info, handler)
+	}
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: ServiceName,
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "BuildImage",
+			Handler: unaryHandler("BuildImage",
+				func() interface{} { return &BuildImageRequest{} },
+				func(s *Server, ctx context.Context, req interface{}) (interface{}, error) {
+					return s.BuildImage(ctx, req.(*BuildImageRequest))
+				}),
+		},
+		{
+			MethodName: "PushImage",
+			Handler: unaryHandler("PushImage",
+				func() interface{} { return &PushImageRequest{} },
+				func(s *Server, ctx context.Context, req interface{}) (interface{}, error) {
+					return s.PushImage(ctx, req.(*PushImageRequest))
+				}),
+		},
+		{
+			MethodName: "GetLayerStatus",
+			Handler: unaryHandler("GetLayerStatus",
+				func() interface{} { return &GetLayerStatusRequest{} },
+				func(s *Server, ctx context.Context, req interface{}) (interface{}, error) {
+					return s.GetLayerStatus(ctx, req.(*GetLayerStatusRequest))
+				}),
+		},
+	},
+	Metadata: "nix2container",
+}
+
+// Listen listens on address, a Unix socket (unix:PATH or
+// unix://PATH). A stale socket is removed. Since the API of the daemon
+// is neither authenticated nor encrypted, and pushes images with the
+// credentials of its clients, it is only served on a Unix socket
+// restricted to the user running the daemon (mode 0600). It is also
+// used by the CRI shim (see the cri package).
+func Listen(address string) (net.Listener, error) {
+	path, err := socketPath(address)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	// The socket is created with the owner permissions only: changing
+	// them once it is listening would let other users connect in the
+	// meantime.
+	restore := restrictUmask()
+	l, err := net.Listen("unix", path)
+	restore()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// socketPath returns the path of the Unix socket of the address
+// (unix:PATH or unix://PATH).
+func socketPath(address string) (string, error) {
+	if !strings.HasPrefix(address, "unix:") {
+		return "", fmt.Errorf("The daemon address %s is not a Unix socket (unix:PATH): the daemon API is not authenticated, it can not be served on the network", address)
+	}
+	path := strings.TrimPrefix(strings.TrimPrefix(address, "unix:"), "//")
+	if path == "" {
+		return "", fmt.Errorf("The daemon address %s has no socket path", address)
+	}
+	return path, nil
+}
+
+// Serve serves the gRPC API of the server on the Unix socket address
+// (unix:PATH) until the context is cancelled. In-flight requests are
+// then completed before returning.
+func Serve(ctx context.Context, server *Server, address string) error {
+	l, err := Listen(address)
+	if err != nil {
+		return err
+	}
+	s := grpc.NewServer()
+	s.RegisterService(&serviceDesc, server)
+	go func() {
+		<-ctx.Done()
+		s.GracefulStop()
+	}()
+	logrus.Infof("Serving the nix2container daemon on %s", address)
+	return s.Serve(l)
+}
+
+// Client is a client of the daemon.
+type Client struct {
+	conn *grpc.ClientConn
+}
+
+// Dial returns a client of the daemon serving on the Unix socket
+// address (unix:PATH). The connection doesn't need to be encrypted
+// since it doesn't leave the machine.
+func Dial(address string) (*Client, error) {
+	path, err := socketPath(address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := grpc.Dial("unix://"+path, grpc.WithInsecure(), grpc.WithDefaultCallOptions(grpc.CallContentSubtype(codecName)))
+	if err != nil {
+		return nil, fmt.Errorf("Could not connect to the daemon %s: %w", address, err)
+	}
+	return &Client{conn: conn}, nil
+}
+
+// Close closes the connection to the daemon.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Client) invoke(ctx context.Context, method string, req, resp interface{}) error {
+	return fromStatus(c.conn.Invoke(ctx, "/"+ServiceName+"/"+method, req, resp))
+}
+
+// BuildImage calls the BuildImage method of the daemon.
+func (c *Client) BuildImage(ctx context.Context, req *BuildImageRequest) (*BuildImageResponse, error) {
+	resp := &BuildImageResponse{}
+	return resp, c.invoke(ctx, "BuildImage", req, resp)
+}
+
+// PushImage calls the PushImage method of the daemon.
+func (c *Client) PushImage(ctx context.Context, req *PushImageRequest) (*PushImageResponse, error) {
+	resp := &PushImageResponse{}
+	return resp, c.invoke(ctx, "PushImage", req, resp)
+}
+
+// GetLayerStatus calls the GetLayerStatus method of the daemon.
+func (c *Client) GetLayerStatus(ctx context.Context, req *GetLayerStatusRequest) (*LayerStatus, error) {
+	resp := &LayerStatus{}
+	return resp, c.invoke(ctx, "GetLayerStatus", req, resp)
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package daemon
+
+import "syscall"
+
+// restrictUmask sets a umask only leaving the owner permissions, so
+// that the files created until the returned function is called, which
+// restores the previous umask, are never accessible to other users.
+// The umask being process wide, it is only used around the creation
+// of the socket.
+func restrictUmask() func() {
+	previous := syscall.Umask(0177)
+	return func() {
+		syscall.Umask(previous)
+	}
+}
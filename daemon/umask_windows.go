@@ -0,0 +1,6 @@
+package daemon
+
+// restrictUmask is a no-op since there is no umask on Windows.
+func restrictUmask() func() {
+	return func() {}
+}
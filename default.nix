@@ -1,5 +1,13 @@
-{ pkgs ? import <nixpkgs> { } }:
+{ pkgs ? import <nixpkgs> { }
+  # The default registry mirrors and registries.conf file of
+  # pullImage, so that all base images are fetched through the
+  # mirrors of a restricted network (see pullImage).
+, registryMirrors ? {}
+, registriesConf ? null
+}:
 let
+  defaultRegistriesConf = registriesConf;
+
   nix2containerUtil = pkgs.buildGoModule rec {
     pname = "nix2container";
     version = "0.0.1";
@@ -17,44 +25,296 @@ let
         p == "default.nix"
       );
     };
-    vendorSha256 = "sha256-o7eE/R8UbuEP0SA+eS0mXb3XeV+gvLfFRDIJ6jvqMuA=";
+    vendorSha256 = pkgs.lib.fakeSha256;
+    # The containers storage (copy-to-containers-storage) is built
+    # without the btrfs and devicemapper graph drivers, which require
+    # their C libraries, and signatures are verified with the Go
+    # OpenPGP implementation instead of gpgme (cgo).
+    tags = [
+      "exclude_graphdriver_btrfs"
+      "exclude_graphdriver_devicemapper"
+      "containers_image_openpgp"
+    ];
   };
 
-  skopeo-nix2container = pkgs.skopeo.overrideAttrs (old: {
-    preBuild = let
-      patch = pkgs.fetchurl {
-        url = "https://github.com/nlewo/image/commit/7a612c8a2e20ac7937cae14773cad948c6c7d881.patch";
-        sha256 = "sha256-Qeks08itjVuB+fzRxWG7NL27SvZQvD92tAAOO5hpZQs=";
+  # Skopeo with the nix: transport of the transport package, which is
+  # imported by its main package to register the transport. The
+  # vendor directory of Skopeo is generated again by go mod vendor,
+  # with the modules required by the transport. The nix2container
+  # module is replaced by a copy of its sources, which are removed
+  # from the vendor directory and copied back before the build: the
+  # vendorSha256 only depends on the dependencies of nix2container.
+  skopeo-nix2container = pkgs.skopeo.override {
+    buildGoModule = args: pkgs.buildGoModule (args // {
+      # TODO: replace by the hash reported by the first build of the
+      # skopeo-nix2container flake check
+      vendorSha256 = pkgs.lib.fakeSha256;
+      postPatch = (args.postPatch or "") + ''
+        rm -rf vendor
+        cp -r ${nix2containerUtil.src} nix2container
+        chmod -R u+w nix2container
+        go mod edit \
+          -require=github.com/nlewo/nix2container@v${nix2containerUtil.version} \
+          -replace=github.com/nlewo/nix2container=./nix2container
+        cat > cmd/skopeo/nix2container.go <<EOF
+        package main
+
+        import _ "github.com/nlewo/nix2container/transport"
+        EOF
+      '';
+      overrideModAttrs = _: {
+        # The go.sum of Skopeo doesn't contain the modules (or the
+        # versions) required by nix2container
+        preBuild = ''
+          go mod tidy
+        '';
+        # The vendor directory is only consistent with the tidied
+        # go.mod and go.sum, which are kept with it
+        postBuild = ''
+          rm -rf vendor/github.com/nlewo/nix2container
+          cp go.mod go.sum vendor/
+        '';
       };
-    in ''
-      mkdir -p vendor/github.com/nlewo/nix2container/
-      cp -r ${nix2containerUtil.src}/* vendor/github.com/nlewo/nix2container/
-      cd vendor/github.com/containers/image/v5
-      mkdir nix/
-      touch nix/transport.go
-      patch -p1 < ${patch}
-      cd -
-    '';
-  });
+      preBuild = (args.preBuild or "") + ''
+        chmod -R u+w vendor
+        mv vendor/go.mod vendor/go.sum .
+        cp -r nix2container vendor/github.com/nlewo/nix2container
+      '';
+    });
+  };
+
+  # Copy the image with Skopeo (or with the copy command of
+  # copyImageWith): args are the Skopeo copy arguments following the
+  # image source (the destination and options). When
+  # the NIX2CONTAINER_RESULT environment variable is set, a JSON file
+  # describing the copy result (manifest digest, layers, destination)
+  # is written to this location, with the bytes uploaded and reused
+  # for each layer.
+  #
+  # The --max-upload-rate (such as 10M, in bytes per second) and
+  # --max-parallel-uploads options of the copy scripts limit the
+  # bandwidth used to read the image layers.
+  #
+  # The --override CONFIG.JSON option merges a configuration (such as
+  # {"Env": ["ENVIRONMENT=staging"]}) over the image configuration
+  # before the copy.
+  # A docker:// destination can have several tags, such as
+  # docker://registry/app:v1.2.3,:v1.2,:latest: the image is pushed
+  # with the first tag and its manifest is then put for the other ones.
+  #
+  # Signatures are only checked when the --policy option or the
+  # NIX2CONTAINER_POLICY environment variable is set to a
+  # containers-policy.json file, or to "system" to use
+  # /etc/containers/policy.json. The policy has to accept the nix
+  # transport, such as {"transports": {"nix": {"": [{"type":
+  # "insecureAcceptAnything"}]}}, ...}. The --registries.d option (or
+  # NIX2CONTAINER_REGISTRIES_D) configures where signatures are looked
+  # up and stored, for instance with --sign-by.
+  #
+  # The --with-debug-layer LAYERS.JSON option (such as a layer built
+  # by buildLayer with busybox) also copies a debug variant of the
+  # image, with these additional layers, to the destination tagged
+  # "debug" (or the --debug-tag one).
+  #
+  # The --state FILE option records the progress of the push in a
+  # state file: an interrupted push started again only uploads the
+  # missing blobs, and a push already done is skipped if the manifest
+  # of the destination is still the image.
+  copyImage = copyImageWith skopeoCopy;
+
+  # The copy commands used by copyImageWith: copy_image IMAGE ARGS
+  # copies the image JSON file IMAGE with the Skopeo copy ARGS, the
+  # policy arguments being in policyArgs.
+  skopeoCopy = ''
+    copy_image() {
+      local src="$1"
+      shift
+      ${skopeo-nix2container}/bin/skopeo "''${policyArgs[@]}" copy nix:"$src" "$@"
+    }
+  '';
+  # The native copy "nix2container copy-to-registry" doesn't depend on
+  # Skopeo but only supports its most common flags (--dest-creds,
+  # --dest-authfile, --dest-cert-dir, --dest-tls-verify, --digestfile,
+  # --policy, --insecure-policy, --registries.d, --sign-by and
+  # --quiet): it is used instead of Skopeo when the
+  # NIX2CONTAINER_NATIVE_COPY environment variable is set to 1. Since
+  # it is built with the Go OpenPGP implementation, it verifies
+  # signatures but can not create them: images are signed
+  # (--sign-by) with Skopeo.
+  registryCopy = ''
+    copy_image() {
+      local src="$1"
+      shift
+      if [ "''${NIX2CONTAINER_NATIVE_COPY:-}" = 1 ]; then
+        ${nix2containerUtil}/bin/nix2container copy-to-registry "''${policyArgs[@]}" "$src" "$@"
+      else
+        ${skopeo-nix2container}/bin/skopeo "''${policyArgs[@]}" copy nix:"$src" "$@"
+      fi
+    }
+  '';
+
+  # The images are written by the containers/storage library, in the
+  # user namespace of rootless users.
+  nativeStorageCopy = ''
+    copy_image() {
+      local src="$1"
+      shift
+      ${nix2containerUtil}/bin/nix2container copy-to-containers-storage "''${policyArgs[@]}" "$src" "$@"
+    }
+  '';
 
-  copyToDockerDeamon = image: pkgs.writeScriptBin "copy-to-docker-deamon" ''
-    ${skopeo-nix2container}/bin/skopeo --insecure-policy copy nix:${image} docker-daemon:${image.name}:${image.tag}
+  copyImageWith = copy: image: destination: args: ''
+    ${copy}
+    policy=''${NIX2CONTAINER_POLICY:-}
+    registriesDir=''${NIX2CONTAINER_REGISTRIES_D:-}
+    skopeoArgs=()
+    override=
+    tagDestination=
+    extraTags=
+    tagArgs=()
+    debugLayers=()
+    debugTag=debug
+    debugImage=
+    pushState=
+    binaryCache=
+    while [ $# -gt 0 ]; do
+      case "$1" in
+        --max-upload-rate) export NIX2CONTAINER_MAX_UPLOAD_RATE="$2"; shift 2;;
+        --max-parallel-uploads) export NIX2CONTAINER_MAX_PARALLEL_UPLOADS="$2"; shift 2;;
+        --override) override="$2"; shift 2;;
+        --policy) policy="$2"; shift 2;;
+        --registries.d) registriesDir="$2"; shift 2;;
+        --with-debug-layer) debugLayers+=("$2"); shift 2;;
+        --debug-tag) debugTag="$2"; shift 2;;
+        --state) pushState="$2"; shift 2;;
+        --binary-cache) binaryCache="$2"; shift 2;;
+        --dest-creds) tagArgs+=(--creds "$2"); skopeoArgs+=("$1" "$2"); shift 2;;
+        --dest-tls-verify=*) tagArgs+=("--tls-verify=''${1#*=}"); skopeoArgs+=("$1"); shift;;
+        docker://*,*) tagDestination="''${1%%,*}"; extraTags="''${1#*,}"; skopeoArgs+=("$tagDestination"); shift;;
+        *) skopeoArgs+=("$1"); shift;;
+      esac
+    done
+    set -- "''${skopeoArgs[@]}"
+    case "$policy" in
+      "") policyArgs=(--insecure-policy);;
+      system) policyArgs=();;
+      *) policyArgs=(--policy "$policy");;
+    esac
+    if [ -n "$registriesDir" ]; then
+      policyArgs+=(--registries.d "$registriesDir")
+    fi
+    digestfile=$(mktemp)
+    uploadReport=$(mktemp)
+    image=${image}
+    if [ -n "$override" ]; then
+      image=$(mktemp)
+      ${nix2containerUtil}/bin/nix2container override "$image" ${image} "$override" || exit $?
+    fi
+    trap 'rm -f "$digestfile" "$uploadReport"; [ -n "$override" ] && rm -f "$image"; [ -n "$debugImage" ] && rm -f "$debugImage"' EXIT
+    pushed=
+    if [ -n "$pushState" ]; then
+      pushed=$(${nix2containerUtil}/bin/nix2container push-state "''${tagArgs[@]}" "$pushState" "$image" ${destination}) || exit $?
+    fi
+    if [ -n "$pushed" ]; then
+      echo "The image has already been pushed to ${destination} (according to $pushState)"
+      printf '%s' "$pushed" > "$digestfile"
+    else
+      NIX2CONTAINER_UPLOAD_REPORT="$uploadReport" NIX2CONTAINER_PUSH_STATE="$pushState" \
+        copy_image "$image" --digestfile "$digestfile" ${args} || exit $?
+      if [ -n "$pushState" ]; then
+        ${nix2containerUtil}/bin/nix2container push-state --mark-pushed "$pushState" "$image" ${destination} || exit $?
+      fi
+    fi
+    if [ -n "$binaryCache" ]; then
+      ${nix2containerUtil}/bin/nix2container publish-binary-cache "$image" "$binaryCache" > /dev/null || exit $?
+    fi
+    if [ -n "$extraTags" ]; then
+      ${nix2containerUtil}/bin/nix2container tag "''${tagArgs[@]}" "$tagDestination" "$extraTags" || exit $?
+    fi
+    if [ ''${#debugLayers[@]} -gt 0 ]; then
+      debugImage=$(mktemp)
+      ${nix2containerUtil}/bin/nix2container add-layers "$debugImage" "$image" "''${debugLayers[@]}" || exit $?
+      # The tag of the destination is replaced by the debug tag
+      dest=${destination}
+      if [[ "''${dest##*/}" == *:* ]]; then
+        debugDestination="''${dest%:*}:$debugTag"
+      else
+        debugDestination="$dest:$debugTag"
+      fi
+      debugArgs=()
+      for arg in ${args}; do
+        if [ "$arg" = "$dest" ]; then
+          debugArgs+=("$debugDestination")
+        else
+          debugArgs+=("$arg")
+        fi
+      done
+      copy_image "$debugImage" "''${debugArgs[@]}" || exit $?
+    fi
+    if [ -n "''${NIX2CONTAINER_RESULT:-}" ]; then
+      ${nix2containerUtil}/bin/nix2container result "$NIX2CONTAINER_RESULT" "$image" \
+        --digest-file "$digestfile" \
+        --upload-report "$uploadReport" \
+        --destination ${destination}
+    fi
+  '';
+
+  copyToDockerDeamon = image: pkgs.writeShellScriptBin "copy-to-docker-deamon" ''
+    ${copyImage image "docker-daemon:${image.name}:${image.tag}" "docker-daemon:${image.name}:${image.tag}"}
     ${skopeo-nix2container}/bin/skopeo --insecure-policy inspect docker-daemon:${image.name}:${image.tag}
   '';
 
-  copyToRegistry = image: pkgs.writeScriptBin "copy-to-docker-deamon" ''
-    ${skopeo-nix2container}/bin/skopeo --insecure-policy copy nix:${image} docker://${image.name}:${image.tag} $@
+  # The tag of the image can be a list of tags, such as "v1.2.3,v1.2,latest".
+  # The image is pushed by Skopeo, or by "nix2container copy-to-registry"
+  # if NIX2CONTAINER_NATIVE_COPY=1 (see registryCopy).
+  copyToRegistry = image: pkgs.writeShellScriptBin "copy-to-registry" ''
+    set -- "docker://${image.name}:${image.tag}" "$@"
+    ${copyImageWith registryCopy image "docker://${image.name}:${builtins.head (pkgs.lib.splitString "," image.tag)}" "\"$@\""}
     echo Docker image ${image.name}:${image.tag} have copied to registry
   '';
 
-  copyTo = image: pkgs.writeScriptBin "copy-to" ''
+  # As copyToRegistry, the image is copied by Skopeo unless
+  # NIX2CONTAINER_NATIVE_COPY=1.
+  copyTo = image: pkgs.writeShellScriptBin "copy-to" ''
     echo Running skopeo --insecure-policy copy nix:${image} $@
-    ${skopeo-nix2container}/bin/skopeo --insecure-policy copy nix:${image} $@
+    ${copyImageWith registryCopy image "\"\${@: -1}\"" "\"$@\""}
+  '';
+
+  # Push many images built with buildImage, such as the images of a
+  # monorepo: the layers shared by several images are only generated
+  # once, in a blob cache shared by the copies.
+  copyImagesToRegistry = images: pkgs.writeShellScriptBin "copy-images-to-registry" ''
+    set -e
+    export NIX2CONTAINER_BLOB_CACHE=''${NIX2CONTAINER_BLOB_CACHE:-$(mktemp -d)}
+    ${nix2containerUtil}/bin/nix2container build-all ${pkgs.lib.concatMapStringsSep " " (i: "${i}") images}
+    ${pkgs.lib.concatMapStringsSep "\n" (i: "${i.copyToRegistry}/bin/copy-to-registry \"$@\"") images}
+  '';
+
+  # A docker-archive of the image, loadable with "docker load", even
+  # by old Docker daemons.
+  dockerArchive = image: pkgs.runCommand "docker-image-${builtins.replaceStrings [ "/" ] [ "-" ] image.name}.tar" {} ''
+    ${nix2containerUtil}/bin/nix2container docker-archive ${image} $out \
+      ${pkgs.lib.concatMapStringsSep " " (t: "--tag '${image.name}:${t}'") (pkgs.lib.splitString "," image.tag)}
+  '';
+
+  # An OCI archive of the image, importable with "ctr images import" or
+  # "nerdctl load", for instance into the containerd of a Colima or
+  # Lima VM on macOS.
+  ctrArchive = image: pkgs.runCommand "ctr-image-${builtins.replaceStrings [ "/" ] [ "-" ] image.name}.tar" {} ''
+    ${nix2containerUtil}/bin/nix2container ctr-archive ${image} $out \
+      ${pkgs.lib.concatMapStringsSep " " (t: "--name '${image.name}:${t}'") (pkgs.lib.splitString "," image.tag)}
+  '';
+
+  # Push the image JSON as an OCI artifact, to push the image from
+  # another machine with "nix2container pull-image-json", for instance
+  # "pushImageJson docker://ghcr.io/org/app-json:v1".
+  pushImageJson = image: pkgs.writeShellScriptBin "push-image-json" ''
+    ${nix2containerUtil}/bin/nix2container push-image-json ${image} "$@"
   '';
 
   copyToPodman = image: pkgs.writeShellScriptBin "copy-to-podman" ''
-    ${skopeo-nix2container}/bin/skopeo --insecure-policy copy nix:${image} containers-storage:${image.name}:${image.tag}
-    ${skopeo-nix2container}/bin/skopeo --insecure-policy inspect containers-storage:${image.name}:${image.tag}
+    ${copyImageWith nativeStorageCopy image "containers-storage:${image.name}:${image.tag}" "containers-storage:${image.name}:${image.tag}"}
+    echo Image ${image.name}:${image.tag} has been copied to the containers storage
   '';
 
   # Pull an image from a registry with Skopeo and translate it to a
@@ -73,7 +333,92 @@ let
     , arch ? pkgs.go.GOARCH
     , tlsVerify ? true
     , name ? fixName "docker-image-${imageName}"
+      # Verify the cosign signature of the image before using it,
+      # either against a public key file (cosignKey) or, for keyless
+      # signatures, against the certificate identity and OIDC issuer
+      # (such as "https://token.actions.githubusercontent.com"). The
+      # signatures of the image are downloaded by a fixed-output
+      # derivation of hash cosignSignaturesSha256 and then verified
+      # offline, with their transparency log bundles, by a regular
+      # derivation: the image is not built if no signature can be
+      # verified.
+    , cosignKey ? null
+    , cosignIdentity ? null
+    , cosignIssuer ? null
+    , cosignSignaturesSha256 ? null
+      # A containers-policy.json file enforced by skopeo when the image
+      # is fetched, such as a policy requiring signatures of the
+      # registry. The registriesD directory configures where
+      # signatures are looked up.
+    , policy ? null
+    , registriesD ? null
+      # Registry mirrors, such as internal pull-through caches, tried
+      # in order before the registry of the image. This is an
+      # attribute set from registries (or repository prefixes) to
+      # mirror locations, for instance
+      # { "docker.io" = [ "mirror.example.com/docker.io" ]; }. A
+      # mirror can also be { location = "..."; insecure = true; }.
+      # Since the image is pulled by digest, mirrors don't change it.
+      # Alternatively, registriesConf is a registries.conf file (see
+      # containers-registries.conf(5)) defining the mirrors.
+    , mirrors ? registryMirrors
+    , registriesConf ? defaultRegistriesConf
     }: let
+      verify = cosignKey != null || cosignIdentity != null;
+      mirrorsConf = (pkgs.formats.toml {}).generate "registries.conf" {
+        registry = pkgs.lib.mapAttrsToList (prefix: locations: {
+          inherit prefix;
+          location = prefix;
+          mirror = map (m: if builtins.isString m then { location = m; } else m) locations;
+        }) mirrors;
+      };
+      registriesConfFile =
+        if registriesConf != null then registriesConf
+        else if mirrors != {} then mirrorsConf
+        else null;
+      cosignFlags = if cosignKey != null
+        then "--key ${cosignKey}"
+        else "--certificate-identity '${cosignIdentity}' --certificate-oidc-issuer '${cosignIssuer}'";
+      # Downloading the signatures needs the network: this is a
+      # fixed-output derivation, which doesn't verify anything.
+      signatures = pkgs.runCommand "${name}-cosign-signatures"
+      {
+        impureEnvVars = pkgs.lib.fetchers.proxyImpureEnvVars;
+        outputHashMode = "flat";
+        outputHashAlgo = "sha256";
+        outputHash = cosignSignaturesSha256;
+        nativeBuildInputs = pkgs.lib.singleton pkgs.cosign;
+        SSL_CERT_FILE = "${pkgs.cacert.out}/etc/ssl/certs/ca-bundle.crt";
+      } ''
+        export HOME=$TMPDIR
+        cosign download signature "${imageName}@${imageDigest}" > $out
+      '';
+      # The signatures are verified by a regular derivation, which is
+      # built again when the image or the verification parameters
+      # change: a signature is valid if its payload is the image digest
+      # and if cosign verifies it offline.
+      verification = pkgs.runCommand "${name}-cosign-verification"
+      {
+        nativeBuildInputs = [ pkgs.cosign pkgs.jq ];
+      } ''
+        export HOME=$TMPDIR
+        n=0
+        while IFS= read -r signature; do
+          n=$((n+1))
+          printf '%s' "$signature" | jq -r .Payload | base64 -d > payload-$n
+          if [ "$(jq -r '.critical.image["docker-manifest-digest"]' payload-$n)" != "${imageDigest}" ]; then
+            echo "Signature $n: the payload is not the one of ${imageDigest}"
+            continue
+          fi
+          printf '%s' "$signature" | jq '{base64Signature: .Base64Signature, cert: ((.Cert // "") | @base64), rekorBundle: .Bundle}' > bundle-$n.json
+          if cosign verify-blob --offline ${cosignFlags} --bundle bundle-$n.json payload-$n; then
+            echo "${imageName}@${imageDigest} verified with ${cosignFlags}" > $out
+            exit 0
+          fi
+        done < ${signatures}
+        echo "None of the $n signatures of ${imageName}@${imageDigest} can be verified with ${cosignFlags}"
+        exit 1
+      '';
       dir = pkgs.runCommand name
       {
         inherit imageDigest;
@@ -88,7 +433,9 @@ let
         sourceURL = "docker://${imageName}@${imageDigest}";
       } ''
       skopeo \
-        --insecure-policy \
+        ${if policy != null then "--policy ${policy}" else "--insecure-policy"} \
+        ${pkgs.lib.optionalString (registriesD != null) "--registries.d ${registriesD}"} \
+        ${pkgs.lib.optionalString (registriesConfFile != null) "--registries-conf ${registriesConfFile}"} \
         --tmpdir=$TMPDIR \
         --override-os ${os} \
         --override-arch ${arch} \
@@ -97,10 +444,27 @@ let
         "$sourceURL" "dir://$out" \
         | cat  # pipe through cat to force-disable progress bar
       '';
-    in pkgs.runCommand "nix2container-${imageName}.json" {} ''
+    in
+    assert pkgs.lib.assertMsg (cosignIdentity == null || cosignIssuer != null) "pullImage: cosignIdentity requires cosignIssuer";
+    assert pkgs.lib.assertMsg (!verify || cosignSignaturesSha256 != null) "pullImage: the cosign verification requires cosignSignaturesSha256";
+    pkgs.runCommand "nix2container-${imageName}.json" {} ''
+      ${pkgs.lib.optionalString verify "echo Signature of ${imageName}: $(cat ${verification})"}
       ${nix2containerUtil}/bin/nix2container image-from-dir $out ${dir}
     '';
 
+  # Build the base image imageName of a base image lock file (written
+  # by "nix2container lock-base") from a local blob directory, without
+  # network access. The build fails if the blobs don't match the
+  # digests of the lock.
+  pullImageFromLock =
+    { imageName
+    , lockFile
+    , blobDirectory
+    }:
+    pkgs.runCommand "nix2container-${builtins.replaceStrings [ "/" ":" ] [ "-" "-" ] imageName}.json" {} ''
+      ${nix2containerUtil}/bin/nix2container image-from-lock $out ${lockFile} '${imageName}' ${blobDirectory}
+    '';
+
   buildLayer = {
     # A list of store paths to include in the layer.
     deps ? [],
@@ -117,6 +481,10 @@ let
     # isolate store paths that are often updated from more stable
     # store paths, to speed up build and push time.
     layers ? [],
+    # A list of images built with the buildImage function: store paths
+    # belonging to the layers of these images are skipped. This
+    # allows to build the delta between an image and a new closure.
+    parentImages ? [],
     # Store the layer tar in the derivation. This is useful when the
     # layer dependencies are not bit reproducible.
     reproducible ? true,
@@ -129,30 +497,257 @@ let
     #   mode = "0664";
     # }
     # The mode is applied on a specific path. In this path subtree,
-    # the mode is then applied on all files matching the regex.
+    # the mode is then applied on all files matching the regex. A
+    # permission can also set the uname and gname of these files.
     perms ? [],
+    # A list of single files to add to the layer. Each element of
+    # this list is a dict such as
+    # { source = pkgs.writeText "nginx.conf" "...";
+    #   destination = "/etc/nginx/nginx.conf";
+    # }
+    # The source store path is then located at destination in the
+    # image, instead of being located in the /nix/store.
+    files ? [],
+    # Clear the setuid, setgid and sticky bits of all files of the
+    # layer. Modes set with perms are applied after.
+    stripSpecialBits ? false,
+    # An octal string of permission bits (such as "022") cleared on
+    # all files of the layer. Modes set with perms are applied after.
+    umask ? null,
+    # How the POSIX ACLs of files are handled: "strip" (default, with
+    # a warning), "preserve" (as xattrs of the archive entries) or
+    # "error".
+    acls ? null,
+    # The layer compression: null (no compression), "gzip", "zstd" or
+    # "zstd:chunked". The zstd:chunked format allows Podman to only
+    # pull files missing in its local storage.
+    compression ? null,
+    # An external multi-threaded compressor used for gzip or zstd
+    # layers, such as "${pkgs.pigz}/bin/pigz -n" or
+    # "${pkgs.zstd}/bin/zstdmt". Its output must be reproducible
+    # since it is also used when the image is pushed: the command
+    # recorded in the layer is only run if the same command is set in
+    # NIX2CONTAINER_COMPRESSION_COMMAND when the image is pushed.
+    compressionCommand ? null,
+    # Write an index of the files of the layer archive, allowing
+    # "nix2container cat" to extract single files quickly.
+    fileIndex ? false,
+    # The prefix of the layer archive entries: "/" (/nix/store/...),
+    # "" (nix/store/...) or any other prefix. By default, entries are
+    # rooted as they are produced by rewrites.
+    tarPrefix ? null,
+    # Pin the version of the layer archive serialization ("v1" or
+    # "v2"), so that upgrading nix2container doesn't change the layer
+    # digest. The latest version is used by default. The v1 version
+    # doesn't support the options introduced by v2: preserved ACLs,
+    # sparse files, owner names (uname and gname), name policies and
+    # absolute symlinks policies.
+    # It also matches perms with the rewrite regex of the path instead
+    # of their own regex, as the first versions of nix2container did,
+    # and archives the store paths in the order they are listed
+    # instead of sorting them.
+    tarFormat ? null,
+    # Fail if an input can not be archived deterministically (a path
+    # outside of the Nix store, a socket, a device, a named pipe or
+    # POSIX ACLs to strip) instead of silently normalizing it.
+    strictRepro ? false,
+    # Fail if a file of the layer is larger than this size, such as
+    # "1G". Files larger than 8GiB are supported (as PAX records).
+    maxEntrySize ? null,
+    # Store the holes of sparse files, such as pre-allocated database
+    # files, as PAX sparse records instead of expanding them. Holes
+    # are runs of zero blocks, whatever the filesystem.
+    sparse ? false,
+    # How unsafe file names are handled: "keep" (default), "reject"
+    # or "sanitize". Names with control characters, invalid UTF-8,
+    # . or .. elements (produced by rewrites) or not in the Unicode
+    # NFC form are rejected or sanitized (control characters are
+    # replaced by underscores and names are normalized), so that the
+    # archive can not be misinterpreted by naive extractors. Symlinks
+    # escaping the archive root, such as ../../etc/passwd, are
+    # rejected by both policies.
+    namePolicy ? null,
+    # How symlinks with an absolute target (such as
+    # /nix/store/...-bash/bin/bash) are handled: null (kept),
+    # "reject" or "relativize", which rewrites the target relative to
+    # the symlink, so that extractors can not resolve it on the host.
+    absoluteSymlinks ? null,
+    # The owner names of the layer files, "root" by default. Some
+    # consumers expect numeric-only ownership (""), others names
+    # present in the /etc/passwd of the image.
+    uname ? null,
+    gname ? null,
+    # How a file overriding a file of the layer with different
+    # attributes (such as overlapping store paths added with different
+    # perms) is handled: "strict" (default) fails, "relaxed" only
+    # fails if their type, link target or content differ.
+    conflicts ? null,
+    # A list of recipients the layer is encrypted for, such as
+    # "jwe:${./public.pem}", "pgp:user@example.com" or
+    # "pkcs7:${./cert.pem}". Since encryption is not reproducible,
+    # the encrypted layer is stored in the derivation.
+    encryptionRecipients ? [],
+    # The algorithm of the layer digest: "sha256" or "sha512"
+    digestAlgorithm ? null,
+    # Split the store paths into several layers (at most maxLayers),
+    # ordered by stability: the deepest dependencies of the closure
+    # (such as glibc or openssl) are in the lowest layers and the
+    # store paths of deps and contents in the top layer. Only
+    # reproducible layers can be split.
+    maxLayers ? 1,
+    # How store paths are split into maxLayers layers: "stability"
+    # (by dependency depth) or "popularity" (as buildLayeredImage of
+    # nixpkgs, the most popular store paths have their own layer).
+    # With both strategies, the top layer only contains the roots of
+    # the closure, such as the application and its customization.
+    splitStrategy ? "stability",
+    # Select the store paths of the layer according to the reference
+    # graph: only the closures of the closureOf store paths are kept
+    # (at most closureMaxDepth references away from them, if set) and
+    # the closures of the excludeClosureOf store paths are skipped.
+    # For instance, the runtime dependencies of an application
+    # excluding the closure of its interpreter, already provided by
+    # another layer:
+    # { deps = [ app ]; excludeClosureOf = [ pkgs.python3 ]; }
+    closureOf ? [],
+    excludeClosureOf ? [],
+    closureMaxDepth ? null,
+    # The RFC3339 creation date of the layer, such as
+    # "2024-01-01T00:00:00Z", set in the history of the image
+    # configuration.
+    created ? null,
+    # The author and the command (nix2container by default) of the
+    # history entry of the layer.
+    author ? null,
+    createdBy ? null,
+    # The position of the layer in the image: layers are sorted by
+    # their order (0 by default), layers with a higher order being
+    # above. An overriding layer, such as a customized /etc, has to
+    # have a higher order than the layers it shadows: otherwise, the
+    # image build fails.
+    order ? null,
+    # A size budget of the layers, such as "100M", enforced when the
+    # image is built: the build fails with the biggest store paths of
+    # the layers when they exceed it. Layers sharing the budgetName
+    # share the budget (by default, each buildLayer call has its own
+    # budget).
+    maxSize ? null,
+    budgetName ? null,
   }: let
-    subcommand = if reproducible
+    subcommand = if reproducible && encryptionRecipients == []
               then "layers-from-reproducible-storepaths"
               else "layers-from-non-reproducible-storepaths";
     rewrites = pkgs.lib.concatMapStringsSep " " (p: "--rewrite '${p},^${p},'") contents;
     permsFile = pkgs.writeText "perms.json" (builtins.toJSON perms);
     permsFlag = pkgs.lib.optionalString (perms != []) "--perms ${permsFile}";
-    allDeps = deps ++ contents;
-    tarDirectory = pkgs.lib.optionalString (! reproducible) "--tar-directory $out";
+    filesFlags = pkgs.lib.concatMapStringsSep " " (f: "--file '${f.source},${f.destination}'") files;
+    allDeps = deps ++ contents ++ (map (f: f.source) files);
+    modeFlags = pkgs.lib.optionalString stripSpecialBits "--strip-special-bits "
+      + pkgs.lib.optionalString (umask != null) "--umask ${umask} "
+      + pkgs.lib.optionalString (acls != null) "--acls ${acls} "
+      + pkgs.lib.optionalString strictRepro "--strict-repro "
+      + pkgs.lib.optionalString (maxEntrySize != null) "--max-entry-size ${maxEntrySize} "
+      + pkgs.lib.optionalString sparse "--sparse "
+      + pkgs.lib.optionalString (namePolicy != null) "--name-policy ${namePolicy} "
+      + pkgs.lib.optionalString (absoluteSymlinks != null) "--absolute-symlinks ${absoluteSymlinks} "
+      + pkgs.lib.optionalString (uname != null) "--uname '${uname}' "
+      + pkgs.lib.optionalString (gname != null) "--gname '${gname}' "
+      + pkgs.lib.optionalString (conflicts != null) "--conflicts ${conflicts}";
+    compressionFlag = pkgs.lib.optionalString (compression != null) "--compression ${compression}";
+    compressionCommandFlag = pkgs.lib.optionalString (compressionCommand != null) "--compression-command '${compressionCommand}'";
+    fileIndexFlag = pkgs.lib.optionalString fileIndex "--file-index-directory $out";
+    tarPrefixFlag = pkgs.lib.optionalString (tarPrefix != null) "--tar-prefix '${tarPrefix}'";
+    tarFormatFlag = pkgs.lib.optionalString (tarFormat != null) "--tar-format ${tarFormat}";
+    tarDirectory = pkgs.lib.optionalString (! reproducible || encryptionRecipients != []) "--tar-directory $out";
+    encryptionFlags = pkgs.lib.concatMapStringsSep " " (r: "--encryption-recipient '${r}'") encryptionRecipients;
+    parentImagesFlags = pkgs.lib.concatMapStringsSep " " (i: "--parent-image ${i}") parentImages;
+    digestAlgorithmFlag = pkgs.lib.optionalString (digestAlgorithm != null) "--digest-algorithm ${digestAlgorithm}";
+    createdFlag = pkgs.lib.optionalString (created != null) "--created ${created}";
+    historyFlags = pkgs.lib.optionalString (author != null) "--author ${pkgs.lib.escapeShellArg author} "
+      + pkgs.lib.optionalString (createdBy != null) "--created-by ${pkgs.lib.escapeShellArg createdBy}";
+    orderFlag = pkgs.lib.optionalString (order != null) "--order=${toString order}";
+    budgetFlags = pkgs.lib.optionalString (maxSize != null) "--max-size ${maxSize} "
+      + pkgs.lib.optionalString (budgetName != null) "--budget-name ${pkgs.lib.escapeShellArg budgetName}";
+    closureGraph = pkgs.runCommand "closure-graph.json" {
+      __structuredAttrs = true;
+      exportReferencesGraph.graph = allDeps ++ closureOf ++ excludeClosureOf;
+    } ''
+      ${pkgs.jq}/bin/jq .graph "''${NIX_ATTRS_JSON_FILE:-.attrs.json}" > $out
+    '';
+    selectClosure = closureOf != [] || excludeClosureOf != [] || closureMaxDepth != null;
+    maxLayersFlags = pkgs.lib.optionalString (maxLayers > 1 || selectClosure) "--closure-graph ${closureGraph} "
+      + pkgs.lib.optionalString (maxLayers > 1) "--max-layers ${toString maxLayers} --split-strategy ${splitStrategy}";
+    closureFlags = pkgs.lib.concatMapStringsSep " " (p: "--closure-of ${p}") closureOf
+      + " " + pkgs.lib.concatMapStringsSep " " (p: "--exclude-closure-of ${p}") excludeClosureOf
+      + pkgs.lib.optionalString (closureMaxDepth != null) " --closure-max-depth ${toString closureMaxDepth}";
   in
+  assert pkgs.lib.assertMsg (maxLayers <= 1 || subcommand == "layers-from-reproducible-storepaths") "buildLayer: maxLayers requires reproducible layers";
   pkgs.runCommand "layers.json" {} ''
     mkdir $out
     ${nix2containerUtil}/bin/nix2container ${subcommand} \
       $out/layers.json \
       ${pkgs.closureInfo {rootPaths = allDeps;}}/store-paths \
       ${rewrites} \
+      ${filesFlags} \
       ${permsFlag} \
+      ${modeFlags} \
+      ${compressionFlag} \
+      ${compressionCommandFlag} \
+      ${fileIndexFlag} \
+      ${tarPrefixFlag} \
+      ${tarFormatFlag} \
       ${tarDirectory} \
+      ${encryptionFlags} \
+      ${parentImagesFlags} \
+      ${digestAlgorithmFlag} \
+      ${createdFlag} \
+      ${historyFlags} \
+      ${orderFlag} \
+      ${budgetFlags} \
+      ${maxLayersFlags} \
+      ${closureFlags} \
       ${pkgs.lib.concatMapStringsSep " "  (l: l + "/layers.json") layers} \
       ${pkgs.lib.optionalString (ignore != null) "--ignore ${ignore}"}
     '';
 
+  # The blob of the layer digest published into a Nix binary cache by
+  # "nix2container publish-binary-cache" (or the --binary-cache option
+  # of the copy scripts). Its store path only depends on the digest:
+  # it is substituted from the binary cache, the derivation is never
+  # built.
+  layerBlobFromBinaryCache = digest:
+    pkgs.runCommand "nix2container-layer" {
+      outputHashMode = "flat";
+      outputHashAlgo = "sha256";
+      outputHash = pkgs.lib.removePrefix "sha256:" digest;
+    } ''
+      echo "The layer blob ${digest} is not available in the substituters" >&2
+      exit 1
+    '';
+
+  # Build a layer only referenced by its digest, such as a huge
+  # dataset layer published once. Its blob is never generated: it
+  # has to be already present on the registry the image is pushed to
+  # or to be available at one of its URLs.
+  buildPinnedLayer = {
+    digest,
+    diffId,
+    # The size in bytes of the layer blob
+    size,
+    mediaType ? "application/vnd.oci.image.layer.v1.tar+gzip",
+    # URLs the layer blob can be downloaded from (a CDN for instance).
+    # They are added to the image manifest, so that clients can
+    # download the blob from them instead of the registry.
+    urls ? [],
+  }:
+  pkgs.runCommand "layers.json" {} ''
+    mkdir $out
+    ${nix2containerUtil}/bin/nix2container layer-pinned \
+      --media-type ${mediaType} \
+      ${pkgs.lib.concatMapStringsSep " " (u: "--url '${u}'") urls} \
+      $out/layers.json ${digest} ${diffId} ${toString size}
+  '';
+
   buildImage = {
     name,
     tag ? "latest",
@@ -169,8 +764,21 @@ let
     # path prefix /nix/store/hash-path is removed. The store path
     # content is then located at the image /.
     contents ? [],
-    # An image that is used as base image of this image.
+    # An image that is used as base image of this image: an image
+    # pulled with pullImage or another image built with buildImage.
+    # With a buildImage image, images can be layered in a hierarchy
+    # fully built by Nix: the layers of the base image are reused, its
+    # store paths are not added again and its configuration is merged
+    # (see configInheritance).
     fromImage ? "",
+    # A previous version of this image, built with buildImage. The
+    # image is then built on top of it and only contains new layers
+    # for store paths which are not in the previous image: layers
+    # already pushed are reused by registries, which makes rolling
+    # updates cheap. fromImage is ignored if this is set. Layers of
+    # the layers attribute should also be built with
+    # `parentImages = [ deltaFrom ];`.
+    deltaFrom ? null,
     # A list of file permisssions which are set when the tar layer is
     # created: these permissions are not written to the Nix store.
     # 
@@ -180,38 +788,277 @@ let
     #   mode = "0664";
     # }
     # The mode is applied on a specific path. In this path subtree,
-    # the mode is then applied on all files matching the regex.
+    # the mode is then applied on all files matching the regex. A
+    # permission can also set the uname and gname of these files.
     perms ? [],
+    # A list of single files to add to the image, such as
+    # { source = pkgs.writeText "nginx.conf" "...";
+    #   destination = "/etc/nginx/nginx.conf";
+    # }
+    files ? [],
+    # Clear the setuid, setgid and sticky bits of all files of the
+    # image customization layer.
+    stripSpecialBits ? false,
+    # An octal string of permission bits cleared on all files of the
+    # image customization layer.
+    umask ? null,
+    # How the POSIX ACLs of the files of the image customization layer
+    # are handled: "strip", "preserve" or "error".
+    acls ? null,
+    # A script wrapping the entrypoint, generated in a dedicated
+    # layer. For instance:
+    # { shell = "${pkgs.bash}/bin/bash";
+    #   init = "${pkgs.tini}/bin/tini";
+    #   env = { PORT = "8080"; };
+    # }
+    # The configuration entrypoint is then prefixed by the wrapper.
+    entrypointWrapper ? null,
+    # The platform of the image, such as "arm64" and "linux". By
+    # default, images are amd64 linux images.
+    architecture ? null,
+    os ? null,
+    # The version and the features of the operating system, such as
+    # "10.0.17763.1234" and [ "win32k" ] for Windows images. They are
+    # inherited from Windows base images, with the configuration
+    # fields nix2container doesn't support (ArgsEscaped and Shell).
+    osVersion ? null,
+    osFeatures ? [],
+    # A scanner command run on the OCI image layout of the image by
+    # the image.scan script, such as
+    # "${pkgs.grype}/bin/grype oci-dir:{} --fail-on high"
+    # where {} is replaced by the layout directory. Options of the
+    # scan script (such as --attach, or --push docker://registry/app
+    # to push the result as a referrer of the pushed image) are passed
+    # to nix2container scan.
+    scanner ? null,
+    # Size budgets, such as "500M" or "1G". The build fails with a
+    # breakdown of the image size by layer and store path when the
+    # image or one of its layers exceeds its budget.
+    maxImageSize ? null,
+    maxLayerSize ? null,
+    # How the fields of the fromImage configuration are inherited,
+    # for instance { Env = "merge"; Labels = "merge"; User = "inherit"; }.
+    # A field is "replace" by default: the fromImage value is ignored.
+    # "inherit" uses the fromImage value if the field is not set and
+    # "merge" adds the fromImage entries of Env, ExposedPorts, Volumes
+    # and Labels to the entries of the config. When fromImage is built
+    # with buildImage, Env, ExposedPorts, Volumes and Labels are merged
+    # and the other fields inherited by default.
+    configInheritance ? {},
+    # Scan the image files for obvious secrets (private keys, AWS
+    # access keys, netrc credentials) captured by impure builds:
+    # "ignore", "warn" or "fail". Files matching one of the
+    # secretsAllow regexes, such as test keys of packages, are not
+    # reported.
+    secretsPolicy ? "ignore",
+    secretsAllow ? [],
+    # The Nix inputs of the image, recorded as annotations of the
+    # image manifest, for instance:
+    # { flakeRef = "github:owner/repo/${self.rev}";
+    #   nixpkgsRevision = nixpkgs.rev;
+    #   derivations = [ pkgs.hello ];
+    # }
+    # The derivation paths of the derivations are recorded, without
+    # making them dependencies of the image.
+    provenance ? null,
+    # How to build the image again, added to the image labels and
+    # used by nix2container reproduce, for instance:
+    # { flake = "github:owner/repo/${self.rev}";
+    #   attribute = "packages.x86_64-linux.image";
+    # }
+    # The system defaults to the current system.
+    rebuild ? null,
+    # The manifest the image is attached to as a referrer, such as a
+    # debug variant of a primary image. It is either another
+    # nix2container image or a descriptor, such as
+    # { digest = "sha256:..."; size = 1234; }.
+    subject ? null,
+    # The RFC3339 creation date of the image, such as
+    # "2024-01-01T00:00:00Z", set in the image configuration. Some
+    # registries rely on it, for instance for cleanup policies. It is
+    # not set by default: registries then show the epoch. Use a fixed
+    # date (such as the date of the last commit) to keep the image
+    # reproducible.
+    created ? null,
+    # History entries without layer, added after the entries of the
+    # layers as empty_layer entries, for instance:
+    # [ { created = "2024-01-01T00:00:00Z"; created-by = "ENV PATH=/bin"; } ]
+    history ? [],
+    # Add the Dockerfile instructions producing the configuration (such
+    # as ENV and LABEL) as empty_layer history entries, so that the
+    # history matches the one of a Dockerfile-built image.
+    configHistory ? false,
+    # Remove the store paths added to several layers from all of them
+    # but the lowest one. The duplicated paths and the size they waste
+    # are reported in any case.
+    hoistDuplicates ? false,
+    # Small files added to the image in a generated layer, without
+    # creating a derivation for each of them, for instance:
+    # [ { path = "/VERSION"; content = "1.2.3"; }
+    #   { path = "/etc/resolv.conf"; content = "nameserver 10.0.0.1\n"; mode = "0644"; }
+    #   { path = "/var/lib/app/key.bin"; content = "AAEC"; encoding = "base64"; uid = 1000; gid = 1000; } ]
+    # The mode defaults to "0644" and the owner to root.
+    inlineFiles ? [],
+    # Check that the executable of the Entrypoint (or of the Cmd)
+    # exists in the image layers, after rewrites, and is executable:
+    # the build fails instead of producing an image which crashes at
+    # runtime. Executables without a slash are searched in the PATH
+    # of the image configuration.
+    checkEntrypoint ? true,
+    # Check that the shared libraries of the ELF executable of the
+    # Entrypoint, and of its libraries, can be found in the image, as
+    # the dynamic loader would search them (RUNPATH, LD_LIBRARY_PATH
+    # of the config and default directories).
+    checkLinkage ? false,
   }:
     let
       configFile = pkgs.writeText "config.json" (builtins.toJSON config);
+      # The wrapper file is added to the layer dependencies in order to
+      # add the shell and the init binary to the image.
+      entrypointWrapperFile = pkgs.writeText "entrypoint-wrapper.json" (builtins.toJSON entrypointWrapper);
+      entrypointWrapperFlag = pkgs.lib.optionalString (entrypointWrapper != null) "--entrypoint-wrapper ${entrypointWrapperFile}";
       # This layer contains all config dependencies. We ignore the
       # configFile because it is already part of the image, as a
       # specific blob.
       configDepsLayer = buildLayer {
-        inherit contents perms;
-        deps = [configFile];
+        inherit contents perms files stripSpecialBits umask acls;
+        deps = [configFile] ++ pkgs.lib.optional (entrypointWrapper != null) entrypointWrapperFile;
         ignore = configFile;
         layers = layers;
+        # Only the store paths of images built by buildImage can be
+        # skipped: the layers of pulled images are not described by
+        # store paths.
+        parentImages = pkgs.lib.optional (deltaFrom != null || composed) baseImage;
+      };
+      baseImage = if deltaFrom != null then deltaFrom else fromImage;
+      # Images built by buildImage can be composed
+      composed = deltaFrom == null && builtins.isAttrs fromImage && fromImage.isNix2containerImage or false;
+      composedInheritance = pkgs.lib.optionalAttrs composed {
+        Env = "merge"; ExposedPorts = "merge"; Volumes = "merge"; Labels = "merge";
+        User = "inherit"; Entrypoint = "inherit"; Cmd = "inherit";
+        WorkingDir = "inherit"; StopSignal = "inherit";
       };
-      fromImageFlag = pkgs.lib.optionalString (fromImage != "") "--from-image ${fromImage}";
+      fromImageFlag = pkgs.lib.optionalString (baseImage != "") "--from-image ${baseImage}";
+      platformFlags = pkgs.lib.optionalString (architecture != null) "--architecture ${architecture} "
+        + pkgs.lib.optionalString (os != null) "--os ${os} "
+        + pkgs.lib.optionalString (osVersion != null) "--os-version ${osVersion} "
+        + pkgs.lib.concatMapStringsSep " " (f: "--os-feature ${f}") osFeatures;
+      budgetFlags = pkgs.lib.optionalString (maxImageSize != null) "--max-image-size ${maxImageSize} "
+        + pkgs.lib.optionalString (maxLayerSize != null) "--max-layer-size ${maxLayerSize}";
+      configInheritanceFlags = pkgs.lib.concatStringsSep " " (pkgs.lib.mapAttrsToList
+        (field: mode: "--config-inheritance ${field}=${mode}") (composedInheritance // configInheritance));
+      secretsFlags = "--secrets-policy ${secretsPolicy} "
+        + pkgs.lib.concatMapStringsSep " " (r: "--secrets-allow ${pkgs.lib.escapeShellArg r}") secretsAllow;
+      provenanceFile = pkgs.writeText "provenance.json" (builtins.toJSON {
+        flake-ref = provenance.flakeRef or "";
+        nixpkgs-revision = provenance.nixpkgsRevision or "";
+        derivations = map (d: builtins.unsafeDiscardStringContext d.drvPath) (provenance.derivations or []);
+      });
+      provenanceFlag = pkgs.lib.optionalString (provenance != null) "--provenance ${provenanceFile}";
+      rebuildFile = pkgs.writeText "rebuild.json" (builtins.toJSON ({ system = pkgs.system; } // rebuild));
+      rebuildFlag = pkgs.lib.optionalString (rebuild != null) "--rebuild ${rebuildFile}";
+      subjectFlag =
+        if subject == null then ""
+        else if pkgs.lib.isDerivation subject then "--subject-image ${subject}"
+        else "--subject ${pkgs.writeText "subject.json" (builtins.toJSON subject)}";
+      createdFlag = pkgs.lib.optionalString (created != null) "--created ${created}";
+      historyFile = pkgs.writeText "history.json" (builtins.toJSON history);
+      historyFlag = pkgs.lib.optionalString (history != []) "--history ${historyFile}";
+      configHistoryFlag = pkgs.lib.optionalString configHistory "--config-history";
+      hoistDuplicatesFlag = pkgs.lib.optionalString hoistDuplicates "--hoist-duplicates";
+      inlineFilesFile = pkgs.writeText "inline-files.json" (builtins.toJSON inlineFiles);
+      inlineFilesFlag = pkgs.lib.optionalString (inlineFiles != []) "--inline-files ${inlineFilesFile}";
+      checkEntrypointFlag = pkgs.lib.optionalString checkEntrypoint "--check-entrypoint";
+      checkLinkageFlag = pkgs.lib.optionalString checkLinkage "--check-linkage";
       layerPaths = pkgs.lib.concatMapStringsSep " " (l: l + "/layers.json") ([configDepsLayer] ++ layers);
       image = pkgs.runCommand "image.json" {} ''
         ${nix2containerUtil}/bin/nix2container image \
         $out \
         ${fromImageFlag} \
+        ${entrypointWrapperFlag} \
+        ${platformFlags} \
+        ${budgetFlags} \
+        ${configInheritanceFlags} \
+        ${secretsFlags} \
+        ${provenanceFlag} \
+        ${rebuildFlag} \
+        ${subjectFlag} \
+        ${createdFlag} \
+        ${historyFlag} \
+        ${configHistoryFlag} \
+        ${hoistDuplicatesFlag} \
+        ${inlineFilesFlag} \
+        ${checkEntrypointFlag} \
+        ${checkLinkageFlag} \
         ${configFile} \
         ${layerPaths}
       '';
       namedImage = image // { inherit name tag; };
     in namedImage // {
+        isNix2containerImage = true;
         copyToDockerDeamon = copyToDockerDeamon namedImage;
         copyToRegistry = copyToRegistry namedImage;
         copyToPodman = copyToPodman namedImage;
+        dockerArchive = dockerArchive namedImage;
+        ctrArchive = ctrArchive namedImage;
+        pushImageJson = pushImageJson namedImage;
         copyTo = copyTo namedImage;
+    } // pkgs.lib.optionalAttrs (scanner != null) {
+        scan = pkgs.writeShellScriptBin "scan" ''
+          ${nix2containerUtil}/bin/nix2container scan "$@" ${image} -- ${scanner}
+        '';
     };
+
+  # Build an ext4, erofs or squashfs filesystem image containing the
+  # files of an image built with buildImage, for instance to boot a
+  # microVM. The digest and size of the filesystem image are written
+  # to the result output.
+  buildRootfs = {
+    image,
+    # "ext4", "erofs" or "squashfs"
+    format ? "ext4",
+    # The size of the ext4 filesystem image, such as "1G"
+    size ? "1G",
+  }:
+  let
+    mkfs = {
+      ext4 = "${pkgs.e2fsprogs}/bin/mkfs.ext4";
+      erofs = "${pkgs.erofs-utils}/bin/mkfs.erofs";
+      squashfs = "${pkgs.squashfsTools}/bin/mksquashfs";
+    }.${format};
+  in
+  pkgs.runCommand "rootfs.${format}" { outputs = [ "out" "result" ]; } ''
+    ${nix2containerUtil}/bin/nix2container rootfs \
+      --format ${format} \
+      --size ${size} \
+      --mkfs ${mkfs} \
+      --result $result \
+      ${image} $out
+  '';
+
+  # Build a multi-platform index from images built with buildImage.
+  # The index JSON file can be copied with the Go nix: transport.
+  buildIndex = {
+    name,
+    tag ? "latest",
+    # A list of platforms such as
+    # { platform = { os = "linux"; architecture = "arm64"; };
+    #   image = buildImage { ... };
+    #   annotations = { ... };
+    # }
+    # Entries without image or with `skip = true;` are placeholders
+    # which are not written to the index.
+    images,
+  }:
+    let
+      entries = map (e: e // pkgs.lib.optionalAttrs (e ? image) { image = "${e.image}"; }) images;
+      entriesFile = pkgs.writeText "index-entries.json" (builtins.toJSON entries);
+      index = pkgs.runCommand "index.json" {} ''
+        ${nix2containerUtil}/bin/nix2container index $out ${entriesFile}
+      '';
+    in index // { inherit name tag; };
 in
 {
   inherit nix2containerUtil skopeo-nix2container;
-  nix2container = { inherit buildImage buildLayer pullImage; };
+  nix2container = { inherit buildImage buildLayer buildPinnedLayer buildIndex buildRootfs pullImage pullImageFromLock copyImagesToRegistry layerBlobFromBinaryCache; };
 }
@@ -22,5 +22,10 @@
             inherit examples;
           };
           defaultPackage = packages.nix2containerUtil;
+          # Skopeo is built with the transport vendored by go mod
+          # vendor, so that its dependencies are checked
+          checks = {
+            inherit (packages) nix2containerUtil skopeo-nix2container;
+          };
         });
 }
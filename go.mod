@@ -4,8 +4,14 @@ go 1.16
 
 require (
 	github.com/containers/image/v5 v5.18.0
+	github.com/containers/ocicrypt v1.1.2
+	github.com/containers/storage v1.37.0
+	github.com/klauspost/compress v1.13.6
 	github.com/opencontainers/go-digest v1.0.0
 	github.com/opencontainers/image-spec v1.0.3-0.20211202193544-a5463b7f9c84
 	github.com/sirupsen/logrus v1.8.1
 	github.com/spf13/cobra v1.3.0
+	golang.org/x/text v0.3.7
+	google.golang.org/grpc v1.42.0
+	google.golang.org/protobuf v1.27.1
 )
@@ -1,7 +1,14 @@
 package main
 
-import "github.com/nlewo/nix2container/cmd"
+import (
+	"github.com/containers/storage/pkg/reexec"
+	"github.com/nlewo/nix2container/cmd"
+)
 
 func main() {
+	// The containers storage applies layers in reexecuted processes
+	if reexec.Init() {
+		return
+	}
 	cmd.Execute()
 }
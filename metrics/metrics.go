@@ -0,0 +1,142 @@
+// Package metrics provides a minimal set of counters describing the
+// work done by nix2container (layers built, bytes tarred, blobs
+// served, blobs pushed, cache lookups). They can be written to a file
+// in the Prometheus text exposition format, for instance to be
+// collected by the node_exporter textfile collector in CI. The hit
+// ratio of a cache is derived from its lookups by result. Spans of the
+// layer builds and blob uploads can also be recorded and written in
+// the OpenTelemetry OTLP/JSON format (see trace.go).
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	LayersBuilt       = NewCounter("nix2container_layers_built_total", "Number of layers built.")
+	LayerPaths        = NewCounter("nix2container_layer_paths_total", "Number of store paths added to layers.")
+	LayerBytes        = NewCounter("nix2container_layer_bytes_total", "Number of bytes of generated layer tar archives.")
+	LayerBuildSeconds = NewCounter("nix2container_layer_build_seconds_total", "Time spent building layers.")
+	BlobsRead         = NewCounter("nix2container_blobs_read_total", "Number of blobs requested from an image.")
+	BlobBytesRead     = NewCounter("nix2container_blob_bytes_read_total", "Number of bytes read from image blobs.")
+	BlobsPushed       = NewCounter("nix2container_blobs_pushed_total", "Number of blobs uploaded to registries by nix2container.")
+	BlobBytesPushed   = NewCounter("nix2container_blob_bytes_pushed_total", "Number of bytes uploaded to registries by nix2container.")
+	BlobPushSeconds   = NewCounter("nix2container_blob_push_seconds_total", "Time spent uploading blobs to registries.")
+	CacheLookups      = NewCounter("nix2container_cache_lookups_total", "Number of lookups of the digest and blob caches, by cache and result (hit or miss).")
+)
+
+var registry struct {
+	sync.Mutex
+	counters []*Counter
+}
+
+// Counter is a monotonically increasing value, optionally split by
+// label values.
+type Counter struct {
+	name   string
+	help   string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewCounter creates a counter and registers it in order to be
+// exported by Write.
+func NewCounter(name, help string) *Counter {
+	c := &Counter{
+		name:   name,
+		help:   help,
+		values: make(map[string]float64),
+	}
+	registry.Lock()
+	registry.counters = append(registry.counters, c)
+	registry.Unlock()
+	return c
+}
+
+// Add adds v to the counter. Labels are provided as a list of
+// name/value pairs.
+func (c *Counter) Add(v float64, labels ...string) {
+	key := formatLabels(labels)
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+// Inc increments the counter by one.
+func (c *Counter) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+// Value returns the current value of the counter for the given
+// labels.
+func (c *Counter) Value(labels ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[formatLabels(labels)]
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var elts []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		elts = append(elts, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	return "{" + strings.Join(elts, ",") + "}"
+}
+
+// Write writes all registered counters in the Prometheus text
+// exposition format.
+func Write(w io.Writer) error {
+	registry.Lock()
+	defer registry.Unlock()
+	for _, c := range registry.counters {
+		c.mu.Lock()
+		keys := make([]string, 0, len(c.values))
+		for k := range c.values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+		if err == nil && len(keys) == 0 {
+			_, err = fmt.Fprintf(w, "%s 0\n", c.name)
+		}
+		for _, k := range keys {
+			if err != nil {
+				break
+			}
+			_, err = fmt.Fprintf(w, "%s%s %v\n", c.name, k, c.values[k])
+		}
+		c.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteFile atomically writes all registered counters to filename:
+// collectors never read a partially written file.
+func WriteFile(filename string) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), ".metrics-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := Write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
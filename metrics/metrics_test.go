@@ -0,0 +1,27 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	c := NewCounter("test_total", "A test counter.")
+	c.Inc("mediatype", "tar")
+	c.Add(2, "mediatype", "tar")
+	c.Inc("mediatype", "gzip")
+
+	var buf bytes.Buffer
+	if err := Write(&buf); err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := `# HELP test_total A test counter.
+# TYPE test_total counter
+test_total{mediatype="gzip"} 1
+test_total{mediatype="tar"} 3
+`
+	if !strings.Contains(buf.String(), expected) {
+		t.Fatalf("Metrics should contain '%s' (while they are '%s')", expected, buf.String())
+	}
+}
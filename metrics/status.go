@@ -0,0 +1,236 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The phases of the status. The bytes processed are only accounted in
+// the phase they belong to: the blobs generated in the blob cache
+// while an image is pushed are not counted twice.
+const (
+	PhaseBuilding = "building"
+	PhasePushing  = "pushing"
+	PhaseDone     = "done"
+	PhaseFailed   = "failed"
+)
+
+// Status is the progress of the running command, served as JSON by
+// the status endpoint so that CI plugins can poll it instead of
+// parsing logs.
+type Status struct {
+	Command        string    `json:"command"`
+	Phase          string    `json:"phase,omitempty"`
+	CurrentLayers  []string  `json:"current-layers"`
+	LayersDone     int       `json:"layers-done"`
+	LayersTotal    int       `json:"layers-total,omitempty"`
+	BytesProcessed int64     `json:"bytes-processed"`
+	BytesTotal     int64     `json:"bytes-total,omitempty"`
+	StartedAt      time.Time `json:"started-at"`
+	ElapsedSeconds float64   `json:"elapsed-seconds"`
+	// The estimated remaining time, computed from the bytes, or
+	// from the layers if the total of bytes is unknown
+	ETASeconds *float64 `json:"eta-seconds,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+var status struct {
+	sync.Mutex
+	enabled       bool
+	status        Status
+	phaseStart    time.Time
+	currentLayers map[string]int
+}
+
+// EnableStatus starts tracking the status of the command. Status
+// updates are ignored until it is called, so that commands run
+// without a status endpoint don't pay for it.
+func EnableStatus(command string) {
+	status.Lock()
+	defer status.Unlock()
+	now := time.Now()
+	status.enabled = true
+	status.status = Status{Command: command, StartedAt: now}
+	status.phaseStart = now
+	status.currentLayers = make(map[string]int)
+}
+
+// StatusEnabled returns whether the status is tracked.
+func StatusEnabled() bool {
+	status.Lock()
+	defer status.Unlock()
+	return status.enabled
+}
+
+// StartStatusPhase starts a phase of layers totalling bytes (0 if it
+// is unknown): the counters of the previous phase are reset.
+func StartStatusPhase(phase string, layers int, bytes int64) {
+	status.Lock()
+	defer status.Unlock()
+	if !status.enabled {
+		return
+	}
+	status.status.Phase = phase
+	status.status.LayersDone = 0
+	status.status.LayersTotal = layers
+	status.status.BytesProcessed = 0
+	status.status.BytesTotal = bytes
+	status.phaseStart = time.Now()
+	status.currentLayers = make(map[string]int)
+}
+
+// StartStatusLayer marks the layer as being processed.
+func StartStatusLayer(layer string) {
+	status.Lock()
+	defer status.Unlock()
+	if !status.enabled {
+		return
+	}
+	status.currentLayers[layer]++
+}
+
+// EndStatusLayer marks the layer as not being processed anymore. It
+// is counted as done if it has been completely processed.
+func EndStatusLayer(layer string, completed bool) {
+	status.Lock()
+	defer status.Unlock()
+	if !status.enabled || status.currentLayers[layer] == 0 {
+		return
+	}
+	status.currentLayers[layer]--
+	if status.currentLayers[layer] == 0 {
+		delete(status.currentLayers, layer)
+	}
+	if completed {
+		status.status.LayersDone++
+	}
+}
+
+// AddStatusBytes accounts n bytes processed in the phase.
+func AddStatusBytes(phase string, n int64) {
+	status.Lock()
+	defer status.Unlock()
+	if !status.enabled || status.status.Phase != phase {
+		return
+	}
+	status.status.BytesProcessed += n
+}
+
+// StatusWriter accounts the bytes written to it in the phase.
+type StatusWriter string
+
+func (w StatusWriter) Write(p []byte) (int, error) {
+	AddStatusBytes(string(w), int64(len(p)))
+	return len(p), nil
+}
+
+// FinishStatus ends the last phase, as failed if err is not nil.
+func FinishStatus(err error) {
+	status.Lock()
+	defer status.Unlock()
+	if !status.enabled {
+		return
+	}
+	status.status.Phase = PhaseDone
+	if err != nil {
+		status.status.Phase = PhaseFailed
+		status.status.Error = err.Error()
+	}
+	status.currentLayers = make(map[string]int)
+}
+
+// CurrentStatus returns the status of the command.
+func CurrentStatus() Status {
+	status.Lock()
+	defer status.Unlock()
+	s := status.status
+	now := time.Now()
+	s.ElapsedSeconds = now.Sub(s.StartedAt).Seconds()
+	s.CurrentLayers = []string{}
+	for layer := range status.currentLayers {
+		s.CurrentLayers = append(s.CurrentLayers, layer)
+	}
+	sort.Strings(s.CurrentLayers)
+	if s.Phase == PhaseDone || s.Phase == PhaseFailed {
+		return s
+	}
+	phaseElapsed := now.Sub(status.phaseStart).Seconds()
+	var done, total float64
+	if s.BytesTotal > 0 {
+		done, total = float64(s.BytesProcessed), float64(s.BytesTotal)
+	} else if s.LayersTotal > 0 {
+		done, total = float64(s.LayersDone), float64(s.LayersTotal)
+	}
+	if done > 0 && total > 0 {
+		eta := 0.0
+		if done < total {
+			eta = phaseElapsed * (total - done) / done
+		}
+		s.ETASeconds = &eta
+	}
+	return s
+}
+
+// StatusHandler serves the status of the command as JSON.
+func StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		content, err := json.Marshal(CurrentStatus())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(append(content, '\n'))
+	})
+}
+
+// ServeStatus serves the status on the address (such as
+// 127.0.0.1:9080, or 127.0.0.1:0 for a random port) until the context
+// is cancelled. The address the endpoint listens on is returned. Since
+// the status is served without authentication and exposes the layers
+// being built, only loopback addresses are accepted.
+func ServeStatus(ctx context.Context, address string) (string, error) {
+	if err := checkLoopback(address); err != nil {
+		return "", err
+	}
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return "", err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", StatusHandler())
+	server := &http.Server{Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	go server.Serve(l)
+	return l.Addr().String(), nil
+}
+
+// checkLoopback returns an error if the host of the address is not a
+// loopback IP address or localhost.
+func checkLoopback(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("The status address %s is not a loopback address, such as 127.0.0.1:9080", address)
+}
@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStatus(t *testing.T) {
+	AddStatusBytes(PhaseBuilding, 10)
+	if StatusEnabled() {
+		t.Fatalf("The status should not be enabled")
+	}
+
+	EnableStatus("build-all")
+	StartStatusPhase(PhaseBuilding, 2, 100)
+	StartStatusLayer("sha256:a")
+	StartStatusLayer("sha256:b")
+	AddStatusBytes(PhaseBuilding, 50)
+	// Bytes of another phase are not accounted
+	AddStatusBytes(PhasePushing, 1000)
+	EndStatusLayer("sha256:a", true)
+
+	s := CurrentStatus()
+	if s.Command != "build-all" || s.Phase != PhaseBuilding {
+		t.Fatalf("The status should be 'build-all building' (while it is %#v)", s)
+	}
+	if s.BytesProcessed != 50 || s.BytesTotal != 100 || s.LayersDone != 1 || s.LayersTotal != 2 {
+		t.Fatalf("The counters should be '50/100 1/2' (while they are %d/%d %d/%d)", s.BytesProcessed, s.BytesTotal, s.LayersDone, s.LayersTotal)
+	}
+	if len(s.CurrentLayers) != 1 || s.CurrentLayers[0] != "sha256:b" {
+		t.Fatalf("The current layers should be '[sha256:b]' (while they are %v)", s.CurrentLayers)
+	}
+	if s.ETASeconds == nil || *s.ETASeconds < 0 {
+		t.Fatalf("The ETA should be computed (while it is %v)", s.ETASeconds)
+	}
+
+	// An interrupted layer is not done
+	EndStatusLayer("sha256:b", false)
+	StartStatusPhase(PhasePushing, 1, 0)
+	if s := CurrentStatus(); s.BytesProcessed != 0 || s.LayersDone != 0 || s.ETASeconds != nil {
+		t.Fatalf("The counters should be reset by the phase (while they are %#v)", s)
+	}
+
+	FinishStatus(errors.New("failure"))
+	rec := httptest.NewRecorder()
+	StatusHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	var served Status
+	if err := json.Unmarshal(rec.Body.Bytes(), &served); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if served.Phase != PhaseFailed || served.Error != "failure" {
+		t.Fatalf("The served status should be failed (while it is %#v)", served)
+	}
+	rec = httptest.NewRecorder()
+	StatusHandler().ServeHTTP(rec, httptest.NewRequest("POST", "/", nil))
+	if rec.Code != 405 {
+		t.Fatalf("The status code should be 405 (while it is %d)", rec.Code)
+	}
+}
+
+func TestServeStatus(t *testing.T) {
+	for _, address := range []string{":0", "0.0.0.0:0", "[::]:0", "192.0.2.1:0", "example.com:0"} {
+		if _, err := ServeStatus(context.Background(), address); err == nil {
+			t.Fatalf("The non loopback address %s should be rejected", address)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	address, err := ServeStatus(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	resp, err := http.Get("http://" + address)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("The status code should be 200 (while it is %d)", resp.StatusCode)
+	}
+}
@@ -0,0 +1,276 @@
+package metrics
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The kind and status codes of the OTLP spans.
+const (
+	spanKindInternal = 1
+	spanStatusOk     = 1
+	spanStatusError  = 2
+)
+
+var tracer struct {
+	sync.Mutex
+	enabled bool
+	traceID string
+	root    *Span
+	spans   []*Span
+}
+
+// Span is a timed operation of the trace, such as the build of a
+// layer or the upload of a blob. The methods of a nil Span, returned
+// by StartSpan when tracing is not enabled, do nothing.
+type Span struct {
+	mu         sync.Mutex
+	name       string
+	id         string
+	parentID   string
+	start      time.Time
+	end        time.Time
+	attributes map[string]interface{}
+	err        error
+}
+
+type spanKey struct{}
+
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// EnableTrace starts recording spans, children of a root span named
+// after the command.
+func EnableTrace(command string) {
+	tracer.Lock()
+	defer tracer.Unlock()
+	tracer.enabled = true
+	tracer.traceID = randomID(16)
+	tracer.root = &Span{
+		name:       command,
+		id:         randomID(8),
+		start:      time.Now(),
+		attributes: make(map[string]interface{}),
+	}
+	tracer.spans = []*Span{tracer.root}
+}
+
+// TraceEnabled returns true if spans are recorded.
+func TraceEnabled() bool {
+	tracer.Lock()
+	defer tracer.Unlock()
+	return tracer.enabled
+}
+
+// StartSpan starts a span, child of the span of ctx or of the root
+// span, and returns a context carrying it. Attributes are provided as
+// a list of key/value pairs.
+func StartSpan(ctx context.Context, name string, attributes ...interface{}) (context.Context, *Span) {
+	tracer.Lock()
+	defer tracer.Unlock()
+	if !tracer.enabled {
+		return ctx, nil
+	}
+	parent := tracer.root
+	if s, ok := ctx.Value(spanKey{}).(*Span); ok {
+		parent = s
+	}
+	s := &Span{
+		name:       name,
+		id:         randomID(8),
+		parentID:   parent.id,
+		start:      time.Now(),
+		attributes: make(map[string]interface{}),
+	}
+	s.SetAttributes(attributes...)
+	tracer.spans = append(tracer.spans, s)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// SetAttributes sets attributes of the span, provided as a list of
+// key/value pairs. Values are strings or integers.
+func (s *Span) SetAttributes(attributes ...interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i+1 < len(attributes); i += 2 {
+		if key, ok := attributes[i].(string); ok {
+			s.attributes[key] = attributes[i+1]
+		}
+	}
+}
+
+// End ends the span, as failed if err is not nil.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.end.IsZero() {
+		s.end = time.Now()
+		s.err = err
+	}
+}
+
+// FinishTrace ends the root span, as failed if err is not nil.
+func FinishTrace(err error) {
+	tracer.Lock()
+	root := tracer.root
+	tracer.Unlock()
+	root.End(err)
+}
+
+// The OTLP/JSON encoding of the spans, as read by the OpenTelemetry
+// collector (otlpjsonfile receiver).
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func otlpAttributeOf(key string, value interface{}) otlpAttribute {
+	var v otlpValue
+	switch value := value.(type) {
+	case int:
+		s := strconv.FormatInt(int64(value), 10)
+		v.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(value, 10)
+		v.IntValue = &s
+	case string:
+		v.StringValue = &value
+	default:
+		s, _ := json.Marshal(value)
+		str := string(s)
+		v.StringValue = &str
+	}
+	return otlpAttribute{Key: key, Value: v}
+}
+
+func (s *Span) otlp(traceID string) otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	end := s.end
+	if end.IsZero() {
+		// The span is still running when the trace is written
+		end = time.Now()
+	}
+	span := otlpSpan{
+		TraceID:           traceID,
+		SpanID:            s.id,
+		ParentSpanID:      s.parentID,
+		Name:              s.name,
+		Kind:              spanKindInternal,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+		Status:            otlpStatus{Code: spanStatusOk},
+	}
+	if s.err != nil {
+		span.Status = otlpStatus{Code: spanStatusError, Message: s.err.Error()}
+	}
+	keys := make([]string, 0, len(s.attributes))
+	for k := range s.attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		span.Attributes = append(span.Attributes, otlpAttributeOf(k, s.attributes[k]))
+	}
+	return span
+}
+
+// WriteTrace writes the recorded spans in the OTLP/JSON format, as a
+// single line.
+func WriteTrace(w io.Writer) error {
+	tracer.Lock()
+	traceID := tracer.traceID
+	spans := append([]*Span{}, tracer.spans...)
+	tracer.Unlock()
+
+	scope := otlpScopeSpans{Spans: []otlpSpan{}}
+	scope.Scope.Name = "github.com/nlewo/nix2container"
+	for _, s := range spans {
+		scope.Spans = append(scope.Spans, s.otlp(traceID))
+	}
+	resource := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{scope}}
+	resource.Resource.Attributes = []otlpAttribute{otlpAttributeOf("service.name", "nix2container")}
+	traces := otlpTraces{ResourceSpans: []otlpResourceSpans{resource}}
+	content, err := json.Marshal(traces)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(content, '\n'))
+	return err
+}
+
+// WriteTraceFile atomically writes the recorded spans to filename.
+func WriteTraceFile(filename string) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), ".trace-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := WriteTrace(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
@@ -0,0 +1,52 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestTrace(t *testing.T) {
+	if _, span := StartSpan(context.Background(), "layer"); span != nil {
+		t.Fatalf("No span should be recorded when tracing is not enabled")
+	}
+
+	EnableTrace("copy-to-registry")
+	ctx, copySpan := StartSpan(context.Background(), "copy")
+	_, uploadSpan := StartSpan(ctx, "blob upload", "blob.digest", "sha256:a")
+	uploadSpan.SetAttributes("blob.size", 10)
+	uploadSpan.End(errors.New("failure"))
+	copySpan.End(nil)
+	FinishTrace(nil)
+
+	var buf bytes.Buffer
+	if err := WriteTrace(&buf); err != nil {
+		t.Fatalf("%v", err)
+	}
+	var traces otlpTraces
+	if err := json.Unmarshal(buf.Bytes(), &traces); err != nil {
+		t.Fatalf("%v", err)
+	}
+	spans := traces.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 3 {
+		t.Fatalf("The trace should have '3' spans (while it has %d)", len(spans))
+	}
+	root, copied, upload := spans[0], spans[1], spans[2]
+	if root.Name != "copy-to-registry" || root.ParentSpanID != "" {
+		t.Fatalf("The root span should be 'copy-to-registry' (while it is %#v)", root)
+	}
+	if copied.ParentSpanID != root.SpanID || upload.ParentSpanID != copied.SpanID {
+		t.Fatalf("The upload span should be a child of the copy span, child of the root span (while they are %#v)", spans)
+	}
+	if upload.TraceID != root.TraceID || len(upload.TraceID) != 32 {
+		t.Fatalf("The spans should belong to the trace '%s' (while it is %s)", root.TraceID, upload.TraceID)
+	}
+	if upload.Status.Code != spanStatusError || upload.Status.Message != "failure" {
+		t.Fatalf("The upload span should be failed (while it is %#v)", upload.Status)
+	}
+	if len(upload.Attributes) != 2 || upload.Attributes[1].Key != "blob.size" || *upload.Attributes[1].Value.IntValue != "10" {
+		t.Fatalf("The upload span should have a 'blob.size' integer attribute (while it has %#v)", upload.Attributes)
+	}
+}
@@ -0,0 +1,46 @@
+package nix
+
+import (
+	"archive/tar"
+
+	"github.com/nlewo/nix2container/types"
+	"github.com/sirupsen/logrus"
+)
+
+// aclXattrs are the extended attributes storing the POSIX ACLs of a
+// file: the access ACL and, for directories, the default ACL.
+var aclXattrs = []string{"system.posix_acl_access", "system.posix_acl_default"}
+
+// applyACLsPolicy handles the POSIX ACLs of the file path according to
+// the policy: they are either stripped with a warning, preserved as
+// PAX xattr records of the archive entry, or the file is rejected.
+// In strict mode, ACLs are not stripped but rejected.
+func applyACLsPolicy(hdr *tar.Header, path string, policy string, strict bool, audit auditFunc) error {
+	for _, name := range aclXattrs {
+		value, err := getXattr(path, name)
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			continue
+		}
+		switch policy {
+		case types.ACLsPreserve:
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = make(map[string]string)
+			}
+			hdr.PAXRecords["SCHILY.xattr."+name] = string(value)
+		case types.ACLsError:
+			return classErrorf(ErrConflict, "The file %s has POSIX ACLs (%s) which can not be stripped", path, name)
+		default:
+			if strict {
+				return classErrorf(ErrNotReproducible, "The POSIX ACLs (%s) of the file %s would be stripped", name, path)
+			}
+			logrus.Warnf("Stripping the POSIX ACLs (%s) of the file %s", name, path)
+			if audit != nil {
+				audit("acls strip", hdr.Name, name)
+			}
+		}
+	}
+	return nil
+}
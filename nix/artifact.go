@@ -0,0 +1,222 @@
+package nix
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/pkg/blobinfocache/none"
+	imageTypes "github.com/containers/image/v5/types"
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+)
+
+// ImageArtifactType is the artifact type of the OCI artifacts
+// containing the JSON description of an image.
+const ImageArtifactType = "application/vnd.nix2container.image.v1+json"
+
+// ImageArtifactTitle is the title of the image JSON blob of the
+// artifact, used as filename by tools such as oras.
+const ImageArtifactTitle = "image.json"
+
+// imageArtifact returns the manifest and the blobs (the empty config
+// and the image JSON) of the artifact of the image.
+func imageArtifact(image types.Image) (manifest []byte, config []byte, blob []byte, err error) {
+	blob, err = types.MarshalCanonical(image)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	m := referrerManifest{
+		Manifest: v1.Manifest{
+			MediaType: v1.MediaTypeImageManifest,
+			Config: v1.Descriptor{
+				MediaType: "application/vnd.oci.empty.v1+json",
+				Digest:    godigest.FromBytes(emptyJSON),
+				Size:      int64(len(emptyJSON)),
+			},
+			Layers: []v1.Descriptor{
+				{
+					MediaType:   ImageArtifactType,
+					Digest:      godigest.FromBytes(blob),
+					Size:        int64(len(blob)),
+					Annotations: map[string]string{v1.AnnotationTitle: ImageArtifactTitle},
+				},
+			},
+		},
+		ArtifactType: ImageArtifactType,
+	}
+	m.SchemaVersion = 2
+	manifest, err = json.Marshal(m)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return manifest, emptyJSON, blob, nil
+}
+
+// imageArtifactBlob returns the descriptor of the image JSON blob of
+// an artifact manifest.
+func imageArtifactBlob(manifest []byte) (desc v1.Descriptor, err error) {
+	var m referrerManifest
+	if err := json.Unmarshal(manifest, &m); err != nil {
+		return desc, err
+	}
+	if m.ArtifactType != ImageArtifactType {
+		return desc, fmt.Errorf("The artifact type should be %s (while it is %q)", ImageArtifactType, m.ArtifactType)
+	}
+	for _, layer := range m.Layers {
+		if layer.MediaType == ImageArtifactType {
+			return layer, nil
+		}
+	}
+	return desc, fmt.Errorf("The artifact doesn't contain a %s blob", ImageArtifactType)
+}
+
+// PushImageArtifact pushes the JSON description of the image, which
+// references the store paths of its layers, as an OCI artifact to the
+// destination (such as docker://ghcr.io/org/app-json:v1). The blobs
+// of the image are not generated: another machine, with the store
+// paths and the credentials of the image registry, pulls the artifact
+// with PullImageArtifact to generate and push them. The digest of the
+// artifact manifest is returned.
+func PushImageArtifact(ctx context.Context, sys *imageTypes.SystemContext, destination string, image types.Image) (godigest.Digest, error) {
+	if !strings.HasPrefix(destination, "docker://") {
+		return "", fmt.Errorf("Only docker:// destinations can receive image artifacts (while it is %s)", destination)
+	}
+	manifest, config, blob, err := imageArtifact(image)
+	if err != nil {
+		return "", err
+	}
+	ref, err := docker.ParseReference(strings.TrimPrefix(destination, "docker:"))
+	if err != nil {
+		return "", err
+	}
+	dest, err := ref.NewImageDestination(ctx, sys)
+	if err != nil {
+		return "", registryError(err, "Could not write to %s", destination)
+	}
+	defer dest.Close()
+	for _, b := range []struct {
+		content   []byte
+		mediaType string
+		isConfig  bool
+	}{
+		{config, "application/vnd.oci.empty.v1+json", true},
+		{blob, ImageArtifactType, false},
+	} {
+		info := imageTypes.BlobInfo{Digest: godigest.FromBytes(b.content), Size: int64(len(b.content)), MediaType: b.mediaType}
+		if _, err := dest.PutBlob(ctx, bytes.NewReader(b.content), info, none.NoCache, b.isConfig); err != nil {
+			return "", registryError(err, "Could not push the blob %s to %s", info.Digest, destination)
+		}
+	}
+	if err := dest.PutManifest(ctx, manifest, nil); err != nil {
+		return "", registryError(err, "Could not push the manifest to %s", destination)
+	}
+	if err := dest.Commit(ctx, nil); err != nil {
+		return "", err
+	}
+	digest := godigest.FromBytes(manifest)
+	logrus.Infof("The image JSON has been pushed to %s (%s)", destination, digest)
+	return digest, nil
+}
+
+// PullImageArtifact pulls the JSON description of an image pushed by
+// PushImageArtifact from the source (such as
+// docker://ghcr.io/org/app-json:v1). The image is strictly validated
+// since the artifact is not trusted, see decodeImageArtifact.
+func PullImageArtifact(ctx context.Context, sys *imageTypes.SystemContext, source string) (image types.Image, err error) {
+	if !strings.HasPrefix(source, "docker://") {
+		return image, fmt.Errorf("Only docker:// image artifacts can be pulled (while it is %s)", source)
+	}
+	ref, err := docker.ParseReference(strings.TrimPrefix(source, "docker:"))
+	if err != nil {
+		return image, err
+	}
+	src, err := ref.NewImageSource(ctx, sys)
+	if err != nil {
+		return image, registryError(err, "Could not read %s", source)
+	}
+	defer src.Close()
+	manifest, _, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return image, registryError(err, "Could not read the manifest of %s", source)
+	}
+	desc, err := imageArtifactBlob(manifest)
+	if err != nil {
+		return image, fmt.Errorf("The reference %s is not an image artifact: %w", source, err)
+	}
+	rc, _, err := src.GetBlob(ctx, imageTypes.BlobInfo{Digest: desc.Digest, Size: desc.Size}, none.NoCache)
+	if err != nil {
+		return image, registryError(err, "Could not get the blob %s from %s", desc.Digest, source)
+	}
+	defer rc.Close()
+	content, err := ioutil.ReadAll(verifyBlob(rc, desc.Digest.String(), desc.Digest, desc.Size))
+	if err != nil {
+		return image, err
+	}
+	return decodeImageArtifact(content)
+}
+
+// decodeImageArtifact strictly decodes the image JSON of an artifact.
+// The artifact comes from a registry, where anyone with write access
+// to the repository can replace it, while the image is then pushed
+// with the credentials of the machine pulling it: the image must not
+// make this machine read files outside of the Nix store or run
+// commands. Layers whose blob is read from a file (layer-path) or
+// generated by a compression command, file indexes and paths outside
+// of the Nix store are then rejected. Store paths are trusted since
+// they can only be added to the store by Nix.
+func decodeImageArtifact(content []byte) (image types.Image, err error) {
+	image, err = types.ValidateImage(content)
+	if err != nil {
+		return image, fmt.Errorf("Invalid image JSON: %w", err)
+	}
+	for _, layer := range image.Layers {
+		if layer.LayerPath != "" {
+			return image, fmt.Errorf("The layer %s of the image artifact is read from the file %s: only layers built from store paths are allowed", layer.Digest, layer.LayerPath)
+		}
+		if len(layer.CompressionCommand) > 0 {
+			return image, fmt.Errorf("The layer %s of the image artifact is compressed by the command %q: commands are not allowed", layer.Digest, strings.Join(layer.CompressionCommand, " "))
+		}
+		if layer.FileIndex != "" {
+			return image, fmt.Errorf("The layer %s of the image artifact has the file index %s: file indexes are not allowed", layer.Digest, layer.FileIndex)
+		}
+		for _, p := range layer.Paths {
+			if !isStorePath(p.Path) {
+				return image, fmt.Errorf("The path %s of the layer %s of the image artifact is not in the Nix store %s", p.Path, layer.Digest, storeDir)
+			}
+		}
+	}
+	return image, nil
+}
+
+// isStorePath returns true if the path is a clean path inside of the
+// Nix store.
+func isStorePath(p string) bool {
+	return path.Clean(p) == p && strings.HasPrefix(p, storeDir) && len(p) > len(storeDir)
+}
+
+// RealiseStorePaths realises the store paths of the layers of the
+// image with nix-store, for instance from a binary cache, so that the
+// blobs of an image pulled with PullImageArtifact can be generated.
+func RealiseStorePaths(ctx context.Context, image types.Image) error {
+	storePaths := ImageStorePaths(image)
+	if len(storePaths) == 0 {
+		return nil
+	}
+	cmd := exec.CommandContext(ctx, "nix-store", append([]string{"--realise"}, storePaths...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Could not realise the store paths of the image: %w: %s", err, stderr.String())
+	}
+	logrus.Infof("%d store paths have been realised", len(storePaths))
+	return nil
+}
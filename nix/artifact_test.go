@@ -0,0 +1,81 @@
+package nix
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestImageArtifact(t *testing.T) {
+	image := types.Image{
+		Architecture: "arm64",
+		Layers: []types.Layer{
+			{
+				Digest:    godigest.FromString("blob").String(),
+				DiffIDs:   godigest.FromString("archive").String(),
+				MediaType: v1.MediaTypeImageLayerGzip,
+				Paths:     types.Paths{types.Path{Path: "/nix/store/aaaa-hello"}},
+			},
+		},
+	}
+	manifest, config, blob, err := imageArtifact(image)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var m referrerManifest
+	if err := json.Unmarshal(manifest, &m); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if m.ArtifactType != ImageArtifactType {
+		t.Fatalf("The artifact type should be '%s' (while it is %s)", ImageArtifactType, m.ArtifactType)
+	}
+	if m.Config.Digest != godigest.FromBytes(config) || string(config) != "{}" {
+		t.Fatalf("The config should be the empty descriptor (while it is %#v)", m.Config)
+	}
+
+	desc, err := imageArtifactBlob(manifest)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if desc.Digest != godigest.FromBytes(blob) || desc.Annotations[v1.AnnotationTitle] != ImageArtifactTitle {
+		t.Fatalf("The blob descriptor should describe the image JSON (while it is %#v)", desc)
+	}
+	decoded, err := decodeImageArtifact(blob)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if decoded.Architecture != "arm64" || len(decoded.Layers) != 1 || decoded.Layers[0].Paths[0].Path != "/nix/store/aaaa-hello" {
+		t.Fatalf("The decoded image should be '%#v' (while it is %#v)", image, decoded)
+	}
+
+	// Images reading files outside of the store or running commands
+	// are rejected
+	for _, modify := range []func(*types.Layer){
+		func(l *types.Layer) { l.Paths[0].Path = "/root/.ssh" },
+		func(l *types.Layer) { l.Paths[0].Path = "/nix/store/../../root/.ssh" },
+		func(l *types.Layer) { l.LayerPath = "/etc/shadow" },
+		func(l *types.Layer) { l.Compression, l.CompressionCommand = "gzip", []string{"sh", "-c", "id"} },
+		func(l *types.Layer) { l.FileIndex = "/etc/shadow" },
+	} {
+		layer := image.Layers[0]
+		layer.Paths = types.Paths{types.Path{Path: "/nix/store/aaaa-hello"}}
+		modify(&layer)
+		_, _, blob, err := imageArtifact(types.Image{Layers: []types.Layer{layer}})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if _, err := decodeImageArtifact(blob); err == nil {
+			t.Fatalf("The image artifact with the layer %#v should be rejected", layer)
+		}
+	}
+	if _, err := decodeImageArtifact([]byte(`{"version":1,"layers":[],"unknown":1}`)); err == nil {
+		t.Fatalf("Unknown fields should be rejected")
+	}
+
+	if _, err := imageArtifactBlob([]byte(`{"schemaVersion":2,"layers":[]}`)); err == nil {
+		t.Fatalf("An image manifest should not be an image artifact")
+	}
+}
@@ -0,0 +1,76 @@
+package nix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/nlewo/nix2container/types"
+)
+
+// PermsAuditEntry describes an archive entry whose ownership or mode
+// is modified by a rule of the path options.
+type PermsAuditEntry struct {
+	// The path of the file in the store
+	Path string
+	// The name of the entry in the archive
+	Name string
+	// The modification, such as "0755 -> 0700"
+	Change string
+}
+
+// PermsAudit contains the entries modified by a rule, such as
+// "umask 022".
+type PermsAudit struct {
+	Rule    string
+	Entries []PermsAuditEntry
+}
+
+// AuditPaths walks the paths as TarPaths does, but instead of
+// producing an archive, it returns the entries modified by the
+// ownership and mode rules, grouped by rule. Perms rules matching no
+// entries are also returned, which allows to check their regexes hit
+// exactly the expected files.
+func AuditPaths(ctx context.Context, paths types.Paths) ([]PermsAudit, error) {
+	var audits []PermsAudit
+	index := make(map[string]int)
+	add := func(rule string) int {
+		i, ok := index[rule]
+		if !ok {
+			i = len(audits)
+			index[rule] = i
+			audits = append(audits, PermsAudit{Rule: rule})
+		}
+		return i
+	}
+	for _, path := range paths {
+		options, err := compilePathOptions(path.Path, path.Options)
+		if err != nil {
+			return audits, err
+		}
+		if options != nil {
+			for _, perms := range options.Perms {
+				add(permsRule(perms))
+			}
+		}
+		err = walkContext(ctx, path.Path, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return errors.New(fmt.Sprintf("Failed accessing path %q: %v", p, err))
+			}
+			_, _, err = fileHeader(p, info, options, func(rule, name, change string) {
+				i := add(rule)
+				audits[i].Entries = append(audits[i].Entries, PermsAuditEntry{
+					Path:   p,
+					Name:   name,
+					Change: change,
+				})
+			})
+			return err
+		})
+		if err != nil {
+			return audits, err
+		}
+	}
+	return audits, nil
+}
@@ -0,0 +1,48 @@
+package nix
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/nlewo/nix2container/types"
+)
+
+func TestAuditPaths(t *testing.T) {
+	paths := types.Paths{
+		types.Path{
+			Path: "../data/layer1/file1",
+			Options: &types.PathOptions{
+				Umask: "027",
+				Perms: []types.Perm{
+					types.Perm{Regex: ".*file1", Mode: "0641"},
+					types.Perm{Regex: ".*nomatch", Mode: "0600"},
+				},
+			},
+		},
+	}
+	audits, err := AuditPaths(context.Background(), paths)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := []PermsAudit{
+		PermsAudit{
+			Rule: `perms regex=".*file1" mode=0641`,
+			Entries: []PermsAuditEntry{
+				PermsAuditEntry{Path: "../data/layer1/file1", Name: "../data/layer1/file1", Change: "0640 -> 0641"},
+			},
+		},
+		PermsAudit{
+			Rule: `perms regex=".*nomatch" mode=0600`,
+		},
+		PermsAudit{
+			Rule: "umask 027",
+			Entries: []PermsAuditEntry{
+				PermsAuditEntry{Path: "../data/layer1/file1", Name: "../data/layer1/file1", Change: "0644 -> 0640"},
+			},
+		},
+	}
+	if !reflect.DeepEqual(audits, expected) {
+		t.Fatalf("Audits should be '%#v' (while they are %#v)", expected, audits)
+	}
+}
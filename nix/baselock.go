@@ -0,0 +1,149 @@
+package nix
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// NewBaseImageLockFromFile reads a base image lock file. A missing
+// file is an empty lock.
+func NewBaseImageLockFromFile(filename string) (lock types.BaseImageLock, err error) {
+	content, err := types.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return lock, nil
+	}
+	if err != nil {
+		return lock, err
+	}
+	if err := json.Unmarshal(content, &lock); err != nil {
+		return lock, fmt.Errorf("Could not parse the base image lock %s: %w", filename, err)
+	}
+	return lock, nil
+}
+
+// LockBaseImage returns the digests of the image stored in a directory
+// populated by the Skopeo dir transport. If blobDirectory is not
+// empty, the manifest and the blobs of the image are copied into it,
+// named by their digest.
+func LockBaseImage(name, directory, blobDirectory string) (locked types.LockedBaseImage, err error) {
+	content, err := ioutil.ReadFile(filepath.Join(directory, "manifest.json"))
+	if err != nil {
+		return locked, err
+	}
+	var manifest v1.Manifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return locked, err
+	}
+	locked.Name = name
+	locked.Manifest = godigest.FromBytes(content).String()
+	locked.Config = manifest.Config.Digest.String()
+	locked.Layers = []string{}
+	for _, layer := range manifest.Layers {
+		locked.Layers = append(locked.Layers, layer.Digest.String())
+	}
+	if blobDirectory == "" {
+		return locked, nil
+	}
+	if err := os.MkdirAll(blobDirectory, 0755); err != nil {
+		return locked, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(blobDirectory, godigest.FromBytes(content).Encoded()), content, 0644); err != nil {
+		return locked, err
+	}
+	blobs := append([]v1.Descriptor{manifest.Config}, manifest.Layers...)
+	for _, blob := range blobs {
+		if err := copyFile(filepath.Join(directory, blob.Digest.Encoded()), filepath.Join(blobDirectory, blob.Digest.Encoded())); err != nil {
+			return locked, err
+		}
+	}
+	return locked, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// NewImageFromLock creates the base image name of the lock from the
+// blobs of blobDirectory. The manifest and the config have to match the
+// digests recorded in the lock, so that the image can not drift from
+// the locked one. Layer blobs are verified when they are read.
+func NewImageFromLock(lock types.BaseImageLock, name, blobDirectory string) (image types.Image, err error) {
+	locked, ok := lock.Lookup(name)
+	if !ok {
+		return image, fmt.Errorf("The base image %s is not part of the lock", name)
+	}
+	blobDirectory, err = filepath.Abs(blobDirectory)
+	if err != nil {
+		return image, err
+	}
+	content, err := readLockedBlob(blobDirectory, locked.Manifest)
+	if err != nil {
+		return image, err
+	}
+	var manifest v1.Manifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return image, fmt.Errorf("Could not parse the manifest of the base image %s: %w", name, err)
+	}
+	if manifest.Config.Digest.String() != locked.Config {
+		return image, classErrorf(ErrDigestMismatch, "The config of the base image %s is %s while it is locked to %s", name, manifest.Config.Digest, locked.Config)
+	}
+	if len(manifest.Layers) != len(locked.Layers) {
+		return image, classErrorf(ErrDigestMismatch, "The base image %s has %d layers while %d layers are locked", name, len(manifest.Layers), len(locked.Layers))
+	}
+	for i, layer := range manifest.Layers {
+		if layer.Digest.String() != locked.Layers[i] {
+			return image, classErrorf(ErrDigestMismatch, "The layer %d of the base image %s is %s while it is locked to %s", i, name, layer.Digest, locked.Layers[i])
+		}
+		if _, err := os.Stat(filepath.Join(blobDirectory, layer.Digest.Encoded())); err != nil {
+			return image, classErrorf(ErrBlobMissing, "The layer %s of the base image %s is not in %s", layer.Digest, name, blobDirectory)
+		}
+	}
+	config, err := readLockedBlob(blobDirectory, locked.Config)
+	if err != nil {
+		return image, err
+	}
+	return newImageFromManifest(manifest, config, func(d godigest.Digest) string {
+		return filepath.Join(blobDirectory, d.Encoded())
+	})
+}
+
+// readLockedBlob reads the blob digest from the blob directory and
+// checks its digest.
+func readLockedBlob(blobDirectory, digest string) ([]byte, error) {
+	d, err := godigest.Parse(digest)
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(filepath.Join(blobDirectory, d.Encoded()))
+	if os.IsNotExist(err) {
+		return nil, classErrorf(ErrBlobMissing, "The blob %s is not in %s", d, blobDirectory)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if actual := d.Algorithm().FromBytes(content); actual != d {
+		return nil, classErrorf(ErrDigestMismatch, "The blob %s of %s has the digest %s", d, blobDirectory, actual)
+	}
+	return content, nil
+}
@@ -0,0 +1,105 @@
+package nix
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	godigest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// writeTestDir writes an image with a single uncompressed layer in a
+// directory laid out as by the Skopeo dir transport.
+func writeTestDir(t *testing.T, directory string, layerContent []byte) {
+	layerDigest := godigest.FromBytes(layerContent)
+	config, err := json.Marshal(v1.Image{
+		RootFS: v1.RootFS{Type: "layers", DiffIDs: []godigest.Digest{layerDigest}},
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	manifest, err := json.Marshal(v1.Manifest{
+		Config: v1.Descriptor{MediaType: v1.MediaTypeImageConfig, Digest: godigest.FromBytes(config), Size: int64(len(config))},
+		Layers: []v1.Descriptor{{MediaType: v1.MediaTypeImageLayer, Digest: layerDigest, Size: int64(len(layerContent))}},
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	files := map[string][]byte{
+		"manifest.json":                      manifest,
+		godigest.FromBytes(config).Encoded(): config,
+		layerDigest.Encoded():                layerContent,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(directory, name), content, 0644); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+}
+
+func TestBaseImageLock(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "nix2container-lock")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(tmp)
+	dir := filepath.Join(tmp, "dir")
+	blobs := filepath.Join(tmp, "blobs")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	writeTestDir(t, dir, []byte("layer"))
+
+	lock, err := NewBaseImageLockFromFile(filepath.Join(tmp, "lock.json"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	locked, err := LockBaseImage("alpine:3.18", dir, blobs)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	lock.Set(locked)
+
+	image, err := NewImageFromLock(lock, "alpine:3.18", blobs)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := godigest.FromBytes([]byte("layer")).String()
+	if len(image.Layers) != 1 || image.Layers[0].Digest != expected {
+		t.Fatalf("The image should have the layer '%#v' (while it has %#v)", expected, image.Layers)
+	}
+	if image.Layers[0].LayerPath != filepath.Join(blobs, godigest.FromBytes([]byte("layer")).Encoded()) {
+		t.Fatalf("The layer should be read from the blob directory (while it is %s)", image.Layers[0].LayerPath)
+	}
+
+	if _, err := NewImageFromLock(lock, "alpine:latest", blobs); err == nil {
+		t.Fatalf("An image which is not locked should be rejected")
+	}
+
+	// The upstream tag moved: the blob directory contains another
+	// image than the locked one
+	writeTestDir(t, dir, []byte("moved"))
+	moved, err := LockBaseImage("alpine:3.18", dir, blobs)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	manifest, err := ioutil.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	d, _ := godigest.Parse(locked.Manifest)
+	if err := ioutil.WriteFile(filepath.Join(blobs, d.Encoded()), manifest, 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	_, err = NewImageFromLock(lock, "alpine:3.18", blobs)
+	if !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("A manifest not matching the lock should be rejected (while the error is %v)", err)
+	}
+	if moved.Manifest == locked.Manifest {
+		t.Fatalf("The manifest digest should change when the image changes")
+	}
+}
@@ -0,0 +1,391 @@
+package nix
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// BinaryCacheBlobName is the name of the store paths of the layer
+// blobs published in Nix binary caches.
+const BinaryCacheBlobName = "nix2container-layer"
+
+const nixBase32Alphabet = "0123456789abcdfghijklmnpqrsvwxyz"
+
+// nixBase32 encodes hash with the base32 encoding of Nix, which is
+// used in store paths and narinfo files.
+func nixBase32(hash []byte) string {
+	n := (len(hash)*8-1)/5 + 1
+	out := make([]byte, 0, n)
+	for i := n - 1; i >= 0; i-- {
+		b := i * 5
+		j := b / 8
+		shift := uint(b % 8)
+		c := int(hash[j]) >> shift
+		if j+1 < len(hash) {
+			c |= int(hash[j+1]) << (8 - shift)
+		}
+		out = append(out, nixBase32Alphabet[c&0x1f])
+	}
+	return string(out)
+}
+
+// compressHash folds hash to size bytes, as Nix does to compute the
+// hash part of store paths.
+func compressHash(hash []byte, size int) []byte {
+	out := make([]byte, size)
+	for i, b := range hash {
+		out[i%size] ^= b
+	}
+	return out
+}
+
+// FixedOutputStorePath returns the store path of a flat file whose
+// SHA256 is hash, as added by a fixed-output derivation named name
+// with outputHashMode "flat". Such a path only depends on the content
+// of the file: it can be substituted from any binary cache containing
+// it.
+func FixedOutputStorePath(hash []byte, name string) string {
+	dir := strings.TrimSuffix(storeDir, "/")
+	inner := sha256.Sum256([]byte("fixed:out:sha256:" + hex.EncodeToString(hash) + ":"))
+	fingerprint := "output:out:sha256:" + hex.EncodeToString(inner[:]) + ":" + dir + ":" + name
+	h := sha256.Sum256([]byte(fingerprint))
+	return dir + "/" + nixBase32(compressHash(h[:], 20)) + "-" + name
+}
+
+// narWriter writes the strings of a NAR (Nix ARchive), padded to 8
+// bytes.
+type narWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (n *narWriter) writeUint64(v uint64) {
+	if n.err != nil {
+		return
+	}
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	_, n.err = n.w.Write(buf[:])
+}
+
+func (n *narWriter) pad(size uint64) {
+	if n.err != nil || size%8 == 0 {
+		return
+	}
+	_, n.err = n.w.Write(make([]byte, 8-size%8))
+}
+
+func (n *narWriter) writeString(s string) {
+	n.writeUint64(uint64(len(s)))
+	if n.err == nil {
+		_, n.err = io.WriteString(n.w, s)
+	}
+	n.pad(uint64(len(s)))
+}
+
+// writeFileNAR writes the NAR of a store path which is a single
+// regular file of size bytes read from r.
+func writeFileNAR(w io.Writer, r io.Reader, size int64) error {
+	n := &narWriter{w: w}
+	for _, s := range []string{"nix-archive-1", "(", "type", "regular", "contents"} {
+		n.writeString(s)
+	}
+	n.writeUint64(uint64(size))
+	if n.err != nil {
+		return n.err
+	}
+	written, err := io.Copy(w, r)
+	if err != nil {
+		return err
+	}
+	if written != size {
+		return fmt.Errorf("The size of the file is %d bytes while %d bytes were expected", written, size)
+	}
+	n.pad(uint64(size))
+	n.writeString(")")
+	return n.err
+}
+
+// NARInfo describes a store path of a binary cache.
+type NARInfo struct {
+	StorePath string
+	URL       string
+	NarHash   []byte
+	NarSize   int64
+	// The SHA256 of the flat file of the store path
+	FileContentHash []byte
+	Sigs            []string
+}
+
+// fingerprint returns the string signed by binary cache keys.
+func (i NARInfo) fingerprint() string {
+	return fmt.Sprintf("1;%s;sha256:%s;%d;", i.StorePath, nixBase32(i.NarHash), i.NarSize)
+}
+
+// String returns the content of the narinfo file. NARs are not
+// compressed since most layer blobs already are.
+func (i NARInfo) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "StorePath: %s\n", i.StorePath)
+	fmt.Fprintf(&b, "URL: %s\n", i.URL)
+	b.WriteString("Compression: none\n")
+	fmt.Fprintf(&b, "FileHash: sha256:%s\n", nixBase32(i.NarHash))
+	fmt.Fprintf(&b, "FileSize: %d\n", i.NarSize)
+	fmt.Fprintf(&b, "NarHash: sha256:%s\n", nixBase32(i.NarHash))
+	fmt.Fprintf(&b, "NarSize: %d\n", i.NarSize)
+	b.WriteString("References: \n")
+	for _, sig := range i.Sigs {
+		fmt.Fprintf(&b, "Sig: %s\n", sig)
+	}
+	fmt.Fprintf(&b, "CA: fixed:sha256:%s\n", nixBase32(i.FileContentHash))
+	return b.String()
+}
+
+// PublishedBlob is a layer blob published into a binary cache.
+type PublishedBlob struct {
+	Digest    string `json:"digest"`
+	StorePath string `json:"store-path"`
+	// False if the blob was already in the binary cache
+	Uploaded bool `json:"uploaded"`
+}
+
+// BinaryCache publishes layer blobs into a Nix binary cache, a local
+// directory or a remote store (see SumCache.SetRemote), such as an S3
+// bucket. A blob is published as the store path of a fixed-output
+// derivation with a flat SHA256 output hash, keyed by the digest of
+// the layer: other builders having this binary cache as substituter
+// can fetch the blob like any other store path.
+type BinaryCache struct {
+	directory string
+	remote    *remoteStore
+	keyName   string
+	key       ed25519.PrivateKey
+}
+
+// NewBinaryCache returns a BinaryCache for location, which is either
+// a directory (optionally as a file:// URL), an http(s):// URL or an
+// s3://BUCKET/PREFIX URL.
+func NewBinaryCache(location string) (*BinaryCache, error) {
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") || strings.HasPrefix(location, "s3://") {
+		remote, err := newRemoteStore(location)
+		if err != nil {
+			return nil, err
+		}
+		return &BinaryCache{remote: remote}, nil
+	}
+	directory := strings.TrimPrefix(location, "file://")
+	if err := os.MkdirAll(filepath.Join(directory, "nar"), 0755); err != nil {
+		return nil, err
+	}
+	return &BinaryCache{directory: directory}, nil
+}
+
+// SetSecretKeyFile sets the key signing the published store paths.
+// The file contains a key generated by "nix-store
+// --generate-binary-cache-key" (NAME:BASE64).
+func (c *BinaryCache) SetSecretKeyFile(filename string) error {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	s := strings.TrimSpace(string(content))
+	i := strings.Index(s, ":")
+	if i <= 0 {
+		return fmt.Errorf("The secret key file %s must contain NAME:BASE64", filename)
+	}
+	key, err := base64.StdEncoding.DecodeString(s[i+1:])
+	if err != nil || len(key) != ed25519.PrivateKeySize {
+		return fmt.Errorf("The secret key file %s doesn't contain a valid ed25519 secret key", filename)
+	}
+	c.keyName = s[:i]
+	c.key = ed25519.PrivateKey(key)
+	return nil
+}
+
+func (c *BinaryCache) exists(name string) (bool, error) {
+	if c.remote != nil {
+		return c.remote.exists(name)
+	}
+	_, err := os.Stat(filepath.Join(c.directory, name))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (c *BinaryCache) putFile(name string, contentType string, content []byte) error {
+	if c.remote != nil {
+		return c.remote.upload(c.remote.client, name, contentType, bytes.NewReader(content), int64(len(content)), sha256.Sum256(content))
+	}
+	return writeFileAtomically(filepath.Join(c.directory, name), content)
+}
+
+// writeFileAtomically writes content to filename through a temporary
+// file, so that readers never see a partial file.
+func writeFileAtomically(filename string, content []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// hashingWriter counts and hashes the bytes written to w.
+type hashingWriter struct {
+	w    io.Writer
+	hash hash.Hash
+	size int64
+}
+
+func (h *hashingWriter) Write(p []byte) (int, error) {
+	n, err := h.w.Write(p)
+	h.hash.Write(p[:n])
+	h.size += int64(n)
+	return n, err
+}
+
+// Publish publishes the layer blobs of the image, read with getBlob
+// (such as GetBlob or BlobCache.GetBlob). Blobs already in the binary
+// cache are not uploaded again. Pinned layers, whose blob is not
+// available, are skipped.
+func (c *BinaryCache) Publish(ctx context.Context, image types.Image, getBlob BlobGetter) ([]PublishedBlob, error) {
+	if err := c.putFile("nix-cache-info", "text/x-nix-cache-info", []byte(fmt.Sprintf("StoreDir: %s\nWantMassQuery: 1\nPriority: 50\n", strings.TrimSuffix(storeDir, "/")))); err != nil {
+		return nil, err
+	}
+	published := []PublishedBlob{}
+	seen := make(map[string]bool)
+	for _, layer := range image.Layers {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if layer.Pinned || seen[layer.Digest] {
+			continue
+		}
+		seen[layer.Digest] = true
+		blob, err := c.publishBlob(ctx, image, layer, getBlob)
+		if err != nil {
+			return nil, err
+		}
+		published = append(published, blob)
+	}
+	return published, nil
+}
+
+func (c *BinaryCache) publishBlob(ctx context.Context, image types.Image, layer types.Layer, getBlob BlobGetter) (PublishedBlob, error) {
+	digest, err := godigest.Parse(layer.Digest)
+	if err != nil {
+		return PublishedBlob{}, err
+	}
+	if digest.Algorithm() != godigest.SHA256 {
+		return PublishedBlob{}, fmt.Errorf("The layer %s can not be published: only sha256 digests are supported", digest)
+	}
+	hash, err := hex.DecodeString(digest.Encoded())
+	if err != nil {
+		return PublishedBlob{}, err
+	}
+	storePath := FixedOutputStorePath(hash, BinaryCacheBlobName)
+	blob := PublishedBlob{Digest: digest.String(), StorePath: storePath}
+	hashPart := strings.SplitN(filepath.Base(storePath), "-", 2)[0]
+	narinfoName := hashPart + ".narinfo"
+	ok, err := c.exists(narinfoName)
+	if err != nil {
+		return blob, err
+	}
+	if ok {
+		logrus.Infof("The layer %s is already in the binary cache as %s", digest, storePath)
+		return blob, nil
+	}
+
+	rc, size, err := getBlob(ctx, image, digest)
+	if err != nil {
+		return blob, err
+	}
+	defer rc.Close()
+	// The size of blobs generated on the fly is not known by
+	// getBlob
+	if size <= 0 {
+		size = layer.Size
+	}
+	tmpDir := ""
+	if c.remote == nil {
+		tmpDir = filepath.Join(c.directory, "nar")
+	}
+	nar, err := ioutil.TempFile(tmpDir, ".tmp-nar-")
+	if err != nil {
+		return blob, err
+	}
+	defer os.Remove(nar.Name())
+	defer nar.Close()
+	verifier := digest.Verifier()
+	narHasher := &hashingWriter{w: nar, hash: sha256.New()}
+	if err := writeFileNAR(narHasher, io.TeeReader(rc, verifier), size); err != nil {
+		return blob, err
+	}
+	if !verifier.Verified() {
+		return blob, classErrorf(ErrDigestMismatch, "The blob of the layer %s doesn't match its digest", digest)
+	}
+	info := NARInfo{
+		StorePath:       storePath,
+		NarHash:         narHasher.hash.Sum(nil),
+		NarSize:         narHasher.size,
+		FileContentHash: hash,
+	}
+	info.URL = "nar/" + nixBase32(info.NarHash) + ".nar"
+	if c.key != nil {
+		sig := ed25519.Sign(c.key, []byte(info.fingerprint()))
+		info.Sigs = append(info.Sigs, c.keyName+":"+base64.StdEncoding.EncodeToString(sig))
+	}
+
+	logrus.Infof("Publishing the layer %s into the binary cache as %s", digest, storePath)
+	if c.remote != nil {
+		if _, err := nar.Seek(0, io.SeekStart); err != nil {
+			return blob, err
+		}
+		var narHash [sha256.Size]byte
+		copy(narHash[:], info.NarHash)
+		if err := c.remote.putFile(info.URL, "application/x-nix-nar", nar, info.NarSize, narHash); err != nil {
+			return blob, err
+		}
+	} else {
+		if err := nar.Chmod(0644); err != nil {
+			return blob, err
+		}
+		if err := os.Rename(nar.Name(), filepath.Join(c.directory, info.URL)); err != nil {
+			return blob, err
+		}
+	}
+	// The narinfo is written last: the store path can only be
+	// substituted once its NAR is in the binary cache
+	if err := c.putFile(narinfoName, "text/x-nix-narinfo", []byte(info.String())); err != nil {
+		return blob, err
+	}
+	blob.Uploaded = true
+	return blob, nil
+}
@@ -0,0 +1,140 @@
+package nix
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+)
+
+func TestNixBase32(t *testing.T) {
+	hash := sha256.Sum256(nil)
+	expected := "0mdqa9w1p6cmli6976v4wi0sw9r4p5prkj7lzfd1877wk11c9c73"
+	if got := nixBase32(hash[:]); got != expected {
+		t.Fatalf("The hash should be '%#v' (while it is %#v)", expected, got)
+	}
+}
+
+func TestWriteFileNAR(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeFileNAR(&buf, strings.NewReader("hello"), 5); err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := "\x0d\x00\x00\x00\x00\x00\x00\x00nix-archive-1\x00\x00\x00" +
+		"\x01\x00\x00\x00\x00\x00\x00\x00(\x00\x00\x00\x00\x00\x00\x00" +
+		"\x04\x00\x00\x00\x00\x00\x00\x00type\x00\x00\x00\x00" +
+		"\x07\x00\x00\x00\x00\x00\x00\x00regular\x00" +
+		"\x08\x00\x00\x00\x00\x00\x00\x00contents" +
+		"\x05\x00\x00\x00\x00\x00\x00\x00hello\x00\x00\x00" +
+		"\x01\x00\x00\x00\x00\x00\x00\x00)\x00\x00\x00\x00\x00\x00\x00"
+	if buf.String() != expected {
+		t.Fatalf("The NAR should be '%#v' (while it is %#v)", expected, buf.String())
+	}
+	if err := writeFileNAR(&buf, strings.NewReader("hello"), 6); err == nil {
+		t.Fatalf("A truncated file should be rejected")
+	}
+}
+
+func TestBinaryCachePublish(t *testing.T) {
+	layers, err := NewLayers(context.Background(), []string{"../data/layer1"}, nil, nil, "", nil, types.PathOptions{}, CompressionNone)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	image := types.Image{Layers: layers}
+	getBlob := func(ctx context.Context, image types.Image, digest godigest.Digest) (io.ReadCloser, int64, error) {
+		return GetBlob(image, digest)
+	}
+
+	directory := t.TempDir()
+	public, secret, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "key")
+	if err := ioutil.WriteFile(keyFile, []byte("test-1:"+base64.StdEncoding.EncodeToString(secret)+"\n"), 0600); err != nil {
+		t.Fatalf("%v", err)
+	}
+	cache, err := NewBinaryCache("file://" + directory)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := cache.SetSecretKeyFile(keyFile); err != nil {
+		t.Fatalf("%v", err)
+	}
+	published, err := cache.Publish(context.Background(), image, getBlob)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(published) != 1 || !published[0].Uploaded || published[0].Digest != layers[0].Digest {
+		t.Fatalf("The layer should have been uploaded (while it is %#v)", published)
+	}
+	if !strings.HasPrefix(published[0].StorePath, "/nix/store/") || !strings.HasSuffix(published[0].StorePath, "-"+BinaryCacheBlobName) {
+		t.Fatalf("The store path %s should be a store path", published[0].StorePath)
+	}
+
+	hashPart := strings.SplitN(filepath.Base(published[0].StorePath), "-", 2)[0]
+	narinfo, err := ioutil.ReadFile(filepath.Join(directory, hashPart+".narinfo"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	fields := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(narinfo)), "\n") {
+		i := strings.Index(line, ": ")
+		fields[line[:i]] = line[i+2:]
+	}
+	if fields["StorePath"] != published[0].StorePath {
+		t.Fatalf("StorePath should be '%#v' (while it is %#v)", published[0].StorePath, fields["StorePath"])
+	}
+	nar, err := ioutil.ReadFile(filepath.Join(directory, fields["URL"]))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	narHash := sha256.Sum256(nar)
+	if fields["NarHash"] != "sha256:"+nixBase32(narHash[:]) {
+		t.Fatalf("NarHash should be the hash of the NAR (while it is %#v)", fields["NarHash"])
+	}
+	blob, _, err := GetBlob(image, godigest.Digest(layers[0].Digest))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var expected bytes.Buffer
+	content, _ := ioutil.ReadAll(blob)
+	blob.Close()
+	writeFileNAR(&expected, bytes.NewReader(content), int64(len(content)))
+	if !bytes.Equal(nar, expected.Bytes()) {
+		t.Fatalf("The NAR should contain the layer blob")
+	}
+	sig := strings.TrimPrefix(fields["Sig"], "test-1:")
+	decoded, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	fingerprint := "1;" + fields["StorePath"] + ";" + fields["NarHash"] + ";" + fields["NarSize"] + ";"
+	if !ed25519.Verify(public, []byte(fingerprint), decoded) {
+		t.Fatalf("The signature %s should be valid", fields["Sig"])
+	}
+	contentHash := sha256.Sum256(content)
+	if fields["CA"] != "fixed:sha256:"+nixBase32(contentHash[:]) {
+		t.Fatalf("CA should be the hash of the blob (while it is %#v)", fields["CA"])
+	}
+	if _, err := ioutil.ReadFile(filepath.Join(directory, "nix-cache-info")); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	published, err = cache.Publish(context.Background(), image, getBlob)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(published) != 1 || published[0].Uploaded {
+		t.Fatalf("The layer should not be uploaded again (while it is %#v)", published)
+	}
+}
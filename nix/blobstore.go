@@ -0,0 +1,272 @@
+package nix
+
+import (
+	"context"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// BlobStore stores blobs addressed by their digest. Blob stores are
+// safe for concurrent use.
+type BlobStore interface {
+	// Has returns true if the blob is in the store.
+	Has(ctx context.Context, digest godigest.Digest) (bool, error)
+	// Get returns the blob and its size, which is -1 if it is
+	// unknown. The error is an ErrBlobMissing error if the blob is
+	// not in the store.
+	Get(ctx context.Context, digest godigest.Digest) (io.ReadCloser, int64, error)
+	// Put stores the blob of size bytes (-1 if it is unknown) read
+	// from r. A blob whose content doesn't match its digest is not
+	// stored and the error is an ErrDigestMismatch error.
+	Put(ctx context.Context, digest godigest.Digest, r io.Reader, size int64) error
+	// String returns the location of the store.
+	String() string
+}
+
+// NewBlobStore returns the blob store of location, which is one of:
+//
+//	DIRECTORY, file://DIRECTORY  blobs in DIRECTORY/ALGORITHM/ENCODED
+//	oci:DIRECTORY                the blobs of an OCI image layout
+//	http(s)://URL, s3://BUCKET/PREFIX
+//	                             a remote store (see SumCache.SetRemote)
+//	docker://REGISTRY/REPOSITORY the blobs of a registry repository
+//	containerd://NAMESPACE       the containerd content store, through ctr
+func NewBlobStore(location string) (BlobStore, error) {
+	switch {
+	case strings.HasPrefix(location, "http://"), strings.HasPrefix(location, "https://"), strings.HasPrefix(location, "s3://"):
+		remote, err := newRemoteStore(location)
+		if err != nil {
+			return nil, err
+		}
+		return &remoteBlobStore{location: location, remote: remote}, nil
+	case strings.HasPrefix(location, "docker://"):
+		return newRegistryBlobStore(location)
+	case strings.HasPrefix(location, "containerd://"):
+		return newContainerdBlobStore(location), nil
+	case strings.HasPrefix(location, "oci:"):
+		return newDirBlobStore(filepath.Join(strings.TrimPrefix(location, "oci:"), "blobs"))
+	default:
+		return newDirBlobStore(strings.TrimPrefix(location, "file://"))
+	}
+}
+
+// BlobGetter returns a blob of an image and its size, such as GetBlob
+// or BlobCache.GetBlob.
+type BlobGetter func(ctx context.Context, image types.Image, digest godigest.Digest) (io.ReadCloser, int64, error)
+
+// CopyBlobs copies the config blob and the layer blobs of the image,
+// read with getBlob, into the store. Blobs already in the store are
+// not copied again and pinned layers, whose blob is not available, are
+// skipped. The digests of the copied blobs are returned.
+func CopyBlobs(ctx context.Context, image types.Image, store BlobStore, getBlob BlobGetter) ([]godigest.Digest, error) {
+	configDigest, _, err := GetConfigDigest(image)
+	if err != nil {
+		return nil, err
+	}
+	digests := []godigest.Digest{configDigest}
+	// The size of blobs generated on the fly is not known by getBlob
+	sizes := make(map[godigest.Digest]int64)
+	for _, layer := range image.Layers {
+		if !layer.Pinned {
+			digests = append(digests, godigest.Digest(layer.Digest))
+			sizes[godigest.Digest(layer.Digest)] = expectedSize(layer)
+		}
+	}
+	copied := []godigest.Digest{}
+	seen := make(map[godigest.Digest]bool)
+	for _, digest := range digests {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if seen[digest] {
+			continue
+		}
+		seen[digest] = true
+		ok, err := store.Has(ctx, digest)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			logrus.Infof("The blob %s is already in %s", digest, store)
+			continue
+		}
+		rc, size, err := getBlob(ctx, image, digest)
+		if err != nil {
+			return nil, err
+		}
+		if size <= 0 {
+			size = sizes[digest]
+		}
+		err = store.Put(ctx, digest, rc, size)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		logrus.Infof("The blob %s has been copied to %s", digest, store)
+		copied = append(copied, digest)
+	}
+	return copied, nil
+}
+
+// verifyingWriter is a temporary file where a blob is written before
+// being moved to a store, once its digest has been verified.
+type verifyingWriter struct {
+	f        *os.File
+	digester godigest.Digester
+	// The SHA256 of the blob, required to sign S3 requests
+	sum  hash.Hash
+	size int64
+}
+
+func newVerifyingWriter(directory string, digest godigest.Digest) (*verifyingWriter, error) {
+	f, err := ioutil.TempFile(directory, ".blob-")
+	if err != nil {
+		return nil, err
+	}
+	return &verifyingWriter{f: f, digester: digest.Algorithm().Digester(), sum: sha256.New()}, nil
+}
+
+// copyFrom writes the blob read from r into the temporary file, and
+// checks it matches digest.
+func (w *verifyingWriter) copyFrom(r io.Reader, digest godigest.Digest) error {
+	n, err := io.Copy(io.MultiWriter(w.f, w.digester.Hash(), w.sum), r)
+	w.size = n
+	if err != nil {
+		return err
+	}
+	if w.digester.Digest() != digest {
+		return classErrorf(ErrDigestMismatch, "The blob digest %s doesn't match the expected digest %s", w.digester.Digest(), digest)
+	}
+	return nil
+}
+
+func (w *verifyingWriter) remove() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+// dirBlobStore stores blobs in a directory, in ALGORITHM/ENCODED
+// files, as in the blobs directory of OCI image layouts.
+type dirBlobStore struct {
+	directory string
+}
+
+func newDirBlobStore(directory string) (*dirBlobStore, error) {
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, err
+	}
+	return &dirBlobStore{directory: directory}, nil
+}
+
+func (s *dirBlobStore) blobPath(digest godigest.Digest) string {
+	return filepath.Join(s.directory, digest.Algorithm().String(), digest.Encoded())
+}
+
+func (s *dirBlobStore) Has(ctx context.Context, digest godigest.Digest) (bool, error) {
+	_, err := os.Stat(s.blobPath(digest))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *dirBlobStore) Get(ctx context.Context, digest godigest.Digest) (io.ReadCloser, int64, error) {
+	f, err := os.Open(s.blobPath(digest))
+	if os.IsNotExist(err) {
+		return nil, 0, classErrorf(ErrBlobMissing, "The blob %s is not in %s", digest, s.directory)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+// Put writes the blob in a temporary file, which is only renamed to
+// its final location if its content matches the digest: readers never
+// see partial blobs.
+func (s *dirBlobStore) Put(ctx context.Context, digest godigest.Digest, r io.Reader, size int64) error {
+	filename := s.blobPath(digest)
+	if _, err := os.Stat(filename); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	w, err := newVerifyingWriter(filepath.Dir(filename), digest)
+	if err != nil {
+		return err
+	}
+	defer w.remove()
+	if err := w.copyFrom(r, digest); err != nil {
+		return err
+	}
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(w.f.Name(), filename)
+}
+
+func (s *dirBlobStore) String() string {
+	return s.directory
+}
+
+// remoteBlobStore stores blobs in a remote store, in ALGORITHM/ENCODED
+// files.
+type remoteBlobStore struct {
+	location string
+	remote   *remoteStore
+}
+
+func remoteBlobName(digest godigest.Digest) string {
+	return digest.Algorithm().String() + "/" + digest.Encoded()
+}
+
+func (s *remoteBlobStore) Has(ctx context.Context, digest godigest.Digest) (bool, error) {
+	return s.remote.exists(remoteBlobName(digest))
+}
+
+func (s *remoteBlobStore) Get(ctx context.Context, digest godigest.Digest) (io.ReadCloser, int64, error) {
+	return s.remote.open(remoteBlobName(digest))
+}
+
+// Put writes the blob in a temporary file before uploading it, since
+// its size and SHA256 are required to sign S3 requests. Blobs already
+// in the store are not uploaded again.
+func (s *remoteBlobStore) Put(ctx context.Context, digest godigest.Digest, r io.Reader, size int64) error {
+	ok, err := s.Has(ctx, digest)
+	if err != nil || ok {
+		return err
+	}
+	w, err := newVerifyingWriter("", digest)
+	if err != nil {
+		return err
+	}
+	defer w.remove()
+	if err := w.copyFrom(r, digest); err != nil {
+		return err
+	}
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], w.sum.Sum(nil))
+	return s.remote.putFile(remoteBlobName(digest), "application/octet-stream", w.f, w.size, sum)
+}
+
+func (s *remoteBlobStore) String() string {
+	return s.location
+}
@@ -0,0 +1,153 @@
+package nix
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+)
+
+func testBlobStore(t *testing.T, store BlobStore) {
+	ctx := context.Background()
+	content := []byte("blob content")
+	digest := godigest.FromBytes(content)
+
+	ok, err := store.Has(ctx, digest)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if ok {
+		t.Fatalf("The blob %s should not be in the store", digest)
+	}
+	if _, _, err := store.Get(ctx, digest); !errors.Is(err, ErrBlobMissing) {
+		t.Fatalf("Err should be '%#v' (while it is %#v)", ErrBlobMissing, err)
+	}
+	err = store.Put(ctx, digest, strings.NewReader("corrupted content"), int64(len(content)))
+	if !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("Err should be '%#v' (while it is %#v)", ErrDigestMismatch, err)
+	}
+	if ok, _ := store.Has(ctx, digest); ok {
+		t.Fatalf("A corrupted blob should not be stored")
+	}
+
+	if err := store.Put(ctx, digest, bytes.NewReader(content), int64(len(content))); err != nil {
+		t.Fatalf("%v", err)
+	}
+	ok, err = store.Has(ctx, digest)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !ok {
+		t.Fatalf("The blob %s should be in the store", digest)
+	}
+	rc, size, err := store.Get(ctx, digest)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer rc.Close()
+	read, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !bytes.Equal(read, content) || size != int64(len(content)) {
+		t.Fatalf("The blob should be '%#v' (while it is %#v of size %d)", string(content), string(read), size)
+	}
+}
+
+// newTestHTTPStore returns an HTTP server storing files in memory.
+func newTestHTTPStore() *httptest.Server {
+	var mu sync.Mutex
+	files := make(map[string][]byte)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			content, ok := files[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(content)
+		case http.MethodPut:
+			content, _ := ioutil.ReadAll(r.Body)
+			files[r.URL.Path] = content
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+}
+
+func TestBlobStores(t *testing.T) {
+	for _, location := range []string{t.TempDir(), "oci:" + t.TempDir()} {
+		store, err := NewBlobStore(location)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		testBlobStore(t, store)
+	}
+
+	server := newTestHTTPStore()
+	defer server.Close()
+	store, err := NewBlobStore(server.URL + "/blobs")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	testBlobStore(t, store)
+}
+
+func TestBlobCacheRemoteStore(t *testing.T) {
+	server := newTestHTTPStore()
+	defer server.Close()
+	layers, err := NewLayers(context.Background(), []string{"../data/layer1"}, nil, nil, "", nil, types.PathOptions{}, CompressionNone)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	image := types.Image{Layers: layers}
+	digest := godigest.Digest(layers[0].Digest)
+
+	cache, err := NewBlobCache(server.URL + "/cache")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if cache.Contains(digest) {
+		t.Fatalf("The layer %s should not be in the cache", digest)
+	}
+	rc, _, err := cache.GetBlob(context.Background(), image, digest)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := ioutil.ReadAll(rc); err != nil {
+		t.Fatalf("%v", err)
+	}
+	rc.Close()
+	if !cache.Contains(digest) {
+		t.Fatalf("The layer %s should have been generated in the cache", digest)
+	}
+
+	destination, err := NewBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	copied, err := CopyBlobs(context.Background(), image, destination, cache.GetBlob)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(copied) != 2 || copied[1] != digest {
+		t.Fatalf("The config and the layer should have been copied (while it is %#v)", copied)
+	}
+	copied, err = CopyBlobs(context.Background(), image, destination, cache.GetBlob)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(copied) != 0 {
+		t.Fatalf("No blob should be copied again (while it is %#v)", copied)
+	}
+}
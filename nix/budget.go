@@ -0,0 +1,177 @@
+package nix
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/nlewo/nix2container/types"
+)
+
+// budgetReportedPaths is the maximal number of paths reported for each
+// layer when a budget is exceeded.
+const budgetReportedPaths = 10
+
+// SizeBudget limits the size of an image and of its layers. Sizes are
+// the sizes of the blobs pushed to a registry. A zero value means no
+// limit.
+type SizeBudget struct {
+	MaxImageSize int64
+	MaxLayerSize int64
+}
+
+// BudgetError is returned when an image exceeds its SizeBudget. The
+// Report contains a breakdown of the image size by layer and by store
+// path, to find out which paths bloat the image.
+type BudgetError struct {
+	Violations []string
+	Report     string
+}
+
+func (e *BudgetError) Error() string {
+	return fmt.Sprintf("%s\n%s", strings.Join(e.Violations, "\n"), e.Report)
+}
+
+// CheckSizeBudget returns a BudgetError if the image or one of its
+// layers exceeds the budget, or if the layers of a component exceed
+// the budget they are annotated with (see types.LayerBudget).
+func CheckSizeBudget(image types.Image, budget SizeBudget) error {
+	var violations []string
+	var imageSize int64
+	for _, layer := range image.Layers {
+		imageSize += layer.Size
+		if budget.MaxLayerSize > 0 && layer.Size > budget.MaxLayerSize {
+			violations = append(violations, fmt.Sprintf(
+				"The layer %s size %s exceeds the budget of %s",
+				layer.Digest, FormatByteSize(layer.Size), FormatByteSize(budget.MaxLayerSize)))
+		}
+	}
+	violations = append(violations, componentViolations(image)...)
+	if budget.MaxImageSize > 0 && imageSize > budget.MaxImageSize {
+		violations = append(violations, fmt.Sprintf(
+			"The image size %s exceeds the budget of %s",
+			FormatByteSize(imageSize), FormatByteSize(budget.MaxImageSize)))
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	return &BudgetError{
+		Violations: violations,
+		Report:     sizeReport(image),
+	}
+}
+
+// componentViolations checks the budgets of the layers. The layers
+// having the same budget name are summed up and the biggest store
+// paths of a component exceeding its budget are reported.
+func componentViolations(image types.Image) (violations []string) {
+	var names []string
+	components := make(map[string][]types.Layer)
+	for _, layer := range image.Layers {
+		if layer.Budget == nil {
+			continue
+		}
+		if _, ok := components[layer.Budget.Name]; !ok {
+			names = append(names, layer.Budget.Name)
+		}
+		components[layer.Budget.Name] = append(components[layer.Budget.Name], layer)
+	}
+	for _, name := range names {
+		layers := components[name]
+		var size, maxSize int64
+		for _, layer := range layers {
+			size += layer.Size
+			if maxSize == 0 || layer.Budget.MaxSize < maxSize {
+				maxSize = layer.Budget.MaxSize
+			}
+		}
+		if size <= maxSize {
+			continue
+		}
+		var b strings.Builder
+		fmt.Fprintf(&b, "The size %s of the layers of %s exceeds the budget of %s", FormatByteSize(size), name, FormatByteSize(maxSize))
+		sizes := pathSizes(layers)
+		for i, s := range sizes {
+			if i == budgetReportedPaths {
+				fmt.Fprintf(&b, "\n    ... and %d other paths", len(sizes)-i)
+				break
+			}
+			fmt.Fprintf(&b, "\n    %s %s", FormatByteSize(s.size), s.path)
+		}
+		violations = append(violations, b.String())
+	}
+	return violations
+}
+
+type pathSize struct {
+	path string
+	size int64
+}
+
+// pathSizes returns the store paths of the layers, from the biggest
+// to the smallest.
+func pathSizes(layers []types.Layer) (sizes []pathSize) {
+	for _, layer := range layers {
+		for _, p := range layer.Paths {
+			sizes = append(sizes, pathSize{p.Path, diskUsage(p.Path)})
+		}
+	}
+	sort.SliceStable(sizes, func(i, j int) bool {
+		return sizes[i].size > sizes[j].size
+	})
+	return sizes
+}
+
+// sizeReport lists the layers from the biggest to the smallest, with
+// the biggest store paths they contain. Store path sizes are the
+// sizes of their files on the disk, before compression.
+func sizeReport(image types.Image) string {
+	layers := make([]types.Layer, len(image.Layers))
+	copy(layers, image.Layers)
+	sort.SliceStable(layers, func(i, j int) bool {
+		return layers[i].Size > layers[j].Size
+	})
+	var b strings.Builder
+	b.WriteString("Image size breakdown:\n")
+	for _, layer := range layers {
+		fmt.Fprintf(&b, "  %10s  %s\n", FormatByteSize(layer.Size), layer.Digest)
+		sizes := pathSizes([]types.Layer{layer})
+		for i, s := range sizes {
+			if i == budgetReportedPaths {
+				fmt.Fprintf(&b, "  %10s    ... and %d other paths\n", "", len(sizes)-i)
+				break
+			}
+			fmt.Fprintf(&b, "  %10s    %s %s\n", "", FormatByteSize(s.size), s.path)
+		}
+	}
+	return b.String()
+}
+
+// diskUsage returns the size of the regular files of path. Errors are
+// ignored since it is only used to report sizes.
+func diskUsage(path string) (size int64) {
+	walkContext(context.Background(), path, func(p string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// FormatByteSize formats a size with the K, M or G suffixes accepted
+// by ParseByteSize.
+func FormatByteSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit && exp < 2; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%c", float64(size)/float64(div), "KMG"[exp])
+}
@@ -0,0 +1,100 @@
+package nix
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/nlewo/nix2container/types"
+)
+
+func TestCheckSizeBudget(t *testing.T) {
+	image := types.Image{
+		Layers: []types.Layer{
+			types.Layer{
+				Digest: "sha256:small",
+				Size:   1024,
+			},
+			types.Layer{
+				Digest: "sha256:big",
+				Size:   3 * 1024 * 1024,
+				Paths: types.Paths{
+					types.Path{Path: "../data/layer1"},
+				},
+			},
+		},
+	}
+	if err := CheckSizeBudget(image, SizeBudget{}); err != nil {
+		t.Fatalf("An empty budget should not be exceeded: %v", err)
+	}
+	if err := CheckSizeBudget(image, SizeBudget{MaxImageSize: 4 * 1024 * 1024, MaxLayerSize: 3 * 1024 * 1024}); err != nil {
+		t.Fatalf("The budget should not be exceeded: %v", err)
+	}
+
+	err := CheckSizeBudget(image, SizeBudget{MaxImageSize: 2 * 1024 * 1024, MaxLayerSize: 1024 * 1024})
+	var budgetErr *BudgetError
+	if !errors.As(err, &budgetErr) {
+		t.Fatalf("The error should be a BudgetError (while it is %#v)", err)
+	}
+	expected := []string{
+		"The layer sha256:big size 3.0M exceeds the budget of 1.0M",
+		"The image size 3.0M exceeds the budget of 2.0M",
+	}
+	if strings.Join(budgetErr.Violations, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Violations should be '%#v' (while they are %#v)", expected, budgetErr.Violations)
+	}
+	lines := strings.Split(budgetErr.Report, "\n")
+	if !strings.HasSuffix(lines[1], "sha256:big") || !strings.HasSuffix(lines[2], "../data/layer1") || !strings.HasSuffix(lines[3], "sha256:small") {
+		t.Fatalf("The report should list layers from the biggest (while it is %s)", budgetErr.Report)
+	}
+}
+
+func TestFormatByteSize(t *testing.T) {
+	for size, expected := range map[int64]string{512: "512", 1536: "1.5K", 10 * 1024 * 1024: "10.0M", 3 * 1024 * 1024 * 1024 * 1024: "3072.0G"} {
+		if s := FormatByteSize(size); s != expected {
+			t.Fatalf("%d should be formatted as '%#v' (while it is %#v)", size, expected, s)
+		}
+	}
+}
+
+func TestCheckSizeBudgetComponents(t *testing.T) {
+	budget := &types.LayerBudget{Name: "python-deps", MaxSize: 2 * 1024 * 1024}
+	image := types.Image{
+		Layers: []types.Layer{
+			types.Layer{
+				Digest: "sha256:unbudgeted",
+				Size:   8 * 1024 * 1024,
+			},
+			types.Layer{
+				Digest: "sha256:deps1",
+				Size:   1024 * 1024,
+				Budget: budget,
+			},
+			types.Layer{
+				Digest: "sha256:deps2",
+				Size:   1024 * 1024,
+				Paths: types.Paths{
+					types.Path{Path: "../data/layer1"},
+				},
+				Budget: budget,
+			},
+		},
+	}
+	if err := CheckSizeBudget(image, SizeBudget{}); err != nil {
+		t.Fatalf("The budget should not be exceeded: %v", err)
+	}
+
+	image.Layers[2].Size = 2 * 1024 * 1024
+	err := CheckSizeBudget(image, SizeBudget{})
+	var budgetErr *BudgetError
+	if !errors.As(err, &budgetErr) {
+		t.Fatalf("The error should be a BudgetError (while it is %#v)", err)
+	}
+	if len(budgetErr.Violations) != 1 {
+		t.Fatalf("There should be one violation (while they are %#v)", budgetErr.Violations)
+	}
+	lines := strings.Split(budgetErr.Violations[0], "\n")
+	if lines[0] != "The size 3.0M of the layers of python-deps exceeds the budget of 2.0M" || len(lines) != 2 || !strings.HasSuffix(lines[1], "../data/layer1") {
+		t.Fatalf("The violation should report the store paths of the component (while it is %#v)", budgetErr.Violations[0])
+	}
+}
@@ -0,0 +1,120 @@
+package nix
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// SharedLayer is a layer used by several images.
+type SharedLayer struct {
+	Layer types.Layer
+	// The number of images using the layer
+	Images int
+}
+
+// OrderSharedLayers returns the unique layers of the images, the
+// layers used by the most images first, and then in the order they
+// are first seen. Since the blob of a layer doesn't depend on the
+// other layers, this order only decides which layers are generated
+// first: the layers needed by the most images are ready first.
+func OrderSharedLayers(images []types.Image) []SharedLayer {
+	var ordered []SharedLayer
+	index := make(map[string]int)
+	for _, image := range images {
+		seen := make(map[string]bool)
+		for _, layer := range image.Layers {
+			i, ok := index[layer.Digest]
+			if !ok {
+				i = len(ordered)
+				index[layer.Digest] = i
+				ordered = append(ordered, SharedLayer{Layer: layer})
+			}
+			if !seen[layer.Digest] {
+				ordered[i].Images++
+				seen[layer.Digest] = true
+			}
+		}
+	}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].Images > ordered[j].Images
+	})
+	return ordered
+}
+
+// BuildHooks are called by BuildSharedLayers, from the goroutines
+// generating the layers, to report the progress of the build.
+type BuildHooks struct {
+	// Called when the generation of a layer starts
+	Started func(layer types.Layer)
+	// Called when the generation of a layer ends, with its error
+	Done func(layer types.Layer, err error)
+}
+
+// BuildAll generates in the cache the blobs of the layers of the
+// images built from store paths. Layers shared by several images are
+// only generated once. At most parallel layers are generated at the
+// same time.
+func BuildAll(ctx context.Context, images []types.Image, cache *BlobCache, parallel int) error {
+	return BuildSharedLayers(ctx, OrderSharedLayers(images), cache, parallel, BuildHooks{})
+}
+
+// BuildSharedLayers generates in the cache the blobs of the shared
+// layers, returned by OrderSharedLayers, built from store paths. It
+// calls the hooks when the generation of a layer starts and ends.
+func BuildSharedLayers(ctx context.Context, shared []SharedLayer, cache *BlobCache, parallel int, hooks BuildHooks) error {
+	if parallel < 1 {
+		parallel = 1
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	sem := make(chan struct{}, parallel)
+	for _, shared := range shared {
+		layer := shared.Layer
+		if layer.LayerPath != "" || layer.Paths == nil {
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		sem <- struct{}{}
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			<-sem
+			break
+		}
+		wg.Add(1)
+		go func(layer types.Layer, images int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if hooks.Started != nil {
+				hooks.Started(layer)
+			}
+			err := cache.ensure(ctx, layer, godigest.Digest(layer.Digest))
+			if hooks.Done != nil {
+				hooks.Done(layer, err)
+			}
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+				return
+			}
+			logrus.Infof("Layer %s has been built (used by %d images)", layer.Digest, images)
+		}(layer, shared.Images)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,66 @@
+package nix
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+)
+
+func TestOrderSharedLayers(t *testing.T) {
+	layer := func(digest string) types.Layer {
+		return types.Layer{Digest: digest}
+	}
+	images := []types.Image{
+		{Layers: []types.Layer{layer("base"), layer("app1")}},
+		{Layers: []types.Layer{layer("base"), layer("runtime"), layer("app2")}},
+		{Layers: []types.Layer{layer("base"), layer("runtime"), layer("app3")}},
+	}
+	ordered := OrderSharedLayers(images)
+	var digests []string
+	for _, shared := range ordered {
+		digests = append(digests, shared.Layer.Digest)
+	}
+	expected := []string{"base", "runtime", "app1", "app2", "app3"}
+	if len(digests) != len(expected) {
+		t.Fatalf("The layers should be '%#v' (while they are %#v)", expected, digests)
+	}
+	for i := range expected {
+		if digests[i] != expected[i] {
+			t.Fatalf("The layers should be '%#v' (while they are %#v)", expected, digests)
+		}
+	}
+	if ordered[0].Images != 3 {
+		t.Fatalf("The base layer should be used by '%#v' images (while it is %#v)", 3, ordered[0].Images)
+	}
+
+	// Layers stacked in different orders are ordered as they are
+	// first seen
+	images = []types.Image{
+		{Layers: []types.Layer{layer("a"), layer("b")}},
+		{Layers: []types.Layer{layer("b"), layer("a")}},
+	}
+	if ordered := OrderSharedLayers(images); len(ordered) != 2 || ordered[0].Layer.Digest != "a" {
+		t.Fatalf("The layers should be ordered as they are first seen (while they are %#v)", ordered)
+	}
+}
+
+func TestBuildAll(t *testing.T) {
+	layers, err := NewLayers(context.Background(), []string{"../data/layer1"}, nil, nil, "", nil, types.PathOptions{}, CompressionNone)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	images := []types.Image{{Layers: layers}, {Layers: layers}}
+	cache, err := NewBlobCache(t.TempDir())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := BuildAll(context.Background(), images, cache, 2); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := os.Stat(cache.store.(*dirBlobStore).blobPath(godigest.Digest(layers[0].Digest))); err != nil {
+		t.Fatalf("The layer should be in the cache: %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+package nix
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/nlewo/nix2container/metrics"
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+)
+
+// BlobCache stores the layer blobs generated from store paths in a
+// blob store, such as a directory, indexed by their digest. A blob is
+// then only generated once, even if several copies of the same image
+// concurrently request it: these copies wait for the blob to be
+// generated and read it from the cache. In a directory, blobs are
+// generated under a per-digest file lock and atomically renamed, so
+// several processes can share a cache directory.
+type BlobCache struct {
+	store BlobStore
+
+	// The compression command of the layers compressed by a
+	// command, see SetCompressionCommand
+	compressionCommand []string
+
+	mu    sync.Mutex
+	locks map[godigest.Digest]*digestLock
+}
+
+// digestLock is the lock of a digest, removed from the locks of the
+// cache once it is no longer used.
+type digestLock struct {
+	sync.Mutex
+	// The number of goroutines holding or waiting for the lock
+	refs int
+}
+
+// NewBlobCache creates a BlobCache storing blobs in the blob store of
+// location (see NewBlobStore), usually a directory which is created
+// if it doesn't exist.
+func NewBlobCache(location string) (*BlobCache, error) {
+	store, err := NewBlobStore(location)
+	if err != nil {
+		return nil, err
+	}
+	return NewBlobCacheFromStore(store), nil
+}
+
+// NewBlobCacheFromStore creates a BlobCache storing blobs in store.
+func NewBlobCacheFromStore(store BlobStore) *BlobCache {
+	return &BlobCache{
+		store: store,
+		locks: make(map[godigest.Digest]*digestLock),
+	}
+}
+
+// SetCompressionCommand sets the command generating the blobs of the
+// layers compressed by a command, instead of the command of the
+// process (see the SetCompressionCommand function).
+func (c *BlobCache) SetCompressionCommand(command []string) {
+	c.compressionCommand = command
+}
+
+// Store returns the blob store of the cache.
+func (c *BlobCache) Store() BlobStore {
+	return c.store
+}
+
+// lock locks the digest and returns the function unlocking it. The
+// lock is deleted once no goroutine uses it, so that the locks don't
+// grow with the number of generated blobs.
+func (c *BlobCache) lock(digest godigest.Digest) func() {
+	c.mu.Lock()
+	l, ok := c.locks[digest]
+	if !ok {
+		l = &digestLock{}
+		c.locks[digest] = l
+	}
+	l.refs++
+	c.mu.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		l.refs--
+		if l.refs == 0 {
+			delete(c.locks, digest)
+		}
+	}
+}
+
+// Contains returns true if the blob of the layer digest has already
+// been generated in the cache.
+func (c *BlobCache) Contains(digest godigest.Digest) bool {
+	ok, err := c.store.Has(context.Background(), digest)
+	return err == nil && ok
+}
+
+// GetBlob is like GetBlobContext but layers built from store paths are read
+// from the cache, where they are generated on the first request.
+func (c *BlobCache) GetBlob(ctx context.Context, image types.Image, digest godigest.Digest) (io.ReadCloser, int64, error) {
+	for _, layer := range image.Layers {
+		if layer.Digest != digest.String() || layer.LayerPath != "" || layer.Paths == nil {
+			continue
+		}
+		// The layer is shown in the status while it is generated
+		metrics.StartStatusLayer(layer.Digest)
+		if err := c.ensure(ctx, layer, digest); err != nil {
+			metrics.EndStatusLayer(layer.Digest, false)
+			return nil, 0, err
+		}
+		rc, size, err := c.store.Get(ctx, digest)
+		if err != nil {
+			metrics.EndStatusLayer(layer.Digest, false)
+			return nil, 0, err
+		}
+		metrics.BlobsRead.Inc("type", "layer")
+		rc = verifyBlob(rc, c.store.String(), digest, expectedSize(layer))
+		return throttleBlob(newCountingReadCloser(rc, digest.String()), true), size, nil
+	}
+	return GetBlobContext(ctx, image, digest)
+}
+
+// ensure generates the blob of the layer in the cache if it is not
+// already there.
+func (c *BlobCache) ensure(ctx context.Context, layer types.Layer, digest godigest.Digest) error {
+	unlock := c.lock(digest)
+	defer unlock()
+
+	ok, err := c.store.Has(ctx, digest)
+	if err != nil {
+		return err
+	}
+	if ok {
+		metrics.CacheLookups.Inc("cache", "blob", "result", "hit")
+		return nil
+	}
+	metrics.CacheLookups.Inc("cache", "blob", "result", "miss")
+	// In a directory, the blob is generated next to its final
+	// location, to be renamed
+	tmpDir := ""
+	dir, isDir := c.store.(*dirBlobStore)
+	if isDir {
+		filename := dir.blobPath(digest)
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			return err
+		}
+		unlock, err := lockFile(ctx, filename+".lock")
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		// Another process could have generated the blob while we
+		// were waiting for the lock
+		if _, err := os.Stat(filename); err == nil {
+			return nil
+		}
+		tmpDir = filepath.Dir(filename)
+	}
+	command, err := layerCompressionCommand(layer, c.compressionCommand)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(tmpDir, ".blob-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	// The blob is generated with the settings of the layer, not
+	// with the ones of the process
+	ctx = withArchiveSettings(ctx, layerArchiveSettings(layer))
+	sum, err := tarPathsCompressedWrite(ctx, layer.Paths, layer.Compression, command, f.Name())
+	if err != nil {
+		return err
+	}
+	// The store paths could have been modified since the layer has
+	// been built: a blob not matching its digest must not be cached.
+	if sum.digest != digest {
+		return classErrorf(ErrDigestMismatch, "The generated blob digest %s doesn't match the layer digest %s", sum.digest, digest)
+	}
+	if layer.DiffIDs != "" && sum.diffID.String() != layer.DiffIDs {
+		return classErrorf(ErrDigestMismatch, "The generated blob diff_ids %s doesn't match the layer diff_ids %s", sum.diffID, layer.DiffIDs)
+	}
+	if isDir {
+		return os.Rename(f.Name(), dir.blobPath(digest))
+	}
+	f, err = os.Open(f.Name())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return c.store.Put(ctx, digest, f, sum.size)
+}
@@ -0,0 +1,177 @@
+package nix
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+)
+
+func TestBlobCache(t *testing.T) {
+	paths := []string{
+		"../data/layer1/file1",
+	}
+	layers, err := NewLayers(context.Background(), paths, []types.Layer{}, []types.RewritePath{}, "", []types.PermPath{}, types.PathOptions{}, CompressionNone)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	image := types.Image{Layers: layers}
+	digest := godigest.Digest(layers[0].Digest)
+
+	cache, err := NewBlobCache(t.TempDir())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rc, size, err := cache.GetBlob(context.Background(), image, digest)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer rc.Close()
+			content, err := ioutil.ReadAll(rc)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if godigest.FromBytes(content) != digest || size != layers[0].Size {
+				t.Errorf("The cached blob should match the layer %#v", layers[0])
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("%v", err)
+	}
+	if len(cache.locks) != 0 {
+		t.Fatalf("The locks should be deleted once the blob is generated (while there are %d locks)", len(cache.locks))
+	}
+
+	// A layer whose store paths have changed is not cached
+	image.Layers[0].Digest = "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	_, _, err = cache.GetBlob(context.Background(), image, godigest.Digest(image.Layers[0].Digest))
+	if err == nil {
+		t.Fatalf("A blob not matching its digest should not be cached")
+	}
+}
+
+func TestLockFile(t *testing.T) {
+	filename := t.TempDir() + "/blob.lock"
+	unlock, err := lockFile(context.Background(), filename)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	locked := make(chan struct{})
+	go func() {
+		unlock, err := lockFile(context.Background(), filename)
+		if err != nil {
+			t.Errorf("%v", err)
+		} else {
+			unlock()
+		}
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatalf("The file should still be locked")
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	<-locked
+
+	// Waiting for a lock held by another process stops once the
+	// context is done
+	unlock, err = lockFile(context.Background(), filename)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := lockFile(ctx, filename); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Taking the lock should fail with the context error (while it is %#v)", err)
+	}
+}
+
+func TestBlobCacheCorruption(t *testing.T) {
+	paths := []string{
+		"../data/layer1/file1",
+	}
+	layers, err := NewLayers(context.Background(), paths, []types.Layer{}, []types.RewritePath{}, "", []types.PermPath{}, types.PathOptions{}, CompressionNone)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	image := types.Image{Layers: layers}
+	digest := godigest.Digest(layers[0].Digest)
+	cache, err := NewBlobCache(t.TempDir())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	rc, _, err := cache.GetBlob(context.Background(), image, digest)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	rc.Close()
+
+	// The cached blob is truncated after its generation
+	if err := os.Truncate(cache.store.(*dirBlobStore).blobPath(digest), 512); err != nil {
+		t.Fatalf("%v", err)
+	}
+	rc, _, err = cache.GetBlob(context.Background(), image, digest)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer rc.Close()
+	_, err = ioutil.ReadAll(rc)
+	if err == nil || !strings.Contains(err.Error(), "is truncated: 512 bytes have been read while its size is 1536") {
+		t.Fatalf("Reading a truncated blob should fail (while the error is %v)", err)
+	}
+}
+
+func TestBlobCacheLayerSettings(t *testing.T) {
+	if err := SetDigestAlgorithm("sha512"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	paths := []string{
+		"../data/layer1/file1",
+	}
+	layers, err := NewLayers(context.Background(), paths, []types.Layer{}, []types.RewritePath{}, "", []types.PermPath{}, types.PathOptions{}, CompressionNone)
+	SetDigestAlgorithm("sha256")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	// The settings of the process, which could be the ones of
+	// another job, don't apply to the blobs of existing layers
+	SetMaxEntrySize(1)
+	defer SetMaxEntrySize(0)
+	cache, err := NewBlobCache(t.TempDir())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	digest := godigest.Digest(layers[0].Digest)
+	rc, _, err := cache.GetBlob(context.Background(), types.Image{Layers: layers}, digest)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer rc.Close()
+	content, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if godigest.SHA512.FromBytes(content) != digest {
+		t.Fatalf("The cached blob should match the sha512 layer digest %s", digest)
+	}
+}
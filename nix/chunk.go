@@ -0,0 +1,229 @@
+package nix
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	imageTypes "github.com/containers/image/v5/types"
+	"github.com/nlewo/nix2container/types"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+)
+
+// MediaTypeChunkIndex is the media type of the experimental chunk
+// index artifact.
+const MediaTypeChunkIndex = "application/vnd.nix2container.chunk-index.v1+json"
+
+// Default chunk sizes. The average size is a power of two since it
+// is used to build the boundary mask.
+const (
+	minChunkSize = 256 * 1024
+	avgChunkSize = 1024 * 1024
+	maxChunkSize = 4 * 1024 * 1024
+)
+
+// gearTable contains the pseudo random values of the Gear rolling
+// hash. They are generated from a fixed seed to get stable boundaries
+// across nix2container versions.
+var gearTable = func() (table [256]uint64) {
+	seed := uint64(0x6e697832636f6e74)
+	for i := range table {
+		// splitmix64
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return
+}()
+
+// chunker splits a stream at content-defined boundaries: a boundary
+// is found when the Gear hash of the last bytes matches a mask. An
+// insertion in the stream then only modifies the chunks around the
+// insertion.
+type chunker struct {
+	min, max int
+	mask     uint64
+}
+
+func newChunker(min, avg, max int) chunker {
+	return chunker{
+		min:  min,
+		max:  max,
+		mask: uint64(avg - 1),
+	}
+}
+
+// next returns the next chunk of r, or io.EOF when r is exhausted.
+func (c chunker) next(r *bufio.Reader) ([]byte, error) {
+	var chunk []byte
+	var hash uint64
+	for len(chunk) < c.max {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		chunk = append(chunk, b)
+		hash = (hash << 1) + gearTable[b]
+		if len(chunk) >= c.min && hash&c.mask == 0 {
+			break
+		}
+	}
+	if len(chunk) == 0 {
+		return nil, io.EOF
+	}
+	return chunk, nil
+}
+
+// ChunkBlob splits the blob read from r into content-defined chunks
+// which are written into directory, named by their digest. Chunks
+// already present in directory are not rewritten.
+func ChunkBlob(r io.Reader, directory string) (index types.ChunkIndex, err error) {
+	return chunkBlob(r, directory, newChunker(minChunkSize, avgChunkSize, maxChunkSize))
+}
+
+func chunkBlob(r io.Reader, directory string, c chunker) (index types.ChunkIndex, err error) {
+	digester := digest.Canonical.Digester()
+	br := bufio.NewReader(io.TeeReader(r, digester.Hash()))
+	index.MediaType = MediaTypeChunkIndex
+	index.Chunks = []types.Chunk{}
+	for {
+		chunk, err := c.next(br)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return index, err
+		}
+		d := digest.FromBytes(chunk)
+		if err := writeChunk(directory, d, chunk); err != nil {
+			return index, err
+		}
+		index.Chunks = append(index.Chunks, types.Chunk{
+			Digest: d.String(),
+			Offset: index.Size,
+			Size:   int64(len(chunk)),
+		})
+		index.Size += int64(len(chunk))
+	}
+	index.Digest = digester.Digest().String()
+	return index, nil
+}
+
+func writeChunk(directory string, d digest.Digest, chunk []byte) error {
+	filename := filepath.Join(directory, d.Encoded())
+	if _, err := os.Stat(filename); err == nil {
+		return nil
+	}
+	f, err := ioutil.TempFile(directory, ".chunk-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(chunk); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// PushChunks uploads the chunks of the index, read from directory, and
+// the index to the repository of destination (such as
+// docker://registry/blobs). Chunks already in the repository are not
+// uploaded again. So that registries keep these blobs, they are
+// referenced by a manifest, whose config is the index, tagged with the
+// encoded digest of the layer blob: the chunks of a layer can then be
+// found from its digest.
+func PushChunks(ctx context.Context, sys *imageTypes.SystemContext, destination string, directory string, index types.ChunkIndex) error {
+	client, err := newDestinationRegistryClient(sys, destination)
+	if err != nil {
+		return err
+	}
+	return pushChunks(ctx, client, directory, index)
+}
+
+func pushChunks(ctx context.Context, client *registryClient, directory string, index types.ChunkIndex) error {
+	layerDigest, err := digest.Parse(index.Digest)
+	if err != nil {
+		return err
+	}
+	manifest := v1.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Layers:    []v1.Descriptor{},
+	}
+	uploaded := 0
+	for _, chunk := range index.Chunks {
+		d, err := digest.Parse(chunk.Digest)
+		if err != nil {
+			return err
+		}
+		manifest.Layers = append(manifest.Layers, v1.Descriptor{
+			MediaType: "application/octet-stream",
+			Digest:    d,
+			Size:      chunk.Size,
+		})
+		ok, err := client.hasBlob(ctx, d.String())
+		if err != nil {
+			return err
+		}
+		if ok {
+			continue
+		}
+		filename := filepath.Join(directory, d.Encoded())
+		f, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		err = client.uploadBlob(ctx, d.String(), verifyBlob(f, filename, d, chunk.Size))
+		f.Close()
+		if err != nil {
+			return err
+		}
+		uploaded++
+	}
+	content, err := types.MarshalCanonical(index)
+	if err != nil {
+		return err
+	}
+	indexDigest := digest.FromBytes(content)
+	ok, err := client.hasBlob(ctx, indexDigest.String())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if err := client.uploadBlob(ctx, indexDigest.String(), bytes.NewReader(content)); err != nil {
+			return err
+		}
+	}
+	manifest.Config = v1.Descriptor{
+		MediaType: MediaTypeChunkIndex,
+		Digest:    indexDigest,
+		Size:      int64(len(content)),
+	}
+	res, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if err := client.putManifest(ctx, layerDigest.Encoded(), v1.MediaTypeImageManifest, res); err != nil {
+		return err
+	}
+	logrus.Infof("%d chunks of %d of the layer %s have been uploaded to %s", uploaded, len(index.Chunks), layerDigest, client.repository)
+	return nil
+}
@@ -0,0 +1,149 @@
+package nix
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestChunkBlob(t *testing.T) {
+	data := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	c := newChunker(4*1024, 16*1024, 64*1024)
+
+	directory := t.TempDir()
+	index, err := chunkBlob(bytes.NewReader(data), directory, c)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if index.Digest != digest.FromBytes(data).String() || index.Size != int64(len(data)) {
+		t.Fatalf("The index doesn't describe the blob: %#v", index)
+	}
+	var content []byte
+	for _, chunk := range index.Chunks {
+		d, _ := digest.Parse(chunk.Digest)
+		b, err := ioutil.ReadFile(filepath.Join(directory, d.Encoded()))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		content = append(content, b...)
+	}
+	if !bytes.Equal(content, data) {
+		t.Fatalf("The concatenation of chunks should be the blob")
+	}
+
+	// Inserting a byte at the beginning of the blob must only
+	// modify a few chunks
+	modified := append([]byte{0}, data...)
+	modifiedIndex, err := chunkBlob(bytes.NewReader(modified), t.TempDir(), c)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	chunks := make(map[string]bool)
+	for _, chunk := range index.Chunks {
+		chunks[chunk.Digest] = true
+	}
+	changed := 0
+	for _, chunk := range modifiedIndex.Chunks {
+		if !chunks[chunk.Digest] {
+			changed++
+		}
+	}
+	if changed > 2 {
+		t.Fatalf("%d chunks out of %d have been modified", changed, len(modifiedIndex.Chunks))
+	}
+}
+
+// blobRegistry is a registry without authentication storing blobs and
+// manifests in memory.
+type blobRegistry struct {
+	mu        sync.Mutex
+	blobs     map[string][]byte
+	uploads   map[string][]byte
+	manifests map[string][]byte
+}
+
+func (r *blobRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case strings.HasPrefix(req.URL.Path, "/v2/blobs/blobs/uploads/"):
+		body, _ := ioutil.ReadAll(req.Body)
+		switch req.Method {
+		case "POST":
+			w.Header().Set("Location", "/v2/blobs/blobs/uploads/session")
+			w.WriteHeader(http.StatusAccepted)
+		case "PATCH":
+			r.uploads["session"] = append(r.uploads["session"], body...)
+			w.Header().Set("Location", "/v2/blobs/blobs/uploads/session")
+			w.WriteHeader(http.StatusAccepted)
+		case "PUT":
+			r.blobs[req.URL.Query().Get("digest")] = r.uploads["session"]
+			delete(r.uploads, "session")
+			w.WriteHeader(http.StatusCreated)
+		}
+	case strings.HasPrefix(req.URL.Path, "/v2/blobs/blobs/"):
+		if _, ok := r.blobs[strings.TrimPrefix(req.URL.Path, "/v2/blobs/blobs/")]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case strings.HasPrefix(req.URL.Path, "/v2/blobs/manifests/") && req.Method == "PUT":
+		body, _ := ioutil.ReadAll(req.Body)
+		r.manifests[strings.TrimPrefix(req.URL.Path, "/v2/blobs/manifests/")] = body
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestPushChunks(t *testing.T) {
+	data := make([]byte, 256*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	directory := t.TempDir()
+	index, err := chunkBlob(bytes.NewReader(data), directory, newChunker(4*1024, 16*1024, 64*1024))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	registry := &blobRegistry{blobs: make(map[string][]byte), uploads: make(map[string][]byte), manifests: make(map[string][]byte)}
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	client := &registryClient{
+		base:       server.URL + "/v2",
+		repository: "blobs",
+		client:     server.Client(),
+		now:        time.Now,
+	}
+	if err := pushChunks(context.Background(), client, directory, index); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	var content []byte
+	for _, chunk := range index.Chunks {
+		content = append(content, registry.blobs[chunk.Digest]...)
+	}
+	if !bytes.Equal(content, data) {
+		t.Fatalf("The concatenation of the uploaded chunks should be the blob")
+	}
+	d, _ := digest.Parse(index.Digest)
+	var manifest v1.Manifest
+	if err := json.Unmarshal(registry.manifests[d.Encoded()], &manifest); err != nil {
+		t.Fatalf("The manifest should be tagged with the layer digest: %v", err)
+	}
+	if manifest.Config.MediaType != MediaTypeChunkIndex || registry.blobs[manifest.Config.Digest.String()] == nil {
+		t.Fatalf("The manifest config should be the uploaded chunk index (while it is %#v)", manifest.Config)
+	}
+	if len(manifest.Layers) != len(index.Chunks) {
+		t.Fatalf("The manifest should reference '%d' chunks (while it references %d)", len(index.Chunks), len(manifest.Layers))
+	}
+}
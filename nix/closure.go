@@ -0,0 +1,102 @@
+package nix
+
+import (
+	"fmt"
+)
+
+// ClosureSelection selects store paths according to the reference
+// graph, such as "the runtime dependencies of X excluding the closure
+// of Y".
+type ClosureSelection struct {
+	// Only the closures of these store paths are selected (all
+	// store paths if empty)
+	Include []string
+	// The closures of these store paths are not selected
+	Exclude []string
+	// If positive, only the store paths at most MaxDepth references
+	// away from the Include store paths are selected
+	MaxDepth int
+}
+
+// IsEmpty returns true if the selection selects all store paths.
+func (s ClosureSelection) IsEmpty() bool {
+	return len(s.Include) == 0 && len(s.Exclude) == 0 && s.MaxDepth <= 0
+}
+
+// Closure returns the store paths reachable from the roots through at
+// most maxDepth references (without limit if maxDepth is not
+// positive), including the roots. An error is returned if a root is
+// not part of the graph.
+func (graph ClosureGraph) Closure(roots []string, maxDepth int) (map[string]bool, error) {
+	references := make(map[string][]string)
+	for _, node := range graph {
+		references[node.Path] = node.References
+	}
+	closure := make(map[string]bool)
+	var current []string
+	for _, root := range roots {
+		if _, ok := references[root]; !ok {
+			return nil, fmt.Errorf("The store path %s is not part of the closure graph", root)
+		}
+		if !closure[root] {
+			closure[root] = true
+			current = append(current, root)
+		}
+	}
+	for depth := 1; len(current) > 0 && (maxDepth <= 0 || depth <= maxDepth); depth++ {
+		var next []string
+		for _, p := range current {
+			for _, ref := range references[p] {
+				if !closure[ref] {
+					closure[ref] = true
+					next = append(next, ref)
+				}
+			}
+		}
+		current = next
+	}
+	return closure, nil
+}
+
+// SelectStorePaths returns the store paths selected by the selection,
+// in their original order. Without Include store paths, the store
+// paths missing from the graph are selected.
+func SelectStorePaths(graph ClosureGraph, storePaths []string, selection ClosureSelection) ([]string, error) {
+	if selection.IsEmpty() {
+		return storePaths, nil
+	}
+	inGraph := make(map[string]bool)
+	for _, node := range graph {
+		inGraph[node.Path] = true
+	}
+	roots := selection.Include
+	if len(roots) == 0 {
+		for _, p := range storePaths {
+			if inGraph[p] {
+				roots = append(roots, p)
+			}
+		}
+	}
+	included, err := graph.Closure(roots, selection.MaxDepth)
+	if err != nil {
+		return nil, err
+	}
+	if len(selection.Include) == 0 {
+		for _, p := range storePaths {
+			if !inGraph[p] {
+				included[p] = true
+			}
+		}
+	}
+	excluded, err := graph.Closure(selection.Exclude, 0)
+	if err != nil {
+		return nil, err
+	}
+	selected := []string{}
+	for _, p := range storePaths {
+		if included[p] && !excluded[p] {
+			selected = append(selected, p)
+		}
+	}
+	return selected, nil
+}
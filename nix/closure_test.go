@@ -0,0 +1,43 @@
+package nix
+
+import (
+	"testing"
+)
+
+func TestSelectStorePaths(t *testing.T) {
+	graph := ClosureGraph{
+		{Path: "app", References: []string{"python", "libapp"}},
+		{Path: "libapp", References: []string{"glibc"}},
+		{Path: "python", References: []string{"glibc", "python"}},
+		{Path: "glibc", References: []string{}},
+		{Path: "tool", References: []string{"glibc"}},
+	}
+	storePaths := []string{"app", "libapp", "python", "glibc", "tool", "not-in-graph"}
+	for _, tc := range []struct {
+		selection ClosureSelection
+		expected  []string
+	}{
+		{ClosureSelection{}, storePaths},
+		{ClosureSelection{Include: []string{"app"}, Exclude: []string{"python"}}, []string{"app", "libapp"}},
+		{ClosureSelection{Include: []string{"app"}, MaxDepth: 1}, []string{"app", "libapp", "python"}},
+		{ClosureSelection{Exclude: []string{"libapp"}}, []string{"app", "python", "tool", "not-in-graph"}},
+	} {
+		selected, err := SelectStorePaths(graph, storePaths, tc.selection)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if len(selected) != len(tc.expected) {
+			t.Fatalf("Selected store paths should be '%#v' (while they are %#v)", tc.expected, selected)
+		}
+		for i := range selected {
+			if selected[i] != tc.expected[i] {
+				t.Fatalf("Selected store paths should be '%#v' (while they are %#v)", tc.expected, selected)
+			}
+		}
+	}
+
+	_, err := SelectStorePaths(graph, storePaths, ClosureSelection{Include: []string{"unknown"}})
+	if err == nil {
+		t.Fatalf("A store path missing from the graph should be rejected")
+	}
+}
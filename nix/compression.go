@@ -0,0 +1,210 @@
+package nix
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+
+	"github.com/containers/storage/pkg/chunked/compressor"
+	"github.com/klauspost/compress/zstd"
+	"github.com/nlewo/nix2container/types"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Supported layer compressions.
+const (
+	CompressionNone = ""
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+	// zstd:chunked is a zstd stream embedding a table of content of
+	// the archive in a skippable frame. This allows Podman to only
+	// pull missing files of a layer. The location of the table of
+	// content is provided by layer annotations.
+	CompressionZstdChunked = "zstd:chunked"
+)
+
+// CompressionMediaType returns the layer media type corresponding to
+// a compression.
+func CompressionMediaType(compression string) (string, error) {
+	switch compression {
+	case CompressionNone:
+		return v1.MediaTypeImageLayer, nil
+	case CompressionGzip:
+		return v1.MediaTypeImageLayerGzip, nil
+	case CompressionZstd, CompressionZstdChunked:
+		return v1.MediaTypeImageLayerZstd, nil
+	default:
+		return "", fmt.Errorf("Unsupported compression %q", compression)
+	}
+}
+
+// compressionCommand is the external command compressing new layers,
+// see SetCompressionCommand.
+var compressionCommand []string
+
+// SetCompressionCommand delegates the compression of new layers to an
+// external command, such as pigz or zstdmt, which reads the archive
+// on its standard input and writes the compressed stream on its
+// standard output. Multi-threaded compressors are much faster than
+// the built-in implementations on big layers. The command is recorded
+// in the layers since it is also used to generate their blobs, if it
+// is configured when they are pushed: its output must then be
+// reproducible (for instance, pigz has to be run with -n). An empty
+// command means the built-in implementations are used.
+func SetCompressionCommand(command []string) {
+	compressionCommand = command
+}
+
+// CompressionCommandEnv is the environment variable containing the
+// compression command of the layers whose blobs are generated, when
+// it is not set by SetCompressionCommand.
+const CompressionCommandEnv = "NIX2CONTAINER_COMPRESSION_COMMAND"
+
+// layerCompressionCommand returns the command generating the blob of
+// the layer. The command recorded in the layer is never run as is,
+// since image and layers JSON files can come from untrusted sources:
+// it has to be the configured command: configured if it is not empty,
+// otherwise the command set by SetCompressionCommand or by the
+// NIX2CONTAINER_COMPRESSION_COMMAND environment variable.
+func layerCompressionCommand(layer types.Layer, configured []string) ([]string, error) {
+	if len(layer.CompressionCommand) == 0 {
+		return nil, nil
+	}
+	if len(configured) == 0 {
+		configured = compressionCommand
+	}
+	if len(configured) == 0 {
+		configured = strings.Fields(os.Getenv(CompressionCommandEnv))
+	}
+	if !reflect.DeepEqual(configured, layer.CompressionCommand) {
+		return nil, fmt.Errorf("The layer %s is compressed by the command %q which is not configured: it has to be set with --compression-command or %s to generate the blob of the layer", layer.Digest, strings.Join(layer.CompressionCommand, " "), CompressionCommandEnv)
+	}
+	return configured, nil
+}
+
+// checkCompressionCommand checks an external command can produce the
+// compression.
+func checkCompressionCommand(compression string, command []string) error {
+	if len(command) == 0 {
+		return nil
+	}
+	switch compression {
+	case CompressionGzip, CompressionZstd:
+		return nil
+	default:
+		return fmt.Errorf("The compression %q can not be done by the command %s", compression, command[0])
+	}
+}
+
+// compressionAnnotationPrefix is the prefix of the layer annotations
+// added by the zstd:chunked compression.
+const compressionAnnotationPrefix = "io.github.containers.zstd-chunked."
+
+// compressWriter returns a WriteCloser compressing data written to
+// w. For the zstd:chunked compression, the layer annotations are
+// added to annotations when the WriteCloser is closed. If command is
+// not empty, the compression is done by this external command.
+func compressWriter(w io.Writer, compression string, command []string, annotations map[string]string) (io.WriteCloser, error) {
+	if len(command) > 0 {
+		if err := checkCompressionCommand(compression, command); err != nil {
+			return nil, err
+		}
+		return newCommandWriter(w, command)
+	}
+	switch compression {
+	case CompressionNone:
+		return nopWriteCloser{w}, nil
+	case CompressionGzip:
+		return gzip.NewWriterLevel(w, gzip.DefaultCompression)
+	case CompressionZstd:
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	case CompressionZstdChunked:
+		level := 3
+		return compressor.ZstdCompressor(w, annotations, &level)
+	default:
+		return nil, fmt.Errorf("Unsupported compression %q", compression)
+	}
+}
+
+// compressReader returns a ReadCloser on the compressed stream of r.
+func compressReader(r io.ReadCloser, compression string, command []string) (io.ReadCloser, error) {
+	if compression == CompressionNone {
+		return r, nil
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		defer r.Close()
+		cw, err := compressWriter(pw, compression, command, make(map[string]string))
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if _, err := io.Copy(cw, r); err != nil {
+			cw.Close()
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(cw.Close())
+	}()
+	return pr, nil
+}
+
+// commandWriter writes data to the standard input of a command whose
+// standard output is written to another writer.
+type commandWriter struct {
+	io.WriteCloser
+	cmd    *exec.Cmd
+	stderr bytes.Buffer
+}
+
+func newCommandWriter(w io.Writer, command []string) (*commandWriter, error) {
+	c := &commandWriter{
+		cmd: exec.Command(command[0], command[1:]...),
+	}
+	c.cmd.Stdout = w
+	c.cmd.Stderr = &c.stderr
+	stdin, err := c.cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	c.WriteCloser = stdin
+	if err := c.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("Could not run the compression command %s: %w", command[0], err)
+	}
+	return c, nil
+}
+
+// Close waits for the command to write all the compressed stream.
+func (c *commandWriter) Close() error {
+	c.WriteCloser.Close()
+	if err := c.cmd.Wait(); err != nil {
+		return fmt.Errorf("The compression command %s failed: %w: %s", c.cmd.Args[0], err, strings.TrimSpace(c.stderr.String()))
+	}
+	return nil
+}
+
+// decompressReader returns a Reader on the archive of a layer blob
+// whose media type is mediaType.
+func decompressReader(r io.Reader, mediaType string) (io.Reader, error) {
+	switch {
+	case strings.HasSuffix(mediaType, "+gzip") || strings.HasSuffix(mediaType, ".tar.gzip"):
+		return gzip.NewReader(r)
+	case strings.HasSuffix(mediaType, "+zstd"):
+		return zstd.NewReader(r)
+	case strings.HasSuffix(mediaType, ".tar") || mediaType == "":
+		return r, nil
+	default:
+		return nil, fmt.Errorf("Unsupported layer media type %q", mediaType)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,256 @@
+package nix
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/nlewo/nix2container/types"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// How a field of the base image configuration is inherited by an
+// image.
+const (
+	// The field of the image configuration is used, even if it is
+	// not set. This is the default behavior.
+	InheritanceReplace = "replace"
+	// The field of the base image configuration is used when the
+	// field of the image configuration is not set.
+	InheritanceInherit = "inherit"
+	// The entries of the field of the base image configuration
+	// are added to the field of the image configuration. Entries
+	// of the image configuration override entries of the base
+	// image with the same key. Only map fields and Env can be
+	// merged.
+	InheritanceMerge = "merge"
+)
+
+// configFields are the fields of the image configuration, as named in
+// the configuration JSON. The mergeable ones are true.
+var configFields = map[string]bool{
+	"User":         false,
+	"ExposedPorts": true,
+	"Env":          true,
+	"Entrypoint":   false,
+	"Cmd":          false,
+	"Volumes":      true,
+	"WorkingDir":   false,
+	"Labels":       true,
+	"StopSignal":   false,
+}
+
+// ValidateConfigInheritance checks the inheritance describes, for
+// configuration fields, a supported behavior.
+func ValidateConfigInheritance(inheritance map[string]string) error {
+	for field, mode := range inheritance {
+		mergeable, ok := configFields[field]
+		if !ok {
+			var fields []string
+			for f := range configFields {
+				fields = append(fields, f)
+			}
+			sort.Strings(fields)
+			return fmt.Errorf("Unknown configuration field %q (valid fields are %s)", field, strings.Join(fields, ", "))
+		}
+		switch mode {
+		case InheritanceReplace, InheritanceInherit:
+		case InheritanceMerge:
+			if !mergeable {
+				return fmt.Errorf("The configuration field %s can not be merged", field)
+			}
+		default:
+			return fmt.Errorf("Invalid inheritance %q of the configuration field %s (it must be replace, inherit or merge)", mode, field)
+		}
+	}
+	return nil
+}
+
+// InheritImageConfig returns the configuration of an image whose base
+// image configuration is base. The inheritance gives, for each field,
+// how it is inherited from the base image (replace if not set).
+func InheritImageConfig(base, config v1.ImageConfig, inheritance map[string]string) (v1.ImageConfig, error) {
+	if err := ValidateConfigInheritance(inheritance); err != nil {
+		return config, err
+	}
+	inherit := func(field string, set bool) bool {
+		return !set && inheritance[field] == InheritanceInherit
+	}
+	if inherit("User", config.User != "") {
+		config.User = base.User
+	}
+	if inherit("Entrypoint", config.Entrypoint != nil) {
+		config.Entrypoint = base.Entrypoint
+	}
+	if inherit("Cmd", config.Cmd != nil) {
+		config.Cmd = base.Cmd
+	}
+	if inherit("WorkingDir", config.WorkingDir != "") {
+		config.WorkingDir = base.WorkingDir
+	}
+	if inherit("StopSignal", config.StopSignal != "") {
+		config.StopSignal = base.StopSignal
+	}
+
+	switch inheritance["Env"] {
+	case InheritanceInherit:
+		if config.Env == nil {
+			config.Env = base.Env
+		}
+	case InheritanceMerge:
+		config.Env = mergeEnv(base.Env, config.Env)
+	}
+	switch inheritance["ExposedPorts"] {
+	case InheritanceInherit:
+		if config.ExposedPorts == nil {
+			config.ExposedPorts = base.ExposedPorts
+		}
+	case InheritanceMerge:
+		config.ExposedPorts = mergeSet(base.ExposedPorts, config.ExposedPorts)
+	}
+	switch inheritance["Volumes"] {
+	case InheritanceInherit:
+		if config.Volumes == nil {
+			config.Volumes = base.Volumes
+		}
+	case InheritanceMerge:
+		config.Volumes = mergeSet(base.Volumes, config.Volumes)
+	}
+	switch inheritance["Labels"] {
+	case InheritanceInherit:
+		if config.Labels == nil {
+			config.Labels = base.Labels
+		}
+	case InheritanceMerge:
+		if base.Labels != nil || config.Labels != nil {
+			labels := make(map[string]string)
+			for k, v := range base.Labels {
+				labels[k] = v
+			}
+			for k, v := range config.Labels {
+				labels[k] = v
+			}
+			config.Labels = labels
+		}
+	}
+	return config, nil
+}
+
+// mergeEnv returns the variables of base, overridden by variables
+// of env with the same name, followed by the other variables of env.
+func mergeEnv(base, env []string) []string {
+	if base == nil {
+		return env
+	}
+	name := func(v string) string {
+		return strings.SplitN(v, "=", 2)[0]
+	}
+	values := make(map[string]string)
+	for _, v := range env {
+		values[name(v)] = v
+	}
+	var merged []string
+	for _, v := range base {
+		if override, ok := values[name(v)]; ok {
+			merged = append(merged, override)
+			delete(values, name(v))
+		} else {
+			merged = append(merged, v)
+		}
+	}
+	for _, v := range env {
+		if _, ok := values[name(v)]; ok {
+			merged = append(merged, v)
+		}
+	}
+	return merged
+}
+
+func mergeSet(base, set map[string]struct{}) map[string]struct{} {
+	if base == nil && set == nil {
+		return nil
+	}
+	merged := make(map[string]struct{})
+	for k := range base {
+		merged[k] = struct{}{}
+	}
+	for k := range set {
+		merged[k] = struct{}{}
+	}
+	return merged
+}
+
+// OverrideImageConfig deep-merges the override configuration over the
+// configuration of an image, for instance to parameterize an image
+// per environment without rebuilding it. Env, Labels, ExposedPorts
+// and Volumes entries are merged, with entries of override taking
+// precedence, while other fields of override replace the image ones
+// when they are set.
+func OverrideImageConfig(config, override v1.ImageConfig) v1.ImageConfig {
+	inheritance := make(map[string]string)
+	for field, mergeable := range configFields {
+		if mergeable {
+			inheritance[field] = InheritanceMerge
+		} else {
+			inheritance[field] = InheritanceInherit
+		}
+	}
+	// The inheritance is valid, there is no error
+	merged, _ := InheritImageConfig(config, override, inheritance)
+	return merged
+}
+
+// ConfigHistory returns the history entries of the configuration, as
+// the instructions of a Dockerfile (such as ENV or LABEL) producing
+// it, so that the history of the image looks like the one of a
+// Dockerfile-built image.
+func ConfigHistory(config v1.ImageConfig) (history []types.History) {
+	add := func(instruction string) {
+		history = append(history, types.History{CreatedBy: instruction, Comment: "nix2container"})
+	}
+	execForm := func(args []string) string {
+		content, _ := json.Marshal(args)
+		return string(content)
+	}
+	sortedKeys := func(m map[string]struct{}) (keys []string) {
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+	for _, env := range config.Env {
+		add("ENV " + env)
+	}
+	var labels []string
+	for k := range config.Labels {
+		labels = append(labels, k)
+	}
+	sort.Strings(labels)
+	for _, k := range labels {
+		add(fmt.Sprintf("LABEL %s=%s", k, config.Labels[k]))
+	}
+	for _, port := range sortedKeys(config.ExposedPorts) {
+		add("EXPOSE " + port)
+	}
+	for _, volume := range sortedKeys(config.Volumes) {
+		add("VOLUME " + execForm([]string{volume}))
+	}
+	if config.User != "" {
+		add("USER " + config.User)
+	}
+	if config.WorkingDir != "" {
+		add("WORKDIR " + config.WorkingDir)
+	}
+	if config.StopSignal != "" {
+		add("STOPSIGNAL " + config.StopSignal)
+	}
+	if len(config.Entrypoint) > 0 {
+		add("ENTRYPOINT " + execForm(config.Entrypoint))
+	}
+	if len(config.Cmd) > 0 {
+		add("CMD " + execForm(config.Cmd))
+	}
+	return history
+}
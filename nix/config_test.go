@@ -0,0 +1,94 @@
+package nix
+
+import (
+	"reflect"
+	"testing"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestInheritImageConfig(t *testing.T) {
+	// The configuration of the base image is a real busybox
+	// configuration
+	base, err := NewImageFromDir("../data/image-directory")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	base.ImageConfig.ExposedPorts = map[string]struct{}{"80/tcp": struct{}{}}
+	base.ImageConfig.Labels = map[string]string{"maintainer": "base", "version": "1"}
+	base.ImageConfig.User = "nobody"
+
+	config := v1.ImageConfig{
+		Env:          []string{"HOME=/root", "PATH=/bin"},
+		ExposedPorts: map[string]struct{}{"443/tcp": struct{}{}},
+		Labels:       map[string]string{"version": "2"},
+		Entrypoint:   []string{"/bin/hello"},
+	}
+
+	replaced, err := InheritImageConfig(base.ImageConfig, config, map[string]string{})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !reflect.DeepEqual(replaced, config) {
+		t.Fatalf("The config should be '%#v' (while it is %#v)", config, replaced)
+	}
+
+	inheritance := map[string]string{
+		"Env":          InheritanceMerge,
+		"ExposedPorts": InheritanceMerge,
+		"Labels":       InheritanceMerge,
+		"Volumes":      InheritanceMerge,
+		"User":         InheritanceInherit,
+		"Cmd":          InheritanceInherit,
+		"Entrypoint":   InheritanceInherit,
+	}
+	merged, err := InheritImageConfig(base.ImageConfig, config, inheritance)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := v1.ImageConfig{
+		User:         "nobody",
+		Env:          []string{"PATH=/bin", "HOME=/root"},
+		ExposedPorts: map[string]struct{}{"80/tcp": struct{}{}, "443/tcp": struct{}{}},
+		Labels:       map[string]string{"maintainer": "base", "version": "2"},
+		Entrypoint:   []string{"/bin/hello"},
+		Cmd:          []string{"/bin/sh"},
+	}
+	if !reflect.DeepEqual(merged, expected) {
+		t.Fatalf("The config should be '%#v' (while it is %#v)", expected, merged)
+	}
+
+	for _, inheritance := range []map[string]string{
+		map[string]string{"User": InheritanceMerge},
+		map[string]string{"Unknown": InheritanceInherit},
+		map[string]string{"Env": "append"},
+	} {
+		if _, err := InheritImageConfig(base.ImageConfig, config, inheritance); err == nil {
+			t.Fatalf("The inheritance %#v should not be valid", inheritance)
+		}
+	}
+}
+
+func TestOverrideImageConfig(t *testing.T) {
+	config := v1.ImageConfig{
+		Env:        []string{"PATH=/bin", "ENVIRONMENT=dev"},
+		Labels:     map[string]string{"app": "hello"},
+		Entrypoint: []string{"/bin/hello"},
+		User:       "nobody",
+	}
+	override := v1.ImageConfig{
+		Env:    []string{"ENVIRONMENT=staging"},
+		Labels: map[string]string{"environment": "staging"},
+		User:   "root",
+	}
+	expected := v1.ImageConfig{
+		Env:        []string{"PATH=/bin", "ENVIRONMENT=staging"},
+		Labels:     map[string]string{"app": "hello", "environment": "staging"},
+		Entrypoint: []string{"/bin/hello"},
+		User:       "root",
+	}
+	overridden := OverrideImageConfig(config, override)
+	if !reflect.DeepEqual(overridden, expected) {
+		t.Fatalf("The config should be '%#v' (while it is %#v)", expected, overridden)
+	}
+}
@@ -0,0 +1,166 @@
+package nix
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/nlewo/nix2container/types"
+)
+
+// headerConflict is the error of a file overriding a file of the
+// archive with a different header. Since only the hashes of the
+// headers of the archive are kept, the overridden header is generated
+// again from its file by conflictError.
+type headerConflict struct {
+	// The file of the input path overriding the archive entry
+	path string
+	hdr  *tar.Header
+	// The index of the input path and the file of the overridden
+	// entry
+	previousInput int
+	previousPath  string
+}
+
+func (e *headerConflict) Error() string {
+	return fmt.Sprintf("The file %s overrides a file with different attributes (current file: %s)", e.hdr.Name, e.path)
+}
+
+func (e *headerConflict) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// previousEntry returns the header overridden by the conflict,
+// generated again from the file which has produced it.
+func previousEntry(paths types.Paths, conflict *headerConflict) (previousPath string, previousHdr *tar.Header, ok bool) {
+	previous := paths[conflict.previousInput]
+	options, err := compilePathOptions(previous.Path, previous.Options)
+	if err != nil {
+		return "", nil, false
+	}
+	info, err := os.Lstat(conflict.previousPath)
+	if err != nil {
+		return "", nil, false
+	}
+	hdr, _, err := fileHeader(conflict.previousPath, info, options, nil)
+	if err != nil || hdr == nil {
+		return "", nil, false
+	}
+	return conflict.previousPath, hdr, true
+}
+
+// conflictError describes the conflict of the input path input:
+// the overridden header is searched in the input path which has
+// produced it and the attributes of both headers are compared.
+func conflictError(paths types.Paths, input int, conflict *headerConflict) error {
+	previousPath, previousHdr, ok := previousEntry(paths, conflict)
+	if !ok {
+		return conflict
+	}
+	return classErrorf(ErrConflict, "The file %s is provided with different attributes by %s (input path %s) and %s (input path %s):\n%s",
+		conflict.hdr.Name,
+		previousPath, paths[conflict.previousInput].Path,
+		conflict.path, paths[input].Path,
+		strings.Join(headerDiff(previousHdr, conflict.hdr), "\n"))
+}
+
+// sameContent returns true if the files of the conflict have the same
+// type, link target and content, their other attributes being
+// ignored by the relaxed conflict checks.
+func sameContent(paths types.Paths, conflict *headerConflict) (bool, error) {
+	previousPath, previousHdr, ok := previousEntry(paths, conflict)
+	if !ok {
+		return false, nil
+	}
+	hdr := conflict.hdr
+	if typeflagName(previousHdr.Typeflag) != typeflagName(hdr.Typeflag) || previousHdr.Linkname != hdr.Linkname ||
+		previousHdr.Size != hdr.Size || previousHdr.Devmajor != hdr.Devmajor || previousHdr.Devminor != hdr.Devminor {
+		return false, nil
+	}
+	if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+		return true, nil
+	}
+	return sameFiles(previousPath, conflict.path)
+}
+
+// sameFiles returns true if the files a and b have the same content.
+func sameFiles(a, b string) (bool, error) {
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+	bufA, bufB := make([]byte, 64<<10), make([]byte, 64<<10)
+	for {
+		na, errA := io.ReadFull(fa, bufA)
+		nb, errB := io.ReadFull(fb, bufB)
+		if !bytes.Equal(bufA[:na], bufB[:nb]) {
+			return false, nil
+		}
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			return errB == io.EOF || errB == io.ErrUnexpectedEOF, nil
+		}
+		if errA != nil {
+			return false, errA
+		}
+		if errB != nil {
+			return false, errB
+		}
+	}
+}
+
+// headerDiff returns the attributes of the tar headers a and b which
+// differ, one per line.
+func headerDiff(a, b *tar.Header) (diff []string) {
+	field := func(name string, va, vb interface{}) {
+		if !reflect.DeepEqual(va, vb) {
+			diff = append(diff, fmt.Sprintf("  %-12s %v != %v", name+":", va, vb))
+		}
+	}
+	field("type", typeflagName(a.Typeflag), typeflagName(b.Typeflag))
+	field("mode", fmt.Sprintf("%04o", a.Mode), fmt.Sprintf("%04o", b.Mode))
+	field("size", a.Size, b.Size)
+	field("owner", owner(a), owner(b))
+	field("link target", fmt.Sprintf("%q", a.Linkname), fmt.Sprintf("%q", b.Linkname))
+	field("device", fmt.Sprintf("%d:%d", a.Devmajor, a.Devminor), fmt.Sprintf("%d:%d", b.Devmajor, b.Devminor))
+	field("mtime", a.ModTime.UTC(), b.ModTime.UTC())
+	field("format", a.Format, b.Format)
+	field("pax records", a.PAXRecords, b.PAXRecords)
+	if len(diff) == 0 {
+		diff = append(diff, "  (other attributes of the headers differ)")
+	}
+	return diff
+}
+
+func owner(hdr *tar.Header) string {
+	return fmt.Sprintf("%d:%d (%s:%s)", hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname)
+}
+
+func typeflagName(typeflag byte) string {
+	switch typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		return "regular file"
+	case tar.TypeLink:
+		return "hard link"
+	case tar.TypeSymlink:
+		return "symlink"
+	case tar.TypeChar:
+		return "character device"
+	case tar.TypeBlock:
+		return "block device"
+	case tar.TypeDir:
+		return "directory"
+	case tar.TypeFifo:
+		return "named pipe"
+	}
+	return fmt.Sprintf("type %q", typeflag)
+}
@@ -0,0 +1,144 @@
+package nix
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	godigest "github.com/opencontainers/go-digest"
+)
+
+// CtrEnv is the environment variable containing the ctr command used
+// to access the containerd content store ("ctr" by default). The
+// address of containerd is read by ctr from CONTAINERD_ADDRESS.
+const CtrEnv = "NIX2CONTAINER_CTR"
+
+// containerdBlobStore stores blobs in the content store of a
+// containerd namespace, with the ctr command: containerd would not
+// see blobs written directly in its content directory, since content
+// is also tracked by its metadata database.
+type containerdBlobStore struct {
+	namespace string
+}
+
+func newContainerdBlobStore(location string) *containerdBlobStore {
+	namespace := strings.Trim(strings.TrimPrefix(location, "containerd://"), "/")
+	if namespace == "" {
+		namespace = "default"
+	}
+	return &containerdBlobStore{namespace: namespace}
+}
+
+func (s *containerdBlobStore) command(ctx context.Context, args ...string) *exec.Cmd {
+	ctr := "ctr"
+	if command := os.Getenv(CtrEnv); command != "" {
+		ctr = command
+	}
+	return exec.CommandContext(ctx, ctr, append([]string{"--namespace", s.namespace, "content"}, args...)...)
+}
+
+// info returns the size of the blob, or false if it is not in the
+// content store.
+func (s *containerdBlobStore) info(ctx context.Context, digest godigest.Digest) (int64, bool, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := s.command(ctx, "info", digest.String())
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if strings.Contains(stderr.String(), "not found") {
+			return 0, false, nil
+		}
+		return 0, false, fmt.Errorf("Could not get the blob %s from the containerd namespace %s: %w: %s", digest, s.namespace, err, strings.TrimSpace(stderr.String()))
+	}
+	var info struct {
+		Size int64
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &info); err != nil {
+		return 0, false, err
+	}
+	return info.Size, true, nil
+}
+
+func (s *containerdBlobStore) Has(ctx context.Context, digest godigest.Digest) (bool, error) {
+	_, ok, err := s.info(ctx, digest)
+	return ok, err
+}
+
+// commandReader is the standard output of a command, which is waited
+// for when the reader is closed.
+type commandReader struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	stderr bytes.Buffer
+}
+
+func (c *commandReader) Close() error {
+	c.ReadCloser.Close()
+	if err := c.cmd.Wait(); err != nil {
+		return fmt.Errorf("The command %s failed: %w: %s", strings.Join(c.cmd.Args, " "), err, strings.TrimSpace(c.stderr.String()))
+	}
+	return nil
+}
+
+func (s *containerdBlobStore) Get(ctx context.Context, digest godigest.Digest) (io.ReadCloser, int64, error) {
+	size, ok, err := s.info(ctx, digest)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !ok {
+		return nil, 0, classErrorf(ErrBlobMissing, "The blob %s is not in the containerd namespace %s", digest, s.namespace)
+	}
+	c := &commandReader{cmd: s.command(ctx, "get", digest.String())}
+	c.cmd.Stderr = &c.stderr
+	stdout, err := c.cmd.StdoutPipe()
+	if err != nil {
+		return nil, 0, err
+	}
+	c.ReadCloser = stdout
+	if err := c.cmd.Start(); err != nil {
+		return nil, 0, err
+	}
+	return verifyBlob(c, "containerd", digest, size), size, nil
+}
+
+// Put ingests the blob, which is verified by containerd. Since
+// content not referenced by an image is garbage collected by
+// containerd, the blob is labeled as a garbage collection root.
+func (s *containerdBlobStore) Put(ctx context.Context, digest godigest.Digest, r io.Reader, size int64) error {
+	ok, err := s.Has(ctx, digest)
+	if err != nil || ok {
+		return err
+	}
+	args := []string{"ingest", "--expected-digest", digest.String()}
+	if size >= 0 {
+		args = append(args, "--expected-size", strconv.FormatInt(size, 10))
+	}
+	var stderr bytes.Buffer
+	cmd := s.command(ctx, append(args, "nix2container-"+digest.Encoded())...)
+	cmd.Stdin = r
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if strings.Contains(stderr.String(), "unexpected commit digest") {
+			return classErrorf(ErrDigestMismatch, "The blob %s doesn't match its digest: %s", digest, strings.TrimSpace(stderr.String()))
+		}
+		return fmt.Errorf("Could not put the blob %s into the containerd namespace %s: %w: %s", digest, s.namespace, err, strings.TrimSpace(stderr.String()))
+	}
+	stderr.Reset()
+	cmd = s.command(ctx, "label", digest.String(), "containerd.io/gc.root="+time.Now().UTC().Format(time.RFC3339))
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Could not label the blob %s in the containerd namespace %s: %w: %s", digest, s.namespace, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+func (s *containerdBlobStore) String() string {
+	return "containerd://" + s.namespace
+}
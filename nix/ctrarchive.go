@@ -0,0 +1,186 @@
+package nix
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// AnnotationContainerdImageName is the annotation of the manifests of
+// an OCI archive naming the images created by "ctr images import".
+const AnnotationContainerdImageName = "io.containerd.image.name"
+
+// ContainerdImageName returns the fully qualified name of the image
+// reference name, such as docker.io/library/app:latest for app, as
+// containerd names images, and its tag.
+func ContainerdImageName(name string) (imageName string, tag string, err error) {
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return "", "", fmt.Errorf("Invalid image name %q: %w", name, err)
+	}
+	named = reference.TagNameOnly(named)
+	if tagged, ok := named.(reference.Tagged); ok {
+		tag = tagged.Tag()
+	}
+	return named.String(), tag, nil
+}
+
+// WriteCtrArchive writes the image as an OCI archive (a tar stream of
+// an OCI image layout) to w, importable with "ctr images import" and
+// "nerdctl load", for instance in the containerd of a Colima or Lima
+// VM. Each name, such as app:v1.2.3, is an entry of the index of the
+// archive labeled with the containerd image name and the platform of
+// the image, so that the images are created with the right name and
+// unpacked for the platform of the VM, even if it is not the default
+// platform of ctr. Layer blobs are stored as they are pushed to a
+// registry.
+func WriteCtrArchive(ctx context.Context, image types.Image, w io.Writer, names []string, variant string) error {
+	config, err := GetConfigBlob(image)
+	if err != nil {
+		return err
+	}
+	manifest, err := GetManifestBlob(image)
+	if err != nil {
+		return err
+	}
+	platform := v1.Platform{
+		OS:           ImageOS(image),
+		Architecture: ImageArchitecture(image),
+		Variant:      variant,
+		OSVersion:    image.OSVersion,
+		OSFeatures:   image.OSFeatures,
+	}
+	desc := v1.Descriptor{
+		MediaType: v1.MediaTypeImageManifest,
+		Digest:    godigest.FromBytes(manifest),
+		Size:      int64(len(manifest)),
+		Platform:  &platform,
+	}
+	index := v1.Index{
+		MediaType: v1.MediaTypeImageIndex,
+		Manifests: []v1.Descriptor{},
+	}
+	index.SchemaVersion = 2
+	for _, name := range names {
+		imageName, tag, err := ContainerdImageName(name)
+		if err != nil {
+			return err
+		}
+		d := desc
+		d.Annotations = map[string]string{AnnotationContainerdImageName: imageName}
+		if tag != "" {
+			d.Annotations[v1.AnnotationRefName] = tag
+		}
+		index.Manifests = append(index.Manifests, d)
+	}
+	if len(names) == 0 {
+		index.Manifests = append(index.Manifests, desc)
+	}
+
+	tw := tar.NewWriter(w)
+	layout, err := json.Marshal(v1.ImageLayout{Version: v1.ImageLayoutVersion})
+	if err != nil {
+		return err
+	}
+	if err := writeArchiveFile(tw, v1.ImageLayoutFile, layout); err != nil {
+		return err
+	}
+	if err := writeArchiveDir(tw, "blobs"); err != nil {
+		return err
+	}
+	dirs := make(map[string]bool)
+	for _, d := range append([]string{desc.Digest.String()}, layerDigests(image)...) {
+		algorithm := godigest.Digest(d).Algorithm().String()
+		if dirs[algorithm] {
+			continue
+		}
+		dirs[algorithm] = true
+		if err := writeArchiveDir(tw, "blobs/"+algorithm); err != nil {
+			return err
+		}
+	}
+	written := make(map[string]bool)
+	for _, layer := range image.Layers {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if written[layer.Digest] {
+			continue
+		}
+		written[layer.Digest] = true
+		if layer.Pinned && len(layer.URLs) == 0 {
+			return fmt.Errorf("The blob of the pinned layer %s can not be written to an OCI archive", layer.Digest)
+		}
+		if err := writeArchiveBlob(tw, layer); err != nil {
+			return err
+		}
+	}
+	for _, content := range [][]byte{config, manifest} {
+		if err := writeArchiveFile(tw, ctrArchiveBlobName(godigest.FromBytes(content)), content); err != nil {
+			return err
+		}
+	}
+	content, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	if err := writeArchiveFile(tw, "index.json", content); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func layerDigests(image types.Image) (digests []string) {
+	for _, layer := range image.Layers {
+		digests = append(digests, layer.Digest)
+	}
+	return digests
+}
+
+func ctrArchiveBlobName(digest godigest.Digest) string {
+	return "blobs/" + digest.Algorithm().String() + "/" + digest.Encoded()
+}
+
+// writeArchiveBlob writes the blob of the layer. If its size is not
+// known, the blob is first written to a temporary file.
+func writeArchiveBlob(tw *tar.Writer, layer types.Layer) error {
+	digest := godigest.Digest(layer.Digest)
+	rc, _, err := LayerGetBlob(layer)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	size := layer.Size
+	var r io.Reader = verifyBlob(rc, layer.Digest, digest, expectedSize(layer))
+	if size == 0 {
+		f, err := ioutil.TempFile("", "nix2container-blob-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		if size, err = io.Copy(f, r); err != nil {
+			return fmt.Errorf("Could not read the layer %s: %w", layer.Digest, err)
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		r = f
+	}
+	if err := tw.WriteHeader(archiveHeader(ctrArchiveBlobName(digest), tar.TypeReg, 0644, size)); err != nil {
+		return err
+	}
+	if _, err := io.Copy(tw, r); err != nil {
+		return fmt.Errorf("Could not read the layer %s: %w", layer.Digest, err)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package nix
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestWriteCtrArchive(t *testing.T) {
+	layers, err := NewLayers(context.Background(), []string{"../data/layer1"}, nil, nil, "", nil, types.PathOptions{}, CompressionGzip)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	image := types.Image{Layers: layers, Architecture: "arm64"}
+	var buf bytes.Buffer
+	if err := WriteCtrArchive(context.Background(), image, &buf, []string{"registry.example.com/app:v1", "registry.example.com/app:latest"}, "v8"); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	files := make(map[string][]byte)
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		files[hdr.Name] = content
+	}
+	var index v1.Index
+	if err := json.Unmarshal(files["index.json"], &index); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(index.Manifests) != 2 {
+		t.Fatalf("The index should have 2 manifests (while it is %#v)", index.Manifests)
+	}
+	for i, tag := range []string{"v1", "latest"} {
+		desc := index.Manifests[i]
+		if name := desc.Annotations[AnnotationContainerdImageName]; name != "registry.example.com/app:"+tag {
+			t.Fatalf("The image name should be 'registry.example.com/app:%s' (while it is %s)", tag, name)
+		}
+		if desc.Annotations[v1.AnnotationRefName] != tag {
+			t.Fatalf("The reference name should be '%s' (while it is %s)", tag, desc.Annotations[v1.AnnotationRefName])
+		}
+		if desc.Platform == nil || desc.Platform.OS != "linux" || desc.Platform.Architecture != "arm64" || desc.Platform.Variant != "v8" {
+			t.Fatalf("The platform should be linux/arm64/v8 (while it is %#v)", desc.Platform)
+		}
+	}
+	manifest, ok := files[ctrArchiveBlobName(index.Manifests[0].Digest)]
+	if !ok {
+		t.Fatalf("The archive should contain the manifest %s", index.Manifests[0].Digest)
+	}
+	var m v1.Manifest
+	if err := json.Unmarshal(manifest, &m); err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, desc := range append(m.Layers, m.Config) {
+		blob, ok := files[ctrArchiveBlobName(desc.Digest)]
+		if !ok || godigest.FromBytes(blob) != desc.Digest {
+			t.Fatalf("The archive should contain the blob %s", desc.Digest)
+		}
+	}
+	if _, ok := files[v1.ImageLayoutFile]; !ok {
+		t.Fatalf("The archive should contain the %s file", v1.ImageLayoutFile)
+	}
+}
@@ -0,0 +1,159 @@
+package nix
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/containers/image/v5/docker"
+	imageTypes "github.com/containers/image/v5/types"
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// LayerDiff tells whether a layer of an image is already part of the
+// remote image.
+type LayerDiff struct {
+	Digest  string
+	Size    int64
+	Present bool
+}
+
+// ImageDiff is the difference between an image and a remote image.
+type ImageDiff struct {
+	Layers []LayerDiff
+	// Whether the remote image has the same config
+	ConfigPresent bool
+	// The size of the blobs (layers and config) which are not part
+	// of the remote image
+	UploadSize int64
+}
+
+// NewLayers returns the number of layers which are not part of the
+// remote image.
+func (d ImageDiff) NewLayers() (n int) {
+	for _, layer := range d.Layers {
+		if !layer.Present {
+			n++
+		}
+	}
+	return n
+}
+
+// remoteManifest is either an image manifest or an index, which can
+// be OCI or Docker ones.
+type remoteManifest struct {
+	Config    v1.Descriptor   `json:"config"`
+	Layers    []v1.Descriptor `json:"layers"`
+	Manifests []v1.Descriptor `json:"manifests"`
+}
+
+// DiffImage compares the blobs of the image to the blobs of the remote
+// image manifest. Blobs of the remote image don't need to be uploaded.
+func DiffImage(image types.Image, remote v1.Manifest) (diff ImageDiff, err error) {
+	remoteBlobs := make(map[string]bool)
+	for _, layer := range remote.Layers {
+		remoteBlobs[layer.Digest.String()] = true
+	}
+	for _, layer := range image.Layers {
+		present := remoteBlobs[layer.Digest]
+		diff.Layers = append(diff.Layers, LayerDiff{
+			Digest:  layer.Digest,
+			Size:    layer.Size,
+			Present: present,
+		})
+		if !present {
+			diff.UploadSize += layer.Size
+		}
+	}
+	configDigest, configSize, err := GetConfigDigest(image)
+	if err != nil {
+		return diff, err
+	}
+	diff.ConfigPresent = remote.Config.Digest == configDigest
+	if !diff.ConfigPresent {
+		diff.UploadSize += configSize
+	}
+	return diff, nil
+}
+
+// GetRemoteManifest reads the manifest of a registry image (such as
+// docker://registry/app:prod). If the image is multi-platform, the
+// manifest of the platform of image is returned.
+func GetRemoteManifest(ctx context.Context, sys *imageTypes.SystemContext, image types.Image, destination string) (manifest v1.Manifest, err error) {
+	src, manifest, _, err := openRemoteImage(ctx, sys, image, destination)
+	if err != nil {
+		return manifest, err
+	}
+	src.Close()
+	return manifest, nil
+}
+
+// openRemoteImage opens the registry image destination and returns
+// its manifest (the one of the platform of image if it is
+// multi-platform) with its digest. The image source has to be closed.
+func openRemoteImage(ctx context.Context, sys *imageTypes.SystemContext, image types.Image, destination string) (src imageTypes.ImageSource, manifest v1.Manifest, digest godigest.Digest, err error) {
+	if !strings.HasPrefix(destination, "docker://") {
+		return nil, manifest, digest, fmt.Errorf("Only docker:// images can be compared (while it is %s)", destination)
+	}
+	ref, err := docker.ParseReference(strings.TrimPrefix(destination, "docker:"))
+	if err != nil {
+		return nil, manifest, digest, err
+	}
+	src, err = ref.NewImageSource(ctx, sys)
+	if errors.As(err, &docker.ErrUnauthorizedForCredentials{}) {
+		return nil, manifest, digest, classErrorf(ErrAuth, "Could not read the manifest of %s: %w", destination, err)
+	}
+	if err != nil {
+		return nil, manifest, digest, err
+	}
+	manifest, digest, err = getRemoteManifest(ctx, src, image, destination)
+	if err != nil {
+		src.Close()
+		return nil, manifest, digest, err
+	}
+	return src, manifest, digest, nil
+}
+
+func getRemoteManifest(ctx context.Context, src imageTypes.ImageSource, image types.Image, destination string) (manifest v1.Manifest, digest godigest.Digest, err error) {
+	blob, _, err := src.GetManifest(ctx, nil)
+	if errors.As(err, &docker.ErrUnauthorizedForCredentials{}) {
+		return manifest, digest, classErrorf(ErrAuth, "Could not read the manifest of %s: %w", destination, err)
+	}
+	if err != nil {
+		return manifest, digest, err
+	}
+	var m remoteManifest
+	if err := json.Unmarshal(blob, &m); err != nil {
+		return manifest, digest, fmt.Errorf("Could not parse the manifest of %s: %w", destination, err)
+	}
+	if len(m.Manifests) > 0 {
+		desc, err := selectPlatformManifest(m.Manifests, ImageOS(image), ImageArchitecture(image))
+		if err != nil {
+			return manifest, digest, fmt.Errorf("%s: %w", destination, err)
+		}
+		blob, _, err = src.GetManifest(ctx, &desc.Digest)
+		if err != nil {
+			return manifest, digest, err
+		}
+		m = remoteManifest{}
+		if err := json.Unmarshal(blob, &m); err != nil {
+			return manifest, digest, fmt.Errorf("Could not parse the manifest of %s: %w", destination, err)
+		}
+	}
+	manifest.Config = m.Config
+	manifest.Layers = m.Layers
+	return manifest, godigest.FromBytes(blob), nil
+}
+
+func selectPlatformManifest(manifests []v1.Descriptor, os, architecture string) (v1.Descriptor, error) {
+	for _, desc := range manifests {
+		if desc.Platform != nil && desc.Platform.OS == os && desc.Platform.Architecture == architecture {
+			return desc, nil
+		}
+	}
+	return v1.Descriptor{}, fmt.Errorf("The index doesn't contain an image for the platform %s/%s", os, architecture)
+}
@@ -0,0 +1,63 @@
+package nix
+
+import (
+	"testing"
+
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestDiffImage(t *testing.T) {
+	image := types.Image{
+		Layers: []types.Layer{
+			{Digest: "sha256:0000000000000000000000000000000000000000000000000000000000000001", DiffIDs: "sha256:0000000000000000000000000000000000000000000000000000000000000001", Size: 100},
+			{Digest: "sha256:0000000000000000000000000000000000000000000000000000000000000002", DiffIDs: "sha256:0000000000000000000000000000000000000000000000000000000000000002", Size: 200},
+		},
+	}
+	configDigest, configSize, err := GetConfigDigest(image)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	remote := v1.Manifest{
+		Config: v1.Descriptor{Digest: configDigest},
+		Layers: []v1.Descriptor{
+			{Digest: godigest.Digest("sha256:0000000000000000000000000000000000000000000000000000000000000001")},
+		},
+	}
+	diff, err := DiffImage(image, remote)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !diff.Layers[0].Present || diff.Layers[1].Present || diff.NewLayers() != 1 {
+		t.Fatalf("Only the second layer should be new (while layers are %#v)", diff.Layers)
+	}
+	if !diff.ConfigPresent || diff.UploadSize != 200 {
+		t.Fatalf("The upload size should be '%#v' (while it is %#v)", 200, diff.UploadSize)
+	}
+
+	diff, err = DiffImage(image, v1.Manifest{})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if diff.NewLayers() != 2 || diff.UploadSize != 300+configSize {
+		t.Fatalf("The upload size should be '%#v' (while it is %#v)", 300+configSize, diff.UploadSize)
+	}
+}
+
+func TestSelectPlatformManifest(t *testing.T) {
+	manifests := []v1.Descriptor{
+		{Digest: "sha256:amd64", Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}},
+		{Digest: "sha256:arm64", Platform: &v1.Platform{OS: "linux", Architecture: "arm64"}},
+	}
+	desc, err := selectPlatformManifest(manifests, "linux", "arm64")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if desc.Digest != "sha256:arm64" {
+		t.Fatalf("The digest should be '%#v' (while it is %#v)", "sha256:arm64", desc.Digest)
+	}
+	if _, err := selectPlatformManifest(manifests, "linux", "riscv64"); err == nil {
+		t.Fatalf("Selecting a missing platform should fail")
+	}
+}
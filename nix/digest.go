@@ -0,0 +1,26 @@
+package nix
+
+import (
+	"fmt"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// digestAlgorithm is the algorithm of the digests and diff IDs of the
+// layers built by nix2container.
+var digestAlgorithm = digest.Canonical
+
+// SetDigestAlgorithm sets the algorithm of the digests and diff IDs of
+// the layers built from store paths and files: sha256 (the default)
+// or sha512, which are the algorithms allowed by the OCI image
+// specification. Config and manifest digests are always sha256
+// digests since registries identify manifests by their sha256 digest.
+func SetDigestAlgorithm(algorithm string) error {
+	switch a := digest.Algorithm(algorithm); a {
+	case digest.SHA256, digest.SHA512:
+		digestAlgorithm = a
+		return nil
+	default:
+		return fmt.Errorf("Unsupported digest algorithm %q (it must be sha256 or sha512)", algorithm)
+	}
+}
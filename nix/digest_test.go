@@ -0,0 +1,44 @@
+package nix
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/nlewo/nix2container/types"
+	digest "github.com/opencontainers/go-digest"
+)
+
+func TestSetDigestAlgorithm(t *testing.T) {
+	if err := SetDigestAlgorithm("sha512"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer SetDigestAlgorithm("sha256")
+
+	paths := []string{
+		"../data/layer1/file1",
+	}
+	layers, err := NewLayers(context.Background(), paths, []types.Layer{}, []types.RewritePath{}, "", []types.PermPath{}, types.PathOptions{}, CompressionNone)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !strings.HasPrefix(layers[0].Digest, "sha512:") || !strings.HasPrefix(layers[0].DiffIDs, "sha512:") {
+		t.Fatalf("The layer digests should be sha512 digests (while they are %s and %s)", layers[0].Digest, layers[0].DiffIDs)
+	}
+	reader, _, err := LayerGetBlob(layers[0])
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer reader.Close()
+	d, err := digest.SHA512.FromReader(reader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if d.String() != layers[0].Digest {
+		t.Fatalf("The blob digest should be %s (while it is %s)", layers[0].Digest, d)
+	}
+
+	if err := SetDigestAlgorithm("blake3"); err == nil {
+		t.Fatalf("blake3 should not be supported")
+	}
+}
@@ -0,0 +1,239 @@
+package nix
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+)
+
+// dockerArchiveManifest is an entry of the manifest.json file of a
+// docker-archive.
+type dockerArchiveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// ChainIDs returns the chain IDs of the layers whose diff IDs are
+// diffIDs: the chain ID of a layer identifies the layer and all the
+// layers below it.
+func ChainIDs(diffIDs []godigest.Digest) []godigest.Digest {
+	chainIDs := make([]godigest.Digest, len(diffIDs))
+	for i, diffID := range diffIDs {
+		if i == 0 {
+			chainIDs[i] = diffID
+			continue
+		}
+		chainIDs[i] = godigest.FromString(chainIDs[i-1].String() + " " + diffID.String())
+	}
+	return chainIDs
+}
+
+// NormalizeRepoTag adds the latest tag to a reference without tag, as
+// Docker does.
+func NormalizeRepoTag(repoTag string) string {
+	if strings.Contains(repoTag[strings.LastIndex(repoTag, "/")+1:], ":") {
+		return repoTag
+	}
+	return repoTag + ":latest"
+}
+
+// legacyLayerConfigs returns the V1 IDs and the legacy JSON
+// configurations of the layers of the image. As Docker does, the V1 ID
+// of a layer is the digest of its configuration containing its chain
+// ID and the V1 ID of its parent. The configuration of the top layer
+// is the image configuration.
+func legacyLayerConfigs(config []byte) (ids []string, configs [][]byte, err error) {
+	var image map[string]interface{}
+	if err := json.Unmarshal(config, &image); err != nil {
+		return nil, nil, err
+	}
+	var rootfs struct {
+		RootFS struct {
+			DiffIDs []godigest.Digest `json:"diff_ids"`
+		} `json:"rootfs"`
+	}
+	if err := json.Unmarshal(config, &rootfs); err != nil {
+		return nil, nil, err
+	}
+	chainIDs := ChainIDs(rootfs.RootFS.DiffIDs)
+	parent := ""
+	for i, chainID := range chainIDs {
+		legacy := map[string]interface{}{
+			"created": "1970-01-01T00:00:00Z",
+		}
+		for _, key := range []string{"created", "os", "architecture"} {
+			if value, ok := image[key]; ok {
+				legacy[key] = value
+			}
+		}
+		if i == len(chainIDs)-1 {
+			for key, value := range image {
+				if key != "rootfs" && key != "history" {
+					legacy[key] = value
+				}
+			}
+		}
+		if parent != "" {
+			legacy["parent"] = parent
+		}
+		legacy["layer_id"] = chainID.String()
+		content, err := json.Marshal(legacy)
+		if err != nil {
+			return nil, nil, err
+		}
+		id := godigest.FromBytes(content).Encoded()
+		delete(legacy, "layer_id")
+		legacy["id"] = id
+		content, err = json.Marshal(legacy)
+		if err != nil {
+			return nil, nil, err
+		}
+		ids = append(ids, id)
+		configs = append(configs, content)
+		parent = id
+	}
+	return ids, configs, nil
+}
+
+// WriteDockerArchive writes the image as a docker-archive (the format
+// of "docker save") to w, tagged with repoTags. In addition to the
+// manifest.json file, the archive contains the legacy V1 layer
+// directories and the repositories file, so that old Docker daemons
+// and tools parsing the archive can load it. Layers are stored
+// uncompressed.
+func WriteDockerArchive(ctx context.Context, image types.Image, w io.Writer, repoTags []string) error {
+	config, err := GetConfigBlob(image)
+	if err != nil {
+		return err
+	}
+	ids, legacyConfigs, err := legacyLayerConfigs(config)
+	if err != nil {
+		return err
+	}
+	if len(ids) != len(image.Layers) {
+		return fmt.Errorf("The image has %d layers while its config has %d diff IDs", len(image.Layers), len(ids))
+	}
+	tw := tar.NewWriter(w)
+	configName := godigest.FromBytes(config).Encoded() + ".json"
+	if err := writeArchiveFile(tw, configName, config); err != nil {
+		return err
+	}
+	manifest := dockerArchiveManifest{
+		Config:   configName,
+		RepoTags: []string{},
+		Layers:   []string{},
+	}
+	for i, layer := range image.Layers {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if IsEncryptedMediaType(layer.MediaType) {
+			return fmt.Errorf("The encrypted layer %s can not be written to a docker-archive", layer.Digest)
+		}
+		if err := writeArchiveDir(tw, ids[i]); err != nil {
+			return err
+		}
+		if err := writeArchiveFile(tw, ids[i]+"/VERSION", []byte("1.0")); err != nil {
+			return err
+		}
+		if err := writeArchiveFile(tw, ids[i]+"/json", legacyConfigs[i]); err != nil {
+			return err
+		}
+		if err := writeArchiveLayer(tw, ids[i]+"/layer.tar", layer); err != nil {
+			return err
+		}
+		manifest.Layers = append(manifest.Layers, ids[i]+"/layer.tar")
+	}
+	repositories := make(map[string]map[string]string)
+	for _, repoTag := range repoTags {
+		repoTag = NormalizeRepoTag(repoTag)
+		manifest.RepoTags = append(manifest.RepoTags, repoTag)
+		i := strings.LastIndex(repoTag, ":")
+		if repositories[repoTag[:i]] == nil {
+			repositories[repoTag[:i]] = make(map[string]string)
+		}
+		if len(ids) > 0 {
+			repositories[repoTag[:i]][repoTag[i+1:]] = ids[len(ids)-1]
+		}
+	}
+	content, err := json.Marshal([]dockerArchiveManifest{manifest})
+	if err != nil {
+		return err
+	}
+	if err := writeArchiveFile(tw, "manifest.json", content); err != nil {
+		return err
+	}
+	if len(repositories) > 0 {
+		content, err = json.Marshal(repositories)
+		if err != nil {
+			return err
+		}
+		if err := writeArchiveFile(tw, "repositories", content); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func archiveHeader(name string, typeflag byte, mode int64, size int64) *tar.Header {
+	return &tar.Header{
+		Typeflag: typeflag,
+		Name:     name,
+		Mode:     mode,
+		Size:     size,
+		Uname:    "root",
+		Gname:    "root",
+		ModTime:  time.Date(1970, 01, 01, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+func writeArchiveDir(tw *tar.Writer, name string) error {
+	return tw.WriteHeader(archiveHeader(name+"/", tar.TypeDir, 0755, 0))
+}
+
+func writeArchiveFile(tw *tar.Writer, name string, content []byte) error {
+	if err := tw.WriteHeader(archiveHeader(name, tar.TypeReg, 0644, int64(len(content)))); err != nil {
+		return err
+	}
+	_, err := tw.Write(content)
+	return err
+}
+
+// writeArchiveLayer writes the uncompressed archive of the layer. Since
+// its size has to be known to write the entry header, the archive is
+// first written to a temporary file.
+func writeArchiveLayer(tw *tar.Writer, name string, layer types.Layer) error {
+	r, err := uncompressedLayerReader(layer)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := ioutil.TempFile("", "nix2container-layer-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	size, err := io.Copy(f, r)
+	if err != nil {
+		return fmt.Errorf("Could not read the layer %s: %w", layer.Digest, err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(archiveHeader(name, tar.TypeReg, 0644, size)); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
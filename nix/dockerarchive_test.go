@@ -0,0 +1,105 @@
+package nix
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+)
+
+func TestChainIDs(t *testing.T) {
+	a := godigest.FromString("a")
+	b := godigest.FromString("b")
+	chainIDs := ChainIDs([]godigest.Digest{a, b})
+	expected := godigest.FromString(a.String() + " " + b.String())
+	if chainIDs[0] != a || chainIDs[1] != expected {
+		t.Fatalf("The chain IDs should be '%#v' (while they are %#v)", []godigest.Digest{a, expected}, chainIDs)
+	}
+}
+
+func TestNormalizeRepoTag(t *testing.T) {
+	for repoTag, expected := range map[string]string{
+		"app":                     "app:latest",
+		"app:v1":                  "app:v1",
+		"localhost:5000/app":      "localhost:5000/app:latest",
+		"localhost:5000/app:v1.2": "localhost:5000/app:v1.2",
+	} {
+		if actual := NormalizeRepoTag(repoTag); actual != expected {
+			t.Fatalf("The repo tag should be '%#v' (while it is %#v)", expected, actual)
+		}
+	}
+}
+
+func TestWriteDockerArchive(t *testing.T) {
+	var layers []types.Layer
+	for _, path := range []string{"../data/layer1", "../data/tar-directory"} {
+		l, err := NewLayers(context.Background(), []string{path}, nil, nil, "", nil, types.PathOptions{}, CompressionNone)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		layers = append(layers, l...)
+	}
+	image := types.Image{Layers: layers}
+	var buf bytes.Buffer
+	if err := WriteDockerArchive(context.Background(), image, &buf, []string{"app"}); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	files := make(map[string][]byte)
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		files[hdr.Name] = content
+	}
+
+	var manifest []dockerArchiveManifest
+	if err := json.Unmarshal(files["manifest.json"], &manifest); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(manifest) != 1 || len(manifest[0].RepoTags) != 1 || manifest[0].RepoTags[0] != "app:latest" {
+		t.Fatalf("The RepoTags should be '%#v' (while the manifest is %#v)", []string{"app:latest"}, manifest)
+	}
+	if len(manifest[0].Layers) != 2 {
+		t.Fatalf("The manifest should have 2 layers (while it is %#v)", manifest[0].Layers)
+	}
+	for i, name := range manifest[0].Layers {
+		if actual := godigest.FromBytes(files[name]).String(); actual != layers[i].DiffIDs {
+			t.Fatalf("The digest of %s should be '%#v' (while it is %#v)", name, layers[i].DiffIDs, actual)
+		}
+	}
+
+	var top struct {
+		ID     string `json:"id"`
+		Parent string `json:"parent"`
+	}
+	topID := manifest[0].Layers[1][:64]
+	if err := json.Unmarshal(files[topID+"/json"], &top); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if top.ID != topID || top.Parent != manifest[0].Layers[0][:64] {
+		t.Fatalf("The top layer should have the ID %s and the parent %s (while it is %#v)", topID, manifest[0].Layers[0][:64], top)
+	}
+	var repositories map[string]map[string]string
+	if err := json.Unmarshal(files["repositories"], &repositories); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if repositories["app"]["latest"] != topID {
+		t.Fatalf("The repositories should point to '%#v' (while it is %#v)", topID, repositories)
+	}
+}
@@ -0,0 +1,93 @@
+package nix
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/containers/ocicrypt"
+	"github.com/containers/ocicrypt/helpers"
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+)
+
+// MediaTypeEncryptedSuffix is appended to the media type of
+// encrypted layers.
+const MediaTypeEncryptedSuffix = "+encrypted"
+
+// IsEncryptedMediaType returns true if the media type is the media
+// type of an encrypted layer.
+func IsEncryptedMediaType(mediaType string) bool {
+	return strings.HasSuffix(mediaType, MediaTypeEncryptedSuffix)
+}
+
+// EncryptLayer encrypts the layer blob for the recipients (such as
+// "jwe:public.pem", "pgp:user@example.com" or "pkcs7:cert.pem") and
+// writes the encrypted blob to filename. Since the encryption is not
+// reproducible, the returned layer is read from this file: its
+// digest doesn't depend on its paths anymore. The keys needed to
+// decrypt the layer are described by the layer annotations. The
+// digest of the encrypted blob is computed with the algorithm of the
+// settings of ctx.
+func EncryptLayer(ctx context.Context, layer types.Layer, recipients []string, filename string) (encrypted types.Layer, err error) {
+	if IsEncryptedMediaType(layer.MediaType) {
+		return encrypted, errors.New("The layer is already encrypted")
+	}
+	cc, err := helpers.CreateCryptoConfig(recipients, nil)
+	if err != nil {
+		return encrypted, err
+	}
+	rc, _, err := LayerGetBlobContext(ctx, layer)
+	if err != nil {
+		return encrypted, err
+	}
+	defer rc.Close()
+	desc := v1.Descriptor{
+		MediaType:   layer.MediaType,
+		Digest:      godigest.Digest(layer.Digest),
+		Size:        layer.Size,
+		Annotations: layer.Annotations,
+	}
+	reader, finalizer, err := ocicrypt.EncryptLayer(cc.EncryptConfig, rc, desc)
+	if err != nil {
+		return encrypted, err
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return encrypted, err
+	}
+	digester := archiveSettingsFrom(ctx).algorithm.Digester()
+	size, err := io.Copy(io.MultiWriter(f, digester.Hash()), reader)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(filename)
+		return encrypted, err
+	}
+	annotations, err := finalizer()
+	if err != nil {
+		os.Remove(filename)
+		return encrypted, err
+	}
+
+	encrypted = layer
+	encrypted.Digest = digester.Digest().String()
+	encrypted.Size = size
+	encrypted.MediaType = layer.MediaType + MediaTypeEncryptedSuffix
+	encrypted.LayerPath = filename
+	encrypted.Annotations = make(map[string]string)
+	for k, v := range layer.Annotations {
+		encrypted.Annotations[k] = v
+	}
+	for k, v := range annotations {
+		encrypted.Annotations[k] = v
+	}
+	logrus.Infof("Encrypting the layer %s for %d recipients (size:%d digest:%s)", layer.Digest, len(recipients), size, encrypted.Digest)
+	return encrypted, nil
+}
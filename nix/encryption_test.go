@@ -0,0 +1,68 @@
+package nix
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+)
+
+func TestEncryptLayer(t *testing.T) {
+	tmpDir := t.TempDir()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	publicKey := tmpDir + "/public.pem"
+	err = ioutil.WriteFile(publicKey, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	paths := []string{
+		"../data/layer1/file1",
+	}
+	layers, err := NewLayers(context.Background(), paths, []types.Layer{}, []types.RewritePath{}, "", []types.PermPath{}, types.PathOptions{}, CompressionNone)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	encrypted, err := EncryptLayer(context.Background(), layers[0], []string{"jwe:" + publicKey}, tmpDir+"/layer.enc")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if encrypted.MediaType != "application/vnd.oci.image.layer.v1.tar+encrypted" {
+		t.Fatalf("MediaType should be encrypted (while it is %#v)", encrypted.MediaType)
+	}
+	if encrypted.DiffIDs != layers[0].DiffIDs {
+		t.Fatalf("DiffIDs should be '%#v' (while it is %#v)", layers[0].DiffIDs, encrypted.DiffIDs)
+	}
+	if _, ok := encrypted.Annotations["org.opencontainers.image.enc.keys.jwe"]; !ok {
+		t.Fatalf("Annotations should contain the JWE keys (while they are %#v)", encrypted.Annotations)
+	}
+	f, err := os.Open(encrypted.LayerPath)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer f.Close()
+	d, err := godigest.FromReader(f)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if d.String() != encrypted.Digest {
+		t.Fatalf("Digest should be '%#v' (while it is %#v)", d.String(), encrypted.Digest)
+	}
+	if err := encrypted.Validate(); err != nil {
+		t.Fatalf("%v", err)
+	}
+}
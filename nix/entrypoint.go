@@ -0,0 +1,217 @@
+package nix
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/nlewo/nix2container/types"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultPath is the PATH used by container runtimes when the image
+// configuration doesn't set it.
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// imageEntry is a file of the filesystem of an image.
+type imageEntry struct {
+	typeflag byte
+	mode     int64
+	linkname string
+	// The index of the layer providing the file
+	layer int
+}
+
+// imageFiles returns the files of the image, as seen by a container:
+// upper layers override files of lower layers and whiteouts are
+// applied. The names are relative clean paths. Layers which can not
+// be read (pinned and encrypted layers) are skipped and reported by
+// complete.
+func imageFiles(ctx context.Context, image types.Image) (files map[string]imageEntry, complete bool, err error) {
+	files = make(map[string]imageEntry)
+	complete = true
+	for i, layer := range image.Layers {
+		if layer.Pinned || IsEncryptedMediaType(layer.MediaType) {
+			complete = false
+			continue
+		}
+		entries := make(map[string]imageEntry)
+		var deletes, opaques []string
+		err := forEachLayerEntry(ctx, layer, func(hdr *tar.Header, r io.Reader) error {
+			dir, base := path.Dir(hdr.Name), path.Base(hdr.Name)
+			switch {
+			case base == whiteoutOpaque:
+				opaques = append(opaques, dir)
+			case strings.HasPrefix(base, whiteoutPrefix):
+				deletes = append(deletes, path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)))
+			default:
+				typeflag := hdr.Typeflag
+				if typeflag == tar.TypeRegA {
+					typeflag = tar.TypeReg
+				}
+				entries[hdr.Name] = imageEntry{typeflag: typeflag, mode: hdr.Mode, linkname: hdr.Linkname, layer: i}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, false, err
+		}
+		// Whiteouts only apply to lower layers
+		for name := range files {
+			for _, d := range deletes {
+				if name == d || strings.HasPrefix(name, d+"/") {
+					delete(files, name)
+				}
+			}
+			for _, o := range opaques {
+				if strings.HasPrefix(name, o+"/") || o == "." {
+					delete(files, name)
+				}
+			}
+		}
+		for name, entry := range entries {
+			files[name] = entry
+		}
+	}
+	return files, complete, nil
+}
+
+// resolveImagePath follows the symlinks of the absolute path p in
+// the image files. It returns the resolved path (the target of hard
+// links) and false if it doesn't exist. Directories which are not in the archives, such as
+// the parent directories of store paths, are implicit.
+func resolveImagePath(files map[string]imageEntry, p string) (string, imageEntry, bool) {
+	components := strings.Split(p, "/")
+	resolved := ""
+	hops := 0
+	for len(components) > 0 {
+		c := components[0]
+		components = components[1:]
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			resolved = normalizeEntryName(path.Dir(resolved))
+			continue
+		}
+		candidate := path.Join(resolved, c)
+		entry, ok := files[candidate]
+		if ok && entry.typeflag == tar.TypeSymlink {
+			hops++
+			if hops > maxSymlinks {
+				return candidate, entry, false
+			}
+			if path.IsAbs(entry.linkname) {
+				resolved = ""
+			}
+			components = append(strings.Split(entry.linkname, "/"), components...)
+			continue
+		}
+		if !ok && len(components) == 0 {
+			return candidate, entry, false
+		}
+		resolved = candidate
+	}
+	entry, ok := files[resolved]
+	if ok && entry.typeflag == tar.TypeLink {
+		resolved = entry.linkname
+		entry, ok = files[resolved]
+	}
+	return "/" + resolved, entry, ok
+}
+
+// entrypointExecutable returns the executable run by a container of
+// the image: the first element of the Entrypoint or, if it is not
+// set, of the Cmd. It is empty if neither is set.
+func entrypointExecutable(image types.Image) string {
+	if len(image.ImageConfig.Entrypoint) > 0 {
+		return image.ImageConfig.Entrypoint[0]
+	}
+	if len(image.ImageConfig.Cmd) > 0 {
+		return image.ImageConfig.Cmd[0]
+	}
+	return ""
+}
+
+// imagePath returns the PATH of the image configuration.
+func imagePath(image types.Image) string {
+	p := defaultPath
+	for _, env := range image.ImageConfig.Env {
+		if strings.HasPrefix(env, "PATH=") {
+			p = strings.TrimPrefix(env, "PATH=")
+		}
+	}
+	return p
+}
+
+// lookupExecutable finds the executable in the image files, as a
+// container runtime does: executables without a slash are searched
+// in the PATH of the image configuration, relative ones in its
+// WorkingDir. It also returns the paths which have been tried.
+func lookupExecutable(files map[string]imageEntry, image types.Image, executable string) (resolved string, entry imageEntry, candidates []string, ok bool) {
+	switch {
+	case path.IsAbs(executable):
+		candidates = []string{executable}
+	case strings.Contains(executable, "/"):
+		workingDir := image.ImageConfig.WorkingDir
+		if workingDir == "" {
+			workingDir = "/"
+		}
+		candidates = []string{path.Join(workingDir, executable)}
+	default:
+		for _, dir := range strings.Split(imagePath(image), ":") {
+			if path.IsAbs(dir) {
+				candidates = append(candidates, path.Join(dir, executable))
+			}
+		}
+	}
+	for _, candidate := range candidates {
+		resolved, entry, ok = resolveImagePath(files, candidate)
+		if ok {
+			return resolved, entry, candidates, true
+		}
+	}
+	return "", entry, candidates, false
+}
+
+// CheckEntrypoint checks the executable of the Entrypoint (or of the
+// Cmd if there is no Entrypoint) exists in the image layers and is
+// executable, so that images which would crash at runtime are not
+// built. Executables without a slash are searched in the PATH of the
+// image configuration, relative ones in its WorkingDir. When some
+// layers can not be read, such as pinned layers, a missing executable
+// is only reported as a warning.
+func CheckEntrypoint(ctx context.Context, image types.Image) error {
+	executable := entrypointExecutable(image)
+	if executable == "" {
+		return nil
+	}
+	files, complete, err := imageFiles(ctx, image)
+	if err != nil {
+		return err
+	}
+	resolved, entry, candidates, ok := lookupExecutable(files, image, executable)
+	if ok {
+		if entry.typeflag != tar.TypeReg {
+			return fmt.Errorf("The entrypoint %s of the image is not a regular file (%s)", executable, resolved)
+		}
+		if entry.mode&0111 == 0 {
+			return fmt.Errorf("The entrypoint %s of the image is not executable (%s has the mode %04o)", executable, resolved, entry.mode&07777)
+		}
+		return nil
+	}
+	var missing error
+	if !strings.Contains(executable, "/") {
+		missing = fmt.Errorf("The entrypoint %s of the image is not found in the PATH %s of the image", executable, imagePath(image))
+	} else {
+		missing = fmt.Errorf("The entrypoint %s of the image doesn't exist in the image layers", candidates[0])
+	}
+	if !complete {
+		logrus.Warnf("%s (some layers can not be read, such as pinned or encrypted layers)", missing)
+		return nil
+	}
+	return missing
+}
@@ -0,0 +1,77 @@
+package nix
+
+import (
+	"archive/tar"
+	"context"
+	"testing"
+
+	"github.com/nlewo/nix2container/types"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestCheckEntrypoint(t *testing.T) {
+	image := types.Image{
+		Layers: []types.Layer{
+			types.Layer{
+				Digest:    "sha256:files",
+				MediaType: "application/vnd.oci.image.layer.v1.tar",
+				Files: []types.File{
+					types.File{Path: "/bin/app", Content: "#!/bin/sh\n", Mode: "0755"},
+					types.File{Path: "/etc/app.conf", Content: "", Mode: "0644"},
+				},
+			},
+		},
+	}
+	testCases := []struct {
+		config v1.ImageConfig
+		valid  bool
+	}{
+		{v1.ImageConfig{}, true},
+		{v1.ImageConfig{Entrypoint: []string{"/bin/app"}}, true},
+		{v1.ImageConfig{Cmd: []string{"/bin/app", "--help"}}, true},
+		{v1.ImageConfig{Entrypoint: []string{"app"}}, true},
+		{v1.ImageConfig{Entrypoint: []string{"app"}, Env: []string{"PATH=/usr/bin"}}, false},
+		{v1.ImageConfig{Entrypoint: []string{"./app"}, WorkingDir: "/bin"}, true},
+		{v1.ImageConfig{Entrypoint: []string{"/bin/missing"}, Cmd: []string{"/bin/app"}}, false},
+		{v1.ImageConfig{Entrypoint: []string{"/etc/app.conf"}}, false},
+		{v1.ImageConfig{Entrypoint: []string{"/etc"}}, false},
+	}
+	for _, testCase := range testCases {
+		image.ImageConfig = testCase.config
+		err := CheckEntrypoint(context.Background(), image)
+		if testCase.valid && err != nil {
+			t.Fatalf("The entrypoint of %#v should be valid (while it is %v)", testCase.config, err)
+		}
+		if !testCase.valid && err == nil {
+			t.Fatalf("The entrypoint of %#v should not be valid", testCase.config)
+		}
+	}
+
+	// A missing entrypoint can be in a pinned layer
+	image.ImageConfig = v1.ImageConfig{Entrypoint: []string{"/bin/missing"}}
+	image.Layers = append(image.Layers, types.Layer{Digest: "sha256:pinned", Pinned: true})
+	if err := CheckEntrypoint(context.Background(), image); err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestResolveImagePath(t *testing.T) {
+	files := map[string]imageEntry{
+		"nix/store/hash-app/bin/app": imageEntry{typeflag: tar.TypeReg, mode: 0755},
+		"bin":                        imageEntry{typeflag: tar.TypeSymlink, linkname: "/nix/store/hash-app/bin"},
+		"usr/bin/app":                imageEntry{typeflag: tar.TypeSymlink, linkname: "../../bin/app"},
+		"usr/bin/hard":               imageEntry{typeflag: tar.TypeLink, linkname: "nix/store/hash-app/bin/app"},
+		"loop":                       imageEntry{typeflag: tar.TypeSymlink, linkname: "/loop"},
+	}
+	for _, p := range []string{"/bin/app", "/usr/bin/app", "/usr/bin/hard", "/nix/store/hash-app/bin/../bin/app"} {
+		resolved, entry, ok := resolveImagePath(files, p)
+		if !ok || entry.typeflag != tar.TypeReg {
+			t.Fatalf("%s should be resolved to a file (while it is %s %#v)", p, resolved, entry)
+		}
+	}
+	for _, p := range []string{"/bin/missing", "/loop", "/usr/lib/app"} {
+		if _, _, ok := resolveImagePath(files, p); ok {
+			t.Fatalf("%s should not be resolved", p)
+		}
+	}
+}
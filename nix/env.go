@@ -0,0 +1,40 @@
+package nix
+
+import "sync"
+
+var configureFromEnv struct {
+	once sync.Once
+	err  error
+}
+
+// ConfigureFromEnv applies the settings of the environment variables:
+// the upload limits, the HTTP options and the walk concurrency. It is
+// called by the commands, whose flags then override these settings,
+// and by the nix transport, which runs in tools such as Skopeo. The
+// settings are only applied by the first call, so that the transport
+// doesn't override the flags of the commands.
+func ConfigureFromEnv() error {
+	configureFromEnv.once.Do(func() {
+		configureFromEnv.err = applyEnv()
+	})
+	return configureFromEnv.err
+}
+
+func applyEnv() error {
+	rate, parallel, err := UploadLimitsFromEnv()
+	if err != nil {
+		return err
+	}
+	httpOptions, err := HTTPOptionsFromEnv()
+	if err != nil {
+		return err
+	}
+	walkConcurrency, err := WalkConcurrencyFromEnv()
+	if err != nil {
+		return err
+	}
+	SetUploadLimits(rate, parallel)
+	SetHTTPOptions(httpOptions)
+	SetWalkConcurrency(walkConcurrency)
+	return nil
+}
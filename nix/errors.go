@@ -0,0 +1,48 @@
+package nix
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Classes of errors, which can be tested with errors.Is, for instance
+// to exit with a specific code.
+var (
+	// Two inputs can not be combined, such as two store paths
+	// providing the same file with different attributes.
+	ErrConflict = errors.New("conflict")
+	// The credentials have been rejected by a server.
+	ErrAuth = errors.New("authentication failed")
+	// A blob is not available.
+	ErrBlobMissing = errors.New("blob missing")
+	// The content of a blob doesn't match its digest or its size.
+	ErrDigestMismatch = errors.New("digest mismatch")
+	// An input can not be archived deterministically, see
+	// SetStrictReproducibility.
+	ErrNotReproducible = errors.New("not reproducible")
+)
+
+// classifiedError is an error belonging to one of the error classes.
+// Its message is the message of the wrapped error.
+type classifiedError struct {
+	class error
+	err   error
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Unwrap() error {
+	return e.err
+}
+
+func (e *classifiedError) Is(target error) bool {
+	return target == e.class
+}
+
+// classErrorf formats an error belonging to the class. Like with
+// fmt.Errorf, an error can be wrapped with %w.
+func classErrorf(class error, format string, a ...interface{}) error {
+	return &classifiedError{class: class, err: fmt.Errorf(format, a...)}
+}
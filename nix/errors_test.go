@@ -0,0 +1,53 @@
+package nix
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+)
+
+func TestClassErrorf(t *testing.T) {
+	err := classErrorf(ErrConflict, "The file %s overrides a file: %w", "/etc/hosts", io.ErrUnexpectedEOF)
+	if err.Error() != "The file /etc/hosts overrides a file: unexpected EOF" {
+		t.Fatalf("The message should not be changed (while it is %#v)", err.Error())
+	}
+	if !errors.Is(err, ErrConflict) || errors.Is(err, ErrAuth) {
+		t.Fatalf("The error should only be an ErrConflict error")
+	}
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("The error should wrap io.ErrUnexpectedEOF")
+	}
+	if wrapped := fmt.Errorf("Could not copy: %w", err); !errors.Is(wrapped, ErrConflict) {
+		t.Fatalf("A wrapping error should be an ErrConflict error")
+	}
+}
+
+func TestErrorClasses(t *testing.T) {
+	content := "content"
+	rc := verifyBlob(ioutil.NopCloser(strings.NewReader("corrupted")), "blob", godigest.FromString(content), -1)
+	if _, err := ioutil.ReadAll(rc); !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("Reading a corrupted blob should be an ErrDigestMismatch error (while it is %v)", err)
+	}
+
+	pinned := types.Layer{Digest: godigest.FromString(content).String(), Pinned: true}
+	if _, _, err := LayerGetBlob(pinned); !errors.Is(err, ErrBlobMissing) {
+		t.Fatalf("Reading a pinned layer should be an ErrBlobMissing error (while it is %v)", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+	pinned.URLs = []string{server.URL + "/blob"}
+	if _, _, err := LayerGetBlob(pinned); !errors.Is(err, ErrAuth) {
+		t.Fatalf("Downloading a layer with rejected credentials should be an ErrAuth error (while it is %v)", err)
+	}
+}
@@ -0,0 +1,431 @@
+package nix
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// fileIndexDirectory is the directory where the file indexes of new
+// layers are written, see SetFileIndexDirectory.
+var fileIndexDirectory string
+
+// SetFileIndexDirectory enables the generation of the file indexes of
+// new layers, which are written into directory. An empty directory
+// disables it.
+func SetFileIndexDirectory(directory string) {
+	fileIndexDirectory = directory
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// BuildFileIndex returns the index of the tar archive read from r.
+func BuildFileIndex(r io.Reader) (index types.FileIndex, err error) {
+	index.Entries = []types.FileIndexEntry{}
+	err = forEachIndexEntry(r, func(entry types.FileIndexEntry) error {
+		index.Entries = append(index.Entries, entry)
+		return nil
+	})
+	return index, err
+}
+
+// forEachIndexEntry calls fn with the index entry of each file of the
+// tar archive read from r. The tar reader reads the archive block by
+// block: once a header has been read, the number of bytes consumed is
+// then the offset of the content of the entry.
+func forEachIndexEntry(r io.Reader, fn func(entry types.FileIndexEntry) error) error {
+	counter := &countingReader{r: r}
+	tr := tar.NewReader(counter)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := normalizeEntryName(hdr.Name)
+		if name == "" {
+			continue
+		}
+		entry := types.FileIndexEntry{
+			Name:   name,
+			Offset: counter.n,
+			Size:   hdr.Size,
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			entry.Type = types.FileIndexFile
+			if _, ok := hdr.PAXRecords["GNU.sparse.major"]; ok {
+				entry.Type = types.FileIndexSparse
+			}
+		case tar.TypeDir:
+			entry.Type = types.FileIndexDir
+		case tar.TypeSymlink:
+			entry.Type = types.FileIndexSymlink
+			entry.Link = hdr.Linkname
+		case tar.TypeLink:
+			entry.Type = types.FileIndexLink
+			entry.Link = normalizeEntryName(hdr.Linkname)
+		default:
+			entry.Type = types.FileIndexOther
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+}
+
+type fileIndexResult struct {
+	index types.FileIndex
+	err   error
+}
+
+// buildFileIndexAsync builds the file index of the archive written to
+// the returned writer, which has to be closed once the archive has
+// been written. The index is then sent to the channel.
+func buildFileIndexAsync() (<-chan fileIndexResult, *io.PipeWriter) {
+	r, w := io.Pipe()
+	result := make(chan fileIndexResult, 1)
+	go func() {
+		index, err := BuildFileIndex(r)
+		if err == nil {
+			// The end of the archive has to be consumed
+			_, err = io.Copy(ioutil.Discard, r)
+		}
+		r.CloseWithError(err)
+		result <- fileIndexResult{index: index, err: err}
+	}()
+	return result, w
+}
+
+// fileIndexFilename returns the file of the file index of the layer
+// blob digest in the file index directory.
+func fileIndexFilename(digest string) (string, error) {
+	d, err := godigest.Parse(digest)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(filepath.Join(fileIndexDirectory, d.Encoded()+".index.json"))
+}
+
+// hasFileIndex returns true if the file index of the layer blob digest
+// is not needed or is already in the file index directory.
+func hasFileIndex(digest godigest.Digest) bool {
+	if fileIndexDirectory == "" {
+		return true
+	}
+	filename, err := fileIndexFilename(digest.String())
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(filename)
+	return err == nil
+}
+
+// writeFileIndex writes the file index of the layer, built while its
+// archive has been generated, into the file index directory, and
+// records it in the layer. If the archive has not been generated since
+// its sum has been cached, the index already in the directory is used.
+func writeFileIndex(layer *types.Layer, sum blobSum) error {
+	if fileIndexDirectory == "" {
+		return nil
+	}
+	filename, err := fileIndexFilename(layer.Digest)
+	if err != nil {
+		return err
+	}
+	if sum.fileIndex == nil {
+		if _, err := os.Stat(filename); err != nil {
+			return fmt.Errorf("The file index of the layer %s is missing: %w", layer.Digest, err)
+		}
+		layer.FileIndex = filename
+		return nil
+	}
+	index := *sum.fileIndex
+	index.Digest = layer.Digest
+	content, err := types.MarshalCanonical(index)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filename, content, 0644); err != nil {
+		return err
+	}
+	layer.FileIndex = filename
+	return nil
+}
+
+// readFileIndex reads the file index of a layer, or returns nil if the
+// layer has no file index.
+func readFileIndex(layer types.Layer) (map[string]types.FileIndexEntry, error) {
+	if layer.FileIndex == "" {
+		return nil, nil
+	}
+	content, err := ioutil.ReadFile(layer.FileIndex)
+	if err != nil {
+		return nil, err
+	}
+	var index types.FileIndex
+	if err := json.Unmarshal(content, &index); err != nil {
+		return nil, fmt.Errorf("Could not parse the file index %s: %w", layer.FileIndex, err)
+	}
+	if index.Digest != layer.Digest {
+		return nil, fmt.Errorf("The file index %s belongs to the layer %s while it should belong to %s", layer.FileIndex, index.Digest, layer.Digest)
+	}
+	entries := make(map[string]types.FileIndexEntry)
+	for _, entry := range index.Entries {
+		entries[entry.Name] = entry
+	}
+	return entries, nil
+}
+
+// maxSymlinks is the maximal number of symlinks followed to find a
+// file, as on Linux.
+const maxSymlinks = 40
+
+// errEntryFound stops the scan of a layer archive.
+var errEntryFound = errors.New("Entry found")
+
+// CatFile writes the content of the file name of the image to w.
+// Layers are searched from the top one, honoring whiteouts, and
+// symlinks are followed inside the image. Layers with a file index are
+// only read if they contain the file, and only the file content is
+// read when the layer is an uncompressed archive on the disk.
+func CatFile(ctx context.Context, image types.Image, name string, w io.Writer) error {
+	name = normalizeEntryName(name)
+	for i := 0; i < maxSymlinks; i++ {
+		layer, entry, ok, err := findFileEntry(ctx, image, name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			// A parent directory can be a symlink, such as
+			// /etc/nginx pointing to a store path
+			resolved, ok, err := resolveParentSymlink(ctx, image, name)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return fmt.Errorf("The file /%s is not part of the image", name)
+			}
+			name = resolved
+			continue
+		}
+		switch entry.Type {
+		case types.FileIndexFile:
+			return copyLayerRange(ctx, layer, entry, w)
+		case types.FileIndexSparse:
+			return copySparseEntry(ctx, layer, entry, w)
+		case types.FileIndexLink:
+			name = entry.Link
+		case types.FileIndexSymlink:
+			name = resolveSymlink(name, entry.Link)
+		default:
+			return fmt.Errorf("The file /%s is not a regular file", name)
+		}
+	}
+	return fmt.Errorf("Too many levels of symbolic links")
+}
+
+func resolveSymlink(name, target string) string {
+	if path.IsAbs(target) {
+		return normalizeEntryName(target)
+	}
+	return normalizeEntryName(path.Join(path.Dir(name), target))
+}
+
+// resolveParentSymlink replaces the first parent directory of name
+// which is a symlink by its target. It returns false if no parent
+// directory is a symlink.
+func resolveParentSymlink(ctx context.Context, image types.Image, name string) (string, bool, error) {
+	elts := strings.Split(name, "/")
+	for i := 1; i < len(elts); i++ {
+		parent := strings.Join(elts[:i], "/")
+		_, entry, ok, err := findFileEntry(ctx, image, parent)
+		if err != nil {
+			return "", false, err
+		}
+		// Archives don't always contain the parent directories
+		// of their files
+		if ok && entry.Type == types.FileIndexSymlink {
+			return path.Join(resolveSymlink(parent, entry.Link), strings.Join(elts[i:], "/")), true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// whiteouts returns the names of the whiteout entries hiding the file
+// name of the lower layers: the whiteouts of the file and of its
+// parent directories, and the opaque markers of its parent
+// directories.
+func whiteouts(name string) map[string]bool {
+	hidden := make(map[string]bool)
+	for p := name; p != "." && p != "/"; p = path.Dir(p) {
+		hidden[normalizeEntryName(path.Join(path.Dir(p), ".wh."+path.Base(p)))] = true
+		hidden[normalizeEntryName(path.Join(path.Dir(p), ".wh..wh..opq"))] = true
+	}
+	return hidden
+}
+
+// findFileEntry returns the top layer containing the file name. It
+// returns false if the file is not part of the image.
+func findFileEntry(ctx context.Context, image types.Image, name string) (layer types.Layer, entry types.FileIndexEntry, ok bool, err error) {
+	hidden := whiteouts(name)
+	for i := len(image.Layers) - 1; i >= 0; i-- {
+		if ctx.Err() != nil {
+			return layer, entry, false, ctx.Err()
+		}
+		layer = image.Layers[i]
+		entries, err := readFileIndex(layer)
+		if err != nil {
+			return layer, entry, false, err
+		}
+		if entries != nil {
+			if entry, ok := entries[name]; ok {
+				return layer, entry, true, nil
+			}
+			for whiteout := range hidden {
+				if _, ok := entries[whiteout]; ok {
+					return layer, entry, false, nil
+				}
+			}
+			continue
+		}
+		if layer.Pinned || IsEncryptedMediaType(layer.MediaType) {
+			continue
+		}
+		entry, ok, whiteout, err := scanFileEntry(layer, name, hidden)
+		if err != nil || ok || whiteout {
+			return layer, entry, ok, err
+		}
+	}
+	return layer, entry, false, nil
+}
+
+// scanFileEntry builds the index entry of the file name by reading the
+// layer archive until the file is found. It also tells whether the
+// file of lower layers is hidden by one of the whiteouts.
+func scanFileEntry(layer types.Layer, name string, whiteouts map[string]bool) (entry types.FileIndexEntry, ok bool, whiteout bool, err error) {
+	r, err := uncompressedLayerReader(layer)
+	if err != nil {
+		return entry, false, false, err
+	}
+	defer r.Close()
+	err = forEachIndexEntry(r, func(e types.FileIndexEntry) error {
+		if e.Name == name {
+			entry = e
+			return errEntryFound
+		}
+		if whiteouts[e.Name] {
+			whiteout = true
+		}
+		return nil
+	})
+	if errors.Is(err, errEntryFound) {
+		return entry, true, false, nil
+	}
+	if err != nil {
+		return entry, false, false, fmt.Errorf("Could not read the archive of the layer %s: %w", layer.Digest, err)
+	}
+	return entry, false, whiteout, nil
+}
+
+// uncompressedLayerReader returns a ReadCloser on the uncompressed
+// archive of the layer.
+func uncompressedLayerReader(layer types.Layer) (io.ReadCloser, error) {
+	if layer.LayerPath == "" && layer.Paths != nil {
+		return TarPaths(layer.Paths), nil
+	}
+	rc, _, err := LayerGetBlob(layer)
+	if err != nil {
+		return nil, err
+	}
+	r, err := decompressReader(rc, layer.MediaType)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return readCloser{Reader: r, Closer: rc}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// copyLayerRange copies the content of the entry of the layer archive
+// to w. Uncompressed archives on the disk are directly read at the
+// entry offset.
+func copyLayerRange(ctx context.Context, layer types.Layer, entry types.FileIndexEntry, w io.Writer) error {
+	if layer.LayerPath != "" && layer.MediaType == v1.MediaTypeImageLayer {
+		f, err := os.Open(layer.LayerPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(w, io.NewSectionReader(f, entry.Offset, entry.Size))
+		return err
+	}
+	r, err := uncompressedLayerReader(layer)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if _, err := io.CopyN(ioutil.Discard, r, entry.Offset); err != nil {
+		return fmt.Errorf("Could not read the archive of the layer %s: %w", layer.Digest, err)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	_, err = io.CopyN(w, r, entry.Size)
+	return err
+}
+
+// copySparseEntry copies the content of the sparse entry of the layer
+// archive to w. Its holes are expanded by the archive reader.
+func copySparseEntry(ctx context.Context, layer types.Layer, entry types.FileIndexEntry, w io.Writer) error {
+	r, err := uncompressedLayerReader(layer)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	tr := tar.NewReader(r)
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return fmt.Errorf("The file /%s is not part of the layer %s", entry.Name, layer.Digest)
+		}
+		if err != nil {
+			return fmt.Errorf("Could not read the archive of the layer %s: %w", layer.Digest, err)
+		}
+		if normalizeEntryName(hdr.Name) == entry.Name {
+			_, err = io.Copy(w, tr)
+			return err
+		}
+	}
+}
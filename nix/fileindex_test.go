@@ -0,0 +1,160 @@
+package nix
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nlewo/nix2container/metrics"
+	"github.com/nlewo/nix2container/types"
+)
+
+func TestCatFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(dir+"/etc", 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := ioutil.WriteFile(dir+"/etc/app.conf", []byte("listen 80\n"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := os.Symlink("app.conf", dir+"/etc/link.conf"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	indexDir := t.TempDir()
+	SetFileIndexDirectory(indexDir)
+	defer SetFileIndexDirectory("")
+	top, err := NewLayers(context.Background(), []string{dir}, nil, []types.RewritePath{{Path: dir, Regex: "^" + dir, Repl: ""}}, "", nil, types.PathOptions{}, CompressionZstd)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if top[0].FileIndex == "" {
+		t.Fatalf("The layer should have a file index")
+	}
+	tarDir := t.TempDir()
+	bottom, err := NewLayersNonReproducible(context.Background(), []string{"../data/tar-directory"}, tarDir, nil, []types.RewritePath{{Path: "../data/tar-directory", Regex: "^../data/tar-directory", Repl: "/etc"}}, "", nil, types.PathOptions{}, CompressionNone)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	image := types.Image{
+		Layers: []types.Layer{bottom[0], top[0]},
+	}
+	for name, expected := range map[string]string{
+		"/etc/app.conf": "listen 80\n",
+		"etc/link.conf": "listen 80\n",
+		"/etc/file1":    "content file1",
+	} {
+		var buf bytes.Buffer
+		if err := CatFile(context.Background(), image, name, &buf); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if buf.String() != expected {
+			t.Fatalf("The content of %s should be '%#v' (while it is %#v)", name, expected, buf.String())
+		}
+	}
+
+	// Without file index, layers are scanned
+	image.Layers[1].FileIndex = ""
+	image.Layers[0].FileIndex = ""
+	var buf bytes.Buffer
+	if err := CatFile(context.Background(), image, "/etc/file1", &buf); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if buf.String() != "content file1" {
+		t.Fatalf("The content of /etc/file1 should be '%#v' (while it is %#v)", "content file1", buf.String())
+	}
+
+	if err := CatFile(context.Background(), image, "/etc/missing", &buf); err == nil {
+		t.Fatalf("Reading a missing file should fail")
+	}
+	if err := CatFile(context.Background(), image, "/etc", &buf); err == nil {
+		t.Fatalf("Reading a directory should fail")
+	}
+}
+
+func TestFileIndexSumCache(t *testing.T) {
+	previousStoreDir := storeDir
+	storeDir = "../data/"
+	defer func() { storeDir = previousStoreDir }()
+
+	cache, err := NewSumCache(t.TempDir())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	SetSumCache(cache)
+	defer SetSumCache(nil)
+	SetFileIndexDirectory(t.TempDir())
+	defer SetFileIndexDirectory("")
+
+	newLayer := func() types.Layer {
+		layers, err := NewLayers(context.Background(), []string{"../data/tar-directory"}, nil, []types.RewritePath{}, "", nil, types.PathOptions{}, CompressionNone)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if layers[0].FileIndex == "" {
+			t.Fatalf("The layer should have a file index")
+		}
+		return layers[0]
+	}
+	layer := newLayer()
+
+	// On a sum cache hit, the index built with the archive is used
+	hits := metrics.CacheLookups.Value("cache", "digest", "result", "hit")
+	if cached := newLayer(); cached.FileIndex != layer.FileIndex {
+		t.Fatalf("The file index should be '%s' (while it is %s)", layer.FileIndex, cached.FileIndex)
+	}
+	if n := metrics.CacheLookups.Value("cache", "digest", "result", "hit") - hits; n != 1 {
+		t.Fatalf("The digest of the layer should be read from the cache (while there are %v hits)", n)
+	}
+
+	// A missing index is built with the archive again
+	if err := os.Remove(layer.FileIndex); err != nil {
+		t.Fatalf("%v", err)
+	}
+	hits = metrics.CacheLookups.Value("cache", "digest", "result", "hit")
+	newLayer()
+	if n := metrics.CacheLookups.Value("cache", "digest", "result", "hit") - hits; n != 0 {
+		t.Fatalf("The archive should be generated when its file index is missing (while there are %v hits)", n)
+	}
+	entries, err := readFileIndex(layer)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, ok := entries["data/tar-directory/file1"]; !ok {
+		t.Fatalf("The file index should contain data/tar-directory/file1 (while it is %#v)", entries)
+	}
+}
+
+func TestCatFileWhiteouts(t *testing.T) {
+	tmpDir := t.TempDir()
+	image := types.Image{
+		Layers: []types.Layer{
+			writeTestLayer(t, filepath.Join(tmpDir, "1.tar"), map[string]string{
+				"etc/a.conf":                   "a",
+				"etc/b.conf":                   "b",
+				"var/lib/c":                    "c",
+				"nix/store/x-nginx/nginx.conf": "nginx",
+			}),
+			writeTestLayer(t, filepath.Join(tmpDir, "2.tar"), map[string]string{
+				"etc/.wh.a.conf":       "",
+				"var/lib/.wh..wh..opq": "",
+				"etc/nginx":            "symlink:/nix/store/x-nginx",
+			}),
+		},
+	}
+	var buf bytes.Buffer
+	if err := CatFile(context.Background(), image, "/etc/b.conf", &buf); err != nil || buf.String() != "b" {
+		t.Fatalf("The content of /etc/b.conf should be 'b' (while it is %#v, %v)", buf.String(), err)
+	}
+	buf.Reset()
+	if err := CatFile(context.Background(), image, "/etc/nginx/nginx.conf", &buf); err != nil || buf.String() != "nginx" {
+		t.Fatalf("The content of /etc/nginx/nginx.conf should be 'nginx' (while it is %#v, %v)", buf.String(), err)
+	}
+	for _, name := range []string{"/etc/a.conf", "/var/lib/c"} {
+		if err := CatFile(context.Background(), image, name, &buf); err == nil {
+			t.Fatalf("The file %s should be hidden by a whiteout", name)
+		}
+	}
+}
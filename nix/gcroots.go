@@ -0,0 +1,99 @@
+package nix
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+
+	"github.com/nlewo/nix2container/types"
+	"github.com/sirupsen/logrus"
+)
+
+// GCRootsDirEnv is the environment variable containing the directory
+// where GC roots are registered while an image is copied.
+const GCRootsDirEnv = "NIX2CONTAINER_GC_ROOTS_DIR"
+
+// DefaultGCRootsDir returns the directory of GC roots set by the
+// environment, or the per-user GC roots directory of Nix.
+func DefaultGCRootsDir() string {
+	if dir := os.Getenv(GCRootsDirEnv); dir != "" {
+		return dir
+	}
+	name := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	return filepath.Join("/nix/var/nix/gcroots/per-user", name)
+}
+
+// ImageStorePaths returns the sorted store paths read to generate the
+// layers of the image.
+func ImageStorePaths(image types.Image) []string {
+	set := make(map[string]bool)
+	for _, layer := range image.Layers {
+		for _, p := range layer.Paths {
+			if storePath := storePathOf(p.Path); storePath != "" {
+				set[storePath] = true
+			}
+		}
+		if storePath := storePathOf(layer.LayerPath); storePath != "" {
+			set[storePath] = true
+		}
+	}
+	var storePaths []string
+	for storePath := range set {
+		storePaths = append(storePaths, storePath)
+	}
+	sort.Strings(storePaths)
+	return storePaths
+}
+
+// GCRoots are symlinks to store paths, registered in a GC roots
+// directory, preventing the garbage collector from removing these
+// store paths.
+type GCRoots struct {
+	links []string
+}
+
+// AddGCRoots registers a GC root in the directory for each store
+// path. The roots have to be released once the store paths are not
+// read anymore. An error is returned if a store path doesn't exist,
+// for instance because it has been removed before it was registered.
+func AddGCRoots(dir string, storePaths []string) (*GCRoots, error) {
+	roots := &GCRoots{}
+	if len(storePaths) == 0 {
+		return roots, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	for _, storePath := range storePaths {
+		link := filepath.Join(dir, fmt.Sprintf("nix2container-%d-%s", os.Getpid(), filepath.Base(storePath)))
+		os.Remove(link)
+		if err := os.Symlink(storePath, link); err != nil {
+			roots.Release()
+			return nil, err
+		}
+		roots.links = append(roots.links, link)
+		if _, err := os.Stat(storePath); err != nil {
+			roots.Release()
+			return nil, fmt.Errorf("The store path %s is not available: %w", storePath, err)
+		}
+	}
+	logrus.Infof("%d GC roots have been registered in %s", len(roots.links), dir)
+	return roots, nil
+}
+
+// Release removes the GC roots.
+func (r *GCRoots) Release() error {
+	var err error
+	for _, link := range r.links {
+		if removeErr := os.Remove(link); removeErr != nil && !os.IsNotExist(removeErr) {
+			err = removeErr
+		}
+	}
+	r.links = nil
+	return err
+}
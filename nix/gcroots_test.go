@@ -0,0 +1,64 @@
+package nix
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/nlewo/nix2container/types"
+)
+
+func TestImageStorePaths(t *testing.T) {
+	image := types.Image{
+		Layers: []types.Layer{
+			types.Layer{Paths: types.Paths{
+				types.Path{Path: "/nix/store/bbb-hello/bin/hello"},
+				types.Path{Path: "/nix/store/aaa-glibc"},
+				types.Path{Path: "../data/layer1"},
+			}},
+			types.Layer{LayerPath: "/nix/store/ccc-layer.tar"},
+			types.Layer{Paths: types.Paths{types.Path{Path: "/nix/store/aaa-glibc/lib"}}},
+		},
+	}
+	expected := []string{"/nix/store/aaa-glibc", "/nix/store/bbb-hello", "/nix/store/ccc-layer.tar"}
+	if storePaths := ImageStorePaths(image); !reflect.DeepEqual(storePaths, expected) {
+		t.Fatalf("Store paths should be '%#v' (while they are %#v)", expected, storePaths)
+	}
+}
+
+func TestAddGCRoots(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "gcroots")
+	storePath, err := filepath.Abs("../data/layer1")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	roots, err := AddGCRoots(dir, []string{storePath})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("One GC root should be registered (while there are %d)", len(entries))
+	}
+	target, err := os.Readlink(filepath.Join(dir, entries[0].Name()))
+	if err != nil || target != storePath {
+		t.Fatalf("The GC root should link to '%#v' (while it is %#v, %v)", storePath, target, err)
+	}
+	if err := roots.Release(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("GC roots should be released (while there are %d)", len(entries))
+	}
+
+	if _, err := AddGCRoots(dir, []string{"/nix/store/missing"}); err == nil {
+		t.Fatalf("Registering a missing store path should fail")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("GC roots of a failed registration should be released (while there are %d)", len(entries))
+	}
+}
@@ -0,0 +1,108 @@
+package nix
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Environment variables configuring the HTTP client used to download
+// the blobs of pinned layers, to talk to remote digest caches and to
+// registries (blob stores and chunked uploads). They are applied by
+// ConfigureFromEnv, so they also apply to the nix transport running in
+// Skopeo. The registry requests sent by containers/image, such as the
+// manifest ones of Skopeo, don't use them: containers/image creates its
+// own HTTP clients. The proxy is always taken from the HTTP_PROXY,
+// HTTPS_PROXY and NO_PROXY environment variables.
+const (
+	HTTPDialTimeoutEnv  = "NIX2CONTAINER_HTTP_DIAL_TIMEOUT"
+	HTTPKeepAliveEnv    = "NIX2CONTAINER_HTTP_KEEP_ALIVE"
+	HTTPMaxIdleConnsEnv = "NIX2CONTAINER_HTTP_MAX_IDLE_CONNS"
+)
+
+// HTTPOptions configures the HTTP client. A zero value keeps the
+// default of the Go standard library.
+type HTTPOptions struct {
+	DialTimeout  time.Duration
+	KeepAlive    time.Duration
+	MaxIdleConns int
+}
+
+var httpClient struct {
+	mu     sync.Mutex
+	opts   HTTPOptions
+	client *http.Client
+}
+
+// HTTPOptionsFromEnv returns the HTTP options set by the environment
+// variables.
+func HTTPOptionsFromEnv() (opts HTTPOptions, err error) {
+	if s := os.Getenv(HTTPDialTimeoutEnv); s != "" {
+		if opts.DialTimeout, err = time.ParseDuration(s); err != nil {
+			return HTTPOptions{}, fmt.Errorf("Invalid HTTP options: %w", err)
+		}
+	}
+	if s := os.Getenv(HTTPKeepAliveEnv); s != "" {
+		if opts.KeepAlive, err = time.ParseDuration(s); err != nil {
+			return HTTPOptions{}, fmt.Errorf("Invalid HTTP options: %w", err)
+		}
+	}
+	if s := os.Getenv(HTTPMaxIdleConnsEnv); s != "" {
+		if opts.MaxIdleConns, err = strconv.Atoi(s); err != nil {
+			return HTTPOptions{}, fmt.Errorf("Invalid HTTP options: %w", err)
+		}
+	}
+	return opts, nil
+}
+
+// SetHTTPOptions replaces the HTTP client by a client configured with
+// opts.
+func SetHTTPOptions(opts HTTPOptions) {
+	httpClient.mu.Lock()
+	defer httpClient.mu.Unlock()
+	httpClient.opts = opts
+	httpClient.client = &http.Client{Transport: newHTTPTransport(opts)}
+}
+
+// getHTTPOptions returns the options set by SetHTTPOptions, to create
+// clients with other TLS settings.
+func getHTTPOptions() HTTPOptions {
+	httpClient.mu.Lock()
+	defer httpClient.mu.Unlock()
+	return httpClient.opts
+}
+
+func newHTTPTransport(opts HTTPOptions) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if opts.DialTimeout > 0 {
+		dialer.Timeout = opts.DialTimeout
+	}
+	if opts.KeepAlive != 0 {
+		// A negative value disables the keep-alive probes
+		dialer.KeepAlive = opts.KeepAlive
+		transport.DisableKeepAlives = opts.KeepAlive < 0
+	}
+	transport.DialContext = dialer.DialContext
+	if opts.MaxIdleConns > 0 {
+		transport.MaxIdleConns = opts.MaxIdleConns
+		transport.MaxIdleConnsPerHost = opts.MaxIdleConns
+	}
+	return transport
+}
+
+// getHTTPClient returns the HTTP client configured by SetHTTPOptions,
+// or a client with the default options.
+func getHTTPClient() *http.Client {
+	httpClient.mu.Lock()
+	defer httpClient.mu.Unlock()
+	if httpClient.client == nil {
+		httpClient.client = &http.Client{Transport: newHTTPTransport(httpClient.opts)}
+	}
+	return httpClient.client
+}
@@ -0,0 +1,41 @@
+package nix
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestHTTPOptionsFromEnv(t *testing.T) {
+	os.Setenv(HTTPDialTimeoutEnv, "5s")
+	defer os.Unsetenv(HTTPDialTimeoutEnv)
+	os.Setenv(HTTPKeepAliveEnv, "-1s")
+	defer os.Unsetenv(HTTPKeepAliveEnv)
+	os.Setenv(HTTPMaxIdleConnsEnv, "4")
+	defer os.Unsetenv(HTTPMaxIdleConnsEnv)
+
+	opts, err := HTTPOptionsFromEnv()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := HTTPOptions{DialTimeout: 5 * time.Second, KeepAlive: -time.Second, MaxIdleConns: 4}
+	if opts != expected {
+		t.Fatalf("Options should be '%#v' (while it is %#v)", expected, opts)
+	}
+
+	transport := newHTTPTransport(opts)
+	if !transport.DisableKeepAlives {
+		t.Fatalf("Keep-alive should be disabled")
+	}
+	if transport.MaxIdleConnsPerHost != 4 {
+		t.Fatalf("MaxIdleConnsPerHost should be '%#v' (while it is %#v)", 4, transport.MaxIdleConnsPerHost)
+	}
+	if transport.Proxy == nil {
+		t.Fatalf("The proxy should be read from the environment")
+	}
+
+	os.Setenv(HTTPMaxIdleConnsEnv, "many")
+	if _, err := HTTPOptionsFromEnv(); err == nil {
+		t.Fatalf("An invalid number of idle connections should be rejected")
+	}
+}
@@ -11,13 +11,15 @@ package nix
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"errors"
 	"io"
 	"io/ioutil"
 	"os"
 	"fmt"
+	"time"
 	"github.com/containers/image/v5/manifest"
+	"github.com/nlewo/nix2container/metrics"
 	"github.com/nlewo/nix2container/types"
 	godigest "github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
@@ -34,7 +36,7 @@ func GetConfigBlob(image types.Image) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	return configBlob, nil
+	return addConfigFields(configBlob, image)
 }
 
 // GetConfigDigest returns the digest and the size of the config blog of an image.
@@ -47,11 +49,111 @@ func GetConfigDigest(image types.Image) (d godigest.Digest, size int64, err erro
 	return  d, int64(len(configBlob)), err
 }
 
+// GetManifestBlob returns the OCI manifest of an image. The config
+// and layer descriptors are built from the image JSON file, which
+// already contains the digests and sizes of all blobs. If the image
+// has a subject, the manifest is a referrer of the subject manifest.
+func GetManifestBlob(image types.Image) ([]byte, error) {
+	configDigest, configSize, err := GetConfigDigest(image)
+	if err != nil {
+		return nil, err
+	}
+	m := v1.Manifest{
+		MediaType: v1.MediaTypeImageManifest,
+		Config: v1.Descriptor{
+			MediaType: v1.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers:      []v1.Descriptor{},
+		Annotations: ProvenanceAnnotations(image.Provenance),
+	}
+	m.SchemaVersion = 2
+	for _, layer := range image.Layers {
+		digest, err := godigest.Parse(layer.Digest)
+		if err != nil {
+			return nil, err
+		}
+		m.Layers = append(m.Layers, v1.Descriptor{
+			MediaType:   layer.MediaType,
+			Digest:      digest,
+			Size:        layer.Size,
+			URLs:        layer.URLs,
+			Annotations: layer.Annotations,
+		})
+	}
+	if image.Subject != nil {
+		subject := *image.Subject
+		if subject.MediaType == "" {
+			subject.MediaType = v1.MediaTypeImageManifest
+		}
+		return json.Marshal(referrerManifest{Manifest: m, Subject: &subject})
+	}
+	return json.Marshal(m)
+}
+
+// GetManifestDescriptor returns the descriptor of the manifest of an
+// image, which can be used as the subject of other images.
+func GetManifestDescriptor(image types.Image) (desc v1.Descriptor, err error) {
+	manifest, err := GetManifestBlob(image)
+	if err != nil {
+		return desc, err
+	}
+	return v1.Descriptor{
+		MediaType: v1.MediaTypeImageManifest,
+		Digest:    godigest.FromBytes(manifest),
+		Size:      int64(len(manifest)),
+	}, nil
+}
+
+// Annotations of the image manifest describing the Nix inputs of the
+// image. The derivations are encoded as a JSON list.
+const (
+	AnnotationFlakeRef        = "org.nixos.flake.ref"
+	AnnotationNixpkgsRevision = "org.nixos.nixpkgs.revision"
+	AnnotationDerivations     = "org.nixos.derivations"
+)
+
+// ProvenanceAnnotations returns the manifest annotations recording the
+// provenance, or nil if there is no provenance.
+func ProvenanceAnnotations(provenance *types.Provenance) map[string]string {
+	if provenance == nil {
+		return nil
+	}
+	annotations := make(map[string]string)
+	if provenance.FlakeRef != "" {
+		annotations[AnnotationFlakeRef] = provenance.FlakeRef
+	}
+	if provenance.NixpkgsRevision != "" {
+		annotations[AnnotationNixpkgsRevision] = provenance.NixpkgsRevision
+	}
+	if len(provenance.Derivations) > 0 {
+		derivations, _ := json.Marshal(provenance.Derivations)
+		annotations[AnnotationDerivations] = string(derivations)
+	}
+	if len(annotations) == 0 {
+		return nil
+	}
+	return annotations
+}
+
 // GetBlob gets the layer corresponding to the provided digest.
 func GetBlob(image types.Image, digest godigest.Digest) (io.ReadCloser, int64, error) {
+	return GetBlobContext(context.Background(), image, digest)
+}
+
+// GetBlobContext is like GetBlob but the layer is read with
+// LayerGetBlobContext.
+func GetBlobContext(ctx context.Context, image types.Image, digest godigest.Digest) (io.ReadCloser, int64, error) {
 	for _, layer := range image.Layers {
 		if layer.Digest == digest.String() {
-			return LayerGetBlob(layer)
+			rc, size, err := LayerGetBlobContext(ctx, layer)
+			if err != nil {
+				return nil, 0, err
+			}
+			metrics.BlobsRead.Inc("type", "layer")
+			metrics.StartStatusLayer(layer.Digest)
+			return throttleBlob(newCountingReadCloser(rc, layer.Digest), true), size, nil
 		}
 	}
 	configDigest, _, err := GetConfigDigest(image)
@@ -63,17 +165,50 @@ func GetBlob(image types.Image, digest godigest.Digest) (io.ReadCloser, int64, e
 		if err != nil {
 			return nil, 0, err
 		}
-		rc := nopCloser{bytes.NewReader(configBlob)}
+		metrics.BlobsRead.Inc("type", "config")
+		rc := throttleBlob(newCountingReadCloser(nopCloser{bytes.NewReader(configBlob)}, digest.String()), false)
 		return rc, int64(len(configBlob)), nil
 	}
-	return nil, 0, errors.New("No blob with specified digest found in image")
+	return nil, 0, classErrorf(ErrBlobMissing, "No blob with specified digest found in image")
+}
+
+// ImageOS returns the operating system of the image.
+func ImageOS(image types.Image) string {
+	if image.OS == "" {
+		return "linux"
+	}
+	return image.OS
+}
+
+// ImageArchitecture returns the CPU architecture of the image.
+func ImageArchitecture(image types.Image) string {
+	if image.Architecture == "" {
+		return "amd64"
+	}
+	return image.Architecture
 }
 
 func getV1Image(image types.Image) (imageV1 v1.Image, err error) {
-	imageV1.OS = "linux"
-	imageV1.Architecture = "amd64"
+	imageV1.OS = ImageOS(image)
+	imageV1.Architecture = ImageArchitecture(image)
 	imageV1.Config = image.ImageConfig
+	if image.Created != "" {
+		created, err := parseCreated(image.Created)
+		if err != nil {
+			return imageV1, err
+		}
+		imageV1.Created = &created
+	}
 
+	// The history is only added when a layer has a creation date
+	// or an author, or when the image has history entries, to keep
+	// the configuration digests of existing images
+	withHistory := len(image.History) > 0
+	for _, layer := range image.Layers {
+		if layer.Created != "" || layer.Author != "" || layer.CreatedBy != "" {
+			withHistory = true
+		}
+	}
 	for _, layer := range image.Layers {
 		digest, err := godigest.Parse(layer.DiffIDs)
 		if err != nil {
@@ -82,24 +217,73 @@ func getV1Image(image types.Image) (imageV1 v1.Image, err error) {
 		imageV1.RootFS.DiffIDs = append(
 			imageV1.RootFS.DiffIDs,
 			digest)
+		if withHistory {
+			history := v1.History{CreatedBy: "nix2container", Author: layer.Author}
+			if layer.CreatedBy != "" {
+				history.CreatedBy = layer.CreatedBy
+			}
+			if history.Created, err = historyCreated(layer.Created, image.Created); err != nil {
+				return imageV1, err
+			}
+			imageV1.History = append(imageV1.History, history)
+		}
+	}
+	for _, h := range image.History {
+		history := v1.History{
+			CreatedBy:  h.CreatedBy,
+			Author:     h.Author,
+			Comment:    h.Comment,
+			EmptyLayer: true,
+		}
+		if history.Created, err = historyCreated(h.Created, image.Created); err != nil {
+			return imageV1, err
+		}
+		imageV1.History = append(imageV1.History, history)
 	}
 	return
 }
 
+// historyCreated returns the creation date of a history entry, which
+// is the creation date of the image if date is not set.
+func historyCreated(date string, imageDate string) (*time.Time, error) {
+	if date == "" {
+		date = imageDate
+	}
+	if date == "" {
+		return nil, nil
+	}
+	created, err := parseCreated(date)
+	if err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// parseCreated parses a RFC3339 creation date. Dates are stored in
+// UTC, so that the configuration doesn't depend on the time zone of
+// the date.
+func parseCreated(date string) (time.Time, error) {
+	created, err := time.Parse(time.RFC3339, date)
+	if err != nil {
+		return created, fmt.Errorf("Invalid created date %q: %w", date, err)
+	}
+	return created.UTC(), nil
+}
+
 // NewImageFromDir creates an Image from a JSON file describing an
 // image. This file has usually been created by Nix through the
-// nix2container binary.
+// nix2container binary. The filename "-" designates the standard
+// input.
 func NewImageFromFile(filename string) (image types.Image, err error) {
-	file, err := os.Open(filename)
-	defer file.Close()
+	content, err := types.ReadFile(filename)
 	if err != nil {
 		return image, err
 	}
-	content, err := ioutil.ReadAll(file)
+	err = json.Unmarshal(content, &image)
 	if err != nil {
 		return image, err
 	}
-	err = json.Unmarshal(content, &image)
+	err = image.Migrate()
 	if err != nil {
 		return image, err
 	}
@@ -129,27 +313,51 @@ func NewImageFromDir(directory string) (image types.Image, err error) {
 	if err != nil {
 		return image, err
 	}
+	return newImageFromManifest(v1Manifest, content, func(d godigest.Digest) string {
+		return directory + "/" + d.Encoded()
+	})
+}
+
+// newImageFromManifest creates an image from a manifest and the
+// content of its config. The blob of a layer is the file returned by
+// blobPath.
+func newImageFromManifest(v1Manifest v1.Manifest, content []byte, blobPath func(godigest.Digest) string) (image types.Image, err error) {
 	var v1ImageConfig manifest.Schema2Image
 	err = json.Unmarshal(content, &v1ImageConfig)
 	if err != nil {
 		return image, err
 	}
-	
-	// TODO: we should also load the configuration in order to
-	// allow configuration merges
+	// The configuration fields of Docker and OCI images have the
+	// same names
+	var v1Image v1.Image
+	err = json.Unmarshal(content, &v1Image)
+	if err != nil {
+		return image, err
+	}
+	image.ImageConfig = v1Image.Config
+	err = readWindowsFields(&image, content)
+	if err != nil {
+		return image, err
+	}
 
+	image.Version = types.ImageVersion
+	if len(v1ImageConfig.RootFS.DiffIDs) != len(v1Manifest.Layers) {
+		return image, fmt.Errorf("The config has %d diff IDs while the manifest has %d layers", len(v1ImageConfig.RootFS.DiffIDs), len(v1Manifest.Layers))
+	}
 	for i, l := range v1Manifest.Layers {
-		layerFilename := directory + "/" + l.Digest.Encoded()
+		layerFilename := blobPath(l.Digest)
 		logrus.Infof("Adding tar file '%s' as image layer", layerFilename)
 		layer := types.Layer{
+			Version:   types.LayerVersion,
 			LayerPath: layerFilename,
 			Digest:    l.Digest.String(),
+			Size:      l.Size,
 			DiffIDs:   v1ImageConfig.RootFS.DiffIDs[i].String(),
 		}
 		switch l.MediaType {
-		case "application/vnd.docker.image.rootfs.diff.tar":
+		case "application/vnd.docker.image.rootfs.diff.tar", v1.MediaTypeImageLayer:
 			layer.MediaType = v1.MediaTypeImageLayer
-		case "application/vnd.docker.image.rootfs.diff.tar.gzip":
+		case "application/vnd.docker.image.rootfs.diff.tar.gzip", v1.MediaTypeImageLayerGzip:
 			layer.MediaType = v1.MediaTypeImageLayerGzip
 		default:
 			return image, fmt.Errorf("Unknown media type: %q", l.MediaType)
@@ -164,3 +372,34 @@ type nopCloser struct {
 }
 
 func (nopCloser) Close() error { return nil }
+
+// countingReadCloser accounts bytes read from blobs in the
+// BlobBytesRead metric, in the upload report and in the status.
+type countingReadCloser struct {
+	io.ReadCloser
+	digest string
+	n      int64
+	// Whether the blob has been completely read
+	eof bool
+}
+
+func newCountingReadCloser(rc io.ReadCloser, digest string) *countingReadCloser {
+	return &countingReadCloser{ReadCloser: rc, digest: digest}
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	metrics.BlobBytesRead.Add(float64(n))
+	metrics.AddStatusBytes(metrics.PhasePushing, int64(n))
+	c.n += int64(n)
+	if err == io.EOF {
+		c.eof = true
+	}
+	return n, err
+}
+
+func (c *countingReadCloser) Close() error {
+	recordBlobRead(c.digest, c.n)
+	metrics.EndStatusLayer(c.digest, c.eof)
+	return c.ReadCloser.Close()
+}
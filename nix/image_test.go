@@ -1,10 +1,16 @@
 package nix
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/nlewo/nix2container/types"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 func TestNewImageFromDir(t *testing.T) {
@@ -15,7 +21,9 @@ func TestNewImageFromDir(t *testing.T) {
 	expected := types.Image{
 		Layers: []types.Layer{
 			types.Layer{
+				Version: types.LayerVersion,
 				Digest: "sha256:59bf1c3509f33515622619af21ed55bbe26d24913cedbca106468a5fb37a50c3",
+				Size: 2818413,
 				DiffIDs:"sha256:8d3ac3489996423f53d6087c81180006263b79f206d3fdec9e66f0e27ceb8759",
 				MediaType:"application/vnd.oci.image.layer.v1.tar+gzip",
 				LayerPath:"../data/image-directory/59bf1c3509f33515622619af21ed55bbe26d24913cedbca106468a5fb37a50c3",
@@ -26,3 +34,258 @@ func TestNewImageFromDir(t *testing.T) {
 		t.Fatalf("Layers should be '%#v' (while they are %#v)", expected.Layers, image.Layers)
 	}
 }
+
+func TestNewImageFromFileVersion(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	legacy := tmpDir + "/legacy.json"
+	err := ioutil.WriteFile(legacy, []byte(`{"image-config":{},"layers":[{"digest":"sha256:59bf1c3509f33515622619af21ed55bbe26d24913cedbca106468a5fb37a50c3"}]}`), 0644)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	image, err := NewImageFromFile(legacy)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if image.Version != types.ImageVersion || image.Layers[0].Version != types.LayerVersion {
+		t.Fatalf("The image should have been upgraded to the current version (while it is %#v)", image)
+	}
+
+	future := tmpDir + "/future.json"
+	err = ioutil.WriteFile(future, []byte(`{"version":1000,"image-config":{},"layers":[]}`), 0644)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	_, err = NewImageFromFile(future)
+	if err == nil {
+		t.Fatalf("Loading an image with an unsupported version should fail")
+	}
+}
+
+func TestValidateImage(t *testing.T) {
+	image, err := NewImageFromDir("../data/image-directory")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	content, err := json.Marshal(image)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	_, err = types.ValidateImage(content)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	_, err = types.ValidateImage([]byte(`{"image-config":{},"layers":[],"unknown":1}`))
+	if err == nil {
+		t.Fatalf("An image with unknown fields should not be valid")
+	}
+	_, err = types.ValidateImage([]byte(`{"image-config":{},"layers":[{"digest":"sha256:wrong","diff_ids":"sha256:wrong","mediatype":"application/vnd.oci.image.layer.v1.tar"}]}`))
+	if err == nil {
+		t.Fatalf("An image with invalid digests should not be valid")
+	}
+
+	a := "sha256:a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4"
+	b := "sha256:b3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4"
+	for _, c := range []struct {
+		digest, diffID, mediaType string
+		valid                     bool
+	}{
+		{a, a, v1.MediaTypeImageLayer, true},
+		{a, b, v1.MediaTypeImageLayer, false},
+		{a, b, v1.MediaTypeImageLayerGzip, true},
+		{a, a, v1.MediaTypeImageLayerGzip, false},
+		{a, a, v1.MediaTypeImageLayerZstd, false},
+	} {
+		content := fmt.Sprintf(`{"image-config":{},"layers":[{"digest":"%s","diff_ids":"%s","mediatype":"%s"}]}`, c.digest, c.diffID, c.mediaType)
+		if _, err = types.ValidateImage([]byte(content)); (err == nil) != c.valid {
+			t.Fatalf("The validity of the image %s should be '%#v' (while the error is %v)", content, c.valid, err)
+		}
+	}
+}
+
+func TestGetManifestBlob(t *testing.T) {
+	image, err := NewImageFromDir("../data/image-directory")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	content, err := GetManifestBlob(image)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var manifest v1.Manifest
+	err = json.Unmarshal(content, &manifest)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	configDigest, _, err := GetConfigDigest(image)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if manifest.Config.Digest != configDigest {
+		t.Fatalf("Config digest should be '%#v' (while it is %#v)", configDigest, manifest.Config.Digest)
+	}
+	if len(manifest.Layers) != 1 || manifest.Layers[0].Digest.String() != image.Layers[0].Digest || manifest.Layers[0].Size != 2818413 {
+		t.Fatalf("Layers should match the image layers (while they are %#v)", manifest.Layers)
+	}
+}
+
+func TestGetManifestBlobProvenance(t *testing.T) {
+	image, err := NewImageFromDir("../data/image-directory")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	image.Provenance = &types.Provenance{
+		FlakeRef:        "github:nlewo/nix2container/abc",
+		NixpkgsRevision: "0123456789abcdef",
+		Derivations:     []string{"/nix/store/aaa-hello.drv"},
+	}
+	content, err := GetManifestBlob(image)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var manifest v1.Manifest
+	err = json.Unmarshal(content, &manifest)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := map[string]string{
+		AnnotationFlakeRef:        "github:nlewo/nix2container/abc",
+		AnnotationNixpkgsRevision: "0123456789abcdef",
+		AnnotationDerivations:     `["/nix/store/aaa-hello.drv"]`,
+	}
+	if !reflect.DeepEqual(manifest.Annotations, expected) {
+		t.Fatalf("Annotations should be '%#v' (while they are %#v)", expected, manifest.Annotations)
+	}
+
+	if annotations := ProvenanceAnnotations(&types.Provenance{}); annotations != nil {
+		t.Fatalf("Annotations of an empty provenance should be nil (while they are %#v)", annotations)
+	}
+}
+
+func TestGetManifestBlobSubject(t *testing.T) {
+	primary, err := NewImageFromDir("../data/image-directory")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	subject, err := GetManifestDescriptor(primary)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	debug := primary
+	debug.Subject = &v1.Descriptor{Digest: subject.Digest, Size: subject.Size}
+	content, err := GetManifestBlob(debug)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var manifest referrerManifest
+	err = json.Unmarshal(content, &manifest)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if manifest.Subject == nil || !reflect.DeepEqual(*manifest.Subject, subject) {
+		t.Fatalf("The subject should be '%#v' (while it is %#v)", subject, manifest.Subject)
+	}
+
+	content, err = GetManifestBlob(primary)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if strings.Contains(string(content), "subject") {
+		t.Fatalf("A manifest without subject should not have a subject field (while it is %s)", content)
+	}
+}
+
+func TestGetConfigBlobCreated(t *testing.T) {
+	digest := "sha256:a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4"
+	image := types.Image{
+		Layers: []types.Layer{
+			{Digest: digest, DiffIDs: digest},
+			{Digest: digest, DiffIDs: digest},
+		},
+	}
+	content, err := GetConfigBlob(image)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if strings.Contains(string(content), "created") || strings.Contains(string(content), "history") {
+		t.Fatalf("The configuration should not have creation dates (while it is %s)", content)
+	}
+
+	image.Created = "2024-01-01T01:00:00+01:00"
+	image.Layers[1].Created = "2024-02-01T00:00:00Z"
+	content, err = GetConfigBlob(image)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var config v1.Image
+	if err := json.Unmarshal(content, &config); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if config.Created == nil || config.Created.Format(time.RFC3339) != "2024-01-01T00:00:00Z" {
+		t.Fatalf("Created should be '2024-01-01T00:00:00Z' (while it is %#v)", config.Created)
+	}
+	if len(config.History) != 2 {
+		t.Fatalf("The history should have 2 entries (while it is %#v)", config.History)
+	}
+	expected := []string{"2024-01-01T00:00:00Z", "2024-02-01T00:00:00Z"}
+	for i, history := range config.History {
+		if history.Created == nil || history.Created.Format(time.RFC3339) != expected[i] {
+			t.Fatalf("History %d created should be '%#v' (while it is %#v)", i, expected[i], history.Created)
+		}
+	}
+
+	_, err = types.ValidateImage([]byte(`{"image-config":{},"layers":[],"created":"yesterday"}`))
+	if err == nil {
+		t.Fatalf("An image with an invalid created date should not be valid")
+	}
+}
+
+func TestGetConfigBlobHistory(t *testing.T) {
+	digest := "sha256:a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4"
+	image := types.Image{
+		Created: "2024-01-01T00:00:00Z",
+		Layers: []types.Layer{
+			{Digest: digest, DiffIDs: digest},
+			{Digest: digest, DiffIDs: digest, Author: "alice"},
+		},
+		ImageConfig: v1.ImageConfig{
+			Env:    []string{"PATH=/bin"},
+			Labels: map[string]string{"b": "2", "a": "1"},
+			Cmd:    []string{"/bin/app", "--serve"},
+		},
+	}
+	image.History = ConfigHistory(image.ImageConfig)
+	content, err := GetConfigBlob(image)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var config v1.Image
+	if err := json.Unmarshal(content, &config); err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := []v1.History{
+		{CreatedBy: "nix2container"},
+		{CreatedBy: "nix2container", Author: "alice"},
+		{CreatedBy: "ENV PATH=/bin", Comment: "nix2container", EmptyLayer: true},
+		{CreatedBy: "LABEL a=1", Comment: "nix2container", EmptyLayer: true},
+		{CreatedBy: "LABEL b=2", Comment: "nix2container", EmptyLayer: true},
+		{CreatedBy: `CMD ["/bin/app","--serve"]`, Comment: "nix2container", EmptyLayer: true},
+	}
+	if len(config.History) != len(expected) {
+		t.Fatalf("The history should have %d entries (while it is %#v)", len(expected), config.History)
+	}
+	for i, history := range config.History {
+		if history.Created == nil || history.Created.Format(time.RFC3339) != image.Created {
+			t.Fatalf("History %d created should be '%#v' (while it is %#v)", i, image.Created, history.Created)
+		}
+		history.Created = nil
+		if history != expected[i] {
+			t.Fatalf("History %d should be '%#v' (while it is %#v)", i, expected[i], history)
+		}
+	}
+	// Only the layers are in the root filesystem
+	if len(config.RootFS.DiffIDs) != 2 {
+		t.Fatalf("The root filesystem should have 2 layers (while it is %#v)", config.RootFS.DiffIDs)
+	}
+}
@@ -0,0 +1,143 @@
+package nix
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+)
+
+// NewIndex creates a multi-platform index from entries. Placeholder
+// and skipped entries are not part of the index. An error is returned
+// if the platform of an image doesn't match the platform of its entry
+// or if a platform is declared several times.
+func NewIndex(entries []types.IndexEntry) (index types.Index, err error) {
+	index.Version = types.IndexVersion
+	platforms := make(map[string]bool)
+	for _, entry := range entries {
+		platform := platformString(entry.Platform)
+		if platforms[platform] {
+			return index, classErrorf(ErrConflict, "The platform %s is declared several times", platform)
+		}
+		platforms[platform] = true
+		if entry.Skip || entry.Image == "" {
+			logrus.Infof("Skipping the platform %s", platform)
+			continue
+		}
+		image, err := NewImageFromFile(entry.Image)
+		if err != nil {
+			return index, err
+		}
+		if ImageOS(image) != entry.Platform.OS || ImageArchitecture(image) != entry.Platform.Architecture {
+			return index, fmt.Errorf("The platform of the image %s is %s/%s while it is declared as %s", entry.Image, ImageOS(image), ImageArchitecture(image), platform)
+		}
+		// Windows clients select images by their OS version
+		if entry.Platform.OSVersion == "" {
+			entry.Platform.OSVersion = image.OSVersion
+		}
+		if len(entry.Platform.OSFeatures) == 0 {
+			entry.Platform.OSFeatures = image.OSFeatures
+		}
+		logrus.Infof("Adding the image %s for the platform %s", entry.Image, platform)
+		index.Manifests = append(index.Manifests, types.IndexManifest{
+			Platform:    entry.Platform,
+			Annotations: entry.Annotations,
+			Image:       image,
+		})
+	}
+	if len(index.Manifests) == 0 {
+		return index, errors.New("The index doesn't contain any image")
+	}
+	return index, nil
+}
+
+func platformString(platform v1.Platform) string {
+	s := platform.OS + "/" + platform.Architecture
+	if platform.Variant != "" {
+		s += "/" + platform.Variant
+	}
+	return s
+}
+
+// NewIndexFromFile creates an Index from a JSON file written by
+// the nix2container index command.
+func NewIndexFromFile(filename string) (index types.Index, err error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return index, err
+	}
+	err = json.Unmarshal(content, &index)
+	if err != nil {
+		return index, err
+	}
+	err = index.Migrate()
+	if err != nil {
+		return index, err
+	}
+	return index, nil
+}
+
+// GetIndexBlob returns the OCI image index of an index.
+func GetIndexBlob(index types.Index) ([]byte, error) {
+	v1Index := v1.Index{
+		MediaType:   v1.MediaTypeImageIndex,
+		Manifests:   []v1.Descriptor{},
+		Annotations: index.Annotations,
+	}
+	v1Index.SchemaVersion = 2
+	for _, m := range index.Manifests {
+		manifest, err := GetManifestBlob(m.Image)
+		if err != nil {
+			return nil, err
+		}
+		platform := m.Platform
+		v1Index.Manifests = append(v1Index.Manifests, v1.Descriptor{
+			MediaType:   v1.MediaTypeImageManifest,
+			Digest:      godigest.FromBytes(manifest),
+			Size:        int64(len(manifest)),
+			Platform:    &platform,
+			Annotations: m.Annotations,
+		})
+	}
+	return json.Marshal(v1Index)
+}
+
+// GetIndexImage returns the image of the index whose manifest digest
+// is manifestDigest.
+func GetIndexImage(index types.Index, manifestDigest godigest.Digest) (image types.Image, err error) {
+	for _, m := range index.Manifests {
+		manifest, err := GetManifestBlob(m.Image)
+		if err != nil {
+			return image, err
+		}
+		if godigest.FromBytes(manifest) == manifestDigest {
+			return m.Image, nil
+		}
+	}
+	return image, fmt.Errorf("No manifest with the digest %s found in the index", manifestDigest)
+}
+
+// GetBlobImage returns the image of the index containing the blob
+// digest.
+func GetBlobImage(index types.Index, digest godigest.Digest) (image types.Image, err error) {
+	for _, m := range index.Manifests {
+		for _, layer := range m.Image.Layers {
+			if layer.Digest == digest.String() {
+				return m.Image, nil
+			}
+		}
+		configDigest, _, err := GetConfigDigest(m.Image)
+		if err != nil {
+			return image, err
+		}
+		if configDigest == digest {
+			return m.Image, nil
+		}
+	}
+	return image, classErrorf(ErrBlobMissing, "No blob with specified digest found in index")
+}
@@ -0,0 +1,68 @@
+package nix
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestNewIndex(t *testing.T) {
+	tmpDir := t.TempDir()
+	amd64 := tmpDir + "/amd64.json"
+	err := ioutil.WriteFile(amd64, []byte(`{"version":1,"image-config":{},"layers":[]}`), 0644)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	arm64 := tmpDir + "/arm64.json"
+	err = ioutil.WriteFile(arm64, []byte(`{"version":1,"image-config":{},"layers":[],"architecture":"arm64"}`), 0644)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	entries := []types.IndexEntry{
+		types.IndexEntry{Platform: v1.Platform{OS: "linux", Architecture: "amd64"}, Image: amd64},
+		types.IndexEntry{Platform: v1.Platform{OS: "linux", Architecture: "arm64"}, Image: arm64, Annotations: map[string]string{"key": "value"}},
+		types.IndexEntry{Platform: v1.Platform{OS: "windows", Architecture: "amd64"}, Skip: true},
+	}
+	index, err := NewIndex(entries)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	content, err := GetIndexBlob(index)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var v1Index v1.Index
+	err = json.Unmarshal(content, &v1Index)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(v1Index.Manifests) != 2 || v1Index.Manifests[1].Platform.Architecture != "arm64" || v1Index.Manifests[1].Annotations["key"] != "value" {
+		t.Fatalf("The index should contain the amd64 and arm64 images (while it is %#v)", v1Index)
+	}
+	manifest, err := GetManifestBlob(index.Manifests[1].Image)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	image, err := GetIndexImage(index, godigest.FromBytes(manifest))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if image.Architecture != "arm64" {
+		t.Fatalf("Architecture should be 'arm64' (while it is %#v)", image.Architecture)
+	}
+
+	entries[0].Image = arm64
+	_, err = NewIndex(entries)
+	if err == nil {
+		t.Fatalf("An image whose architecture doesn't match its platform should not be added to the index")
+	}
+	entries[0].Image = amd64
+	_, err = NewIndex(append(entries, entries[0]))
+	if err == nil {
+		t.Fatalf("A platform declared several times should not be added to the index")
+	}
+}
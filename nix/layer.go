@@ -1,20 +1,96 @@
 package nix
 
 import (
+	"context"
+	"fmt"
 	"io"
+	"net/http"
 	"os"
+	"strings"
 
 	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
 )
 
 func LayerGetBlob(layer types.Layer) (reader io.ReadCloser, size int64, err error) {
+	return LayerGetBlobContext(context.Background(), layer)
+}
+
+// LayerGetBlobContext is like LayerGetBlob but the download of the
+// blob and the generation of the archive stop when the context is
+// cancelled.
+func LayerGetBlobContext(ctx context.Context, layer types.Layer) (reader io.ReadCloser, size int64, err error) {
+	if layer.Pinned && len(layer.URLs) > 0 {
+		return downloadBlob(ctx, layer)
+	}
+	if layer.Pinned {
+		return nil, 0, classErrorf(ErrBlobMissing, "The blob of the pinned layer %s is not available: it has to be already present on the destination", layer.Digest)
+	}
 	if layer.LayerPath != "" {
-		reader, err = os.Open(layer.LayerPath)
-		return
+		f, err := os.Open(layer.LayerPath)
+		if err != nil {
+			return nil, 0, err
+		}
+		return verifyBlob(f, layer.LayerPath, godigest.Digest(layer.Digest), expectedSize(layer)), 0, nil
+	}
+	if layer.Files != nil {
+		reader, err = TarFiles(layer.Files)
+		return reader, layer.Size, err
 	}
 	if layer.Paths != nil {
-		reader = TarPaths(layer.Paths)
+		var command []string
+		command, err = layerCompressionCommand(layer, nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		ctx := withArchiveSettings(ctx, layerArchiveSettings(layer))
+		reader, err = compressReader(TarPathsContext(ctx, layer.Paths), layer.Compression, command)
 		return
 	}
 	return reader, layer.Size, err
 }
+
+// downloadBlob returns the blob of the layer downloaded from the
+// first of its URLs which is available. The blob is verified against
+// the digest and the size of the layer while it is read, since it
+// comes from an arbitrary server. If the blob can not be downloaded,
+// the error is an ErrAuth error if a server rejected the credentials,
+// an ErrBlobMissing error otherwise.
+func downloadBlob(ctx context.Context, layer types.Layer) (io.ReadCloser, int64, error) {
+	var errs []string
+	class := ErrBlobMissing
+	for _, u := range layer.URLs {
+		logrus.Infof("Downloading the layer %s from %s", layer.Digest, u)
+		req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		resp, err := getHTTPClient().Do(req)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			errs = append(errs, fmt.Sprintf("%s: %s", u, resp.Status))
+			if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+				class = ErrAuth
+			}
+			continue
+		}
+		return verifyBlob(resp.Body, u, godigest.Digest(layer.Digest), expectedSize(layer)), layer.Size, nil
+	}
+	return nil, 0, classErrorf(class, "The layer %s can not be downloaded from its URLs: %s", layer.Digest, strings.Join(errs, ", "))
+}
+
+// expectedSize returns the size of the layer blob, or -1 if it is not
+// known. The size of layers created by older nix2container versions
+// is not set.
+func expectedSize(layer types.Layer) int64 {
+	if layer.Size == 0 {
+		return -1
+	}
+	return layer.Size
+}
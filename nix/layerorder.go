@@ -0,0 +1,94 @@
+package nix
+
+import (
+	"archive/tar"
+	"context"
+	"os"
+	"sort"
+
+	"github.com/nlewo/nix2container/types"
+)
+
+// OrderLayers sorts the layers by their order: layers with a lower
+// order are below the layers with a higher order, and layers with the
+// same order (0 if it is not set) keep their relative position. Since
+// an overriding layer, such as a customized /etc, is then explicitly
+// above the layers it shadows, the files of a layer shadowed by
+// another layer of the same or of a lower order are reported as
+// ErrConflict errors: such files are shadowed by accident. Files
+// provided by the same path of both layers are not shadowed. Layers
+// are only checked if one of them has an order.
+func OrderLayers(ctx context.Context, layers []types.Layer) ([]types.Layer, error) {
+	ordered := make([]types.Layer, len(layers))
+	copy(ordered, layers)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].Order < ordered[j].Order
+	})
+	withOrder := false
+	for _, layer := range ordered {
+		if layer.Order != 0 {
+			withOrder = true
+		}
+	}
+	if !withOrder {
+		return ordered, nil
+	}
+
+	// The layer index and the file of the entries of the layers
+	// below the current one
+	type source struct {
+		layer int
+		path  string
+	}
+	entries := make(map[string]source)
+	for i, layer := range ordered {
+		layerEntries, err := layerFileEntries(ctx, layer)
+		if err != nil {
+			return nil, err
+		}
+		names := make([]string, 0, len(layerEntries))
+		for name := range layerEntries {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			path := layerEntries[name]
+			previous, ok := entries[name]
+			if ok && previous.path != path && ordered[previous.layer].Order >= layer.Order {
+				return nil, classErrorf(ErrConflict, "The file /%s of the layer %s (order %d) is shadowed by the file %s of the layer %s (order %d): the order of the overriding layer has to be higher",
+					name, ordered[previous.layer].Digest, ordered[previous.layer].Order, path, layer.Digest, layer.Order)
+			}
+			entries[name] = source{layer: i, path: path}
+		}
+	}
+	return ordered, nil
+}
+
+// layerFileEntries returns the files of the archive of the layer
+// built from its paths, except directories, indexed by their entry
+// name. The archive is not generated: only the headers of its
+// entries are computed.
+func layerFileEntries(ctx context.Context, layer types.Layer) (map[string]string, error) {
+	entries := make(map[string]string)
+	for _, p := range layer.Paths {
+		options, err := compilePathOptions(p.Path, p.Options)
+		if err != nil {
+			return nil, err
+		}
+		err = walkContext(ctx, p.Path, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			hdr, _, err := fileHeader(path, info, options, nil)
+			if err != nil || hdr == nil || hdr.Typeflag == tar.TypeDir {
+				return err
+			}
+			entries[normalizeEntryName(hdr.Name)] = path
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,62 @@
+package nix
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/nlewo/nix2container/types"
+)
+
+func TestOrderLayers(t *testing.T) {
+	rewritten := func(digest string, path string, order int) types.Layer {
+		return types.Layer{
+			Digest: digest,
+			Order:  order,
+			Paths: types.Paths{
+				types.Path{
+					Path: path,
+					Options: &types.PathOptions{
+						Rewrite: types.Rewrite{Regex: "^" + path, Repl: ""},
+					},
+				},
+			},
+		}
+	}
+	etc := rewritten("etc", "../data/tar-directory", 1)
+	base := rewritten("base", "../data/layer1", 0)
+	other := types.Layer{Digest: "other"}
+
+	ordered, err := OrderLayers(context.Background(), []types.Layer{etc, base, other})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var digests []string
+	for _, layer := range ordered {
+		digests = append(digests, layer.Digest)
+	}
+	if len(digests) != 3 || digests[0] != "base" || digests[1] != "other" || digests[2] != "etc" {
+		t.Fatalf("The layers should be '[base other etc]' (while they are %v)", digests)
+	}
+
+	// The same file in both layers is not shadowed
+	if _, err := OrderLayers(context.Background(), []types.Layer{base, rewritten("copy", "../data/layer1", 1)}); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// The overriding layer has to be above the layers it shadows
+	etc.Order = 0
+	_, err = OrderLayers(context.Background(), []types.Layer{base, etc, rewritten("top", "../data/layer1", 2)})
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("The shadowed file should be a conflict (while the error is %v)", err)
+	}
+
+	// Layers without order are neither reordered nor checked
+	ordered, err = OrderLayers(context.Background(), []types.Layer{etc, base})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if ordered[0].Digest != "etc" || ordered[1].Digest != "base" {
+		t.Fatalf("The layers should not be reordered (while they are %#v)", ordered)
+	}
+}
@@ -1,23 +1,51 @@
 package nix
 
 import (
+	"context"
 	_ "crypto/sha256"
 	_ "crypto/sha512"
+	"fmt"
+	"io"
 	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/nlewo/nix2container/metrics"
 	"github.com/nlewo/nix2container/types"
 	"github.com/sirupsen/logrus"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
-func getPaths(storePaths []string, parents []types.Layer, rewrites []types.RewritePath, exclude string, permPaths []types.PermPath) types.Paths {
+// getPaths builds the list of paths of a layer. The options
+// defaultOptions are applied on all paths and are completed by the
+// per path rewrites and perms.
+//
+// Paths are sorted, so that the layer doesn't depend on the order of
+// the storePaths, and paths listed several times are only added once.
+// With the tar format v1, paths keep the order of storePaths, which
+// defines the order of the archive and thus the layer digest.
+func getPaths(storePaths []string, parents []types.Layer, rewrites []types.RewritePath, exclude string, permPaths []types.PermPath, defaultOptions types.PathOptions) types.Paths {
 	var paths types.Paths
-	for _, p := range storePaths {
+	ordered := storePaths
+	if defaultOptions.TarFormat != types.TarFormatV1 {
+		ordered = make([]string, len(storePaths))
+		copy(ordered, storePaths)
+		sort.Strings(ordered)
+	}
+	seen := make(map[string]bool)
+	for _, p := range ordered {
+		if seen[p] {
+			logrus.Warnf("The path %s is listed several times in the layer: it is only added once", p)
+			continue
+		}
+		seen[p] = true
 		path := types.Path{
 			Path: p,
 		}
-		var pathOptions types.PathOptions
-		hasPathOptions := false
+		pathOptions := defaultOptions
+		hasPathOptions := !reflect.DeepEqual(defaultOptions, types.PathOptions{})
 		var perms []types.Perm
 		for _, perm := range permPaths {
 			if p == perm.Path {
@@ -25,6 +53,8 @@ func getPaths(storePaths []string, parents []types.Layer, rewrites []types.Rewri
 				perms = append(perms, types.Perm{
 					Regex: perm.Regex,
 					Mode:  perm.Mode,
+					Uname: perm.Uname,
+					Gname: perm.Gname,
 				})
 			}
 		}
@@ -56,48 +86,311 @@ func getPaths(storePaths []string, parents []types.Layer, rewrites []types.Rewri
 	return paths
 }
 
-func NewLayers(storePaths []string, parents []types.Layer, rewrites []types.RewritePath, exclude string, perms []types.PermPath) (layers []types.Layer, err error) {
-	paths := getPaths(storePaths, parents, rewrites, exclude, perms)
-	d, s, err := TarPathsSum(paths)
-	logrus.Infof("Adding %d paths to layer (size:%d digest:%s)", len(paths), s, d.String())
+// NewLayers creates a layer containing the storePaths which are
+// not already part of parents. The layer archive is compressed with
+// compression, by the command set by SetCompressionCommand if any.
+func NewLayers(ctx context.Context, storePaths []string, parents []types.Layer, rewrites []types.RewritePath, exclude string, perms []types.PermPath, defaultOptions types.PathOptions, compression string) (layers []types.Layer, err error) {
+	start := time.Now()
+	mediaType, err := CompressionMediaType(compression)
 	if err != nil {
 		return layers, err
 	}
+	command := compressionCommand
+	if err := checkCompressionCommand(compression, command); err != nil {
+		return layers, err
+	}
+	paths := getPaths(storePaths, parents, rewrites, exclude, perms, defaultOptions)
+	if err := validatePaths(ctx, paths); err != nil {
+		return layers, err
+	}
+	name := statusLayerName(paths)
+	metrics.StartStatusLayer(name)
+	defer func() { metrics.EndStatusLayer(name, err == nil) }()
+	ctx, span := metrics.StartSpan(ctx, "layer", "layer.name", name, "layer.paths", len(paths), "layer.compression", compression)
+	defer func() { span.End(err) }()
+	sum, err := sumPaths(ctx, paths, compression, command)
+	logrus.Infof("Adding %d paths to layer (size:%d digest:%s)", len(paths), sum.size, sum.digest.String())
+	if err != nil {
+		return layers, err
+	}
+	recordLayerMetrics(start, paths, sum.size)
+	span.SetAttributes("layer.digest", sum.digest.String(), "layer.size", sum.size)
 	layers = []types.Layer{
 		types.Layer{
-			Digest:    d.String(),
-			DiffIDs:    d.String(),
-			Size: s,
+			Version:   types.LayerVersion,
+			Digest:    sum.digest.String(),
+			DiffIDs:    sum.diffID.String(),
+			Size: sum.size,
 			Paths:     paths,
-			MediaType: v1.MediaTypeImageLayer,
+			MediaType: mediaType,
+			Compression: compression,
+			CompressionCommand: command,
+			Annotations: sum.annotations,
 		},
 	}
+	if err := writeFileIndex(&layers[0], sum); err != nil {
+		return layers, err
+	}
 	return layers, nil
 }
 
-func NewLayersNonReproducible(storePaths []string, tarDirectory string, parents []types.Layer, rewrites []types.RewritePath, exclude string, perms []types.PermPath) (layers []types.Layer, err error) {
-	paths := getPaths(storePaths, parents, rewrites, exclude, perms)
+// NewLayersNonReproducible is like NewLayers but the layer archive is
+// also written into the tarDirectory. This archive is then used when
+// the layer blob is read.
+func NewLayersNonReproducible(ctx context.Context, storePaths []string, tarDirectory string, parents []types.Layer, rewrites []types.RewritePath, exclude string, perms []types.PermPath, defaultOptions types.PathOptions, compression string) (layers []types.Layer, err error) {
+	start := time.Now()
+	mediaType, err := CompressionMediaType(compression)
+	if err != nil {
+		return layers, err
+	}
+	command := compressionCommand
+	if err := checkCompressionCommand(compression, command); err != nil {
+		return layers, err
+	}
+	paths := getPaths(storePaths, parents, rewrites, exclude, perms, defaultOptions)
+	if err := validatePaths(ctx, paths); err != nil {
+		return layers, err
+	}
+	name := statusLayerName(paths)
+	metrics.StartStatusLayer(name)
+	defer func() { metrics.EndStatusLayer(name, err == nil) }()
+	ctx, span := metrics.StartSpan(ctx, "layer", "layer.name", name, "layer.paths", len(paths), "layer.compression", compression)
+	defer func() { span.End(err) }()
 
 	layerPath := tarDirectory + "/layer.tar"
-	d, s, err := TarPathsWrite(paths, layerPath)
-	logrus.Infof("Adding %d paths to layer (size:%d digest:%s)", len(paths), s, d.String())
+	switch compression {
+	case CompressionNone:
+	case CompressionGzip:
+		layerPath += ".gz"
+	default:
+		layerPath += ".zst"
+	}
+	sum, err := tarPathsCompressedWrite(ctx, paths, compression, command, layerPath)
+	logrus.Infof("Adding %d paths to layer (size:%d digest:%s)", len(paths), sum.size, sum.digest.String())
 	if err != nil {
 		return layers, err
 	}
+	recordLayerMetrics(start, paths, sum.size)
+	span.SetAttributes("layer.digest", sum.digest.String(), "layer.size", sum.size)
 	layers = []types.Layer{
 		types.Layer{
-			Digest:    d.String(),
-			DiffIDs:    d.String(),
-			Size: s,
+			Version:   types.LayerVersion,
+			Digest:    sum.digest.String(),
+			DiffIDs:    sum.diffID.String(),
+			Size: sum.size,
 			Paths:     paths,
-			// TODO: we should use v1.MediaTypeImageLayerGzip instead
-			MediaType: v1.MediaTypeImageLayer,
+			MediaType: mediaType,
 			LayerPath: layerPath,
+			Compression: compression,
+			CompressionCommand: command,
+			Annotations: sum.annotations,
 		},
 	}
+	if err := writeFileIndex(&layers[0], sum); err != nil {
+		return layers, err
+	}
 	return layers, nil
 }
 
+// NewLayerFromFiles creates a layer containing files described in
+// the JSON file. Its digest is computed with the algorithm of the
+// settings of ctx.
+func NewLayerFromFiles(ctx context.Context, files []types.File) (layer types.Layer, err error) {
+	reader, err := TarFiles(files)
+	if err != nil {
+		return layer, err
+	}
+	defer reader.Close()
+	digester := archiveSettingsFrom(ctx).algorithm.Digester()
+	size, err := io.Copy(digester.Hash(), reader)
+	if err != nil {
+		return layer, err
+	}
+	d := digester.Digest()
+	logrus.Infof("Adding %d files to layer (size:%d digest:%s)", len(files), size, d.String())
+	layer = types.Layer{
+		Version:   types.LayerVersion,
+		Digest:    d.String(),
+		DiffIDs:   d.String(),
+		Size:      size,
+		MediaType: v1.MediaTypeImageLayer,
+		Files:     files,
+	}
+	return layer, nil
+}
+
+// NewFileRewritePath returns a RewritePath moving the file path to
+// destination in the layer. This allows to add a single file (for
+// instance a store path created by writeText) at an arbitrary
+// location of the image, without having to wrap it into a directory.
+// Since the replacement is expanded, the $ of destination are escaped.
+func NewFileRewritePath(path, destination string) types.RewritePath {
+	return types.RewritePath{
+		Path:  path,
+		Regex: "^" + regexp.QuoteMeta(path) + "$",
+		Repl:  strings.ReplaceAll(destination, "$", "$$"),
+	}
+}
+
+func recordLayerMetrics(start time.Time, paths types.Paths, size int64) {
+	metrics.LayersBuilt.Inc()
+	metrics.LayerPaths.Add(float64(len(paths)))
+	metrics.LayerBytes.Add(float64(size))
+	metrics.LayerBuildSeconds.Add(time.Since(start).Seconds())
+}
+
+// statusLayerName names the layer of the paths in the status.
+func statusLayerName(paths types.Paths) string {
+	switch len(paths) {
+	case 0:
+		return "empty layer"
+	case 1:
+		return paths[0].Path
+	default:
+		return fmt.Sprintf("%s and %d other paths", paths[0].Path, len(paths)-1)
+	}
+}
+
+// NewPinnedLayer creates a layer only referencing an existing blob
+// by its digest, size and diffID, such as a huge layer published once
+// on a registry. Its blob is never generated. If urls are provided,
+// they are added to the image manifest and the blob is downloaded
+// from them when it needs to be copied.
+func NewPinnedLayer(digest string, diffID string, size int64, mediaType string, urls []string) (layer types.Layer, err error) {
+	layer = types.Layer{
+		URLs:      urls,
+		Version:   types.LayerVersion,
+		Digest:    digest,
+		DiffIDs:   diffID,
+		Size:      size,
+		MediaType: mediaType,
+		Pinned:    true,
+	}
+	if err := layer.Validate(); err != nil {
+		return layer, err
+	}
+	return layer, nil
+}
+
+// PathDuplicate is a store path added to several layers.
+type PathDuplicate struct {
+	Path string
+	// The digests of the layers containing the path
+	Layers []string
+	// The size of the files of the path, stored once per layer:
+	// the copies above the first one are wasted
+	Size int64
+}
+
+// Wasted returns the size of the copies of the path which are
+// overridden by the last one.
+func (d PathDuplicate) Wasted() int64 {
+	return d.Size * int64(len(d.Layers)-1)
+}
+
+// FindPathDuplicates returns the store paths added to several layers,
+// sorted by path. The last layer containing a path overrides its files
+// in the image.
+func FindPathDuplicates(layers []types.Layer) (duplicates []PathDuplicate) {
+	digests := make(map[string][]string)
+	for _, layer := range layers {
+		for _, p := range layer.Paths {
+			digests[p.Path] = append(digests[p.Path], layer.Digest)
+		}
+	}
+	for path, layers := range digests {
+		if len(layers) > 1 {
+			duplicates = append(duplicates, PathDuplicate{Path: path, Layers: layers, Size: diskUsage(path)})
+		}
+	}
+	sort.Slice(duplicates, func(i, j int) bool {
+		return duplicates[i].Path < duplicates[j].Path
+	})
+	return duplicates
+}
+
+// HoistPathDuplicates removes the store paths added to several layers
+// from all of them but the lowest one, which provides them to the
+// layers above. The layers losing paths are generated again to compute
+// their new digests and layers losing all their paths are removed.
+// Only layers built from store paths are modified: a path is kept in
+// the other layers, such as encrypted or pinned layers, and in layers
+// where it has different options. A path is also kept if a layer in
+// between overrides its files, that is if this layer contains the path
+// with other options or a path containing it or contained by it, or if
+// its content is unknown.
+func HoistPathDuplicates(ctx context.Context, layers []types.Layer) ([]types.Layer, error) {
+	modifiable := func(layer types.Layer) bool {
+		return layer.Paths != nil && !layer.Pinned && !IsEncryptedMediaType(layer.MediaType)
+	}
+	hoisted := make([]types.Layer, 0, len(layers))
+	for _, layer := range layers {
+		var paths types.Paths
+		for _, p := range layer.Paths {
+			if modifiable(layer) && isPathProvided(hoisted, p) {
+				logrus.Infof("Removing the path %s from the layer %s: it is provided by a lower layer", p.Path, layer.Digest)
+				continue
+			}
+			paths = append(paths, p)
+		}
+		if len(paths) == len(layer.Paths) {
+			hoisted = append(hoisted, layer)
+			continue
+		}
+		if len(paths) == 0 {
+			logrus.Infof("Removing the layer %s: all its paths are provided by lower layers", layer.Digest)
+			continue
+		}
+		command, err := layerCompressionCommand(layer, nil)
+		if err != nil {
+			return nil, err
+		}
+		sum, err := sumPaths(ctx, paths, layer.Compression, command)
+		if err != nil {
+			return nil, err
+		}
+		logrus.Infof("The layer %s without the duplicated paths is the layer %s (size:%d)", layer.Digest, sum.digest, sum.size)
+		layer.Paths = paths
+		layer.Digest = sum.digest.String()
+		layer.DiffIDs = sum.diffID.String()
+		layer.Size = sum.size
+		layer.Annotations = sum.annotations
+		// The archive of the layer-path and the file index are the
+		// ones of the previous layer: the blob is generated from the
+		// paths
+		layer.LayerPath = ""
+		layer.FileIndex = ""
+		hoisted = append(hoisted, layer)
+	}
+	return hoisted, nil
+}
+
+// isPathProvided returns true if the files of the path are the ones
+// of the topmost layer of layers containing the path, or a path
+// overlapping it: this layer has to contain the path itself, with the
+// same options, and no other overlapping path.
+func isPathProvided(layers []types.Layer, path types.Path) bool {
+	overlap := func(p, q string) bool {
+		return p == q || strings.HasPrefix(p, q+"/") || strings.HasPrefix(q, p+"/")
+	}
+	for i := len(layers) - 1; i >= 0; i-- {
+		// The files of layers without paths are unknown
+		if layers[i].Paths == nil {
+			return false
+		}
+		var overlapping types.Paths
+		for _, p := range layers[i].Paths {
+			if overlap(p.Path, path.Path) {
+				overlapping = append(overlapping, p)
+			}
+		}
+		if len(overlapping) != 0 {
+			return len(overlapping) == 1 && reflect.DeepEqual(overlapping[0], path)
+		}
+	}
+	return false
+}
+
 func isPathInLayers(layers []types.Layer, path types.Path) bool {
 	for _, layer := range layers {
 		for _, p := range layer.Paths {
@@ -108,3 +401,25 @@ func isPathInLayers(layers []types.Layer, path types.Path) bool {
 	}
 	return false
 }
+
+// AppendLayers adds the layers on top of the image, for instance to
+// build a debug variant of an image with a shell at copy time. Layers
+// already part of the image are skipped.
+func AppendLayers(image types.Image, layers []types.Layer) types.Image {
+	digests := make(map[string]bool)
+	for _, layer := range image.Layers {
+		digests[layer.Digest] = true
+	}
+	appended := make([]types.Layer, len(image.Layers), len(image.Layers)+len(layers))
+	copy(appended, image.Layers)
+	for _, layer := range layers {
+		if digests[layer.Digest] {
+			logrus.Infof("Skipping the layer %s already part of the image", layer.Digest)
+			continue
+		}
+		digests[layer.Digest] = true
+		appended = append(appended, layer)
+	}
+	image.Layers = appended
+	return image
+}
@@ -1,10 +1,20 @@
 package nix
 
 import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
 	"reflect"
 	"testing"
 
 	"github.com/nlewo/nix2container/types"
+	digest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 func TestPerms(t *testing.T) {
@@ -18,12 +28,13 @@ func TestPerms(t *testing.T) {
 			Mode: "0641",
 		},
 	}
-	layer, err := NewLayers(paths, []types.Layer{}, []types.RewritePath{}, "", perms)
+	layer, err := NewLayers(context.Background(), paths, []types.Layer{}, []types.RewritePath{}, "", perms, types.PathOptions{}, CompressionNone)
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
 	expected := []types.Layer{
 		types.Layer{
+			Version: types.LayerVersion,
 			Digest: "sha256:1d93274b1a59eed0a471f601a7f87ae58e2860566ed20313043b1efd983e8baa",
 			DiffIDs: "sha256:1d93274b1a59eed0a471f601a7f87ae58e2860566ed20313043b1efd983e8baa",
 			Size: 1536,
@@ -52,12 +63,13 @@ func TestNewLayers(t *testing.T) {
 	paths := []string{
 		"../data/layer1/file1",
 	}
-	layer, err := NewLayers(paths, []types.Layer{}, []types.RewritePath{}, "", []types.PermPath{})
+	layer, err := NewLayers(context.Background(), paths, []types.Layer{}, []types.RewritePath{}, "", []types.PermPath{}, types.PathOptions{}, CompressionNone)
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
 	expected := []types.Layer{
 		types.Layer{
+			Version: types.LayerVersion,
 			Digest: "sha256:38856f8cd2e336497b6257e891ad860ea77e24193a726125445823618aa16cce",
 			DiffIDs: "sha256:38856f8cd2e336497b6257e891ad860ea77e24193a726125445823618aa16cce",
 			Size: 1536,
@@ -74,12 +86,13 @@ func TestNewLayers(t *testing.T) {
 	}
 
 	tmpDir := t.TempDir()
-	layer, err = NewLayersNonReproducible(paths, tmpDir, []types.Layer{}, []types.RewritePath{}, "", []types.PermPath{})
+	layer, err = NewLayersNonReproducible(context.Background(), paths, tmpDir, []types.Layer{}, []types.RewritePath{}, "", []types.PermPath{}, types.PathOptions{}, CompressionNone)
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
 	expected = []types.Layer{
 		types.Layer{
+			Version: types.LayerVersion,
 			Digest: "sha256:38856f8cd2e336497b6257e891ad860ea77e24193a726125445823618aa16cce",
 			DiffIDs: "sha256:38856f8cd2e336497b6257e891ad860ea77e24193a726125445823618aa16cce",
 			Size: 1536,
@@ -96,3 +109,397 @@ func TestNewLayers(t *testing.T) {
 		t.Fatalf("Layers should be '%#v' (while it is %#v)", expected, layer)
 	}
 }
+
+func TestFileRewritePath(t *testing.T) {
+	paths := []string{
+		"../data/layer1/file1",
+	}
+	rewrites := []types.RewritePath{
+		NewFileRewritePath("../data/layer1/file1", "/etc/file1"),
+	}
+	layers, err := NewLayers(context.Background(), paths, []types.Layer{}, rewrites, "", []types.PermPath{}, types.PathOptions{}, CompressionNone)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	reader := TarPaths(layers[0].Paths)
+	defer reader.Close()
+	hdr, err := tar.NewReader(reader).Next()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if hdr.Name != "/etc/file1" {
+		t.Fatalf("The file should be located at /etc/file1 (while it is located at %s)", hdr.Name)
+	}
+
+	// The destination is not expanded
+	rewrites = []types.RewritePath{
+		NewFileRewritePath("../data/layer1/file1", "/etc/$1${name}"),
+	}
+	layers, err = NewLayers(context.Background(), paths, []types.Layer{}, rewrites, "", []types.PermPath{}, types.PathOptions{}, CompressionNone)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	reader = TarPaths(layers[0].Paths)
+	defer reader.Close()
+	hdr, err = tar.NewReader(reader).Next()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if hdr.Name != "/etc/$1${name}" {
+		t.Fatalf("The file should be located at /etc/$1${name} (while it is located at %s)", hdr.Name)
+	}
+}
+
+func TestModePolicy(t *testing.T) {
+	paths := []string{
+		"../data/layer1/file1",
+	}
+	perms := []types.PermPath{
+		types.PermPath{
+			Path:  "../data/layer1/file1",
+			Regex: ".*file1",
+			Mode:  "4755",
+		},
+	}
+	testCases := []struct {
+		perms    []types.PermPath
+		options  types.PathOptions
+		expected int64
+	}{
+		{nil, types.PathOptions{Umask: "077"}, 0600},
+		{perms, types.PathOptions{}, 04755},
+		{perms, types.PathOptions{StripSpecialBits: true}, 04755},
+		{nil, types.PathOptions{StripSpecialBits: true}, 0644},
+	}
+	for _, tc := range testCases {
+		layers, err := NewLayers(context.Background(), paths, []types.Layer{}, []types.RewritePath{}, "", tc.perms, tc.options, CompressionNone)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		reader := TarPaths(layers[0].Paths)
+		hdr, err := tar.NewReader(reader).Next()
+		reader.Close()
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if hdr.Mode != tc.expected {
+			t.Fatalf("Mode should be %o (while it is %o)", tc.expected, hdr.Mode)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	paths := []string{
+		"../data/layer1/file1",
+	}
+	for _, compression := range []string{CompressionZstd, CompressionZstdChunked} {
+		layers, err := NewLayers(context.Background(), paths, []types.Layer{}, []types.RewritePath{}, "", []types.PermPath{}, types.PathOptions{}, compression)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		layer := layers[0]
+		expectedDiffID := "sha256:38856f8cd2e336497b6257e891ad860ea77e24193a726125445823618aa16cce"
+		if layer.DiffIDs != expectedDiffID {
+			t.Fatalf("DiffIDs should be %s (while it is %s)", expectedDiffID, layer.DiffIDs)
+		}
+		if layer.MediaType != v1.MediaTypeImageLayerZstd {
+			t.Fatalf("MediaType should be %s (while it is %s)", v1.MediaTypeImageLayerZstd, layer.MediaType)
+		}
+		if compression == CompressionZstdChunked && len(layer.Annotations) == 0 {
+			t.Fatalf("A zstd:chunked layer should have annotations")
+		}
+		reader, _, err := LayerGetBlob(layer)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		d, err := digest.FromReader(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if d.String() != layer.Digest {
+			t.Fatalf("The blob digest should be %s (while it is %s)", layer.Digest, d)
+		}
+	}
+}
+
+func TestCompressionCommand(t *testing.T) {
+	if _, err := exec.LookPath("gzip"); err != nil {
+		t.Skip("gzip is not available")
+	}
+	paths := []string{
+		"../data/layer1/file1",
+	}
+	SetCompressionCommand([]string{"gzip", "-n"})
+	defer SetCompressionCommand(nil)
+	layers, err := NewLayers(context.Background(), paths, []types.Layer{}, []types.RewritePath{}, "", []types.PermPath{}, types.PathOptions{}, CompressionGzip)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	layer := layers[0]
+	expectedDiffID := "sha256:38856f8cd2e336497b6257e891ad860ea77e24193a726125445823618aa16cce"
+	if layer.DiffIDs != expectedDiffID {
+		t.Fatalf("DiffIDs should be %s (while it is %s)", expectedDiffID, layer.DiffIDs)
+	}
+	if layer.MediaType != v1.MediaTypeImageLayerGzip || !reflect.DeepEqual(layer.CompressionCommand, []string{"gzip", "-n"}) {
+		t.Fatalf("The layer should be compressed by gzip -n (while it is %#v)", layer)
+	}
+	// The command recorded in the layer is not run if it is not
+	// configured
+	SetCompressionCommand(nil)
+	if _, _, err := LayerGetBlob(layer); err == nil {
+		t.Fatalf("The blob should not be generated by a command which is not configured")
+	}
+	tampered := layer
+	tampered.CompressionCommand = []string{"sh", "-c", "touch /tmp/owned"}
+	SetCompressionCommand([]string{"gzip", "-n"})
+	if _, _, err := LayerGetBlob(tampered); err == nil {
+		t.Fatalf("The blob should not be generated by the command of the layer JSON")
+	}
+	// The blob is generated by the configured command
+	reader, _, err := LayerGetBlob(layer)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	d, err := digest.FromReader(reader)
+	reader.Close()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if d.String() != layer.Digest {
+		t.Fatalf("The blob digest should be %s (while it is %s)", layer.Digest, d)
+	}
+
+	SetCompressionCommand([]string{"gzip", "-n"})
+	_, err = NewLayers(context.Background(), paths, []types.Layer{}, []types.RewritePath{}, "", []types.PermPath{}, types.PathOptions{}, CompressionZstdChunked)
+	if err == nil {
+		t.Fatalf("A zstd:chunked layer can not be compressed by a command")
+	}
+	SetCompressionCommand([]string{"false"})
+	_, err = NewLayers(context.Background(), paths, []types.Layer{}, []types.RewritePath{}, "", []types.PermPath{}, types.PathOptions{}, CompressionGzip)
+	if err == nil {
+		t.Fatalf("A failing compression command should fail the layer creation")
+	}
+}
+
+func TestGetPathsDuplicates(t *testing.T) {
+	paths := getPaths([]string{"/nix/store/b", "/nix/store/a", "/nix/store/b"}, []types.Layer{}, []types.RewritePath{}, "", []types.PermPath{}, types.PathOptions{})
+	expected := types.Paths{
+		types.Path{Path: "/nix/store/a"},
+		types.Path{Path: "/nix/store/b"},
+	}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Fatalf("Paths should be '%#v' (while they are %#v)", expected, paths)
+	}
+
+	// The tar format v1 keeps the order of the paths
+	opts := types.PathOptions{TarFormat: types.TarFormatV1}
+	paths = getPaths([]string{"/nix/store/b", "/nix/store/a", "/nix/store/b"}, []types.Layer{}, []types.RewritePath{}, "", []types.PermPath{}, opts)
+	expected = types.Paths{
+		types.Path{Path: "/nix/store/b", Options: &opts},
+		types.Path{Path: "/nix/store/a", Options: &opts},
+	}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Fatalf("Paths should be '%#v' (while they are %#v)", expected, paths)
+	}
+}
+
+func TestFindPathDuplicates(t *testing.T) {
+	layers := []types.Layer{
+		types.Layer{Digest: "sha256:1", Paths: types.Paths{types.Path{Path: "/nix/store/b"}, types.Path{Path: "/nix/store/a"}}},
+		types.Layer{Digest: "sha256:2", Paths: types.Paths{types.Path{Path: "/nix/store/c"}}},
+		types.Layer{Digest: "sha256:3", Paths: types.Paths{types.Path{Path: "/nix/store/b"}}},
+	}
+	duplicates := FindPathDuplicates(layers)
+	expected := []PathDuplicate{
+		PathDuplicate{Path: "/nix/store/b", Layers: []string{"sha256:1", "sha256:3"}},
+	}
+	if !reflect.DeepEqual(duplicates, expected) {
+		t.Fatalf("Duplicates should be '%#v' (while they are %#v)", expected, duplicates)
+	}
+}
+
+func TestHoistPathDuplicates(t *testing.T) {
+	var layers []types.Layer
+	for _, paths := range [][]string{
+		{"../data/tar-directory"},
+		{"../data/tar-directory", "../data/layer1"},
+		{"../data/layer1/file1"},
+		{"../data/tar-directory"},
+	} {
+		l, err := NewLayers(context.Background(), paths, nil, nil, "", nil, types.PathOptions{}, CompressionNone)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		layers = append(layers, l...)
+	}
+	duplicates := FindPathDuplicates(layers)
+	if len(duplicates) != 1 || duplicates[0].Path != "../data/tar-directory" || duplicates[0].Wasted() != 2*duplicates[0].Size || duplicates[0].Size == 0 {
+		t.Fatalf("The path ../data/tar-directory should be duplicated twice (while duplicates are %#v)", duplicates)
+	}
+
+	hoisted, err := HoistPathDuplicates(context.Background(), layers)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(hoisted) != 3 {
+		t.Fatalf("The last layer should be removed (while layers are %#v)", hoisted)
+	}
+	expected, err := NewLayers(context.Background(), []string{"../data/layer1"}, nil, nil, "", nil, types.PathOptions{}, CompressionNone)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !reflect.DeepEqual(hoisted[1], expected[0]) {
+		t.Fatalf("The layer should be '%#v' (while it is %#v)", expected[0], hoisted[1])
+	}
+	if !reflect.DeepEqual(hoisted[0], layers[0]) || !reflect.DeepEqual(hoisted[2], layers[2]) {
+		t.Fatalf("The other layers should not be modified (while layers are %#v)", hoisted)
+	}
+	if len(FindPathDuplicates(hoisted)) != 0 {
+		t.Fatalf("The layers should not have duplicates (while they are %#v)", FindPathDuplicates(hoisted))
+	}
+
+	// The path is kept in the last layer since the layer in between
+	// overrides its files with other options
+	layers = nil
+	for _, options := range []types.PathOptions{{}, {StripSpecialBits: true}, {}} {
+		l, err := NewLayers(context.Background(), []string{"../data/tar-directory"}, nil, nil, "", nil, options, CompressionNone)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		layers = append(layers, l...)
+	}
+	hoisted, err = HoistPathDuplicates(context.Background(), layers)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !reflect.DeepEqual(hoisted, layers) {
+		t.Fatalf("The layers should not be modified (while layers are %#v)", hoisted)
+	}
+}
+
+func TestNewPinnedLayer(t *testing.T) {
+	layer, err := NewPinnedLayer(
+		"sha256:59bf1c3509f33515622619af21ed55bbe26d24913cedbca106468a5fb37a50c3",
+		"sha256:8d3ac3489996423f53d6087c81180006263b79f206d3fdec9e66f0e27ceb8759",
+		2818413, v1.MediaTypeImageLayerGzip, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !layer.Pinned {
+		t.Fatalf("The layer should be pinned")
+	}
+	if _, _, err := LayerGetBlob(layer); err == nil {
+		t.Fatalf("The blob of a pinned layer should not be available")
+	}
+	_, err = NewPinnedLayer(
+		"sha256:59bf1c3509f33515622619af21ed55bbe26d24913cedbca106468a5fb37a50c3",
+		"sha256:8d3ac3489996423f53d6087c81180006263b79f206d3fdec9e66f0e27ceb8759",
+		0, v1.MediaTypeImageLayerGzip, nil)
+	if err == nil {
+		t.Fatalf("A pinned layer without size should not be valid")
+	}
+}
+
+func TestPinnedLayerURLs(t *testing.T) {
+	content := []byte("blob")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/blob" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	d := digest.FromBytes(content).String()
+	urls := []string{server.URL + "/missing", server.URL + "/blob"}
+	layer, err := NewPinnedLayer(d, d, int64(len(content)), v1.MediaTypeImageLayer, urls)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	reader, _, err := LayerGetBlob(layer)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	blob, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if string(blob) != string(content) {
+		t.Fatalf("The blob should be '%s' (while it is %s)", content, blob)
+	}
+
+	// The downloaded blob is verified
+	tampered := layer
+	tampered.Digest = digest.FromString("another blob").String()
+	reader, _, err = LayerGetBlob(tampered)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	_, err = ioutil.ReadAll(reader)
+	reader.Close()
+	if !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("Reading a blob which doesn't match the layer digest should fail (while the error is %v)", err)
+	}
+
+	// The download is stopped when the context is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := LayerGetBlobContext(ctx, layer); err == nil {
+		t.Fatalf("The download should fail once the context is cancelled")
+	}
+
+	manifestBlob, err := GetManifestBlob(types.Image{Layers: []types.Layer{layer}})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var manifest v1.Manifest
+	if err := json.Unmarshal(manifestBlob, &manifest); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !reflect.DeepEqual(manifest.Layers[0].URLs, urls) {
+		t.Fatalf("URLs should be '%#v' (while they are %#v)", urls, manifest.Layers[0].URLs)
+	}
+
+	if _, err := NewPinnedLayer(d, d, int64(len(content)), v1.MediaTypeImageLayer, []string{"file:///blob"}); err == nil {
+		t.Fatalf("A layer with a non HTTP URL should not be valid")
+	}
+}
+
+func TestAppendLayers(t *testing.T) {
+	image := types.Image{
+		Layers: []types.Layer{{Digest: "sha256:a"}, {Digest: "sha256:b"}},
+	}
+	debug := AppendLayers(image, []types.Layer{{Digest: "sha256:b"}, {Digest: "sha256:c"}})
+	var digests []string
+	for _, layer := range debug.Layers {
+		digests = append(digests, layer.Digest)
+	}
+	expected := []string{"sha256:a", "sha256:b", "sha256:c"}
+	if !reflect.DeepEqual(digests, expected) {
+		t.Fatalf("Layers should be '%#v' (while they are %#v)", expected, digests)
+	}
+	if len(image.Layers) != 2 {
+		t.Fatalf("The original image should not be modified (while it has %d layers)", len(image.Layers))
+	}
+}
+
+func TestLayerArchiveSettings(t *testing.T) {
+	ctx := withArchiveSettings(context.Background(), archiveSettings{algorithm: digest.SHA512, strict: true})
+	layer, err := NewLayerFromFiles(ctx, []types.File{types.File{Path: "/etc/motd", Content: "hello"}})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if algorithm := digest.Digest(layer.Digest).Algorithm(); algorithm != digest.SHA512 {
+		t.Fatalf("The digest of the layer should be computed with sha512 (while it is %s)", algorithm)
+	}
+	paths := types.Paths{types.Path{Path: "../data/tar-directory"}}
+	if err := validatePaths(ctx, paths); err == nil {
+		t.Fatalf("A path which is not a store path should be rejected with the strict reproducibility of the context")
+	}
+	if err := validatePaths(context.Background(), paths); err != nil {
+		t.Fatalf("%v", err)
+	}
+}
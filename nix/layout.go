@@ -0,0 +1,205 @@
+package nix
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+)
+
+// WriteOCILayout writes the image into the OCI image layout
+// directory, which is created if needed. The image manifest is added
+// to the layout index with the reference name refName (if not
+// empty). The descriptor of the image manifest is returned.
+func WriteOCILayout(ctx context.Context, image types.Image, directory string, refName string) (desc v1.Descriptor, err error) {
+	return writeOCILayout(ctx, image, directory, refName, func(layer types.Layer) (io.ReadCloser, error) {
+		rc, _, err := LayerGetBlob(layer)
+		return rc, err
+	})
+}
+
+// WriteOCILayoutFromCache is like WriteOCILayout but the layers built
+// from store paths are read from the cache.
+func WriteOCILayoutFromCache(ctx context.Context, cache *BlobCache, image types.Image, directory string, refName string) (desc v1.Descriptor, err error) {
+	return writeOCILayout(ctx, image, directory, refName, func(layer types.Layer) (io.ReadCloser, error) {
+		rc, _, err := cache.GetBlob(ctx, image, godigest.Digest(layer.Digest))
+		return rc, err
+	})
+}
+
+func writeOCILayout(ctx context.Context, image types.Image, directory string, refName string, getBlob func(layer types.Layer) (io.ReadCloser, error)) (desc v1.Descriptor, err error) {
+	if err := os.MkdirAll(filepath.Join(directory, "blobs"), 0755); err != nil {
+		return desc, err
+	}
+	layout, err := json.Marshal(v1.ImageLayout{Version: v1.ImageLayoutVersion})
+	if err != nil {
+		return desc, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(directory, v1.ImageLayoutFile), layout, 0644); err != nil {
+		return desc, err
+	}
+
+	for _, layer := range image.Layers {
+		if ctx.Err() != nil {
+			return desc, ctx.Err()
+		}
+		rc, err := getBlob(layer)
+		if err != nil {
+			return desc, err
+		}
+		err = writeLayoutBlob(directory, godigest.Digest(layer.Digest), rc)
+		rc.Close()
+		if err != nil {
+			return desc, err
+		}
+	}
+	config, err := GetConfigBlob(image)
+	if err != nil {
+		return desc, err
+	}
+	if _, err := writeLayoutBlobBytes(directory, config); err != nil {
+		return desc, err
+	}
+	manifest, err := GetManifestBlob(image)
+	if err != nil {
+		return desc, err
+	}
+	desc, err = writeLayoutBlobBytes(directory, manifest)
+	if err != nil {
+		return desc, err
+	}
+	desc.MediaType = v1.MediaTypeImageManifest
+	if refName != "" {
+		desc.Annotations = map[string]string{v1.AnnotationRefName: refName}
+	}
+	if err := addLayoutManifest(directory, desc); err != nil {
+		return desc, err
+	}
+	logrus.Infof("Image has been written to the OCI layout %s", directory)
+	return desc, nil
+}
+
+// referrerManifest is an image manifest with a subject, as defined by
+// the version 1.1 of the OCI image specification.
+type referrerManifest struct {
+	v1.Manifest
+	ArtifactType string         `json:"artifactType,omitempty"`
+	Subject      *v1.Descriptor `json:"subject,omitempty"`
+}
+
+// emptyJSON is the content of the empty descriptor used as config of
+// artifacts.
+var emptyJSON = []byte("{}")
+
+// newReferrerManifest returns the manifest of an artifact whose
+// subject is the manifest described by subject. The artifact contains
+// a single blob, content, with the mediaType and its config is the
+// empty JSON.
+func newReferrerManifest(subject v1.Descriptor, artifactType string, mediaType string, content []byte) ([]byte, error) {
+	subject.Annotations = nil
+	m := referrerManifest{
+		Manifest: v1.Manifest{
+			MediaType: v1.MediaTypeImageManifest,
+			Config: v1.Descriptor{
+				MediaType: "application/vnd.oci.empty.v1+json",
+				Digest:    godigest.FromBytes(emptyJSON),
+				Size:      int64(len(emptyJSON)),
+			},
+			Layers: []v1.Descriptor{{
+				MediaType: mediaType,
+				Digest:    godigest.FromBytes(content),
+				Size:      int64(len(content)),
+			}},
+		},
+		ArtifactType: artifactType,
+		Subject:      &subject,
+	}
+	m.SchemaVersion = 2
+	return json.Marshal(m)
+}
+
+// AddOCILayoutReferrer adds to the OCI layout directory an artifact
+// whose subject is the manifest described by subject. The artifact
+// contains a single blob with the mediaType.
+func AddOCILayoutReferrer(directory string, subject v1.Descriptor, artifactType string, mediaType string, content []byte) (desc v1.Descriptor, err error) {
+	for _, blob := range [][]byte{content, emptyJSON} {
+		if _, err := writeLayoutBlobBytes(directory, blob); err != nil {
+			return desc, err
+		}
+	}
+	manifest, err := newReferrerManifest(subject, artifactType, mediaType, content)
+	if err != nil {
+		return desc, err
+	}
+	desc, err = writeLayoutBlobBytes(directory, manifest)
+	if err != nil {
+		return desc, err
+	}
+	desc.MediaType = v1.MediaTypeImageManifest
+	return desc, addLayoutManifest(directory, desc)
+}
+
+func layoutBlobPath(directory string, digest godigest.Digest) string {
+	return filepath.Join(directory, "blobs", digest.Algorithm().String(), digest.Encoded())
+}
+
+func writeLayoutBlobBytes(directory string, content []byte) (desc v1.Descriptor, err error) {
+	desc.Digest = godigest.FromBytes(content)
+	desc.Size = int64(len(content))
+	filename := layoutBlobPath(directory, desc.Digest)
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return desc, err
+	}
+	return desc, ioutil.WriteFile(filename, content, 0644)
+}
+
+// writeLayoutBlob writes the blob read from r into the layout. The
+// blob is only renamed to its final location if its content matches
+// the digest.
+func writeLayoutBlob(directory string, digest godigest.Digest, r io.Reader) error {
+	store, err := newDirBlobStore(filepath.Join(directory, "blobs"))
+	if err != nil {
+		return err
+	}
+	return store.Put(context.Background(), digest, r, -1)
+}
+
+// addLayoutManifest adds the manifest descriptor to the index of the
+// layout. A manifest with the same reference name is replaced.
+func addLayoutManifest(directory string, desc v1.Descriptor) error {
+	indexPath := filepath.Join(directory, "index.json")
+	index := v1.Index{
+		MediaType: v1.MediaTypeImageIndex,
+		Manifests: []v1.Descriptor{},
+	}
+	index.SchemaVersion = 2
+	content, err := ioutil.ReadFile(indexPath)
+	if err == nil {
+		if err := json.Unmarshal(content, &index); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	refName := desc.Annotations[v1.AnnotationRefName]
+	var manifests []v1.Descriptor
+	for _, m := range index.Manifests {
+		if m.Digest == desc.Digest || (refName != "" && m.Annotations[v1.AnnotationRefName] == refName) {
+			continue
+		}
+		manifests = append(manifests, m)
+	}
+	index.Manifests = append(manifests, desc)
+	content, err = json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(indexPath, content, 0644)
+}
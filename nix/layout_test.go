@@ -0,0 +1,68 @@
+package nix
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/nlewo/nix2container/types"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestWriteOCILayout(t *testing.T) {
+	paths := []string{
+		"../data/layer1/file1",
+	}
+	layers, err := NewLayers(context.Background(), paths, []types.Layer{}, []types.RewritePath{}, "", []types.PermPath{}, types.PathOptions{}, CompressionNone)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	image := types.Image{Layers: layers}
+	directory := t.TempDir()
+	desc, err := WriteOCILayout(context.Background(), image, directory, "latest")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := os.Stat(layoutBlobPath(directory, desc.Digest)); err != nil {
+		t.Fatalf("%v", err)
+	}
+	referrer, err := AddOCILayoutReferrer(directory, desc, "application/vnd.nix2container.scan.v1", "application/json", []byte("{}"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	content, err := ioutil.ReadFile(directory + "/index.json")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var index v1.Index
+	if err := json.Unmarshal(content, &index); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(index.Manifests) != 2 || index.Manifests[0].Annotations[v1.AnnotationRefName] != "latest" || index.Manifests[1].Digest != referrer.Digest {
+		t.Fatalf("The index should contain the image and its referrer (while it is %#v)", index)
+	}
+	content, err = ioutil.ReadFile(layoutBlobPath(directory, referrer.Digest))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var m referrerManifest
+	if err := json.Unmarshal(content, &m); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if m.Subject == nil || m.Subject.Digest != desc.Digest {
+		t.Fatalf("The referrer subject should be the image manifest (while it is %#v)", m.Subject)
+	}
+	if m.ArtifactType != "application/vnd.nix2container.scan.v1" {
+		t.Fatalf("The referrer artifact type should be 'application/vnd.nix2container.scan.v1' (while it is %s)", m.ArtifactType)
+	}
+
+	// Writing the image again replaces the manifest with the same
+	// reference name
+	_, err = WriteOCILayout(context.Background(), image, directory, "latest")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+}
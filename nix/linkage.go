@@ -0,0 +1,258 @@
+package nix
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/nlewo/nix2container/types"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultLibraryDirs are the directories searched by the dynamic
+// loader after the RUNPATH of an object, for images which are not
+// only made of store paths.
+var defaultLibraryDirs = []string{"/lib", "/usr/lib", "/lib64", "/usr/lib64"}
+
+// multiarchLibraryDirs are the Debian multiarch directories of the
+// machines, also searched by the dynamic loader.
+var multiarchLibraryDirs = map[elf.Machine][]string{
+	elf.EM_X86_64:  {"/lib/x86_64-linux-gnu", "/usr/lib/x86_64-linux-gnu"},
+	elf.EM_AARCH64: {"/lib/aarch64-linux-gnu", "/usr/lib/aarch64-linux-gnu"},
+	elf.EM_386:     {"/lib/i386-linux-gnu", "/usr/lib/i386-linux-gnu"},
+	elf.EM_ARM:     {"/lib/arm-linux-gnueabihf", "/usr/lib/arm-linux-gnueabihf"},
+}
+
+// MissingLibrary is a shared library needed by an object of the
+// image which can not be found in the image.
+type MissingLibrary struct {
+	// The DT_NEEDED entry or the PT_INTERP program interpreter,
+	// such as libssl.so.3
+	Library string
+	// The object needing the library, such as the entrypoint
+	NeededBy string
+}
+
+func (m MissingLibrary) String() string {
+	return fmt.Sprintf("%s (needed by %s)", m.Library, m.NeededBy)
+}
+
+// elfObject is a dynamically linked object of the image.
+type elfObject struct {
+	interpreter string
+	needed      []string
+	// The RUNPATH, or the RPATH if there is no RUNPATH
+	runpath []string
+	machine elf.Machine
+}
+
+func parseELF(content []byte) (object elfObject, err error) {
+	f, err := elf.NewFile(bytes.NewReader(content))
+	if err != nil {
+		return object, err
+	}
+	defer f.Close()
+	object.machine = f.Machine
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_INTERP {
+			continue
+		}
+		interpreter, err := ioutil.ReadAll(prog.Open())
+		if err != nil {
+			return object, err
+		}
+		object.interpreter = strings.TrimRight(string(interpreter), "\x00")
+	}
+	// Static executables have no dynamic section
+	if f.Section(".dynamic") == nil {
+		return object, nil
+	}
+	object.needed, err = f.DynString(elf.DT_NEEDED)
+	if err != nil {
+		return object, err
+	}
+	runpath, err := f.DynString(elf.DT_RUNPATH)
+	if err != nil {
+		return object, err
+	}
+	if len(runpath) == 0 {
+		runpath, err = f.DynString(elf.DT_RPATH)
+		if err != nil {
+			return object, err
+		}
+	}
+	for _, r := range runpath {
+		object.runpath = append(object.runpath, strings.Split(r, ":")...)
+	}
+	return object, nil
+}
+
+// readImageFiles reads the content of the files of the image, each
+// layer being read once.
+func readImageFiles(ctx context.Context, image types.Image, files map[string]imageEntry, names []string) (map[string][]byte, error) {
+	byLayer := make(map[int]map[string]bool)
+	for _, name := range names {
+		layer := files[name].layer
+		if byLayer[layer] == nil {
+			byLayer[layer] = make(map[string]bool)
+		}
+		byLayer[layer][name] = true
+	}
+	contents := make(map[string][]byte)
+	for layer, wanted := range byLayer {
+		remaining := len(wanted)
+		err := forEachLayerEntry(ctx, image.Layers[layer], func(hdr *tar.Header, r io.Reader) error {
+			if !wanted[hdr.Name] {
+				return nil
+			}
+			content, err := ioutil.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			contents[hdr.Name] = content
+			remaining--
+			if remaining == 0 {
+				return errEntryFound
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, errEntryFound) {
+			return nil, err
+		}
+	}
+	return contents, nil
+}
+
+// findLibrary searches the library needed by the object at
+// objectPath, as the dynamic loader does: in the RUNPATH of the
+// object ($ORIGIN being the directory of the object), in the
+// LD_LIBRARY_PATH of the image configuration and then in the
+// default directories.
+func findLibrary(files map[string]imageEntry, image types.Image, objectPath string, object elfObject, library string) (string, bool) {
+	if strings.Contains(library, "/") {
+		resolved, entry, ok := resolveImagePath(files, library)
+		return resolved, ok && entry.typeflag == tar.TypeReg
+	}
+	var dirs []string
+	for _, dir := range object.runpath {
+		dirs = append(dirs, strings.NewReplacer("${ORIGIN}", path.Dir(objectPath), "$ORIGIN", path.Dir(objectPath)).Replace(dir))
+	}
+	for _, env := range image.ImageConfig.Env {
+		if strings.HasPrefix(env, "LD_LIBRARY_PATH=") {
+			dirs = append(dirs, strings.Split(strings.TrimPrefix(env, "LD_LIBRARY_PATH="), ":")...)
+		}
+	}
+	dirs = append(dirs, multiarchLibraryDirs[object.machine]...)
+	dirs = append(dirs, defaultLibraryDirs...)
+	for _, dir := range dirs {
+		if !path.IsAbs(dir) {
+			continue
+		}
+		resolved, entry, ok := resolveImagePath(files, path.Join(dir, library))
+		if ok && entry.typeflag == tar.TypeReg {
+			return resolved, true
+		}
+	}
+	return "", false
+}
+
+// AuditLinkage checks the shared libraries of the executable of the
+// Entrypoint (or of the Cmd), and of the libraries they need, can be
+// found in the image: the program interpreter and the DT_NEEDED
+// libraries are searched as the dynamic loader does. Scripts and
+// static executables have no libraries to audit. The libraries which
+// can not be found are returned.
+func AuditLinkage(ctx context.Context, image types.Image) (missing []MissingLibrary, err error) {
+	executable := entrypointExecutable(image)
+	if executable == "" {
+		return nil, nil
+	}
+	files, _, err := imageFiles(ctx, image)
+	if err != nil {
+		return nil, err
+	}
+	resolved, _, _, ok := lookupExecutable(files, image, executable)
+	if !ok {
+		logrus.Warnf("The linkage of the entrypoint %s can not be audited: it is not in the image layers", executable)
+		return nil, nil
+	}
+
+	// The objects are read level by level, so that each layer is
+	// read once per level of the dependency tree
+	visited := map[string]bool{resolved: true}
+	level := []string{resolved}
+	for len(level) > 0 {
+		var names []string
+		for _, p := range level {
+			names = append(names, normalizeEntryName(p))
+		}
+		contents, err := readImageFiles(ctx, image, files, names)
+		if err != nil {
+			return missing, err
+		}
+		var next []string
+		for _, objectPath := range level {
+			content := contents[normalizeEntryName(objectPath)]
+			if !bytes.HasPrefix(content, []byte(elf.ELFMAG)) {
+				if objectPath == resolved {
+					logrus.Infof("The entrypoint %s is not an ELF executable: its linkage is not audited", executable)
+				}
+				continue
+			}
+			object, err := parseELF(content)
+			if err != nil {
+				return missing, fmt.Errorf("Could not parse the ELF object %s: %w", objectPath, err)
+			}
+			needed := object.needed
+			if object.interpreter != "" {
+				needed = append([]string{object.interpreter}, needed...)
+			}
+			for _, library := range needed {
+				libraryPath, ok := findLibrary(files, image, objectPath, object, library)
+				if !ok {
+					missing = append(missing, MissingLibrary{Library: library, NeededBy: objectPath})
+					continue
+				}
+				if !visited[libraryPath] {
+					visited[libraryPath] = true
+					next = append(next, libraryPath)
+				}
+			}
+		}
+		sort.Strings(next)
+		level = next
+	}
+	return missing, nil
+}
+
+// CheckLinkage fails if shared libraries of the entrypoint are
+// missing from the image, see AuditLinkage. When some layers can not
+// be read, such as pinned layers, missing libraries are only
+// reported as warnings.
+func CheckLinkage(ctx context.Context, image types.Image) error {
+	missing, err := AuditLinkage(ctx, image)
+	if err != nil {
+		return err
+	}
+	for _, m := range missing {
+		logrus.Warnf("Missing shared library %s", m)
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	for _, layer := range image.Layers {
+		if layer.Pinned || IsEncryptedMediaType(layer.MediaType) {
+			logrus.Warnf("Some layers can not be read, such as pinned or encrypted layers: the missing shared libraries may be provided by them")
+			return nil
+		}
+	}
+	return fmt.Errorf("%d shared libraries needed by the entrypoint %s are missing from the image", len(missing), entrypointExecutable(image))
+}
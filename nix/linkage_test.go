@@ -0,0 +1,127 @@
+package nix
+
+import (
+	"bytes"
+	"context"
+	"debug/elf"
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/nlewo/nix2container/types"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// testELF builds a minimal x86_64 ELF object with a program
+// interpreter (if set), DT_NEEDED entries and a RUNPATH.
+func testELF(interpreter string, needed []string, runpath string) []byte {
+	const headerSize, progSize, sectionSize = 64, 56, 64
+	dynstr := []byte{0}
+	addString := func(s string) uint64 {
+		offset := uint64(len(dynstr))
+		dynstr = append(append(dynstr, s...), 0)
+		return offset
+	}
+	var dynamic []elf.Dyn64
+	for _, n := range needed {
+		dynamic = append(dynamic, elf.Dyn64{Tag: int64(elf.DT_NEEDED), Val: addString(n)})
+	}
+	if runpath != "" {
+		dynamic = append(dynamic, elf.Dyn64{Tag: int64(elf.DT_RUNPATH), Val: addString(runpath)})
+	}
+	dynamic = append(dynamic, elf.Dyn64{Tag: int64(elf.DT_NULL)})
+	var dynamicData bytes.Buffer
+	binary.Write(&dynamicData, binary.LittleEndian, dynamic)
+	shstrtab := []byte("\x00.dynstr\x00.dynamic\x00.shstrtab\x00")
+	interp := []byte(interpreter + "\x00")
+
+	interpOffset := uint64(headerSize + progSize)
+	dynstrOffset := interpOffset + uint64(len(interp))
+	dynamicOffset := dynstrOffset + uint64(len(dynstr))
+	shstrtabOffset := dynamicOffset + uint64(dynamicData.Len())
+	sectionsOffset := shstrtabOffset + uint64(len(shstrtab))
+
+	var buf bytes.Buffer
+	header := elf.Header64{
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(elf.EM_X86_64),
+		Version:   uint32(elf.EV_CURRENT),
+		Phoff:     headerSize,
+		Shoff:     sectionsOffset,
+		Ehsize:    headerSize,
+		Phentsize: progSize,
+		Phnum:     1,
+		Shentsize: sectionSize,
+		Shnum:     4,
+		Shstrndx:  3,
+	}
+	copy(header.Ident[:], elf.ELFMAG)
+	header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	binary.Write(&buf, binary.LittleEndian, header)
+	prog := elf.Prog64{Type: uint32(elf.PT_INTERP), Off: interpOffset, Filesz: uint64(len(interp)), Memsz: uint64(len(interp))}
+	if interpreter == "" {
+		prog.Type = uint32(elf.PT_NULL)
+	}
+	binary.Write(&buf, binary.LittleEndian, prog)
+	buf.Write(interp)
+	buf.Write(dynstr)
+	buf.Write(dynamicData.Bytes())
+	buf.Write(shstrtab)
+	sections := []elf.Section64{
+		{},
+		{Name: 1, Type: uint32(elf.SHT_STRTAB), Off: dynstrOffset, Size: uint64(len(dynstr))},
+		{Name: 9, Type: uint32(elf.SHT_DYNAMIC), Off: dynamicOffset, Size: uint64(dynamicData.Len()), Link: 1, Entsize: 16},
+		{Name: 18, Type: uint32(elf.SHT_STRTAB), Off: shstrtabOffset, Size: uint64(len(shstrtab))},
+	}
+	binary.Write(&buf, binary.LittleEndian, sections)
+	return buf.Bytes()
+}
+
+func TestAuditLinkage(t *testing.T) {
+	loader := "/nix/store/hash-glibc/lib/ld-linux-x86-64.so.2"
+	image := types.Image{
+		ImageConfig: v1.ImageConfig{Entrypoint: []string{"/nix/store/hash-app/bin/app"}},
+		Layers: []types.Layer{
+			types.Layer{
+				Digest:    "sha256:files",
+				MediaType: "application/vnd.oci.image.layer.v1.tar",
+				Files: []types.File{
+					types.File{Path: "/nix/store/hash-app/bin/app", Mode: "0755", Content: string(testELF(loader, []string{"libapp.so", "libc.so.6"}, "$ORIGIN/../lib:/nix/store/hash-glibc/lib"))},
+					types.File{Path: "/nix/store/hash-app/lib/libapp.so", Mode: "0644", Content: string(testELF("", []string{"libssl.so.3", "libc.so.6"}, "/nix/store/hash-glibc/lib"))},
+					types.File{Path: "/nix/store/hash-glibc/lib/libc.so.6", Mode: "0644", Content: string(testELF("", nil, ""))},
+					types.File{Path: loader, Mode: "0755", Content: string(testELF("", nil, ""))},
+				},
+			},
+		},
+	}
+	missing, err := AuditLinkage(context.Background(), image)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := []MissingLibrary{
+		MissingLibrary{Library: "libssl.so.3", NeededBy: "/nix/store/hash-app/lib/libapp.so"},
+	}
+	if !reflect.DeepEqual(missing, expected) {
+		t.Fatalf("Missing libraries should be '%#v' (while they are %#v)", expected, missing)
+	}
+	if err := CheckLinkage(context.Background(), image); err == nil {
+		t.Fatalf("The linkage check should fail")
+	}
+
+	// The library is found in the LD_LIBRARY_PATH
+	image.ImageConfig.Env = []string{"LD_LIBRARY_PATH=/opt/lib"}
+	image.Layers[0].Files = append(image.Layers[0].Files, types.File{Path: "/opt/lib/libssl.so.3", Mode: "0644", Content: string(testELF("", nil, ""))})
+	if err := CheckLinkage(context.Background(), image); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Scripts are not audited
+	image.ImageConfig.Entrypoint = []string{"/bin/script"}
+	image.Layers[0].Files = append(image.Layers[0].Files, types.File{Path: "/bin/script", Mode: "0755", Content: "#!/bin/sh\n"})
+	missing, err = AuditLinkage(context.Background(), image)
+	if err != nil || len(missing) != 0 {
+		t.Fatalf("A script should not have missing libraries (while it is %#v, %v)", missing, err)
+	}
+}
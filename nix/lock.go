@@ -0,0 +1,50 @@
+//go:build !windows
+// +build !windows
+
+package nix
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"time"
+)
+
+// lockRetryInterval is the interval between two attempts to take a
+// file lock held by another process.
+const lockRetryInterval = 50 * time.Millisecond
+
+// lockFile takes an exclusive lock on filename, which is created if
+// needed, waiting until the lock is available or ctx is done. The
+// lock is released by calling the returned function. Such locks are
+// shared across processes: concurrent nix2container or Skopeo
+// invocations using the same cache wait for each other instead of
+// duplicating work.
+func lockFile(ctx context.Context, filename string) (func(), error) {
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	// The lock is taken without blocking, so that a cancelled
+	// build doesn't wait for another process holding it
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK && err != syscall.EINTR {
+			f.Close()
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, ctx.Err()
+		case <-time.After(lockRetryInterval):
+		}
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
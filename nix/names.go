@@ -0,0 +1,178 @@
+package nix
+
+import (
+	"archive/tar"
+	"fmt"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/nlewo/nix2container/types"
+	"golang.org/x/text/unicode/norm"
+)
+
+// unsafeName returns why the name of an archive entry could be
+// misinterpreted by the tools extracting the archive, or an empty
+// string if it is safe. Relative elements are allowed in symlink
+// targets.
+func unsafeName(name string, symlinkTarget bool) string {
+	if !utf8.ValidString(name) {
+		return "invalid UTF-8"
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return "control characters"
+		}
+	}
+	if !symlinkTarget {
+		for _, elt := range strings.Split(name, "/") {
+			if elt == ".." || elt == "." {
+				return "relative path elements"
+			}
+		}
+	}
+	if !norm.NFC.IsNormalString(name) {
+		return "not NFC normalized"
+	}
+	return ""
+}
+
+// sanitizeName replaces the control characters and the invalid UTF-8
+// sequences of name by underscores and normalizes it to the NFC
+// form. The . and .. elements of entry names are removed, keeping
+// the leading slash if any.
+func sanitizeName(name string, symlinkTarget bool) string {
+	name = strings.ToValidUTF8(name, "_")
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return '_'
+		}
+		return r
+	}, name)
+	if !symlinkTarget {
+		cleaned := path.Clean("/" + name)
+		if !strings.HasPrefix(name, "/") {
+			cleaned = strings.TrimPrefix(cleaned, "/")
+		}
+		name = cleaned
+	}
+	return norm.NFC.String(name)
+}
+
+// symlinkEscapes returns true if the target of the symlink name
+// refers to a file outside of the archive root, such as
+// ../../etc/passwd. Absolute targets are resolved in the root of
+// containers, but naive extractors resolve them on the host: they
+// are only reported if they contain .. elements.
+func symlinkEscapes(name string, target string) bool {
+	dir := path.Dir("/" + strings.TrimPrefix(name, "/"))
+	if path.IsAbs(target) {
+		dir = "/"
+	}
+	depth := strings.Count(strings.Trim(dir, "/"), "/") + 1
+	if dir == "/" {
+		depth = 0
+	}
+	for _, elt := range strings.Split(target, "/") {
+		switch elt {
+		case "", ".":
+		case "..":
+			if path.IsAbs(target) {
+				return true
+			}
+			depth--
+			if depth < 0 {
+				return true
+			}
+		default:
+			depth++
+		}
+	}
+	return false
+}
+
+// applyNamePolicy checks the name and the link target of the archive
+// entry of the file path according to the policy: unsafe names (with
+// control characters, invalid UTF-8, . or .. elements or not in the
+// NFC form) and symlinks escaping the archive root are either kept,
+// rejected, or sanitized. The target of hardlinks, which is an entry
+// name, is handled as the entry names. Escaping symlinks can not be
+// sanitized.
+func applyNamePolicy(hdr *tar.Header, path string, policy string, audit auditFunc) error {
+	if policy == "" || policy == types.NamePolicyKeep {
+		return nil
+	}
+	if hdr.Typeflag == tar.TypeSymlink && symlinkEscapes(hdr.Name, hdr.Linkname) {
+		return fmt.Errorf("The symlink %s of the file %s points outside of the archive root (%s)", hdr.Name, path, hdr.Linkname)
+	}
+	fields := []*string{&hdr.Name}
+	if hdr.Typeflag == tar.TypeSymlink || hdr.Typeflag == tar.TypeLink {
+		fields = append(fields, &hdr.Linkname)
+	}
+	for i, field := range fields {
+		symlinkTarget := i == 1 && hdr.Typeflag == tar.TypeSymlink
+		reason := unsafeName(*field, symlinkTarget)
+		if reason == "" {
+			continue
+		}
+		if policy == types.NamePolicyReject {
+			return fmt.Errorf("The name %q of the file %s is unsafe (%s)", *field, path, reason)
+		}
+		sanitized := sanitizeName(*field, symlinkTarget)
+		if audit != nil {
+			audit("name-policy sanitize", hdr.Name, fmt.Sprintf("%q -> %q", *field, sanitized))
+		}
+		*field = sanitized
+	}
+	return nil
+}
+
+// applyAbsoluteSymlinksPolicy handles the symlink of the archive entry
+// of the file path if its target is absolute: it is kept, rejected,
+// or rewritten relative to the directory of the symlink. Absolute
+// targets are resolved in the root of containers, but naive extractors
+// resolve them on the host.
+func applyAbsoluteSymlinksPolicy(hdr *tar.Header, path string, policy string, audit auditFunc) error {
+	if hdr.Typeflag != tar.TypeSymlink || !strings.HasPrefix(hdr.Linkname, "/") {
+		return nil
+	}
+	switch policy {
+	case types.AbsoluteSymlinksReject:
+		return fmt.Errorf("The symlink %s of the file %s has the absolute target %s", hdr.Name, path, hdr.Linkname)
+	case types.AbsoluteSymlinksRelativize:
+		relative := relativeTarget(hdr.Name, hdr.Linkname)
+		if audit != nil {
+			audit("absolute-symlinks relativize", hdr.Name, fmt.Sprintf("%s -> %s", hdr.Linkname, relative))
+		}
+		hdr.Linkname = relative
+	}
+	return nil
+}
+
+// relativeTarget returns the absolute target of the symlink name
+// relative to the directory of the symlink, both being resolved in the
+// archive root.
+func relativeTarget(name string, target string) string {
+	split := func(p string) []string {
+		if p == "/" {
+			return nil
+		}
+		return strings.Split(strings.TrimPrefix(p, "/"), "/")
+	}
+	dir := split(path.Dir("/" + strings.TrimPrefix(name, "/")))
+	elts := split(path.Clean(target))
+	common := 0
+	for common < len(dir) && common < len(elts) && dir[common] == elts[common] {
+		common++
+	}
+	var relative []string
+	for range dir[common:] {
+		relative = append(relative, "..")
+	}
+	relative = append(relative, elts[common:]...)
+	if len(relative) == 0 {
+		return "."
+	}
+	return strings.Join(relative, "/")
+}
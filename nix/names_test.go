@@ -0,0 +1,195 @@
+package nix
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/nlewo/nix2container/types"
+)
+
+func TestUnsafeName(t *testing.T) {
+	testCases := []struct {
+		name          string
+		symlinkTarget bool
+		reason        string
+		sanitized     string
+	}{
+		{"/nix/store/abc-pkg/bin/app", false, "", "/nix/store/abc-pkg/bin/app"},
+		{"/etc/a\tb", false, "control characters", "/etc/a_b"},
+		{"/etc/a\xffb", false, "invalid UTF-8", "/etc/a_b"},
+		{"/etc/cafe\u0301", false, "not NFC normalized", "/etc/caf\u00e9"},
+		{"nix/store/../../etc/passwd", false, "relative path elements", "etc/passwd"},
+		{"../lib/libapp.so", true, "", "../lib/libapp.so"},
+		{"../lib/a\nb", true, "control characters", "../lib/a_b"},
+	}
+	for _, testCase := range testCases {
+		reason := unsafeName(testCase.name, testCase.symlinkTarget)
+		if reason != testCase.reason {
+			t.Fatalf("The reason of %q should be '%#v' (while it is %#v)", testCase.name, testCase.reason, reason)
+		}
+		sanitized := sanitizeName(testCase.name, testCase.symlinkTarget)
+		if sanitized != testCase.sanitized {
+			t.Fatalf("%q should be sanitized to '%#v' (while it is %#v)", testCase.name, testCase.sanitized, sanitized)
+		}
+	}
+}
+
+func TestSymlinkEscapes(t *testing.T) {
+	testCases := []struct {
+		name    string
+		target  string
+		escapes bool
+	}{
+		{"/nix/store/abc-pkg/lib/link", "../../def-pkg/lib/libc.so", false},
+		{"/nix/store/abc-pkg/lib/link", "../../../../../etc/passwd", true},
+		{"nix/store/abc-pkg/link", "/nix/store/def-pkg", false},
+		{"nix/store/abc-pkg/link", "/../../etc/passwd", true},
+		{"link", "../etc", true},
+	}
+	for _, testCase := range testCases {
+		if escapes := symlinkEscapes(testCase.name, testCase.target); escapes != testCase.escapes {
+			t.Fatalf("The symlink %s -> %s escape should be '%#v' (while it is %#v)", testCase.name, testCase.target, testCase.escapes, escapes)
+		}
+	}
+}
+
+func tarNames(t *testing.T, paths types.Paths) ([]string, error) {
+	rc := TarPaths(paths)
+	defer rc.Close()
+	tr := tar.NewReader(rc)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			sort.Strings(names)
+			return names, nil
+		}
+		if err != nil {
+			return names, err
+		}
+		names = append(names, hdr.Name)
+	}
+}
+
+func TestNamePolicy(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "a\tb"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "cafe\u0301"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rewrite := types.Rewrite{Regex: "^" + dir, Repl: "/app"}
+
+	names, err := tarNames(t, types.Paths{{Path: dir, Options: &types.PathOptions{Rewrite: rewrite}}})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := []string{"/app", "/app/a\tb", "/app/cafe\u0301"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("Names should be kept '%#v' (while they are %#v)", expected, names)
+	}
+
+	_, err = tarNames(t, types.Paths{{Path: dir, Options: &types.PathOptions{Rewrite: rewrite, NamePolicy: types.NamePolicyReject}}})
+	if err == nil || !strings.Contains(err.Error(), "is unsafe") {
+		t.Fatalf("Unsafe names should be rejected (while it is %v)", err)
+	}
+
+	names, err = tarNames(t, types.Paths{{Path: dir, Options: &types.PathOptions{Rewrite: rewrite, NamePolicy: types.NamePolicySanitize}}})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected = []string{"/app", "/app/a_b", "/app/caf\u00e9"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("Names should be sanitized '%#v' (while they are %#v)", expected, names)
+	}
+
+	if err := os.Symlink("../../etc/passwd", filepath.Join(dir, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	_, err = tarNames(t, types.Paths{{Path: dir, Options: &types.PathOptions{Rewrite: rewrite, NamePolicy: types.NamePolicySanitize}}})
+	if err == nil || !strings.Contains(err.Error(), "outside of the archive root") {
+		t.Fatalf("Escaping symlinks should be rejected (while it is %v)", err)
+	}
+}
+
+func TestRelativeTarget(t *testing.T) {
+	for _, testCase := range []struct {
+		name     string
+		target   string
+		relative string
+	}{
+		{"nix/store/abc-app/bin/sh", "/nix/store/def-bash/bin/bash", "../../def-bash/bin/bash"},
+		{"/bin/sh", "/bin/bash", "bash"},
+		{"sh", "/bin/bash", "bin/bash"},
+		{"nix/store/abc-app/lib", "/nix/store/abc-app", "."},
+		{"etc/link", "/../../etc/passwd", "passwd"},
+	} {
+		if relative := relativeTarget(testCase.name, testCase.target); relative != testCase.relative {
+			t.Fatalf("The target of %s -> %s should be '%#v' (while it is %#v)", testCase.name, testCase.target, testCase.relative, relative)
+		}
+	}
+}
+
+func TestAbsoluteSymlinksPolicy(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/nix/store/abc-bash/bin/bash", filepath.Join(dir, "bin", "sh")); err != nil {
+		t.Fatal(err)
+	}
+	rewrite := types.Rewrite{Regex: "^" + dir, Repl: "/app"}
+	targets := func(policy string) (map[string]string, error) {
+		rc := TarPaths(types.Paths{{Path: dir, Options: &types.PathOptions{Rewrite: rewrite, AbsoluteSymlinks: policy}}})
+		defer rc.Close()
+		tr := tar.NewReader(rc)
+		links := make(map[string]string)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return links, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			if hdr.Typeflag == tar.TypeSymlink {
+				links[hdr.Name] = hdr.Linkname
+			}
+		}
+	}
+	links, err := targets("")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if links["/app/bin/sh"] != "/nix/store/abc-bash/bin/bash" {
+		t.Fatalf("The absolute target should be kept (while it is %v)", links)
+	}
+	links, err = targets(types.AbsoluteSymlinksRelativize)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if expected := "../../nix/store/abc-bash/bin/bash"; links["/app/bin/sh"] != expected {
+		t.Fatalf("The target should be '%s' (while it is %v)", expected, links)
+	}
+	if _, err := targets(types.AbsoluteSymlinksReject); err == nil || !strings.Contains(err.Error(), "absolute target") {
+		t.Fatalf("Absolute targets should be rejected (while it is %v)", err)
+	}
+}
+
+func TestNamePolicyHardlink(t *testing.T) {
+	hdr := &tar.Header{Typeflag: tar.TypeLink, Name: "app/link", Linkname: "app/./a\tb"}
+	if err := applyNamePolicy(hdr, "/tmp/link", types.NamePolicySanitize, nil); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if hdr.Linkname != "app/a_b" {
+		t.Fatalf("The hardlink target should be sanitized as an entry name 'app/a_b' (while it is %q)", hdr.Linkname)
+	}
+}
@@ -0,0 +1,193 @@
+package nix
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+)
+
+// ClosureGraphNode is a store path of a closure graph, as exported by
+// the exportReferencesGraph attribute of derivations with structured
+// attributes.
+type ClosureGraphNode struct {
+	Path       string   `json:"path"`
+	References []string `json:"references"`
+}
+
+// ClosureGraph is the list of the store paths of a closure.
+type ClosureGraph []ClosureGraphNode
+
+// NewClosureGraphFromFile reads a closure graph JSON file.
+func NewClosureGraphFromFile(filename string) (graph ClosureGraph, err error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return graph, err
+	}
+	err = json.Unmarshal(content, &graph)
+	return graph, err
+}
+
+// depths returns the dependency depth of each store path of the
+// graph: store paths without references (such as glibc) have the
+// depth 0 and other store paths are one level above their deepest
+// reference.
+func (graph ClosureGraph) depths() map[string]int {
+	references := make(map[string][]string)
+	for _, node := range graph {
+		references[node.Path] = node.References
+	}
+	depths := make(map[string]int)
+	var depth func(path string, visiting map[string]bool) int
+	depth = func(path string, visiting map[string]bool) int {
+		if d, ok := depths[path]; ok {
+			return d
+		}
+		visiting[path] = true
+		d := 0
+		for _, ref := range references[path] {
+			// Self references and cycles are ignored
+			if visiting[ref] {
+				continue
+			}
+			if refDepth := depth(ref, visiting) + 1; refDepth > d {
+				d = refDepth
+			}
+		}
+		delete(visiting, path)
+		depths[path] = d
+		return d
+	}
+	for _, node := range graph {
+		depth(node.Path, make(map[string]bool))
+	}
+	return depths
+}
+
+// GroupByStability splits the store paths into at most maxLayers
+// groups, ordered from the most stable to the most frequently changing
+// store paths. The roots of the graph (the store paths not referenced
+// by other store paths, usually the application) and the store paths
+// missing from the graph are in the last group. The other store paths
+// are grouped by dependency depth, so that the deepest dependencies
+// (such as glibc or openssl) are in the first groups: a layer only
+// changes when one of its store paths or their dependencies change.
+func GroupByStability(graph ClosureGraph, storePaths []string, maxLayers int) (groups [][]string) {
+	if maxLayers <= 1 || len(storePaths) == 0 {
+		return [][]string{storePaths}
+	}
+	referenced := make(map[string]bool)
+	for _, node := range graph {
+		for _, ref := range node.References {
+			if ref != node.Path {
+				referenced[ref] = true
+			}
+		}
+	}
+	depths := graph.depths()
+	maxDepth := 0
+	for _, p := range storePaths {
+		if d, ok := depths[p]; ok && referenced[p] && d > maxDepth {
+			maxDepth = d
+		}
+	}
+	// The last layer is reserved to the roots
+	layers := maxLayers - 1
+	buckets := make([][]string, maxLayers)
+	for _, p := range storePaths {
+		d, ok := depths[p]
+		if !ok || !referenced[p] {
+			buckets[maxLayers-1] = append(buckets[maxLayers-1], p)
+			continue
+		}
+		i := d * layers / (maxDepth + 1)
+		buckets[i] = append(buckets[i], p)
+	}
+	for _, bucket := range buckets {
+		if len(bucket) == 0 {
+			continue
+		}
+		sort.Strings(bucket)
+		groups = append(groups, bucket)
+	}
+	return groups
+}
+
+// Strategies splitting store paths into layers.
+const (
+	// Store paths are grouped by dependency depth
+	SplitStability = "stability"
+	// As the buildLayeredImage function of nixpkgs, the most
+	// popular store paths have their own layer
+	SplitPopularity = "popularity"
+)
+
+// popularity returns, for each store path of the graph, the number of
+// store paths depending on it, directly or not.
+func (graph ClosureGraph) popularity() map[string]int {
+	popularity := make(map[string]int)
+	for _, node := range graph {
+		closure, _ := graph.Closure([]string{node.Path}, 0)
+		for p := range closure {
+			if p != node.Path {
+				popularity[p]++
+			}
+		}
+	}
+	return popularity
+}
+
+// GroupByPopularity splits the store paths into at most maxLayers
+// groups. The roots of the graph (the store paths not referenced by
+// other store paths, usually the application) and the store paths
+// missing from the graph, such as files added to the image, are in the
+// last group: it is the only layer changing when the application
+// changes. The other store paths are ranked by popularity: the most
+// popular ones (such as glibc) have their own layer and the least
+// popular ones share the layer below the last one.
+func GroupByPopularity(graph ClosureGraph, storePaths []string, maxLayers int) (groups [][]string) {
+	if maxLayers <= 1 || len(storePaths) == 0 {
+		return [][]string{storePaths}
+	}
+	referenced := make(map[string]bool)
+	inGraph := make(map[string]bool)
+	for _, node := range graph {
+		inGraph[node.Path] = true
+		for _, ref := range node.References {
+			if ref != node.Path {
+				referenced[ref] = true
+			}
+		}
+	}
+	popularity := graph.popularity()
+	var deps, top []string
+	for _, p := range storePaths {
+		if inGraph[p] && referenced[p] {
+			deps = append(deps, p)
+		} else {
+			top = append(top, p)
+		}
+	}
+	sort.SliceStable(deps, func(i, j int) bool {
+		if popularity[deps[i]] != popularity[deps[j]] {
+			return popularity[deps[i]] > popularity[deps[j]]
+		}
+		return deps[i] < deps[j]
+	})
+	// The last layer is reserved to the roots
+	layers := maxLayers - 1
+	for len(deps) > 0 {
+		if len(groups) == layers-1 || len(deps) == 1 {
+			rest := append([]string{}, deps...)
+			sort.Strings(rest)
+			groups = append(groups, rest)
+			break
+		}
+		groups = append(groups, []string{deps[0]})
+		deps = deps[1:]
+	}
+	if len(top) > 0 {
+		sort.Strings(top)
+		groups = append(groups, top)
+	}
+	return groups
+}
@@ -0,0 +1,72 @@
+package nix
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGroupByStability(t *testing.T) {
+	graph := ClosureGraph{
+		ClosureGraphNode{Path: "/nix/store/app", References: []string{"/nix/store/app", "/nix/store/python", "/nix/store/openssl"}},
+		ClosureGraphNode{Path: "/nix/store/python", References: []string{"/nix/store/openssl", "/nix/store/glibc"}},
+		ClosureGraphNode{Path: "/nix/store/openssl", References: []string{"/nix/store/glibc"}},
+		ClosureGraphNode{Path: "/nix/store/glibc", References: []string{"/nix/store/glibc"}},
+	}
+	storePaths := []string{"/nix/store/app", "/nix/store/glibc", "/nix/store/openssl", "/nix/store/python", "/nix/store/file"}
+
+	groups := GroupByStability(graph, storePaths, 4)
+	expected := [][]string{
+		[]string{"/nix/store/glibc"},
+		[]string{"/nix/store/openssl"},
+		[]string{"/nix/store/python"},
+		[]string{"/nix/store/app", "/nix/store/file"},
+	}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Fatalf("Groups should be '%#v' (while they are %#v)", expected, groups)
+	}
+
+	groups = GroupByStability(graph, storePaths, 2)
+	expected = [][]string{
+		[]string{"/nix/store/glibc", "/nix/store/openssl", "/nix/store/python"},
+		[]string{"/nix/store/app", "/nix/store/file"},
+	}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Fatalf("Groups should be '%#v' (while they are %#v)", expected, groups)
+	}
+
+	groups = GroupByStability(graph, storePaths, 1)
+	if !reflect.DeepEqual(groups, [][]string{storePaths}) {
+		t.Fatalf("Groups should be '%#v' (while they are %#v)", [][]string{storePaths}, groups)
+	}
+}
+
+func TestGroupByPopularity(t *testing.T) {
+	graph := ClosureGraph{
+		ClosureGraphNode{Path: "/nix/store/app", References: []string{"/nix/store/app", "/nix/store/python", "/nix/store/openssl"}},
+		ClosureGraphNode{Path: "/nix/store/python", References: []string{"/nix/store/openssl", "/nix/store/glibc"}},
+		ClosureGraphNode{Path: "/nix/store/openssl", References: []string{"/nix/store/glibc"}},
+		ClosureGraphNode{Path: "/nix/store/glibc", References: []string{"/nix/store/glibc"}},
+	}
+	storePaths := []string{"/nix/store/app", "/nix/store/glibc", "/nix/store/openssl", "/nix/store/python", "/nix/store/file"}
+
+	groups := GroupByPopularity(graph, storePaths, 3)
+	expected := [][]string{
+		[]string{"/nix/store/glibc"},
+		[]string{"/nix/store/openssl", "/nix/store/python"},
+		[]string{"/nix/store/app", "/nix/store/file"},
+	}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Fatalf("Groups should be '%#v' (while they are %#v)", expected, groups)
+	}
+
+	groups = GroupByPopularity(graph, storePaths, 10)
+	expected = [][]string{
+		[]string{"/nix/store/glibc"},
+		[]string{"/nix/store/openssl"},
+		[]string{"/nix/store/python"},
+		[]string{"/nix/store/app", "/nix/store/file"},
+	}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Fatalf("Groups should be '%#v' (while they are %#v)", expected, groups)
+	}
+}
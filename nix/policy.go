@@ -0,0 +1,35 @@
+package nix
+
+// The signature policy used by skopeo to copy images is read from
+// these environment variables.
+const (
+	// A containers-policy.json file, or "system" for the system
+	// policy (/etc/containers/policy.json). Signatures are not
+	// checked if it is empty.
+	PolicyEnv = "NIX2CONTAINER_POLICY"
+	// A registries.d directory, configuring where signatures are
+	// looked up
+	RegistriesDirEnv = "NIX2CONTAINER_REGISTRIES_D"
+)
+
+// PolicySystem designates the system signature policy.
+const PolicySystem = "system"
+
+// SkopeoPolicyArgs returns the skopeo global options enforcing the
+// signature policy (see PolicyEnv) and the registries.d directory.
+// Without policy, skopeo is run with --insecure-policy, since the
+// image source (the nix transport) is usually not trusted by system
+// policies.
+func SkopeoPolicyArgs(policy, registriesDir string) (args []string) {
+	switch policy {
+	case "":
+		args = append(args, "--insecure-policy")
+	case PolicySystem:
+	default:
+		args = append(args, "--policy", policy)
+	}
+	if registriesDir != "" {
+		args = append(args, "--registries.d", registriesDir)
+	}
+	return args
+}
@@ -0,0 +1,22 @@
+package nix
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSkopeoPolicyArgs(t *testing.T) {
+	for _, c := range []struct {
+		policy, registriesDir string
+		expected              []string
+	}{
+		{"", "", []string{"--insecure-policy"}},
+		{PolicySystem, "", nil},
+		{"/etc/policy.json", "/etc/registries.d", []string{"--policy", "/etc/policy.json", "--registries.d", "/etc/registries.d"}},
+	} {
+		args := SkopeoPolicyArgs(c.policy, c.registriesDir)
+		if !reflect.DeepEqual(args, c.expected) {
+			t.Fatalf("Arguments should be '%#v' (while they are %#v)", c.expected, args)
+		}
+	}
+}
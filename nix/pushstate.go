@@ -0,0 +1,169 @@
+package nix
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/manifest"
+	imageTypes "github.com/containers/image/v5/types"
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// PushStateEnv is the environment variable containing the file where
+// the progress of a push is recorded: the blobs uploaded to the
+// destination and the manifests pushed to it. When an interrupted push
+// is started again, the copy tool only uploads the blobs missing on the
+// destination, and the state tells which part of the image was already
+// pushed.
+const PushStateEnv = "NIX2CONTAINER_PUSH_STATE"
+
+type pushRecord struct {
+	Blob        string `json:"blob,omitempty"`
+	Manifest    string `json:"manifest,omitempty"`
+	Destination string `json:"destination,omitempty"`
+}
+
+// PushState is the progress of the pushes recorded in a state file.
+type PushState struct {
+	// The digests of the blobs uploaded to, or found on, the
+	// destination
+	Blobs map[string]bool
+	// The destinations of the pushed manifests, by manifest digest
+	Manifests map[string]map[string]bool
+}
+
+// recordBlobPushed records in the push state, if any, that the blob is
+// on the destination. It is only called once the upload of the blob
+// has been committed by the registry: a blob completely read by the
+// copy tool can still fail to be written.
+func recordBlobPushed(digest string) {
+	filename := os.Getenv(PushStateEnv)
+	if filename == "" {
+		return
+	}
+	if err := appendRecord(filename, pushRecord{Blob: digest}); err != nil {
+		logrus.Warnf("Could not write the push state %s: %s", filename, err)
+	}
+}
+
+// RecordManifestPushed records in the push state file that the
+// manifest has been pushed to the destination.
+func RecordManifestPushed(filename, manifest, destination string) error {
+	return appendRecord(filename, pushRecord{Manifest: manifest, Destination: destination})
+}
+
+// RemoteManifestDigest returns the digest of the manifest of the
+// docker destination, to check that an image recorded as pushed is
+// still on it before skipping its push: the image could have been
+// deleted or the tag moved since.
+func RemoteManifestDigest(ctx context.Context, sys *imageTypes.SystemContext, destination string) (godigest.Digest, error) {
+	if !strings.HasPrefix(destination, "docker://") {
+		return "", fmt.Errorf("Only the manifests of docker:// destinations can be checked (while it is %s)", destination)
+	}
+	ref, err := docker.ParseReference(strings.TrimPrefix(destination, "docker:"))
+	if err != nil {
+		return "", err
+	}
+	src, err := ref.NewImageSource(ctx, sys)
+	if err != nil {
+		return "", registryError(err, "Could not read %s", destination)
+	}
+	defer src.Close()
+	content, _, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return "", registryError(err, "Could not read the manifest of %s", destination)
+	}
+	return manifest.Digest(content)
+}
+
+// ReadPushState reads a push state file. A missing file is an empty
+// state.
+func ReadPushState(filename string) (state PushState, err error) {
+	state.Blobs = make(map[string]bool)
+	state.Manifests = make(map[string]map[string]bool)
+	content, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var record pushRecord
+		// The last line can be truncated if the copy has been
+		// killed while it was written
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			logrus.Warnf("Ignoring an invalid record of the push state %s: %s", filename, err)
+			continue
+		}
+		if record.Blob != "" {
+			state.Blobs[record.Blob] = true
+		}
+		if record.Manifest != "" {
+			if state.Manifests[record.Manifest] == nil {
+				state.Manifests[record.Manifest] = make(map[string]bool)
+			}
+			state.Manifests[record.Manifest][record.Destination] = true
+		}
+	}
+	return state, scanner.Err()
+}
+
+// PushProgress is the progress of the push of an image.
+type PushProgress struct {
+	// The digest of the image manifest
+	Manifest       string
+	ManifestPushed bool
+	Blobs          int
+	BlobsPushed    int
+	Size           int64
+	SizePushed     int64
+}
+
+// GetPushProgress returns the progress of the push of the image to the
+// destination.
+func GetPushProgress(state PushState, image types.Image, destination string) (progress PushProgress, err error) {
+	desc, err := GetManifestDescriptor(image)
+	if err != nil {
+		return progress, err
+	}
+	progress.Manifest = desc.Digest.String()
+	progress.ManifestPushed = state.Manifests[progress.Manifest][destination]
+	configDigest, configSize, err := GetConfigDigest(image)
+	if err != nil {
+		return progress, err
+	}
+	blobs := map[string]int64{configDigest.String(): configSize}
+	for _, layer := range image.Layers {
+		blobs[layer.Digest] = layer.Size
+	}
+	for digest, size := range blobs {
+		progress.Blobs++
+		progress.Size += size
+		if progress.ManifestPushed || state.Blobs[digest] {
+			progress.BlobsPushed++
+			progress.SizePushed += size
+		}
+	}
+	return progress, nil
+}
+
+func (p PushProgress) String() string {
+	if p.ManifestPushed {
+		return fmt.Sprintf("pushed (%d blobs, %s)", p.Blobs, FormatByteSize(p.Size))
+	}
+	return fmt.Sprintf("%d/%d blobs pushed (%s of %s)", p.BlobsPushed, p.Blobs, FormatByteSize(p.SizePushed), FormatByteSize(p.Size))
+}
@@ -0,0 +1,85 @@
+package nix
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+)
+
+func TestPushState(t *testing.T) {
+	layers, err := NewLayers(context.Background(), []string{"../data/tar-directory"}, nil, nil, "", nil, types.PathOptions{}, CompressionNone)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	image := types.Image{Layers: layers}
+	state := filepath.Join(t.TempDir(), "state")
+	os.Setenv(PushStateEnv, state)
+	defer os.Unsetenv(PushStateEnv)
+
+	// A blob read by the copy tool can still fail to be written:
+	// it is only recorded once its upload is committed
+	rc, _, err := GetBlob(image, godigest.Digest(layers[0].Digest))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := io.Copy(ioutil.Discard, rc); err != nil {
+		t.Fatalf("%v", err)
+	}
+	rc.Close()
+	s, err := ReadPushState(state)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if s.Blobs[layers[0].Digest] {
+		t.Fatalf("The read blob should not be recorded")
+	}
+
+	recordBlobPushed(layers[0].Digest)
+	// A record truncated by a killed copy is ignored
+	f, err := os.OpenFile(state, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	f.Write([]byte(`{"blob":"sha2`))
+	f.Close()
+
+	s, err = ReadPushState(state)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	progress, err := GetPushProgress(s, image, "docker://registry/app")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if progress.ManifestPushed || progress.Blobs != 2 || progress.BlobsPushed != 1 || progress.SizePushed != layers[0].Size {
+		t.Fatalf("The layer should be the only pushed blob (while the progress is %#v)", progress)
+	}
+
+	if err := RecordManifestPushed(state, progress.Manifest, "docker://registry/app"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	s, err = ReadPushState(state)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	progress, err = GetPushProgress(s, image, "docker://registry/app")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !progress.ManifestPushed || progress.BlobsPushed != 2 {
+		t.Fatalf("The image should be pushed (while the progress is %#v)", progress)
+	}
+	progress, err = GetPushProgress(s, image, "docker://registry/other")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if progress.ManifestPushed {
+		t.Fatalf("The image should not be pushed to another destination")
+	}
+}
@@ -0,0 +1,127 @@
+package nix
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// RecompressImage returns the image whose layers built from store
+// paths are compressed with compression, for instance to migrate a
+// registry from gzip to zstd. The archives are not generated again:
+// the blobs of the layers are read from the cache, decompressed and
+// compressed again, and the new blobs are stored in the cache. Their
+// diffIDs are checked against the ones of the layers. Other layers,
+// such as pinned layers, encrypted layers or layers of base images,
+// are kept.
+func RecompressImage(ctx context.Context, image types.Image, cache *BlobCache, compression string) (types.Image, error) {
+	mediaType, err := CompressionMediaType(compression)
+	if err != nil {
+		return image, err
+	}
+	layers := make([]types.Layer, len(image.Layers))
+	recompressed := make(map[string]types.Layer)
+	for i, layer := range image.Layers {
+		layers[i] = layer
+		if layer.Paths == nil || layer.Pinned || IsEncryptedMediaType(layer.MediaType) || (layer.Compression == compression && layer.MediaType == mediaType) {
+			continue
+		}
+		if l, ok := recompressed[layer.Digest]; ok {
+			layers[i] = l
+			continue
+		}
+		if layers[i], err = recompressLayer(ctx, image, cache, layer, compression, mediaType); err != nil {
+			return image, err
+		}
+		recompressed[layer.Digest] = layers[i]
+	}
+	image.Layers = layers
+	return image, nil
+}
+
+// recompressLayer compresses the blob of the layer with compression
+// and stores it in the cache.
+func recompressLayer(ctx context.Context, image types.Image, cache *BlobCache, layer types.Layer, compression string, mediaType string) (types.Layer, error) {
+	digest := godigest.Digest(layer.Digest)
+	if !cache.Contains(digest) {
+		logrus.Infof("The layer %s is not in the cache: its blob is generated", digest)
+	}
+	rc, _, err := cache.GetBlob(ctx, image, digest)
+	if err != nil {
+		return layer, err
+	}
+	defer rc.Close()
+	archive, err := decompressReader(rc, layer.MediaType)
+	if err != nil {
+		return layer, err
+	}
+
+	f, err := ioutil.TempFile("", "nix2container-recompress-")
+	if err != nil {
+		return layer, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// As when layers are built, the diffID and the digest are
+	// computed in a single pass. The diffID is checked with the
+	// algorithm of the layer diffID, while the new digest is
+	// computed with the algorithm of the settings of ctx.
+	diffIDAlgorithm := godigest.Digest(layer.DiffIDs).Algorithm()
+	if !diffIDAlgorithm.Available() {
+		diffIDAlgorithm = godigest.Canonical
+	}
+	diffIDDigester := diffIDAlgorithm.Digester()
+	digester := archiveSettingsFrom(ctx).algorithm.Digester()
+	counter := &countingWriter{}
+	annotations := make(map[string]string)
+	cw, err := compressWriter(io.MultiWriter(f, digester.Hash(), counter), compression, nil, annotations)
+	if err != nil {
+		return layer, err
+	}
+	if _, err := io.Copy(io.MultiWriter(cw, diffIDDigester.Hash()), archive); err != nil {
+		cw.Close()
+		return layer, err
+	}
+	if err := cw.Close(); err != nil {
+		return layer, err
+	}
+	if diffID := diffIDDigester.Digest(); diffID.String() != layer.DiffIDs {
+		return layer, classErrorf(ErrDigestMismatch, "The archive of the layer %s has the diff_ids %s while the layer diff_ids is %s", digest, diffID, layer.DiffIDs)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return layer, err
+	}
+	newDigest := digester.Digest()
+	if err := cache.Store().Put(ctx, newDigest, f, counter.n); err != nil {
+		return layer, err
+	}
+	logrus.Infof("The layer %s (size:%d) has been compressed with %s to %s (size:%d)", digest, layer.Size, compression, newDigest, counter.n)
+
+	layer.Digest = newDigest.String()
+	layer.Size = counter.n
+	layer.MediaType = mediaType
+	layer.Compression = compression
+	layer.CompressionCommand = nil
+	// Only the annotations of the previous compression are replaced
+	for k, v := range layer.Annotations {
+		if !strings.HasPrefix(k, compressionAnnotationPrefix) {
+			annotations[k] = v
+		}
+	}
+	layer.Annotations = nil
+	if len(annotations) > 0 {
+		layer.Annotations = annotations
+	}
+	// The blob is now read from the cache and the file index
+	// references the previous blob
+	layer.LayerPath = ""
+	layer.FileIndex = ""
+	return layer, nil
+}
@@ -0,0 +1,101 @@
+package nix
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestRecompressImage(t *testing.T) {
+	paths := []string{"../data/layer1"}
+	layers, err := NewLayers(context.Background(), paths, nil, nil, "", nil, types.PathOptions{}, CompressionGzip)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	image := types.Image{Layers: []types.Layer{layers[0], layers[0]}}
+	cache, err := NewBlobCache(t.TempDir())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	recompressed, err := RecompressImage(context.Background(), image, cache, CompressionZstd)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	layer := recompressed.Layers[0]
+	if layer.MediaType != v1.MediaTypeImageLayerZstd || layer.Compression != CompressionZstd {
+		t.Fatalf("The layer should be a zstd layer (while it is %#v)", layer)
+	}
+	if layer.DiffIDs != layers[0].DiffIDs || layer.Digest == layers[0].Digest {
+		t.Fatalf("Only the digest of the layer should change (while it is %#v)", layer)
+	}
+	if recompressed.Layers[1].Digest != layer.Digest {
+		t.Fatalf("Both layers should be recompressed (while they are %#v)", recompressed.Layers)
+	}
+	if err := layer.Validate(); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// The blob is the one generated from the paths with zstd
+	zstdLayers, err := NewLayers(context.Background(), paths, nil, nil, "", nil, types.PathOptions{}, CompressionZstd)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if layer.Digest != zstdLayers[0].Digest || layer.Size != zstdLayers[0].Size {
+		t.Fatalf("The layer should be '%#v' (while it is %#v)", zstdLayers[0], layer)
+	}
+	rc, _, err := cache.GetBlob(context.Background(), recompressed, godigest.Digest(layer.Digest))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer rc.Close()
+	content, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if godigest.FromBytes(content).String() != layer.Digest {
+		t.Fatalf("The cached blob should have the digest %s", layer.Digest)
+	}
+
+	if _, err := RecompressImage(context.Background(), image, cache, "lz4"); err == nil {
+		t.Fatalf("An unsupported compression should be rejected")
+	}
+
+	// A layer whose archive doesn't match its diffID is rejected
+	image.Layers[0].DiffIDs = "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+	if _, err := RecompressImage(context.Background(), image, cache, CompressionNone); !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("A layer with an invalid diff_ids should not be recompressed (while the error is %v)", err)
+	}
+
+	// Only the compression annotations are replaced
+	annotated := layers[0]
+	annotated.Annotations = map[string]string{
+		compressionAnnotationPrefix + "manifest-checksum": "sha256:0000000000000000000000000000000000000000000000000000000000000000",
+		"org.example.team": "infra",
+	}
+	recompressed, err = RecompressImage(context.Background(), types.Image{Layers: []types.Layer{annotated}}, cache, CompressionZstd)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := map[string]string{"org.example.team": "infra"}
+	if annotations := recompressed.Layers[0].Annotations; !reflect.DeepEqual(annotations, expected) {
+		t.Fatalf("The annotations should be '%#v' (while they are %#v)", expected, annotations)
+	}
+
+	// Encrypted layers are kept
+	encrypted := layers[0]
+	encrypted.MediaType = v1.MediaTypeImageLayerGzip + MediaTypeEncryptedSuffix
+	recompressed, err = RecompressImage(context.Background(), types.Image{Layers: []types.Layer{encrypted}}, cache, CompressionZstd)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !reflect.DeepEqual(recompressed.Layers[0], encrypted) {
+		t.Fatalf("The encrypted layer should be kept (while it is %#v)", recompressed.Layers[0])
+	}
+}
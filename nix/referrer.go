@@ -0,0 +1,55 @@
+package nix
+
+import (
+	"bytes"
+	"context"
+
+	imageTypes "github.com/containers/image/v5/types"
+	godigest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+)
+
+// PushReferrer pushes to the repository of destination (such as
+// docker://registry/app) an artifact whose subject is the manifest
+// described by subject, already pushed to this repository. The
+// artifact contains a single blob, content, with the mediaType: it is
+// listed by the referrers API of the registry for the subject
+// manifest. The artifact manifest is put by digest.
+func PushReferrer(ctx context.Context, sys *imageTypes.SystemContext, destination string, subject v1.Descriptor, artifactType string, mediaType string, content []byte) (desc v1.Descriptor, err error) {
+	client, err := newDestinationRegistryClient(sys, destination)
+	if err != nil {
+		return desc, err
+	}
+	return pushReferrer(ctx, client, subject, artifactType, mediaType, content)
+}
+
+func pushReferrer(ctx context.Context, client *registryClient, subject v1.Descriptor, artifactType string, mediaType string, content []byte) (desc v1.Descriptor, err error) {
+	for _, blob := range [][]byte{content, emptyJSON} {
+		digest := godigest.FromBytes(blob)
+		ok, err := client.hasBlob(ctx, digest.String())
+		if err != nil {
+			return desc, err
+		}
+		if ok {
+			continue
+		}
+		if err := client.uploadBlob(ctx, digest.String(), bytes.NewReader(blob)); err != nil {
+			return desc, err
+		}
+	}
+	manifest, err := newReferrerManifest(subject, artifactType, mediaType, content)
+	if err != nil {
+		return desc, err
+	}
+	desc = v1.Descriptor{
+		MediaType: v1.MediaTypeImageManifest,
+		Digest:    godigest.FromBytes(manifest),
+		Size:      int64(len(manifest)),
+	}
+	if err := client.putManifest(ctx, desc.Digest.String(), v1.MediaTypeImageManifest, manifest); err != nil {
+		return desc, err
+	}
+	logrus.Infof("The referrer %s of %s has been pushed to %s", desc.Digest, subject.Digest, client.repository)
+	return desc, nil
+}
@@ -0,0 +1,56 @@
+package nix
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	godigest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestPushReferrer(t *testing.T) {
+	registry := &blobRegistry{blobs: make(map[string][]byte), uploads: make(map[string][]byte), manifests: make(map[string][]byte)}
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	client := &registryClient{
+		base:       server.URL + "/v2",
+		repository: "blobs",
+		client:     server.Client(),
+		now:        time.Now,
+	}
+	subject := v1.Descriptor{
+		MediaType:   v1.MediaTypeImageManifest,
+		Digest:      godigest.FromString("manifest"),
+		Size:        8,
+		Annotations: map[string]string{v1.AnnotationRefName: "latest"},
+	}
+	result := []byte(`{"matches":[]}`)
+	desc, err := pushReferrer(context.Background(), client, subject, "application/vnd.nix2container.scan.v1", "application/json", result)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	content, ok := registry.manifests[desc.Digest.String()]
+	if !ok || godigest.FromBytes(content) != desc.Digest {
+		t.Fatalf("The referrer manifest should be put by digest (while the manifests are %#v)", registry.manifests)
+	}
+	var m referrerManifest
+	if err := json.Unmarshal(content, &m); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if m.Subject == nil || m.Subject.Digest != subject.Digest || m.Subject.Annotations != nil {
+		t.Fatalf("The referrer subject should be the image manifest (while it is %#v)", m.Subject)
+	}
+	if m.ArtifactType != "application/vnd.nix2container.scan.v1" {
+		t.Fatalf("The referrer artifact type should be 'application/vnd.nix2container.scan.v1' (while it is %s)", m.ArtifactType)
+	}
+	if len(m.Layers) != 1 || string(registry.blobs[m.Layers[0].Digest.String()]) != string(result) {
+		t.Fatalf("The scan result should be uploaded (while the layers are %#v)", m.Layers)
+	}
+	if _, ok := registry.blobs[m.Config.Digest.String()]; !ok {
+		t.Fatalf("The empty config should be uploaded")
+	}
+}
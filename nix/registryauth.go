@@ -0,0 +1,626 @@
+package nix
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/pkg/docker/config"
+	"github.com/containers/image/v5/pkg/sysregistriesv2"
+	"github.com/containers/image/v5/pkg/tlsclientconfig"
+	"github.com/containers/image/v5/types"
+	"github.com/nlewo/nix2container/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// registryChunkSize is the size of the chunks of the blobs uploaded
+// to registries. The bearer token is refreshed between two chunks if
+// it is about to expire, so that multi-hour uploads of huge layers
+// don't fail once the token has expired.
+var registryChunkSize = 32 << 20
+
+// defaultTokenLifetime is the lifetime of the tokens whose response
+// doesn't set expires_in, as specified by the Docker token
+// authentication.
+const defaultTokenLifetime = 60 * time.Second
+
+// maxRegistryTokens is the number of tokens kept by registryTokens,
+// so that long-lived processes pushing to many repositories don't
+// accumulate them.
+const maxRegistryTokens = 256
+
+type registryToken struct {
+	value string
+	// The token is refreshed before being used once refreshAt is
+	// reached, before it expires
+	refreshAt time.Time
+	// The token is dropped from the cache once it has expired
+	expiresAt time.Time
+}
+
+// registryTokens caches the bearer tokens of registries by token
+// service, scope and user, so that the requests to a repository share
+// their tokens. Expired tokens are dropped.
+var registryTokens = struct {
+	sync.Mutex
+	tokens map[string]registryToken
+}{tokens: make(map[string]registryToken)}
+
+// registryClient talks to the API of a repository of a registry,
+// authenticating its requests with the basic or the bearer token
+// authentication asked by the registry.
+type registryClient struct {
+	// The base URL of the API, such as https://registry.example.com/v2
+	base       string
+	repository string
+	auth       registryCredentials
+	client     *http.Client
+	now        func() time.Time
+	// The registry can be contacted over HTTP if it doesn't serve
+	// HTTPS, see detectScheme
+	insecure bool
+	// The scheme is only detected by the first request
+	scheme struct {
+		once sync.Once
+		err  error
+	}
+
+	mu sync.Mutex
+	// The authentication challenge of the registry, such as
+	// {"scheme": "bearer", "realm": "https://auth.example.com/token"},
+	// set by the first 401 response
+	challenge map[string]string
+}
+
+// registryCredentials are the credentials of a registry: a username
+// and a password, or an OAuth2 refresh token.
+type registryCredentials struct {
+	username      string
+	password      string
+	identityToken string
+}
+
+func newRegistryClient(registry string, repository string, auth registryCredentials) *registryClient {
+	// Docker Hub is not served by its registry name
+	if registry == "docker.io" {
+		registry = "registry-1.docker.io"
+	}
+	return &registryClient{
+		base:       "https://" + registry + "/v2",
+		repository: repository,
+		auth:       auth,
+		client:     &http.Client{Transport: getHTTPClient().Transport},
+		now:        time.Now,
+	}
+}
+
+// newSystemRegistryClient returns the client of the repository of
+// named configured by sys, as containers/image does: the credentials
+// come from sys or from the containers auth files, the certificates
+// from the certificate directories of the registry and the TLS
+// verification is disabled by --tls-verify=false or for the insecure
+// registries of registries.conf, which can also be contacted over
+// HTTP.
+func newSystemRegistryClient(sys *types.SystemContext, named reference.Named) (*registryClient, error) {
+	registry := reference.Domain(named)
+	creds, err := config.GetCredentials(sys, registry)
+	if err != nil {
+		return nil, err
+	}
+	insecure := sys != nil && sys.DockerInsecureSkipTLSVerify == types.OptionalBoolTrue
+	conf, err := sysregistriesv2.FindRegistry(sys, named.Name())
+	if err != nil {
+		return nil, err
+	}
+	if conf != nil && conf.Insecure {
+		insecure = true
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecure}
+	if dir := registryCertDir(sys, registry); dir != "" {
+		if err := tlsclientconfig.SetupCertificates(dir, tlsConfig); err != nil {
+			return nil, err
+		}
+	}
+	transport := newHTTPTransport(getHTTPOptions())
+	transport.TLSClientConfig = tlsConfig
+	c := newRegistryClient(registry, reference.Path(named), registryCredentials{
+		username:      creds.Username,
+		password:      creds.Password,
+		identityToken: creds.IdentityToken,
+	})
+	c.client = &http.Client{Transport: transport}
+	c.insecure = insecure
+	return c, nil
+}
+
+// newDestinationRegistryClient returns the client of the repository
+// of a docker:// destination, such as docker://registry/app.
+func newDestinationRegistryClient(sys *types.SystemContext, destination string) (*registryClient, error) {
+	if !strings.HasPrefix(destination, "docker://") {
+		return nil, fmt.Errorf("Only docker:// destinations are supported (while it is %s)", destination)
+	}
+	named, err := reference.ParseNormalizedNamed(strings.TrimPrefix(destination, "docker://"))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid destination %s: %w", destination, err)
+	}
+	return newSystemRegistryClient(sys, named)
+}
+
+// registryCertDir returns the directory of the certificates of the
+// registry (HOST[:PORT]), looked up as containers/image does, or an
+// empty string if there is none.
+func registryCertDir(sys *types.SystemContext, registry string) string {
+	if sys != nil && sys.DockerCertPath != "" {
+		return sys.DockerCertPath
+	}
+	var dirs []string
+	if sys != nil && sys.DockerPerHostCertDirPath != "" {
+		dirs = []string{sys.DockerPerHostCertDirPath}
+	} else {
+		if home, err := os.UserHomeDir(); err == nil && os.Geteuid() != 0 {
+			dirs = append(dirs, filepath.Join(home, ".config/containers/certs.d"))
+		}
+		dirs = append(dirs, "/etc/containers/certs.d", "/etc/docker/certs.d")
+	}
+	for _, dir := range dirs {
+		path := filepath.Join(dir, registry)
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			return path
+		}
+	}
+	return ""
+}
+
+// detectScheme switches an insecure registry to HTTP if it doesn't
+// serve HTTPS. The registry is only probed by the first call, which
+// the other calls wait for: the base URL is then not modified while
+// requests use it.
+func (c *registryClient) detectScheme(ctx context.Context) error {
+	c.scheme.once.Do(func() {
+		c.scheme.err = c.probeScheme(ctx)
+	})
+	return c.scheme.err
+}
+
+func (c *registryClient) probeScheme(ctx context.Context) error {
+	if !c.insecure || !strings.HasPrefix(c.base, "https://") {
+		return nil
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", c.base+"/", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	logrus.Debugf("The insecure registry %s is contacted over HTTP: %s", c.base, err)
+	c.base = "http://" + strings.TrimPrefix(c.base, "https://")
+	return nil
+}
+
+// parseChallenge parses a WWW-Authenticate header, such as
+// Bearer realm="https://auth.example.com/token",service="registry".
+// The scheme is lowercased.
+func parseChallenge(header string) map[string]string {
+	challenge := make(map[string]string)
+	header = strings.TrimSpace(header)
+	i := strings.IndexAny(header, " \t")
+	if i < 0 {
+		challenge["scheme"] = strings.ToLower(header)
+		return challenge
+	}
+	challenge["scheme"] = strings.ToLower(header[:i])
+	rest := header[i:]
+	for {
+		rest = strings.TrimLeft(rest, " \t,")
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			return challenge
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			var b strings.Builder
+			j := 1
+			for ; j < len(rest) && rest[j] != '"'; j++ {
+				if rest[j] == '\\' && j+1 < len(rest) {
+					j++
+				}
+				b.WriteByte(rest[j])
+			}
+			value = b.String()
+			if j < len(rest) {
+				j++
+			}
+			rest = rest[j:]
+		} else {
+			end := strings.Index(rest, ",")
+			if end < 0 {
+				end = len(rest)
+			}
+			value = strings.TrimSpace(rest[:end])
+			rest = rest[end:]
+		}
+		challenge[key] = value
+	}
+}
+
+// scope returns the scope of the tokens of the repository.
+func (c *registryClient) scope() string {
+	return fmt.Sprintf("repository:%s:pull,push", c.repository)
+}
+
+// token returns the bearer token of the repository: a cached token is
+// used until it is about to expire. A new token is fetched if force
+// is set, for instance when the cached token has been refused.
+func (c *registryClient) token(ctx context.Context, challenge map[string]string, force bool) (string, error) {
+	key := strings.Join([]string{challenge["realm"], challenge["service"], c.scope(), c.auth.username}, "\x00")
+	now := c.now()
+	registryTokens.Lock()
+	cached, ok := registryTokens.tokens[key]
+	if ok && !now.Before(cached.expiresAt) {
+		delete(registryTokens.tokens, key)
+	}
+	registryTokens.Unlock()
+	if ok && !force && now.Before(cached.refreshAt) {
+		return cached.value, nil
+	}
+	token, err := c.fetchToken(ctx, challenge)
+	if err != nil {
+		return "", err
+	}
+	registryTokens.Lock()
+	storeRegistryToken(key, token, now)
+	registryTokens.Unlock()
+	return token.value, nil
+}
+
+// storeRegistryToken adds the token to registryTokens, whose lock is
+// held. Once the cache is full, the expired tokens are dropped, and
+// then the token expiring first.
+func storeRegistryToken(key string, token registryToken, now time.Time) {
+	if _, ok := registryTokens.tokens[key]; !ok && len(registryTokens.tokens) >= maxRegistryTokens {
+		var first string
+		for k, t := range registryTokens.tokens {
+			if !now.Before(t.expiresAt) {
+				delete(registryTokens.tokens, k)
+			} else if first == "" || t.expiresAt.Before(registryTokens.tokens[first].expiresAt) {
+				first = k
+			}
+		}
+		if len(registryTokens.tokens) >= maxRegistryTokens {
+			delete(registryTokens.tokens, first)
+		}
+	}
+	registryTokens.tokens[key] = token
+}
+
+// fetchToken gets a token from the token server of the challenge. The
+// token is refreshed when a fifth of its lifetime remains.
+func (c *registryClient) fetchToken(ctx context.Context, challenge map[string]string) (token registryToken, err error) {
+	realm, err := url.Parse(challenge["realm"])
+	if err != nil || realm.Scheme == "" {
+		return token, fmt.Errorf("Invalid token realm %q of the registry %s", challenge["realm"], c.base)
+	}
+	params := url.Values{}
+	if challenge["service"] != "" {
+		params.Set("service", challenge["service"])
+	}
+	params.Set("scope", c.scope())
+	var req *http.Request
+	if c.auth.identityToken != "" {
+		params.Set("grant_type", "refresh_token")
+		params.Set("refresh_token", c.auth.identityToken)
+		params.Set("client_id", "nix2container")
+		req, err = http.NewRequestWithContext(ctx, "POST", realm.String(), strings.NewReader(params.Encode()))
+		if err != nil {
+			return token, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		query := realm.Query()
+		for k, v := range params {
+			query[k] = v
+		}
+		realm.RawQuery = query.Encode()
+		req, err = http.NewRequestWithContext(ctx, "GET", realm.String(), nil)
+		if err != nil {
+			return token, err
+		}
+		if c.auth.username != "" {
+			req.SetBasicAuth(c.auth.username, c.auth.password)
+		}
+	}
+	requested := c.now()
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return token, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return token, classErrorf(ErrAuth, "Could not get a token for %s from %s: %s", c.repository, realm.Host, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return token, fmt.Errorf("Could not get a token for %s from %s: %s", c.repository, realm.Host, resp.Status)
+	}
+	var response struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return token, fmt.Errorf("Could not parse the token response of %s: %w", realm.Host, err)
+	}
+	token.value = response.Token
+	if token.value == "" {
+		token.value = response.AccessToken
+	}
+	lifetime := defaultTokenLifetime
+	if response.ExpiresIn > 0 {
+		lifetime = time.Duration(response.ExpiresIn) * time.Second
+	}
+	// The lifetime starts when the token is requested, since the
+	// clock of the token server may not be in sync
+	token.refreshAt = requested.Add(lifetime - lifetime/5)
+	token.expiresAt = requested.Add(lifetime)
+	return token, nil
+}
+
+// authorize sets the authentication of the request asked by the
+// challenge of the registry, if any.
+func (c *registryClient) authorize(ctx context.Context, req *http.Request, force bool) error {
+	c.mu.Lock()
+	challenge := c.challenge
+	c.mu.Unlock()
+	switch challenge["scheme"] {
+	case "basic":
+		req.SetBasicAuth(c.auth.username, c.auth.password)
+	case "bearer":
+		token, err := c.token(ctx, challenge, force)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return nil
+}
+
+// do sends the request created by newRequest. If the registry refuses
+// it, the request is sent again with a new token: newRequest is then
+// called again, so that the body can be sent twice.
+func (c *registryClient) do(ctx context.Context, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	req, err := newRequest()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.authorize(ctx, req, false); err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	header := resp.Header.Get("WWW-Authenticate")
+	if header == "" {
+		return nil, classErrorf(ErrAuth, "The registry %s refused the request %s %s without authentication challenge", c.base, req.Method, req.URL.Path)
+	}
+	c.mu.Lock()
+	c.challenge = parseChallenge(header)
+	c.mu.Unlock()
+	req, err = newRequest()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.authorize(ctx, req, true); err != nil {
+		return nil, err
+	}
+	return c.client.Do(req)
+}
+
+// statusError returns the error of an unexpected response of the
+// registry.
+func statusError(resp *http.Response, format string, args ...interface{}) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	msg := fmt.Sprintf(format, args...)
+	if len(body) > 0 {
+		msg = fmt.Sprintf("%s: %s (%s)", msg, resp.Status, strings.TrimSpace(string(body)))
+	} else {
+		msg = fmt.Sprintf("%s: %s", msg, resp.Status)
+	}
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return classErrorf(ErrAuth, "%s", msg)
+	}
+	return fmt.Errorf("%s", msg)
+}
+
+// location resolves the Location header of an upload response.
+func (c *registryClient) location(resp *http.Response) (string, error) {
+	base, err := url.Parse(c.base)
+	if err != nil {
+		return "", err
+	}
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.Header.Get("Location") == "" {
+		return "", fmt.Errorf("Invalid upload location %q returned by %s", resp.Header.Get("Location"), c.base)
+	}
+	return base.ResolveReference(location).String(), nil
+}
+
+// hasBlob returns true if the blob is in the repository.
+func (c *registryClient) hasBlob(ctx context.Context, digest string) (bool, error) {
+	if err := c.detectScheme(ctx); err != nil {
+		return false, err
+	}
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "HEAD", fmt.Sprintf("%s/%s/blobs/%s", c.base, c.repository, digest), nil)
+	})
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, statusError(resp, "Could not check the blob %s in %s", digest, c.repository)
+}
+
+// getBlob returns the content of the blob and its size, -1 if it is
+// unknown.
+func (c *registryClient) getBlob(ctx context.Context, digest string) (io.ReadCloser, int64, error) {
+	if err := c.detectScheme(ctx); err != nil {
+		return nil, 0, err
+	}
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/%s/blobs/%s", c.base, c.repository, digest), nil)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, resp.ContentLength, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, 0, classErrorf(ErrBlobMissing, "The blob %s is not in %s", digest, c.repository)
+	}
+	defer resp.Body.Close()
+	return nil, 0, statusError(resp, "Could not get the blob %s from %s", digest, c.repository)
+}
+
+// putManifest puts the manifest, of the given media type, with the
+// reference (a tag or a digest) in the repository.
+func (c *registryClient) putManifest(ctx context.Context, ref string, mediaType string, manifest []byte) error {
+	if err := c.detectScheme(ctx); err != nil {
+		return err
+	}
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "PUT", fmt.Sprintf("%s/%s/manifests/%s", c.base, c.repository, ref), bytes.NewReader(manifest))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", mediaType)
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return statusError(resp, "Could not put the manifest %s to %s", ref, c.repository)
+	}
+	return nil
+}
+
+// uploadBlob uploads the blob read from r in chunks of
+// registryChunkSize bytes. Each chunk is authenticated with a fresh
+// token and sent again if the registry refuses it, so that long
+// uploads survive the expiration of tokens. The upload stops before
+// the next chunk once ctx is done.
+func (c *registryClient) uploadBlob(ctx context.Context, digest string, r io.Reader) (err error) {
+	if err := c.detectScheme(ctx); err != nil {
+		return err
+	}
+	start := time.Now()
+	ctx, span := metrics.StartSpan(ctx, "blob upload", "blob.digest", digest, "blob.repository", c.repository)
+	defer func() {
+		metrics.BlobPushSeconds.Add(time.Since(start).Seconds())
+		span.End(err)
+	}()
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/%s/blobs/uploads/", c.base, c.repository), nil)
+	})
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		defer resp.Body.Close()
+		return statusError(resp, "Could not start the upload of the blob %s to %s", digest, c.repository)
+	}
+	resp.Body.Close()
+	location, err := c.location(resp)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, registryChunkSize)
+	offset := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, readErr := io.ReadFull(r, buf)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return readErr
+		}
+		if n > 0 {
+			chunk := buf[:n]
+			resp, err := c.do(ctx, func() (*http.Request, error) {
+				req, err := http.NewRequestWithContext(ctx, "PATCH", location, bytes.NewReader(chunk))
+				if err != nil {
+					return nil, err
+				}
+				req.Header.Set("Content-Type", "application/octet-stream")
+				req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", offset, offset+n-1))
+				return req, nil
+			})
+			if err != nil {
+				return err
+			}
+			if resp.StatusCode != http.StatusAccepted {
+				defer resp.Body.Close()
+				return statusError(resp, "Could not upload the blob %s to %s", digest, c.repository)
+			}
+			resp.Body.Close()
+			if location, err = c.location(resp); err != nil {
+				return err
+			}
+			metrics.BlobBytesPushed.Add(float64(n))
+			offset += n
+		}
+		if readErr != nil {
+			break
+		}
+	}
+	resp, err = c.do(ctx, func() (*http.Request, error) {
+		u, err := url.Parse(location)
+		if err != nil {
+			return nil, err
+		}
+		query := u.Query()
+		query.Set("digest", digest)
+		u.RawQuery = query.Encode()
+		return http.NewRequestWithContext(ctx, "PUT", u.String(), nil)
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return statusError(resp, "Could not complete the upload of the blob %s to %s", digest, c.repository)
+	}
+	metrics.BlobsPushed.Inc()
+	span.SetAttributes("blob.size", offset)
+	return nil
+}
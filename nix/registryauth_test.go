@@ -0,0 +1,288 @@
+package nix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containers/image/v5/types"
+	"github.com/nlewo/nix2container/metrics"
+	godigest "github.com/opencontainers/go-digest"
+)
+
+func TestParseChallenge(t *testing.T) {
+	challenge := parseChallenge(`Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:app:pull,push"`)
+	expected := map[string]string{
+		"scheme":  "bearer",
+		"realm":   "https://auth.example.com/token",
+		"service": "registry.example.com",
+		"scope":   "repository:app:pull,push",
+	}
+	if !reflect.DeepEqual(challenge, expected) {
+		t.Fatalf("The challenge should be '%#v' (while it is %#v)", expected, challenge)
+	}
+	challenge = parseChallenge(`Basic realm=registry`)
+	expected = map[string]string{"scheme": "basic", "realm": "registry"}
+	if !reflect.DeepEqual(challenge, expected) {
+		t.Fatalf("The challenge should be '%#v' (while it is %#v)", expected, challenge)
+	}
+}
+
+// testRegistry is a registry accepting blob uploads authenticated by
+// the tokens it issues, which can be revoked.
+type testRegistry struct {
+	mu     sync.Mutex
+	issued int
+	valid  map[string]bool
+	blob   []byte
+	digest string
+}
+
+func (r *testRegistry) handler(t *testing.T) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		user, password, _ := req.BasicAuth()
+		if user != "user" || password != "password" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if scope := req.URL.Query().Get("scope"); scope != "repository:app:pull,push" {
+			t.Errorf("The scope should be 'repository:app:pull,push' (while it is %s)", scope)
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.issued++
+		token := fmt.Sprintf("token-%d", r.issued)
+		r.valid[token] = true
+		fmt.Fprintf(w, `{"token": "%s", "expires_in": 100}`, token)
+	})
+	mux.HandleFunc("/v2/app/blobs/uploads/", func(w http.ResponseWriter, req *http.Request) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if !r.valid[strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")] {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="test"`, req.Host))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch req.Method {
+		case "POST":
+			w.Header().Set("Location", "/v2/app/blobs/uploads/session")
+			w.WriteHeader(http.StatusAccepted)
+		case "PATCH":
+			body, _ := ioutil.ReadAll(req.Body)
+			if expected := fmt.Sprintf("%d-%d", len(r.blob), len(r.blob)+len(body)-1); req.Header.Get("Content-Range") != expected {
+				t.Errorf("The range should be '%s' (while it is %s)", expected, req.Header.Get("Content-Range"))
+			}
+			r.blob = append(r.blob, body...)
+			w.Header().Set("Location", "/v2/app/blobs/uploads/session")
+			w.WriteHeader(http.StatusAccepted)
+		case "PUT":
+			r.digest = req.URL.Query().Get("digest")
+			w.WriteHeader(http.StatusCreated)
+		}
+	})
+	mux.HandleFunc("/v2/app/blobs/", func(w http.ResponseWriter, req *http.Request) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if !r.valid[strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")] {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="test"`, req.Host))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if strings.TrimPrefix(req.URL.Path, "/v2/app/blobs/") != r.digest {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(r.blob)))
+		if req.Method == "GET" {
+			w.Write(r.blob)
+		}
+	})
+	return mux
+}
+
+func (r *testRegistry) revoke() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.valid = make(map[string]bool)
+}
+
+func TestRegistryClientUploadBlob(t *testing.T) {
+	defer func(size int) { registryChunkSize = size }(registryChunkSize)
+	registryChunkSize = 4
+
+	registry := &testRegistry{valid: make(map[string]bool)}
+	server := httptest.NewServer(registry.handler(t))
+	defer server.Close()
+
+	// Each request takes 30 seconds, so that the token, which
+	// expires after 100 seconds, is refreshed during the upload
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	client := &registryClient{
+		base:       server.URL + "/v2",
+		repository: "app",
+		auth:       registryCredentials{username: "user", password: "password"},
+		client:     server.Client(),
+		now: func() time.Time {
+			now = now.Add(30 * time.Second)
+			return now
+		},
+	}
+	blob := []byte("a blob of 18 bytes")
+	digest := godigest.FromBytes(blob).String()
+	pushed := metrics.BlobBytesPushed.Value()
+	if err := client.uploadBlob(context.Background(), digest, strings.NewReader(string(blob))); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if n := metrics.BlobBytesPushed.Value() - pushed; n != float64(len(blob)) {
+		t.Fatalf("The pushed bytes should be '%d' (while they are %v)", len(blob), n)
+	}
+	if string(registry.blob) != string(blob) || registry.digest != digest {
+		t.Fatalf("The uploaded blob should be '%s' (while it is %s with the digest %s)", blob, registry.blob, registry.digest)
+	}
+	if registry.issued < 2 {
+		t.Fatalf("The token should have been refreshed during the upload (while %d token has been issued)", registry.issued)
+	}
+
+	// A revoked token is replaced by a new one
+	registry.blob = nil
+	issued := registry.issued
+	registry.revoke()
+	client.now = func() time.Time { return now }
+	if err := client.uploadBlob(context.Background(), digest, strings.NewReader(string(blob))); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if string(registry.blob) != string(blob) || registry.issued != issued+1 {
+		t.Fatalf("The upload should use a new token (while %d tokens have been issued and the blob is %s)", registry.issued-issued, registry.blob)
+	}
+
+	// Invalid credentials are authentication errors
+	client.auth.password = "invalid"
+	registry.revoke()
+	if err := client.uploadBlob(context.Background(), digest, strings.NewReader(string(blob))); !errors.Is(err, ErrAuth) {
+		t.Fatalf("The upload should fail with an authentication error (while it is %v)", err)
+	}
+}
+
+func TestRegistryClientGetBlob(t *testing.T) {
+	blob := []byte("blob")
+	registry := &testRegistry{valid: make(map[string]bool), blob: blob, digest: godigest.FromBytes(blob).String()}
+	server := httptest.NewServer(registry.handler(t))
+	defer server.Close()
+	client := &registryClient{
+		base:       server.URL + "/v2",
+		repository: "app",
+		auth:       registryCredentials{username: "user", password: "password"},
+		client:     server.Client(),
+		now:        time.Now,
+	}
+	ok, err := client.hasBlob(context.Background(), registry.digest)
+	if err != nil || !ok {
+		t.Fatalf("The blob should be in the registry (while it is %v, %v)", ok, err)
+	}
+	rc, size, err := client.getBlob(context.Background(), registry.digest)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	content, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil || string(content) != "blob" || size != 4 {
+		t.Fatalf("The blob should be 'blob' of 4 bytes (while it is %q of %d bytes, %v)", content, size, err)
+	}
+
+	missing := godigest.FromString("missing").String()
+	if ok, err := client.hasBlob(context.Background(), missing); err != nil || ok {
+		t.Fatalf("The blob should not be in the registry (while it is %v, %v)", ok, err)
+	}
+	if _, _, err := client.getBlob(context.Background(), missing); !errors.Is(err, ErrBlobMissing) {
+		t.Fatalf("Getting a missing blob should fail with ErrBlobMissing (while it is %v)", err)
+	}
+}
+
+func TestRegistryClientDetectScheme(t *testing.T) {
+	registry := &testRegistry{valid: make(map[string]bool)}
+	server := httptest.NewServer(registry.handler(t))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	// Secure registries are only contacted over HTTPS
+	client := &registryClient{base: "https://" + host + "/v2", client: server.Client()}
+	if err := client.detectScheme(context.Background()); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if client.base != "https://"+host+"/v2" {
+		t.Fatalf("The base should be 'https://%s/v2' (while it is %s)", host, client.base)
+	}
+
+	// The scheme of insecure registries is probed once, by the
+	// first of the concurrent requests
+	client = &registryClient{base: "https://" + host + "/v2", client: server.Client(), insecure: true}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := client.detectScheme(context.Background()); err != nil {
+				t.Errorf("%v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if client.base != server.URL+"/v2" {
+		t.Fatalf("The base should be '%s/v2' (while it is %s)", server.URL, client.base)
+	}
+}
+
+func TestStoreRegistryToken(t *testing.T) {
+	defer func(tokens map[string]registryToken) { registryTokens.tokens = tokens }(registryTokens.tokens)
+	registryTokens.tokens = make(map[string]registryToken)
+
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < maxRegistryTokens; i++ {
+		registryTokens.tokens[fmt.Sprintf("key-%d", i)] = registryToken{value: "token", expiresAt: now.Add(time.Duration(i+1) * time.Minute)}
+	}
+	// The token expiring first is dropped once the cache is full
+	storeRegistryToken("new", registryToken{value: "token", expiresAt: now.Add(time.Hour)}, now)
+	if len(registryTokens.tokens) != maxRegistryTokens {
+		t.Fatalf("The cache should contain %d tokens (while it contains %d)", maxRegistryTokens, len(registryTokens.tokens))
+	}
+	if _, ok := registryTokens.tokens["key-0"]; ok {
+		t.Fatalf("The token expiring first should be dropped")
+	}
+	// The expired tokens are dropped first
+	storeRegistryToken("other", registryToken{value: "token", expiresAt: now.Add(time.Hour)}, now.Add(10*time.Minute+time.Second))
+	if len(registryTokens.tokens) != maxRegistryTokens-8 {
+		t.Fatalf("The cache should contain %d tokens (while it contains %d)", maxRegistryTokens-8, len(registryTokens.tokens))
+	}
+	if _, ok := registryTokens.tokens["key-10"]; !ok {
+		t.Fatalf("The tokens which have not expired should be kept")
+	}
+}
+
+func TestRegistryCertDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "registry.example.com:5000"), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	sys := &types.SystemContext{DockerPerHostCertDirPath: dir}
+	if d := registryCertDir(sys, "registry.example.com:5000"); d != filepath.Join(dir, "registry.example.com:5000") {
+		t.Fatalf("The certificate directory should be '%s' (while it is %s)", filepath.Join(dir, "registry.example.com:5000"), d)
+	}
+	if d := registryCertDir(sys, "other.example.com"); d != "" {
+		t.Fatalf("The registry should not have a certificate directory (while it is %s)", d)
+	}
+	sys.DockerCertPath = "/certs"
+	if d := registryCertDir(sys, "other.example.com"); d != "/certs" {
+		t.Fatalf("The certificate directory should be '/certs' (while it is %s)", d)
+	}
+}
@@ -0,0 +1,99 @@
+package nix
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	imageTypes "github.com/containers/image/v5/types"
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// UploadLayers uploads the blobs of the layers, read with getBlob, to
+// the repository of the docker reference ref before the image is
+// copied by containers/image, which then reuses them. Blobs are
+// uploaded in chunks authenticated by bearer tokens which are
+// refreshed during the upload (see registryClient.uploadBlob): since
+// containers/image uploads a blob with the token it had when the
+// upload started, the push of a huge layer fails once this token has
+// expired. Blobs already in the repository and the blobs of pinned
+// layers, which are not available, are skipped. The blobs on the
+// repository are recorded in the push state, if any. The number of
+// blobs uploaded at the same time is limited by the upload limits
+// (see SetUploadLimits), and the first failure cancels the other
+// uploads.
+func UploadLayers(ctx context.Context, sys *imageTypes.SystemContext, ref imageTypes.ImageReference, layers []types.Layer, getBlob func(ctx context.Context, digest godigest.Digest) (io.ReadCloser, int64, error)) error {
+	store := &registryBlobStore{location: "docker:" + ref.StringWithinTransport(), ref: ref, sys: sys}
+	var digests []godigest.Digest
+	uploaded := make(map[string]bool)
+	for _, layer := range layers {
+		if layer.Pinned || uploaded[layer.Digest] {
+			continue
+		}
+		uploaded[layer.Digest] = true
+		digests = append(digests, godigest.Digest(layer.Digest))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	jobs := make(chan godigest.Digest)
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for i := 0; i < parallelUploads() && i < len(digests); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for digest := range jobs {
+				if err := uploadLayer(ctx, store, digest, getBlob); err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+send:
+	for _, digest := range digests {
+		select {
+		case jobs <- digest:
+		case <-ctx.Done():
+			break send
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// uploadLayer uploads the blob of a layer to the store, unless it is
+// already there.
+func uploadLayer(ctx context.Context, store *registryBlobStore, digest godigest.Digest, getBlob func(ctx context.Context, digest godigest.Digest) (io.ReadCloser, int64, error)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ok, err := store.Has(ctx, digest)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		logrus.Infof("Uploading the layer %s to %s", digest, store.location)
+		rc, size, err := getBlob(ctx, digest)
+		if err != nil {
+			return err
+		}
+		err = store.upload(ctx, digest, rc, size)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	recordBlobPushed(digest.String())
+	return nil
+}
@@ -0,0 +1,134 @@
+package nix
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containers/image/v5/docker"
+	imageTypes "github.com/containers/image/v5/types"
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+)
+
+// blockingReadCloser blocks its first read until the release channel
+// is closed.
+type blockingReadCloser struct {
+	io.Reader
+	release chan struct{}
+	closed  func()
+	read    bool
+}
+
+func (r *blockingReadCloser) Read(p []byte) (int, error) {
+	if !r.read {
+		r.read = true
+		select {
+		case <-r.release:
+		case <-time.After(10 * time.Second):
+			return 0, fmt.Errorf("The blobs have not been uploaded in parallel")
+		}
+	}
+	return r.Reader.Read(p)
+}
+
+func (r *blockingReadCloser) Close() error {
+	r.closed()
+	return nil
+}
+
+func TestUploadLayers(t *testing.T) {
+	defer SetUploadLimits(0, 0)
+	SetUploadLimits(0, 2)
+
+	var mu sync.Mutex
+	uploaded := make(map[string]bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case req.Method == "HEAD":
+			if !uploaded[strings.TrimPrefix(req.URL.Path, "/v2/app/blobs/")] {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		case req.Method == "POST":
+			w.Header().Set("Location", "/v2/app/blobs/uploads/session")
+			w.WriteHeader(http.StatusAccepted)
+		case req.Method == "PATCH":
+			ioutil.ReadAll(req.Body)
+			w.Header().Set("Location", "/v2/app/blobs/uploads/session")
+			w.WriteHeader(http.StatusAccepted)
+		case req.Method == "PUT":
+			uploaded[req.URL.Query().Get("digest")] = true
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer server.Close()
+	ref, err := docker.ParseReference("//" + strings.TrimPrefix(server.URL, "http://") + "/app")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	sys := &imageTypes.SystemContext{DockerInsecureSkipTLSVerify: imageTypes.OptionalBoolTrue}
+
+	var layers []types.Layer
+	blobs := make(map[godigest.Digest]string)
+	for i := 0; i < 5; i++ {
+		blob := fmt.Sprintf("blob %d", i)
+		digest := godigest.FromString(blob)
+		blobs[digest] = blob
+		layers = append(layers, types.Layer{Digest: digest.String()})
+	}
+	// The first reads are blocked until 2 blobs are read at the
+	// same time, and no more than 2 blobs are read at the same time
+	release := make(chan struct{})
+	reading, maxReading := 0, 0
+	getBlob := func(ctx context.Context, digest godigest.Digest) (io.ReadCloser, int64, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		reading++
+		if reading > maxReading {
+			maxReading = reading
+		}
+		if reading == 2 && maxReading == 2 {
+			select {
+			case <-release:
+			default:
+				close(release)
+			}
+		}
+		return &blockingReadCloser{
+			Reader:  strings.NewReader(blobs[digest]),
+			release: release,
+			closed: func() {
+				mu.Lock()
+				defer mu.Unlock()
+				reading--
+			},
+		}, int64(len(blobs[digest])), nil
+	}
+	if err := UploadLayers(context.Background(), sys, ref, layers, getBlob); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(uploaded) != len(layers) {
+		t.Fatalf("%d blobs should be uploaded (while %d are)", len(layers), len(uploaded))
+	}
+	if maxReading != 2 {
+		t.Fatalf("2 blobs should be uploaded at the same time (while it is %d)", maxReading)
+	}
+
+	// The first failure is returned
+	uploaded = make(map[string]bool)
+	failing := func(ctx context.Context, digest godigest.Digest) (io.ReadCloser, int64, error) {
+		return nil, 0, fmt.Errorf("failure")
+	}
+	if err := UploadLayers(context.Background(), sys, ref, layers, failing); err == nil || err.Error() != "failure" {
+		t.Fatalf("The upload should fail with 'failure' (while it is %v)", err)
+	}
+}
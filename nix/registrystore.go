@@ -0,0 +1,100 @@
+package nix
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/types"
+	godigest "github.com/opencontainers/go-digest"
+)
+
+// registryBlobStore stores blobs in a repository of a registry. The
+// credentials are read from the usual containers auth files, as
+// Skopeo does.
+type registryBlobStore struct {
+	location string
+	ref      types.ImageReference
+	sys      *types.SystemContext
+
+	mu sync.Mutex
+	// The client of the repository, shared by the requests of the
+	// store so that the registry is only probed once
+	registryClient *registryClient
+}
+
+func newRegistryBlobStore(location string) (*registryBlobStore, error) {
+	ref, err := docker.ParseReference(strings.TrimPrefix(location, "docker:"))
+	if err != nil {
+		return nil, err
+	}
+	return &registryBlobStore{location: location, ref: ref, sys: &types.SystemContext{}}, nil
+}
+
+// registryError classifies the errors of the registry.
+func registryError(err error, format string, args ...interface{}) error {
+	if errors.As(err, &docker.ErrUnauthorizedForCredentials{}) {
+		return classErrorf(ErrAuth, format+": %w", append(args, err)...)
+	}
+	return err
+}
+
+// client returns the client of the repository of the store.
+func (s *registryBlobStore) client() (*registryClient, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.registryClient == nil {
+		client, err := newSystemRegistryClient(s.sys, s.ref.DockerReference())
+		if err != nil {
+			return nil, err
+		}
+		s.registryClient = client
+	}
+	return s.registryClient, nil
+}
+
+// Has and Get talk to the registry with the HTTP client configured by
+// SetHTTPOptions, as uploads do, instead of the clients of
+// containers/image.
+func (s *registryBlobStore) Has(ctx context.Context, digest godigest.Digest) (bool, error) {
+	client, err := s.client()
+	if err != nil {
+		return false, err
+	}
+	return client.hasBlob(ctx, digest.String())
+}
+
+func (s *registryBlobStore) Get(ctx context.Context, digest godigest.Digest) (io.ReadCloser, int64, error) {
+	client, err := s.client()
+	if err != nil {
+		return nil, 0, err
+	}
+	return client.getBlob(ctx, digest.String())
+}
+
+// Put uploads the blob, which is verified by the registry. Blobs
+// already in the repository are not uploaded again.
+func (s *registryBlobStore) Put(ctx context.Context, digest godigest.Digest, r io.Reader, size int64) error {
+	ok, err := s.Has(ctx, digest)
+	if err != nil || ok {
+		return err
+	}
+	return s.upload(ctx, digest, r, size)
+}
+
+// upload uploads the blob in chunks, see registryClient.uploadBlob.
+func (s *registryBlobStore) upload(ctx context.Context, digest godigest.Digest, r io.Reader, size int64) error {
+	client, err := s.client()
+	if err != nil {
+		return err
+	}
+	verified := verifyBlob(io.NopCloser(r), "its source", digest, size)
+	return client.uploadBlob(ctx, digest.String(), verified)
+}
+
+func (s *registryBlobStore) String() string {
+	return s.location
+}
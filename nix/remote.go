@@ -0,0 +1,252 @@
+package nix
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RemoteCacheTokenEnv is the environment variable containing the
+// bearer token sent to HTTP remote caches.
+const RemoteCacheTokenEnv = "NIX2CONTAINER_DIGEST_CACHE_TOKEN"
+
+// remoteStore stores small files in an HTTP store, with GET and PUT
+// requests, or in an S3 bucket.
+type remoteStore struct {
+	// The URL of the directory containing the files
+	base   string
+	client *http.Client
+	// sign authenticates requests, whose payload has the SHA256
+	// payloadHash
+	sign func(req *http.Request, payloadHash [sha256.Size]byte)
+}
+
+// newRemoteStore creates a store from an http(s):// URL or an
+// s3://BUCKET/PREFIX URL. Requests to S3 are signed with the AWS
+// credentials found in the environment (AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN), for the region
+// AWS_REGION. AWS_ENDPOINT_URL can be set to use an S3 compatible
+// server, such as MinIO.
+func newRemoteStore(location string) (*remoteStore, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	store := &remoteStore{client: &http.Client{Transport: getHTTPClient().Transport, Timeout: 30 * time.Second}}
+	switch u.Scheme {
+	case "http", "https":
+		store.base = strings.TrimSuffix(u.String(), "/")
+		token := os.Getenv(RemoteCacheTokenEnv)
+		store.sign = func(req *http.Request, payloadHash [sha256.Size]byte) {
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+		}
+	case "s3":
+		region := os.Getenv("AWS_REGION")
+		if region == "" {
+			region = os.Getenv("AWS_DEFAULT_REGION")
+		}
+		if region == "" {
+			region = "us-east-1"
+		}
+		prefix := strings.Trim(u.Path, "/")
+		if endpoint := os.Getenv("AWS_ENDPOINT_URL"); endpoint != "" {
+			store.base = strings.TrimSuffix(endpoint, "/") + "/" + u.Host
+		} else {
+			store.base = fmt.Sprintf("https://%s.s3.%s.amazonaws.com", u.Host, region)
+		}
+		if prefix != "" {
+			store.base += "/" + prefix
+		}
+		creds := awsCredentials{
+			accessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			secretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			sessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+			region:          region,
+		}
+		if creds.accessKeyID == "" || creds.secretAccessKey == "" {
+			return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required to use the S3 cache %s", location)
+		}
+		store.sign = func(req *http.Request, payloadHash [sha256.Size]byte) {
+			creds.signHash(req, payloadHash, time.Now())
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported remote cache URL %q (it must be an http(s):// or s3:// URL)", location)
+	}
+	return store, nil
+}
+
+// get returns the content of the file name, or false if it doesn't
+// exist.
+func (s *remoteStore) get(name string) ([]byte, bool, error) {
+	resp, err := s.do(s.client, http.MethodGet, name)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, false, nil
+	}
+	content, err := ioutil.ReadAll(resp.Body)
+	return content, err == nil, err
+}
+
+// exists returns true if the file name exists.
+func (s *remoteStore) exists(name string) (bool, error) {
+	resp, err := s.do(s.client, http.MethodHead, name)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+// open returns the content of the file name, such as a layer blob,
+// and its size. The download is not limited in time.
+func (s *remoteStore) open(name string) (io.ReadCloser, int64, error) {
+	resp, err := s.do(&http.Client{Transport: s.client.Transport}, http.MethodGet, name)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, 0, classErrorf(ErrBlobMissing, "The file %s/%s doesn't exist", s.base, name)
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+// do sends a request without payload. The response is returned if its
+// status is 200 or 404.
+func (s *remoteStore) do(client *http.Client, method string, name string) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.base+"/"+name, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, sha256.Sum256(nil))
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNotFound:
+		return resp, nil
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return nil, classErrorf(ErrAuth, "Could not get %s/%s: %s", s.base, name, resp.Status)
+	}
+	return nil, fmt.Errorf("Could not get %s/%s: %s", s.base, name, resp.Status)
+}
+
+func (s *remoteStore) put(name string, content []byte) error {
+	return s.upload(s.client, name, "application/json", bytes.NewReader(content), int64(len(content)), sha256.Sum256(content))
+}
+
+// putFile is like put for large files, such as layer blobs, read from
+// r whose size and SHA256 are known. The upload is not limited in
+// time.
+func (s *remoteStore) putFile(name string, contentType string, r io.Reader, size int64, hash [sha256.Size]byte) error {
+	return s.upload(&http.Client{Transport: s.client.Transport}, name, contentType, r, size, hash)
+}
+
+func (s *remoteStore) upload(client *http.Client, name string, contentType string, r io.Reader, size int64, hash [sha256.Size]byte) error {
+	req, err := http.NewRequest(http.MethodPut, s.base+"/"+name, r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
+	s.sign(req, hash)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+		return nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return classErrorf(ErrAuth, "Could not put %s/%s: %s", s.base, name, resp.Status)
+	default:
+		return fmt.Errorf("Could not put %s/%s: %s", s.base, name, resp.Status)
+	}
+}
+
+type awsCredentials struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+	region          string
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// sign adds the AWS Signature Version 4 of the S3 request to its
+// headers. The headers set before are signed.
+func (c awsCredentials) sign(req *http.Request, payload []byte, now time.Time) {
+	c.signHash(req, sha256.Sum256(payload), now)
+}
+
+// signHash is like sign for a payload whose SHA256 is payloadHash.
+func (c awsCredentials) signHash(req *http.Request, payloadHash [sha256.Size]byte, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := day + "/" + c.region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(canonicalRequestHash[:]),
+	}, "\n")
+	key := hmacSHA256([]byte("AWS4"+c.secretAccessKey), day)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", c.accessKeyID, scope, signedHeaders, signature))
+}
@@ -0,0 +1,122 @@
+package nix
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+)
+
+// LabelRebuild is the label of the image configuration containing
+// the JSON rebuild instructions of the image.
+const LabelRebuild = "org.nixos.nix2container.rebuild"
+
+// SetRebuildLabel adds the rebuild instructions to the labels of the
+// image configuration.
+func SetRebuildLabel(config *v1.ImageConfig, rebuild types.RebuildInstructions) error {
+	if rebuild.Flake == "" || rebuild.Attribute == "" || rebuild.System == "" {
+		return fmt.Errorf("The rebuild instructions require a flake, an attribute and a system")
+	}
+	content, err := json.Marshal(rebuild)
+	if err != nil {
+		return err
+	}
+	labels := make(map[string]string)
+	for k, v := range config.Labels {
+		labels[k] = v
+	}
+	labels[LabelRebuild] = string(content)
+	config.Labels = labels
+	return nil
+}
+
+// ReproduceResult compares the digests of a published image with the
+// digests of the image built again from its rebuild instructions.
+type ReproduceResult struct {
+	Rebuild               types.RebuildInstructions
+	ManifestDigest        godigest.Digest
+	ConfigDigest          godigest.Digest
+	RebuiltManifestDigest godigest.Digest
+	RebuiltConfigDigest   godigest.Digest
+}
+
+// Reproducible is true when the rebuilt image is identical to the
+// published one.
+func (r ReproduceResult) Reproducible() bool {
+	return r.ManifestDigest == r.RebuiltManifestDigest && r.ConfigDigest == r.RebuiltConfigDigest
+}
+
+// Reproduce fetches the manifest and the configuration of the image
+// ref (such as docker://registry/image:tag) with skopeo, builds the
+// image again with nix from the rebuild instructions found in its
+// labels and compares the digests. The reference has to designate an
+// image manifest, not an index.
+func Reproduce(ctx context.Context, ref string, skopeo string, nix string) (result ReproduceResult, err error) {
+	rawManifest, err := runOutput(ctx, skopeo, "inspect", "--raw", ref)
+	if err != nil {
+		return result, err
+	}
+	var manifest v1.Manifest
+	if err := json.Unmarshal(rawManifest, &manifest); err != nil {
+		return result, fmt.Errorf("Could not parse the manifest of %s: %w", ref, err)
+	}
+	if manifest.Config.Digest == "" {
+		return result, fmt.Errorf("The reference %s is not an image manifest (an index is not supported)", ref)
+	}
+	result.ManifestDigest = godigest.FromBytes(rawManifest)
+	result.ConfigDigest = manifest.Config.Digest
+
+	rawConfig, err := runOutput(ctx, skopeo, "inspect", "--config", "--raw", ref)
+	if err != nil {
+		return result, err
+	}
+	var config v1.Image
+	if err := json.Unmarshal(rawConfig, &config); err != nil {
+		return result, fmt.Errorf("Could not parse the configuration of %s: %w", ref, err)
+	}
+	label, ok := config.Config.Labels[LabelRebuild]
+	if !ok {
+		return result, fmt.Errorf("The image %s has no %s label", ref, LabelRebuild)
+	}
+	if err := json.Unmarshal([]byte(label), &result.Rebuild); err != nil {
+		return result, fmt.Errorf("Could not parse the %s label: %w", LabelRebuild, err)
+	}
+
+	installable := result.Rebuild.Flake + "#" + result.Rebuild.Attribute
+	logrus.Infof("Building %s for %s", installable, result.Rebuild.System)
+	out, err := runOutput(ctx, nix, "build", "--no-link", "--print-out-paths", "--system", result.Rebuild.System, installable)
+	if err != nil {
+		return result, err
+	}
+	image, err := NewImageFromFile(strings.TrimSpace(string(out)))
+	if err != nil {
+		return result, err
+	}
+	rebuiltManifest, err := GetManifestBlob(image)
+	if err != nil {
+		return result, err
+	}
+	result.RebuiltManifestDigest = godigest.FromBytes(rebuiltManifest)
+	result.RebuiltConfigDigest, _, err = GetConfigDigest(image)
+	return result, err
+}
+
+// runOutput runs the command and returns its standard output.
+func runOutput(ctx context.Context, name string, args ...string) ([]byte, error) {
+	var stdout bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("The command %s %s failed: %w", name, strings.Join(args, " "), err)
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,95 @@
+package nix
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nlewo/nix2container/types"
+)
+
+// fakeCommand writes a shell script printing the file output, or
+// configOutput if --config is one of its arguments.
+func fakeCommand(t *testing.T, name, output, configOutput string) string {
+	script := filepath.Join(t.TempDir(), name)
+	content := "#!/bin/sh\nfor a in \"$@\"; do [ \"$a\" = --config ] && exec cat " + configOutput + "; done\nexec cat " + output + "\n"
+	if err := ioutil.WriteFile(script, []byte(content), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	return script
+}
+
+func TestReproduce(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("/bin/sh is not available")
+	}
+	dir := t.TempDir()
+	image, err := NewImageFromDir("../data/image-directory")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	rebuild := types.RebuildInstructions{Flake: "github:owner/repo/abc", Attribute: "image", System: "x86_64-linux"}
+	if err := SetRebuildLabel(&image.ImageConfig, rebuild); err != nil {
+		t.Fatalf("%v", err)
+	}
+	manifest, err := GetManifestBlob(image)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	config, err := GetConfigBlob(image)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	imageJSON, err := types.MarshalCanonical(image)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for name, content := range map[string][]byte{"manifest.json": manifest, "config.json": config, "image.json": imageJSON} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	outPath := filepath.Join(dir, "out-path")
+	if err := ioutil.WriteFile(outPath, []byte(filepath.Join(dir, "image.json")+"\n"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	skopeo := fakeCommand(t, "skopeo", filepath.Join(dir, "manifest.json"), filepath.Join(dir, "config.json"))
+	nix := fakeCommand(t, "nix", outPath, outPath)
+
+	result, err := Reproduce(context.Background(), "docker://example.com/image:latest", skopeo, nix)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if result.Rebuild != rebuild {
+		t.Fatalf("Rebuild instructions should be '%#v' (while they are %#v)", rebuild, result.Rebuild)
+	}
+	if !result.Reproducible() {
+		t.Fatalf("The image should be reproducible (while the result is %#v)", result)
+	}
+
+	// The published image differs from the rebuilt one
+	image.ImageConfig.User = "nobody"
+	config, err = GetConfigBlob(image)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "config.json"), config, 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	manifest, err = GetManifestBlob(image)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "manifest.json"), manifest, 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	result, err = Reproduce(context.Background(), "docker://example.com/image:latest", skopeo, nix)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if result.Reproducible() {
+		t.Fatalf("The image should not be reproducible (while the result is %#v)", result)
+	}
+}
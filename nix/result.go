@@ -0,0 +1,34 @@
+package nix
+
+import (
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+)
+
+// NewResult builds the result of the copy of an image whose manifest
+// digest is manifestDigest to destinations.
+func NewResult(image types.Image, manifestDigest godigest.Digest, destinations []string) (result types.Result, err error) {
+	configDigest, configSize, err := GetConfigDigest(image)
+	if err != nil {
+		return result, err
+	}
+	result = types.Result{
+		Digest:       manifestDigest.String(),
+		Size:         configSize,
+		Destinations: destinations,
+		Config: types.ResultBlob{
+			Digest: configDigest.String(),
+			Size:   configSize,
+		},
+		Layers: []types.ResultLayer{},
+	}
+	for _, layer := range image.Layers {
+		result.Layers = append(result.Layers, types.ResultLayer{
+			Digest:  layer.Digest,
+			DiffIDs: layer.DiffIDs,
+			Size:    layer.Size,
+		})
+		result.Size += layer.Size
+	}
+	return result, nil
+}
@@ -0,0 +1,34 @@
+package nix
+
+import (
+	"testing"
+
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+)
+
+func TestNewResult(t *testing.T) {
+	image := types.Image{
+		Layers: []types.Layer{
+			types.Layer{
+				Digest:  "sha256:1d93274b1a59eed0a471f601a7f87ae58e2860566ed20313043b1efd983e8baa",
+				DiffIDs: "sha256:1d93274b1a59eed0a471f601a7f87ae58e2860566ed20313043b1efd983e8baa",
+				Size:    1536,
+			},
+		},
+	}
+	manifestDigest := godigest.FromString("manifest")
+	result, err := NewResult(image, manifestDigest, []string{"docker://localhost/image:latest"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if result.Digest != manifestDigest.String() {
+		t.Fatalf("Digest should be %s (while it is %s)", manifestDigest, result.Digest)
+	}
+	if result.Size != result.Config.Size+1536 {
+		t.Fatalf("Size should be the sum of the config and layers sizes (while it is %d)", result.Size)
+	}
+	if len(result.Layers) != 1 || result.Layers[0].Reused != nil {
+		t.Fatalf("Layers are not the expected ones: %#v", result.Layers)
+	}
+}
@@ -0,0 +1,277 @@
+package nix
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nlewo/nix2container/types"
+	"github.com/sirupsen/logrus"
+)
+
+// Filesystem image formats supported by WriteRootfs.
+const (
+	RootfsExt4  = "ext4"
+	RootfsErofs = "erofs"
+	// The squashfs image is created by mksquashfs, reading the
+	// tarball on its standard input
+	RootfsSquashfs = "squashfs"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// forEachLayerEntry calls fn on each entry of the layer archive. The
+// entry name is normalized to a relative clean path.
+func forEachLayerEntry(ctx context.Context, layer types.Layer, fn func(hdr *tar.Header, r io.Reader) error) error {
+	rc, _, err := LayerGetBlob(layer)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	r, err := decompressReader(rc, layer.MediaType)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(r)
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Could not read the archive of the layer %s: %w", layer.Digest, err)
+		}
+		hdr.Name = normalizeEntryName(hdr.Name)
+		if hdr.Name == "" {
+			continue
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			hdr.Linkname = normalizeEntryName(hdr.Linkname)
+		}
+		if err := fn(hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func normalizeEntryName(name string) string {
+	name = strings.TrimLeft(path.Clean("/"+name), "/")
+	if name == "." {
+		return ""
+	}
+	return name
+}
+
+// FlattenImage writes to w a single archive containing the files of
+// the image, as seen by a container: upper layers override files of
+// lower layers and whiteouts are applied. Directories are written
+// first, followed by the other entries in the layer order. Missing
+// parent directories are added with the 0755 mode.
+func FlattenImage(ctx context.Context, image types.Image, w io.Writer) error {
+	// The entries are selected by walking the layers from the top
+	// one: an entry is kept if it is not already provided by an
+	// upper layer and not hidden by a whiteout of an upper layer.
+	winners := make(map[string]int)
+	directories := make(map[string]*tar.Header)
+	// Paths removed by whiteouts and directories whose content is
+	// removed by opaque whiteouts
+	deleted := make(map[string]bool)
+	opaque := make(map[string]bool)
+	isHidden := func(name string) bool {
+		for p := name; p != "."; p = path.Dir(p) {
+			if deleted[p] {
+				return true
+			}
+			if p == name {
+				continue
+			}
+			if opaque[p] {
+				return true
+			}
+			// A file of an upper layer hides the content of
+			// a lower directory
+			if _, ok := winners[p]; ok && directories[p] == nil {
+				return true
+			}
+		}
+		return false
+	}
+	for i := len(image.Layers) - 1; i >= 0; i-- {
+		var deletes, opaques []string
+		err := forEachLayerEntry(ctx, image.Layers[i], func(hdr *tar.Header, r io.Reader) error {
+			dir, base := path.Dir(hdr.Name), path.Base(hdr.Name)
+			switch {
+			case base == whiteoutOpaque:
+				opaques = append(opaques, dir)
+			case strings.HasPrefix(base, whiteoutPrefix):
+				deletes = append(deletes, path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)))
+			case isHidden(hdr.Name):
+			default:
+				if _, ok := winners[hdr.Name]; ok {
+					return nil
+				}
+				winners[hdr.Name] = i
+				if hdr.Typeflag == tar.TypeDir {
+					h := *hdr
+					directories[hdr.Name] = &h
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// Whiteouts only apply to lower layers
+		for _, d := range deletes {
+			deleted[d] = true
+		}
+		for _, o := range opaques {
+			opaque[o] = true
+		}
+	}
+
+	for name := range winners {
+		for p := path.Dir(name); p != "."; p = path.Dir(p) {
+			if _, ok := winners[p]; !ok {
+				winners[p] = -1
+				directories[p] = &tar.Header{
+					Typeflag: tar.TypeDir,
+					Name:     p,
+					Mode:     0755,
+					Uname:    "root",
+					Gname:    "root",
+					ModTime:  time.Date(1970, 01, 01, 0, 0, 0, 0, time.UTC),
+				}
+			}
+		}
+	}
+	var names []string
+	for name := range directories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tw := tar.NewWriter(w)
+	for _, name := range names {
+		hdr := directories[name]
+		hdr.Name = name + "/"
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+	}
+	for i, layer := range image.Layers {
+		err := forEachLayerEntry(ctx, layer, func(hdr *tar.Header, r io.Reader) error {
+			if winner, ok := winners[hdr.Name]; !ok || winner != i || hdr.Typeflag == tar.TypeDir {
+				return nil
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			_, err := io.Copy(tw, r)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// WriteRootfs writes the files of the image into the filesystem image
+// output, with the format ext4, erofs or squashfs, for instance to
+// boot a microVM. The filesystem is created by the mkfs command (such
+// as mkfs.ext4, which needs to support tarballs, or mksquashfs) from
+// the flattened archive of the image, so that file ownerships and
+// modes are the ones of the image. The size of ext4 images is
+// required.
+//
+// Filesystem timestamps and UUIDs are fixed to generate reproducible
+// filesystem images.
+func WriteRootfs(ctx context.Context, image types.Image, format string, size int64, mkfs string, output string) error {
+	if _, err := mkfsArgs(format, size, "", output); err != nil {
+		return err
+	}
+	tarball, err := ioutil.TempFile(filepath.Dir(output), ".rootfs-*.tar")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tarball.Name())
+	err = FlattenImage(ctx, image, tarball)
+	if closeErr := tarball.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if format == RootfsExt4 {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		err = f.Truncate(size)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	args, _ := mkfsArgs(format, size, tarball.Name(), output)
+	logrus.Infof("Running %s %s", mkfs, strings.Join(args, " "))
+	cmd := exec.CommandContext(ctx, mkfs, args...)
+	// mke2fs uses E2FSPROGS_FAKE_TIME as the filesystem creation
+	// time, and mkfs.erofs SOURCE_DATE_EPOCH
+	cmd.Env = append(os.Environ(), "E2FSPROGS_FAKE_TIME=1", "SOURCE_DATE_EPOCH=1")
+	cmd.Stdout = os.Stderr
+	if format == RootfsSquashfs {
+		f, err := os.Open(tarball.Name())
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		cmd.Stdin = f
+	}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Could not create the %s filesystem image %s: %w", format, output, err)
+	}
+	logrus.Infof("The %s filesystem image has been written to %s", format, output)
+	return nil
+}
+
+// nullUUID is the UUID of generated filesystems
+const nullUUID = "00000000-0000-0000-0000-000000000000"
+
+// mkfsArgs returns the arguments of the mkfs command creating the
+// filesystem image output from the tarball.
+func mkfsArgs(format string, size int64, tarball string, output string) ([]string, error) {
+	switch format {
+	case RootfsExt4:
+		if size <= 0 {
+			return nil, fmt.Errorf("The size of the ext4 filesystem image is required")
+		}
+		return []string{"-F", "-q", "-U", nullUUID, "-E", "hash_seed=" + nullUUID + ",root_owner=0:0", "-d", tarball, output}, nil
+	case RootfsErofs:
+		return []string{"--tar=f", "-T0", "-U", nullUUID, output, tarball}, nil
+	case RootfsSquashfs:
+		return []string{"-", output, "-tar", "-noappend", "-quiet", "-reproducible", "-mkfs-time", "0", "-all-time", "0"}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported filesystem image format %q (it must be %s, %s or %s)", format, RootfsExt4, RootfsErofs, RootfsSquashfs)
+	}
+}
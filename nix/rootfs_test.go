@@ -0,0 +1,171 @@
+package nix
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/nlewo/nix2container/types"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func writeTestLayer(t *testing.T, filename string, entries map[string]string) types.Layer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range sortedKeys(entries) {
+		content := entries[name]
+		hdr := &tar.Header{Name: name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(content))}
+		if content == "dir" {
+			hdr = &tar.Header{Name: name, Mode: 0755, Typeflag: tar.TypeDir}
+			content = ""
+		}
+		if strings.HasPrefix(content, "symlink:") {
+			hdr = &tar.Header{Name: name, Mode: 0777, Typeflag: tar.TypeSymlink, Linkname: strings.TrimPrefix(content, "symlink:")}
+			content = ""
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := ioutil.WriteFile(filename, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	return types.Layer{Digest: filename, LayerPath: filename, MediaType: v1.MediaTypeImageLayer}
+}
+
+func sortedKeys(m map[string]string) (keys []string) {
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestFlattenImage(t *testing.T) {
+	tmpDir := t.TempDir()
+	image := types.Image{
+		Layers: []types.Layer{
+			writeTestLayer(t, filepath.Join(tmpDir, "1.tar"), map[string]string{
+				"etc/":          "dir",
+				"etc/passwd":    "root",
+				"etc/shadow":    "secret",
+				"var/":          "dir",
+				"var/cache/":    "dir",
+				"var/cache/old": "old",
+				"lib/":          "dir",
+				"lib/libc.so":   "libc",
+			}),
+			writeTestLayer(t, filepath.Join(tmpDir, "2.tar"), map[string]string{
+				"/etc/passwd":              "root:x:0:0",
+				"etc/.wh.shadow":           "",
+				"var/cache/.wh..wh..opq":   "",
+				"var/cache/new":            "new",
+				"lib":                      "a file hiding the lower directory",
+				"/nix/store/abc-hello/bin": "hello",
+			}),
+		},
+	}
+	var buf bytes.Buffer
+	if err := FlattenImage(context.Background(), image, &buf); err != nil {
+		t.Fatalf("%v", err)
+	}
+	var entries []string
+	contents := make(map[string]string)
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		entries = append(entries, hdr.Name)
+		content, _ := ioutil.ReadAll(tr)
+		contents[hdr.Name] = string(content)
+	}
+	expected := []string{
+		"etc/",
+		"nix/",
+		"nix/store/",
+		"nix/store/abc-hello/",
+		"var/",
+		"var/cache/",
+		"etc/passwd",
+		"nix/store/abc-hello/bin",
+		"lib",
+		"var/cache/new",
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Fatalf("Entries should be '%#v' (while they are %#v)", expected, entries)
+	}
+	if contents["etc/passwd"] != "root:x:0:0" {
+		t.Fatalf("The upper layer file should override the lower one (while it is %s)", contents["etc/passwd"])
+	}
+}
+
+func TestMkfsArgs(t *testing.T) {
+	if _, err := mkfsArgs(RootfsExt4, 0, "rootfs.tar", "rootfs.img"); err == nil {
+		t.Fatalf("The size of ext4 images should be required")
+	}
+	if _, err := mkfsArgs("btrfs", 0, "rootfs.tar", "rootfs.img"); err == nil {
+		t.Fatalf("btrfs should not be supported")
+	}
+	args, err := mkfsArgs(RootfsErofs, 0, "rootfs.tar", "rootfs.img")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := []string{"--tar=f", "-T0", "-U", nullUUID, "rootfs.img", "rootfs.tar"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Fatalf("Args should be '%#v' (while they are %#v)", expected, args)
+	}
+}
+
+func TestWriteRootfsExt4(t *testing.T) {
+	mkfs := "mkfs.ext4"
+	if _, err := os.Stat("/usr/sbin/mkfs.ext4"); err == nil {
+		mkfs = "/usr/sbin/mkfs.ext4"
+	}
+	tmpDir := t.TempDir()
+	image := types.Image{
+		Layers: []types.Layer{
+			writeTestLayer(t, filepath.Join(tmpDir, "1.tar"), map[string]string{"etc/hostname": "vm"}),
+		},
+	}
+	output := filepath.Join(tmpDir, "rootfs.img")
+	if err := WriteRootfs(context.Background(), image, RootfsExt4, 8*1024*1024, mkfs, output); err != nil {
+		t.Skipf("%s can not create filesystems from tarballs: %v", mkfs, err)
+	}
+	info, err := os.Stat(output)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if info.Size() != 8*1024*1024 {
+		t.Fatalf("The filesystem image size should be 8M (while it is %d)", info.Size())
+	}
+}
+
+func TestMkfsArgsSquashfs(t *testing.T) {
+	args, err := mkfsArgs(RootfsSquashfs, 0, "rootfs.tar", "rootfs.img")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	// The tarball is read from the standard input
+	if args[0] != "-" || args[1] != "rootfs.img" {
+		t.Fatalf("Args should start with the stdin and the output (while they are %#v)", args)
+	}
+}
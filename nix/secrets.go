@@ -0,0 +1,144 @@
+package nix
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"regexp"
+
+	"github.com/nlewo/nix2container/types"
+	"github.com/sirupsen/logrus"
+)
+
+// What to do when secrets are found in an image.
+const (
+	SecretsPolicyIgnore = "ignore"
+	SecretsPolicyWarn   = "warn"
+	SecretsPolicyFail   = "fail"
+)
+
+// secretsScanSize is the number of bytes of each file whose content
+// is scanned.
+const secretsScanSize = 1024 * 1024
+
+type secretRule struct {
+	name string
+	// Matched against the file name
+	filename *regexp.Regexp
+	// Matched against the file content
+	content *regexp.Regexp
+}
+
+// secretRules only detect obvious secrets, with few false positives.
+var secretRules = []secretRule{
+	{
+		name:    "private key",
+		content: regexp.MustCompile(`-----BEGIN (RSA |EC |DSA |OPENSSH |ENCRYPTED |PGP )?PRIVATE KEY( BLOCK)?-----`),
+	},
+	{
+		name:    "AWS access key",
+		content: regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`),
+	},
+	{
+		name:    "netrc credentials",
+		content: regexp.MustCompile(`machine\s+\S+\s+login\s+\S+\s+password\s+\S+`),
+	},
+	{
+		name:     "netrc file",
+		filename: regexp.MustCompile(`(^|/)\.netrc$`),
+	},
+	{
+		name:     "AWS credentials file",
+		filename: regexp.MustCompile(`(^|/)\.aws/credentials$`),
+	},
+	{
+		name:     "SSH private key file",
+		filename: regexp.MustCompile(`(^|/)id_(rsa|dsa|ecdsa|ed25519)$`),
+	},
+}
+
+// SecretFinding is a file of a layer which seems to contain a secret.
+type SecretFinding struct {
+	// The name of the entry in the layer archive
+	Name  string
+	Layer string
+	// The rule detecting the secret, such as "private key"
+	Rule string
+}
+
+func (f SecretFinding) String() string {
+	return fmt.Sprintf("%s: %s (layer %s)", f.Name, f.Rule, f.Layer)
+}
+
+// ScanSecrets checks the files of the image layers for obvious
+// secrets, such as private keys or AWS access keys, which could have
+// been captured by impure builds. Files whose name matches one of the
+// allowed regexes (such as test keys of packages) are not reported.
+// Only the beginning of big files is scanned.
+func ScanSecrets(ctx context.Context, image types.Image, allowed []*regexp.Regexp) (findings []SecretFinding, err error) {
+	for _, layer := range image.Layers {
+		if layer.Pinned || IsEncryptedMediaType(layer.MediaType) {
+			logrus.Warnf("The layer %s can not be scanned for secrets", layer.Digest)
+			continue
+		}
+		err := forEachLayerEntry(ctx, layer, func(hdr *tar.Header, r io.Reader) error {
+			if hdr.Typeflag != tar.TypeReg {
+				return nil
+			}
+			for _, re := range allowed {
+				if re.MatchString("/" + hdr.Name) {
+					return nil
+				}
+			}
+			content, err := ioutil.ReadAll(io.LimitReader(r, secretsScanSize))
+			if err != nil {
+				return err
+			}
+			for _, rule := range secretRules {
+				if rule.filename != nil && !rule.filename.MatchString(path.Clean(hdr.Name)) {
+					continue
+				}
+				if rule.content != nil && !rule.content.Match(content) {
+					continue
+				}
+				findings = append(findings, SecretFinding{
+					Name:  "/" + hdr.Name,
+					Layer: layer.Digest,
+					Rule:  rule.name,
+				})
+			}
+			return nil
+		})
+		if err != nil {
+			return findings, err
+		}
+	}
+	return findings, nil
+}
+
+// ApplySecretsPolicy scans the image for secrets according to the
+// policy: findings are logged with the warn policy and an error is
+// returned with the fail policy.
+func ApplySecretsPolicy(ctx context.Context, image types.Image, policy string, allowed []*regexp.Regexp) error {
+	switch policy {
+	case "", SecretsPolicyIgnore:
+		return nil
+	case SecretsPolicyWarn, SecretsPolicyFail:
+	default:
+		return fmt.Errorf("Invalid secrets policy %q (it must be ignore, warn or fail)", policy)
+	}
+	findings, err := ScanSecrets(ctx, image, allowed)
+	if err != nil {
+		return err
+	}
+	for _, f := range findings {
+		logrus.Warnf("Secret found in %s", f)
+	}
+	if len(findings) > 0 && policy == SecretsPolicyFail {
+		return fmt.Errorf("%d secrets have been found in the image (files can be allowed with --secrets-allow)", len(findings))
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package nix
+
+import (
+	"context"
+
+	"github.com/nlewo/nix2container/types"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// archiveSettings are the settings of the generation of an archive.
+// They default to the settings of the process (see
+// SetDigestAlgorithm, SetStrictReproducibility and SetMaxEntrySize),
+// which only apply to the layers built by the process: the blobs of
+// existing layers are regenerated with the settings of the layer, so
+// that jobs sharing a process, such as the jobs of the daemon, don't
+// depend on each other.
+type archiveSettings struct {
+	// The algorithm of the digests and of the diff IDs
+	algorithm digest.Algorithm
+	// Fail on inputs which can not be normalized deterministically
+	strict bool
+	// The maximal size of the files, zero means no limit
+	maxEntrySize int64
+}
+
+type archiveSettingsKey struct{}
+
+// processArchiveSettings returns the settings of the layers built by
+// the process.
+func processArchiveSettings() archiveSettings {
+	return archiveSettings{
+		algorithm:    digestAlgorithm,
+		strict:       strictRepro,
+		maxEntrySize: maxEntrySize,
+	}
+}
+
+// layerArchiveSettings returns the settings regenerating the blob of
+// the layer: the algorithm of its digest, without the checks which
+// only reject inputs when layers are built.
+func layerArchiveSettings(layer types.Layer) archiveSettings {
+	algorithm := digest.Digest(layer.Digest).Algorithm()
+	if !algorithm.Available() {
+		algorithm = digest.Canonical
+	}
+	return archiveSettings{algorithm: algorithm}
+}
+
+// withArchiveSettings returns a context generating archives with the
+// settings.
+func withArchiveSettings(ctx context.Context, settings archiveSettings) context.Context {
+	return context.WithValue(ctx, archiveSettingsKey{}, settings)
+}
+
+// archiveSettingsFrom returns the settings of the context, or the
+// settings of the process.
+func archiveSettingsFrom(ctx context.Context) archiveSettings {
+	if settings, ok := ctx.Value(archiveSettingsKey{}).(archiveSettings); ok {
+		return settings
+	}
+	return processArchiveSettings()
+}
@@ -0,0 +1,235 @@
+package nix
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+// sparseBlockSize is the granularity of the holes of sparse files.
+// Holes are the aligned blocks only containing zeros, whether they
+// are holes of the filesystem or not: the archive then doesn't depend
+// on how the file has been written or copied.
+const sparseBlockSize = 4096
+
+// maxUSTARSize is the largest size of the USTAR size field.
+const maxUSTARSize = 077777777777
+
+// sparseRegion is a region of a file.
+type sparseRegion struct {
+	Offset int64
+	Length int64
+}
+
+// sparseDataRegions returns the regions of the file of size bytes
+// which are not holes. The holes reported by the filesystem are
+// skipped without being read.
+func sparseDataRegions(f *os.File, size int64) ([]sparseRegion, error) {
+	ranges, err := fileDataRanges(f, size)
+	if err != nil {
+		return nil, err
+	}
+	var regions []sparseRegion
+	buf := make([]byte, sparseBlockSize)
+	next := int64(0)
+	for _, r := range ranges {
+		start := r.Offset / sparseBlockSize * sparseBlockSize
+		if start < next {
+			start = next
+		}
+		for off := start; off < r.Offset+r.Length && off < size; off += sparseBlockSize {
+			block := buf
+			if size-off < sparseBlockSize {
+				block = buf[:size-off]
+			}
+			n, err := f.ReadAt(block, off)
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+			// A file shrinking while it is read is padded with
+			// zeros, as by copyFileContent
+			for i := n; i < len(block); i++ {
+				block[i] = 0
+			}
+			next = off + int64(len(block))
+			if isZero(block) {
+				continue
+			}
+			if last := len(regions) - 1; last >= 0 && regions[last].Offset+regions[last].Length == off {
+				regions[last].Length += int64(len(block))
+			} else {
+				regions = append(regions, sparseRegion{Offset: off, Length: int64(len(block))})
+			}
+		}
+	}
+	return regions, nil
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// appendSparseFileToTar writes the file described by hdr as a PAX
+// sparse entry (format 1.0, as GNU tar) if it has holes. Since the
+// archive/tar package can't write sparse entries, the entry is
+// directly written to w, the writer of tw. It returns false if the
+// file has no holes: it then has to be archived as a regular file.
+func appendSparseFileToTar(tw *tar.Writer, w io.Writer, hdr *tar.Header, filename string) (bool, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false, fmt.Errorf("Could not open file '%s', got error '%s'", filename, err)
+	}
+	defer f.Close()
+	regions, err := sparseDataRegions(f, hdr.Size)
+	if err != nil {
+		return false, fmt.Errorf("Could not read the file '%s', got error '%s'", filename, err)
+	}
+	var dataSize int64
+	for _, r := range regions {
+		dataSize += r.Length
+	}
+	if dataSize == hdr.Size {
+		return false, nil
+	}
+
+	// The sparse map is the number of entries followed by their
+	// offsets and lengths. It ends with an empty entry at the end of
+	// the file when the file ends with a hole.
+	entries := regions
+	if len(entries) == 0 || entries[len(entries)-1].Offset+entries[len(entries)-1].Length < hdr.Size {
+		entries = append(entries, sparseRegion{Offset: hdr.Size})
+	}
+	var sparseMap bytes.Buffer
+	fmt.Fprintf(&sparseMap, "%d\n", len(entries))
+	for _, e := range entries {
+		fmt.Fprintf(&sparseMap, "%d\n%d\n", e.Offset, e.Length)
+	}
+	sparseMap.Write(make([]byte, blockPadding(int64(sparseMap.Len()))))
+	entrySize := int64(sparseMap.Len()) + dataSize
+
+	records := map[string]string{
+		"GNU.sparse.major":    "1",
+		"GNU.sparse.minor":    "0",
+		"GNU.sparse.name":     hdr.Name,
+		"GNU.sparse.realsize": strconv.FormatInt(hdr.Size, 10),
+	}
+	for k, v := range hdr.PAXRecords {
+		records[k] = v
+	}
+	ustarSize := entrySize
+	if entrySize > maxUSTARSize {
+		records["size"] = strconv.FormatInt(entrySize, 10)
+		ustarSize = 0
+	}
+	keys := make([]string, 0, len(records))
+	for k := range records {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pax bytes.Buffer
+	for _, k := range keys {
+		pax.WriteString(paxRecord(k, records[k]))
+	}
+	paxSize := int64(pax.Len())
+	pax.Write(make([]byte, blockPadding(paxSize)))
+
+	// The previous entry is padded before writing raw blocks
+	if err := tw.Flush(); err != nil {
+		return false, err
+	}
+	dir, file := path.Split(hdr.Name)
+	if _, err := w.Write(ustarHeader(path.Join(dir, "PaxHeaders.0", file), tar.TypeXHeader, 0644, paxSize, hdr)); err != nil {
+		return false, err
+	}
+	if _, err := w.Write(pax.Bytes()); err != nil {
+		return false, err
+	}
+	if _, err := w.Write(ustarHeader(path.Join(dir, "GNUSparseFile.0", file), tar.TypeReg, hdr.Mode, ustarSize, hdr)); err != nil {
+		return false, err
+	}
+	if _, err := w.Write(sparseMap.Bytes()); err != nil {
+		return false, err
+	}
+	for _, r := range regions {
+		n, err := io.Copy(w, io.NewSectionReader(f, r.Offset, r.Length))
+		if err != nil {
+			return false, err
+		}
+		if n < r.Length {
+			logrus.Warnf("The file %s has shrunk while it was archived: its content is padded with %d zeros", filename, r.Length-n)
+			if _, err := io.CopyN(w, zeroReader{}, r.Length-n); err != nil {
+				return false, err
+			}
+		}
+	}
+	if _, err := w.Write(make([]byte, blockPadding(dataSize))); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// blockPadding returns the number of bytes padding size to a multiple
+// of the archive block size.
+func blockPadding(size int64) int64 {
+	return -size & 511
+}
+
+// paxRecord formats a PAX record, whose length includes the length of
+// its own decimal representation.
+func paxRecord(k, v string) string {
+	size := len(k) + len(v) + 3
+	size += len(strconv.Itoa(size))
+	record := strconv.Itoa(size) + " " + k + "=" + v + "\n"
+	if len(record) != size {
+		size = len(record)
+		record = strconv.Itoa(size) + " " + k + "=" + v + "\n"
+	}
+	return record
+}
+
+// ustarHeader returns a USTAR header block with the ownership of hdr
+// and a null modification time. Names are truncated to the 100 bytes
+// of the name field: the name of sparse entries is the
+// GNU.sparse.name record.
+func ustarHeader(name string, typeflag byte, mode int64, size int64, hdr *tar.Header) []byte {
+	b := make([]byte, 512)
+	if len(name) > 100 {
+		name = name[:100]
+	}
+	copy(b[0:100], name)
+	formatOctal(b[100:108], mode&07777777)
+	formatOctal(b[108:116], int64(hdr.Uid))
+	formatOctal(b[116:124], int64(hdr.Gid))
+	formatOctal(b[124:136], size)
+	formatOctal(b[136:148], 0)
+	b[156] = typeflag
+	copy(b[257:263], "ustar\x00")
+	copy(b[263:265], "00")
+	copy(b[265:297], hdr.Uname)
+	copy(b[297:329], hdr.Gname)
+	formatOctal(b[329:337], 0)
+	formatOctal(b[337:345], 0)
+	copy(b[148:156], "        ")
+	sum := 0
+	for _, c := range b {
+		sum += int(c)
+	}
+	copy(b[148:156], fmt.Sprintf("%06o\x00 ", sum))
+	return b
+}
+
+func formatOctal(b []byte, v int64) {
+	copy(b, fmt.Sprintf("%0*o\x00", len(b)-1, v))
+}
@@ -0,0 +1,45 @@
+package nix
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// The whence values of lseek seeking data and holes
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// fileDataRanges returns the ranges of the file of size bytes which
+// are not holes of the filesystem. The whole file is returned if the
+// filesystem doesn't support seeking holes.
+func fileDataRanges(f *os.File, size int64) ([]sparseRegion, error) {
+	var ranges []sparseRegion
+	for off := int64(0); off < size; {
+		data, err := f.Seek(off, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			break
+		}
+		if errors.Is(err, syscall.EINVAL) {
+			return []sparseRegion{{Offset: 0, Length: size}}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		hole, err := f.Seek(data, seekHole)
+		if err != nil {
+			return nil, err
+		}
+		if hole > size {
+			hole = size
+		}
+		if hole <= data {
+			break
+		}
+		ranges = append(ranges, sparseRegion{Offset: data, Length: hole - data})
+		off = hole
+	}
+	return ranges, nil
+}
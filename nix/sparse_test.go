@@ -0,0 +1,128 @@
+package nix
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"testing"
+
+	"github.com/nlewo/nix2container/types"
+)
+
+const sparseTestSize = 1 << 20
+
+// sparseTestContent returns the content of a file of sparseTestSize
+// bytes with data at its beginning and in its middle.
+func sparseTestContent() []byte {
+	content := make([]byte, sparseTestSize)
+	copy(content, "head")
+	copy(content[sparseTestSize/2:], "middle")
+	return content
+}
+
+func tarSparseDirectory(t *testing.T, dir string) []byte {
+	paths := types.Paths{
+		types.Path{
+			Path: dir,
+			Options: &types.PathOptions{
+				Rewrite: types.Rewrite{Regex: "^" + regexp.QuoteMeta(dir), Repl: ""},
+				Sparse:  true,
+			},
+		},
+	}
+	r := TarPaths(paths)
+	defer r.Close()
+	archive, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return archive
+}
+
+func TestTarSparseFile(t *testing.T) {
+	// A file whose holes are holes of the filesystem
+	sparseDir := t.TempDir()
+	f, err := os.Create(sparseDir + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(sparseTestSize); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("head"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("middle"), sparseTestSize/2); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := os.Chmod(sparseDir+"/file", 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The same file written with its zeros
+	denseDir := t.TempDir()
+	if err := ioutil.WriteFile(denseDir+"/file", sparseTestContent(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := tarSparseDirectory(t, sparseDir)
+	if len(archive) > 32*1024 {
+		t.Fatalf("The archive size should be smaller than %d (while it is %d)", 32*1024, len(archive))
+	}
+	if !bytes.Equal(archive, tarSparseDirectory(t, denseDir)) {
+		t.Fatalf("The archive should not depend on the holes of the filesystem")
+	}
+
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			t.Fatalf("The archive should contain the file /file")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name != "/file" {
+			continue
+		}
+		if hdr.Size != sparseTestSize {
+			t.Fatalf("Size should be '%#v' (while it is %#v)", sparseTestSize, hdr.Size)
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(content, sparseTestContent()) {
+			t.Fatalf("The content of the sparse file should be restored")
+		}
+		break
+	}
+
+	index, err := BuildFileIndex(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range index.Entries {
+		if entry.Name == "file" && entry.Type != types.FileIndexSparse {
+			t.Fatalf("Type should be '%#v' (while it is %#v)", types.FileIndexSparse, entry.Type)
+		}
+	}
+}
+
+func TestTarSparseOptionWithoutHoles(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(dir+"/file", []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	archive := tarSparseDirectory(t, dir)
+	hdr, err := tar.NewReader(bytes.NewReader(archive)).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := hdr.PAXRecords["GNU.sparse.major"]; ok {
+		t.Fatalf("A file without holes should not be a sparse entry")
+	}
+}
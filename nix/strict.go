@@ -0,0 +1,51 @@
+package nix
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// strictRepro makes the generation of layers fail on inputs which can
+// not be normalized deterministically, see SetStrictReproducibility.
+var strictRepro bool
+
+// SetStrictReproducibility enables the strict reproducibility mode:
+// instead of being silently normalized or skipped, paths outside of
+// the Nix store, special files (sockets, devices, named pipes) and
+// POSIX ACLs which would be stripped make the layer generation fail.
+func SetStrictReproducibility(strict bool) {
+	strictRepro = strict
+}
+
+// checkStorePath returns an error if the path is not in the Nix store:
+// files outside of the store are mutable, so the layer can not be
+// regenerated identically when the image is pushed.
+func checkStorePath(path string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(abs, storeDir) {
+		return classErrorf(ErrNotReproducible, "The path %s is not in the Nix store %s", path, storeDir)
+	}
+	return nil
+}
+
+// checkFileType returns an error if the file type can not be archived
+// deterministically: sockets are skipped while devices and named
+// pipes depend on the host they are created on.
+func checkFileType(path string, info os.FileInfo) error {
+	mode := info.Mode()
+	switch {
+	case mode&os.ModeSocket != 0:
+		return classErrorf(ErrNotReproducible, "The file %s is a socket", path)
+	case mode&os.ModeDevice != 0:
+		return classErrorf(ErrNotReproducible, "The file %s is a device", path)
+	case mode&os.ModeNamedPipe != 0:
+		return classErrorf(ErrNotReproducible, "The file %s is a named pipe", path)
+	case mode&os.ModeIrregular != 0:
+		return classErrorf(ErrNotReproducible, "The file %s has an unsupported type", path)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+//go:build !windows
+// +build !windows
+
+package nix
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/nlewo/nix2container/types"
+)
+
+func TestStrictReproducibility(t *testing.T) {
+	SetStrictReproducibility(true)
+	defer SetStrictReproducibility(false)
+
+	_, err := NewLayers(context.Background(), []string{"../data/layer1"}, []types.Layer{}, []types.RewritePath{}, "", []types.PermPath{}, types.PathOptions{}, CompressionNone)
+	if !errors.Is(err, ErrNotReproducible) {
+		t.Fatalf("NewLayers should fail with ErrNotReproducible on a path outside of the store (while it is %#v)", err)
+	}
+
+	store := t.TempDir()
+	previousStoreDir := storeDir
+	storeDir = store + "/"
+	defer func() { storeDir = previousStoreDir }()
+	storePath := filepath.Join(store, "abc-pkg")
+	if err := os.Mkdir(storePath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(storePath, "file"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewLayers(context.Background(), []string{storePath}, []types.Layer{}, []types.RewritePath{}, "", []types.PermPath{}, types.PathOptions{}, CompressionNone)
+	if err != nil {
+		t.Fatalf("NewLayers should succeed on a store path (while it is %#v)", err)
+	}
+
+	if err := syscall.Mkfifo(filepath.Join(storePath, "fifo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewLayers(context.Background(), []string{storePath}, []types.Layer{}, []types.RewritePath{}, "", []types.PermPath{}, types.PathOptions{}, CompressionNone)
+	if !errors.Is(err, ErrNotReproducible) {
+		t.Fatalf("NewLayers should fail with ErrNotReproducible on a named pipe (while it is %#v)", err)
+	}
+}
+
+func TestStrictReproducibilitySumCache(t *testing.T) {
+	store := t.TempDir()
+	previousStoreDir := storeDir
+	storeDir = store + "/"
+	defer func() { storeDir = previousStoreDir }()
+	storePath := filepath.Join(store, "abc-pkg")
+	if err := os.Mkdir(storePath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mkfifo(filepath.Join(storePath, "fifo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cache, err := NewSumCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetSumCache(cache)
+	defer SetSumCache(nil)
+
+	// The digest of the layer is cached by a non strict build
+	_, err = NewLayers(context.Background(), []string{storePath}, []types.Layer{}, []types.RewritePath{}, "", []types.PermPath{}, types.PathOptions{}, CompressionNone)
+	if err != nil {
+		t.Fatalf("NewLayers should succeed on a named pipe without strict reproducibility (while it is %#v)", err)
+	}
+
+	SetStrictReproducibility(true)
+	defer SetStrictReproducibility(false)
+	_, err = NewLayers(context.Background(), []string{storePath}, []types.Layer{}, []types.RewritePath{}, "", []types.PermPath{}, types.PathOptions{}, CompressionNone)
+	if !errors.Is(err, ErrNotReproducible) {
+		t.Fatalf("NewLayers should fail with ErrNotReproducible on a named pipe even if its digest is cached (while it is %#v)", err)
+	}
+}
@@ -0,0 +1,429 @@
+package nix
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/nlewo/nix2container/metrics"
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// sumCacheVersion has to be bumped when the archives generated from
+// the same paths change, to invalidate existing entries.
+const sumCacheVersion = 1
+
+// storeDir contains immutable paths
+var storeDir = "/nix/store/"
+
+// SumCache stores the digests and sizes of layers built from store
+// paths. Since store paths are immutable, a layer built from the same
+// paths with the same options always has the same digest: the
+// archive of such a layer doesn't need to be generated again to
+// compute its digest. Layers containing paths outside of the Nix
+// store are never cached.
+//
+// Sums can also be shared through a remote cache, such as an S3
+// bucket, so that ephemeral CI runners reuse the sums computed by
+// previous pipelines. Since anyone with write access to the remote
+// cache could poison it, remote entries are authenticated with the
+// key of NIX2CONTAINER_DIGEST_CACHE_KEY, shared by the builders: see
+// SetRemote.
+//
+// Layers containing paths outside of the Nix store can be cached by
+// content when segment hashing is enabled (see SetSegmentSize).
+type SumCache struct {
+	directory string
+	remote    *remoteStore
+	// The key authenticating the remote entries
+	remoteKey   []byte
+	segmentSize int64
+}
+
+// NewSumCache creates a SumCache storing sums in directory, which is
+// created if it doesn't exist. If directory is empty, sums are only
+// stored in the remote cache.
+func NewSumCache(directory string) (*SumCache, error) {
+	if directory == "" {
+		return &SumCache{}, nil
+	}
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, err
+	}
+	return &SumCache{directory: directory}, nil
+}
+
+// RemoteCacheKeyEnv is the environment variable containing the secret
+// key authenticating the entries of the remote cache.
+const RemoteCacheKeyEnv = "NIX2CONTAINER_DIGEST_CACHE_KEY"
+
+// SetRemote sets the remote cache, an http(s):// URL of a directory
+// accepting GET and PUT requests or an s3://BUCKET/PREFIX URL. Sums
+// missing in the local directory are read from the remote cache and
+// new sums are written to both of them.
+//
+// Remote entries are not trusted. If the NIX2CONTAINER_DIGEST_CACHE_KEY
+// environment variable is set, entries are written with an HMAC-SHA256
+// of this key and entries without a valid HMAC are ignored. Otherwise,
+// a remote entry is checked against the archive generated locally the
+// first time it is used, and then kept in the local directory: the
+// remote cache then doesn't save any archive generation.
+func (c *SumCache) SetRemote(location string) error {
+	remote, err := newRemoteStore(location)
+	if err != nil {
+		return err
+	}
+	c.remote = remote
+	if key := os.Getenv(RemoteCacheKeyEnv); key != "" {
+		c.remoteKey = []byte(key)
+	} else {
+		logrus.Warnf("The remote digest cache entries are not authenticated (%s is not set): they are checked by generating the layer archives", RemoteCacheKeyEnv)
+	}
+	return nil
+}
+
+// SetSegmentSize enables the caching of layers containing paths
+// outside of the Nix store: their archive is split into segments of
+// size bytes, hashed in parallel, and the combination of these hashes
+// is the cache key of the layer. On a cache hit, the digest of the
+// layer is then known without hashing the archive sequentially, which
+// is slow for huge layers. On a miss, the archive is generated a
+// second time to compute its digest. A size of 0 disables it.
+func (c *SumCache) SetSegmentSize(size int64) {
+	c.segmentSize = size
+}
+
+// sumKey identifies an entry of the cache. Entries are stored under
+// the name of their key, a hash of the key, and contain the key
+// itself: two keys whose names collide are then never mixed up.
+type sumKey struct {
+	name string
+	key  string
+}
+
+type sumCacheEntry struct {
+	// The key of the entry, see sumKey
+	Key         string            `json:"key"`
+	Digest      string            `json:"digest"`
+	DiffID      string            `json:"diff_id"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// The HMAC of the entries of the remote cache, see entryMAC
+	MAC string `json:"mac,omitempty"`
+}
+
+// entryMAC returns the HMAC-SHA256, with the remote key, of the entry
+// of key: the MAC binds the entry to its key so that entries can not
+// be swapped.
+func (c *SumCache) entryMAC(key string, entry sumCacheEntry) string {
+	entry.MAC = ""
+	content, _ := json.Marshal(entry)
+	mac := hmac.New(sha256.New, c.remoteKey)
+	mac.Write([]byte(key))
+	mac.Write([]byte{0})
+	mac.Write(content)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// key returns the cache key of the archive of paths generated with
+// the settings, or false if the archive can not be cached. Since the
+// checks of the settings are skipped on a cache hit, their entries
+// are not shared with archives generated without these checks.
+func (c *SumCache) key(paths types.Paths, compression string, command []string, settings archiveSettings) (sumKey, bool) {
+	for _, p := range paths {
+		if !strings.HasPrefix(p.Path, storeDir) {
+			return sumKey{}, false
+		}
+	}
+	content, err := json.Marshal(struct {
+		Version            int         `json:"version"`
+		Algorithm          string      `json:"algorithm"`
+		Compression        string      `json:"compression"`
+		CompressionCommand []string    `json:"compression-command,omitempty"`
+		Strict             bool        `json:"strict,omitempty"`
+		MaxEntrySize       int64       `json:"max-entry-size,omitempty"`
+		Paths              types.Paths `json:"paths"`
+	}{sumCacheVersion, settings.algorithm.String(), compression, command, settings.strict, settings.maxEntrySize, paths})
+	if err != nil {
+		return sumKey{}, false
+	}
+	// The key contains all the paths of the layer, which can be
+	// huge: a fast non-cryptographic hash is used to name the
+	// entry. Since the key is stored in the entry, paths crafted
+	// to collide with the name of the entry of another layer
+	// can't make it be reused.
+	h := fnv.New128a()
+	h.Write(content)
+	return sumKey{name: hex.EncodeToString(h.Sum(nil)), key: string(content)}, true
+}
+
+// contentKey returns the cache key of the archive of paths computed
+// from its content, by hashing its segments in parallel. The archive
+// is generated with the settings of ctx.
+func (c *SumCache) contentKey(ctx context.Context, paths types.Paths, compression string, command []string) (sumKey, error) {
+	settings := archiveSettingsFrom(ctx)
+	reader := TarPathsContext(ctx, paths)
+	defer reader.Close()
+	segments, err := hashSegments(reader, c.segmentSize, runtime.NumCPU())
+	if err != nil {
+		return sumKey{}, err
+	}
+	content, err := json.Marshal(struct {
+		Version            int      `json:"version"`
+		Algorithm          string   `json:"algorithm"`
+		Compression        string   `json:"compression"`
+		CompressionCommand []string `json:"compression-command,omitempty"`
+		Strict             bool     `json:"strict,omitempty"`
+		MaxEntrySize       int64    `json:"max-entry-size,omitempty"`
+		SegmentSize        int64    `json:"segment-size"`
+	}{sumCacheVersion, settings.algorithm.String(), compression, command, settings.strict, settings.maxEntrySize, c.segmentSize})
+	if err != nil {
+		return sumKey{}, err
+	}
+	// Unlike the keys of store paths, which are immutable, content
+	// keys identify the content itself: a cryptographic hash is used
+	// and is the key itself
+	h := sha256.New()
+	h.Write(content)
+	for _, segment := range segments {
+		h.Write(segment)
+	}
+	name := "content-" + hex.EncodeToString(h.Sum(nil))
+	return sumKey{name: name, key: name}, nil
+}
+
+// hashSegments splits r into segments of size bytes and returns their
+// SHA-256 hashes, computed by workers goroutines. At most workers
+// segments are held in memory.
+func hashSegments(r io.Reader, size int64, workers int) ([][]byte, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	buffers := make(chan []byte, workers)
+	for i := 0; i < workers; i++ {
+		buffers <- nil
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var sums [][]byte
+	for i := 0; ; i++ {
+		buffer := <-buffers
+		if buffer == nil {
+			buffer = make([]byte, size)
+		}
+		n, err := io.ReadFull(r, buffer)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			wg.Wait()
+			return nil, err
+		}
+		if n == 0 {
+			break
+		}
+		mu.Lock()
+		sums = append(sums, nil)
+		mu.Unlock()
+		wg.Add(1)
+		go func(i int, segment []byte) {
+			defer wg.Done()
+			sum := sha256.Sum256(segment)
+			mu.Lock()
+			sums[i] = sum[:]
+			mu.Unlock()
+			buffers <- segment[:cap(segment)]
+		}(i, buffer[:n])
+		if n < len(buffer) {
+			break
+		}
+	}
+	wg.Wait()
+	return sums, nil
+}
+
+// get returns the sum of the entry key. Remote entries which are not
+// authenticated are returned as unverified: they have to be checked
+// with verify before being used.
+func (c *SumCache) get(key sumKey) (sum blobSum, verified bool, ok bool) {
+	content, remote, ok := c.read(key.name)
+	if !ok {
+		return sum, false, false
+	}
+	var entry sumCacheEntry
+	if err := json.Unmarshal(content, &entry); err != nil {
+		return sum, false, false
+	}
+	if entry.Key != key.key {
+		logrus.Debugf("Ignoring the entry %s of the digest cache: it is the entry of another key", key.name)
+		return sum, false, false
+	}
+	sum = blobSum{
+		digest:      godigest.Digest(entry.Digest),
+		diffID:      godigest.Digest(entry.DiffID),
+		size:        entry.Size,
+		annotations: entry.Annotations,
+	}
+	if sum.digest.Validate() != nil || sum.diffID.Validate() != nil {
+		return sum, false, false
+	}
+	if !remote {
+		return sum, true, true
+	}
+	if c.remoteKey == nil {
+		return sum, false, true
+	}
+	if !hmac.Equal([]byte(entry.MAC), []byte(c.entryMAC(key.name, entry))) {
+		logrus.Warnf("Ignoring the entry %s of the remote digest cache: its MAC is invalid", key.name)
+		return sum, false, false
+	}
+	c.keep(key, sum)
+	return sum, true, true
+}
+
+// read returns the entry key from the local directory or, if it is
+// missing, from the remote cache.
+func (c *SumCache) read(key string) (content []byte, remote bool, ok bool) {
+	if c.directory != "" {
+		if content, err := ioutil.ReadFile(filepath.Join(c.directory, key+".json")); err == nil {
+			return content, false, true
+		}
+	}
+	if c.remote == nil {
+		return nil, false, false
+	}
+	content, ok, err := c.remote.get(key + ".json")
+	if err != nil {
+		logrus.Warnf("Could not read the layer digest from the remote cache: %s", err)
+		return nil, false, false
+	}
+	return content, true, ok
+}
+
+// keep writes a verified remote entry to the local directory.
+func (c *SumCache) keep(key sumKey, sum blobSum) {
+	if c.directory == "" {
+		return
+	}
+	if err := c.writeLocal(key.name, c.marshalEntry(key, sum, false)); err != nil {
+		logrus.Warnf("Could not write the layer digest to the cache: %s", err)
+	}
+}
+
+// marshalEntry returns the entry of the sum, authenticated for the
+// remote cache if remote is set.
+func (c *SumCache) marshalEntry(key sumKey, sum blobSum, remote bool) []byte {
+	entry := sumCacheEntry{
+		Key:         key.key,
+		Digest:      sum.digest.String(),
+		DiffID:      sum.diffID.String(),
+		Size:        sum.size,
+		Annotations: sum.annotations,
+	}
+	if remote && c.remoteKey != nil {
+		entry.MAC = c.entryMAC(key.name, entry)
+	}
+	content, _ := json.Marshal(entry)
+	return content
+}
+
+func (c *SumCache) put(key sumKey, sum blobSum) error {
+	if c.remote != nil {
+		if err := c.remote.put(key.name+".json", c.marshalEntry(key, sum, true)); err != nil {
+			logrus.Warnf("Could not write the layer digest to the remote cache: %s", err)
+		}
+	}
+	if c.directory == "" {
+		return nil
+	}
+	return c.writeLocal(key.name, c.marshalEntry(key, sum, false))
+}
+
+func (c *SumCache) writeLocal(key string, content []byte) error {
+	f, err := ioutil.TempFile(c.directory, ".sum-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(c.directory, key+".json"))
+}
+
+var sumCache struct {
+	mu    sync.Mutex
+	cache *SumCache
+}
+
+// SetSumCache sets the cache used by NewLayers to skip the generation
+// of archives whose digest is already known. A nil cache disables it.
+func SetSumCache(cache *SumCache) {
+	sumCache.mu.Lock()
+	defer sumCache.mu.Unlock()
+	sumCache.cache = cache
+}
+
+// sumPaths is like tarPathsCompressed without writer, but the sum is
+// read from the sum cache when possible.
+func sumPaths(ctx context.Context, paths types.Paths, compression string, command []string) (blobSum, error) {
+	sumCache.mu.Lock()
+	cache := sumCache.cache
+	sumCache.mu.Unlock()
+	if cache == nil {
+		return tarPathsCompressed(ctx, paths, compression, command, nil)
+	}
+	key, ok := cache.key(paths, compression, command, archiveSettingsFrom(ctx))
+	if !ok && cache.segmentSize > 0 {
+		var err error
+		if key, err = cache.contentKey(ctx, paths, compression, command); err != nil {
+			return blobSum{}, err
+		}
+		ok = true
+	}
+	if !ok {
+		return tarPathsCompressed(ctx, paths, compression, command, nil)
+	}
+	// The diffID of an uncompressed archive is its digest: entries
+	// not following this are ignored. The archive is also generated
+	// if its file index is missing.
+	cached, verified, ok := cache.get(key)
+	if ok && verified && (compression == CompressionNone) == (cached.digest == cached.diffID) && hasFileIndex(cached.digest) {
+		logrus.Infof("Reusing the cached digest %s of the layer", cached.digest)
+		metrics.CacheLookups.Inc("cache", "digest", "result", "hit")
+		return cached, nil
+	}
+	metrics.CacheLookups.Inc("cache", "digest", "result", "miss")
+	sum, err := tarPathsCompressed(ctx, paths, compression, command, nil)
+	if err != nil {
+		return sum, err
+	}
+	if ok && !verified {
+		// The unauthenticated remote entry is checked against
+		// the generated archive, and then kept locally
+		if cached.digest != sum.digest || cached.diffID != sum.diffID || cached.size != sum.size || !reflect.DeepEqual(cached.annotations, sum.annotations) {
+			logrus.Warnf("The remote digest cache entry %s doesn't match the generated layer %s: it is ignored", key.name, sum.digest)
+		} else {
+			cache.keep(key, sum)
+			return sum, nil
+		}
+	}
+	if err := cache.put(key, sum); err != nil {
+		logrus.Warnf("Could not write the layer digest to the cache: %s", err)
+	}
+	return sum, nil
+}
@@ -0,0 +1,162 @@
+package nix
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nlewo/nix2container/types"
+)
+
+func TestSumCache(t *testing.T) {
+	previousStoreDir := storeDir
+	storeDir = "../data/"
+	defer func() { storeDir = previousStoreDir }()
+
+	cache, err := NewSumCache(t.TempDir())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	SetSumCache(cache)
+	defer SetSumCache(nil)
+
+	paths := []string{
+		"../data/layer1/file1",
+	}
+	layers, err := NewLayers(context.Background(), paths, []types.Layer{}, []types.RewritePath{}, "", []types.PermPath{}, types.PathOptions{}, CompressionNone)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	key, ok := cache.key(layers[0].Paths, CompressionNone, nil, processArchiveSettings())
+	if !ok {
+		t.Fatalf("Paths of the store should be cached")
+	}
+	sum, _, ok := cache.get(key)
+	if !ok || sum.digest.String() != layers[0].Digest || sum.size != layers[0].Size {
+		t.Fatalf("The cache should contain the sum of the layer (while it contains %#v)", sum)
+	}
+	cached, err := NewLayers(context.Background(), paths, []types.Layer{}, []types.RewritePath{}, "", []types.PermPath{}, types.PathOptions{}, CompressionNone)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !reflect.DeepEqual(layers, cached) {
+		t.Fatalf("Layers should be '%#v' (while they are %#v)", layers, cached)
+	}
+
+	// The entry of a key whose name collides with the name of
+	// another key is not reused
+	if _, _, ok := cache.get(sumKey{name: key.name, key: key.key + " "}); ok {
+		t.Fatalf("The entry of another key should not be used")
+	}
+
+	if _, ok := cache.key(types.Paths{types.Path{Path: "/tmp/file"}}, CompressionNone, nil, processArchiveSettings()); ok {
+		t.Fatalf("Paths outside of the store should not be cached")
+	}
+}
+
+func TestSumCacheMaxEntrySize(t *testing.T) {
+	store := t.TempDir()
+	previousStoreDir := storeDir
+	storeDir = store + "/"
+	defer func() { storeDir = previousStoreDir }()
+	storePath := filepath.Join(store, "abc-pkg")
+	if err := ioutil.WriteFile(storePath, make([]byte, 2048), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cache, err := NewSumCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetSumCache(cache)
+	defer SetSumCache(nil)
+
+	// The digest of the layer is cached by a build without limit
+	_, err = NewLayers(context.Background(), []string{storePath}, []types.Layer{}, []types.RewritePath{}, "", []types.PermPath{}, types.PathOptions{}, CompressionNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	SetMaxEntrySize(1024)
+	defer SetMaxEntrySize(0)
+	_, err = NewLayers(context.Background(), []string{storePath}, []types.Layer{}, []types.RewritePath{}, "", []types.PermPath{}, types.PathOptions{}, CompressionNone)
+	if err == nil {
+		t.Fatalf("A file larger than the maximum entry size should be rejected even if the digest of its layer is cached")
+	}
+}
+
+func TestHashSegments(t *testing.T) {
+	content := []byte("0123456789abcdefghij")
+	for _, workers := range []int{1, 3} {
+		sums, err := hashSegments(bytes.NewReader(content), 8, workers)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		var expected [][]byte
+		for _, segment := range []string{"01234567", "89abcdef", "ghij"} {
+			sum := sha256.Sum256([]byte(segment))
+			expected = append(expected, sum[:])
+		}
+		if !reflect.DeepEqual(sums, expected) {
+			t.Fatalf("Sums should be '%#v' (while they are %#v)", expected, sums)
+		}
+	}
+	sums, err := hashSegments(bytes.NewReader(content[:16]), 8, 2)
+	if err != nil || len(sums) != 2 {
+		t.Fatalf("A stream of 2 segments should have 2 sums (while it has %d)", len(sums))
+	}
+}
+
+func TestSumCacheSegments(t *testing.T) {
+	cache, err := NewSumCache(t.TempDir())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	cache.SetSegmentSize(1024)
+	SetSumCache(cache)
+	defer SetSumCache(nil)
+
+	// The test data are outside of the store: they are cached by
+	// content
+	paths := []string{
+		"../data/layer1/file1",
+	}
+	layers, err := NewLayers(context.Background(), paths, []types.Layer{}, []types.RewritePath{}, "", []types.PermPath{}, types.PathOptions{}, CompressionNone)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, ok := cache.key(layers[0].Paths, CompressionNone, nil, processArchiveSettings()); ok {
+		t.Fatalf("Paths outside of the store should not be cached by paths")
+	}
+	key, err := cache.contentKey(context.Background(), layers[0].Paths, CompressionNone, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !strings.HasPrefix(key.name, "content-") {
+		t.Fatalf("The key should be a content key (while it is %s)", key)
+	}
+	sum, _, ok := cache.get(key)
+	if !ok || sum.digest.String() != layers[0].Digest || sum.size != layers[0].Size {
+		t.Fatalf("The cache should contain the sum of the layer (while it contains %#v)", sum)
+	}
+	cached, err := NewLayers(context.Background(), paths, []types.Layer{}, []types.RewritePath{}, "", []types.PermPath{}, types.PathOptions{}, CompressionNone)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !reflect.DeepEqual(layers, cached) {
+		t.Fatalf("Layers should be '%#v' (while they are %#v)", layers, cached)
+	}
+
+	// The key depends on the content of the archive
+	other, err := cache.contentKey(context.Background(), types.Paths{types.Path{Path: "../data/layer1"}}, CompressionNone, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if other == key {
+		t.Fatalf("Archives with different contents should have different keys")
+	}
+}
@@ -0,0 +1,86 @@
+package nix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/types"
+	"github.com/sirupsen/logrus"
+)
+
+// ParseDestinationTags splits a destination with several tags, such
+// as docker://registry/app:v1.2.3,:v1.2,:latest, into the destination
+// of the first tag (docker://registry/app:v1.2.3) and the additional
+// tags (v1.2 and latest).
+func ParseDestinationTags(destination string) (first string, tags []string, err error) {
+	parts := strings.Split(destination, ",")
+	first = parts[0]
+	for _, tag := range parts[1:] {
+		tag = strings.TrimPrefix(tag, ":")
+		if tag == "" || strings.ContainsAny(tag, ":/@") {
+			return first, nil, fmt.Errorf("Invalid tag %q in the destination %s", tag, destination)
+		}
+		tags = append(tags, tag)
+	}
+	return first, tags, nil
+}
+
+// TagImage adds the tags to the image already pushed to the registry
+// destination (such as docker://registry/app:v1.2.3). The manifest is
+// read once and put for each tag: since the blobs are already in the
+// repository, they are not checked again.
+func TagImage(ctx context.Context, sys *types.SystemContext, destination string, tags []string) error {
+	if !strings.HasPrefix(destination, "docker://") {
+		return fmt.Errorf("Only docker:// destinations can be tagged (while it is %s)", destination)
+	}
+	ref, err := docker.ParseReference(strings.TrimPrefix(destination, "docker:"))
+	if err != nil {
+		return err
+	}
+	src, err := ref.NewImageSource(ctx, sys)
+	if err != nil {
+		return err
+	}
+	manifest, _, err := src.GetManifest(ctx, nil)
+	src.Close()
+	if errors.As(err, &docker.ErrUnauthorizedForCredentials{}) {
+		return classErrorf(ErrAuth, "Could not read the manifest of %s: %w", destination, err)
+	}
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		tagged, err := reference.WithTag(reference.TrimNamed(ref.DockerReference()), tag)
+		if err != nil {
+			return err
+		}
+		tagRef, err := docker.NewReference(tagged)
+		if err != nil {
+			return err
+		}
+		if err := putManifest(ctx, sys, tagRef, manifest); err != nil {
+			if errors.As(err, &docker.ErrUnauthorizedForCredentials{}) {
+				return classErrorf(ErrAuth, "Could not tag the image %s with %s: %w", destination, tag, err)
+			}
+			return fmt.Errorf("Could not tag the image %s with %s: %w", destination, tag, err)
+		}
+		logrus.Infof("The image %s has been tagged %s", destination, tag)
+	}
+	return nil
+}
+
+func putManifest(ctx context.Context, sys *types.SystemContext, ref types.ImageReference, manifest []byte) error {
+	dest, err := ref.NewImageDestination(ctx, sys)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+	if err := dest.PutManifest(ctx, manifest, nil); err != nil {
+		return err
+	}
+	return dest.Commit(ctx, nil)
+}
@@ -0,0 +1,31 @@
+package nix
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDestinationTags(t *testing.T) {
+	first, tags, err := ParseDestinationTags("docker://registry:5000/app:v1.2.3,:v1.2,latest")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if first != "docker://registry:5000/app:v1.2.3" {
+		t.Fatalf("The first destination should be 'docker://registry:5000/app:v1.2.3' (while it is %#v)", first)
+	}
+	expected := []string{"v1.2", "latest"}
+	if !reflect.DeepEqual(tags, expected) {
+		t.Fatalf("Tags should be '%#v' (while they are %#v)", expected, tags)
+	}
+
+	_, tags, err = ParseDestinationTags("docker://registry/app:latest")
+	if err != nil || tags != nil {
+		t.Fatalf("A single destination should have no additional tags (while they are %#v, %v)", tags, err)
+	}
+
+	for _, destination := range []string{"docker://registry/app:v1,", "docker://registry/app:v1,:other/app:v2"} {
+		if _, _, err := ParseDestinationTags(destination); err == nil {
+			t.Fatalf("The destination %s should be invalid", destination)
+		}
+	}
+}
@@ -2,144 +2,598 @@ package nix
 
 import (
 	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
-	"reflect"
 	"regexp"
+	"strings"
 	"time"
 
+	"github.com/nlewo/nix2container/metrics"
 	"github.com/nlewo/nix2container/types"
 	digest "github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
 )
 
-func TarPathsWrite(paths types.Paths, destinationFilename string) (digest.Digest, int64, error) {
-	f, err := os.Create(destinationFilename)
-	defer f.Close()
+// TarPathsWrite writes the tar archive of paths to
+// destinationFilename. If the context is cancelled or if an error
+// occurs, the partially written file is removed.
+func TarPathsWrite(ctx context.Context, paths types.Paths, destinationFilename string) (digest.Digest, int64, error) {
+	sum, err := tarPathsCompressedWrite(ctx, paths, CompressionNone, nil, destinationFilename)
 	if err != nil {
 		return "", 0, err
 	}
-	reader := TarPaths(paths)
-	defer reader.Close()
-
-	r := io.TeeReader(reader, f)
+	return sum.digest, sum.size, nil
+}
 
-	digester := digest.Canonical.Digester()
-	size, err := io.Copy(digester.Hash(), r)
+func TarPathsSum(ctx context.Context, paths types.Paths) (digest.Digest, int64, error) {
+	sum, err := tarPathsCompressed(ctx, paths, CompressionNone, nil, nil)
 	if err != nil {
 		return "", 0, err
 	}
+	return sum.digest, sum.size, nil
+}
 
-	return digester.Digest(), size, nil
+// tarPathsCompressedWrite writes the compressed archive of paths to
+// destinationFilename. If the context is cancelled or if an error
+// occurs, the partially written file is removed.
+func tarPathsCompressedWrite(ctx context.Context, paths types.Paths, compression string, command []string, destinationFilename string) (sum blobSum, err error) {
+	f, err := os.Create(destinationFilename)
+	if err != nil {
+		return sum, err
+	}
+	sum, err = tarPathsCompressed(ctx, paths, compression, command, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(destinationFilename)
+		return blobSum{}, err
+	}
+	return sum, nil
 }
 
-func TarPathsSum(paths types.Paths) (digest.Digest, int64, error) {
-	reader := TarPaths(paths)
+// blobSum describes a possibly compressed archive.
+type blobSum struct {
+	// The digest of the compressed archive
+	digest digest.Digest
+	// The digest of the uncompressed archive
+	diffID digest.Digest
+	// The size of the compressed archive
+	size        int64
+	annotations map[string]string
+	// The file index of the archive, built while it is generated if
+	// file indexes are enabled (see SetFileIndexDirectory)
+	fileIndex *types.FileIndex
+}
+
+// tarPathsCompressed computes in a single pass the digests of the
+// archive of paths and of its compressed stream, and its file index if
+// file indexes are enabled. If w is not nil, the compressed stream is
+// also written to w. The compression is done by command if it is not
+// empty.
+func tarPathsCompressed(ctx context.Context, paths types.Paths, compression string, command []string, w io.Writer) (sum blobSum, err error) {
+	reader := TarPathsContext(ctx, paths)
 	defer reader.Close()
 
-	digester := digest.Canonical.Digester()
-	size, err := io.Copy(digester.Hash(), reader)
+	var indexed <-chan fileIndexResult
+	var indexWriter *io.PipeWriter
+	if fileIndexDirectory != "" {
+		indexed, indexWriter = buildFileIndexAsync()
+		defer indexWriter.Close()
+	}
+
+	settings := archiveSettingsFrom(ctx)
+	diffIDDigester := settings.algorithm.Digester()
+	digester := settings.algorithm.Digester()
+	counter := &countingWriter{}
+	writers := []io.Writer{digester.Hash(), counter, metrics.StatusWriter(metrics.PhaseBuilding)}
+	if w != nil {
+		writers = append(writers, w)
+	}
+	annotations := make(map[string]string)
+	cw, err := compressWriter(io.MultiWriter(writers...), compression, command, annotations)
 	if err != nil {
-		return "", 0, err
+		return sum, err
+	}
+	uncompressed := []io.Writer{cw, diffIDDigester.Hash()}
+	if indexWriter != nil {
+		uncompressed = append(uncompressed, indexWriter)
+	}
+	_, err = io.Copy(io.MultiWriter(uncompressed...), reader)
+	if err != nil {
+		cw.Close()
+		return sum, err
+	}
+	if err = cw.Close(); err != nil {
+		return sum, err
 	}
-	return digester.Digest(), size, nil
+	sum = blobSum{
+		digest: digester.Digest(),
+		diffID: diffIDDigester.Digest(),
+		size:   counter.n,
+	}
+	if len(annotations) > 0 {
+		sum.annotations = annotations
+	}
+	if indexWriter != nil {
+		indexWriter.Close()
+		result := <-indexed
+		if result.err != nil {
+			return blobSum{}, result.err
+		}
+		sum.fileIndex = &result.index
+	}
+	return sum, nil
+}
+
+type countingWriter struct {
+	n int64
 }
 
-func appendFileToTar(tw *tar.Writer, tarHeaders *tarHeaders, path string, info os.FileInfo, opts *types.PathOptions) error {
-	var link string
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// appendFileToTar appends the file path of the input path input to
+// the archive written by tw into w.
+func appendFileToTar(tw *tar.Writer, w io.Writer, tarHeaders tarHeaders, input int, path string, info os.FileInfo, opts *pathOptions, settings archiveSettings) error {
+	hdr, _, err := settingsFileHeader(path, info, opts, nil, settings)
+	if err != nil {
+		return err
+	}
+	if hdr == nil {
+		return nil
+	}
+
+	// We don't want to override a file already existing in the archive
+	// by a file with different headers.
+	sum := hashHeader(hdr)
+	if previous, ok := tarHeaders[hdr.Name]; ok {
+		if previous.sum != sum {
+			return &headerConflict{path: path, hdr: hdr, previousInput: previous.input, previousPath: previous.path}
+		}
+		return nil
+	}
+	tarHeaders[hdr.Name] = tarHeader{sum: sum, input: input, path: path}
+
+	if opts != nil && opts.Sparse && info.Mode().IsRegular() && hdr.Size > 0 {
+		written, err := appendSparseFileToTar(tw, w, hdr, path)
+		if err != nil || written {
+			return err
+		}
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return errors.New(fmt.Sprintf("Could not write hdr '%#v', got error '%s'", hdr, err.Error()))
+	}
+	// Only regular files have a content: directories, symlinks,
+	// named pipes (opening them would block), devices and empty
+	// files are never opened, which avoids failures on restricted
+	// mounts and reduces the number of opened files.
+	if !info.Mode().IsRegular() || hdr.Size == 0 {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Could not open file '%s', got error '%s'", path, err.Error()))
+	}
+	defer file.Close()
+	err = copyFileContent(tw, file, path, hdr.Size)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Could not copy the file '%s' data to the tarball, got error '%s'", path, err.Error()))
+	}
+	return nil
+}
+
+// copyFileContent copies exactly size bytes of the file path to the
+// archive, size being the size written in the file header. If the
+// file has been modified since its header has been written, the
+// archive would be corrupted: its content is then truncated or padded
+// with zeros, and a warning is emitted.
+func copyFileContent(tw io.Writer, file io.Reader, path string, size int64) error {
+	n, err := io.CopyN(tw, file, size)
+	if err == io.EOF {
+		logrus.Warnf("The file %s has shrunk while it was archived: its content is padded with %d zeros", path, size-n)
+		_, err = io.CopyN(tw, zeroReader{}, size-n)
+	}
+	if err != nil {
+		return err
+	}
+	if m, _ := file.Read(make([]byte, 1)); m > 0 {
+		logrus.Warnf("The file %s has grown while it was archived: its content is truncated to %d bytes", path, size)
+	}
+	return nil
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// pathOptions are the options of a path whose regexes and modes are
+// parsed once, before walking the path which can contain millions of
+// files.
+type pathOptions struct {
+	*types.PathOptions
+	rewrite *regexp.Regexp
+	umask   int64
+	perms   []pathPerm
+}
+
+type pathPerm struct {
+	types.Perm
+	regex *regexp.Regexp
+	mode  int64
+}
+
+// permsMatch returns whether the perms rule applies to the file path.
+// The v1 tar format keeps matching the rewrite regex of the path
+// instead of the regex of the rule, which matches all files if there
+// is no rewrite, since fixing it would change the v1 digests.
+func (opts *pathOptions) permsMatch(perms pathPerm, path string) bool {
+	if opts.TarFormat == types.TarFormatV1 {
+		return opts.rewrite == nil || opts.rewrite.MatchString(path)
+	}
+	return perms.regex.MatchString(path)
+}
+
+// compilePathOptions parses the options of the path. Invalid regexes
+// or modes are reported with the path they belong to. It returns nil
+// if opts is nil.
+func compilePathOptions(path string, opts *types.PathOptions) (*pathOptions, error) {
+	if opts == nil {
+		return nil, nil
+	}
+	compiled := &pathOptions{PathOptions: opts}
 	var err error
+	if opts.Rewrite.Regex != "" {
+		compiled.rewrite, err = regexp.Compile(opts.Rewrite.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid rewrite regex %q of the path %s: %w", opts.Rewrite.Regex, path, err)
+		}
+	}
+	if opts.Umask != "" {
+		if _, err := fmt.Sscanf(opts.Umask, "%o", &compiled.umask); err != nil {
+			return nil, fmt.Errorf("Invalid umask %q of the path %s: %w", opts.Umask, path, err)
+		}
+	}
+	if err := opts.Validate(path); err != nil {
+		return nil, err
+	}
+	for _, perm := range opts.Perms {
+		p := pathPerm{Perm: perm}
+		p.regex, err = regexp.Compile(perm.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid perms regex %q of the path %s: %w", perm.Regex, path, err)
+		}
+		if _, err := fmt.Sscanf(perm.Mode, "%o", &p.mode); err != nil {
+			return nil, fmt.Errorf("Invalid mode %q of the path %s: %w", perm.Mode, path, err)
+		}
+		compiled.perms = append(compiled.perms, p)
+	}
+	return compiled, nil
+}
+
+// validatePaths checks the options of all paths, before starting to
+// archive them. Store paths are only required with the strict
+// reproducibility of the settings of ctx.
+func validatePaths(ctx context.Context, paths types.Paths) error {
+	strict := archiveSettingsFrom(ctx).strict
+	for _, path := range paths {
+		if strict {
+			if err := checkStorePath(path.Path); err != nil {
+				return err
+			}
+		}
+		if _, err := compilePathOptions(path.Path, path.Options); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// auditFunc is called with the rules modifying the header of an
+// archive entry, and a description of the modification.
+type auditFunc func(rule string, name string, change string)
+
+// maxEntrySize is the maximal size of the files of archives, see
+// SetMaxEntrySize.
+var maxEntrySize int64
+
+// SetMaxEntrySize makes the generation of archives fail on files
+// larger than size, such as a forgotten dataset or core dump. Zero
+// means no limit.
+func SetMaxEntrySize(size int64) {
+	maxEntrySize = size
+}
+
+// fileHeader returns the archive header of the file path, or nil if
+// the file is not part of the archive. If audit is not nil, it is
+// called for each rule modifying the ownership or the mode of the
+// file.
+func fileHeader(path string, info os.FileInfo, opts *pathOptions, audit auditFunc) (hdr *tar.Header, link string, err error) {
+	return settingsFileHeader(path, info, opts, audit, processArchiveSettings())
+}
+
+// settingsFileHeader is like fileHeader with the archive settings.
+func settingsFileHeader(path string, info os.FileInfo, opts *pathOptions, audit auditFunc, settings archiveSettings) (hdr *tar.Header, link string, err error) {
+	if settings.strict {
+		if err := checkFileType(path, info); err != nil {
+			return nil, "", err
+		}
+	}
+	// Sockets can not be represented in tar archives and are
+	// meaningless in an image: they are skipped.
+	if info.Mode()&os.ModeSocket != 0 {
+		logrus.Warnf("Skipping the socket %s", path)
+		return nil, "", nil
+	}
 	if info.Mode()&os.ModeSymlink != 0 {
 		link, err = os.Readlink(path)
 		if err != nil {
-			return err
+			return nil, "", err
 		}
 	}
-	hdr, err := tar.FileInfoHeader(info, link)
+	hdr, err = tar.FileInfoHeader(info, link)
 	if err != nil {
-		return err
+		return nil, "", err
+	}
+	if settings.maxEntrySize > 0 && hdr.Size > settings.maxEntrySize {
+		return nil, "", fmt.Errorf("The file %s size %s exceeds the maximum entry size of %s", path, FormatByteSize(hdr.Size), FormatByteSize(settings.maxEntrySize))
 	}
-	if opts != nil && opts.Rewrite.Regex != "" {
-		re := regexp.MustCompile(opts.Rewrite.Regex)
-		hdr.Name = string(re.ReplaceAll([]byte(path), []byte(opts.Rewrite.Repl)))
+	if opts != nil && opts.rewrite != nil {
+		hdr.Name = opts.rewrite.ReplaceAllString(path, opts.Rewrite.Repl)
 	} else {
 		hdr.Name = path
 	}
 	if hdr.Name == "" {
-		return nil
+		return nil, "", nil
+	}
+	if opts != nil && opts.Prefix != nil {
+		hdr.Name = prefixName(hdr.Name, *opts.Prefix)
+		if hdr.Name == "" {
+			return nil, "", nil
+		}
+	}
+	if opts != nil {
+		if err := applyNamePolicy(hdr, path, opts.NamePolicy, audit); err != nil {
+			return nil, "", err
+		}
+		if err := applyAbsoluteSymlinksPolicy(hdr, path, opts.AbsoluteSymlinks, audit); err != nil {
+			return nil, "", err
+		}
+	}
+	if audit != nil && (hdr.Uid != 0 || hdr.Gid != 0) {
+		audit("owner root:root", hdr.Name, fmt.Sprintf("%d:%d -> 0:0", hdr.Uid, hdr.Gid))
 	}
 	hdr.Uid = 0
 	hdr.Gid = 0
 	hdr.Uname = "root"
 	hdr.Gname = "root"
+	if opts != nil {
+		setOwnerNames(hdr, opts.Uname, opts.Gname)
+	}
 
 	if opts != nil {
-		for _, perms := range opts.Perms {
-			re := regexp.MustCompile(opts.Rewrite.Regex)
-			if re.Match([]byte(path)) {
-				_, err := fmt.Sscanf(perms.Mode, "%o", &hdr.Mode)
-				if err != nil{
-					return err
+		if opts.StripSpecialBits {
+			setMode(hdr, hdr.Mode&^07000, "strip-special-bits", audit)
+		}
+		if opts.Umask != "" {
+			setMode(hdr, hdr.Mode&^opts.umask, "umask "+opts.Umask, audit)
+		}
+		for _, perms := range opts.perms {
+			if opts.permsMatch(perms, path) {
+				// Matching entries are reported even if their
+				// mode is not modified
+				if audit != nil {
+					audit(permsRule(perms.Perm), hdr.Name, modeChange(hdr.Mode, perms.mode))
 				}
+				hdr.Mode = perms.mode
+				setOwnerNames(hdr, perms.Uname, perms.Gname)
 			}
 		}
 	}
 
+	if info.Mode()&os.ModeSymlink == 0 {
+		policy := types.ACLsStrip
+		if opts != nil && opts.ACLs != "" {
+			policy = opts.ACLs
+		}
+		if err := applyACLsPolicy(hdr, path, policy, settings.strict, audit); err != nil {
+			return nil, "", err
+		}
+	}
 
 	hdr.ModTime = time.Date(1970, 01, 01, 0, 0, 0, 0, time.UTC)
 	hdr.AccessTime = time.Date(1970, 01, 01, 0, 0, 0, 0, time.UTC)
 	hdr.ChangeTime = time.Date(1970, 01, 01, 0, 0, 0, 0, time.UTC)
+	setTarFormat(hdr, opts)
+	return hdr, link, nil
+}
 
-	for _, h := range *tarHeaders {
-		if hdr.Name == h.Name {
-			// We don't want to override a file already existing in the archive
-			// by a file with different headers.
-			if !reflect.DeepEqual(hdr, h) {
-				return errors.New(fmt.Sprintf("The file %s overrides a file with different attributes (previous: %#v current: %#v)", hdr.Name, h, hdr))
-			}
-			return nil
-		}
+// setTarFormat sets the header format of the archive serialization
+// version of the path, so that the format doesn't depend on the
+// choices of the archive/tar package.
+func setTarFormat(hdr *tar.Header, opts *pathOptions) {
+	version := types.TarFormatLatest
+	if opts != nil && opts.TarFormat != "" {
+		version = opts.TarFormat
 	}
-	*tarHeaders = append(*tarHeaders, hdr)
+	switch version {
+	case types.TarFormatV1, types.TarFormatV2:
+		// The writer chooses USTAR, or PAX if a field can not be
+		// represented in USTAR, such as the size of files larger
+		// than 8GiB. Access and change times are then not written.
+		hdr.Format = tar.FormatUnknown
+	}
+}
 
-	if err := tw.WriteHeader(hdr); err != nil {
-		return errors.New(fmt.Sprintf("Could not write hdr '%#v', got error '%s'", hdr, err.Error()))
+func modeChange(from, to int64) string {
+	return fmt.Sprintf("%04o -> %04o", from, to)
+}
+
+func permsRule(perms types.Perm) string {
+	return fmt.Sprintf("perms regex=%q mode=%s", perms.Regex, perms.Mode)
+}
+
+// setOwnerNames sets the owner names of the header which are not nil.
+func setOwnerNames(hdr *tar.Header, uname, gname *string) {
+	if uname != nil {
+		hdr.Uname = *uname
+	}
+	if gname != nil {
+		hdr.Gname = *gname
 	}
-	if link == "" {
-		file, err := os.Open(path)
+}
+
+func setMode(hdr *tar.Header, mode int64, rule string, audit auditFunc) {
+	if audit != nil && mode != hdr.Mode {
+		audit(rule, hdr.Name, modeChange(hdr.Mode, mode))
+	}
+	hdr.Mode = mode
+}
+
+// prefixName replaces the leading slashes of name by prefix. The
+// name is also cleaned, so that all entries are normalized the same
+// way, whatever the rewrites producing them.
+func prefixName(name string, prefix string) string {
+	name = strings.TrimLeft(filepath.Clean(name), "/")
+	if name == "" || name == "." {
+		return prefix
+	}
+	return prefix + name
+}
+
+// tarHeaders contains, for each file name of the archive, a hash of
+// its header. Only storing the hash bounds the memory used to detect
+// conflicting files in archives containing millions of files.
+type tarHeaders map[string]tarHeader
+
+type tarHeader struct {
+	sum [sha256.Size]byte
+	// The index of the input path and the file producing the
+	// entry, to describe conflicts
+	input int
+	path  string
+}
+
+func hashHeader(hdr *tar.Header) [sha256.Size]byte {
+	// Maps are printed in key-sorted order
+	return sha256.Sum256([]byte(fmt.Sprintf("%#v", *hdr)))
+}
+
+// TarFiles returns a ReadCloser to the tar archive of files described
+// in the JSON files.
+func TarFiles(files []types.File) (io.ReadCloser, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range files {
+		content, err := f.Bytes()
 		if err != nil {
-			return errors.New(fmt.Sprintf("Could not open file '%s', got error '%s'", path, err.Error()))
+			return nil, fmt.Errorf("Invalid content of the file %s: %w", f.Path, err)
+		}
+		hdr := &tar.Header{
+			Typeflag:   tar.TypeReg,
+			Name:       f.Path,
+			Size:       int64(len(content)),
+			Mode:       0644,
+			Uid:        f.Uid,
+			Gid:        f.Gid,
+			Uname:      "root",
+			Gname:      "root",
+			ModTime:    time.Date(1970, 01, 01, 0, 0, 0, 0, time.UTC),
+			AccessTime: time.Date(1970, 01, 01, 0, 0, 0, 0, time.UTC),
+			ChangeTime: time.Date(1970, 01, 01, 0, 0, 0, 0, time.UTC),
 		}
-		defer file.Close()
-		if !info.IsDir() {
-			_, err = io.Copy(tw, file)
+		if f.Mode != "" {
+			_, err := fmt.Sscanf(f.Mode, "%o", &hdr.Mode)
 			if err != nil {
-				return errors.New(fmt.Sprintf("Could not copy the file '%s' data to the tarball, got error '%s'", path, err.Error()))
+				return nil, err
 			}
 		}
+		if f.Uid != 0 {
+			hdr.Uname = ""
+		}
+		if f.Gid != 0 {
+			hdr.Gname = ""
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not write hdr '%#v', got error '%s'", hdr, err.Error()))
+		}
+		if _, err := tw.Write(content); err != nil {
+			return nil, err
+		}
 	}
-	return nil
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return nopCloser{bytes.NewReader(buf.Bytes())}, nil
 }
 
-type tarHeaders []*tar.Header
-
 // TarPaths takes a list of paths and return a ReadCloser to the tar
 // archive. If an error occurs, the ReadCloser is closed with the error.
 func TarPaths(paths types.Paths) (io.ReadCloser) {
+	return TarPathsContext(context.Background(), paths)
+}
+
+// TarPathsContext is like TarPaths but stops producing the archive
+// when the context is cancelled: the ReadCloser is then closed with
+// the context error and the goroutine writing the archive exits, even
+// if nobody is reading the archive anymore.
+func TarPathsContext(ctx context.Context, paths types.Paths) (io.ReadCloser) {
 	r, w := io.Pipe()
 	tw := tar.NewWriter(w)
-	tarHeaders := make(tarHeaders, 0)
+	tarHeaders := make(tarHeaders)
+	settings := archiveSettingsFrom(ctx)
+	done := make(chan struct{})
 	go func() {
+		select {
+		case <-ctx.Done():
+			w.CloseWithError(ctx.Err())
+		case <-done:
+		}
+	}()
+	go func() {
+		defer close(done)
 		defer w.Close()
-		for _, path := range paths {
-			options := path.Options
-			err := filepath.Walk(path.Path, func(path string, info os.FileInfo, err error) error {
+		for input, path := range paths {
+			options, err := compilePathOptions(path.Path, path.Options)
+			if err != nil {
+				w.CloseWithError(err)
+				return
+			}
+			err = walkContext(ctx, path.Path, func(path string, info os.FileInfo, err error) error {
 				if err != nil {
 					return errors.New(fmt.Sprintf("Failed accessing path %q: %v", path, err))
 				}
-				return appendFileToTar(tw, &tarHeaders, path, info, options)
+				err = appendFileToTar(tw, w, tarHeaders, input, path, info, options, settings)
+				var conflict *headerConflict
+				if errors.As(err, &conflict) && options != nil && options.Conflicts == types.ConflictsRelaxed {
+					same, sameErr := sameContent(paths, conflict)
+					if sameErr != nil {
+						return sameErr
+					}
+					if same {
+						logrus.Debugf("The file %s overrides a file with the same content but different attributes: it is skipped", conflict.hdr.Name)
+						return nil
+					}
+				}
+				return err
 			})
+			var conflict *headerConflict
+			if errors.As(err, &conflict) {
+				err = conflictError(paths, input, conflict)
+			}
 			if err != nil {
 				w.CloseWithError(err)
 				return
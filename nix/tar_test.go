@@ -1,7 +1,19 @@
 package nix
 
 import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
 	"testing"
+
 	"github.com/nlewo/nix2container/types"
 )
 
@@ -9,7 +21,7 @@ func TestTar(t *testing.T) {
 	path := types.Path{
 		Path: "../data/tar-directory",
 	}
-	digest, size, err := TarPathsSum(types.Paths{path})
+	digest, size, err := TarPathsSum(context.Background(), types.Paths{path})
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
@@ -22,3 +34,438 @@ func TestTar(t *testing.T) {
 		t.Fatalf("Size is %d while it should be %d", size, expectedSize)
 	}
 }
+
+
+func TestTarCancel(t *testing.T) {
+	path := types.Path{
+		Path: "../data/tar-directory",
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err := TarPathsSum(ctx, types.Paths{path})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Error should be %v (while it is %v)", context.Canceled, err)
+	}
+
+	layerPath := t.TempDir() + "/layer.tar"
+	_, _, err = TarPathsWrite(ctx, types.Paths{path}, layerPath)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Error should be %v (while it is %v)", context.Canceled, err)
+	}
+	if _, err := os.Stat(layerPath); !os.IsNotExist(err) {
+		t.Fatalf("The partial file %s should have been removed", layerPath)
+	}
+}
+
+func TestTarConflict(t *testing.T) {
+	path := types.Path{
+		Path: "../data/tar-directory",
+	}
+	_, _, err := TarPathsSum(context.Background(), types.Paths{path, path})
+	if err != nil {
+		t.Fatalf("Adding twice the same file should not fail: %v", err)
+	}
+
+	paths := types.Paths{
+		types.Path{
+			Path: "../data/layer1",
+			Options: &types.PathOptions{
+				Rewrite: types.Rewrite{Regex: "^../data/layer1", Repl: ""},
+			},
+		},
+		types.Path{
+			Path: "../data/tar-directory",
+			Options: &types.PathOptions{
+				Rewrite: types.Rewrite{Regex: "^../data/tar-directory", Repl: ""},
+			},
+		},
+	}
+	_, _, err = TarPathsSum(context.Background(), paths)
+	if err == nil {
+		t.Fatalf("Overriding a file with a different file should fail")
+	}
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("The error should be a conflict (while it is %v)", err)
+	}
+	expected := "The file /file1 is provided with different attributes by ../data/layer1/file1 (input path ../data/layer1) and ../data/tar-directory/file1 (input path ../data/tar-directory):\n  size:        0 != 13"
+	if err.Error() != expected {
+		t.Fatalf("The error should be '%s' (while it is %s)", expected, err)
+	}
+}
+
+func TestTarConflictRelaxed(t *testing.T) {
+	dirA, dirB := t.TempDir(), t.TempDir()
+	if err := ioutil.WriteFile(dirA+"/file", []byte("content"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := ioutil.WriteFile(dirB+"/file", []byte("content"), 0600); err != nil {
+		t.Fatalf("%v", err)
+	}
+	paths := func(conflicts string) types.Paths {
+		var paths types.Paths
+		for _, dir := range []string{dirA, dirB} {
+			paths = append(paths, types.Path{
+				Path: dir,
+				Options: &types.PathOptions{
+					Rewrite:   types.Rewrite{Regex: "^" + regexp.QuoteMeta(dir), Repl: ""},
+					Conflicts: conflicts,
+				},
+			})
+		}
+		return paths
+	}
+	if _, _, err := TarPathsSum(context.Background(), paths(types.ConflictsStrict)); !errors.Is(err, ErrConflict) {
+		t.Fatalf("Files with different modes should conflict (while the error is %v)", err)
+	}
+	if _, _, err := TarPathsSum(context.Background(), paths(types.ConflictsRelaxed)); err != nil {
+		t.Fatalf("Files with the same content should not conflict in relaxed mode: %v", err)
+	}
+	if err := ioutil.WriteFile(dirB+"/file", []byte("CONTENT"), 0600); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, _, err := TarPathsSum(context.Background(), paths(types.ConflictsRelaxed)); !errors.Is(err, ErrConflict) {
+		t.Fatalf("Files with different contents should conflict in relaxed mode (while the error is %v)", err)
+	}
+}
+
+func TestTarPrefix(t *testing.T) {
+	for _, c := range []struct{ name, prefix, expected string }{
+		{"/nix/store/abc-foo", "", "nix/store/abc-foo"},
+		{"nix/store/abc-foo", "/", "/nix/store/abc-foo"},
+		{"//etc//file1", "./", "./etc/file1"},
+		{"/", "", ""},
+		{"/", "/", "/"},
+	} {
+		if name := prefixName(c.name, c.prefix); name != c.expected {
+			t.Fatalf("Name should be '%#v' (while it is %#v)", c.expected, name)
+		}
+	}
+
+	prefix := ""
+	path := types.Path{
+		Path: "../data/tar-directory",
+		Options: &types.PathOptions{
+			Rewrite: types.Rewrite{
+				Regex: "^\\.\\./data",
+				Repl:  "/data",
+			},
+			Prefix: &prefix,
+		},
+	}
+	reader := TarPaths(types.Paths{path})
+	defer reader.Close()
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if !strings.HasPrefix(hdr.Name, "data/tar-directory") {
+			t.Fatalf("Name %s should be relative", hdr.Name)
+		}
+	}
+}
+
+func TestTarOwnerNames(t *testing.T) {
+	empty, nobody := "", "nobody"
+	path := types.Path{
+		Path: "../data/tar-directory",
+		Options: &types.PathOptions{
+			Uname: &empty,
+			Gname: &empty,
+			Perms: []types.Perm{
+				types.Perm{Regex: "file1$", Mode: "0644", Uname: &nobody},
+			},
+		},
+	}
+	reader := TarPaths(types.Paths{path})
+	defer reader.Close()
+	tr := tar.NewReader(reader)
+	names := make(map[string]string)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		names[hdr.Name] = hdr.Uname + ":" + hdr.Gname
+	}
+	expected := map[string]string{
+		"../data/tar-directory":       ":",
+		"../data/tar-directory/file1": "nobody:",
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("Owner names should be '%#v' (while they are %#v)", expected, names)
+	}
+}
+
+func TestCopyFileContent(t *testing.T) {
+	for content, expected := range map[string]string{
+		"abc":   "abc",
+		"a":     "a\x00\x00",
+		"abcde": "abc",
+	} {
+		var buf bytes.Buffer
+		err := copyFileContent(&buf, strings.NewReader(content), "file", 3)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if buf.String() != expected {
+			t.Fatalf("The content of %q should be '%#v' (while it is %#v)", content, expected, buf.String())
+		}
+	}
+}
+
+func TestTarUnreadableEmptyFile(t *testing.T) {
+	if os.Getuid() == 0 {
+		t.Skip("Permissions are not enforced for root")
+	}
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(dir+"/empty", nil, 0000); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, _, err := TarPathsSum(context.Background(), types.Paths{types.Path{Path: dir}}); err != nil {
+		t.Fatalf("Empty files should not be opened: %v", err)
+	}
+}
+
+func TestTarInvalidRegex(t *testing.T) {
+	for _, options := range []types.PathOptions{
+		{Rewrite: types.Rewrite{Regex: "^../data/(tar"}},
+		{Perms: []types.Perm{{Regex: "[", Mode: "0644"}}},
+		{Perms: []types.Perm{{Regex: ".*", Mode: "rw"}}},
+	} {
+		options := options
+		path := types.Path{
+			Path:    "../data/tar-directory",
+			Options: &options,
+		}
+		_, _, err := TarPathsSum(context.Background(), types.Paths{path})
+		if err == nil || !strings.Contains(err.Error(), "../data/tar-directory") {
+			t.Fatalf("The error should mention the path (while it is %v)", err)
+		}
+	}
+}
+
+func TestTarFormatMigration(t *testing.T) {
+	// A layer written before the tar format option, whose perms
+	// rule is matched with the rewrite regex of the path
+	options := types.PathOptions{
+		TarFormat: types.TarFormatV1,
+		Perms:     []types.Perm{{Regex: "nomatch", Mode: "0600"}},
+	}
+	path := types.Path{Path: "../data/tar-directory", Options: &options}
+	expected, _, err := TarPathsSum(context.Background(), types.Paths{path})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	content := `{"version": 9, "paths": [{"path": "../data/tar-directory", "options": {"perms": [{"path": "", "regex": "nomatch", "mode": "0600"}]}}]}`
+	var layer types.Layer
+	if err := json.Unmarshal([]byte(content), &layer); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := layer.Migrate(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	digest, _, err := TarPathsSum(context.Background(), layer.Paths)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if digest != expected {
+		t.Fatalf("The digest of the migrated layer should be '%s' (while it is %s)", expected, digest)
+	}
+}
+
+func TestTarFormat(t *testing.T) {
+	// The digest of the v1 serialization must never change
+	path := types.Path{
+		Path:    "../data/tar-directory",
+		Options: &types.PathOptions{TarFormat: types.TarFormatV1},
+	}
+	digest, _, err := TarPathsSum(context.Background(), types.Paths{path})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expectedDigest := "sha256:a0a389b8df6fec3293a0b26714f77d6aa252d2304de516daa683b4a55053dc5a"
+	if digest.String() != expectedDigest {
+		t.Fatalf("Digest is %s while it should be %s", digest.String(), expectedDigest)
+	}
+
+	path.Options.TarFormat = "v0"
+	if _, _, err := TarPathsSum(context.Background(), types.Paths{path}); err == nil {
+		t.Fatalf("An unknown tar format should be rejected")
+	}
+
+	// Perms rules are matched with the rewrite regex of the path
+	// with v1, so they apply to all files without rewrite
+	path.Options = &types.PathOptions{
+		TarFormat: types.TarFormatV1,
+		Perms:     []types.Perm{{Regex: "nomatch", Mode: "0600"}},
+	}
+	for _, format := range []string{types.TarFormatV1, types.TarFormatV2} {
+		path.Options.TarFormat = format
+		reader := TarPaths(types.Paths{path})
+		tr := tar.NewReader(reader)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if (hdr.Mode == 0600) != (format == types.TarFormatV1) {
+				t.Fatalf("The mode of %s should only be 0600 with v1 (while it is %04o with %s)", hdr.Name, hdr.Mode, format)
+			}
+		}
+		reader.Close()
+	}
+
+	// The options introduced by v2 are rejected with v1
+	root := "root"
+	for _, opts := range []types.PathOptions{
+		{ACLs: types.ACLsPreserve},
+		{Sparse: true},
+		{Uname: &root},
+		{Perms: []types.Perm{{Regex: ".*", Mode: "0644", Gname: &root}}},
+		{NamePolicy: types.NamePolicySanitize},
+		{AbsoluteSymlinks: types.AbsoluteSymlinksRelativize},
+	} {
+		opts.TarFormat = types.TarFormatV1
+		p := types.Path{Path: "../data/tar-directory", Options: &opts}
+		if _, _, err := TarPathsSum(context.Background(), types.Paths{p}); err == nil {
+			t.Fatalf("The options %#v should be rejected with the tar format v1", opts)
+		}
+		opts.TarFormat = types.TarFormatV2
+		if _, _, err := TarPathsSum(context.Background(), types.Paths{p}); err != nil {
+			t.Fatalf("The options %#v should be accepted with the tar format v2: %v", opts, err)
+		}
+	}
+}
+
+// headWriter keeps the first bytes written and counts all of them.
+type headWriter struct {
+	head []byte
+	n    int64
+}
+
+func (w *headWriter) Write(p []byte) (int, error) {
+	if n := 4096 - len(w.head); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		w.head = append(w.head, p[:n]...)
+	}
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+func TestTarLargeFile(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Archiving a 8GiB file is skipped in short mode")
+	}
+	// A sparse file larger than the USTAR size field (8GiB)
+	path := t.TempDir() + "/large"
+	size := int64(8<<30 + 1)
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var w headWriter
+	tw := tar.NewWriter(&w)
+	if err := appendFileToTar(tw, &w, make(tarHeaders), 0, path, info, nil, processArchiveSettings()); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	hdr, err := tar.NewReader(bytes.NewReader(w.head)).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Size != size {
+		t.Fatalf("Size should be '%#v' (while it is %#v)", size, hdr.Size)
+	}
+	if hdr.Format&tar.FormatPAX == 0 {
+		t.Fatalf("Format should be '%#v' (while it is %#v)", tar.FormatPAX, hdr.Format)
+	}
+	if w.n < size {
+		t.Fatalf("The archive size should be larger than %d (while it is %d)", size, w.n)
+	}
+}
+
+func TestTarMaxEntrySize(t *testing.T) {
+	SetMaxEntrySize(1024)
+	defer SetMaxEntrySize(0)
+	path := t.TempDir() + "/file"
+	if err := ioutil.WriteFile(path, make([]byte, 2048), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = fileHeader(path, info, nil, nil)
+	if err == nil {
+		t.Fatalf("A file larger than the maximum entry size should be rejected")
+	}
+	SetMaxEntrySize(4096)
+	if _, _, err = fileHeader(path, info, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTarFiles(t *testing.T) {
+	files := []types.File{
+		types.File{Path: "/VERSION", Content: "1.2.3"},
+		types.File{Path: "/var/lib/app/key.bin", Content: "AAEC", Encoding: types.FileEncodingBase64, Mode: "0600", Uid: 1000, Gid: 100},
+	}
+	rc, err := TarFiles(files)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer rc.Close()
+	tr := tar.NewReader(rc)
+	expected := []struct {
+		name    string
+		content []byte
+		mode    int64
+		uid     int
+		uname   string
+	}{
+		{"/VERSION", []byte("1.2.3"), 0644, 0, "root"},
+		{"/var/lib/app/key.bin", []byte{0, 1, 2}, 0600, 1000, ""},
+	}
+	for _, e := range expected {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if hdr.Name != e.name || !bytes.Equal(content, e.content) || hdr.Mode != e.mode || hdr.Uid != e.uid || hdr.Uname != e.uname {
+			t.Fatalf("The entry %s should be '%#v' (while it is %#v with the content %#v)", e.name, e, hdr, content)
+		}
+	}
+
+	_, err = TarFiles([]types.File{types.File{Path: "/bad", Content: "not base64!", Encoding: types.FileEncodingBase64}})
+	if err == nil {
+		t.Fatalf("Invalid base64 content should be rejected")
+	}
+}
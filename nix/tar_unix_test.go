@@ -0,0 +1,76 @@
+//go:build !windows
+// +build !windows
+
+package nix
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/nlewo/nix2container/types"
+)
+
+// createSpecialFiles creates in directory an empty file, a file, a
+// symlink, a named pipe and a socket.
+func createSpecialFiles(t *testing.T, directory string, modTime time.Time) {
+	if err := ioutil.WriteFile(directory+"/empty", []byte{}, 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := ioutil.WriteFile(directory+"/file", []byte("content\n"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := os.Symlink("file", directory+"/link"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := syscall.Mkfifo(directory+"/fifo", 0600); err != nil {
+		t.Fatalf("%v", err)
+	}
+	l, err := net.Listen("unix", directory+"/socket")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	for _, f := range []string{"", "/empty", "/file", "/fifo"} {
+		if err := os.Chmod(directory+f, 0755); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := os.Chtimes(directory+f, modTime, modTime); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+}
+
+func TestTarSpecialFiles(t *testing.T) {
+	// The archive must not depend on the files timestamps
+	for _, modTime := range []time.Time{time.Unix(0, 0), time.Now()} {
+		directory := t.TempDir()
+		createSpecialFiles(t, directory, modTime)
+		path := types.Path{
+			Path: directory,
+			Options: &types.PathOptions{
+				Rewrite: types.Rewrite{
+					Regex: "^" + regexp.QuoteMeta(directory),
+					Repl:  "",
+				},
+			},
+		}
+		digest, size, err := TarPathsSum(context.Background(), types.Paths{path})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		expectedDigest := "sha256:d2cd26bdbb5cea1c6e2f5b82b105f54ed515a78d10dc43b3c9a9fbfe0d28ca56"
+		if digest.String() != expectedDigest {
+			t.Fatalf("Digest is %s while it should be %s", digest.String(), expectedDigest)
+		}
+		expectedSize := int64(3584)
+		if size != expectedSize {
+			t.Fatalf("Size is %d while it should be %d", size, expectedSize)
+		}
+	}
+}
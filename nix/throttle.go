@@ -0,0 +1,183 @@
+package nix
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Environment variables limiting the rate and the number of blobs
+// read through GetBlob. Since blobs are streamed to the destination
+// while they are read, this bounds the bandwidth used by Skopeo when
+// pushing an image. They are applied by ConfigureFromEnv, so each copy
+// (and thus each destination) can have its own limits.
+const (
+	MaxUploadRateEnv       = "NIX2CONTAINER_MAX_UPLOAD_RATE"
+	MaxParallelUploadsEnv  = "NIX2CONTAINER_MAX_PARALLEL_UPLOADS"
+	throttleReadBufferSize = 32 * 1024
+)
+
+var throttle struct {
+	mu       sync.Mutex
+	limiter  *rateLimiter
+	parallel chan struct{}
+}
+
+// UploadLimitsFromEnv returns the upload limits set by the
+// environment variables, see SetUploadLimits.
+func UploadLimitsFromEnv() (rate int64, parallel int, err error) {
+	if s := os.Getenv(MaxUploadRateEnv); s != "" {
+		if rate, err = ParseByteSize(s); err != nil {
+			return 0, 0, fmt.Errorf("Invalid %s: %w", MaxUploadRateEnv, err)
+		}
+	}
+	if s := os.Getenv(MaxParallelUploadsEnv); s != "" {
+		if parallel, err = strconv.Atoi(s); err != nil {
+			return 0, 0, fmt.Errorf("Invalid %s: %w", MaxParallelUploadsEnv, err)
+		}
+	}
+	return rate, parallel, nil
+}
+
+// SetUploadLimits limits the rate of all blobs read through GetBlob
+// to rate bytes per second, and the number of layer blobs being read
+// at the same time to parallel. A zero value disables the limit.
+func SetUploadLimits(rate int64, parallel int) {
+	throttle.mu.Lock()
+	defer throttle.mu.Unlock()
+	throttle.limiter = nil
+	if rate > 0 {
+		throttle.limiter = &rateLimiter{rate: float64(rate)}
+	}
+	throttle.parallel = nil
+	if parallel > 0 {
+		throttle.parallel = make(chan struct{}, parallel)
+	}
+}
+
+// defaultParallelUploads is the number of blobs uploaded at the same
+// time by UploadLayers when it is not limited, as containers/image
+// does.
+const defaultParallelUploads = 6
+
+// parallelUploads returns the number of blobs uploaded at the same
+// time by UploadLayers: the limit of SetUploadLimits, if any.
+func parallelUploads() int {
+	throttle.mu.Lock()
+	defer throttle.mu.Unlock()
+	if throttle.parallel != nil {
+		return cap(throttle.parallel)
+	}
+	return defaultParallelUploads
+}
+
+// throttleBlob applies the upload limits on a blob. If isLayer is
+// true, reads block while the number of layers being read is at the
+// limit. A layer only takes a slot from its first read until it has
+// been completely read or closed: a consumer opening several blobs
+// before reading them, or generating a blob while another one is open,
+// would otherwise wait for a slot it holds itself.
+func throttleBlob(rc io.ReadCloser, isLayer bool) io.ReadCloser {
+	throttle.mu.Lock()
+	limiter, parallel := throttle.limiter, throttle.parallel
+	throttle.mu.Unlock()
+	if !isLayer {
+		parallel = nil
+	}
+	if limiter == nil && parallel == nil {
+		return rc
+	}
+	return &throttledReadCloser{
+		ReadCloser: rc,
+		limiter:    limiter,
+		parallel:   parallel,
+	}
+}
+
+type throttledReadCloser struct {
+	io.ReadCloser
+	limiter  *rateLimiter
+	parallel chan struct{}
+	// Whether the blob holds a slot of parallel
+	acquired bool
+	released bool
+}
+
+func (t *throttledReadCloser) Read(p []byte) (int, error) {
+	if t.parallel != nil && !t.acquired {
+		t.parallel <- struct{}{}
+		t.acquired = true
+	}
+	if t.limiter != nil && len(p) > throttleReadBufferSize {
+		p = p[:throttleReadBufferSize]
+	}
+	n, err := t.ReadCloser.Read(p)
+	if t.limiter != nil {
+		t.limiter.wait(n)
+	}
+	if err != nil {
+		t.release()
+	}
+	return n, err
+}
+
+func (t *throttledReadCloser) release() {
+	if t.acquired && !t.released {
+		<-t.parallel
+		t.released = true
+	}
+}
+
+func (t *throttledReadCloser) Close() error {
+	t.release()
+	return t.ReadCloser.Close()
+}
+
+// rateLimiter is shared by all blobs: the limit applies to the sum of
+// their rates.
+type rateLimiter struct {
+	mu   sync.Mutex
+	rate float64
+	// The time at which the bytes already read would have been
+	// sent at the limited rate
+	next time.Time
+}
+
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+	d := l.next.Sub(now)
+	l.mu.Unlock()
+	time.Sleep(d)
+}
+
+// ParseByteSize parses sizes such as "512", "100K", "10M" or "1G"
+// (powers of 1024).
+func ParseByteSize(s string) (int64, error) {
+	size := s
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		multiplier = 1024
+	case strings.HasSuffix(s, "M"):
+		multiplier = 1024 * 1024
+	case strings.HasSuffix(s, "G"):
+		multiplier = 1024 * 1024 * 1024
+	}
+	if multiplier != 1 {
+		size = s[:len(s)-1]
+	}
+	v, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("Invalid size %q: it must be a positive number optionally followed by K, M or G", s)
+	}
+	return v * multiplier, nil
+}
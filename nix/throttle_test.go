@@ -0,0 +1,95 @@
+package nix
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseByteSize(t *testing.T) {
+	for s, expected := range map[string]int64{"512": 512, "100K": 100 * 1024, "10M": 10 * 1024 * 1024, "1G": 1024 * 1024 * 1024} {
+		v, err := ParseByteSize(s)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if v != expected {
+			t.Fatalf("%s should be '%#v' (while it is %#v)", s, expected, v)
+		}
+	}
+	for _, s := range []string{"", "M", "-1", "10T"} {
+		if _, err := ParseByteSize(s); err == nil {
+			t.Fatalf("%q should not be a valid size", s)
+		}
+	}
+}
+
+func TestThrottleBlob(t *testing.T) {
+	SetUploadLimits(1024*1024, 1)
+	defer SetUploadLimits(0, 0)
+
+	start := time.Now()
+	rc := throttleBlob(nopCloser{bytes.NewReader(make([]byte, 200*1024))}, true)
+	if _, err := ioutil.ReadAll(rc); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Fatalf("Reading 200K at 1M/s should take at least 150ms (while it took %s)", elapsed)
+	}
+
+	// A layer being read holds a slot until it has been completely
+	// read or closed
+	rc = throttleBlob(nopCloser{bytes.NewReader(make([]byte, 1024))}, true)
+	if _, err := rc.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("%v", err)
+	}
+	read := make(chan struct{})
+	go func() {
+		other := throttleBlob(nopCloser{bytes.NewReader(nil)}, true)
+		ioutil.ReadAll(other)
+		other.Close()
+		close(read)
+	}()
+	select {
+	case <-read:
+		t.Fatalf("A second layer should not be read while the first one is being read")
+	case <-time.After(50 * time.Millisecond):
+	}
+	rc.Close()
+	<-read
+
+	// Opened layers which are not read don't hold a slot, so that
+	// a blob can be read while another one is open
+	opened := throttleBlob(nopCloser{bytes.NewReader(nil)}, true)
+	defer opened.Close()
+	done := make(chan struct{})
+	go func() {
+		other := throttleBlob(nopCloser{bytes.NewReader(make([]byte, 10))}, true)
+		ioutil.ReadAll(other)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("A layer should be read while another one is open but not read")
+	}
+}
+
+func TestUploadLimitsFromEnv(t *testing.T) {
+	os.Setenv(MaxUploadRateEnv, "10M")
+	defer os.Unsetenv(MaxUploadRateEnv)
+	os.Setenv(MaxParallelUploadsEnv, "2")
+	defer os.Unsetenv(MaxParallelUploadsEnv)
+	rate, parallel, err := UploadLimitsFromEnv()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if rate != 10*1024*1024 || parallel != 2 {
+		t.Fatalf("The limits should be '10M 2' (while they are %d %d)", rate, parallel)
+	}
+	os.Setenv(MaxParallelUploadsEnv, "many")
+	if _, _, err := UploadLimitsFromEnv(); err == nil {
+		t.Fatalf("An invalid number of parallel uploads should be rejected")
+	}
+}
@@ -0,0 +1,143 @@
+package nix
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nlewo/nix2container/types"
+	"github.com/sirupsen/logrus"
+)
+
+// TraceEntry describes an entry of a layer and where it comes from.
+type TraceEntry struct {
+	// The name of the entry in the archive
+	Name string
+	// The digest of the layer containing the entry
+	Layer string
+	// The store path the entry comes from. It is empty if the
+	// entry doesn't come from a store path.
+	StorePath string
+	// The file the entry has been generated from, if it is known
+	Path string
+}
+
+// TraceImage returns the entries of all layers of the image, with the
+// store path and the layer they come from. Entries of layers built by
+// nix2container are traced to the paths of the layer while entries of
+// other layers (such as base image layers) are read from their
+// archive.
+func TraceImage(ctx context.Context, image types.Image) (entries []TraceEntry, err error) {
+	for _, layer := range image.Layers {
+		layerEntries, err := TraceLayer(ctx, layer)
+		if err != nil {
+			return entries, err
+		}
+		entries = append(entries, layerEntries...)
+	}
+	return entries, nil
+}
+
+// TraceLayer returns the entries of a layer, with the store path they
+// come from.
+func TraceLayer(ctx context.Context, layer types.Layer) (entries []TraceEntry, err error) {
+	switch {
+	case layer.Paths != nil:
+		return tracePaths(ctx, layer)
+	case layer.Files != nil:
+		for _, f := range layer.Files {
+			entries = append(entries, TraceEntry{Name: f.Path, Layer: layer.Digest})
+		}
+		return entries, nil
+	case layer.Pinned:
+		logrus.Warnf("Skipping the pinned layer %s", layer.Digest)
+		return entries, nil
+	case IsEncryptedMediaType(layer.MediaType):
+		logrus.Warnf("Skipping the encrypted layer %s", layer.Digest)
+		return entries, nil
+	default:
+		return traceArchive(layer)
+	}
+}
+
+func tracePaths(ctx context.Context, layer types.Layer) (entries []TraceEntry, err error) {
+	// As in the archive, only the first file of a name is added
+	names := make(map[string]bool)
+	for _, path := range layer.Paths {
+		options, err := compilePathOptions(path.Path, path.Options)
+		if err != nil {
+			return entries, err
+		}
+		err = walkContext(ctx, path.Path, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return errors.New(fmt.Sprintf("Failed accessing path %q: %v", p, err))
+			}
+			hdr, _, err := fileHeader(p, info, options, nil)
+			if err != nil || hdr == nil || names[hdr.Name] {
+				return err
+			}
+			names[hdr.Name] = true
+			entries = append(entries, TraceEntry{
+				Name:      hdr.Name,
+				Layer:     layer.Digest,
+				StorePath: path.Path,
+				Path:      p,
+			})
+			return nil
+		})
+		if err != nil {
+			return entries, err
+		}
+	}
+	return entries, nil
+}
+
+// traceArchive reads the entries of the layer archive. Since the
+// files the entries come from are unknown, the store path is guessed
+// from the entry name.
+func traceArchive(layer types.Layer) (entries []TraceEntry, err error) {
+	rc, _, err := LayerGetBlob(layer)
+	if err != nil {
+		return entries, err
+	}
+	defer rc.Close()
+	r, err := decompressReader(rc, layer.MediaType)
+	if err != nil {
+		return entries, err
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return entries, fmt.Errorf("Could not read the archive of the layer %s: %w", layer.Digest, err)
+		}
+		entries = append(entries, TraceEntry{
+			Name:      hdr.Name,
+			Layer:     layer.Digest,
+			StorePath: storePathOf(hdr.Name),
+		})
+	}
+}
+
+// storePathOf returns the store path containing the file name, such
+// as /nix/store/...-hello for nix/store/...-hello/bin/hello, or an
+// empty string if name is not in the store.
+func storePathOf(name string) string {
+	name = "/" + strings.TrimLeft(filepath.Clean(name), "/")
+	if !strings.HasPrefix(name, "/nix/store/") {
+		return ""
+	}
+	parts := strings.SplitN(strings.TrimPrefix(name, "/nix/store/"), "/", 2)
+	if parts[0] == "" {
+		return ""
+	}
+	return "/nix/store/" + parts[0]
+}
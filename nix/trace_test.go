@@ -0,0 +1,56 @@
+package nix
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/nlewo/nix2container/types"
+)
+
+func TestTraceImage(t *testing.T) {
+	paths := types.Paths{
+		types.Path{Path: "../data/layer1"},
+	}
+	archive := filepath.Join(t.TempDir(), "layer.tar")
+	digest, _, err := TarPathsWrite(context.Background(), paths, archive)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	image := types.Image{
+		Layers: []types.Layer{
+			types.Layer{Digest: "sha256:paths", Paths: paths},
+			types.Layer{Digest: "sha256:files", Files: []types.File{types.File{Path: "/etc/hosts"}}},
+			types.Layer{Digest: digest.String(), LayerPath: archive, MediaType: "application/vnd.oci.image.layer.v1.tar"},
+		},
+	}
+	entries, err := TraceImage(context.Background(), image)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := []TraceEntry{
+		TraceEntry{Name: "../data/layer1", Layer: "sha256:paths", StorePath: "../data/layer1", Path: "../data/layer1"},
+		TraceEntry{Name: "../data/layer1/file1", Layer: "sha256:paths", StorePath: "../data/layer1", Path: "../data/layer1/file1"},
+		TraceEntry{Name: "/etc/hosts", Layer: "sha256:files"},
+		TraceEntry{Name: "../data/layer1", Layer: digest.String()},
+		TraceEntry{Name: "../data/layer1/file1", Layer: digest.String()},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Fatalf("Entries should be '%#v' (while they are %#v)", expected, entries)
+	}
+}
+
+func TestStorePathOf(t *testing.T) {
+	for name, expected := range map[string]string{
+		"nix/store/abc-hello/bin/hello": "/nix/store/abc-hello",
+		"/nix/store/abc-hello":          "/nix/store/abc-hello",
+		"./nix/store/abc-hello/lib/":    "/nix/store/abc-hello",
+		"nix/store/":                    "",
+		"etc/passwd":                    "",
+	} {
+		if storePath := storePathOf(name); storePath != expected {
+			t.Fatalf("The store path of %s should be '%#v' (while it is %#v)", name, expected, storePath)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package nix
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/nlewo/nix2container/types"
+	"github.com/sirupsen/logrus"
+)
+
+// UploadReportEnv is the environment variable containing the file
+// where the blobs read by the copy tool are recorded. Since the copy
+// tool only reads the blobs missing on the destination, the blobs
+// which are not recorded have been reused.
+const UploadReportEnv = "NIX2CONTAINER_UPLOAD_REPORT"
+
+type uploadRecord struct {
+	Digest string `json:"digest"`
+	Bytes  int64  `json:"bytes"`
+}
+
+// recordBlobRead appends the number of bytes read from the blob to
+// the upload report, if any. Records are JSON lines, since the blobs
+// of several images can be copied by several processes.
+func recordBlobRead(digest string, n int64) {
+	filename := os.Getenv(UploadReportEnv)
+	if filename == "" {
+		return
+	}
+	if err := appendRecord(filename, uploadRecord{Digest: digest, Bytes: n}); err != nil {
+		logrus.Warnf("Could not write the upload report %s: %s", filename, err)
+	}
+}
+
+var appendRecordMu sync.Mutex
+
+// appendRecord appends the record to filename as a JSON line. If the
+// last line has been truncated, for instance because a process has
+// been killed while writing it, the record starts on a new line.
+func appendRecord(filename string, record interface{}) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	appendRecordMu.Lock()
+	defer appendRecordMu.Unlock()
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			line = append([]byte{'\n'}, line...)
+		}
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ReadUploadReport returns the number of bytes read by the copy tool
+// for each blob digest.
+func ReadUploadReport(filename string) (map[string]int64, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	uploads := make(map[string]int64)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var record uploadRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("Invalid record in the upload report %s: %w", filename, err)
+		}
+		uploads[record.Digest] += record.Bytes
+	}
+	return uploads, scanner.Err()
+}
+
+// SetResultUploads records in the result which blobs have been
+// uploaded, according to the upload report, and which ones have been
+// reused.
+func SetResultUploads(result *types.Result, uploads map[string]int64) {
+	result.UploadedSize = uploads[result.Config.Digest]
+	if _, ok := uploads[result.Config.Digest]; !ok {
+		result.ReusedSize = result.Config.Size
+	}
+	for i := range result.Layers {
+		layer := &result.Layers[i]
+		uploaded, ok := uploads[layer.Digest]
+		reused := !ok
+		layer.Reused = &reused
+		layer.Uploaded = uploaded
+		result.UploadedSize += uploaded
+		if reused {
+			result.ReusedSize += layer.Size
+		}
+	}
+}
+
+// LogResultUploads logs the bytes uploaded and reused for each layer
+// of the result.
+func LogResultUploads(result types.Result) {
+	for _, layer := range result.Layers {
+		if layer.Reused != nil && *layer.Reused {
+			logrus.Infof("Layer %s: reused (%s)", layer.Digest, FormatByteSize(layer.Size))
+		} else {
+			logrus.Infof("Layer %s: uploaded %s", layer.Digest, FormatByteSize(layer.Uploaded))
+		}
+	}
+	saved := 0.0
+	if total := result.UploadedSize + result.ReusedSize; total > 0 {
+		saved = 100 * float64(result.ReusedSize) / float64(total)
+	}
+	logrus.Infof("Uploaded %s, reused %s (%.0f%% saved)", FormatByteSize(result.UploadedSize), FormatByteSize(result.ReusedSize), saved)
+}
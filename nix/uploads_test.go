@@ -0,0 +1,53 @@
+package nix
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+)
+
+func TestUploadReport(t *testing.T) {
+	layers, err := NewLayers(context.Background(), []string{"../data/tar-directory"}, nil, nil, "", nil, types.PathOptions{}, CompressionNone)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	image := types.Image{Layers: layers}
+	report := filepath.Join(t.TempDir(), "uploads")
+	os.Setenv(UploadReportEnv, report)
+	defer os.Unsetenv(UploadReportEnv)
+
+	layer := image.Layers[0]
+	rc, _, err := GetBlob(image, godigest.Digest(layer.Digest))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := io.Copy(ioutil.Discard, rc); err != nil {
+		t.Fatalf("%v", err)
+	}
+	rc.Close()
+
+	uploads, err := ReadUploadReport(report)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if uploads[layer.Digest] != layer.Size {
+		t.Fatalf("The uploaded size should be '%#v' (while it is %#v)", layer.Size, uploads[layer.Digest])
+	}
+	result, err := NewResult(image, godigest.FromString("manifest"), nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	SetResultUploads(&result, uploads)
+	if *result.Layers[0].Reused || result.UploadedSize != layer.Size {
+		t.Fatalf("The layer should have been uploaded (while the result is %#v)", result)
+	}
+	if result.ReusedSize != result.Config.Size {
+		t.Fatalf("The reused size should be '%#v' (while it is %#v)", result.Config.Size, result.ReusedSize)
+	}
+}
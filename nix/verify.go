@@ -0,0 +1,226 @@
+package nix
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/containers/image/v5/pkg/blobinfocache/none"
+	imageTypes "github.com/containers/image/v5/types"
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// VerifyMismatch is a difference between a local image and a
+// registry image.
+type VerifyMismatch struct {
+	// What differs: "layer-count", "layer", "diff-id" or
+	// "config" (Field is then the configuration field, such as
+	// config.Env)
+	Kind  string `json:"kind"`
+	Index int    `json:"index"`
+	Field string `json:"field,omitempty"`
+	// The local and remote values
+	Local  string `json:"local"`
+	Remote string `json:"remote"`
+}
+
+// VerifyResult compares a local image to a registry image.
+type VerifyResult struct {
+	Reference           string           `json:"reference"`
+	ManifestDigest      godigest.Digest  `json:"manifest-digest"`
+	LocalManifestDigest godigest.Digest  `json:"local-manifest-digest"`
+	ConfigDigest        godigest.Digest  `json:"config-digest"`
+	LocalConfigDigest   godigest.Digest  `json:"local-config-digest"`
+	Layers              int              `json:"layers"`
+	Mismatches          []VerifyMismatch `json:"mismatches"`
+}
+
+// Verified is true when the registry image has the configuration and
+// the layers of the local image. Their manifests can still differ,
+// for instance because of annotations added by the registry.
+func (r VerifyResult) Verified() bool {
+	return len(r.Mismatches) == 0
+}
+
+// VerifyImage compares the configuration, the layer digests and the
+// diff IDs of the image to the ones of the registry image reference
+// (such as docker://registry/app@sha256:...). If the registry image
+// is multi-platform, the image of the platform of image is compared.
+func VerifyImage(ctx context.Context, sys *imageTypes.SystemContext, image types.Image, reference string) (result VerifyResult, err error) {
+	src, manifest, manifestDigest, err := openRemoteImage(ctx, sys, image, reference)
+	if err != nil {
+		return result, err
+	}
+	defer src.Close()
+	rc, _, err := src.GetBlob(ctx, imageTypes.BlobInfo{Digest: manifest.Config.Digest, Size: manifest.Config.Size}, none.NoCache)
+	if err != nil {
+		return result, fmt.Errorf("Could not read the configuration of %s: %w", reference, err)
+	}
+	defer rc.Close()
+	remoteConfig, err := ioutil.ReadAll(verifyBlob(rc, reference, manifest.Config.Digest, manifest.Config.Size))
+	if err != nil {
+		return result, err
+	}
+	result, err = verifyImage(image, manifest, remoteConfig)
+	result.Reference = reference
+	result.ManifestDigest = manifestDigest
+	return result, err
+}
+
+// configRootFS is the part of image configurations containing the
+// diff IDs.
+type configRootFS struct {
+	RootFS struct {
+		DiffIDs []godigest.Digest `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+// verifyImage compares the image to a remote image manifest and
+// configuration.
+func verifyImage(image types.Image, manifest v1.Manifest, remoteConfig []byte) (result VerifyResult, err error) {
+	localManifest, err := GetManifestBlob(image)
+	if err != nil {
+		return result, err
+	}
+	result.LocalManifestDigest = godigest.FromBytes(localManifest)
+	localConfig, err := GetConfigBlob(image)
+	if err != nil {
+		return result, err
+	}
+	result.LocalConfigDigest = godigest.FromBytes(localConfig)
+	result.ConfigDigest = manifest.Config.Digest
+	result.Layers = len(image.Layers)
+	result.Mismatches = []VerifyMismatch{}
+
+	if result.ConfigDigest != result.LocalConfigDigest {
+		fields, err := configFieldMismatches(localConfig, remoteConfig)
+		if err != nil {
+			return result, err
+		}
+		result.Mismatches = append(result.Mismatches, fields...)
+	}
+
+	if len(manifest.Layers) != len(image.Layers) {
+		result.Mismatches = append(result.Mismatches, VerifyMismatch{
+			Kind:   "layer-count",
+			Local:  fmt.Sprintf("%d", len(image.Layers)),
+			Remote: fmt.Sprintf("%d", len(manifest.Layers)),
+		})
+	}
+	for i := 0; i < len(image.Layers) && i < len(manifest.Layers); i++ {
+		if image.Layers[i].Digest != manifest.Layers[i].Digest.String() {
+			result.Mismatches = append(result.Mismatches, VerifyMismatch{
+				Kind:   "layer",
+				Index:  i,
+				Local:  image.Layers[i].Digest,
+				Remote: manifest.Layers[i].Digest.String(),
+			})
+		}
+	}
+
+	var local, remote configRootFS
+	if err := json.Unmarshal(localConfig, &local); err != nil {
+		return result, err
+	}
+	if err := json.Unmarshal(remoteConfig, &remote); err != nil {
+		return result, fmt.Errorf("Could not parse the remote configuration: %w", err)
+	}
+	localDiffIDs, remoteDiffIDs := local.RootFS.DiffIDs, remote.RootFS.DiffIDs
+	for i := 0; i < len(localDiffIDs) || i < len(remoteDiffIDs); i++ {
+		var l, r string
+		if i < len(localDiffIDs) {
+			l = localDiffIDs[i].String()
+		}
+		if i < len(remoteDiffIDs) {
+			r = remoteDiffIDs[i].String()
+		}
+		if l != r {
+			result.Mismatches = append(result.Mismatches, VerifyMismatch{
+				Kind:   "diff-id",
+				Index:  i,
+				Local:  l,
+				Remote: r,
+			})
+		}
+	}
+	return result, nil
+}
+
+// configFieldMismatches returns the fields of the configurations
+// which differ. The fields of the config object (such as Env) are
+// compared one by one, the rootfs field is compared through the diff
+// IDs.
+func configFieldMismatches(localConfig, remoteConfig []byte) ([]VerifyMismatch, error) {
+	var local, remote map[string]json.RawMessage
+	if err := json.Unmarshal(localConfig, &local); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(remoteConfig, &remote); err != nil {
+		return nil, fmt.Errorf("Could not parse the remote configuration: %w", err)
+	}
+	mismatches := []VerifyMismatch{}
+	for _, field := range unionKeys(local, remote) {
+		switch field {
+		case "rootfs":
+			continue
+		case "config":
+			var localFields, remoteFields map[string]json.RawMessage
+			if err := unmarshalOptional(local[field], &localFields); err != nil {
+				return nil, err
+			}
+			if err := unmarshalOptional(remote[field], &remoteFields); err != nil {
+				return nil, err
+			}
+			for _, name := range unionKeys(localFields, remoteFields) {
+				if !jsonEqual(localFields[name], remoteFields[name]) {
+					mismatches = append(mismatches, VerifyMismatch{Kind: "config", Field: field + "." + name, Local: string(localFields[name]), Remote: string(remoteFields[name])})
+				}
+			}
+		default:
+			if !jsonEqual(local[field], remote[field]) {
+				mismatches = append(mismatches, VerifyMismatch{Kind: "config", Field: field, Local: string(local[field]), Remote: string(remote[field])})
+			}
+		}
+	}
+	return mismatches, nil
+}
+
+func unionKeys(a, b map[string]json.RawMessage) []string {
+	var keys []string
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func unmarshalOptional(data json.RawMessage, v interface{}) error {
+	if len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+// jsonEqual compares JSON values regardless of their formatting.
+func jsonEqual(a, b json.RawMessage) bool {
+	if bytes.Equal(a, b) {
+		return true
+	}
+	var va, vb interface{}
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return false
+	}
+	ca, _ := json.Marshal(va)
+	cb, _ := json.Marshal(vb)
+	return bytes.Equal(ca, cb)
+}
@@ -0,0 +1,67 @@
+package nix
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestVerifyImage(t *testing.T) {
+	layers, err := NewLayers(context.Background(), []string{"../data/layer1"}, nil, nil, "", nil, types.PathOptions{}, CompressionNone)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	image := types.Image{Layers: layers, ImageConfig: v1.ImageConfig{Env: []string{"A=1"}}}
+	content, err := GetManifestBlob(image)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var manifest v1.Manifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		t.Fatalf("%v", err)
+	}
+	config, err := GetConfigBlob(image)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	result, err := verifyImage(image, manifest, config)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !result.Verified() || result.LocalConfigDigest != result.ConfigDigest {
+		t.Fatalf("The image should be verified (while it is %#v)", result)
+	}
+
+	// The published image has another layer and environment
+	published := types.Image{Layers: layers, ImageConfig: v1.ImageConfig{Env: []string{"A=2"}}}
+	published.Layers = []types.Layer{layers[0]}
+	published.Layers[0].Digest = godigest.FromString("other").String()
+	published.Layers[0].DiffIDs = godigest.FromString("other-diff-id").String()
+	remoteConfig, err := GetConfigBlob(published)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	manifest.Config.Digest = godigest.FromBytes(remoteConfig)
+	manifest.Layers[0].Digest = godigest.Digest(published.Layers[0].Digest)
+	result, err = verifyImage(image, manifest, remoteConfig)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := []VerifyMismatch{
+		{Kind: "config", Field: "config.Env", Local: `["A=1"]`, Remote: `["A=2"]`},
+		{Kind: "layer", Local: layers[0].Digest, Remote: published.Layers[0].Digest},
+		{Kind: "diff-id", Local: layers[0].DiffIDs, Remote: published.Layers[0].DiffIDs},
+	}
+	if result.Verified() || len(result.Mismatches) != len(expected) {
+		t.Fatalf("Mismatches should be '%#v' (while it is %#v)", expected, result.Mismatches)
+	}
+	for i := range expected {
+		if result.Mismatches[i] != expected[i] {
+			t.Fatalf("Mismatches should be '%#v' (while it is %#v)", expected, result.Mismatches)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package nix
+
+import (
+	"io"
+
+	godigest "github.com/opencontainers/go-digest"
+)
+
+// verifyingReadCloser checks the content of a blob read from a file,
+// such as a cached layer, matches its expected digest and size while
+// it is read. Once the whole blob has been read, a corrupted or
+// truncated blob is reported with an error naming the file, instead
+// of io.EOF, so that the copy is aborted before the registry rejects
+// the blob.
+type verifyingReadCloser struct {
+	rc       io.ReadCloser
+	filename string
+	digest   godigest.Digest
+	// The expected size, or -1 if unknown
+	size     int64
+	digester godigest.Digester
+	n        int64
+}
+
+// verifyBlob returns a ReadCloser verifying the blob read from rc,
+// which comes from filename. The size is not checked if it is -1.
+func verifyBlob(rc io.ReadCloser, filename string, digest godigest.Digest, size int64) io.ReadCloser {
+	if digest.Validate() != nil {
+		return rc
+	}
+	return &verifyingReadCloser{
+		rc:       rc,
+		filename: filename,
+		digest:   digest,
+		size:     size,
+		digester: digest.Algorithm().Digester(),
+	}
+}
+
+func (v *verifyingReadCloser) Read(p []byte) (int, error) {
+	n, err := v.rc.Read(p)
+	v.digester.Hash().Write(p[:n])
+	v.n += int64(n)
+	if v.size >= 0 && v.n > v.size {
+		return n, classErrorf(ErrDigestMismatch, "The blob %s read from %s is corrupted: it is bigger than its expected size %d", v.digest, v.filename, v.size)
+	}
+	if err == io.EOF {
+		if v.size >= 0 && v.n < v.size {
+			return n, classErrorf(ErrDigestMismatch, "The blob %s read from %s is truncated: %d bytes have been read while its size is %d", v.digest, v.filename, v.n, v.size)
+		}
+		if d := v.digester.Digest(); d != v.digest {
+			return n, classErrorf(ErrDigestMismatch, "The blob %s read from %s is corrupted: its digest is %s", v.digest, v.filename, d)
+		}
+	}
+	return n, err
+}
+
+func (v *verifyingReadCloser) Close() error {
+	return v.rc.Close()
+}
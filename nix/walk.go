@@ -0,0 +1,184 @@
+package nix
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// WalkConcurrencyEnv is the environment variable setting the number of
+// concurrent stat calls of file tree walks, see SetWalkConcurrency. It
+// is applied by ConfigureFromEnv.
+const WalkConcurrencyEnv = "NIX2CONTAINER_WALK_CONCURRENCY"
+
+const (
+	defaultWalkConcurrency = 16
+	// The number of files walked ahead of the walk function
+	walkBufferSize = 4096
+)
+
+// walkConcurrency is the number of concurrent stat calls of a
+// directory walk.
+var walkConcurrency int32 = defaultWalkConcurrency
+
+// WalkConcurrencyFromEnv returns the walk concurrency set by the
+// environment variable, or the default one.
+func WalkConcurrencyFromEnv() (int, error) {
+	s := os.Getenv(WalkConcurrencyEnv)
+	if s == "" {
+		return defaultWalkConcurrency, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s: %w", WalkConcurrencyEnv, err)
+	}
+	return n, nil
+}
+
+// SetWalkConcurrency sets the number of files of a directory whose
+// attributes are read at the same time when walking file trees. On
+// network filesystems or slow disks, stat calls are then overlapped.
+// A value lower than 1 makes walks sequential.
+func SetWalkConcurrency(n int) {
+	if n < 1 {
+		n = 1
+	}
+	atomic.StoreInt32(&walkConcurrency, int32(n))
+}
+
+type walkItem struct {
+	path string
+	info os.FileInfo
+	err  error
+}
+
+// walkContext walks the file tree rooted at root as filepath.Walk,
+// calling fn for each file in lexical order. The tree is read ahead by
+// a goroutine: while fn handles a file, the next directories are read
+// and the attributes of their files are read concurrently (see
+// SetWalkConcurrency). Only one directory is opened at a time. The
+// walk stops with the context error when the context is cancelled.
+func walkContext(ctx context.Context, root string, fn filepath.WalkFunc) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	items := make(chan walkItem, walkBufferSize)
+	go func() {
+		defer close(items)
+		info, err := os.Lstat(root)
+		walkTree(ctx, root, info, err, items)
+	}()
+
+	// Since the tree is read ahead, the files of skipped
+	// directories are ignored when they are received
+	skipped := ""
+	for item := range items {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if skipped != "" && strings.HasPrefix(item.path, skipped) {
+			continue
+		}
+		err := fn(item.path, item.info, item.err)
+		if err == filepath.SkipDir {
+			if item.info != nil && item.info.IsDir() {
+				skipped = item.path + string(filepath.Separator)
+			} else {
+				skipped = filepath.Dir(item.path) + string(filepath.Separator)
+			}
+			if item.path == root {
+				return nil
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// walkTree sends the file path and the files of its tree to items. It
+// returns false if the context has been cancelled.
+func walkTree(ctx context.Context, path string, info os.FileInfo, err error, items chan<- walkItem) bool {
+	if !sendWalkItem(ctx, items, walkItem{path: path, info: info, err: err}) {
+		return false
+	}
+	if err != nil || !info.IsDir() {
+		return true
+	}
+	names, err := readDirNames(path)
+	if err != nil {
+		return sendWalkItem(ctx, items, walkItem{path: path, info: info, err: err})
+	}
+	infos, errs := lstatAll(ctx, path, names)
+	if ctx.Err() != nil {
+		return false
+	}
+	for i, name := range names {
+		if !walkTree(ctx, filepath.Join(path, name), infos[i], errs[i], items) {
+			return false
+		}
+	}
+	return true
+}
+
+func sendWalkItem(ctx context.Context, items chan<- walkItem, item walkItem) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	select {
+	case items <- item:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// readDirNames returns the sorted names of the files of the directory.
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// lstatAll reads the attributes of the files of the directory dir,
+// with at most walkConcurrency concurrent calls.
+func lstatAll(ctx context.Context, dir string, names []string) ([]os.FileInfo, []error) {
+	infos := make([]os.FileInfo, len(names))
+	errs := make([]error, len(names))
+	workers := int(atomic.LoadInt32(&walkConcurrency))
+	if workers > len(names) {
+		workers = len(names)
+	}
+	next := int64(-1)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				i := atomic.AddInt64(&next, 1)
+				if i >= int64(len(names)) {
+					return
+				}
+				infos[i], errs[i] = os.Lstat(filepath.Join(dir, names[i]))
+			}
+		}()
+	}
+	wg.Wait()
+	return infos, errs
+}
@@ -0,0 +1,64 @@
+package nix
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func walkedFiles(t *testing.T, walk func(root string, fn filepath.WalkFunc) error, root string, skip string) []string {
+	var files []string
+	err := walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		files = append(files, p)
+		if p == skip {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestWalkContext(t *testing.T) {
+	walk := func(root string, fn filepath.WalkFunc) error {
+		return walkContext(context.Background(), root, fn)
+	}
+	for _, concurrency := range []int{1, 4} {
+		SetWalkConcurrency(concurrency)
+		expected := walkedFiles(t, filepath.Walk, "../data", "")
+		files := walkedFiles(t, walk, "../data", "")
+		if !reflect.DeepEqual(files, expected) {
+			t.Fatalf("Files should be '%#v' (while it is %#v)", expected, files)
+		}
+		expected = walkedFiles(t, filepath.Walk, "../data", "../data/layer1")
+		files = walkedFiles(t, walk, "../data", "../data/layer1")
+		if !reflect.DeepEqual(files, expected) {
+			t.Fatalf("Files should be '%#v' (while it is %#v)", expected, files)
+		}
+	}
+	SetWalkConcurrency(defaultWalkConcurrency)
+}
+
+func TestWalkContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	n := 0
+	err := walkContext(ctx, "../data", func(p string, info os.FileInfo, err error) error {
+		n++
+		cancel()
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Err should be '%#v' (while it is %#v)", context.Canceled, err)
+	}
+	if n != 1 {
+		t.Fatalf("The walk should stop after the first file (while %d files have been walked)", n)
+	}
+}
@@ -0,0 +1,62 @@
+package nix
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// fileVersion identifies the content of a file which can be a
+// symlink, such as the result symlink of nix build: a new build
+// changes the target of the symlink while an edited file has a new
+// modification time or size.
+type fileVersion struct {
+	target  string
+	modTime time.Time
+	size    int64
+}
+
+func getFileVersion(filename string) (v fileVersion, err error) {
+	v.target, err = filepath.EvalSymlinks(filename)
+	if err != nil {
+		return v, err
+	}
+	info, err := os.Stat(v.target)
+	if err != nil {
+		return v, err
+	}
+	v.modTime = info.ModTime()
+	v.size = info.Size()
+	return v, nil
+}
+
+// WatchFile calls fn when the file filename is available and then
+// each time it changes, until the context is cancelled. The file is
+// polled every interval. Errors returned by fn are logged: fn is
+// called again on the next change.
+func WatchFile(ctx context.Context, filename string, interval time.Duration, fn func(target string) error) error {
+	var current fileVersion
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		v, err := getFileVersion(filename)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil && v != current {
+			current = v
+			logrus.Infof("The file %s has changed (%s)", filename, v.target)
+			if err := fn(v.target); err != nil {
+				logrus.Errorf("%v", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package nix
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchFile(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.json")
+	second := filepath.Join(dir, "second.json")
+	for _, f := range []string{first, second} {
+		if err := ioutil.WriteFile(f, []byte("{}"), 0644); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	result := filepath.Join(dir, "result")
+	if err := os.Symlink(first, result); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	targets := make(chan string)
+	done := make(chan error)
+	go func() {
+		done <- WatchFile(ctx, result, 10*time.Millisecond, func(target string) error {
+			targets <- target
+			return nil
+		})
+	}()
+	wait := func(expected string) {
+		select {
+		case target := <-targets:
+			if target != expected {
+				t.Fatalf("The target should be '%#v' (while it is %#v)", expected, target)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("The change of %s has not been detected", expected)
+		}
+	}
+	wait(first)
+
+	// A new build updates the result symlink
+	if err := os.Remove(result); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := os.Symlink(second, result); err != nil {
+		t.Fatalf("%v", err)
+	}
+	wait(second)
+
+	// The target file is edited
+	if err := ioutil.WriteFile(second, []byte(`{"layers": []}`), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	wait(second)
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("%v", err)
+	}
+}
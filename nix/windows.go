@@ -0,0 +1,104 @@
+package nix
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/nlewo/nix2container/types"
+)
+
+// windowsConfigFields are the fields of the configuration of Windows
+// images which are not supported by v1.ImageConfig. They are
+// preserved from Windows base images.
+var windowsConfigFields = []string{"ArgsEscaped", "Shell"}
+
+// readWindowsFields sets the platform, the os.version, os.features
+// and the extra configuration fields of a Windows base image
+// configuration. They are ignored for other images, so that the
+// configurations of Linux images built on top of Docker images don't
+// change.
+func readWindowsFields(image *types.Image, content []byte) error {
+	var config struct {
+		OS           string                     `json:"os"`
+		Architecture string                     `json:"architecture"`
+		OSVersion    string                     `json:"os.version"`
+		OSFeatures   []string                   `json:"os.features"`
+		Config       map[string]json.RawMessage `json:"config"`
+	}
+	if err := json.Unmarshal(content, &config); err != nil {
+		return err
+	}
+	if config.OS != "windows" {
+		return nil
+	}
+	image.OS = config.OS
+	image.Architecture = config.Architecture
+	image.OSVersion = config.OSVersion
+	image.OSFeatures = config.OSFeatures
+	image.ExtraConfig = extraConfig(config.Config)
+	return nil
+}
+
+// extraConfig returns the fields of config which are not supported
+// by v1.ImageConfig, or nil if there are none.
+func extraConfig(config map[string]json.RawMessage) (extra map[string]json.RawMessage) {
+	for _, field := range windowsConfigFields {
+		value, ok := config[field]
+		if !ok {
+			continue
+		}
+		if extra == nil {
+			extra = make(map[string]json.RawMessage)
+		}
+		extra[field] = value
+	}
+	return extra
+}
+
+// ExtraConfigFromJSON returns the fields of the image configuration
+// content not supported by v1.ImageConfig, such as ArgsEscaped.
+func ExtraConfigFromJSON(content []byte) (map[string]json.RawMessage, error) {
+	var config map[string]json.RawMessage
+	if err := json.Unmarshal(content, &config); err != nil {
+		return nil, err
+	}
+	return extraConfig(config), nil
+}
+
+// addConfigFields adds the fields of the image which are not part of
+// v1.Image to the configuration blob. The configuration is not
+// modified if the image doesn't have such fields, keeping its
+// digest.
+func addConfigFields(configBlob []byte, image types.Image) ([]byte, error) {
+	if image.OSVersion == "" && len(image.OSFeatures) == 0 && len(image.ExtraConfig) == 0 {
+		return configBlob, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(configBlob, &fields); err != nil {
+		return nil, err
+	}
+	if image.OSVersion != "" {
+		fields["os.version"], _ = json.Marshal(image.OSVersion)
+	}
+	if len(image.OSFeatures) > 0 {
+		fields["os.features"], _ = json.Marshal(image.OSFeatures)
+	}
+	if len(image.ExtraConfig) > 0 {
+		config := make(map[string]json.RawMessage)
+		if err := unmarshalOptional(fields["config"], &config); err != nil {
+			return nil, err
+		}
+		for name, value := range image.ExtraConfig {
+			if _, ok := config[name]; ok {
+				return nil, fmt.Errorf("The extra configuration field %s is already set by the image configuration", name)
+			}
+			config[name] = value
+		}
+		var err error
+		fields["config"], err = json.Marshal(config)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(fields)
+}
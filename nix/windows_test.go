@@ -0,0 +1,62 @@
+package nix
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/nlewo/nix2container/types"
+)
+
+func TestWindowsFields(t *testing.T) {
+	config := []byte(`{"architecture":"amd64","os":"windows","os.version":"10.0.17763.1234","os.features":["win32k"],"config":{"Cmd":["cmd.exe"],"ArgsEscaped":true,"Hostname":""},"rootfs":{"type":"layers","diff_ids":[]}}`)
+	var image types.Image
+	if err := readWindowsFields(&image, config); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if image.OS != "windows" || image.OSVersion != "10.0.17763.1234" || !reflect.DeepEqual(image.OSFeatures, []string{"win32k"}) {
+		t.Fatalf("The platform should be the one of the Windows image (while it is %#v)", image)
+	}
+	if len(image.ExtraConfig) != 1 || string(image.ExtraConfig["ArgsEscaped"]) != "true" {
+		t.Fatalf("Only ArgsEscaped should be preserved (while it is %#v)", image.ExtraConfig)
+	}
+
+	image.ImageConfig.Cmd = []string{"cmd.exe"}
+	blob, err := GetConfigBlob(image)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var generated struct {
+		OSVersion  string   `json:"os.version"`
+		OSFeatures []string `json:"os.features"`
+		Config     struct {
+			Cmd         []string
+			ArgsEscaped bool
+		} `json:"config"`
+	}
+	if err := json.Unmarshal(blob, &generated); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if generated.OSVersion != "10.0.17763.1234" || len(generated.OSFeatures) != 1 || !generated.Config.ArgsEscaped || len(generated.Config.Cmd) != 1 {
+		t.Fatalf("The configuration should contain the Windows fields (while it is %s)", blob)
+	}
+
+	// Linux images are not modified
+	var linux types.Image
+	if err := readWindowsFields(&linux, []byte(`{"os":"linux","config":{"ArgsEscaped":true}}`)); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !reflect.DeepEqual(linux, types.Image{}) {
+		t.Fatalf("The fields of Linux images should be ignored (while it is %#v)", linux)
+	}
+	linux.ImageConfig.Cmd = []string{"sh"}
+	blob, err = GetConfigBlob(linux)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	imageV1, _ := getV1Image(linux)
+	expected, _ := json.Marshal(imageV1)
+	if string(blob) != string(expected) {
+		t.Fatalf("The configuration should be '%s' (while it is %s)", expected, blob)
+	}
+}
@@ -0,0 +1,81 @@
+package nix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/nlewo/nix2container/types"
+)
+
+const defaultEntrypointWrapperPath = "/entrypoint"
+
+// envNameRegexp matches the names of the variables which can be
+// exported by the wrapper script: other names would be interpreted by
+// the shell.
+var envNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// NewEntrypointWrapperLayer generates a layer containing a script
+// wrapping the entrypoint, as described by wrapper. It returns this
+// layer and the entrypoint to use in the image configuration.
+func NewEntrypointWrapperLayer(ctx context.Context, wrapper types.EntrypointWrapper, entrypoint []string) (layer types.Layer, newEntrypoint []string, err error) {
+	if wrapper.Shell == "" {
+		return layer, nil, errors.New("The shell of the entrypoint wrapper has to be set")
+	}
+	for name := range wrapper.Env {
+		if !envNameRegexp.MatchString(name) {
+			return layer, nil, fmt.Errorf("Invalid variable name %q of the entrypoint wrapper: it must match %s", name, envNameRegexp)
+		}
+	}
+	path := wrapper.Path
+	if path == "" {
+		path = defaultEntrypointWrapperPath
+	}
+	layer, err = NewLayerFromFiles(ctx, []types.File{
+		types.File{
+			Path:    path,
+			Content: entrypointWrapperScript(wrapper),
+			Mode:    "0755",
+		},
+	})
+	if err != nil {
+		return layer, nil, err
+	}
+	newEntrypoint = append([]string{path}, entrypoint...)
+	return layer, newEntrypoint, nil
+}
+
+func entrypointWrapperScript(wrapper types.EntrypointWrapper) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "#!%s\n", wrapper.Shell)
+	// Variables are sorted to get a reproducible script
+	var names []string
+	for name := range wrapper.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&b, "export %s=\"${%s-%s}\"\n", name, name, shellEscapeDoubleQuoted(wrapper.Env[name]))
+	}
+	b.WriteString("exec")
+	if wrapper.Init != "" {
+		fmt.Fprintf(&b, " %s --", shellQuote(wrapper.Init))
+	}
+	for _, arg := range wrapper.Exec {
+		fmt.Fprintf(&b, " %s", shellQuote(arg))
+	}
+	b.WriteString(" \"$@\"\n")
+	return b.String()
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func shellEscapeDoubleQuoted(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`")
+	return r.Replace(s)
+}
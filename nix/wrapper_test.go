@@ -0,0 +1,60 @@
+package nix
+
+import (
+	"context"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/nlewo/nix2container/types"
+)
+
+func TestEntrypointWrapper(t *testing.T) {
+	wrapper := types.EntrypointWrapper{
+		Shell: "/bin/sh",
+		Init:  "/bin/tini",
+		Env: map[string]string{
+			"PORT": "8080",
+			"HOME": "/var/empty",
+		},
+		Exec: []string{"chpst", "-u", "nobody"},
+	}
+	layer, entrypoint, err := NewEntrypointWrapperLayer(context.Background(), wrapper, []string{"/bin/app"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expectedEntrypoint := []string{"/entrypoint", "/bin/app"}
+	if !reflect.DeepEqual(entrypoint, expectedEntrypoint) {
+		t.Fatalf("Entrypoint should be %#v (while it is %#v)", expectedEntrypoint, entrypoint)
+	}
+	expectedScript := `#!/bin/sh
+export HOME="${HOME-/var/empty}"
+export PORT="${PORT-8080}"
+exec '/bin/tini' -- 'chpst' '-u' 'nobody' "$@"
+`
+	if layer.Files[0].Content != expectedScript {
+		t.Fatalf("Script should be '%s' (while it is '%s')", expectedScript, layer.Files[0].Content)
+	}
+
+	reader, size, err := LayerGetBlob(layer)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer reader.Close()
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if int64(len(content)) != size {
+		t.Fatalf("Blob size should be %d (while it is %d)", size, len(content))
+	}
+}
+
+func TestEntrypointWrapperEnvNames(t *testing.T) {
+	for _, name := range []string{"", "1PORT", "A-B", "A}\"; id; #", "PATH=x"} {
+		wrapper := types.EntrypointWrapper{Shell: "/bin/sh", Env: map[string]string{name: "value"}}
+		if _, _, err := NewEntrypointWrapperLayer(context.Background(), wrapper, []string{"/bin/app"}); err == nil {
+			t.Fatalf("The variable name %q should be rejected", name)
+		}
+	}
+}
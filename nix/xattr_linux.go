@@ -0,0 +1,24 @@
+package nix
+
+import (
+	"os"
+	"syscall"
+)
+
+// getXattr returns the value of the extended attribute name of the
+// file path, or nil if the file doesn't have this attribute.
+func getXattr(path, name string) ([]byte, error) {
+	size, err := syscall.Getxattr(path, name, nil)
+	if err == syscall.ENODATA || err == syscall.ENOTSUP {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "getxattr", Path: path, Err: err}
+	}
+	value := make([]byte, size)
+	size, err = syscall.Getxattr(path, name, value)
+	if err != nil {
+		return nil, &os.PathError{Op: "getxattr", Path: path, Err: err}
+	}
+	return value[:size], nil
+}
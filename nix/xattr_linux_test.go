@@ -0,0 +1,82 @@
+package nix
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/nlewo/nix2container/types"
+)
+
+// testACL returns an access ACL granting read access to the user 1000.
+func testACL() []byte {
+	entries := []struct {
+		tag, perm uint16
+		id        uint32
+	}{
+		{0x01, 6, 0xffffffff}, // user owner
+		{0x02, 4, 1000},       // user 1000
+		{0x04, 4, 0xffffffff}, // group owner
+		{0x10, 4, 0xffffffff}, // mask
+		{0x20, 4, 0xffffffff}, // other
+	}
+	acl := make([]byte, 4, 4+8*len(entries))
+	binary.LittleEndian.PutUint32(acl, 2)
+	for _, e := range entries {
+		entry := make([]byte, 8)
+		binary.LittleEndian.PutUint16(entry, e.tag)
+		binary.LittleEndian.PutUint16(entry[2:], e.perm)
+		binary.LittleEndian.PutUint32(entry[4:], e.id)
+		acl = append(acl, entry...)
+	}
+	return acl
+}
+
+func tarACLsPolicy(file, policy string) (*tar.Header, error) {
+	paths := types.Paths{{Path: file, Options: &types.PathOptions{ACLs: policy}}}
+	reader := TarPaths(paths)
+	defer reader.Close()
+	tr := tar.NewReader(reader)
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(ioutil.Discard, tr)
+	return hdr, err
+}
+
+func TestACLsPolicy(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(file, []byte("content"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := syscall.Setxattr(file, "system.posix_acl_access", testACL(), 0); err != nil {
+		t.Skipf("ACLs are not supported: %v", err)
+	}
+
+	hdr, err := tarACLsPolicy(file, types.ACLsPreserve)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if hdr.PAXRecords["SCHILY.xattr.system.posix_acl_access"] != string(testACL()) {
+		t.Fatalf("The ACL should be preserved (while the PAX records are %#v)", hdr.PAXRecords)
+	}
+
+	hdr, err = tarACLsPolicy(file, types.ACLsStrip)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(hdr.PAXRecords) != 0 {
+		t.Fatalf("The ACL should be stripped (while the PAX records are %#v)", hdr.PAXRecords)
+	}
+
+	_, err = tarACLsPolicy(file, types.ACLsError)
+	if !errors.Is(err, ErrConflict) {
+		t.Fatalf("The file with ACLs should be rejected (while the error is %v)", err)
+	}
+}
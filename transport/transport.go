@@ -0,0 +1,396 @@
+// Package transport implements the containers/image "nix:" transport
+// which reads images from nix2container image JSON files. Index JSON
+// files, describing multi-platform images, are also supported.
+//
+// Importing this package registers the transport, so that references
+// such as "nix:/nix/store/...-image.json" can be parsed with
+// alltransports.ParseImageName and used with copy.Image, like with
+// the Skopeo nix transport.
+//
+// If the NIX2CONTAINER_BLOB_CACHE environment variable is set, layers
+// built from store paths are generated once in this blob store, such
+// as a directory, and then served from it (see nix.BlobCache).
+//
+// While an image source is open, GC roots of the store paths of the
+// image are registered in the directory NIX2CONTAINER_GC_ROOTS_DIR
+// (the Nix per-user GC roots directory by default).
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/image"
+	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/transports"
+	"github.com/containers/image/v5/types"
+	"github.com/nlewo/nix2container/nix"
+	nixtypes "github.com/nlewo/nix2container/types"
+	digest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	transports.Register(Transport)
+}
+
+// Transport is an ImageTransport for nix2container image JSON files.
+var Transport = nixTransport{}
+
+type nixTransport struct{}
+
+func (t nixTransport) Name() string {
+	return "nix"
+}
+
+// ParseReference converts a string, which should not start with the
+// ImageTransport.Name prefix, into an ImageReference.
+func (t nixTransport) ParseReference(reference string) (types.ImageReference, error) {
+	return NewReference(reference)
+}
+
+// ValidatePolicyConfigurationScope checks that scope is a valid name
+// for a signature.PolicyTransportScopes key. As for the dir
+// transport, scopes are absolute paths.
+func (t nixTransport) ValidatePolicyConfigurationScope(scope string) error {
+	if !filepath.IsAbs(scope) {
+		return fmt.Errorf("Invalid scope %s: must be an absolute path", scope)
+	}
+	if scope == "/" {
+		return errors.New(`Invalid scope "/": Use the generic default scope ""`)
+	}
+	if cleaned := filepath.Clean(scope); cleaned != scope {
+		return fmt.Errorf(`Invalid scope %s: Uses non-canonical format, perhaps try %s`, scope, cleaned)
+	}
+	return nil
+}
+
+type nixReference struct {
+	path string
+	// The blob cache of the image sources, instead of the one of
+	// the environment
+	cache *nix.BlobCache
+}
+
+// NewReference returns a reference to the image described by the
+// image JSON file path.
+func NewReference(path string) (types.ImageReference, error) {
+	if path == "" {
+		return nil, errors.New("The image JSON file path can not be empty")
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	return nixReference{path: absPath}, nil
+}
+
+// NewReferenceWithBlobCache returns a reference to the image
+// described by the image JSON file path, whose layers are generated in
+// and served from the blob cache instead of the one configured by the
+// environment. It allows several blob caches in the same process.
+func NewReferenceWithBlobCache(path string, cache *nix.BlobCache) (types.ImageReference, error) {
+	ref, err := NewReference(path)
+	if err != nil {
+		return nil, err
+	}
+	r := ref.(nixReference)
+	r.cache = cache
+	return r, nil
+}
+
+func (ref nixReference) Transport() types.ImageTransport {
+	return Transport
+}
+
+func (ref nixReference) StringWithinTransport() string {
+	return ref.path
+}
+
+// DockerReference returns nil since image JSON files are not
+// associated to an image name.
+func (ref nixReference) DockerReference() reference.Named {
+	return nil
+}
+
+func (ref nixReference) PolicyConfigurationIdentity() string {
+	return ref.path
+}
+
+// PolicyConfigurationNamespaces returns the parent directories of the
+// image JSON file, from the most specific to the least specific one.
+func (ref nixReference) PolicyConfigurationNamespaces() []string {
+	res := []string{}
+	path := ref.path
+	for {
+		lastSlash := strings.LastIndex(path, "/")
+		if lastSlash <= 0 {
+			break
+		}
+		path = path[:lastSlash]
+		res = append(res, path)
+	}
+	return res
+}
+
+func (ref nixReference) NewImage(ctx context.Context, sys *types.SystemContext) (types.ImageCloser, error) {
+	src, err := ref.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return image.FromSource(ctx, sys, src)
+}
+
+func (ref nixReference) NewImageSource(ctx context.Context, sys *types.SystemContext) (types.ImageSource, error) {
+	return newImageSource(ref)
+}
+
+func (ref nixReference) NewImageDestination(ctx context.Context, sys *types.SystemContext) (types.ImageDestination, error) {
+	return nil, errors.New("The nix transport can not be used as a destination: images are built by Nix")
+}
+
+func (ref nixReference) DeleteImage(ctx context.Context, sys *types.SystemContext) error {
+	return errors.New("Deleting images from the Nix store is not supported by the nix transport")
+}
+
+// BlobCacheEnv is the environment variable containing the location of
+// the blob cache, such as a directory (see nix.NewBlobStore).
+const BlobCacheEnv = "NIX2CONTAINER_BLOB_CACHE"
+
+var (
+	blobCachesMu sync.Mutex
+	blobCaches   = make(map[string]*nix.BlobCache)
+)
+
+// blobCacheFromEnv returns the blob cache configured by the
+// environment, if any. Image sources using the same location share
+// the same cache, and thus the same locks.
+func blobCacheFromEnv() (*nix.BlobCache, error) {
+	location := os.Getenv(BlobCacheEnv)
+	if location == "" {
+		return nil, nil
+	}
+	blobCachesMu.Lock()
+	defer blobCachesMu.Unlock()
+	if cache, ok := blobCaches[location]; ok {
+		return cache, nil
+	}
+	cache, err := nix.NewBlobCache(location)
+	if err != nil {
+		return nil, err
+	}
+	blobCaches[location] = cache
+	return cache, nil
+}
+
+type nixImageSource struct {
+	ref   nixReference
+	image nixtypes.Image
+	// Set if the reference is an index JSON file
+	index *nixtypes.Index
+	cache *nix.BlobCache
+	// The GC roots of the store paths read by the image source
+	gcRoots *nix.GCRoots
+}
+
+func newImageSource(ref nixReference) (*nixImageSource, error) {
+	// The transport runs in tools such as Skopeo, which don't
+	// configure nix2container
+	if err := nix.ConfigureFromEnv(); err != nil {
+		return nil, err
+	}
+	cache := ref.cache
+	if cache == nil {
+		var err error
+		cache, err = blobCacheFromEnv()
+		if err != nil {
+			return nil, err
+		}
+	}
+	src := &nixImageSource{ref: ref, cache: cache}
+	isIndex, err := isIndexFile(ref.path)
+	if err != nil {
+		return nil, err
+	}
+	if isIndex {
+		index, err := nix.NewIndexFromFile(ref.path)
+		if err != nil {
+			return nil, err
+		}
+		src.index = &index
+		src.addGCRoots()
+		return src, nil
+	}
+	src.image, err = nix.NewImageFromFile(ref.path)
+	if err != nil {
+		return nil, err
+	}
+	src.addGCRoots()
+	return src, nil
+}
+
+// addGCRoots registers GC roots for the store paths of the image (or
+// of the images of the index) while the image source is open, so that
+// a concurrent garbage collection can not remove them while they are
+// archived. The copy is not prevented if the roots can not be
+// registered, for instance out of a Nix installation.
+func (s *nixImageSource) addGCRoots() {
+	images := []nixtypes.Image{s.image}
+	if s.index != nil {
+		images = nil
+		for _, m := range s.index.Manifests {
+			images = append(images, m.Image)
+		}
+	}
+	var storePaths []string
+	for _, image := range images {
+		storePaths = append(storePaths, nix.ImageStorePaths(image)...)
+	}
+	roots, err := nix.AddGCRoots(nix.DefaultGCRootsDir(), storePaths)
+	if err != nil {
+		logrus.Warnf("Could not register the GC roots of the image store paths: %v", err)
+		return
+	}
+	s.gcRoots = roots
+}
+
+// isIndexFile returns true if the JSON file describes an index
+// instead of an image.
+func isIndexFile(filename string) (bool, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return false, err
+	}
+	var probe struct {
+		Manifests json.RawMessage `json:"manifests"`
+	}
+	if err := json.Unmarshal(content, &probe); err != nil {
+		return false, err
+	}
+	return probe.Manifests != nil, nil
+}
+
+func (s *nixImageSource) Reference() types.ImageReference {
+	return s.ref
+}
+
+func (s *nixImageSource) Close() error {
+	if s.gcRoots != nil {
+		return s.gcRoots.Release()
+	}
+	return nil
+}
+
+// GetManifest returns the OCI manifest of the image, or the OCI
+// index if the reference is an index. In this case, instanceDigest
+// selects the manifest of an image of the index.
+func (s *nixImageSource) GetManifest(ctx context.Context, instanceDigest *digest.Digest) ([]byte, string, error) {
+	image := s.image
+	if s.index != nil {
+		if instanceDigest == nil {
+			index, err := nix.GetIndexBlob(*s.index)
+			if err != nil {
+				return nil, "", err
+			}
+			return index, v1.MediaTypeImageIndex, nil
+		}
+		var err error
+		image, err = nix.GetIndexImage(*s.index, *instanceDigest)
+		if err != nil {
+			return nil, "", err
+		}
+	} else if instanceDigest != nil {
+		return nil, "", errors.New("The image is not an index: instance digests are not supported")
+	}
+	manifest, err := nix.GetManifestBlob(image)
+	if err != nil {
+		return nil, "", err
+	}
+	return manifest, v1.MediaTypeImageManifest, nil
+}
+
+// HasThreadSafeGetBlob returns true since each blob is generated
+// independently from the others.
+func (s *nixImageSource) HasThreadSafeGetBlob() bool {
+	return true
+}
+
+// GetBlob returns a stream for the specified blob and its size (or -1
+// if unknown).
+func (s *nixImageSource) GetBlob(ctx context.Context, info types.BlobInfo, cache types.BlobInfoCache) (io.ReadCloser, int64, error) {
+	var rc io.ReadCloser
+	var size int64
+	var err error
+	image := s.image
+	if s.index != nil {
+		image, err = nix.GetBlobImage(*s.index, info.Digest)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	if s.cache != nil {
+		rc, size, err = s.cache.GetBlob(ctx, image, info.Digest)
+	} else {
+		rc, size, err = nix.GetBlobContext(ctx, image, info.Digest)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if size == 0 {
+		size = -1
+	}
+	return rc, size, nil
+}
+
+func (s *nixImageSource) GetSignatures(ctx context.Context, instanceDigest *digest.Digest) ([][]byte, error) {
+	return [][]byte{}, nil
+}
+
+// LayerInfosForCopy returns nil since the layers of the manifest can
+// be copied as is.
+func (s *nixImageSource) LayerInfosForCopy(ctx context.Context, instanceDigest *digest.Digest) ([]types.BlobInfo, error) {
+	return nil, nil
+}
+
+// UploadLayers uploads the layer blobs of the image (or of the images
+// of the index) of the nix reference ref to the destination dest
+// before the image is copied to it, so that the blobs are uploaded
+// with the tokens refreshed by nix2container (see nix.UploadLayers).
+// Only docker destinations are concerned. As copy.Image does, nothing
+// is written to the destination if the policy rejects the image.
+func UploadLayers(ctx context.Context, ref types.ImageReference, dest types.ImageReference, sys *types.SystemContext, policyContext *signature.PolicyContext) error {
+	if dest.Transport().Name() != "docker" {
+		return nil
+	}
+	nixRef, ok := ref.(nixReference)
+	if !ok {
+		return fmt.Errorf("The reference %s is not a reference of the nix transport", ref.StringWithinTransport())
+	}
+	src, err := newImageSource(nixRef)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if allowed, err := policyContext.IsRunningImageAllowed(ctx, image.UnparsedInstance(src, nil)); !allowed || err != nil {
+		return fmt.Errorf("Source image rejected: %w", err)
+	}
+	layers := src.image.Layers
+	if src.index != nil {
+		for _, m := range src.index.Manifests {
+			layers = append(layers, m.Image.Layers...)
+		}
+	}
+	return nix.UploadLayers(ctx, sys, dest, layers, func(ctx context.Context, d digest.Digest) (io.ReadCloser, int64, error) {
+		return src.GetBlob(ctx, types.BlobInfo{Digest: d}, nil)
+	})
+}
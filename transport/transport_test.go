@@ -0,0 +1,242 @@
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/types"
+	"github.com/nlewo/nix2container/nix"
+	nixtypes "github.com/nlewo/nix2container/types"
+	digest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// writeImage writes the JSON file of an image made of layers built
+// from directories.
+func writeImage(t *testing.T) string {
+	layers, err := nix.NewLayers(context.Background(), []string{"../data/layer1", "../data/tar-directory"}, []nixtypes.Layer{}, []nixtypes.RewritePath{}, "", []nixtypes.PermPath{}, nixtypes.PathOptions{}, nix.CompressionNone)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	image := nixtypes.Image{Version: nixtypes.ImageVersion, Layers: layers}
+	content, err := json.Marshal(image)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	filename := filepath.Join(t.TempDir(), "image.json")
+	if err := ioutil.WriteFile(filename, content, 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	return filename
+}
+
+// readImage reads the manifest of the image source and checks that
+// the config and layer blobs match their descriptors.
+func readImage(t *testing.T, ref types.ImageReference) v1.Manifest {
+	ctx := context.Background()
+	src, err := ref.NewImageSource(ctx, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer src.Close()
+	content, mediaType, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if mediaType != v1.MediaTypeImageManifest {
+		t.Fatalf("The manifest media type should be '%s' (while it is %s)", v1.MediaTypeImageManifest, mediaType)
+	}
+	var manifest v1.Manifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, desc := range append([]v1.Descriptor{manifest.Config}, manifest.Layers...) {
+		rc, size, err := src.GetBlob(ctx, types.BlobInfo{Digest: desc.Digest, Size: desc.Size}, nil)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		blob, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if d := digest.FromBytes(blob); d != desc.Digest || int64(len(blob)) != desc.Size {
+			t.Fatalf("The blob should be '%s' of %d bytes (while it is %s of %d bytes)", desc.Digest, desc.Size, d, len(blob))
+		}
+		if size != -1 && size != desc.Size {
+			t.Fatalf("The blob size should be '%d' (while it is %d)", desc.Size, size)
+		}
+	}
+	return manifest
+}
+
+func TestImageSource(t *testing.T) {
+	defer os.Setenv(nix.GCRootsDirEnv, os.Getenv(nix.GCRootsDirEnv))
+	os.Setenv(nix.GCRootsDirEnv, t.TempDir())
+	defer os.Setenv(BlobCacheEnv, os.Getenv(BlobCacheEnv))
+	os.Unsetenv(BlobCacheEnv)
+
+	filename := writeImage(t)
+	ref, err := Transport.ParseReference(filename)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if ref.StringWithinTransport() != filename {
+		t.Fatalf("The reference should be '%s' (while it is %s)", filename, ref.StringWithinTransport())
+	}
+	manifest := readImage(t, ref)
+	if len(manifest.Layers) != 1 {
+		t.Fatalf("The manifest should have '1' layer (while it has %d)", len(manifest.Layers))
+	}
+
+	// Blobs are generated in the blob cache and then served from it
+	cacheDir := t.TempDir()
+	cache, err := nix.NewBlobCache(cacheDir)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	cached, err := NewReferenceWithBlobCache(filename, cache)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if m := readImage(t, cached); m.Layers[0].Digest != manifest.Layers[0].Digest {
+			t.Fatalf("The layer served from the cache should be '%s' (while it is %s)", manifest.Layers[0].Digest, m.Layers[0].Digest)
+		}
+	}
+	if files, err := ioutil.ReadDir(cacheDir); err != nil || len(files) == 0 {
+		t.Fatalf("The layer should have been generated in the blob cache (%v)", err)
+	}
+}
+
+func TestIndexImageSource(t *testing.T) {
+	defer os.Setenv(nix.GCRootsDirEnv, os.Getenv(nix.GCRootsDirEnv))
+	os.Setenv(nix.GCRootsDirEnv, t.TempDir())
+	defer os.Setenv(BlobCacheEnv, os.Getenv(BlobCacheEnv))
+	os.Unsetenv(BlobCacheEnv)
+
+	filename := writeImage(t)
+	image, err := nix.NewImageFromFile(filename)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	index, err := nix.NewIndex([]nixtypes.IndexEntry{{
+		Platform: v1.Platform{OS: nix.ImageOS(image), Architecture: nix.ImageArchitecture(image)},
+		Image:    filename,
+	}})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	content, err := json.Marshal(index)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	indexFilename := filepath.Join(t.TempDir(), "index.json")
+	if err := ioutil.WriteFile(indexFilename, content, 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	ctx := context.Background()
+	ref, err := NewReference(indexFilename)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	src, err := ref.NewImageSource(ctx, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer src.Close()
+	content, mediaType, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	var ociIndex v1.Index
+	if err := json.Unmarshal(content, &ociIndex); err != nil || mediaType != v1.MediaTypeImageIndex {
+		t.Fatalf("The manifest should be an index (while it is %s: %v)", mediaType, err)
+	}
+	if len(ociIndex.Manifests) != 1 {
+		t.Fatalf("The index should have '1' manifest (while it has %d)", len(ociIndex.Manifests))
+	}
+	instance := ociIndex.Manifests[0].Digest
+	content, _, err = src.GetManifest(ctx, &instance)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if d := digest.FromBytes(content); d != instance {
+		t.Fatalf("The manifest digest should be '%s' (while it is %s)", instance, d)
+	}
+	var manifest v1.Manifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		t.Fatalf("%v", err)
+	}
+	layer := manifest.Layers[len(manifest.Layers)-1]
+	rc, _, err := src.GetBlob(ctx, types.BlobInfo{Digest: layer.Digest}, nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	blob, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil || digest.FromBytes(blob) != layer.Digest {
+		t.Fatalf("The layer of an image of the index should be '%s' (while it is %s: %v)", layer.Digest, digest.FromBytes(blob), err)
+	}
+}
+
+func TestImageDestination(t *testing.T) {
+	ref, err := NewReference("/nix/store/abc-image.json")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := ref.NewImageDestination(context.Background(), nil); err == nil {
+		t.Fatalf("The nix transport should not be usable as a destination")
+	}
+	if err := ref.DeleteImage(context.Background(), nil); err == nil {
+		t.Fatalf("Images should not be deleted by the nix transport")
+	}
+	if _, err := NewReference(""); err == nil {
+		t.Fatalf("An empty path should not be a valid reference")
+	}
+}
+
+func TestUploadLayersPolicy(t *testing.T) {
+	defer os.Setenv(nix.GCRootsDirEnv, os.Getenv(nix.GCRootsDirEnv))
+	os.Setenv(nix.GCRootsDirEnv, t.TempDir())
+	defer os.Setenv(BlobCacheEnv, os.Getenv(BlobCacheEnv))
+	os.Unsetenv(BlobCacheEnv)
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	ref, err := Transport.ParseReference(writeImage(t))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	dest, err := docker.ParseReference("//" + strings.TrimPrefix(server.URL, "http://") + "/app")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	policyContext, err := signature.NewPolicyContext(&signature.Policy{Default: []signature.PolicyRequirement{signature.NewPRReject()}})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer policyContext.Destroy()
+	sys := &types.SystemContext{DockerInsecureSkipTLSVerify: types.OptionalBoolTrue}
+	if err := UploadLayers(context.Background(), ref, dest, sys, policyContext); err == nil {
+		t.Fatalf("The layers of an image rejected by the policy should not be uploaded")
+	}
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Fatalf("The registry should not be contacted (while it has received %d requests)", n)
+	}
+}
@@ -0,0 +1,44 @@
+package types
+
+// BaseImageLock pins the base images of builds to the digests of their
+// manifest, config and layers. Base images are then read from a local
+// blob directory, so builds don't depend on the network and are not
+// affected by upstream tags being moved.
+type BaseImageLock struct {
+	Images []LockedBaseImage `json:"images"`
+}
+
+type LockedBaseImage struct {
+	// The name of the base image, such as
+	// docker.io/library/alpine:3.18
+	Name string `json:"name"`
+	// The digest of the manifest of the base image
+	Manifest string `json:"manifest"`
+	// The digest of the config of the base image
+	Config string `json:"config"`
+	// The digests of the layers of the base image
+	Layers []string `json:"layers"`
+}
+
+// Lookup returns the locked base image name, or false if the lock
+// doesn't contain it.
+func (l BaseImageLock) Lookup(name string) (LockedBaseImage, bool) {
+	for _, image := range l.Images {
+		if image.Name == name {
+			return image, true
+		}
+	}
+	return LockedBaseImage{}, false
+}
+
+// Set adds the locked base image to the lock, replacing the image with
+// the same name if any.
+func (l *BaseImageLock) Set(image LockedBaseImage) {
+	for i := range l.Images {
+		if l.Images[i].Name == image.Name {
+			l.Images[i] = image
+			return
+		}
+	}
+	l.Images = append(l.Images, image)
+}
@@ -0,0 +1,20 @@
+package types
+
+// ChunkIndex describes a layer blob split into content-defined
+// chunks. Concatenating the chunks in order produces the layer blob.
+//
+// This is an experimental format: it is not understood by container
+// runtimes and is only meant to store layers in registries used as
+// generic blob stores.
+type ChunkIndex struct {
+	MediaType string  `json:"mediaType"`
+	Digest    string  `json:"digest"`
+	Size      int64   `json:"size"`
+	Chunks    []Chunk `json:"chunks"`
+}
+
+type Chunk struct {
+	Digest string `json:"digest"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+}
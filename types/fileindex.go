@@ -0,0 +1,37 @@
+package types
+
+// FileIndex locates the files of a layer in its uncompressed archive,
+// so that a single file can be extracted without reading the whole
+// archive.
+type FileIndex struct {
+	// The digest of the layer blob
+	Digest  string           `json:"digest"`
+	Entries []FileIndexEntry `json:"entries"`
+}
+
+// Types of the file index entries.
+const (
+	FileIndexFile    = "file"
+	FileIndexDir     = "dir"
+	FileIndexSymlink = "symlink"
+	FileIndexLink    = "link"
+	// A sparse file: its content is not a contiguous range of
+	// the archive
+	FileIndexSparse = "sparse"
+	FileIndexOther  = "other"
+)
+
+type FileIndexEntry struct {
+	// The normalized name of the archive entry (without leading
+	// slash)
+	Name string `json:"name"`
+	// The offset of the content of the entry in the uncompressed
+	// archive
+	Offset int64 `json:"offset"`
+	Size   int64 `json:"size"`
+	// The target of symlinks and hard links
+	Link string `json:"link,omitempty"`
+	// The type of the entry: file, dir, symlink, link (hard link)
+	// or other
+	Type string `json:"type"`
+}
@@ -0,0 +1,32 @@
+package types
+
+import (
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// IndexEntry describes the image of a platform when building a
+// multi-platform index. Entries without image, or explicitly
+// skipped, are placeholders: the platform is declared but not
+// written to the index.
+type IndexEntry struct {
+	Platform v1.Platform `json:"platform"`
+	// The image JSON file of this platform
+	Image       string            `json:"image,omitempty"`
+	Skip        bool              `json:"skip,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Index is a multi-platform image. The images of all platforms are
+// embedded, so that an index JSON file contains everything needed to
+// generate the index, the manifests and the blobs.
+type Index struct {
+	Version     int               `json:"version"`
+	Manifests   []IndexManifest   `json:"manifests"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type IndexManifest struct {
+	Platform    v1.Platform       `json:"platform"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Image       Image             `json:"image"`
+}
@@ -0,0 +1,52 @@
+package types
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// MarshalCanonical returns the JSON encoding of v, in a canonical
+// form: object keys are sorted, HTML characters are not escaped, the
+// document is indented with tabs and ends with a newline. The same
+// value is then always encoded to the same bytes, whatever the order
+// of the struct fields, which allows to store JSON files in content
+// addressed stores.
+//
+// Note the JSON files written by nix2container don't contain
+// timestamps, unless creation dates are explicitly set: all dates of
+// the image are set to the epoch.
+func MarshalCanonical(v interface{}) ([]byte, error) {
+	content, err := marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	// Decoding into an interface{} converts objects to maps, which
+	// are encoded with sorted keys. Numbers are kept as they are to
+	// not lose the precision of big integers.
+	var generic interface{}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	if err := decoder.Decode(&generic); err != nil {
+		return nil, err
+	}
+	content, err = marshal(generic)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, content, "", "\t"); err != nil {
+		return nil, err
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+func marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
@@ -0,0 +1,35 @@
+package types
+
+import (
+	"testing"
+)
+
+func TestMarshalCanonical(t *testing.T) {
+	layer := Layer{
+		Version:     1,
+		Digest:      "sha256:digest",
+		Size:        9007199254740993,
+		DiffIDs:     "sha256:diffid",
+		MediaType:   "application/vnd.oci.image.layer.v1.tar",
+		Annotations: map[string]string{"b": "<&>", "a": "1"},
+	}
+	content, err := MarshalCanonical(layer)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := `{
+	"annotations": {
+		"a": "1",
+		"b": "<&>"
+	},
+	"diff_ids": "sha256:diffid",
+	"digest": "sha256:digest",
+	"mediatype": "application/vnd.oci.image.layer.v1.tar",
+	"size": 9007199254740993,
+	"version": 1
+}
+`
+	if string(content) != expected {
+		t.Fatalf("The layer should be encoded as '%s' (while it is %s)", expected, content)
+	}
+}
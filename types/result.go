@@ -0,0 +1,44 @@
+package types
+
+// Result describes the outcome of an image copy. It is written as a
+// JSON file by copy commands, allowing the Nix side and CI to consume
+// the copy outcome without parsing logs.
+type Result struct {
+	// The digest of the manifest written to the destinations
+	Digest string `json:"digest"`
+	// The sum of the config and layers sizes
+	Size         int64         `json:"size"`
+	Destinations []string      `json:"destinations"`
+	Config       ResultBlob    `json:"config"`
+	Layers       []ResultLayer `json:"layers"`
+	// The bytes of blobs read by the copy tool and the size of the
+	// blobs already present on the destination. They are not set
+	// when the copy tool doesn't report it.
+	UploadedSize int64 `json:"uploaded_size,omitempty"`
+	ReusedSize   int64 `json:"reused_size,omitempty"`
+}
+
+type ResultBlob struct {
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+}
+
+type ResultLayer struct {
+	Digest  string `json:"digest"`
+	DiffIDs string `json:"diff_ids"`
+	Size    int64  `json:"size"`
+	// Whether the layer was already present on the destination. This
+	// is not set when the copy tool doesn't report it.
+	Reused *bool `json:"reused,omitempty"`
+	// The bytes of the layer read by the copy tool
+	Uploaded int64 `json:"uploaded,omitempty"`
+}
+
+// RootfsResult describes a filesystem image written by the rootfs
+// command.
+type RootfsResult struct {
+	// The filesystem format, such as squashfs
+	Format string `json:"format"`
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+}
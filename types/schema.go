@@ -0,0 +1,212 @@
+package types
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	godigest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+//go:embed schema/*.json
+var schemas embed.FS
+
+// ImageSchema returns the JSON Schema of image JSON files.
+func ImageSchema() []byte {
+	content, _ := schemas.ReadFile("schema/image.json")
+	return content
+}
+
+// LayerSchema returns the JSON Schema of a layer, as found in
+// layers JSON files (which contain a list of layers) and image JSON
+// files.
+func LayerSchema() []byte {
+	content, _ := schemas.ReadFile("schema/layer.json")
+	return content
+}
+
+// imageConfigFields are the fields of v1.ImageConfig.
+var imageConfigFields = map[string]bool{
+	"User": true, "ExposedPorts": true, "Env": true, "Entrypoint": true, "Cmd": true,
+	"Volumes": true, "WorkingDir": true, "Labels": true, "StopSignal": true,
+}
+
+// ValidateImage strictly decodes an image JSON document and checks
+// its consistency. Unknown fields are reported as errors.
+func ValidateImage(content []byte) (image Image, err error) {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(&image); err != nil {
+		return image, err
+	}
+	if err = image.Migrate(); err != nil {
+		return image, err
+	}
+	if image.Subject != nil {
+		if err := image.Subject.Digest.Validate(); err != nil {
+			return image, fmt.Errorf("Invalid subject digest %q: %w", image.Subject.Digest, err)
+		}
+	}
+	if image.Created != "" {
+		if _, err := time.Parse(time.RFC3339, image.Created); err != nil {
+			return image, fmt.Errorf("Invalid created date %q: %w", image.Created, err)
+		}
+	}
+	for _, history := range image.History {
+		if history.Created == "" {
+			continue
+		}
+		if _, err := time.Parse(time.RFC3339, history.Created); err != nil {
+			return image, fmt.Errorf("Invalid created date %q of the history entry %q: %w", history.Created, history.CreatedBy, err)
+		}
+	}
+	for name := range image.ExtraConfig {
+		if imageConfigFields[name] {
+			return image, fmt.Errorf("The extra configuration field %s is an image-config field", name)
+		}
+	}
+	for i, layer := range image.Layers {
+		if err = layer.Validate(); err != nil {
+			return image, fmt.Errorf("Layer %d: %w", i, err)
+		}
+	}
+	return image, nil
+}
+
+// ValidateLayers strictly decodes a layers JSON document and checks
+// its consistency. Unknown fields are reported as errors.
+func ValidateLayers(content []byte) (layers []Layer, err error) {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(&layers); err != nil {
+		return layers, err
+	}
+	for i := range layers {
+		if err = layers[i].Migrate(); err != nil {
+			return layers, err
+		}
+		if err = layers[i].Validate(); err != nil {
+			return layers, fmt.Errorf("Layer %d: %w", i, err)
+		}
+	}
+	return layers, nil
+}
+
+// Validate checks the consistency of a layer.
+func (layer Layer) Validate() error {
+	if _, err := godigest.Parse(layer.Digest); err != nil {
+		return fmt.Errorf("Invalid digest %q: %w", layer.Digest, err)
+	}
+	if _, err := godigest.Parse(layer.DiffIDs); err != nil {
+		return fmt.Errorf("Invalid diff_ids %q: %w", layer.DiffIDs, err)
+	}
+	if layer.Size < 0 {
+		return fmt.Errorf("Invalid negative size %d", layer.Size)
+	}
+	if layer.Pinned {
+		if layer.Size == 0 {
+			return fmt.Errorf("The pinned layer %s has no size", layer.Digest)
+		}
+		if layer.Paths != nil || layer.Files != nil || layer.LayerPath != "" {
+			return fmt.Errorf("The pinned layer %s can not have paths, files or a layer-path", layer.Digest)
+		}
+	}
+	if layer.Created != "" {
+		if _, err := time.Parse(time.RFC3339, layer.Created); err != nil {
+			return fmt.Errorf("Invalid created date %q of the layer %s: %w", layer.Created, layer.Digest, err)
+		}
+	}
+	if layer.Budget != nil && layer.Budget.MaxSize <= 0 {
+		return fmt.Errorf("Invalid max-size %d of the budget %s of the layer %s", layer.Budget.MaxSize, layer.Budget.Name, layer.Digest)
+	}
+	for _, u := range layer.URLs {
+		if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+			return fmt.Errorf("The URL %q of the layer %s must be an HTTP URL", u, layer.Digest)
+		}
+	}
+	// Encrypted layers can not be generated from their paths: they
+	// are read from their layer-path.
+	mediaType := layer.MediaType
+	if strings.HasSuffix(mediaType, "+encrypted") {
+		mediaType = strings.TrimSuffix(mediaType, "+encrypted")
+		if layer.LayerPath == "" {
+			return fmt.Errorf("The encrypted layer %s has no layer-path", layer.Digest)
+		}
+	}
+	switch mediaType {
+	case v1.MediaTypeImageLayer, v1.MediaTypeImageLayerGzip, v1.MediaTypeImageLayerZstd:
+	default:
+		return fmt.Errorf("Unsupported mediatype %q", layer.MediaType)
+	}
+	// The diff_ids of the image configuration are the digests of the
+	// uncompressed archives: they have to match the digests of the
+	// manifest for uncompressed layers only
+	switch {
+	case mediaType != layer.MediaType:
+	case mediaType == v1.MediaTypeImageLayer && layer.DiffIDs != layer.Digest:
+		return fmt.Errorf("The diff_ids %s of the uncompressed layer %s must be its digest", layer.DiffIDs, layer.Digest)
+	case mediaType != v1.MediaTypeImageLayer && layer.DiffIDs == layer.Digest:
+		return fmt.Errorf("The diff_ids of the compressed layer %s must be the digest of its uncompressed archive", layer.Digest)
+	}
+	switch layer.Compression {
+	case "":
+	case "gzip":
+		if mediaType != v1.MediaTypeImageLayerGzip {
+			return fmt.Errorf("The mediatype of a %s layer must be %s", layer.Compression, v1.MediaTypeImageLayerGzip)
+		}
+	case "zstd", "zstd:chunked":
+		if mediaType != v1.MediaTypeImageLayerZstd {
+			return fmt.Errorf("The mediatype of a %s layer must be %s", layer.Compression, v1.MediaTypeImageLayerZstd)
+		}
+	default:
+		return fmt.Errorf("Unsupported compression %q", layer.Compression)
+	}
+	if len(layer.CompressionCommand) > 0 && layer.Compression != "gzip" && layer.Compression != "zstd" {
+		return fmt.Errorf("The compression %q of the layer %s can not be done by a command", layer.Compression, layer.Digest)
+	}
+	for _, file := range layer.Files {
+		if _, err := file.Bytes(); err != nil {
+			return fmt.Errorf("Invalid content of the file %s: %w", file.Path, err)
+		}
+		if file.Uid < 0 || file.Gid < 0 {
+			return fmt.Errorf("Invalid owner %d:%d of the file %s", file.Uid, file.Gid, file.Path)
+		}
+	}
+	for _, path := range layer.Paths {
+		if path.Path == "" {
+			return fmt.Errorf("A path of the layer %s is empty", layer.Digest)
+		}
+		if path.Options == nil {
+			continue
+		}
+		if path.Options.Rewrite.Regex != "" {
+			if _, err := regexp.Compile(path.Options.Rewrite.Regex); err != nil {
+				return fmt.Errorf("Invalid rewrite regex %q of the path %s: %w", path.Options.Rewrite.Regex, path.Path, err)
+			}
+		}
+		if path.Options.Umask != "" {
+			var umask int64
+			if _, err := fmt.Sscanf(path.Options.Umask, "%o", &umask); err != nil {
+				return fmt.Errorf("Invalid umask %q of the path %s: %w", path.Options.Umask, path.Path, err)
+			}
+		}
+		if err := path.Options.Validate(path.Path); err != nil {
+			return err
+		}
+		for _, perm := range path.Options.Perms {
+			if _, err := regexp.Compile(perm.Regex); err != nil {
+				return fmt.Errorf("Invalid perms regex %q of the path %s: %w", perm.Regex, path.Path, err)
+			}
+			var mode int64
+			if _, err := fmt.Sscanf(perm.Mode, "%o", &mode); err != nil {
+				return fmt.Errorf("Invalid mode %q of the path %s: %w", perm.Mode, path.Path, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package types
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// Stdio is the filename designating the standard input, when a file
+// is read, or the standard output, when a file is written. This
+// allows to use nix2container in pipelines, without temporary files.
+const Stdio = "-"
+
+// ReadFile reads the file filename, or the standard input if
+// filename is "-".
+func ReadFile(filename string) ([]byte, error) {
+	if filename == Stdio {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	return ioutil.ReadFile(filename)
+}
+
+// WriteFile writes content to the file filename, or to the standard
+// output if filename is "-".
+func WriteFile(filename string, content []byte) error {
+	if filename == Stdio {
+		_, err := os.Stdout.Write(content)
+		return err
+	}
+	return ioutil.WriteFile(filename, content, 0666)
+}
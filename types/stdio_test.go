@@ -0,0 +1,51 @@
+package types
+
+import (
+	"os"
+	"testing"
+)
+
+func TestReadWriteStdio(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	err = WriteFile(Stdio, []byte("[]\n"))
+	os.Stdout = stdout
+	w.Close()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = stdin }()
+	content, err := ReadFile(Stdio)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if string(content) != "[]\n" {
+		t.Fatalf("Content should be '%#v' (while it is %#v)", "[]\n", string(content))
+	}
+}
+
+func TestNewLayersFromStdin(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	w.Write([]byte(`[{"digest": "sha256:abc", "diff_ids": "sha256:def", "mediatype": "application/vnd.oci.image.layer.v1.tar"}]`))
+	w.Close()
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = stdin }()
+	layers, err := NewLayersFromFile(Stdio)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(layers) != 1 || layers[0].Digest != "sha256:abc" {
+		t.Fatalf("One layer should be read from the standard input (while layers are %#v)", layers)
+	}
+}
@@ -1,16 +1,71 @@
 package types
 
 import (
+	"encoding/base64"
 	"encoding/json"
-	"io/ioutil"
-	"os"
+	"fmt"
 
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 type Image struct {
+	Version     int            `json:"version"`
 	ImageConfig v1.ImageConfig `json:"image-config"`
 	Layers      []Layer        `json:"layers"`
+	// The platform of the image, linux/amd64 if not set
+	Architecture string `json:"architecture,omitempty"`
+	OS           string `json:"os,omitempty"`
+	// The Nix inputs the image has been built from, recorded as
+	// annotations of the image manifest
+	Provenance *Provenance `json:"provenance,omitempty"`
+	// The manifest this image is attached to, as a referrer (such
+	// as a debug variant of a primary image)
+	Subject *v1.Descriptor `json:"subject,omitempty"`
+	// The creation date of the image, as a RFC3339 date, set in
+	// the created field of the image configuration. It is omitted
+	// from the configuration if not set.
+	Created string `json:"created,omitempty"`
+	// The version and the features of the operating system, such
+	// as 10.0.17763.1234 for a Windows image
+	OSVersion  string   `json:"os-version,omitempty"`
+	OSFeatures []string `json:"os-features,omitempty"`
+	// Fields of the configuration not supported by ImageConfig,
+	// such as ArgsEscaped, preserved from Windows base images
+	ExtraConfig map[string]json.RawMessage `json:"extra-config,omitempty"`
+	// History entries without layer, such as the ENV and LABEL
+	// instructions of a Dockerfile, added as empty_layer entries
+	// after the history entries of the layers
+	History []History `json:"history,omitempty"`
+}
+
+// History is a history entry of the image configuration which is not
+// associated to a layer.
+type History struct {
+	// The RFC3339 creation date of the entry, the creation date of
+	// the image if it is not set
+	Created   string `json:"created,omitempty"`
+	CreatedBy string `json:"created-by,omitempty"`
+	Author    string `json:"author,omitempty"`
+	Comment   string `json:"comment,omitempty"`
+}
+
+// RebuildInstructions describe how to build an image again, with
+// nix build FLAKE#ATTRIBUTE --system SYSTEM.
+type RebuildInstructions struct {
+	// A locked flake reference, such as github:owner/repo/rev
+	Flake     string `json:"flake"`
+	Attribute string `json:"attribute"`
+	System    string `json:"system"`
+}
+
+// Provenance describes the Nix inputs of an image.
+type Provenance struct {
+	// The flake reference, such as github:owner/repo/rev
+	FlakeRef string `json:"flake-ref,omitempty"`
+	// The revision of nixpkgs
+	NixpkgsRevision string `json:"nixpkgs-revision,omitempty"`
+	// The store paths of the top-level derivations
+	Derivations []string `json:"derivations,omitempty"`
 }
 
 type Rewrite struct {
@@ -34,6 +89,11 @@ type Perm struct {
 	Regex string `json:"regex"`
 	// Octal representation of file permissions
 	Mode  string `json:"mode"`
+	// The owner names of the matching files, overriding the
+	// names of the path options. An empty name only keeps the
+	// numeric owner.
+	Uname *string `json:"uname,omitempty"`
+	Gname *string `json:"gname,omitempty"`
 }
 
 type PermPath struct {
@@ -41,11 +101,170 @@ type PermPath struct {
 	Regex string `json:"regex"`
 	// Octal representation of file permissions
 	Mode  string `json:"mode"`
+	Uname *string `json:"uname,omitempty"`
+	Gname *string `json:"gname,omitempty"`
 }
 
 type PathOptions struct {
 	Rewrite Rewrite `json:"rewrite,omitempty"`
 	Perms []Perm `json:"perms,omitempty"`
+	// Clear the setuid, setgid and sticky bits of all files. Perms
+	// are applied after, allowing to explicitly set them on some
+	// files.
+	StripSpecialBits bool `json:"strip-special-bits,omitempty"`
+	// Octal representation of permission bits cleared on all
+	// files. Perms are applied after.
+	Umask string `json:"umask,omitempty"`
+	// If set, the leading slashes of file names are replaced by
+	// this prefix, for instance "/" to root all entries or "" to
+	// get relative entries (nix/store/...). Otherwise, file names
+	// are kept as they are.
+	Prefix *string `json:"prefix,omitempty"`
+	// How the POSIX ACLs of files are handled: strip (default, with
+	// a warning), preserve (as xattrs of the archive entries) or
+	// error.
+	ACLs string `json:"acls,omitempty"`
+	// The version of the archive serialization (header format and
+	// entry ordering), which is the latest one if not set. Pinning
+	// it keeps layer digests stable across nix2container upgrades.
+	TarFormat string `json:"tar-format,omitempty"`
+	// Store the holes of files (runs of zero blocks) as PAX sparse
+	// records instead of expanding them, which keeps archives of
+	// pre-allocated files small.
+	Sparse bool `json:"sparse,omitempty"`
+	// How unsafe file names (with control characters, invalid
+	// UTF-8, . or .. elements or not in the NFC form) and symlinks
+	// escaping the archive root are handled: keep (default),
+	// reject or sanitize.
+	NamePolicy string `json:"name-policy,omitempty"`
+	// How symlinks with an absolute target, such as
+	// /nix/store/...-bash/bin/bash, are handled: keep (default),
+	// reject, or relativize, which rewrites the target relative to
+	// the symlink so that extractors can not resolve it on the
+	// host.
+	AbsoluteSymlinks string `json:"absolute-symlinks,omitempty"`
+	// The owner names of the archive entries, which are "root" if
+	// they are not set. An empty name only keeps the numeric owner
+	// (0:0), as expected by some consumers, while others need
+	// names present in the /etc/passwd of the image.
+	Uname *string `json:"uname,omitempty"`
+	Gname *string `json:"gname,omitempty"`
+	// How a file overriding a file of the layer with a different
+	// header is handled: strict (default) fails, relaxed only fails
+	// if their type, link target or content differ.
+	Conflicts string `json:"conflicts,omitempty"`
+}
+
+// Versions of the archive serialization. The serialization of a
+// version never changes: a new version is added instead, and the
+// options it introduces are rejected with the previous versions (see
+// CheckTarFormat).
+const (
+	// Entries are walked in lexical order, with USTAR headers, or
+	// PAX headers if a field can not be represented in USTAR, and
+	// without access and change times. Owners are root:root and file
+	// names are kept as they are. The store paths of a layer are
+	// archived in the order they are listed.
+	TarFormatV1 = "v1"
+	// The v1 serialization extended with the preserved POSIX ACLs
+	// (as PAX xattr records), sparse files (as PAX sparse records),
+	// custom owner names, the name policies and the absolute
+	// symlinks policies. Perms rules are
+	// matched with their own regex, while v1 matches them with the
+	// rewrite regex of the path. The store paths of a layer are
+	// sorted.
+	TarFormatV2 = "v2"
+	// The version used when it is not pinned
+	TarFormatLatest = TarFormatV2
+)
+
+// CheckTarFormat returns an error if the tar format of the options of
+// path is unknown, or if options introduced by a later version are
+// used with it.
+func CheckTarFormat(path string, opts PathOptions) error {
+	switch opts.TarFormat {
+	case "", TarFormatV2:
+		return nil
+	case TarFormatV1:
+	default:
+		return fmt.Errorf("Unknown tar format %q of the path %s (the supported versions are %s and %s)", opts.TarFormat, path, TarFormatV1, TarFormatV2)
+	}
+	ownerNames := opts.Uname != nil || opts.Gname != nil
+	for _, perm := range opts.Perms {
+		ownerNames = ownerNames || perm.Uname != nil || perm.Gname != nil
+	}
+	var option string
+	switch {
+	case opts.ACLs == ACLsPreserve:
+		option = "acls preserve"
+	case opts.Sparse:
+		option = "sparse"
+	case ownerNames:
+		option = "uname and gname"
+	case opts.NamePolicy != "" && opts.NamePolicy != NamePolicyKeep:
+		option = "name-policy " + opts.NamePolicy
+	case opts.AbsoluteSymlinks != "" && opts.AbsoluteSymlinks != AbsoluteSymlinksKeep:
+		option = "absolute-symlinks " + opts.AbsoluteSymlinks
+	default:
+		return nil
+	}
+	return fmt.Errorf("The option %s of the path %s requires the tar format %s (while it is %s)", option, path, TarFormatV2, opts.TarFormat)
+}
+
+// Policies of unsafe file names.
+const (
+	NamePolicyKeep     = "keep"
+	NamePolicyReject   = "reject"
+	NamePolicySanitize = "sanitize"
+)
+
+// Conflict checks of the files overriding files of the layer.
+const (
+	ConflictsStrict  = "strict"
+	ConflictsRelaxed = "relaxed"
+)
+
+// Policies of the symlinks with an absolute target.
+const (
+	AbsoluteSymlinksKeep       = "keep"
+	AbsoluteSymlinksReject     = "reject"
+	AbsoluteSymlinksRelativize = "relativize"
+)
+
+// Policies of the POSIX ACLs of files.
+const (
+	ACLsStrip    = "strip"
+	ACLsPreserve = "preserve"
+	ACLsError    = "error"
+)
+
+// Validate returns an error if a policy of the options of path is
+// unknown or not supported by its tar format.
+func (opts PathOptions) Validate(path string) error {
+	if err := CheckTarFormat(path, opts); err != nil {
+		return err
+	}
+	switch opts.ACLs {
+	case "", ACLsStrip, ACLsPreserve, ACLsError:
+	default:
+		return fmt.Errorf("Invalid ACLs policy %q of the path %s (strip, preserve or error)", opts.ACLs, path)
+	}
+	switch opts.NamePolicy {
+	case "", NamePolicyKeep, NamePolicyReject, NamePolicySanitize:
+	default:
+		return fmt.Errorf("Invalid name policy %q of the path %s (keep, reject or sanitize)", opts.NamePolicy, path)
+	}
+	switch opts.AbsoluteSymlinks {
+	case "", AbsoluteSymlinksKeep, AbsoluteSymlinksReject, AbsoluteSymlinksRelativize:
+	default:
+		return fmt.Errorf("Invalid absolute symlinks policy %q of the path %s (keep, reject or relativize)", opts.AbsoluteSymlinks, path)
+	}
+	switch opts.Conflicts {
+	case "", ConflictsStrict, ConflictsRelaxed:
+	default:
+		return fmt.Errorf("Invalid conflict check %q of the path %s (strict or relaxed)", opts.Conflicts, path)
+	}
+	return nil
 }
 
 type Path struct {
@@ -55,7 +274,61 @@ type Path struct {
 
 type Paths []Path
 
+// File is a file whose content is directly described in the
+// JSON file. This is used to generate small files without
+// requiring a store path.
+type File struct {
+	// The location of the file in the image
+	Path    string `json:"path"`
+	Content string `json:"content"`
+	// Octal representation of file permissions
+	Mode    string `json:"mode"`
+	// The encoding of the content: empty for a literal string, or
+	// base64 for binary content
+	Encoding string `json:"encoding,omitempty"`
+	// The owner of the file, root by default
+	Uid int `json:"uid,omitempty"`
+	Gid int `json:"gid,omitempty"`
+}
+
+// Encodings of the content of files.
+const FileEncodingBase64 = "base64"
+
+// Bytes returns the content of the file, decoded according to its
+// encoding.
+func (f File) Bytes() ([]byte, error) {
+	switch f.Encoding {
+	case "":
+		return []byte(f.Content), nil
+	case FileEncodingBase64:
+		return base64.StdEncoding.DecodeString(f.Content)
+	default:
+		return nil, fmt.Errorf("Unsupported encoding %q (base64 or empty)", f.Encoding)
+	}
+}
+
+// EntrypointWrapper describes a script wrapping the image entrypoint.
+// The script sets default values of environment variables and execs
+// the entrypoint, optionally through an init process (such as tini)
+// and a chain of commands.
+type EntrypointWrapper struct {
+	// The location of the generated script in the image (defaults
+	// to /entrypoint)
+	Path string `json:"path,omitempty"`
+	// The shell interpreting the script
+	Shell string `json:"shell"`
+	// An init process used as PID 1, forwarding signals to the
+	// entrypoint. It is invoked as INIT -- COMMAND ARGS...
+	Init string `json:"init,omitempty"`
+	// Default values of environment variables, only set when they
+	// are not already defined
+	Env map[string]string `json:"env,omitempty"`
+	// A command prefixed to the entrypoint, such as ["chpst", "-u", "nobody"]
+	Exec []string `json:"exec,omitempty"`
+}
+
 type Layer struct {
+	Version int `json:"version"`
 	Digest string `json:"digest"`
 	Size int64 `json:"size"`
 	DiffIDs string `json:"diff_ids"`
@@ -64,16 +337,56 @@ type Layer struct {
 	// https://github.com/opencontainers/image-spec/blob/8b9d41f48198a7d6d0a5c1a12dc2d1f7f47fc97f/specs-go/v1/mediatype.go
 	MediaType string `json:"mediatype"`
 	LayerPath string `json:"layer-path,omitempty"`
+	// Files generated from their description, instead of being
+	// read from store paths
+	Files []File `json:"files,omitempty"`
+	// The compression applied on the archive generated from Paths
+	// (gzip, zstd or zstd:chunked). It is empty if the archive is
+	// not compressed.
+	Compression string `json:"compression,omitempty"`
+	// The external command doing the compression, such as
+	// ["pigz", "-n"]. It reads the archive on its standard input
+	// and writes the compressed stream on its standard output.
+	CompressionCommand []string `json:"compression-command,omitempty"`
+	// Annotations of the layer descriptor in the image manifest
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// The layer blob is never generated: it is only referenced by
+	// its digest, size and diff_ids and has to be already present
+	// on the destination.
+	Pinned bool `json:"pinned,omitempty"`
+	// A JSON file containing the FileIndex of the layer archive
+	FileIndex string `json:"file-index,omitempty"`
+	// URLs the layer blob can be downloaded from, such as a CDN,
+	// added to the layer descriptor of the image manifest. The
+	// blob is still validated by its digest.
+	URLs []string `json:"urls,omitempty"`
+	// The creation date of the layer, as a RFC3339 date, set in
+	// the history entry of the layer in the image configuration
+	Created string `json:"created,omitempty"`
+	// The author and the command of the history entry of the
+	// layer, "nix2container" by default
+	Author    string `json:"author,omitempty"`
+	CreatedBy string `json:"created-by,omitempty"`
+	// The size budget of the component the layer belongs to,
+	// enforced when the image is built
+	Budget *LayerBudget `json:"budget,omitempty"`
+	// The position of the layer in the image: layers are sorted by
+	// their order, layers with a higher order being above
+	Order int `json:"order,omitempty"`
+}
+
+// LayerBudget limits the size of the layers of a component, such as
+// the layers built by a buildLayer call. Layers having the same
+// budget name share the budget.
+type LayerBudget struct {
+	Name string `json:"name"`
+	// The maximal size in bytes of the layer blobs of the component
+	MaxSize int64 `json:"max-size"`
 }
 
 func NewLayersFromFile(filename string) ([]Layer, error) {
 	var layers []Layer
-	file, err := os.Open(filename)
-	defer file.Close()
-	if err != nil {
-		return nil, err
-	}
-	content, err := ioutil.ReadAll(file)
+	content, err := ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
@@ -81,5 +394,10 @@ func NewLayersFromFile(filename string) ([]Layer, error) {
 	if err != nil {
 		return nil, err
 	}
+	for i := range layers {
+		if err := layers[i].Migrate(); err != nil {
+			return nil, err
+		}
+	}
 	return layers, nil
 }
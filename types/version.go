@@ -0,0 +1,108 @@
+package types
+
+import "fmt"
+
+// Versions of the image and layer JSON formats written by this
+// version of nix2container. Files written before the introduction of
+// the version field are decoded with the version 0.
+//
+// When a field changing the generated image is added, the version has
+// to be bumped: older nix2container versions would ignore this field
+// and silently generate another image, while they reject files of
+// newer versions. If the previous behavior is not the default value
+// of the field, a migration from the previous version has to be added
+// to the Migrate methods, so that files generated by older
+// nix2container versions can still be consumed.
+//
+// Image versions:
+//   - 1: the version field
+//   - 2: the architecture and the os
+//   - 3: the provenance
+//   - 4: the subject
+//   - 5: the created date
+//   - 6: the os-version, os-features and extra-config
+//   - 7: the history
+//
+// Layer versions:
+//   - 1: the version field
+//   - 2: the strip-special-bits and umask path options
+//   - 3: the files generated from their description
+//   - 4: the compression and the annotations
+//   - 5: the prefix path option
+//   - 6: pinned layers
+//   - 7: the URLs of the layer descriptor
+//   - 8: the compression command
+//   - 9: the acls path option
+//   - 10: the tar-format path option
+//   - 11: the sparse path option
+//   - 12: the created date
+//   - 13: the size budget
+//   - 14: the name-policy and absolute-symlinks path options
+//   - 15: the encoding, uid and gid of the generated files
+//   - 16: the uname and gname path and perm options
+//   - 17: the author and created-by of the history entry
+//   - 18: the order of the layer
+const (
+	ImageVersion = 7
+	LayerVersion = 18
+	IndexVersion = 1
+)
+
+// Migrate upgrades an image decoded from an older format version to
+// the current version. An error is returned if the image has been
+// written by a newer, unsupported, version of nix2container.
+func (image *Image) Migrate() error {
+	if image.Version > ImageVersion {
+		return fmt.Errorf("The image version %d is not supported (the maximum supported version is %d): nix2container needs to be upgraded", image.Version, ImageVersion)
+	}
+	// The fields added by each version default to the behavior of
+	// the previous versions.
+	image.Version = ImageVersion
+	for i := range image.Layers {
+		if err := image.Layers[i].Migrate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Migrate upgrades a layer decoded from an older format version to
+// the current version. An error is returned if the layer has been
+// written by a newer, unsupported, version of nix2container.
+func (layer *Layer) Migrate() error {
+	if layer.Version > LayerVersion {
+		return fmt.Errorf("The layer %s version %d is not supported (the maximum supported version is %d): nix2container needs to be upgraded", layer.Digest, layer.Version, LayerVersion)
+	}
+	// The fields added by each version default to the behavior of
+	// the previous versions, except the tar format: the paths of
+	// layers written before it are archived with the v1
+	// serialization, which applies perms rules to all files of the
+	// paths without rewrite.
+	if layer.Version < 10 {
+		for i := range layer.Paths {
+			var options PathOptions
+			if layer.Paths[i].Options != nil {
+				options = *layer.Paths[i].Options
+			}
+			options.TarFormat = TarFormatV1
+			layer.Paths[i].Options = &options
+		}
+	}
+	layer.Version = LayerVersion
+	return nil
+}
+
+// Migrate upgrades an index decoded from an older format version to
+// the current version. An error is returned if the index has been
+// written by a newer, unsupported, version of nix2container.
+func (index *Index) Migrate() error {
+	if index.Version > IndexVersion {
+		return fmt.Errorf("The index version %d is not supported (the maximum supported version is %d): nix2container needs to be upgraded", index.Version, IndexVersion)
+	}
+	for i := range index.Manifests {
+		if err := index.Manifests[i].Image.Migrate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
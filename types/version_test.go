@@ -0,0 +1,75 @@
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	image := Image{Layers: []Layer{{Digest: "sha256:digest"}}}
+	if err := image.Migrate(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if image.Version != ImageVersion || image.Layers[0].Version != LayerVersion {
+		t.Fatalf("The image should be migrated to the version %d and its layer to the version %d (while they are %d and %d)", ImageVersion, LayerVersion, image.Version, image.Layers[0].Version)
+	}
+
+	image = Image{Version: ImageVersion + 1}
+	if err := image.Migrate(); err == nil {
+		t.Fatalf("The image version %d should be rejected", ImageVersion+1)
+	}
+	image = Image{Version: ImageVersion, Layers: []Layer{{Version: LayerVersion + 1}}}
+	if err := image.Migrate(); err == nil {
+		t.Fatalf("The layer version %d should be rejected", LayerVersion+1)
+	}
+	index := Index{Version: IndexVersion + 1}
+	if err := index.Migrate(); err == nil {
+		t.Fatalf("The index version %d should be rejected", IndexVersion+1)
+	}
+	index = Index{Version: IndexVersion, Manifests: []IndexManifest{{Image: Image{Version: ImageVersion + 1}}}}
+	if err := index.Migrate(); err == nil {
+		t.Fatalf("The image version %d of the index should be rejected", ImageVersion+1)
+	}
+
+	content := []byte(fmt.Sprintf(`{"version": %d, "layers": []}`, ImageVersion))
+	if _, err := ValidateImage(content); err != nil {
+		t.Fatalf("%v", err)
+	}
+	content = []byte(fmt.Sprintf(`{"version": %d, "layers": []}`, ImageVersion+1))
+	if _, err := ValidateImage(content); err == nil {
+		t.Fatalf("The image version %d should be rejected by the validation", ImageVersion+1)
+	}
+	layer := `[{"version": %d, "digest": "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", "diff_ids": "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", "mediatype": "application/vnd.oci.image.layer.v1.tar"}]`
+	if _, err := ValidateLayers([]byte(fmt.Sprintf(layer, LayerVersion))); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := ValidateLayers([]byte(fmt.Sprintf(layer, LayerVersion+1))); err == nil {
+		t.Fatalf("The layer version %d should be rejected by the validation", LayerVersion+1)
+	}
+}
+
+func TestSchemaVersions(t *testing.T) {
+	for _, schema := range []struct {
+		name    string
+		content []byte
+		version int
+	}{
+		{"image", ImageSchema(), ImageVersion},
+		{"layer", LayerSchema(), LayerVersion},
+	} {
+		var s struct {
+			Properties struct {
+				Version struct {
+					Maximum int `json:"maximum"`
+				} `json:"version"`
+			} `json:"properties"`
+		}
+		if err := json.Unmarshal(schema.content, &s); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if s.Properties.Version.Maximum != schema.version {
+			t.Fatalf("The maximum version of the %s schema should be %d (while it is %d)", schema.name, schema.version, s.Properties.Version.Maximum)
+		}
+	}
+}